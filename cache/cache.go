@@ -34,22 +34,36 @@ package cache
 
 import (
 	"bytes"
+	"container/list"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 
 	"github.com/awslabs/soci-snapshotter/util/lrucache"
 	"github.com/awslabs/soci-snapshotter/util/namedmutex"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	defaultMaxLRUCacheEntry = 10
 	defaultMaxCacheFds      = 10
+
+	// defaultFreeInodesSampleInterval is the number of adds between samples
+	// of the free inodes of the cache directory while there are enough of them.
+	defaultFreeInodesSampleInterval = 64
 )
 
+// ErrLowFreeInodes is returned by Add when the filesystem backing the cache
+// directory has fewer free inodes than configured by MinFreeInodes.
+var ErrLowFreeInodes = errors.New("free inodes of cache directory below threshold")
+
+// ErrClosed is returned when reading from or writing to a cache that is already closed.
+var ErrClosed = errors.New("cache is already closed")
+
 type DirectoryCacheConfig struct {
 
 	// Number of entries of LRU cache (default: 10).
@@ -77,6 +91,12 @@ type DirectoryCacheConfig struct {
 	// Direct forcefully enables direct mode for all operation in cache.
 	// Thus operation won't use on-memory caches.
 	Direct bool
+
+	// MinFreeInodes is the minimum number of free inodes on the filesystem
+	// backing the cache directory. When free inodes drop below it, the cache
+	// is compacted, evicting the least recently used entries, and new writes
+	// are paused until enough inodes are available. 0 disables the guard.
+	MinFreeInodes uint64
 }
 
 // TODO: contents validation.
@@ -176,8 +196,14 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 		wipDirectory: wipdir,
 		bufPool:      bufPool,
 		direct:       config.Direct,
+		wipFiles:     make(map[string]struct{}),
+		entries:      list.New(),
+		entryElems:   make(map[string]*list.Element),
 	}
 	dc.syncAdd = config.SyncAdd
+	dc.minFreeInodes = config.MinFreeInodes
+	dc.statfs = unix.Statfs
+	dc.freeInodesSampleInterval = defaultFreeInodesSampleInterval
 	return dc, nil
 }
 
@@ -194,13 +220,38 @@ type directoryCache struct {
 	syncAdd bool
 	direct  bool
 
+	minFreeInodes uint64
+	statfs        func(path string, buf *unix.Statfs_t) error
+	compactMu     sync.Mutex
+	// freeInodesSampleInterval is the number of adds between samples of the free
+	// inodes while there are enough of them. They're sampled on every add otherwise.
+	freeInodesSampleInterval uint64
+	adds                     atomic.Uint64
+	lowFreeInodes            atomic.Bool
+
+	// entries are the keys of the committed entries, most recently used first.
+	// They're only tracked if minFreeInodes is set, for compaction to evict them.
+	entries    *list.List
+	entryElems map[string]*list.Element
+	entriesMu  sync.Mutex
+
+	// wipFiles tracks the files in wipDirectory that back in-flight writes.
+	wipFiles   map[string]struct{}
+	wipFilesMu sync.Mutex
+
+	// pins counts the in-progress reads and commits. Removing the cache directory
+	// on Close is deferred until they are all done, so that they never see a
+	// partially removed cache.
+	pins     int
 	closed   bool
 	closedMu sync.Mutex
 }
 
 func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
-	if dc.isClosed() {
-		return nil, fmt.Errorf("cache is already closed")
+	// The cache is pinned until the returned reader is closed.
+	unpin, ok := dc.pin()
+	if !ok {
+		return nil, ErrClosed
 	}
 
 	opt := &cacheOpt{}
@@ -215,18 +266,19 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 				ReaderAt: bytes.NewReader(b.(*bytes.Buffer).Bytes()),
 				closeFunc: func() error {
 					done()
-					return nil
+					return unpin()
 				},
 			}, nil
 		}
 
 		// Get data from disk. If the file is already opened, use it.
 		if f, done, ok := dc.fileCache.Get(key); ok {
+			dc.touchEntry(key)
 			return &reader{
 				ReaderAt: f.(*os.File),
 				closeFunc: func() error {
 					done() // file will be closed when it's evicted from the cache
-					return nil
+					return unpin()
 				},
 			}, nil
 		}
@@ -237,16 +289,19 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	//       or simply report the cache miss?
 	file, err := os.Open(dc.cachePath(key))
 	if err != nil {
-		return nil, fmt.Errorf("failed to open blob file for %q: %w", key, err)
+		return nil, errors.Join(fmt.Errorf("failed to open blob file for %q: %w", key, err), unpin())
 	}
+	dc.touchEntry(key)
 
 	// If "direct" option is specified, do not cache the file on memory.
 	// This option is useful for preventing memory cache from being polluted by data
 	// that won't be accessed immediately.
 	if dc.direct || opt.direct {
 		return &reader{
-			ReaderAt:  file,
-			closeFunc: func() error { return file.Close() },
+			ReaderAt: file,
+			closeFunc: func() error {
+				return errors.Join(file.Close(), unpin())
+			},
 		}, nil
 	}
 
@@ -256,6 +311,7 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	return &reader{
 		ReaderAt: file,
 		closeFunc: func() error {
+			defer unpin()
 			_, done, added := dc.fileCache.Add(key, file)
 			defer done() // Release it immediately. Cleaned up on eviction.
 			if !added {
@@ -268,7 +324,7 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 
 func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 	if dc.isClosed() {
-		return nil, fmt.Errorf("cache is already closed")
+		return nil, ErrClosed
 	}
 
 	opt := &cacheOpt{}
@@ -276,6 +332,10 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 		opt = o(opt)
 	}
 
+	if err := dc.checkFreeInodes(); err != nil {
+		return nil, err
+	}
+
 	wip, err := dc.wipFile(key)
 	if err != nil {
 		return nil, err
@@ -283,9 +343,14 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 	w := &writer{
 		WriteCloser: wip,
 		commitFunc: func() error {
-			if dc.isClosed() {
-				return fmt.Errorf("cache is already closed")
+			defer dc.untrackWipFile(wip.Name())
+			// Pin the cache so that the cache directory can't be removed (and
+			// recreated by MkdirAll below) while the contents are committed.
+			unpin, ok := dc.pin()
+			if !ok {
+				return ErrClosed
 			}
+			defer unpin()
 			// Commit the cache contents
 			c := dc.cachePath(key)
 			if err := os.MkdirAll(filepath.Dir(c), os.ModePerm); err != nil {
@@ -296,9 +361,14 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 				return errors.Join(allErr,
 					fmt.Errorf("failed to create cache directory %q: %w", c, err))
 			}
-			return os.Rename(wip.Name(), c)
+			if err := os.Rename(wip.Name(), c); err != nil {
+				return err
+			}
+			dc.touchEntry(key)
+			return nil
 		},
 		abortFunc: func() error {
+			defer dc.untrackWipFile(wip.Name())
 			return os.Remove(wip.Name())
 		},
 	}
@@ -316,7 +386,7 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 		commitFunc: func() error {
 			if dc.isClosed() {
 				w.Close()
-				return fmt.Errorf("cache is already closed")
+				return ErrClosed
 			}
 			cached, done, added := dc.cache.Add(key, b)
 			if !added {
@@ -358,6 +428,8 @@ func (dc *directoryCache) putBuffer(b *bytes.Buffer) {
 	dc.bufPool.Put(b)
 }
 
+// Close closes the cache and removes the cache directory. If there are
+// in-progress reads or commits, the directory is removed once they are done.
 func (dc *directoryCache) Close() error {
 	dc.closedMu.Lock()
 	defer dc.closedMu.Unlock()
@@ -365,9 +437,35 @@ func (dc *directoryCache) Close() error {
 		return nil
 	}
 	dc.closed = true
+	if dc.pins > 0 {
+		return nil
+	}
 	return os.RemoveAll(dc.directory)
 }
 
+// pin defers removing the cache directory on Close until unpin is called.
+// It returns false if the cache is already closed.
+func (dc *directoryCache) pin() (unpin func() error, ok bool) {
+	dc.closedMu.Lock()
+	defer dc.closedMu.Unlock()
+	if dc.closed {
+		return nil, false
+	}
+	dc.pins++
+	var once sync.Once
+	return func() (err error) {
+		once.Do(func() {
+			dc.closedMu.Lock()
+			defer dc.closedMu.Unlock()
+			dc.pins--
+			if dc.closed && dc.pins == 0 {
+				err = os.RemoveAll(dc.directory)
+			}
+		})
+		return err
+	}, true
+}
+
 func (dc *directoryCache) isClosed() bool {
 	dc.closedMu.Lock()
 	closed := dc.closed
@@ -380,7 +478,113 @@ func (dc *directoryCache) cachePath(key string) string {
 }
 
 func (dc *directoryCache) wipFile(key string) (*os.File, error) {
-	return os.CreateTemp(dc.wipDirectory, key+"-*")
+	f, err := os.CreateTemp(dc.wipDirectory, key+"-*")
+	if err != nil {
+		return nil, err
+	}
+	dc.wipFilesMu.Lock()
+	dc.wipFiles[f.Name()] = struct{}{}
+	dc.wipFilesMu.Unlock()
+	return f, nil
+}
+
+func (dc *directoryCache) untrackWipFile(name string) {
+	dc.wipFilesMu.Lock()
+	delete(dc.wipFiles, name)
+	dc.wipFilesMu.Unlock()
+}
+
+// checkFreeInodes returns ErrLowFreeInodes if the filesystem backing the cache
+// directory has fewer free inodes than minFreeInodes. The cache is compacted
+// before giving up so that the write can proceed if enough inodes are released.
+// While there are enough free inodes, they're only sampled every
+// freeInodesSampleInterval adds, since statfs isn't free on every span write.
+func (dc *directoryCache) checkFreeInodes() error {
+	if dc.minFreeInodes == 0 {
+		return nil
+	}
+	if !dc.lowFreeInodes.Load() && (dc.adds.Add(1)-1)%dc.freeInodesSampleInterval != 0 {
+		return nil
+	}
+	if _, ok := dc.lowInodes(); !ok {
+		dc.lowFreeInodes.Store(false)
+		return nil
+	}
+	dc.lowFreeInodes.Store(true)
+	dc.compact()
+	if _, ok := dc.lowInodes(); !ok {
+		dc.lowFreeInodes.Store(false)
+		return nil
+	}
+	return ErrLowFreeInodes
+}
+
+// lowInodes returns whether the filesystem backing the cache directory has
+// fewer free inodes than minFreeInodes, and how many inodes are missing.
+func (dc *directoryCache) lowInodes() (missing uint64, low bool) {
+	var s unix.Statfs_t
+	if err := dc.statfs(dc.directory, &s); err != nil {
+		// Don't block writes if the filesystem can't report its inode usage.
+		return 0, false
+	}
+	if free := uint64(s.Ffree); free < dc.minFreeInodes {
+		return dc.minFreeInodes - free, true
+	}
+	return 0, false
+}
+
+// compact releases inodes held by files in the wip directory that no longer
+// back an in-flight write, e.g. those left behind by a failed commit. If that
+// isn't enough, the least recently used committed entries are evicted.
+// Only one compaction runs at a time; concurrent callers return immediately.
+func (dc *directoryCache) compact() {
+	if !dc.compactMu.TryLock() {
+		return
+	}
+	defer dc.compactMu.Unlock()
+
+	if entries, err := os.ReadDir(dc.wipDirectory); err == nil {
+		dc.wipFilesMu.Lock()
+		for _, e := range entries {
+			name := filepath.Join(dc.wipDirectory, e.Name())
+			if _, ok := dc.wipFiles[name]; ok {
+				continue
+			}
+			os.Remove(name)
+		}
+		dc.wipFilesMu.Unlock()
+	}
+	if missing, low := dc.lowInodes(); low {
+		dc.evictEntries(missing)
+	}
+}
+
+// touchEntry marks the committed entry key as the most recently used.
+func (dc *directoryCache) touchEntry(key string) {
+	if dc.minFreeInodes == 0 {
+		return
+	}
+	dc.entriesMu.Lock()
+	defer dc.entriesMu.Unlock()
+	if e, ok := dc.entryElems[key]; ok {
+		dc.entries.MoveToFront(e)
+		return
+	}
+	dc.entryElems[key] = dc.entries.PushFront(key)
+}
+
+// evictEntries removes the n least recently used committed entries from disk.
+// Their files are closed once nobody reads them, which releases their inodes.
+// Entries held in memory are kept, since they don't take up inodes.
+func (dc *directoryCache) evictEntries(n uint64) {
+	dc.entriesMu.Lock()
+	defer dc.entriesMu.Unlock()
+	for ; n > 0 && dc.entries.Len() > 0; n-- {
+		key := dc.entries.Remove(dc.entries.Back()).(string)
+		delete(dc.entryElems, key)
+		os.Remove(dc.cachePath(key))
+		dc.fileCache.Remove(key)
+	}
 }
 
 func NewMemoryCache() BlobCache {
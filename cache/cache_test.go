@@ -40,9 +40,17 @@ package cache
 
 import (
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -80,6 +88,214 @@ func TestDirectoryCache(t *testing.T) {
 	testCache(t, "dir-with-small-mem", newCache)
 }
 
+func TestDirectoryCacheMinFreeInodes(t *testing.T) {
+	const minFreeInodes = 10
+
+	tmp := t.TempDir()
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+		SyncAdd:       true,
+		Direct:        true,
+		MinFreeInodes: minFreeInodes,
+	})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	defer c.Close()
+	dc := c.(*directoryCache)
+	// Sample free inodes on every add.
+	dc.freeInodesSampleInterval = 1
+
+	// The fake filesystem has totalInodes free inodes minus one for each
+	// file in the cache directory, including the wip directory.
+	var totalInodes atomic.Uint64
+	dc.statfs = func(path string, buf *unix.Statfs_t) error {
+		var files uint64
+		err := filepath.WalkDir(tmp, func(_ string, d os.DirEntry, err error) error {
+			if err == nil && d.Type().IsRegular() {
+				files++
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		buf.Ffree = totalInodes.Load() - files
+		return nil
+	}
+	addStaleWipFile := func(t *testing.T) string {
+		f, err := os.CreateTemp(dc.wipDirectory, "stale-*")
+		if err != nil {
+			t.Fatalf("failed to create stale wip file: %v", err)
+		}
+		f.Close()
+		return f.Name()
+	}
+	add := func(key string) error {
+		w, err := c.Add(key)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		if _, err := w.Write([]byte(sampleData)); err != nil {
+			return err
+		}
+		return w.Commit()
+	}
+
+	t.Run("writes pause when compaction can't free enough inodes", func(t *testing.T) {
+		totalInodes.Store(minFreeInodes - 1)
+		stale := addStaleWipFile(t)
+		if err := add("paused"); !errors.Is(err, ErrLowFreeInodes) {
+			t.Fatalf("expected %v; got %v", ErrLowFreeInodes, err)
+		}
+		if _, err := os.Stat(stale); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected compaction to remove stale wip file; got %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(tmp, "paused")); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected paused write not to be cached; got %v", err)
+		}
+	})
+
+	t.Run("writes proceed when compaction frees enough inodes", func(t *testing.T) {
+		totalInodes.Store(minFreeInodes)
+		stale := addStaleWipFile(t)
+		if err := add("compacted"); err != nil {
+			t.Fatalf("failed to add after compaction: %v", err)
+		}
+		if _, err := os.Stat(stale); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected compaction to remove stale wip file; got %v", err)
+		}
+		testBlob(t, c, "compacted", 0, sampleData)
+	})
+
+	t.Run("writes resume when inodes are available", func(t *testing.T) {
+		totalInodes.Store(minFreeInodes - 1)
+		if err := add("resumed"); !errors.Is(err, ErrLowFreeInodes) {
+			t.Fatalf("expected %v; got %v", ErrLowFreeInodes, err)
+		}
+		totalInodes.Store(minFreeInodes * 2)
+		if err := add("resumed"); err != nil {
+			t.Fatalf("failed to add after inodes became available: %v", err)
+		}
+		testBlob(t, c, "resumed", 0, sampleData)
+	})
+
+	t.Run("compaction evicts least recently used entries", func(t *testing.T) {
+		// "resumed" takes up one inode, and so does each new entry,
+		// so only the last entry needs another one to be evicted.
+		totalInodes.Store(minFreeInodes + 2)
+		for _, key := range []string{"old", "new"} {
+			if err := add(key); err != nil {
+				t.Fatalf("failed to add %q: %v", key, err)
+			}
+		}
+		testBlob(t, c, "resumed", 0, sampleData)
+		if err := add("evicting"); err != nil {
+			t.Fatalf("failed to add after evicting an entry: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(tmp, "old")); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected least recently used entry to be evicted; got %v", err)
+		}
+		for _, key := range []string{"new", "resumed", "evicting"} {
+			testBlob(t, c, key, 0, sampleData)
+		}
+	})
+}
+
+func TestDirectoryCacheReadsRacingClose(t *testing.T) {
+	const (
+		spans   = 8
+		readers = 8
+		rounds  = 50
+	)
+
+	for round := range rounds {
+		dir := filepath.Join(t.TempDir(), "cache")
+		c, err := NewDirectoryCache(dir, DirectoryCacheConfig{
+			MaxLRUCacheEntry: 1,
+			MaxCacheFds:      1,
+			SyncAdd:          true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		for i := range spans {
+			sample := fmt.Sprintf("span-%d-%s", i, sampleData)
+			w, err := c.Add(digestFor(sample))
+			if err != nil {
+				t.Fatalf("failed to add span %d: %v", i, err)
+			}
+			if _, err := w.Write([]byte(sample)); err != nil {
+				t.Fatalf("failed to write span %d: %v", i, err)
+			}
+			if err := w.Commit(); err != nil {
+				t.Fatalf("failed to commit span %d: %v", i, err)
+			}
+			w.Close()
+		}
+
+		// Readers hammer the same spans until the cache is closed. Every read that
+		// got a reader must succeed, even if the cache is closed while it's in progress.
+		var (
+			wg    sync.WaitGroup
+			start = make(chan struct{})
+			errs  = make(chan error, readers)
+		)
+		for r := range readers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				for i := 0; ; i++ {
+					sample := fmt.Sprintf("span-%d-%s", (r+i)%spans, sampleData)
+					var opts []Option
+					if i%2 == 0 {
+						opts = append(opts, Direct())
+					}
+					rd, err := c.Get(digestFor(sample), opts...)
+					if errors.Is(err, ErrClosed) {
+						return
+					}
+					if err != nil {
+						errs <- fmt.Errorf("failed to get span: %w", err)
+						return
+					}
+					p := make([]byte, len(sample))
+					n, err := rd.ReadAt(p, 0)
+					closeErr := rd.Close()
+					if err != nil && err != io.EOF {
+						errs <- fmt.Errorf("failed to read span: %w", err)
+						return
+					}
+					if string(p[:n]) != sample {
+						errs <- fmt.Errorf("read %q; want %q", p[:n], sample)
+						return
+					}
+					if closeErr != nil {
+						errs <- fmt.Errorf("failed to close reader: %w", closeErr)
+						return
+					}
+				}
+			}()
+		}
+		close(start)
+		time.Sleep(time.Duration(round%5) * time.Millisecond)
+		if err := c.Close(); err != nil {
+			t.Fatalf("failed to close cache: %v", err)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("round %d: %v", round, err)
+		}
+
+		// The cache directory is removed once the last read is done.
+		if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("round %d: expected cache directory to be removed; got %v", round, err)
+		}
+	}
+}
+
 func TestMemoryCache(t *testing.T) {
 	testCache(t, "memory", func(*testing.T) BlobCache { return NewMemoryCache() })
 }
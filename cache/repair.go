@@ -0,0 +1,105 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrRepairIncomplete is returned by Repair when it runs out of time before
+// all entries of the cache are checked.
+var ErrRepairIncomplete = errors.New("cache repair did not complete before its deadline")
+
+// RepairStats reports what Repair did to a cache.
+type RepairStats struct {
+	// RemovedWipFiles is the number of files of interrupted writes that were removed.
+	RemovedWipFiles int
+	// VerifiedEntries is the number of entries that were verified.
+	VerifiedEntries int
+	// RemovedEntries is the number of entries that failed verification and were removed.
+	RemovedEntries int
+}
+
+// Repair brings the directory cache at directory back to a consistent state
+// before it is opened with NewDirectoryCache, e.g. after the snapshotter crashed.
+// The cache directory is its own index, so an entry exists if and only if its
+// file does. Files of writes that were interrupted before being committed are
+// removed, and so are entries for which verify returns false, e.g. because they
+// were truncated by a power loss. If verify is nil, entries aren't verified.
+//
+// Repair stops checking entries at deadline and returns ErrRepairIncomplete,
+// leaving the entries it didn't get to as they are.
+func Repair(directory string, deadline time.Time, verify func(key string, r io.Reader) bool) (RepairStats, error) {
+	var stats RepairStats
+	wipdir := filepath.Join(directory, "wip")
+	wipEntries, err := os.ReadDir(wipdir)
+	if err != nil && !os.IsNotExist(err) {
+		return stats, err
+	}
+	// No write is in flight before the cache is opened.
+	for _, e := range wipEntries {
+		if err := os.RemoveAll(filepath.Join(wipdir, e.Name())); err != nil {
+			return stats, err
+		}
+		stats.RemovedWipFiles++
+	}
+	if verify == nil {
+		return stats, nil
+	}
+
+	err = filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == directory {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if path == wipdir {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrRepairIncomplete
+		}
+		key, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		ok := verify(key, f)
+		f.Close()
+		stats.VerifiedEntries++
+		if !ok {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			stats.RemovedEntries++
+		}
+		return nil
+	})
+	return stats, err
+}
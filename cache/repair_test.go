@@ -0,0 +1,94 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRepair(t *testing.T) {
+	// verifyDigest checks that the contents of an entry match its key, like the
+	// digest of a blob does.
+	verifyDigest := func(key string, r io.Reader) bool {
+		b, err := io.ReadAll(r)
+		return err == nil && digestFor(string(b)) == filepath.Base(key)
+	}
+	var (
+		complete  = digestFor("complete")
+		truncated = digestFor("truncated")
+	)
+
+	dir := filepath.Join(t.TempDir(), "cache")
+	c, err := NewDirectoryCache(dir, DirectoryCacheConfig{Direct: true})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	for _, key := range []string{complete, truncated} {
+		w, err := c.Add(key)
+		if err != nil {
+			t.Fatalf("failed to add %s: %v", key, err)
+		}
+		content := "complete"
+		if key == truncated {
+			content = "trunc"
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatalf("failed to write %s: %v", key, err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit %s: %v", key, err)
+		}
+		w.Close()
+	}
+	// The snapshotter crashes in the middle of a write, without closing the cache.
+	if _, err := c.Add(digestFor("interrupted")); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+
+	stats, err := Repair(dir, time.Now().Add(time.Minute), verifyDigest)
+	if err != nil {
+		t.Fatalf("failed to repair cache: %v", err)
+	}
+	expected := RepairStats{RemovedWipFiles: 1, VerifiedEntries: 2, RemovedEntries: 1}
+	if stats != expected {
+		t.Fatalf("expected %+v; got %+v", expected, stats)
+	}
+
+	c, err = NewDirectoryCache(dir, DirectoryCacheConfig{Direct: true})
+	if err != nil {
+		t.Fatalf("failed to reopen cache: %v", err)
+	}
+	defer c.Close()
+	testBlob(t, c, complete, 0, "complete")
+	if _, err := c.Get(truncated); err == nil {
+		t.Fatalf("expected entry failing verification to be removed")
+	}
+	if entries, err := os.ReadDir(filepath.Join(dir, "wip")); err != nil || len(entries) != 0 {
+		t.Fatalf("expected no files of interrupted writes to be left; got %d: %v", len(entries), err)
+	}
+
+	// Repair is bounded in time, leaving entries it didn't check as they are.
+	if _, err := Repair(dir, time.Now().Add(-time.Second), func(string, io.Reader) bool { return false }); !errors.Is(err, ErrRepairIncomplete) {
+		t.Fatalf("expected %v; got %v", ErrRepairIncomplete, err)
+	}
+	testBlob(t, c, complete, 0, "complete")
+}
@@ -46,10 +46,10 @@ import (
 	"strings"
 	"time"
 
-	_ "net/http/pprof"
-
 	"github.com/awslabs/soci-snapshotter/config"
 	"github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/internal/audit"
+	"github.com/awslabs/soci-snapshotter/internal/debug"
 	"github.com/awslabs/soci-snapshotter/metadata"
 	"github.com/awslabs/soci-snapshotter/service"
 	"github.com/awslabs/soci-snapshotter/service/keychain/cri/v1"
@@ -59,6 +59,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
 	"github.com/awslabs/soci-snapshotter/service/keychain/kubeconfig"
 	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/awslabs/soci-snapshotter/snapshot"
 	"github.com/awslabs/soci-snapshotter/version"
 	"github.com/awslabs/soci-snapshotter/ztoc"
 	snapshotsapi "github.com/containerd/containerd/api/services/snapshots/v1"
@@ -198,6 +199,16 @@ func main() {
 				runtime.RegisterImageServiceServer(rpc, criServer)
 				credsFuncs = append(credsFuncs, f)
 			}
+			if cfg.AuditLogPath != "" {
+				auditLog, err := audit.NewFileEmitter(cfg.AuditLogPath)
+				if err != nil {
+					log.G(ctx).WithError(err).Fatalf("failed to configure audit log")
+					return err
+				}
+				defer auditLog.Close()
+				audit.SetEmitter(auditLog)
+			}
+
 			var fsOpts []fs.Option
 			mt, err := getMetadataStore(ctx, rootDir, *cfg)
 			if err != nil {
@@ -207,14 +218,22 @@ func main() {
 			log.G(ctx).Debug("metadata store initialized")
 
 			fsOpts = append(fsOpts, fs.WithMetadataStore(mt))
+			var stats *fs.StatsHandler
+			if cfg.DebugAddress != "" {
+				stats = fs.NewStatsHandler()
+				fsOpts = append(fsOpts, fs.WithStatsHandler(stats))
+			}
+			reloader := &service.ConfigReloader{}
 			rs, err := service.NewSociSnapshotterService(ctx, rootDir, &cfg.ServiceConfig,
-				service.WithCredsFuncs(credsFuncs...), service.WithFilesystemOptions(fsOpts...))
+				service.WithCredsFuncs(credsFuncs...), service.WithFilesystemOptions(fsOpts...),
+				service.WithConfigReloader(reloader))
 			if err != nil {
 				log.G(ctx).WithError(err).Fatalf("failed to configure snapshotter")
 				return err
 			}
+			go reloadConfigOnSIGHUP(ctx, cmd.String("config"), reloader)
 
-			cleanup, err := serve(ctx, rpc, cmd.String("address"), rs, *cfg)
+			cleanup, err := serve(ctx, rpc, cmd.String("address"), rs, stats, *cfg)
 			if err != nil {
 				log.G(ctx).WithError(err).Fatalf("failed to serve snapshotter")
 				return err
@@ -238,7 +257,7 @@ func main() {
 	cancel()
 }
 
-func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snapshotter, cfg config.Config) (bool, error) {
+func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snapshotter, stats *fs.StatsHandler, cfg config.Config) (bool, error) {
 	// Convert the snapshotter to a gRPC service,
 	snsvc := snapshotservice.FromSnapshotter(rs)
 
@@ -276,17 +295,32 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 		}()
 	}
 
-	if cfg.DebugAddress != "" {
+	l, err := debug.Listen(cfg.DebugNetwork, cfg.DebugAddress)
+	if err != nil {
+		return false, fmt.Errorf("failed to get listener for debug endpoint: %w", err)
+	}
+	if l != nil {
 		log.G(ctx).Infof("listen %q for debugging", cfg.DebugAddress)
+		cleanupFns = append(cleanupFns, l.Close)
 		go func() {
-			if err := http.ListenAndServe(cfg.DebugAddress, nil); err != nil {
-				errCh <- fmt.Errorf("error on serving a debug endpoint via socket %q: %w", addr, err)
+			handlers := debug.Handlers{
+				Stats: stats,
+				Spans: stats.SpanCacheInventory(),
+			}
+			if cfg.DebugUnfetchedFiles {
+				handlers.Unfetched = stats.UnfetchedFiles()
+			}
+			if p, ok := rs.(snapshot.Prewarmer); ok {
+				handlers.Prewarm = snapshot.NewPrewarmHandler(p)
+			}
+			if err := http.Serve(l, debug.NewHandler(handlers)); err != nil {
+				errCh <- fmt.Errorf("error on serving a debug endpoint via socket %q: %w", cfg.DebugAddress, err)
 			}
 		}()
 	}
 
 	// Listen and serve
-	l, err := listen(ctx, addr)
+	l, err = listen(ctx, addr)
 	if err != nil {
 		return false, fmt.Errorf("error on listen socket %q: %w", addr, err)
 	}
@@ -325,6 +359,31 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 	return false, nil
 }
 
+// reloadConfigOnSIGHUP reloads the registry configuration from the config file at
+// cfgPath each time the process receives SIGHUP, until ctx is done.
+func reloadConfigOnSIGHUP(ctx context.Context, cfgPath string, reloader *service.ConfigReloader) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, unix.SIGHUP)
+	defer signal.Stop(sigCh)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigCh:
+		}
+		cfg, err := config.NewConfigFromToml(cfgPath)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to reload config, keeping the current one")
+			continue
+		}
+		if err := reloader.Reload(&cfg.ServiceConfig); err != nil {
+			log.G(ctx).WithError(err).Error("failed to reload registry config")
+			continue
+		}
+		log.G(ctx).WithField("path", cfgPath).Info("reloaded registry config")
+	}
+}
+
 const (
 	dbMetadataType = "db"
 )
@@ -37,6 +37,12 @@ var infoCommand = &cli.Command{
 	Usage:       "display an index",
 	Description: "get detailed info about an index",
 	ArgsUsage:   "<digest>",
+	Flags: []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "metadata",
+			Usage: "display the build-time metadata of the index, e.g. its span size and zTOC versions, instead of the index",
+		},
+	},
 	Action: func(ctx context.Context, cmd *cli.Command) error {
 		ctx, cancel := internal.AppContext(ctx, cmd)
 		defer cancel()
@@ -64,6 +70,18 @@ var infoCommand = &cli.Command{
 			return err
 		}
 
+		if cmd.Bool("metadata") {
+			md, err := soci.DescribeIndex(ctx, store, v1.Descriptor{Digest: digest})
+			if err != nil {
+				return err
+			}
+			b, err := json.Marshal(md)
+			if err != nil {
+				return err
+			}
+			return prettyPrintJSON(b)
+		}
+
 		reader, err := store.Fetch(ctx, v1.Descriptor{Digest: digest})
 		if err != nil {
 			return err
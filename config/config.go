@@ -66,9 +66,20 @@ type Config struct {
 	// NoPrometheus is a flag to disable the emission of the metrics
 	NoPrometheus bool `toml:"no_prometheus"`
 
-	// DebugAddress is a Unix domain socket address where the snapshotter exposes /debug/ endpoints.
+	// DebugAddress is the address where the snapshotter exposes /debug/ endpoints.
 	DebugAddress string `toml:"debug_address"`
 
+	// DebugNetwork is the type of network for the debug endpoints (tcp or unix)
+	DebugNetwork string `toml:"debug_network"`
+
+	// DebugUnfetchedFiles enables the /debug/unfetched endpoint listing the files of
+	// mounted layers that aren't fetched yet.
+	DebugUnfetchedFiles bool `toml:"debug_unfetched_files"`
+
+	// AuditLogPath is the file where fetch retries and registry host failovers are
+	// recorded as JSON audit records. If empty, no audit records are written.
+	AuditLogPath string `toml:"audit_log_path"`
+
 	// MetadataStore is the type of the metadata store to use.
 	MetadataStore string `toml:"metadata_store"`
 
@@ -129,6 +140,9 @@ func parseRootConfig(cfg *Config) error {
 	if cfg.MetricsNetwork == "" {
 		cfg.MetricsNetwork = defaultMetricsNetwork
 	}
+	if cfg.DebugNetwork == "" {
+		cfg.DebugNetwork = defaultDebugNetwork
+	}
 	if cfg.MetadataStore == "" {
 		cfg.MetadataStore = defaultMetadataStore
 	}
@@ -53,6 +53,16 @@ func TestConfigDefaults(t *testing.T) {
 			expected: defaultMetricsNetwork,
 			actual:   cfg.MetricsNetwork,
 		},
+		{
+			name:     "debug network",
+			expected: defaultDebugNetwork,
+			actual:   cfg.DebugNetwork,
+		},
+		{
+			name:     "cache repair timeout",
+			expected: int64(defaultCacheRepairTimeoutSec),
+			actual:   cfg.DirectoryCacheConfig.RepairTimeoutSec,
+		},
 		{
 			name:     "metadata store",
 			expected: defaultMetadataStore,
@@ -68,6 +78,11 @@ func TestConfigDefaults(t *testing.T) {
 			expected: int64(defaultMountTimeoutSec),
 			actual:   cfg.MountTimeoutSec,
 		},
+		{
+			name:     "host failover timeout",
+			expected: int64(defaultHostFailoverTimeoutMsec),
+			actual:   cfg.HostFailoverTimeoutMsec,
+		},
 		{
 			name:     "fuse metric emit wait duration",
 			expected: int64(defaultFuseMetricsEmitWaitDurationSec),
@@ -78,6 +93,11 @@ func TestConfigDefaults(t *testing.T) {
 			expected: int64(defaultMaxConcurrency),
 			actual:   cfg.MaxConcurrency,
 		},
+		{
+			name:     "max concurrency override ceiling",
+			expected: int64(defaultMaxConcurrencyOverrideCeiling),
+			actual:   cfg.MaxConcurrencyOverrideCeiling,
+		},
 		{
 			name:     "fuse attr timeout",
 			expected: int64(defaultFuseTimeoutSec),
@@ -98,6 +118,26 @@ func TestConfigDefaults(t *testing.T) {
 			expected: true,
 			actual:   cfg.FSConfig.DirectoryCacheConfig.Direct,
 		},
+		{
+			name:     "directory cache min free inodes",
+			expected: uint64(0),
+			actual:   cfg.FSConfig.DirectoryCacheConfig.MinFreeInodes,
+		},
+		{
+			name:     "mirror discovery refresh interval",
+			expected: int64(defaultMirrorDiscoveryRefreshIntervalSec),
+			actual:   cfg.ResolverConfig.MirrorDiscovery.RefreshIntervalSec,
+		},
+		{
+			name:     "mirror check timeout",
+			expected: int64(defaultMirrorCheckTimeoutSec),
+			actual:   cfg.ResolverConfig.MirrorCheck.TimeoutSec,
+		},
+		{
+			name:     "mirror check cache ttl",
+			expected: int64(defaultMirrorCheckCacheTTLSec),
+			actual:   cfg.ResolverConfig.MirrorCheck.CacheTTLSec,
+		},
 		{
 			name:     "bg fetch period",
 			expected: int64(defaultBgFetchPeriodMsec),
@@ -149,6 +189,56 @@ func TestConfigDefaults(t *testing.T) {
 			expected: int64(defaultMaxWaitMsec),
 			actual:   cfg.RetryableHTTPClientConfig.RetryConfig.MaxWaitMsec,
 		},
+		{
+			name:     "index discovery max retries",
+			expected: defaultIndexDiscoveryMaxRetries,
+			actual:   cfg.IndexDiscoveryConfig.MaxRetries,
+		},
+		{
+			name:     "index discovery min wait",
+			expected: int64(defaultIndexDiscoveryMinWaitMsec),
+			actual:   cfg.IndexDiscoveryConfig.MinWaitMsec,
+		},
+		{
+			name:     "index discovery max wait",
+			expected: int64(defaultIndexDiscoveryMaxWaitMsec),
+			actual:   cfg.IndexDiscoveryConfig.MaxWaitMsec,
+		},
+		{
+			name:     "index revalidation read mode",
+			expected: IndexRevalidationReadModeStale,
+			actual:   cfg.IndexDiscoveryConfig.RevalidationReadMode,
+		},
+		{
+			name:     "index discovery stale manifest mode",
+			expected: StaleManifestModeFailover,
+			actual:   cfg.IndexDiscoveryConfig.StaleManifestMode,
+		},
+		{
+			name:     "preferred index version",
+			expected: IndexVersionV2,
+			actual:   cfg.IndexDiscoveryConfig.PreferredIndexVersion,
+		},
+		{
+			name:     "min index version",
+			expected: IndexVersionV1,
+			actual:   cfg.IndexDiscoveryConfig.MinIndexVersion,
+		},
+		{
+			name:     "mount fetch budget action",
+			expected: FetchBudgetActionFail,
+			actual:   cfg.BlobConfig.MountFetchBudgetAction,
+		},
+		{
+			name:     "http token refresh grace",
+			expected: int64(defaultTokenRefreshGraceMsec),
+			actual:   cfg.RetryableHTTPClientConfig.TokenRefreshGraceMsec,
+		},
+		{
+			name:     "http max redirects",
+			expected: defaultMaxRedirects,
+			actual:   cfg.RetryableHTTPClientConfig.MaxRedirects,
+		},
 		{
 			name:     "blob valid interval",
 			expected: int64(defaultValidIntervalSec),
@@ -159,6 +249,26 @@ func TestConfigDefaults(t *testing.T) {
 			expected: int64(defaultFetchTimeoutSec),
 			actual:   cfg.BlobConfig.FetchTimeoutSec,
 		},
+		{
+			name:     "blob span grouping threshold",
+			expected: int64(defaultSpanGroupingThreshold),
+			actual:   cfg.BlobConfig.SpanGroupingThreshold,
+		},
+		{
+			name:     "blob span group size",
+			expected: int64(defaultSpanGroupSize),
+			actual:   cfg.BlobConfig.SpanGroupSize,
+		},
+		{
+			name:     "blob ignored range action",
+			expected: IgnoredRangeActionSlice,
+			actual:   cfg.BlobConfig.IgnoredRangeAction,
+		},
+		{
+			name:     "blob max ignored range slice bytes",
+			expected: int64(defaultMaxIgnoredRangeSliceBytes),
+			actual:   cfg.BlobConfig.MaxIgnoredRangeSliceBytes,
+		},
 		{
 			name:     "content store type",
 			expected: SociContentStoreType,
@@ -189,6 +299,11 @@ func TestConfigDefaults(t *testing.T) {
 			expected: int64(defaultMaxConcurrentUnpacksPerImage),
 			actual:   cfg.PullModes.Parallel.MaxConcurrentUnpacksPerImage,
 		},
+		{
+			name:     "remove wait timeout",
+			expected: int64(defaultRemoveWaitTimeoutSec),
+			actual:   cfg.PullModes.Parallel.RemoveWaitTimeoutSec,
+		},
 	}
 
 	for _, tc := range tests {
@@ -272,6 +387,18 @@ concurrent_download_chunk_size = "1MB"
 			config: []byte(`
 [pull_modes.parallel_pull_unpack]
 concurrent_download_chunk_size = "badchunksize"
+`),
+			assert: func(t *testing.T, actual *Config, err error) {
+				if err == nil {
+					t.Error("Expected error, got none")
+				}
+			},
+		},
+		{
+			name: "NegativeMirrorDiscoveryRefreshInterval",
+			config: []byte(`
+[resolver.mirror_discovery]
+refresh_interval_sec = -1
 `),
 			assert: func(t *testing.T, actual *Config, err error) {
 				if err == nil {
@@ -337,6 +464,7 @@ func TestRegistryConfigParsing(t *testing.T) {
 	tomlData := `
 [registry]
   config_path = "/etc/containerd/certs.d"
+  disable_default_config_path = true
 
 [resolver]
   [resolver.host."docker.io"]
@@ -351,6 +479,9 @@ func TestRegistryConfigParsing(t *testing.T) {
 	if cfg.RegistryConfig.ConfigPath != "/etc/containerd/certs.d" {
 		t.Errorf("expected config_path to be /etc/containerd/certs.d, got %q", cfg.RegistryConfig.ConfigPath)
 	}
+	if !cfg.RegistryConfig.DisableDefaultConfigPath {
+		t.Error("expected disable_default_config_path to be true")
+	}
 
 	// Check Legacy ResolverConfig is also parsed (for backward compatibility)
 	if len(cfg.ResolverConfig.Host) != 1 {
@@ -41,6 +41,7 @@ package config
 // Config (root) defaults
 const (
 	defaultMetricsNetwork = "tcp"
+	defaultDebugNetwork   = "tcp"
 	defaultMetadataStore  = "db"
 )
 
@@ -48,6 +49,18 @@ const (
 const (
 	DefaultImageServiceAddress = "/run/containerd/containerd.sock"
 	DefaultCertsDPath          = "/etc/containerd/certs.d"
+
+	// defaultMirrorDiscoveryRefreshIntervalSec is the default number of seconds between refreshes
+	// of discovered registry mirrors. See `MirrorDiscoveryConfig.RefreshIntervalSec`.
+	defaultMirrorDiscoveryRefreshIntervalSec = 60
+
+	// defaultMirrorCheckTimeoutSec is the default timeout, in seconds, of checking whether
+	// a mirror serves a repository. See `MirrorCheckConfig.TimeoutSec`.
+	defaultMirrorCheckTimeoutSec = 5
+
+	// defaultMirrorCheckCacheTTLSec is the default number of seconds the result of checking
+	// a mirror is cached. See `MirrorCheckConfig.CacheTTLSec`.
+	defaultMirrorCheckCacheTTLSec = 60
 )
 
 // ParallelPullUnpack defaults
@@ -78,16 +91,37 @@ const (
 	// defaultMountTimeoutSec is the amount of time Mount will time out if a layer can't be resolved.
 	defaultMountTimeoutSec = 30
 
+	// defaultHostFailoverTimeoutMsec is the default number of milliseconds a registry host may take
+	// to answer before failing over to the next host. See `FSConfig.HostFailoverTimeoutMsec`.
+	defaultHostFailoverTimeoutMsec = 3_000
+
 	// defaultFuseMetricsEmitWaitDurationSec is the amount of time the snapshotter will wait before emitting the metrics for FUSE operation.
 	defaultFuseMetricsEmitWaitDurationSec = 60
 
 	// defaultMaxConcurrency is the maximum number of layers allowed to be pulled at once
 	defaultMaxConcurrency = 100
+	// defaultMaxConcurrencyOverrideCeiling is the maximum concurrency an image can request with a per-image override
+	defaultMaxConcurrencyOverrideCeiling = 1000
+
+	// defaultCacheRepairTimeoutSec is the default number of seconds spent checking the caches on startup.
+	// See `DirectoryCacheConfig.RepairTimeoutSec`.
+	defaultCacheRepairTimeoutSec = 60
 
 	defaultValidIntervalSec = 60
 
 	defaultFetchTimeoutSec = 300
 
+	// defaultSpanGroupingThreshold is the default span size below which spans are fetched in groups.
+	// See `BlobConfig.SpanGroupingThreshold`.
+	defaultSpanGroupingThreshold = 1 << 20
+	// defaultSpanGroupSize is the default number of bytes of spans fetched together, which is
+	// the default span size of the soci CLI. See `BlobConfig.SpanGroupSize`.
+	defaultSpanGroupSize = 4 << 20
+
+	// defaultMaxIgnoredRangeSliceBytes is the default number of bytes of a whole blob read to
+	// slice a range out of it. See `BlobConfig.MaxIgnoredRangeSliceBytes`.
+	defaultMaxIgnoredRangeSliceBytes = 64 << 20
+
 	// defaultDialTimeoutMsec is the default number of milliseconds before timeout while connecting to a remote endpoint. See `TimeoutConfig.DialTimeout`.
 	defaultDialTimeoutMsec = 3_000
 	// defaultResponseHeaderTimeoutMsec is the default number of milliseconds before timeout while waiting for response header from a remote endpoint. See `TimeoutConfig.ResponseHeaderTimeout`.
@@ -104,6 +138,21 @@ const (
 	// defaultMaxWaitMsec is the default maximum number of milliseconds between attempts. See `RetryConfig.MaxWait`.
 	defaultMaxWaitMsec = 300_000
 
+	// defaultTokenRefreshGraceMsec is the default number of milliseconds before a bearer token expires that it will be refreshed.
+	// See `RetryableHTTPClientConfig.TokenRefreshGraceMsec`.
+	defaultTokenRefreshGraceMsec = 10_000
+
+	// defaultMaxRedirects is the default number of redirects followed by a single request attempt.
+	// See `RetryableHTTPClientConfig.MaxRedirects`.
+	defaultMaxRedirects = 10
+
+	// defaultIndexDiscoveryMaxRetries is the default number of times SOCI index discovery is retried. See `IndexDiscoveryConfig.MaxRetries`.
+	defaultIndexDiscoveryMaxRetries = 2
+	// defaultIndexDiscoveryMinWaitMsec is the default minimum number of milliseconds between discovery attempts.
+	defaultIndexDiscoveryMinWaitMsec = 500
+	// defaultIndexDiscoveryMaxWaitMsec is the default maximum number of milliseconds between discovery attempts.
+	defaultIndexDiscoveryMaxWaitMsec = 5_000
+
 	// DefaultContentStore chooses the soci or containerd content store as the default
 	DefaultContentStoreType = "containerd"
 
@@ -134,4 +183,8 @@ const (
 	// defaultMaxConcurrentUnpacks sets the default value for the max number of layers per image that will be unpacked at once.
 	// This must be less than or equal to MaxConcurrentUnpacks.
 	defaultMaxConcurrentUnpacksPerImage = 1
+
+	// defaultRemoveWaitTimeoutSec sets the default value for how long removing a snapshot waits for
+	// the image's cancelled unpacks to stop.
+	defaultRemoveWaitTimeoutSec = 10
 )
@@ -39,6 +39,8 @@
 package config
 
 import (
+	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/containerd/containerd/defaults"
@@ -51,9 +53,45 @@ type FSConfig struct {
 	Debug                          bool   `toml:"debug"`
 	DisableVerification            bool   `toml:"disable_verification"`
 	MaxConcurrency                 int64  `toml:"max_concurrency"`
+	MaxConcurrencyOverrideCeiling  int64  `toml:"max_concurrency_override_ceiling"`
 	NoPrometheus                   bool   `toml:"no_prometheus"`
 	MountTimeoutSec                int64  `toml:"mount_timeout_sec"`
 	FuseMetricsEmitWaitDurationSec int64  `toml:"fuse_metrics_emit_wait_duration_sec"`
+	CacheEagerPulls                bool   `toml:"cache_eager_pulls"`
+
+	// LazyLoadPaths are glob patterns of the files that are lazily loaded. If set,
+	// the spans of all other files are fetched in the background once a layer is resolved.
+	LazyLoadPaths []string `toml:"lazy_load_paths"`
+
+	// PrecomputeDirTree loads the directory structure of a layer into memory
+	// when it is mounted, so that readdir and lookup don't query the metadata store.
+	PrecomputeDirTree bool `toml:"precompute_dir_tree"`
+
+	// MmapZtocThresholdBytes is the size from which ztocs are spooled to disk
+	// and memory-mapped instead of being read into memory, and their file
+	// metadata are parsed in chunks while the layer is mounted.
+	// A value <= 0 disables memory-mapping.
+	MmapZtocThresholdBytes int64 `toml:"mmap_ztoc_threshold_bytes"`
+
+	// ReclaimUnreferencedLayers removes the cache of a lazily loaded layer as soon as
+	// containerd removes the last snapshot using it, e.g. during garbage collection,
+	// instead of keeping it until it is evicted to make room for other layers.
+	ReclaimUnreferencedLayers bool `toml:"reclaim_unreferenced_layers"`
+
+	// MountProgressMetrics emits the fetch progress of each mounted layer, labeled
+	// by image, and the number of mounted layers that completed fetching.
+	MountProgressMetrics bool `toml:"mount_progress_metrics"`
+
+	// HostFailoverTimeoutMsec is how long a registry host may take to answer before the
+	// next host is tried when SOCI artifacts and parallel pulled layers are fetched from
+	// images with several hosts, e.g. mirrors followed by the registry.
+	HostFailoverTimeoutMsec int64 `toml:"host_failover_timeout_msec"`
+
+	// HostRepositoryPrefixes maps registry host names, e.g. "cache.example.com", to prefixes
+	// prepended to the repositories of images when SOCI artifacts and layers, both lazily
+	// loaded and pulled in parallel, are fetched from the host, e.g. "cache/docker.io" for
+	// pull-through caches namespacing upstream repositories under a prefix.
+	HostRepositoryPrefixes map[string]string `toml:"host_repository_prefixes"`
 
 	RetryableHTTPClientConfig `toml:"http"`
 	BlobConfig                `toml:"blob"`
@@ -65,6 +103,10 @@ type FSConfig struct {
 	BackgroundFetchConfig `toml:"background_fetch"`
 
 	ContentStoreConfig `toml:"content_store"`
+
+	IndexDiscoveryConfig `toml:"index_discovery"`
+
+	FetchLanesConfig `toml:"fetch_lanes"`
 }
 
 // BlobConfig is config for layer blob management.
@@ -77,17 +119,93 @@ type BlobConfig struct {
 	CheckAlways          bool  `toml:"check_always"`
 	ForceSingleRangeMode bool  `toml:"force_single_range_mode"`
 
+	// DisableRangeLengthCheck disables checking that the body of a ranged response
+	// has exactly the length of the requested range. The check catches proxies that
+	// transform ranged bodies, which would otherwise corrupt the cache.
+	DisableRangeLengthCheck bool `toml:"disable_range_length_check"`
+
+	// DisableContentTypeCheck disables rejecting blob responses with an HTML Content-Type.
+	// Proxies and captive portals may serve an error page with a successful status, which
+	// is otherwise treated as a failure of the host so that another one is used.
+	DisableContentTypeCheck bool `toml:"disable_content_type_check"`
+
 	// MaxSpanVerificationRetries defines the number of additional times fetch
 	// will be invoked in case of span verification failure.
 	MaxSpanVerificationRetries int `toml:"max_span_verification_retries"`
+
+	// SpanBufferSize is the size of the pooled buffers that compressed spans are
+	// fetched into. It should match the span size of the images. 0 disables pooling.
+	SpanBufferSize int64 `toml:"span_buffer_size"`
+
+	// SpanGroupingThreshold is the span size below which the spans of a layer are
+	// fetched in groups of consecutive spans, so that layers indexed with tiny spans
+	// don't need a request for every few kilobytes read. Negative values disable grouping.
+	SpanGroupingThreshold int64 `toml:"span_grouping_threshold"`
+	// SpanGroupSize is the number of bytes of spans fetched together when spans are grouped.
+	SpanGroupSize int64 `toml:"span_group_size"`
+
+	// HeadBeforeGet makes the snapshotter send a HEAD request for each blob to learn
+	// its size before any GET, so that ranges outside of the blob and missing blobs
+	// fail without a GET.
+	HeadBeforeGet bool `toml:"head_before_get"`
+
+	// MaxHostCorruptSpans is the number of corrupt spans a registry host may serve
+	// before layers are no longer lazily loaded from it. 0 disables the limit.
+	MaxHostCorruptSpans int `toml:"max_host_corrupt_spans"`
+
+	// MountFetchBudgetBytes is the number of bytes a single mounted layer may fetch
+	// from the registry. 0 disables the budget.
+	MountFetchBudgetBytes int64 `toml:"mount_fetch_budget_bytes"`
+	// MountFetchBudgetAction controls what happens to fetches beyond the budget.
+	// One of "fail" or "alert".
+	MountFetchBudgetAction string `toml:"mount_fetch_budget_action"`
+
+	// IgnoredRangeAction controls how blobs are fetched from registry hosts that answer
+	// ranged requests with the whole blob. One of "slice" or "exclude".
+	IgnoredRangeAction string `toml:"ignored_range_action"`
+	// MaxIgnoredRangeSliceBytes is the number of bytes of a whole blob that may be read
+	// to slice a range out of it when IgnoredRangeAction is "slice".
+	MaxIgnoredRangeSliceBytes int64 `toml:"max_ignored_range_slice_bytes"`
 }
 
+const (
+	// FetchBudgetActionFail fails fetches that would exceed the fetch budget.
+	FetchBudgetActionFail = "fail"
+	// FetchBudgetActionAlert reports fetches beyond the fetch budget and lets them continue.
+	FetchBudgetActionAlert = "alert"
+)
+
+const (
+	// IgnoredRangeActionSlice reads the ranges out of whole blobs returned by hosts
+	// ignoring ranged requests, as long as the ranges are within MaxIgnoredRangeSliceBytes.
+	IgnoredRangeActionSlice = "slice"
+	// IgnoredRangeActionExclude stops fetching blobs from hosts ignoring ranged requests.
+	IgnoredRangeActionExclude = "exclude"
+)
+
 // DirectoryCacheConfig is config for directory-based cache.
 type DirectoryCacheConfig struct {
 	MaxLRUCacheEntry int  `toml:"max_lru_cache_entry"`
 	MaxCacheFds      int  `toml:"max_cache_fds"`
 	SyncAdd          bool `toml:"sync_add"`
 	Direct           bool `toml:"direct"`
+
+	// MinFreeInodes is the minimum number of free inodes on the filesystem
+	// backing the cache directory. Below it, new cache writes are paused and
+	// the cache is compacted. 0 disables the guard.
+	MinFreeInodes uint64 `toml:"min_free_inodes"`
+
+	// WriteFailureMode defines how reads behave when a fetched span can't be
+	// written to the cache, e.g. because the disk is full. "fail-open" serves
+	// the span without caching it, "fail-closed" fails the read.
+	WriteFailureMode string `toml:"write_failure_mode"`
+
+	// RepairOnStartup checks the caches left on disk by a previous run on startup,
+	// e.g. after a crash, and repairs them so that they start in a consistent state.
+	RepairOnStartup bool `toml:"repair_on_startup"`
+
+	// RepairTimeoutSec bounds the time spent checking the caches on startup, in seconds.
+	RepairTimeoutSec int64 `toml:"repair_timeout_sec"`
 }
 
 func defaultDirectoryCacheConfig(cfg *Config) error {
@@ -109,6 +227,19 @@ type FuseConfig struct {
 	// for debugging purposes only. This option may emit sensitive information,
 	// e.g. filenames and paths within an image
 	LogFuseOperations bool `toml:"log_fuse_operations"`
+
+	// ReadLatencyMetrics enables histograms of the latency of FUSE file reads,
+	// labeled by image and layer and broken down by whether the read was served
+	// from the local cache or had to fetch from the registry.
+	ReadLatencyMetrics bool `toml:"read_latency_metrics"`
+
+	// LazyMount defers the FUSE mount of a lazily loaded layer until the layer
+	// is first used by a container, so layers that are never used aren't mounted.
+	LazyMount bool `toml:"lazy_mount"`
+
+	// ShareLayerMounts mounts a layer that appears multiple times in the chain of an
+	// image only once, and bind mounts it to the mountpoint of each of its snapshots.
+	ShareLayerMounts bool `toml:"share_layer_mounts"`
 }
 
 type BackgroundFetchConfig struct {
@@ -132,6 +263,97 @@ type BackgroundFetchConfig struct {
 	EmitMetricPeriodSec int64 `toml:"emit_metric_period_sec"`
 }
 
+// IndexDiscoveryConfig is config for retrying SOCI index discovery and fetch.
+// These retries wrap the whole discovery phase and are in addition to the
+// per-request retries of the HTTP client.
+type IndexDiscoveryConfig struct {
+	// MaxRetries is the maximum number of times SOCI index discovery will be retried
+	// after a transient failure before falling back to eagerly unpacking the image.
+	MaxRetries int `toml:"max_retries"`
+	// MinWaitMsec is the minimum wait time between discovery attempts.
+	MinWaitMsec int64 `toml:"min_wait_msec"`
+	// MaxWaitMsec is the maximum wait time between discovery attempts.
+	MaxWaitMsec int64 `toml:"max_wait_msec"`
+	// DisableDigestVerification disables verifying the fetched SOCI index bytes against
+	// the index digest before parsing them. This is only meant for environments that
+	// discover the index without a trusted digest.
+	DisableDigestVerification bool `toml:"disable_digest_verification"`
+
+	// HedgedFetchHosts is the number of registry hosts, in the order of the configured
+	// mirrors followed by the registry, from which the SOCI index is fetched in parallel.
+	// Hosts that recently failed are skipped.
+	// The first response that completes and verifies is used. Values below 2 disable
+	// hedged fetches.
+	HedgedFetchHosts int `toml:"hedged_fetch_hosts"`
+
+	// PipelineColdStart resolves the blob of the layer being mounted while
+	// its SOCI index is discovered and fetched, instead of after it.
+	PipelineColdStart bool `toml:"pipeline_cold_start"`
+
+	// RevalidationIntervalSec is how often, in seconds, the SOCI index of an image
+	// is discovered again, so that layers mounted afterwards use a newly pushed index.
+	// Indices given by digest are never revalidated. Values <= 0 disable revalidation.
+	RevalidationIntervalSec int64 `toml:"revalidation_interval_sec"`
+	// RevalidationReadMode controls which index is used while it is revalidated.
+	// One of "stale" or "block".
+	RevalidationReadMode string `toml:"revalidation_read_mode"`
+
+	// StaleManifestMode controls what happens when a host serves an image manifest
+	// that doesn't match the requested digest, e.g. a stale manifest cached by a
+	// pull-through mirror. One of "failover" or "error".
+	StaleManifestMode string `toml:"stale_manifest_mode"`
+
+	// InlineIndexAnnotation is the image manifest annotation holding either the SOCI
+	// index, base64 encoded, or the digest of the SOCI index. When the manifest has the
+	// annotation, the index is used without discovering it through the referrers API or
+	// the SOCI v2 index annotation. Empty disables it.
+	InlineIndexAnnotation string `toml:"inline_index_annotation"`
+
+	// PreferredIndexVersion is the SOCI index version used when an image has indices
+	// of several versions. Other versions are used, newest first, if the image has no
+	// index of the preferred version. One of "v1" or "v2".
+	PreferredIndexVersion string `toml:"preferred_index_version"`
+	// MinIndexVersion is the oldest SOCI index version that is used. Images only
+	// having older indices are pulled without one. One of "v1" or "v2".
+	MinIndexVersion string `toml:"min_index_version"`
+}
+
+const (
+	// IndexRevalidationReadModeStale keeps using the current SOCI index while
+	// it is revalidated in the background.
+	IndexRevalidationReadModeStale = "stale"
+	// IndexRevalidationReadModeBlock waits for an in-progress revalidation to
+	// finish and then uses the revalidated SOCI index.
+	IndexRevalidationReadModeBlock = "block"
+
+	// StaleManifestModeFailover fetches the image manifest from the next
+	// registry host when a host serves a manifest not matching its digest.
+	StaleManifestModeFailover = "failover"
+	// StaleManifestModeError fails SOCI index discovery as soon as a host
+	// serves a manifest not matching its digest.
+	StaleManifestModeError = "error"
+
+	// IndexVersionV1 is the version of SOCI indices discovered through the referrers API.
+	IndexVersionV1 = "v1"
+	// IndexVersionV2 is the version of SOCI indices referenced by an image manifest annotation.
+	IndexVersionV2 = "v2"
+)
+
+// indexVersions are the SOCI index versions that can be configured, oldest first.
+var indexVersions = []string{IndexVersionV1, IndexVersionV2}
+
+// FetchLanesConfig is config for limiting on-demand fetches driven by metadata
+// separately from fetches of file data.
+type FetchLanesConfig struct {
+	// MetadataMaxConcurrency is the maximum number of concurrent on-demand fetches
+	// of tar headers, which are fetched to verify files when they are first read.
+	// Values <= 0 don't limit them.
+	MetadataMaxConcurrency int64 `toml:"metadata_max_concurrency"`
+	// DataMaxConcurrency is the maximum number of concurrent on-demand fetches of
+	// file data. Values <= 0 don't limit them.
+	DataMaxConcurrency int64 `toml:"data_max_concurrency"`
+}
+
 // RetryConfig represents the settings for retries in a retryable http client.
 type RetryConfig struct {
 	// MaxRetries is the maximum number of retries before giving up on a retryable request.
@@ -143,6 +365,9 @@ type RetryConfig struct {
 	// MaxWait is the maximum wait time between attempts. The actual wait time is governed by the BackoffStrategy,
 	// but the wait time will never be longer than this duration.
 	MaxWaitMsec int64
+	// RetryStatusCodes are the response statuses that are retried. If empty, 429 and 5xx responses
+	// (except 501) are retried. Requests failing without a response are always retried.
+	RetryStatusCodes []int
 }
 
 // TimeoutConfig represents the settings for timeout at various points in a request lifecycle in a retryable http client.
@@ -162,6 +387,37 @@ type TimeoutConfig struct {
 type RetryableHTTPClientConfig struct {
 	TimeoutConfig
 	RetryConfig
+
+	// TokenRefreshGraceMsec is how long before a bearer token expires that it will be proactively
+	// refreshed, so that long-running requests don't start with a token that lapses mid-read.
+	// A negative value disables proactive refreshes.
+	TokenRefreshGraceMsec int64
+
+	// QueryAuthParams are the query parameters that carry auth tokens in blob URLs
+	// (e.g. pre-signed URLs). Requests to URLs containing any of them are sent without
+	// an Authorization header. If empty, a set of well-known parameters is used.
+	QueryAuthParams []string
+
+	// MaxRedirects is the maximum number of redirects followed within a single request
+	// attempt. Redirects are followed by the transport and never count against MaxRetries;
+	// only failed attempts (e.g. 429 and 5xx responses) do. A request exceeding MaxRedirects
+	// fails without being retried. A negative value disables following redirects.
+	MaxRedirects int
+
+	// DisableStaleConnRetry disables transparently retrying requests whose reused connection
+	// was closed by the registry before the first response byte. Some registries close idle
+	// connections aggressively, so by default such requests are retried once on a fresh
+	// connection without counting against MaxRetries.
+	DisableStaleConnRetry bool
+
+	// TokenRateLimit is the maximum number of token requests per second sent to each auth
+	// server, so that an auth server shared by many registries isn't overwhelmed during a
+	// mass pull. Requests over the limit are queued. A value <= 0 disables the limit.
+	TokenRateLimit float64
+
+	// TokenRateLimitBurst is the number of token requests that may be sent to an auth
+	// server at once before TokenRateLimit applies. A value <= 0 allows a single request.
+	TokenRateLimitBurst int
 }
 
 type ContentStoreType string
@@ -195,12 +451,22 @@ func parseFSConfig(cfg *Config) error {
 	if cfg.MaxConcurrency == 0 {
 		cfg.MaxConcurrency = defaultMaxConcurrency
 	}
-	// If MaxConcurrency is negative, disable concurrency limits entirely.
-	if cfg.MaxConcurrency < 0 {
-		cfg.MaxConcurrency = 0
+	// Negative MaxConcurrency values are kept so that the snapshotter service rejects them.
+	if cfg.MaxConcurrencyOverrideCeiling == 0 {
+		cfg.MaxConcurrencyOverrideCeiling = defaultMaxConcurrencyOverrideCeiling
+	}
+	// If MaxConcurrencyOverrideCeiling is negative, ignore per-image concurrency overrides.
+	if cfg.MaxConcurrencyOverrideCeiling < 0 {
+		cfg.MaxConcurrencyOverrideCeiling = 0
+	}
+	if cfg.DirectoryCacheConfig.RepairTimeoutSec == 0 {
+		cfg.DirectoryCacheConfig.RepairTimeoutSec = defaultCacheRepairTimeoutSec
+	}
+	if cfg.HostFailoverTimeoutMsec <= 0 {
+		cfg.HostFailoverTimeoutMsec = defaultHostFailoverTimeoutMsec
 	}
 	// Parse nested fs configs
-	parsers := []configParser{parseFuseConfig, parseBackgroundFetchConfig, parseRetryableHTTPClientConfig, parseBlobConfig, parseContentStoreConfig}
+	parsers := []configParser{parseFuseConfig, parseBackgroundFetchConfig, parseRetryableHTTPClientConfig, parseBlobConfig, parseContentStoreConfig, parseIndexDiscoveryConfig}
 	for _, p := range parsers {
 		if err := p(cfg); err != nil {
 			return err
@@ -266,6 +532,16 @@ func parseRetryableHTTPClientConfig(cfg *Config) error {
 	if cfg.RetryableHTTPClientConfig.RetryConfig.MaxWaitMsec == 0 {
 		cfg.RetryableHTTPClientConfig.RetryConfig.MaxWaitMsec = defaultMaxWaitMsec
 	}
+	if cfg.RetryableHTTPClientConfig.TokenRefreshGraceMsec == 0 {
+		cfg.RetryableHTTPClientConfig.TokenRefreshGraceMsec = defaultTokenRefreshGraceMsec
+	}
+	// If TokenRefreshGraceMsec is negative, only refresh tokens once they have expired.
+	if cfg.RetryableHTTPClientConfig.TokenRefreshGraceMsec < 0 {
+		cfg.RetryableHTTPClientConfig.TokenRefreshGraceMsec = 0
+	}
+	if cfg.RetryableHTTPClientConfig.MaxRedirects == 0 {
+		cfg.RetryableHTTPClientConfig.MaxRedirects = defaultMaxRedirects
+	}
 	return nil
 }
 
@@ -288,6 +564,29 @@ func parseBlobConfig(cfg *Config) error {
 	if cfg.BlobConfig.MaxWaitMsec == 0 {
 		cfg.BlobConfig.MaxWaitMsec = cfg.RetryableHTTPClientConfig.RetryConfig.MaxWaitMsec
 	}
+	if cfg.BlobConfig.SpanGroupingThreshold == 0 {
+		cfg.BlobConfig.SpanGroupingThreshold = defaultSpanGroupingThreshold
+	}
+	if cfg.BlobConfig.SpanGroupSize <= 0 {
+		cfg.BlobConfig.SpanGroupSize = defaultSpanGroupSize
+	}
+	switch cfg.BlobConfig.MountFetchBudgetAction {
+	case "":
+		cfg.BlobConfig.MountFetchBudgetAction = FetchBudgetActionFail
+	case FetchBudgetActionFail, FetchBudgetActionAlert:
+	default:
+		return fmt.Errorf("invalid mount fetch budget action %q", cfg.BlobConfig.MountFetchBudgetAction)
+	}
+	switch cfg.BlobConfig.IgnoredRangeAction {
+	case "":
+		cfg.BlobConfig.IgnoredRangeAction = IgnoredRangeActionSlice
+	case IgnoredRangeActionSlice, IgnoredRangeActionExclude:
+	default:
+		return fmt.Errorf("invalid ignored range action %q", cfg.BlobConfig.IgnoredRangeAction)
+	}
+	if cfg.BlobConfig.MaxIgnoredRangeSliceBytes <= 0 {
+		cfg.BlobConfig.MaxIgnoredRangeSliceBytes = defaultMaxIgnoredRangeSliceBytes
+	}
 	return nil
 }
 
@@ -304,3 +603,51 @@ func parseContentStoreConfig(cfg *Config) error {
 	}
 	return nil
 }
+
+func parseIndexDiscoveryConfig(cfg *Config) error {
+	if cfg.IndexDiscoveryConfig.MaxRetries == 0 {
+		cfg.IndexDiscoveryConfig.MaxRetries = defaultIndexDiscoveryMaxRetries
+	}
+	// If MaxRetries is negative, don't retry index discovery.
+	if cfg.IndexDiscoveryConfig.MaxRetries < 0 {
+		cfg.IndexDiscoveryConfig.MaxRetries = 0
+	}
+	if cfg.IndexDiscoveryConfig.MinWaitMsec == 0 {
+		cfg.IndexDiscoveryConfig.MinWaitMsec = defaultIndexDiscoveryMinWaitMsec
+	}
+	if cfg.IndexDiscoveryConfig.MaxWaitMsec == 0 {
+		cfg.IndexDiscoveryConfig.MaxWaitMsec = defaultIndexDiscoveryMaxWaitMsec
+	}
+	switch cfg.IndexDiscoveryConfig.RevalidationReadMode {
+	case "":
+		cfg.IndexDiscoveryConfig.RevalidationReadMode = IndexRevalidationReadModeStale
+	case IndexRevalidationReadModeStale, IndexRevalidationReadModeBlock:
+	default:
+		return fmt.Errorf("invalid index revalidation read mode %q", cfg.IndexDiscoveryConfig.RevalidationReadMode)
+	}
+	switch cfg.IndexDiscoveryConfig.StaleManifestMode {
+	case "":
+		cfg.IndexDiscoveryConfig.StaleManifestMode = StaleManifestModeFailover
+	case StaleManifestModeFailover, StaleManifestModeError:
+	default:
+		return fmt.Errorf("invalid stale manifest mode %q", cfg.IndexDiscoveryConfig.StaleManifestMode)
+	}
+	if cfg.IndexDiscoveryConfig.PreferredIndexVersion == "" {
+		cfg.IndexDiscoveryConfig.PreferredIndexVersion = IndexVersionV2
+	}
+	if cfg.IndexDiscoveryConfig.MinIndexVersion == "" {
+		cfg.IndexDiscoveryConfig.MinIndexVersion = IndexVersionV1
+	}
+	preferred := slices.Index(indexVersions, cfg.IndexDiscoveryConfig.PreferredIndexVersion)
+	if preferred < 0 {
+		return fmt.Errorf("invalid preferred index version %q", cfg.IndexDiscoveryConfig.PreferredIndexVersion)
+	}
+	minimum := slices.Index(indexVersions, cfg.IndexDiscoveryConfig.MinIndexVersion)
+	if minimum < 0 {
+		return fmt.Errorf("invalid min index version %q", cfg.IndexDiscoveryConfig.MinIndexVersion)
+	}
+	if minimum > preferred {
+		return fmt.Errorf("min index version %q is newer than preferred index version %q", cfg.IndexDiscoveryConfig.MinIndexVersion, cfg.IndexDiscoveryConfig.PreferredIndexVersion)
+	}
+	return nil
+}
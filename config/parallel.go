@@ -60,6 +60,10 @@ type ParallelConfig struct {
 	DecompressStreams map[string]DecompressStream `toml:"decompress_streams"`
 
 	DiscardUnpackedLayers bool `toml:"discard_unpacked_layers"`
+
+	// RemoveWaitTimeoutSec bounds how long removing a snapshot waits for the image's
+	// cancelled unpacks to stop before their partial content is deleted.
+	RemoveWaitTimeoutSec int64 `toml:"remove_wait_timeout_sec"`
 }
 
 func defaultParallelConfig() ParallelConfig {
@@ -69,6 +73,7 @@ func defaultParallelConfig() ParallelConfig {
 		ConcurrentDownloadChunkSize:    defaultConcurrentDownloadChunkSize,
 		MaxConcurrentUnpacks:           defaultMaxConcurrentUnpacks,
 		MaxConcurrentUnpacksPerImage:   defaultMaxConcurrentUnpacksPerImage,
+		RemoveWaitTimeoutSec:           defaultRemoveWaitTimeoutSec,
 	}
 }
 
@@ -44,6 +44,14 @@ type V2 struct {
 type Parallel struct {
 	ParallelConfig
 	Enable bool `toml:"enable"`
+
+	// LazyLoadIndexedLayers lazily loads the layers covered by an image's SOCI index,
+	// if any, and only unpacks the remaining layers in parallel.
+	LazyLoadIndexedLayers bool `toml:"lazy_load_indexed_layers"`
+
+	// SerialRepositoryPrefixes are prefixes of normalized repository names, e.g.
+	// "docker.io/library/", of images that are pulled without parallel pull and unpack.
+	SerialRepositoryPrefixes []string `toml:"serial_repository_prefixes"`
 }
 
 func defaultPullModes(cfg *Config) error {
@@ -44,15 +44,67 @@ type RegistryConfig struct {
 	// in containerd's certs.d layout. When set, per-host resolver settings are
 	// ignored in favor of the files in this directory.
 	ConfigPath string `toml:"config_path"`
+
+	// DisableDefaultConfigPath disables falling back to the default certs.d directory
+	// when neither ConfigPath nor legacy per-host resolver settings are configured.
+	// The snapshotter then fails to start instead of using an empty host configuration.
+	DisableDefaultConfigPath bool `toml:"disable_default_config_path"`
 }
 
 // ResolverConfig is config for resolving registries.
 type ResolverConfig struct {
 	Host map[string]HostConfig `toml:"host"`
+
+	// MirrorDiscovery is config for discovering mirrors from a remote endpoint.
+	MirrorDiscovery MirrorDiscoveryConfig `toml:"mirror_discovery"`
+
+	// MirrorCheck is config for checking that mirrors serve an image's repository.
+	MirrorCheck MirrorCheckConfig `toml:"mirror_check"`
+}
+
+// MirrorDiscoveryConfig is config for periodically pulling the list of
+// registry mirrors from a discovery endpoint.
+type MirrorDiscoveryConfig struct {
+	// URL is the endpoint returning the current mirrors of each registry host
+	// as JSON. An empty URL disables mirror discovery.
+	URL string `toml:"url"`
+
+	// RefreshIntervalSec is how often, in seconds, the mirror list is refreshed.
+	RefreshIntervalSec int64 `toml:"refresh_interval_sec"`
+}
+
+// MirrorCheckConfig is config for checking that each mirror serves an image's
+// repository before it's used to pull the image.
+type MirrorCheckConfig struct {
+	// Enable issues a manifest HEAD request against each mirror when an image
+	// is resolved, and skips mirrors that answer that they don't serve it.
+	Enable bool `toml:"enable"`
+
+	// TimeoutSec is the timeout, in seconds, of each check.
+	TimeoutSec int64 `toml:"timeout_sec"`
+
+	// CacheTTLSec is how long, in seconds, the result of checking a mirror
+	// for a repository is cached.
+	CacheTTLSec int64 `toml:"cache_ttl_sec"`
 }
 
 type HostConfig struct {
 	Mirrors []MirrorConfig `toml:"mirrors"`
+
+	// Proxy is the HTTP proxy requests to the host are sent through.
+	Proxy ProxyConfig `toml:"proxy"`
+}
+
+// ProxyConfig is config for an HTTP proxy in front of a registry host.
+type ProxyConfig struct {
+	// URL is the URL of the proxy, e.g. http://proxy.example.com:3128.
+	// An empty URL means requests to the host don't use a per-host proxy.
+	URL string `toml:"url"`
+
+	// Username and Password are the credentials sent to the proxy in the
+	// Proxy-Authorization header. They are never sent to the registry.
+	Username string `toml:"username"`
+	Password string `toml:"password"`
 }
 
 type MirrorConfig struct {
@@ -32,6 +32,8 @@
 
 package config
 
+import "fmt"
+
 type ServiceConfig struct {
 	FSConfig
 
@@ -53,6 +55,30 @@ type ServiceConfig struct {
 
 	// SnapshotterConfig is snapshotter-related config.
 	SnapshotterConfig `toml:"snapshotter"`
+
+	// HTTPRecordingConfig is config for recording and replaying registry traffic.
+	HTTPRecordingConfig `toml:"http_recording"`
+}
+
+const (
+	// HTTPRecordingModeRecord records all registry requests and responses.
+	HTTPRecordingModeRecord = "record"
+	// HTTPRecordingModeReplay serves registry requests from a recording without network access.
+	HTTPRecordingModeReplay = "replay"
+)
+
+// HTTPRecordingConfig is config for recording registry traffic for offline
+// debugging and replaying it later.
+type HTTPRecordingConfig struct {
+	// Mode is "record" or "replay". Empty disables recording and replaying.
+	Mode string `toml:"mode"`
+
+	// Path is the file the recording is written to or read from.
+	Path string `toml:"path"`
+
+	// DigestOnly records only the digest and size of response bodies instead of
+	// the bodies themselves. Such recordings can't be replayed.
+	DigestOnly bool `toml:"digest_only"`
 }
 
 // KubeconfigKeychainConfig is config for kubeconfig-based keychain.
@@ -84,11 +110,54 @@ type SnapshotterConfig struct {
 	// NOTE: User needs to manually remove the snapshots from containerd's metadata store using
 	//       ctr (e.g. `ctr snapshot rm`).
 	AllowInvalidMountsOnRestart bool `toml:"allow_invalid_mounts_on_restart"`
+
+	// TmpfsUpperdirPath places the upperdir and workdir of container snapshots
+	// under this path, which should be backed by tmpfs. If empty, they are
+	// placed under the snapshotter root.
+	TmpfsUpperdirPath string `toml:"tmpfs_upperdir_path"`
+
+	// TmpfsUpperdirSize is the size limit, in bytes, of the tmpfs the snapshotter
+	// mounts for each container snapshot under TmpfsUpperdirPath. If zero, no tmpfs is
+	// mounted and TmpfsUpperdirPath is expected to already be on tmpfs.
+	TmpfsUpperdirSize int64 `toml:"tmpfs_upperdir_size"`
+
+	// ChainMode controls whether a snapshot chain may mix lazily loaded and
+	// eagerly unpacked layers. One of "mixed", "lazy" or "eager".
+	ChainMode string `toml:"chain_mode"`
+
+	// LowerdirLimitMode controls how overlay mounts whose lowerdir option is too long
+	// for the kernel are handled. One of "relative" or "error".
+	LowerdirLimitMode string `toml:"lowerdir_limit_mode"`
+
+	// ActiveHostLabel reports the registry host or mirror each lazily loaded layer
+	// is currently fetched from as a label on the layer's snapshot info.
+	ActiveHostLabel bool `toml:"active_host_label"`
+
+	// SELinuxContext is the SELinux context set on the overlay mounts of snapshots,
+	// e.g. "system_u:object_r:container_file_t:s0". If empty, no context is set.
+	SELinuxContext string `toml:"selinux_context"`
+
+	// VerifyUserXAttr verifies whether overlay mounts need the "userxattr" option by
+	// writing and reading back xattrs on the backing filesystem of the snapshotter root,
+	// correcting the heuristic detection when the filesystem disagrees with it.
+	VerifyUserXAttr bool `toml:"verify_userxattr"`
 }
 
 func parseServiceConfig(cfg *Config) error {
 	if cfg.CRIKeychainConfig.ImageServicePath == "" {
 		cfg.CRIKeychainConfig.ImageServicePath = DefaultImageServiceAddress
 	}
+	if cfg.ResolverConfig.MirrorDiscovery.RefreshIntervalSec < 0 {
+		return fmt.Errorf("invalid mirror discovery refresh interval %d", cfg.ResolverConfig.MirrorDiscovery.RefreshIntervalSec)
+	}
+	if cfg.ResolverConfig.MirrorDiscovery.RefreshIntervalSec == 0 {
+		cfg.ResolverConfig.MirrorDiscovery.RefreshIntervalSec = defaultMirrorDiscoveryRefreshIntervalSec
+	}
+	if cfg.ResolverConfig.MirrorCheck.TimeoutSec == 0 {
+		cfg.ResolverConfig.MirrorCheck.TimeoutSec = defaultMirrorCheckTimeoutSec
+	}
+	if cfg.ResolverConfig.MirrorCheck.CacheTTLSec == 0 {
+		cfg.ResolverConfig.MirrorCheck.CacheTTLSec = defaultMirrorCheckCacheTTLSec
+	}
 	return nil
 }
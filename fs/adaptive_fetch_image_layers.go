@@ -64,6 +64,7 @@ var (
 	ErrImageUnpackJobNotFound    = errors.New("image unpack job not found")
 	ErrImageUnpackJobHasNoLayers = errors.New("image unpack job has no layers")
 	ErrImageUnpackJobExpired     = errors.New("image unpack job has expired")
+	ErrImageUnpackJobStopTimeout = errors.New("timed out waiting for image unpack job to stop")
 	ErrLayerHasNoJobs            = errors.New("layer has no jobs")
 
 	ErrNoClaimableLayerJobs    = errors.New("no claimable jobs")
@@ -458,6 +459,68 @@ func (jobs *unpackJobs) RemoveImageWithError(imageDigest string, cause error) er
 	return nil
 }
 
+// RemoveImageAndWait cancels and removes all layer unpack jobs of an image like RemoveImageWithError,
+// then waits up to timeout for each job to stop, including the rebase of claimed jobs, before deleting
+// its partial content from storage. Jobs that don't stop in time are left to the garbage collector.
+func (jobs *unpackJobs) RemoveImageAndWait(ctx context.Context, imageDigest string, cause error, timeout time.Duration) error {
+	jobs.mu.Lock()
+	imageJob, ok := jobs.images[imageDigest]
+	if !ok {
+		jobs.mu.Unlock()
+		return fmt.Errorf("%w: %s", ErrImageUnpackJobNotFound, imageDigest)
+	}
+
+	var (
+		layerJobs []*layerUnpackJob
+		// rebases are the rebases of claimed jobs, which use the content of the jobs until they're done.
+		rebases []chan struct{}
+	)
+	for _, layers := range imageJob.layers {
+		for _, layerJob := range layers {
+			if layerJob.status.Load() == LayerUnpackJobClaimed {
+				rebases = append(rebases, layerJob.rebased)
+			}
+			// Mark the jobs as cancelled so that a concurrent rebase doesn't use their content.
+			layerJob.Cancel(cause)
+			layerJobs = append(layerJobs, layerJob)
+		}
+	}
+	imageJob.Cancel(cause)
+	delete(jobs.images, imageDigest)
+	jobs.mu.Unlock()
+
+	if timeout <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for _, rebased := range rebases {
+		select {
+		case <-rebased:
+		case <-timer.C:
+			return fmt.Errorf("%w: %s", ErrImageUnpackJobStopTimeout, imageDigest)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var errs []error
+	for _, layerJob := range layerJobs {
+		select {
+		case <-layerJob.done:
+		case <-timer.C:
+			return fmt.Errorf("%w: %s", ErrImageUnpackJobStopTimeout, imageDigest)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if err := jobs.storage.Delete(layerJob.layerUnpackID); err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete layer unpack job %s: %w", layerJob.layerUnpackID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func (jobs *unpackJobs) remove(job *layerUnpackJob, cause error) error {
 	imageDigest := job.imageDigest
 	layerDigest := job.layerDigest
@@ -620,6 +683,16 @@ type layerUnpackJob struct {
 	upperPath     string
 	errCh         chan error
 	status        atomic.Value
+	// host is the registry host the layer was fetched from. It is set before
+	// the result of the unpack is sent to errCh.
+	host string
+
+	// done is closed once the unpack of the job no longer reads or writes its content in storage.
+	done     chan struct{}
+	doneOnce sync.Once
+	// rebased is closed once the rebase of a claimed job no longer moves its content.
+	rebased     chan struct{}
+	rebasedOnce sync.Once
 }
 
 func withImageUnpackJob(image *imageUnpackJob) layerUnpackJobOption {
@@ -655,6 +728,8 @@ func newLayerUnpackJob(layerDigest string, storage LayerUnpackJobStorage, opts .
 		upperPath:     filepath.Join(path, layerUnpackDir),
 		status:        atomic.Value{},
 		errCh:         make(chan error, 1),
+		done:          make(chan struct{}),
+		rebased:       make(chan struct{}),
 	}
 
 	for _, opt := range opts {
@@ -703,6 +778,20 @@ func (job *layerUnpackJob) Cancel(cause error) {
 	job.status.Store(LayerUnpackJobCancelled)
 }
 
+// Finish marks that the unpack of the job no longer reads or writes its content in storage.
+func (job *layerUnpackJob) Finish() {
+	job.doneOnce.Do(func() {
+		close(job.done)
+	})
+}
+
+// FinishRebase marks that the rebase of the claimed job no longer moves its content.
+func (job *layerUnpackJob) FinishRebase() {
+	job.rebasedOnce.Do(func() {
+		close(job.rebased)
+	})
+}
+
 // Claim claims this job and returns true if job is unclaimed,
 // and false if the job is already claimed.
 func (job *layerUnpackJob) Claim() bool {
@@ -18,10 +18,12 @@ package fs
 
 import (
 	"context"
+	"errors"
 	"os"
 	"path/filepath"
 	"slices"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -558,3 +560,146 @@ func TestParallelStructCreation(t *testing.T) {
 	}
 
 }
+
+func TestRemoveImageMidUnpack(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	tests := []struct {
+		name string
+		// stop reports whether the unpack stops when cancelled.
+		stop        bool
+		expectedErr error
+	}{
+		{
+			name: "cancelled unpack content is deleted once the unpack stops",
+			stop: true,
+		},
+		{
+			name:        "cancelled unpack content is garbage collected if the unpack doesn't stop in time",
+			stop:        false,
+			expectedErr: ErrImageUnpackJobStopTimeout,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			testCtx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			disk, err := newLayerUnpackDiskStorage(t.TempDir())
+			if err != nil {
+				t.Fatalf("Failed to create disk storage: %v", err)
+			}
+			inProgressJobs, err := newUnpackJobs(testCtx, newEnableParallelPullConfig(), disk)
+			if err != nil {
+				t.Fatalf("Expected no setup error, got %v", err)
+			}
+
+			premountCtx, premountCancel := context.WithCancelCause(context.Background())
+			imageJob := inProgressJobs.GetOrAddImageJob(helloWorldImageDigest, premountCancel)
+			layerJob, err := inProgressJobs.AddLayerJob(imageJob, helloWorldLayerDigest)
+			if err != nil {
+				t.Fatalf("Failed to add layer job: %v", err)
+			}
+
+			// Simulate a premount which has partially downloaded and unpacked the layer.
+			if err := os.WriteFile(layerJob.GetIngestLocation(), []byte("partial"), 0600); err != nil {
+				t.Fatalf("Failed to write partial ingest: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(layerJob.GetUnpackUpperPath(), "partial"), []byte("partial"), 0600); err != nil {
+				t.Fatalf("Failed to write partial unpack: %v", err)
+			}
+			release := make(chan struct{})
+			cancelled := make(chan error, 1)
+			go func() {
+				defer layerJob.Finish()
+				<-premountCtx.Done()
+				cancelled <- context.Cause(premountCtx)
+				if !tc.stop {
+					<-release
+				}
+			}()
+
+			err = inProgressJobs.RemoveImageAndWait(context.Background(), helloWorldImageDigest, context.Canceled, time.Second)
+			close(release)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("Expected error %v, got %v", tc.expectedErr, err)
+			}
+
+			if cause := <-cancelled; !errors.Is(cause, context.Canceled) {
+				t.Fatalf("Expected unpack to be cancelled with %v, got %v", context.Canceled, cause)
+			}
+			if status := layerJob.status.Load(); status != LayerUnpackJobCancelled {
+				t.Fatalf("Expected job to be cancelled, but was %v", status)
+			}
+			if inProgressJobs.ImageExists(helloWorldImageDigest) {
+				t.Fatalf("Expected image job to be removed")
+			}
+
+			if !tc.stop {
+				await(2)
+			}
+			ids, err := disk.Keys()
+			if err != nil {
+				t.Fatalf("Failed to list jobs in storage: %v", err)
+			}
+			if len(ids) != 0 {
+				t.Fatalf("Expected partial content to be deleted, but found jobs %v in storage", ids)
+			}
+		})
+	}
+}
+
+func TestRemoveImageMidRebase(t *testing.T) {
+	defer goleak.VerifyNone(t)
+
+	testCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	disk, err := newLayerUnpackDiskStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create disk storage: %v", err)
+	}
+	inProgressJobs, err := newUnpackJobs(testCtx, newEnableParallelPullConfig(), disk)
+	if err != nil {
+		t.Fatalf("Expected no setup error, got %v", err)
+	}
+
+	premountCtx, premountCancel := context.WithCancelCause(context.Background())
+	imageJob := inProgressJobs.GetOrAddImageJob(helloWorldImageDigest, premountCancel)
+	layerJob, err := inProgressJobs.AddLayerJob(imageJob, helloWorldLayerDigest)
+	if err != nil {
+		t.Fatalf("Failed to add layer job: %v", err)
+	}
+	if _, err := inProgressJobs.Claim(helloWorldImageDigest, helloWorldLayerDigest); err != nil {
+		t.Fatalf("Failed to claim layer job: %v", err)
+	}
+
+	// Simulate a premount which is cancelled, and a rebase of the claimed job which
+	// still moves its content once the premount has stopped.
+	go func() {
+		defer layerJob.Finish()
+		<-premountCtx.Done()
+	}()
+	var rebased atomic.Bool
+	go func() {
+		defer layerJob.FinishRebase()
+		<-layerJob.done
+		time.Sleep(50 * time.Millisecond)
+		rebased.Store(true)
+	}()
+
+	if err := inProgressJobs.RemoveImageAndWait(context.Background(), helloWorldImageDigest, context.Canceled, time.Second); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !rebased.Load() {
+		t.Fatalf("Expected content to be deleted after the rebase, but it was deleted before")
+	}
+	ids, err := disk.Keys()
+	if err != nil {
+		t.Fatalf("Failed to list jobs in storage: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("Expected content to be deleted, but found jobs %v in storage", ids)
+	}
+}
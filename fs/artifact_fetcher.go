@@ -23,20 +23,26 @@ import (
 	"fmt"
 	"io"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	sociremote "github.com/awslabs/soci-snapshotter/fs/remote"
 	socihttp "github.com/awslabs/soci-snapshotter/internal/http"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/soci/store"
-	"github.com/awslabs/soci-snapshotter/util/ioutils"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/log"
+	distribution "github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"golang.org/x/sync/errgroup"
 	"oras.land/oras-go/v2/content"
@@ -45,6 +51,63 @@ import (
 	"oras.land/oras-go/v2/registry/remote/errcode"
 )
 
+// ErrIndexDigestMismatch is returned when the fetched SOCI index bytes don't
+// match the digest of the index descriptor.
+var ErrIndexDigestMismatch = errors.New("SOCI index digest mismatch")
+
+// ErrNoReachableHost is returned when none of the registry hosts of an image can be reached.
+var ErrNoReachableHost = errors.New("no reachable registry host")
+
+// HostError is the failure of a registry host.
+type HostError struct {
+	// Host is the name of the host, e.g. "mirror.example.com:5000".
+	Host string
+	Err  error
+}
+
+func (e *HostError) Error() string {
+	return fmt.Sprintf("host %q: %v", e.Host, e.Err)
+}
+
+func (e *HostError) Unwrap() error {
+	return e.Err
+}
+
+// AllHostsFailedError is returned when every registry host of an image was tried and failed.
+// It wraps ErrNoReachableHost and the failure of each host.
+type AllHostsFailedError struct {
+	// Hosts are the failures of the hosts, in the order they were tried.
+	Hosts []*HostError
+}
+
+func (e *AllHostsFailedError) Error() string {
+	msgs := make([]string, len(e.Hosts))
+	for i, h := range e.Hosts {
+		msgs[i] = h.Error()
+	}
+	return fmt.Sprintf("%v: %s", ErrNoReachableHost, strings.Join(msgs, "\n"))
+}
+
+func (e *AllHostsFailedError) Unwrap() []error {
+	errs := []error{ErrNoReachableHost}
+	for _, h := range e.Hosts {
+		errs = append(errs, h)
+	}
+	return errs
+}
+
+// ErrTruncatedRange is returned when a registry host answers a range request
+// with fewer bytes than requested.
+var ErrTruncatedRange = errors.New("truncated range response")
+
+// ErrMirrorResolveTimeout is returned when a registry host doesn't answer a request
+// within the mirror resolve timeout.
+var ErrMirrorResolveTimeout = errors.New("registry host did not respond within the mirror resolve timeout")
+
+// ErrHostFailoverTimeout is returned when a registry host doesn't answer a request within
+// the host failover timeout, after which the request fails over to the next host.
+var ErrHostFailoverTimeout = errors.New("registry host did not respond within the host failover timeout")
+
 type Fetcher interface {
 	// Fetch fetches the artifact identified by the descriptor. It first checks the local content store
 	// and returns a `ReadCloser` from there. Otherwise it fetches from the remote, saves in the local content store
@@ -76,21 +139,201 @@ type artifactFetcher struct {
 type orasBlobStore struct {
 	*remote.Repository
 	pathPrefix string
+
+	// hosts are the registry hosts blobs can be fetched from, in order.
+	// Repository is on hosts[primary], the first one that didn't recently fail,
+	// and its requests fail over to the other hosts.
+	hosts    []docker.RegistryHost
+	primary  int
+	refspec  reference.Spec
+	client   *http.Client
+	policy   hostPolicy
+	cooldown *hostCooldown
+
+	mu sync.Mutex
+	// repos are the repositories of the image on each host, created
+	// when a blob is first fetched from the host.
+	repos []*remote.Repository
+	// blobHosts maps the digest of each blob to the index of the host it's fetched from,
+	// so that all the requests for a blob, e.g. its ranges, are sent to the same host.
+	blobHosts map[string]int
 }
 
-func newRemoteBlobStore(refspec reference.Spec, client *http.Client, hosts []docker.RegistryHost) (*orasBlobStore, error) {
-	repo, err := newRemoteStore(refspec, client, hosts)
+func newRemoteBlobStore(ctx context.Context, refspec reference.Spec, client *http.Client, hosts []docker.RegistryHost, policy hostPolicy) (*orasBlobStore, error) {
+	cooldown := policy.cooldown
+	if cooldown == nil {
+		cooldown = newHostCooldown(defaultHostCooldown)
+	}
+	hosts, err := policy.withOrigin(refspec, hosts)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create remote store: %w", err)
 	}
-	pathPrefix := "/v2"
-	if len(hosts) > 0 {
-		h := hosts[0]
-		if h.Path != "" {
-			pathPrefix = h.Path
+	repo, primary, err := selectRemoteStore(refspec, client, hosts, policy, cooldown)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create remote store: %w", err)
+	}
+	repos := make([]*remote.Repository, max(len(hosts), 1))
+	repos[primary] = repo
+	if len(hosts) > 1 {
+		// The requests of the repository itself, e.g. for the manifest of the image,
+		// fail over like the requests for blobs.
+		repo, err = newFailoverRemoteStore(refspec, client, hosts, policy, cooldown)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create remote store: %w", err)
+		}
+	}
+	return &orasBlobStore{
+		Repository: repo,
+		pathPrefix: hostPathPrefix(hosts, primary),
+		hosts:      hosts,
+		primary:    primary,
+		refspec:    refspec,
+		client:     client,
+		policy:     policy,
+		cooldown:   cooldown,
+		repos:      repos,
+		blobHosts:  make(map[string]int),
+	}, nil
+}
+
+// hostPathPrefix returns the normalized API root of hosts[i], or /v2 if there are no hosts.
+func hostPathPrefix(hosts []docker.RegistryHost, i int) string {
+	if i < len(hosts) {
+		return normalizeAPIPath(hosts[i].Path)
+	}
+	return "/v2"
+}
+
+// blobHost returns the repository the blob dgst is fetched from, its API root and the
+// index of its host. The host selected for the blob is kept unless it recently failed
+// or is in tried. Otherwise a host is selected among the others, skipping those that
+// recently failed unless all of them did. It returns -1 if every host is in tried.
+func (r *orasBlobStore) blobHost(dgst string, tried map[int]bool) (*remote.Repository, string, int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.hosts) <= 1 {
+		if tried[r.primary] {
+			return nil, "", -1, nil
+		}
+		return r.Repository, r.pathPrefix, r.primary, nil
+	}
+
+	i, ok := r.blobHosts[dgst]
+	if !ok || tried[i] || r.cooldown.cooling(r.hosts[i]) {
+		var candidates, cooling []int
+		for j, h := range r.hosts {
+			switch {
+			case tried[j]:
+			case r.cooldown.cooling(h):
+				cooling = append(cooling, j)
+			default:
+				candidates = append(candidates, j)
+			}
+		}
+		if len(candidates) == 0 {
+			candidates = cooling
+		}
+		if len(candidates) == 0 {
+			return nil, "", -1, nil
+		}
+		i = candidates[0]
+		if r.policy.selector != nil {
+			// Blobs are spread across the mirrors. The registry of the image only
+			// serves them when no mirror can.
+			origin := originHost(r.refspec)
+			var mirrors []int
+			var hosts []docker.RegistryHost
+			for _, j := range candidates {
+				if r.hosts[j].Host != origin {
+					mirrors = append(mirrors, j)
+					hosts = append(hosts, r.hosts[j])
+				}
+			}
+			if len(mirrors) > 0 {
+				i = mirrors[0]
+				if k := r.policy.selector.Select(hosts); k >= 0 && k < len(mirrors) {
+					i = mirrors[k]
+				}
+			}
+		}
+		r.blobHosts[dgst] = i
+	}
+
+	if r.repos[i] == nil {
+		client := r.policy.hostClient(r.client, r.hosts, i)
+		repo, err := r.policy.hostRemoteStore(r.refspec, client, r.hosts[i:i+1])
+		if err != nil {
+			return nil, "", i, err
+		}
+		r.repos[i] = repo
+	}
+	return r.repos[i], hostPathPrefix(r.hosts, i), i, nil
+}
+
+// hostFailed records that hosts[i] failed a request for the blob dgst with err, so that
+// the blob is fetched from another host. If err means the host is unhealthy, other blobs
+// are also fetched from other hosts for a while.
+func (r *orasBlobStore) hostFailed(ctx context.Context, i int, dgst string, err error) {
+	if len(r.hosts) <= 1 {
+		return
+	}
+	logger := log.G(ctx).WithError(err).WithField("host", r.hosts[i].Host).WithField("digest", dgst)
+	if hostUnhealthy(err) {
+		logger.Warn("registry host failed, skipping it for a while")
+		r.cooldown.fail(r.hosts[i])
+	} else {
+		logger.Warn("registry host failed the blob request, trying another host for the blob")
+	}
+	commonmetrics.IncMirrorFailover(r.hosts[i].Host)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.blobHosts[dgst] == i {
+		delete(r.blobHosts, dgst)
+	}
+}
+
+// hostUnhealthy returns whether err, returned by a request to a registry host, means that
+// the host is unhealthy: the request couldn't complete or was answered with a 5xx. Other
+// statuses, e.g. 404 or 401, and blobs not matching their digest are specific to a blob.
+func hostUnhealthy(err error) bool {
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.code >= http.StatusInternalServerError
+	}
+	var respErr *errcode.ErrorResponse
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode >= http.StatusInternalServerError
+	}
+	var headerErr *sociremote.HeaderStatusError
+	if errors.As(err, &headerErr) {
+		return headerErr.ServerError()
+	}
+	return !errors.Is(err, ErrBlobDigestMismatch)
+}
+
+// servingHost returns the name of the host the blob dgst is fetched from: the host selected
+// for it, which is the next host after a failover, or the primary host if none was selected.
+func (r *orasBlobStore) servingHost(dgst string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, ok := r.blobHosts[dgst]
+	if !ok {
+		i = r.primary
+	}
+	return hostName(r.hosts, i, r.refspec)
+}
+
+// recordRequest records the result err of a request to hosts[i] in the mirror metrics.
+// failed are the hosts that failed the request before, if any.
+func (r *orasBlobStore) recordRequest(i int, failed map[int]bool, err error) {
+	fellBack := false
+	for j := range failed {
+		if j != i {
+			fellBack = true
+			break
 		}
 	}
-	return &orasBlobStore{repo, pathPrefix}, nil
+	recordHostRequest(hostName(r.hosts, i, r.refspec), fellBack, err)
 }
 
 // Logic mostly taken from oras-go. Try to resolve with a HEAD, then a GET request.
@@ -105,10 +348,23 @@ func (r *orasBlobStore) Resolve(ctx context.Context, reference string) (ocispec.
 		return ocispec.Descriptor{}, err
 	}
 
-	tr := &clientWrapper{r.Client}
-	url := r.buildBlobURL(ref.Reference)
+	repo, pathPrefix, host, err := r.blobHost(ref.Reference, nil)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := r.waitHost(ctx, host); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	tr := &clientWrapper{repo.Client}
+	url := buildBlobURL(repo, pathPrefix, ref.Reference)
+	logBlobURL(ctx, repo, pathPrefix, ref.Reference)
 	resp, err := sociremote.GetHeader(ctx, url, tr)
+	if abortedByCaller(ctx, err) {
+		return ocispec.Descriptor{}, ctx.Err()
+	}
+	r.recordRequest(host, nil, err)
 	if err != nil {
+		r.hostFailed(ctx, host, ref.Reference, err)
 		return ocispec.Descriptor{}, err
 	}
 
@@ -132,11 +388,35 @@ func (r *orasBlobStore) Resolve(ctx context.Context, reference string) (ocispec.
 
 // We use our own Fetch function to ensure sensitive information gets redacted from any Fetch calls
 func (r *orasBlobStore) Fetch(ctx context.Context, target ocispec.Descriptor) (io.ReadCloser, error) {
-	rc, err := r.Repository.Fetch(ctx, target)
+	return r.fetch(ctx, target, true)
+}
+
+// fetch fetches the blob target. If verify is false, the content isn't verified against
+// the digest of target, e.g. because the caller verifies it once it is written to disk.
+func (r *orasBlobStore) fetch(ctx context.Context, target ocispec.Descriptor, verify bool) (io.ReadCloser, error) {
+	repo, _, host, err := r.blobHost(target.Digest.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.waitHost(ctx, host); err != nil {
+		return nil, err
+	}
+	rc, err := repo.Fetch(ctx, target)
+	if abortedByCaller(ctx, err) {
+		return nil, ctx.Err()
+	}
+	r.recordRequest(host, nil, err)
 	if err != nil {
-		return nil, cleanFetchErrors(err)
+		err = cleanFetchErrors(err)
+		r.hostFailed(ctx, host, target.Digest.String(), err)
+		return nil, err
 	}
-	return rc, nil
+	if !verify {
+		return rc, nil
+	}
+	return newVerifyingReader(rc, target.Digest, func(err error) {
+		r.hostFailed(ctx, host, target.Digest.String(), err)
+	})
 }
 
 // GetContentWithRange gets the requested content in the byte range [lower, upper]
@@ -160,24 +440,107 @@ func GetContentWithRange(ctx context.Context, realURL string, rt http.RoundTripp
 	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
 		return resp, nil
 	}
-	return nil, fmt.Errorf("error getting range: %v", err)
+	socihttp.Drain(resp.Body)
+	return nil, fmt.Errorf("error getting range: %w", &statusError{code: resp.StatusCode, status: resp.Status})
+}
+
+// statusError is returned when a registry answers a request with an unexpected status.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%v: %s", sociremote.ErrUnexpectedStatusCode, e.status)
+}
+
+func (e *statusError) Unwrap() error {
+	return sociremote.ErrUnexpectedStatusCode
 }
 
 // FetchRange returns the response body of the range requested.
 // This assumes the upstream repo supports ranged GET calls.
 // If it does not, return an error.
+// Requests failing with a retryable status are retried by the HTTP client of the host. If the
+// host still fails the request, it is sent to the next host that wasn't tried, if any.
+// Concurrent requests for the same range of a blob are coalesced if the store shares flights.
 // TODO: Unify this with the artifact fetching done in fs/remote/resolver.go
 func (r *orasBlobStore) FetchRange(ctx context.Context, reference string, lower, upper int64) (io.ReadCloser, error) {
 	ref, err := registry.ParseReference(reference)
 	if err != nil {
 		return nil, err
 	}
+	if r.policy.flights == nil {
+		return r.fetchRangeWithFailover(ctx, ref.Reference, lower, upper)
+	}
 
-	tr := &clientWrapper{r.Client}
-	realURL := r.buildBlobURL(ref.Reference)
+	data, err := r.policy.flights.do(ctx, rangeKey(ref.Reference, lower, upper), func(ctx context.Context) ([]byte, error) {
+		rc, err := r.fetchRangeWithFailover(ctx, ref.Reference, lower, upper)
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		size := upper - lower + 1
+		data, err := io.ReadAll(io.LimitReader(rc, size))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) != size {
+			return nil, fmt.Errorf("%w: range [%d, %d]", ErrTruncatedRange, lower, upper)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// fetchRangeWithFailover is FetchRange without coalescing.
+func (r *orasBlobStore) fetchRangeWithFailover(ctx context.Context, dgst string, lower, upper int64) (io.ReadCloser, error) {
+	failed := make(map[int]bool)
+	for {
+		n := len(failed)
+		rc, err := r.fetchRange(ctx, dgst, lower, upper, failed)
+		// Errors that aren't failures of the host, e.g. canceled requests, aren't sent to another host.
+		if err == nil || len(failed) == n || len(failed) >= max(len(r.hosts), 1) {
+			return rc, err
+		}
+		log.G(ctx).WithError(err).WithField("digest", dgst).Debug("range request failed, trying the next registry host")
+	}
+}
+
+// fetchRange makes a single attempt of FetchRange. failed are the hosts that failed the
+// previous attempts, which are skipped and to which the host is added if the attempt fails.
+func (r *orasBlobStore) fetchRange(ctx context.Context, dgst string, lower, upper int64, failed map[int]bool) (io.ReadCloser, error) {
+	repo, pathPrefix, host, err := r.blobHost(dgst, failed)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.waitHost(ctx, host); err != nil {
+		return nil, err
+	}
+	tr := &clientWrapper{repo.Client}
+	realURL := buildBlobURL(repo, pathPrefix, dgst)
+	logBlobURL(ctx, repo, pathPrefix, dgst)
 	resp, err := GetContentWithRange(ctx, realURL, tr, lower, upper)
+	var size int64
+	if err == nil {
+		size = rangeSize(resp, lower, upper)
+	}
+	if err == nil && resp.ContentLength >= 0 && resp.ContentLength < size {
+		resp.Body.Close()
+		err = fmt.Errorf("%w: Content-Length %d of range [%d, %d]", ErrTruncatedRange, resp.ContentLength, lower, upper)
+	}
+	if abortedByCaller(ctx, err) {
+		return nil, ctx.Err()
+	}
+	r.recordRequest(host, failed, err)
 	if err != nil {
-		return nil, cleanFetchErrors(err)
+		failed[host] = true
+		err = cleanFetchErrors(err)
+		r.hostFailed(ctx, host, dgst, err)
+		return nil, err
 	}
 
 	// Check if upstream allows for ranged GET requests
@@ -185,7 +548,53 @@ func (r *orasBlobStore) FetchRange(ctx context.Context, reference string, lower,
 		resp.Body.Close()
 		return nil, fmt.Errorf("upstream repo does not support ranged GET requests")
 	}
-	return resp.Body, nil
+	body := &rangeBody{
+		ReadCloser: resp.Body,
+		remaining:  size,
+		truncated: func(err error) {
+			r.hostFailed(ctx, host, dgst, err)
+		},
+	}
+	if r.policy.verifyRanges && coversBlob(resp, lower, upper) {
+		return newVerifyingReader(body, digest.Digest(dgst), func(err error) {
+			r.hostFailed(ctx, host, dgst, err)
+		})
+	}
+	return body, nil
+}
+
+// rangeSize returns the number of bytes of the range [lower, upper] in resp, which is
+// fewer than requested if the Content-Range of resp shows that the blob ends before upper.
+func rangeSize(resp *http.Response, lower, upper int64) int64 {
+	if n, ok := blobSize(resp); ok && n > lower {
+		upper = min(upper, n-1)
+	}
+	return upper - lower + 1
+}
+
+// rangeBody is the body of the response to a range request of size bytes. Reading it fails
+// with ErrTruncatedRange if it ends early, e.g. because a caching proxy in front of the host
+// truncated it, in which case truncated is called so that later requests skip the host.
+type rangeBody struct {
+	io.ReadCloser
+	remaining int64
+	truncated func(error)
+}
+
+func (b *rangeBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining > 0 && (errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)) {
+		err = fmt.Errorf("%w: %d bytes missing", ErrTruncatedRange, b.remaining)
+		b.truncated(err)
+	}
+	return n, err
 }
 
 func cleanFetchErrors(err error) error {
@@ -196,6 +605,9 @@ func cleanFetchErrors(err error) error {
 		return retErr
 	// Eat URL errors as a malformed URL might still have credentials.
 	case *url.Error:
+		if errors.Is(retErr, ErrMirrorResolveTimeout) {
+			return ErrMirrorResolveTimeout
+		}
 		return errors.New("URL error during fetch")
 	// Otherwise it should be safe to print
 	default:
@@ -206,55 +618,149 @@ func cleanFetchErrors(err error) error {
 // doInitialFetch makes a dummy call to the specified content, allowing the authClient
 // to make a single request to pre-populate fields for future requests for the same content.
 // This is only called in the ParallelPull path as sparse index cases will only ever call each layer sequentially.
+// If the host of the content fails, another registry host is selected for it, and the
+// errors of all hosts are returned if every host fails. If ctx is canceled, the request
+// in flight is aborted and the error of ctx is returned.
 func (r *orasBlobStore) doInitialFetch(ctx context.Context, reference string) (bool, error) {
 	ref, err := registry.ParseReference(reference)
 	if err != nil {
 		return false, err
 	}
 
-	tr := &clientWrapper{r.Client}
-	url := r.buildBlobURL(ref.Reference)
-	resp, err := sociremote.GetHeaderWithGet(ctx, url, tr)
-	if err != nil {
-		return false, fmt.Errorf("error getting header info: %v", err)
+	var failures []*HostError
+	tried := make(map[int]bool)
+	for {
+		repo, pathPrefix, host, err := r.blobHost(ref.Reference, tried)
+		if host < 0 {
+			return false, fmt.Errorf("error getting header info: %w", &AllHostsFailedError{Hosts: failures})
+		}
+		if err == nil {
+			if err := r.waitHost(ctx, host); err != nil {
+				return false, err
+			}
+			var resp *http.Response
+			logBlobURL(ctx, repo, pathPrefix, ref.Reference)
+			resp, err = getHeaderWithTimeout(ctx, buildBlobURL(repo, pathPrefix, ref.Reference), &clientWrapper{repo.Client}, r.policy.timeout)
+			if abortedByCaller(ctx, err) {
+				return false, ctx.Err()
+			}
+			r.recordRequest(host, tried, err)
+			if err == nil {
+				return acceptsRanges(resp), nil
+			}
+			r.hostFailed(ctx, host, ref.Reference, err)
+		}
+		failures = append(failures, &HostError{Host: hostName(r.hosts, host, r.refspec), Err: err})
+		tried[host] = true
+	}
+}
+
+// waitHost waits until the rate limit of the policy allows a request to the host
+// at index i, or ctx is done.
+func (r *orasBlobStore) waitHost(ctx context.Context, i int) error {
+	return r.policy.rateLimiter.Wait(ctx, hostName(r.hosts, i, r.refspec))
+}
+
+// abortedByCaller returns whether a request that failed with err was aborted because ctx
+// is done, e.g. because containerd canceled the prepare of the snapshot, rather than
+// failed by its host. Such requests aren't failed over to other hosts.
+func abortedByCaller(ctx context.Context, err error) bool {
+	return err != nil && ctx.Err() != nil
+}
+
+// hostName returns the name of hosts[i], or the registry of refspec if there are no hosts.
+func hostName(hosts []docker.RegistryHost, i int, refspec reference.Spec) string {
+	if i < len(hosts) {
+		return hosts[i].Host
 	}
+	return refspec.Hostname()
+}
+
+// getHeaderWithTimeout gets the header of the blob at url, waiting at most timeout for the host.
+func getHeaderWithTimeout(ctx context.Context, url string, tr http.RoundTripper, timeout time.Duration) (*http.Response, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return sociremote.GetHeaderWithGet(ctx, url, tr)
+}
+
+// acceptsRanges returns whether the host of resp allows ranged GET requests.
+func acceptsRanges(resp *http.Response) bool {
 	socihttp.Drain(resp.Body)
 
 	// Check if upstream allows for ranged GET requests
-	if rangeUnit := resp.Header.Get("Accept-Ranges"); rangeUnit == "bytes" {
-		return true, nil
-	}
-	return false, nil
+	return resp.Header.Get("Accept-Ranges") == "bytes"
 }
 
 // buildBlobURL constructs a mirror-aware blob URL.
-// It takes the digest reference string and builds the full URL using the repository's
-// host/repo (which may be a mirror) and the appropriate scheme (http/https).
+// It takes the digest reference string and builds the full URL using the host/repo
+// the blob is fetched from (which may be a mirror) and the appropriate scheme (http/https).
 func (r *orasBlobStore) buildBlobURL(digestRef string) string {
+	repo, pathPrefix, _, err := r.blobHost(digestRef, nil)
+	if err != nil {
+		repo, pathPrefix = r.Repository, r.pathPrefix
+	}
+	return buildBlobURL(repo, pathPrefix, digestRef)
+}
+
+func buildBlobURL(repo *remote.Repository, pathPrefix, digestRef string) string {
 	// Copy the repository reference and set the digest
-	repoRef := r.Repository.Reference
+	repoRef := repo.Reference
 	repoRef.Reference = digestRef
 
 	scheme := "https"
-	if r.Repository.PlainHTTP {
+	if repo.PlainHTTP {
 		scheme = "http"
 	}
 
-	// Avoid double slashes if pathPrefix already starts with /
-	// pathPrefix is expected to start with / (e.g. /v2 or /custom/path)
 	// The URL format is: scheme://host/pathPrefix/repo/blobs/digest
-	// We use path.Join for the path part to be safe
-
 	// repoRef.Repository contains the repository path (e.g. library/ubuntu)
-	// r.pathPrefix contains the API root (e.g. /v2 or /custom)
+	// pathPrefix contains the API root (e.g. /v2 or /custom)
 
 	// Note: We must manually construct this because path.Join will clean the path,
 	// but we want to ensure we match the registry URL structure exactly.
+	return fmt.Sprintf("%s://%s%s/%s/blobs/%s", scheme, normalizeHost(repoRef.Host()), normalizeAPIPath(pathPrefix), repoRef.Repository, repoRef.Reference)
+}
 
-	// Strip leading slash from pathPrefix for easier joining
-	prefix := strings.TrimPrefix(r.pathPrefix, "/")
+// logBlobURL logs the parts of the URL of the blob dgst built by buildBlobURL at debug level,
+// e.g. to debug the API roots of mirrors.
+func logBlobURL(ctx context.Context, repo *remote.Repository, pathPrefix, dgst string) {
+	logger := log.G(ctx)
+	if !logger.Logger.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+	logger.WithFields(log.Fields{
+		"host":       repo.Reference.Host(),
+		"path":       normalizeAPIPath(pathPrefix),
+		"repository": repo.Reference.Repository,
+		"digest":     dgst,
+		"reference":  fmt.Sprintf("%s/%s@%s", repo.Reference.Host(), repo.Reference.Repository, dgst),
+	}).Debug("resolved blob URL")
+}
 
-	return fmt.Sprintf("%s://%s/%s/%s/blobs/%s", scheme, repoRef.Host(), prefix, repoRef.Repository, repoRef.Reference)
+// normalizeAPIPath returns the API root p of a registry host with exactly one leading
+// slash and no trailing slash, e.g. "/v2" for "v2" or "/v2/". It returns "/v2" if p is empty.
+func normalizeAPIPath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "/v2"
+	}
+	return "/" + p
+}
+
+// normalizeHost returns the name of a registry host with IPv6 literals in brackets,
+// e.g. "[fd00::1]:5000" for "[fd00::1]:5000" and "[fd00::1]" for "fd00::1", so that
+// their colons aren't taken for the separator of a port.
+func normalizeHost(host string) string {
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		return net.JoinHostPort(h, port)
+	}
+	if literal := strings.Trim(host, "[]"); strings.Contains(literal, ":") && net.ParseIP(literal) != nil {
+		return "[" + literal + "]"
+	}
+	return host
 }
 
 // This wrapper is to allow a [remote.Client] to implement the
@@ -267,21 +773,163 @@ func (c *clientWrapper) RoundTrip(req *http.Request) (*http.Response, error) {
 	return c.Client.Do(req)
 }
 
-func newRemoteStore(refspec reference.Spec, client *http.Client, hosts []docker.RegistryHost) (*remote.Repository, error) {
+// newRemoteStore returns a repository for the image of refspec on hosts, in order. If there
+// are several hosts, requests are sent to the first host that didn't recently fail, and fail over
+// to the next hosts if it fails them. See failoverClient. client is used for the first host.
+// The other hosts use their own client, if any. If the policy falls back to the origin,
+// the registry of refspec is tried after hosts.
+func newRemoteStore(ctx context.Context, refspec reference.Spec, client *http.Client, hosts []docker.RegistryHost, policy hostPolicy) (*remote.Repository, error) {
+	hosts, err := policy.withOrigin(refspec, hosts)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) <= 1 {
+		// There is no other host to fail over to.
+		return policy.hostRemoteStore(refspec, policy.hostClient(client, hosts, 0), hosts)
+	}
+	cooldown := policy.cooldown
+	if cooldown == nil {
+		cooldown = newHostCooldown(defaultHostCooldown)
+	}
+	return newFailoverRemoteStore(refspec, client, hosts, policy, cooldown)
+}
+
+// selectRemoteStore returns a repository for the image of refspec on the first of hosts, in order,
+// that didn't recently fail according to cooldown, or on the first host if all of them did, and
+// the index of the host. Hosts aren't contacted, so that failing hosts are only skipped once
+// requests to them fail.
+func selectRemoteStore(refspec reference.Spec, client *http.Client, hosts []docker.RegistryHost, policy hostPolicy, cooldown *hostCooldown) (*remote.Repository, int, error) {
+	if len(hosts) <= 1 {
+		repo, err := policy.hostRemoteStore(refspec, policy.hostClient(client, hosts, 0), hosts)
+		return repo, 0, err
+	}
+	i := firstAvailableHost(hosts, cooldown)
+	repo, err := policy.hostRemoteStore(refspec, policy.hostClient(client, hosts, i), hosts[i:i+1])
+	return repo, i, err
+}
+
+// firstAvailableHost returns the index of the first of hosts that didn't recently fail
+// according to cooldown, or 0 if all of them did.
+func firstAvailableHost(hosts []docker.RegistryHost, cooldown *hostCooldown) int {
+	for i, h := range hosts {
+		if !cooldown.cooling(h) {
+			return i
+		}
+	}
+	return 0
+}
+
+// hostClient returns the client to use for hosts[i]: client for the first host,
+// and the client of the host for the others, if any, caching redirects if client does.
+// Its transport is tuned by the policy.
+func (p hostPolicy) hostClient(client *http.Client, hosts []docker.RegistryHost, i int) *http.Client {
+	if i > 0 && hosts[i].Client != nil {
+		if cachesRedirects(client) {
+			client = redirectCachingClient(hosts[i].Client)
+		} else {
+			client = hosts[i].Client
+		}
+	}
+	return p.withTransportConfig(client)
+}
+
+// cachesRedirects returns whether client caches the redirects of registry hosts, e.g. to
+// the storage of blobs, so that the ranges of a blob aren't redirected again.
+func cachesRedirects(client *http.Client) bool {
+	if client == nil {
+		return false
+	}
+	authClient, ok := client.Transport.(*socihttp.AuthClient)
+	return ok && authClient.CachesRedirects()
+}
+
+// redirectCachingClient returns a clone of client that caches redirects, with an empty cache.
+// The clone keeps the transport of client, e.g. its TLS configuration. client is returned
+// as is if it doesn't authenticate its requests, since only the AuthClient caches redirects.
+func redirectCachingClient(client *http.Client) *http.Client {
+	authClient, ok := client.Transport.(*socihttp.AuthClient)
+	if !ok {
+		return client
+	}
+	retryClient := resolver.CloneRetryableClient(authClient.Client())
+	retryClient.HTTPClient.Transport = authClient.Client().HTTPClient.Transport
+	newAuthClient := authClient.CloneWithNewClient(retryClient)
+	newAuthClient.CacheRedirects(true)
+	return &http.Client{Transport: newAuthClient}
+}
+
+// probeStatusError returns the error of a probe answered with status, if it failed.
+func probeStatusError(status int) error {
+	if status >= http.StatusInternalServerError {
+		return fmt.Errorf("%w: %d %s", sociremote.ErrUnexpectedStatusCode, status, http.StatusText(status))
+	}
+	return nil
+}
+
+// pingHost sends an unauthenticated request to the registry API of host, waiting
+// at most timeout for it to answer, and returns the status of its response.
+func pingHost(ctx context.Context, client *http.Client, host docker.RegistryHost, timeout time.Duration) (int, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	scheme := host.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s://%s%s/", scheme, normalizeHost(host.Host), normalizeAPIPath(host.Path)), nil)
+	if err != nil {
+		return 0, err
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if authClient, ok := client.Transport.(*socihttp.AuthClient); ok {
+		client = authClient.Client().HTTPClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, socihttp.RedactHTTPQueryValuesFromError(err)
+	}
+	defer socihttp.Drain(resp.Body)
+	return resp.StatusCode, nil
+}
+
+// hostRemoteStore is newHostRemoteStore with the client, scheme and repository prefix of the policy.
+// The repository prefix only applies to hosts[0], so it never applies to the registry of refspec
+// if there are no hosts.
+func (p hostPolicy) hostRemoteStore(refspec reference.Spec, client *http.Client, hosts []docker.RegistryHost) (*remote.Repository, error) {
+	repo, err := newHostRemoteStore(refspec, p.wrapClient(client), hosts)
+	if err != nil {
+		return nil, err
+	}
+	host := refspec.Hostname()
+	if len(hosts) > 0 {
+		host = hosts[0].Host
+		if prefix := strings.Trim(p.repositoryPrefixes[host], "/"); prefix != "" {
+			repo.Reference.Repository = path.Join(prefix, repo.Reference.Repository)
+		}
+	}
+	repo.PlainHTTP = p.plainHTTP(refspec, host, repo.PlainHTTP)
+	return repo, nil
+}
+
+// newHostRemoteStore returns a repository for the image of refspec on hosts[0],
+// or on the registry of refspec if there are no hosts.
+func newHostRemoteStore(refspec reference.Spec, client *http.Client, hosts []docker.RegistryHost) (*remote.Repository, error) {
+	// repository suffix excludes the original hostname
+	repoSuffix := repositoryPath(refspec)
 	// Default to the original locator
-	mirrorLocator := refspec.Locator
+	mirrorLocator := path.Join(refspec.Hostname(), repoSuffix)
 	plainHTTP := false
 
 	// If registry hosts are provided (e.g., from containerd certs.d/hosts.toml),
 	// construct a mirror-aware locator and scheme.
 	if len(hosts) > 0 {
-		// Currently, we only use the first configured host/mirror.
-		// Future improvement: implement failover logic if the first mirror is unreachable.
 		h := hosts[0]
-		// repository suffix excludes the original hostname
-		repoSuffix := strings.TrimPrefix(refspec.Locator, refspec.Hostname()+"/")
 		// Do NOT include h.Path (e.g., /v2) in the repository locator
-		mirrorLocator = path.Join(h.Host, repoSuffix)
+		mirrorLocator = path.Join(normalizeHost(h.Host), repoSuffix)
 		if h.Scheme == "http" {
 			plainHTTP = true
 		}
@@ -304,6 +952,18 @@ func newRemoteStore(refspec reference.Spec, client *http.Client, hosts []docker.
 	return repo, nil
 }
 
+// repositoryPath returns the repository of refspec without its hostname. Short names of
+// Docker Hub images, e.g. docker.io/ubuntu, are expanded to their library/ repository,
+// since mirrors of Docker Hub don't necessarily expand them.
+func repositoryPath(refspec reference.Spec) string {
+	repo := strings.TrimPrefix(refspec.Locator, refspec.Hostname()+"/")
+	named, err := distribution.ParseNormalizedNamed(refspec.Locator)
+	if err != nil || distribution.Domain(named) != refspec.Hostname() {
+		return repo
+	}
+	return distribution.Path(named)
+}
+
 // Constructs a new artifact fetcher
 // Takes in the image reference, the local store and the resolver
 func newArtifactFetcher(refspec reference.Spec, localStore store.BasicStore, remoteStore resolverStorage) (*artifactFetcher, error) {
@@ -374,31 +1034,52 @@ func (f *artifactFetcher) Store(ctx context.Context, desc ocispec.Descriptor, re
 	return nil
 }
 
-func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc ocispec.Descriptor, localStore store.Store, remoteStore resolverStorage) (*soci.Index, error) {
+// FetchSociArtifacts fetches the SOCI index described by indexDesc and its zTOCs and stores them
+// in localStore. Unless skipIndexDigestVerification is set, the index bytes are verified against
+// the digest of indexDesc before they are parsed.
+func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc ocispec.Descriptor, localStore store.Store, remoteStore resolverStorage, skipIndexDigestVerification bool) (*soci.Index, error) {
 	fetcher, err := newArtifactFetcher(refspec, localStore, remoteStore)
 	if err != nil {
 		return nil, fmt.Errorf("could not create an artifact fetcher: %w", err)
 	}
 
-	log.G(ctx).WithField("digest", indexDesc.Digest).Infof("fetching SOCI index from remote registry")
+	var (
+		indexBytes []byte
+		local      bool
+	)
+	if indexDesc.Data != nil {
+		// The index was found inline, e.g. in an image manifest annotation.
+		indexBytes = indexDesc.Data
+	} else {
+		log.G(ctx).WithField("digest", indexDesc.Digest).Infof("fetching SOCI index from remote registry")
 
-	indexReader, local, err := fetcher.Fetch(ctx, indexDesc)
-	if err != nil {
-		return nil, fmt.Errorf("unable to fetch SOCI index: %w", err)
-	}
-	defer indexReader.Close()
+		var indexReader io.ReadCloser
+		indexReader, local, err = fetcher.Fetch(ctx, indexDesc)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch SOCI index: %w", err)
+		}
+		defer indexReader.Close()
 
-	tr := ioutils.NewPositionTrackerReader(indexReader)
+		indexBytes, err = io.ReadAll(indexReader)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read SOCI index: %w", err)
+		}
+	}
+	if !skipIndexDigestVerification {
+		if err := verifyIndexDigest(indexDesc, indexBytes); err != nil {
+			return nil, err
+		}
+	}
 
 	var index soci.Index
-	err = soci.DecodeIndex(tr, &index)
+	err = soci.UnmarshalIndex(indexBytes, &index)
 	if err != nil {
 		return nil, fmt.Errorf("cannot deserialize byte data to index: %w", err)
 	}
 
 	desc := ocispec.Descriptor{
 		Digest: indexDesc.Digest,
-		Size:   tr.CurrentPos(),
+		Size:   int64(len(indexBytes)),
 	}
 
 	// batch will prevent content from being garbage collected in the middle of the following operations
@@ -413,6 +1094,15 @@ func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc o
 		if err != nil {
 			return nil, err
 		}
+		if skipIndexDigestVerification {
+			// The claimed digest may not match the index, and the local store verifies
+			// pushed bytes, so the index is stored under the digest of its bytes.
+			if actual := digest.FromBytes(b); actual != desc.Digest {
+				log.G(ctx).WithField("digest", indexDesc.Digest).WithField("actual", actual).Warn("SOCI index doesn't match its digest; storing it under its actual digest")
+				desc.Digest = actual
+				desc.Size = int64(len(b))
+			}
+		}
 
 		err = localStore.Push(ctx, desc, bytes.NewReader(b))
 		if err != nil && !store.IsErrAlreadyExists(err) {
@@ -449,3 +1139,15 @@ func FetchSociArtifacts(ctx context.Context, refspec reference.Spec, indexDesc o
 
 	return &index, nil
 }
+
+// verifyIndexDigest checks that the SOCI index bytes match the digest of the index descriptor,
+// so that data not matching the digest found during discovery is never parsed.
+func verifyIndexDigest(indexDesc ocispec.Descriptor, b []byte) error {
+	if err := indexDesc.Digest.Validate(); err != nil {
+		return fmt.Errorf("%w: invalid digest %q: %w", ErrIndexDigestMismatch, indexDesc.Digest, err)
+	}
+	if actual := indexDesc.Digest.Algorithm().FromBytes(b); actual != indexDesc.Digest {
+		return fmt.Errorf("%w: %w: expected %v, got %v", ErrIndexDigestMismatch, content.ErrMismatchedDigest, indexDesc.Digest, actual)
+	}
+	return nil
+}
@@ -23,11 +23,19 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/soci/store"
 	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
 	"github.com/google/go-cmp/cmp"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -286,7 +294,7 @@ func TestNewRemoteStore(t *testing.T) {
 			if err != nil {
 				t.Fatalf("unexpected failure parsing reference: %v", err)
 			}
-			r, err := newRemoteStore(refspec, &client, nil)
+			r, err := newRemoteStore(context.Background(), refspec, &client, nil, hostPolicy{})
 			if err != nil {
 				t.Fatalf("unexpected error, got %v", err)
 			}
@@ -351,7 +359,15 @@ func TestFetchSociArtifacts(t *testing.T) {
 				sociIndexDesc.Digest: modifiedSociBytes,
 				fakeZtocDesc.Digest:  fakeZtoc,
 			},
-			expectedError: content.ErrMismatchedDigest,
+			expectedError: ErrIndexDigestMismatch,
+		},
+		{
+			name: "index data not matching the claimed digest fails before parsing",
+			remoteContents: map[digest.Digest][]byte{
+				sociIndexDesc.Digest: []byte("not a SOCI index"),
+				fakeZtocDesc.Digest:  fakeZtoc,
+			},
+			expectedError: ErrIndexDigestMismatch,
 		},
 		{
 			name: "modified ztoc data fails",
@@ -366,7 +382,7 @@ func TestFetchSociArtifacts(t *testing.T) {
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			ctx := context.Background()
-			_, err = FetchSociArtifacts(ctx, reference.Spec{}, sociIndexDesc, newFakeLocalStore(), newFakeRemoteStoreWithContents(test.remoteContents))
+			_, err = FetchSociArtifacts(ctx, reference.Spec{}, sociIndexDesc, newFakeLocalStore(), newFakeRemoteStoreWithContents(test.remoteContents), false)
 			if !errors.Is(err, test.expectedError) {
 				t.Fatalf("unexpected error, got: %v. expected: %v", err, test.expectedError)
 			}
@@ -374,6 +390,40 @@ func TestFetchSociArtifacts(t *testing.T) {
 	}
 }
 
+func TestFetchSociArtifactsSkipIndexDigestVerification(t *testing.T) {
+	sociIndex := soci.NewIndex(soci.V2, nil, nil, nil)
+	sociBytes, err := soci.MarshalIndex(sociIndex)
+	if err != nil {
+		t.Fatalf("failed to serialize soci index: %v", err)
+	}
+	// The index is discovered with an untrusted digest that doesn't match its contents.
+	untrustedDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Size:      int64(len(sociBytes)),
+		Digest:    digest.FromString("untrusted"),
+	}
+	remoteContents := map[digest.Digest][]byte{untrustedDesc.Digest: sociBytes}
+
+	ctx := context.Background()
+	_, err = FetchSociArtifacts(ctx, reference.Spec{}, untrustedDesc, newFakeLocalStore(), newFakeRemoteStoreWithContents(remoteContents), false)
+	if !errors.Is(err, ErrIndexDigestMismatch) {
+		t.Fatalf("unexpected error, got: %v. expected: %v", err, ErrIndexDigestMismatch)
+	}
+
+	localStore := newFakeLocalStore()
+	index, err := FetchSociArtifacts(ctx, reference.Spec{}, untrustedDesc, localStore, newFakeRemoteStoreWithContents(remoteContents), true)
+	if err != nil {
+		t.Fatalf("expected fetch to succeed when verification is skipped; got %v", err)
+	}
+	if index == nil {
+		t.Fatal("expected a SOCI index")
+	}
+	exists, err := localStore.Exists(ctx, ocispec.Descriptor{Digest: digest.FromBytes(sociBytes), Size: int64(len(sociBytes))})
+	if err != nil || !exists {
+		t.Fatalf("expected the index to be stored under its actual digest; exists: %v, err: %v", exists, err)
+	}
+}
+
 func newFakeArtifactFetcher(ref string, contents []byte) (*artifactFetcher, error) {
 	refspec, err := reference.Parse(ref)
 	if err != nil {
@@ -446,3 +496,264 @@ func (f *fakeRemoteStore) Resolve(_ context.Context, ref string) (ocispec.Descri
 		Size: int64(len(f.defaultContents)),
 	}, nil
 }
+
+func TestFetchRangeRetry(t *testing.T) {
+	blob := []byte("layer contents")
+	dgst := digest.FromBytes(blob)
+
+	testCases := []struct {
+		name             string
+		failures         []int
+		retry            config.RetryConfig
+		expectedAttempts int
+		expectErr        bool
+	}{
+		{
+			name:             "succeeds after retryable failures",
+			failures:         []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			retry:            config.RetryConfig{MaxRetries: 2, MinWaitMsec: 1, MaxWaitMsec: 10},
+			expectedAttempts: 3,
+		},
+		{
+			name:             "fails when retries are exhausted",
+			failures:         []int{http.StatusTooManyRequests, http.StatusServiceUnavailable},
+			retry:            config.RetryConfig{MaxRetries: 1, MinWaitMsec: 1, MaxWaitMsec: 10},
+			expectedAttempts: 2,
+			expectErr:        true,
+		},
+		{
+			name:             "does not retry other statuses",
+			failures:         []int{http.StatusServiceUnavailable},
+			retry:            config.RetryConfig{MaxRetries: 2, MinWaitMsec: 1, MaxWaitMsec: 10, RetryStatusCodes: []int{http.StatusTooManyRequests}},
+			expectedAttempts: 1,
+			expectErr:        true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/blobs/"+dgst.String()) {
+					return
+				}
+				n := int(attempts.Add(1))
+				if n <= len(tc.failures) {
+					w.WriteHeader(tc.failures[n-1])
+					return
+				}
+				w.Header().Set("Accept-Ranges", "bytes")
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+			}))
+			defer srv.Close()
+
+			refspec, err := reference.Parse(strings.TrimPrefix(srv.URL, "http://") + "/repo:tag")
+			if err != nil {
+				t.Fatalf("failed to parse reference: %v", err)
+			}
+			httpConfig := config.RetryableHTTPClientConfig{RetryConfig: tc.retry}
+			hosts, err := resolver.NewRegistryManager(httpConfig, config.ResolverConfig{}, nil).AsRegistryHosts()(refspec)
+			if err != nil {
+				t.Fatalf("failed to get registry hosts: %v", err)
+			}
+			store, err := newRemoteBlobStore(context.Background(), refspec, hosts[0].Client, hosts, hostPolicy{})
+			if err != nil {
+				t.Fatalf("newRemoteBlobStore failed: %v", err)
+			}
+
+			rc, err := store.FetchRange(context.Background(), constructRef(refspec, ocispec.Descriptor{Digest: dgst}), 0, int64(len(blob)-1))
+			if got := int(attempts.Load()); got != tc.expectedAttempts {
+				t.Fatalf("expected %d attempts; got %d", tc.expectedAttempts, got)
+			}
+			if tc.expectErr {
+				if err == nil {
+					rc.Close()
+					t.Fatal("expected FetchRange to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FetchRange failed: %v", err)
+			}
+			defer rc.Close()
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("failed to read range: %v", err)
+			}
+			if !bytes.Equal(got, blob) {
+				t.Fatalf("expected %q; got %q", blob, got)
+			}
+		})
+	}
+}
+
+func TestFetchRangeTruncated(t *testing.T) {
+	blob := []byte("layer contents")
+	dgst := digest.FromBytes(blob)
+	truncated := blob[:len(blob)-4]
+
+	newServer := func(handler func(w http.ResponseWriter)) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, "/blobs/"+dgst.String()) {
+				return
+			}
+			w.Header().Set("Accept-Ranges", "bytes")
+			handler(w)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	// shortLength answers with a Content-Length matching its truncated body.
+	shortLength := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(truncated)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(truncated)
+	}
+	// shortBody answers with the Content-Length of the range but a truncated body.
+	shortBody := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(truncated)
+	}
+	full := func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusOK)
+		w.Write(blob)
+	}
+	hostOf := func(srv *httptest.Server) docker.RegistryHost {
+		return docker.RegistryHost{Host: strings.TrimPrefix(srv.URL, "http://"), Scheme: "http", Path: "/v2"}
+	}
+
+	refspec, err := reference.Parse("registry.example.com/repo:tag")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	ref := constructRef(refspec, ocispec.Descriptor{Digest: dgst})
+
+	testCases := []struct {
+		name     string
+		handlers []func(w http.ResponseWriter)
+		// expectFetchErr is whether the truncation is detected before reading the body.
+		expectFetchErr bool
+		expectReadErr  bool
+	}{
+		{
+			name:           "short Content-Length",
+			handlers:       []func(w http.ResponseWriter){shortLength},
+			expectFetchErr: true,
+		},
+		{
+			name:          "body shorter than Content-Length",
+			handlers:      []func(w http.ResponseWriter){shortBody},
+			expectReadErr: true,
+		},
+		{
+			name:     "fails over to the next host",
+			handlers: []func(w http.ResponseWriter){shortLength, full},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var hosts []docker.RegistryHost
+			for _, h := range tc.handlers {
+				hosts = append(hosts, hostOf(newServer(h)))
+			}
+			store, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{})
+			if err != nil {
+				t.Fatalf("newRemoteBlobStore failed: %v", err)
+			}
+
+			rc, err := store.FetchRange(context.Background(), ref, 0, int64(len(blob)-1))
+			if tc.expectFetchErr {
+				if !errors.Is(err, ErrTruncatedRange) {
+					t.Fatalf("expected %v; got %v", ErrTruncatedRange, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FetchRange failed: %v", err)
+			}
+			defer rc.Close()
+			got, err := io.ReadAll(rc)
+			if tc.expectReadErr {
+				if !errors.Is(err, ErrTruncatedRange) {
+					t.Fatalf("expected %v; got %v", ErrTruncatedRange, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read range: %v", err)
+			}
+			if !bytes.Equal(got, blob) {
+				t.Fatalf("expected %q; got %q", blob, got)
+			}
+		})
+	}
+}
+
+func TestDoInitialFetchCanceled(t *testing.T) {
+	dgst := digest.FromString("layer")
+	// slow answers blob requests once they are canceled or the test ends.
+	newSlowServer := func(requests *atomic.Int32, started chan<- struct{}) docker.RegistryHost {
+		release := make(chan struct{})
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, "/blobs/"+dgst.String()) {
+				return
+			}
+			requests.Add(1)
+			if started != nil {
+				started <- struct{}{}
+			}
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}))
+		t.Cleanup(srv.Close)
+		t.Cleanup(func() { close(release) })
+		return docker.RegistryHost{Host: strings.TrimPrefix(srv.URL, "http://"), Scheme: "http", Path: "/v2"}
+	}
+
+	var primaryRequests, fallbackRequests atomic.Int32
+	started := make(chan struct{}, 1)
+	hosts := []docker.RegistryHost{
+		newSlowServer(&primaryRequests, started),
+		newSlowServer(&fallbackRequests, nil),
+	}
+	refspec, err := reference.Parse("registry.example.com/repo:tag")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	store, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{})
+	if err != nil {
+		t.Fatalf("newRemoteBlobStore failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := store.doInitialFetch(ctx, constructRef(refspec, ocispec.Descriptor{Digest: dgst}))
+		errCh <- err
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the primary host to be requested")
+	}
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected %v; got %v", context.Canceled, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected doInitialFetch to return promptly after its context was canceled")
+	}
+	if n := fallbackRequests.Load(); n != 0 {
+		t.Fatalf("expected canceled fetch not to fail over; got %d fallback requests", n)
+	}
+	if store.cooldown.cooling(hosts[0]) {
+		t.Fatal("expected the primary host not to be skipped after a canceled fetch")
+	}
+}
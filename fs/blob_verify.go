@@ -0,0 +1,90 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrBlobDigestMismatch is returned when the content of a blob fetched from a registry
+// host doesn't match its digest, e.g. because a mirror serves poisoned content.
+var ErrBlobDigestMismatch = errors.New("blob digest mismatch")
+
+// verifyingReader verifies that the content read from a blob matches its digest.
+// Reading the end of the content fails with ErrBlobDigestMismatch if it doesn't,
+// in which case mismatch is called, e.g. so that later requests skip the host.
+type verifyingReader struct {
+	io.ReadCloser
+	dgst     digest.Digest
+	verifier digest.Verifier
+	mismatch func(error)
+}
+
+// newVerifyingReader returns rc verifying that its content matches dgst.
+func newVerifyingReader(rc io.ReadCloser, dgst digest.Digest, mismatch func(error)) (io.ReadCloser, error) {
+	if err := dgst.Validate(); err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("cannot verify blob %s: %w", dgst, err)
+	}
+	return &verifyingReader{
+		ReadCloser: rc,
+		dgst:       dgst,
+		verifier:   dgst.Verifier(),
+		mismatch:   mismatch,
+	}, nil
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.verifier.Write(p[:n])
+	if err == io.EOF && !r.verifier.Verified() {
+		err = fmt.Errorf("%w: content of %s doesn't match its digest", ErrBlobDigestMismatch, r.dgst)
+		r.mismatch(err)
+	}
+	return n, err
+}
+
+// blobSize returns the size of the blob a range response is for,
+// as shown by its Content-Range, if it does.
+func blobSize(resp *http.Response) (int64, bool) {
+	_, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(total, 10, 64)
+	return n, err == nil
+}
+
+// coversBlob returns whether the response to the range request [lower, upper]
+// is the whole content of the blob, whose digest it can then be verified against.
+func coversBlob(resp *http.Response, lower, upper int64) bool {
+	if lower != 0 {
+		return false
+	}
+	if size, ok := blobSize(resp); ok {
+		return upper >= size-1
+	}
+	// Hosts that ignore the range answer with the whole blob.
+	return resp.StatusCode == http.StatusOK && resp.ContentLength >= 0 && upper >= resp.ContentLength-1
+}
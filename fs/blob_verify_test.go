@@ -0,0 +1,136 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestBlobDigestVerification(t *testing.T) {
+	blob := []byte("layer contents")
+	poisoned := []byte("layer poisoned")
+	dgst := digest.FromBytes(blob)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content := blob
+		if strings.HasPrefix(r.URL.Path, "/v2/poisoned/") {
+			content = poisoned
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	last := int64(len(blob) - 1)
+
+	tests := []struct {
+		name         string
+		repo         string
+		verifyRanges bool
+		// fetch fetches the blob of ref from store.
+		fetch     func(store *orasBlobStore, ref string) (io.ReadCloser, error)
+		expectErr bool
+	}{
+		{
+			name:  "blob",
+			repo:  "repo",
+			fetch: fetchBlob(dgst, len(blob)),
+		},
+		{
+			name:      "poisoned blob",
+			repo:      "poisoned",
+			fetch:     fetchBlob(dgst, len(blob)),
+			expectErr: true,
+		},
+		{
+			// e.g. by the parallel fetcher, once the blob is written to disk.
+			name: "poisoned blob verified by the caller",
+			repo: "poisoned",
+			fetch: func(store *orasBlobStore, _ string) (io.ReadCloser, error) {
+				return store.fetch(context.Background(), ocispec.Descriptor{Digest: dgst, Size: int64(len(blob))}, false)
+			},
+		},
+		{
+			name:         "poisoned range of the whole blob",
+			repo:         "poisoned",
+			verifyRanges: true,
+			fetch:        fetchBlobRange(0, last),
+			expectErr:    true,
+		},
+		{
+			name:  "poisoned range without verification",
+			repo:  "poisoned",
+			fetch: fetchBlobRange(0, last),
+		},
+		{
+			name:         "poisoned range of part of the blob",
+			repo:         "poisoned",
+			verifyRanges: true,
+			fetch:        fetchBlobRange(0, last-1),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			refspec, err := reference.Parse(host + "/" + tc.repo + ":tag")
+			if err != nil {
+				t.Fatalf("failed to parse reference: %v", err)
+			}
+			store, err := newRemoteBlobStore(context.Background(), refspec, srv.Client(), nil, hostPolicy{verifyRanges: tc.verifyRanges})
+			if err != nil {
+				t.Fatalf("newRemoteBlobStore failed: %v", err)
+			}
+			rc, err := tc.fetch(store, refspec.Locator+"@"+dgst.String())
+			if err != nil {
+				t.Fatalf("failed to fetch blob: %v", err)
+			}
+			defer rc.Close()
+			_, err = io.ReadAll(rc)
+			if tc.expectErr {
+				if !errors.Is(err, ErrBlobDigestMismatch) {
+					t.Fatalf("expected %v; got %v", ErrBlobDigestMismatch, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read blob: %v", err)
+			}
+		})
+	}
+}
+
+func fetchBlob(dgst digest.Digest, size int) func(*orasBlobStore, string) (io.ReadCloser, error) {
+	return func(store *orasBlobStore, _ string) (io.ReadCloser, error) {
+		return store.Fetch(context.Background(), ocispec.Descriptor{Digest: dgst, Size: int64(size)})
+	}
+}
+
+func fetchBlobRange(lower, upper int64) func(*orasBlobStore, string) (io.ReadCloser, error) {
+	return func(store *orasBlobStore, ref string) (io.ReadCloser, error) {
+		return store.FetchRange(context.Background(), ref, lower, upper)
+	}
+}
@@ -20,6 +20,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/awslabs/soci-snapshotter/soci"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -28,6 +30,9 @@ import (
 
 var (
 	ErrNoReferrers = errors.New("no existing referrers")
+	// ErrUnsupportedIndexVersion is returned when an image only has SOCI indices of
+	// versions newer than the ones this snapshotter supports.
+	ErrUnsupportedIndexVersion = errors.New("unsupported SOCI index version")
 )
 
 // Determines which index will be selected from a list of index descriptors
@@ -37,6 +42,66 @@ func SelectFirstPolicy(descs []ocispec.Descriptor) (ocispec.Descriptor, error) {
 	return descs[0], nil
 }
 
+// SelectIndexVersionPolicy returns an IndexSelectionPolicy selecting an index of the
+// preferred version. If there is none, the newest index older than preferred is selected,
+// down to minimum, and then the oldest index newer than preferred. Indices of versions
+// this snapshotter doesn't support are never selected; if they are the only indices,
+// ErrUnsupportedIndexVersion is returned.
+func SelectIndexVersionPolicy(preferred, minimum soci.IndexVersion) IndexSelectionPolicy {
+	var versions []soci.IndexVersion
+	for i := len(soci.SupportedIndexVersions) - 1; i >= 0; i-- {
+		if v := soci.SupportedIndexVersions[i]; v.Compare(preferred) <= 0 && v.Compare(minimum) >= 0 {
+			versions = append(versions, v)
+		}
+	}
+	for _, v := range soci.SupportedIndexVersions {
+		if v.Compare(preferred) > 0 {
+			versions = append(versions, v)
+		}
+	}
+	return func(descs []ocispec.Descriptor) (ocispec.Descriptor, error) {
+		for _, v := range versions {
+			for _, desc := range descs {
+				if dv, ok := soci.IndexVersionOf(desc.ArtifactType); ok && dv.Compare(v) == 0 {
+					return desc, nil
+				}
+			}
+		}
+		var unsupported []string
+		for _, desc := range descs {
+			if _, ok := soci.IndexVersionOf(desc.ArtifactType); !ok && !slices.Contains(unsupported, desc.ArtifactType) {
+				unsupported = append(unsupported, desc.ArtifactType)
+			}
+		}
+		if len(unsupported) > 0 {
+			return ocispec.Descriptor{}, fmt.Errorf("%w: image only has SOCI indices of type %s; upgrade the snapshotter to lazily load it",
+				ErrUnsupportedIndexVersion, strings.Join(unsupported, ", "))
+		}
+		return ocispec.Descriptor{}, fmt.Errorf("%w: no SOCI index of version %s or newer", ErrNoReferrers, minimum)
+	}
+}
+
+// selectEnabledIndexVersions returns an IndexSelectionPolicy selecting an index with policy
+// among the indices whose version is enabled, so that an index of a disabled pull mode is
+// never selected. Indices of versions this snapshotter doesn't support are kept, so that
+// policy can report them.
+func selectEnabledIndexVersions(policy IndexSelectionPolicy, enabled []soci.IndexVersion) IndexSelectionPolicy {
+	return func(descs []ocispec.Descriptor) (ocispec.Descriptor, error) {
+		var candidates []ocispec.Descriptor
+		for _, desc := range descs {
+			v, ok := soci.IndexVersionOf(desc.ArtifactType)
+			if ok && !slices.ContainsFunc(enabled, func(e soci.IndexVersion) bool { return e.Compare(v) == 0 }) {
+				continue
+			}
+			candidates = append(candidates, desc)
+		}
+		if len(candidates) == 0 {
+			return ocispec.Descriptor{}, fmt.Errorf("%w: no SOCI index of an enabled pull mode", ErrNoReferrers)
+		}
+		return policy(candidates)
+	}
+}
+
 // Responsible for making Referrers API calls to remote registry to fetch list of referrers.
 type ReferrersClient interface {
 	/// Takes in an manifest descriptor and IndexSelectionPolicy and returns a single artifact descriptor.
@@ -75,10 +140,20 @@ func (c *OCIArtifactClient) SelectReferrer(ctx context.Context, desc ocispec.Des
 	return fn(descs)
 }
 
+// AllReferrers returns the SOCI index referrers of desc, of any index version.
+//
+// Referrers are listed without an artifactType, since a single artifactType can't match the
+// indices of every version, so every referrer of desc is listed. Signed images also have cosign
+// signatures and attestations among their referrers, so referrers are filtered by artifactType
+// here to never mistake them for a SOCI index.
 func (c *OCIArtifactClient) AllReferrers(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
 	descs := []ocispec.Descriptor{}
-	err := c.Referrers(ctx, desc, soci.SociIndexArtifactType, func(referrers []ocispec.Descriptor) error {
-		descs = append(descs, referrers...)
+	err := c.Referrers(ctx, desc, "", func(referrers []ocispec.Descriptor) error {
+		for _, referrer := range referrers {
+			if soci.IsIndexArtifactType(referrer.ArtifactType) {
+				descs = append(descs, referrer)
+			}
+		}
 		return nil
 	})
 	return descs, err
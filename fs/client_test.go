@@ -22,6 +22,7 @@ import (
 	"io"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/google/go-cmp/cmp"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -72,20 +73,66 @@ func TestOCIArtifactClientSelectReferrer(t *testing.T) {
 			name: "SelectFirstPolicy returns the first descriptor",
 			descs: []ocispec.Descriptor{
 				{
-					Digest: digest.FromBytes([]byte("foo")),
-					Size:   3,
+					ArtifactType: soci.SociIndexArtifactType,
+					Digest:       digest.FromBytes([]byte("foo")),
+					Size:         3,
 				},
 				{
-					Digest: digest.FromBytes([]byte("test")),
-					Size:   4,
+					ArtifactType: soci.SociIndexArtifactType,
+					Digest:       digest.FromBytes([]byte("test")),
+					Size:         4,
 				},
 			},
 			expectedDesc: ocispec.Descriptor{
-				Digest: digest.FromBytes([]byte("foo")),
-				Size:   3,
+				ArtifactType: soci.SociIndexArtifactType,
+				Digest:       digest.FromBytes([]byte("foo")),
+				Size:         3,
 			},
 			selectionPolicy: SelectFirstPolicy,
 		},
+		{
+			name: "cosign signatures and attestations are not selected",
+			descs: []ocispec.Descriptor{
+				{
+					MediaType:    ocispec.MediaTypeImageManifest,
+					ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json",
+					Digest:       digest.FromBytes([]byte("signature")),
+					Size:         9,
+				},
+				{
+					MediaType:    ocispec.MediaTypeImageManifest,
+					ArtifactType: "application/vnd.dev.sigstore.bundle.v0.3+json",
+					Digest:       digest.FromBytes([]byte("attestation")),
+					Size:         11,
+				},
+				{
+					MediaType:    ocispec.MediaTypeImageManifest,
+					ArtifactType: soci.SociIndexArtifactType,
+					Digest:       digest.FromBytes([]byte("index")),
+					Size:         5,
+				},
+			},
+			expectedDesc: ocispec.Descriptor{
+				MediaType:    ocispec.MediaTypeImageManifest,
+				ArtifactType: soci.SociIndexArtifactType,
+				Digest:       digest.FromBytes([]byte("index")),
+				Size:         5,
+			},
+			selectionPolicy: SelectFirstPolicy,
+		},
+		{
+			name: "only signatures returns ErrNoReferrers",
+			descs: []ocispec.Descriptor{
+				{
+					MediaType:    ocispec.MediaTypeImageManifest,
+					ArtifactType: "application/vnd.dev.cosign.artifact.sig.v1+json",
+					Digest:       digest.FromBytes([]byte("signature")),
+					Size:         9,
+				},
+			},
+			expectedErr:     ErrNoReferrers,
+			selectionPolicy: SelectFirstPolicy,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -104,3 +151,166 @@ func TestOCIArtifactClientSelectReferrer(t *testing.T) {
 		})
 	}
 }
+
+func TestSelectIndexVersionPolicy(t *testing.T) {
+	const futureArtifactType = "application/vnd.amazon.soci.index.v3+json"
+	v1Index := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: soci.SociIndexArtifactTypeV1,
+		Digest:       digest.FromBytes([]byte("v1")),
+		Size:         2,
+	}
+	v2Index := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: soci.SociIndexArtifactTypeV2,
+		Digest:       digest.FromBytes([]byte("v2")),
+		Size:         2,
+	}
+	futureIndex := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: futureArtifactType,
+		Digest:       digest.FromBytes([]byte("v3")),
+		Size:         2,
+	}
+
+	testCases := []struct {
+		name               string
+		descs              []ocispec.Descriptor
+		preferred, minimum soci.IndexVersion
+		expectedErr        error
+		expectedDesc       ocispec.Descriptor
+	}{
+		{
+			name:         "v2 is chosen over v1 when preferred",
+			descs:        []ocispec.Descriptor{v1Index, v2Index},
+			preferred:    soci.V2,
+			minimum:      soci.V1,
+			expectedDesc: v2Index,
+		},
+		{
+			name:         "v1 is chosen over v2 when preferred",
+			descs:        []ocispec.Descriptor{v2Index, v1Index},
+			preferred:    soci.V1,
+			minimum:      soci.V1,
+			expectedDesc: v1Index,
+		},
+		{
+			name:         "older version is used without an index of the preferred version",
+			descs:        []ocispec.Descriptor{v1Index},
+			preferred:    soci.V2,
+			minimum:      soci.V1,
+			expectedDesc: v1Index,
+		},
+		{
+			name:         "newer version is used without an index of the preferred version",
+			descs:        []ocispec.Descriptor{v2Index},
+			preferred:    soci.V1,
+			minimum:      soci.V1,
+			expectedDesc: v2Index,
+		},
+		{
+			name:        "versions older than the minimum are ignored",
+			descs:       []ocispec.Descriptor{v1Index},
+			preferred:   soci.V2,
+			minimum:     soci.V2,
+			expectedErr: ErrNoReferrers,
+		},
+		{
+			name:         "unsupported versions are ignored",
+			descs:        []ocispec.Descriptor{futureIndex, v1Index},
+			preferred:    soci.V2,
+			minimum:      soci.V1,
+			expectedDesc: v1Index,
+		},
+		{
+			name:        "only unsupported versions returns ErrUnsupportedIndexVersion",
+			descs:       []ocispec.Descriptor{futureIndex},
+			preferred:   soci.V2,
+			minimum:     soci.V1,
+			expectedErr: ErrUnsupportedIndexVersion,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := NewOCIArtifactClient(newFakeInner(tc.descs))
+
+			desc, err := client.SelectReferrer(context.Background(), ocispec.Descriptor{}, SelectIndexVersionPolicy(tc.preferred, tc.minimum))
+			if tc.expectedErr != nil {
+				if !errors.Is(err, tc.expectedErr) {
+					t.Fatalf("expected %v; got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error getting descriptor: %v", err)
+			}
+			if diff := cmp.Diff(desc, tc.expectedDesc); diff != "" {
+				t.Fatalf("unexpected descriptor; diff = %v", diff)
+			}
+		})
+	}
+}
+
+func TestSelectEnabledIndexVersions(t *testing.T) {
+	v1Index := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: soci.SociIndexArtifactTypeV1,
+		Digest:       digest.FromBytes([]byte("v1")),
+		Size:         2,
+	}
+	v2Index := ocispec.Descriptor{
+		MediaType:    ocispec.MediaTypeImageManifest,
+		ArtifactType: soci.SociIndexArtifactTypeV2,
+		Digest:       digest.FromBytes([]byte("v2")),
+		Size:         2,
+	}
+	policy := SelectIndexVersionPolicy(soci.V2, soci.V1)
+
+	testCases := []struct {
+		name         string
+		descs        []ocispec.Descriptor
+		enabled      []soci.IndexVersion
+		expectedErr  error
+		expectedDesc ocispec.Descriptor
+	}{
+		{
+			name:         "preferred version is chosen when enabled",
+			descs:        []ocispec.Descriptor{v1Index, v2Index},
+			enabled:      []soci.IndexVersion{soci.V1, soci.V2},
+			expectedDesc: v2Index,
+		},
+		{
+			name:         "disabled versions are never chosen",
+			descs:        []ocispec.Descriptor{v1Index, v2Index},
+			enabled:      []soci.IndexVersion{soci.V1},
+			expectedDesc: v1Index,
+		},
+		{
+			name:        "only disabled versions returns ErrNoReferrers",
+			descs:       []ocispec.Descriptor{v2Index},
+			enabled:     []soci.IndexVersion{soci.V1},
+			expectedErr: ErrNoReferrers,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := NewOCIArtifactClient(newFakeInner(tc.descs))
+
+			desc, err := client.SelectReferrer(context.Background(), ocispec.Descriptor{}, selectEnabledIndexVersions(policy, tc.enabled))
+			if tc.expectedErr != nil {
+				if !errors.Is(err, tc.expectedErr) {
+					t.Fatalf("expected %v; got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error getting descriptor: %v", err)
+			}
+			if diff := cmp.Diff(desc, tc.expectedDesc); diff != "" {
+				t.Fatalf("unexpected descriptor; diff = %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// eagerBlobCacheHandlerName is the name of the resolve handler serving blobs from the eager blob cache.
+const eagerBlobCacheHandlerName = "eager-blob-cache"
+
+// ErrEagerBlobDigestMismatch is returned when a blob streamed during an eager pull
+// doesn't match its digest.
+var ErrEagerBlobDigestMismatch = errors.New("eagerly pulled blob digest mismatch")
+
+// eagerBlobCache caches the compressed blobs of eagerly pulled layers by digest.
+// Blobs are only committed once they are fully streamed and their digest is verified.
+// It also serves as a remote.Handler, so that a layer pulled eagerly can later be
+// range-read from the cache instead of the registry, e.g. when the image is re-pushed
+// with a SOCI index and lazily loaded.
+type eagerBlobCache struct {
+	cache cache.BlobCache
+}
+
+func newEagerBlobCache(root string, minFreeInodes uint64) (*eagerBlobCache, error) {
+	c, err := cache.NewDirectoryCache(eagerBlobCachePath(root), cache.DirectoryCacheConfig{
+		Direct:        true,
+		MinFreeInodes: minFreeInodes,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create eager blob cache: %w", err)
+	}
+	return &eagerBlobCache{cache: c}, nil
+}
+
+func eagerBlobCachePath(root string) string {
+	return filepath.Join(root, "eagercache")
+}
+
+// repairEagerBlobCache repairs the eager blob cache left on disk by a previous run
+// before it is opened. Blobs that don't match their digest are removed, so that they
+// are pulled again instead of being served. At most timeout is spent verifying blobs.
+func repairEagerBlobCache(ctx context.Context, root string, timeout time.Duration) {
+	stats, err := cache.Repair(eagerBlobCachePath(root), time.Now().Add(timeout), func(key string, r io.Reader) bool {
+		dgst, err := digest.Parse(key)
+		if err != nil {
+			return false
+		}
+		verifier := dgst.Verifier()
+		if _, err := io.Copy(verifier, r); err != nil {
+			return false
+		}
+		return verifier.Verified()
+	})
+	logger := log.G(ctx).WithFields(logrus.Fields{
+		"removedWipFiles": stats.RemovedWipFiles,
+		"verifiedBlobs":   stats.VerifiedEntries,
+		"removedBlobs":    stats.RemovedEntries,
+	})
+	if err != nil {
+		logger.WithError(err).Warn("failed to repair eager blob cache")
+		return
+	}
+	logger.Info("repaired eager blob cache")
+}
+
+// newReader returns a reader streaming r, the contents of the blob described by desc,
+// into the cache. Reading it to EOF verifies the blob digest and commits the blob.
+// The returned reader must be closed, which discards a partially read blob.
+func (c *eagerBlobCache) newReader(desc ocispec.Descriptor, r io.Reader) (io.ReadCloser, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	w, err := c.cache.Add(desc.Digest.String(), cache.Direct())
+	if err != nil {
+		return nil, err
+	}
+	return &cachingReader{
+		r:        r,
+		w:        w,
+		desc:     desc,
+		verifier: desc.Digest.Verifier(),
+	}, nil
+}
+
+// Handle returns a fetcher for blobs in the cache.
+func (c *eagerBlobCache) Handle(ctx context.Context, desc ocispec.Descriptor) (remote.Fetcher, int64, error) {
+	if desc.Size == 0 {
+		return nil, 0, fmt.Errorf("size of blob %v is unknown", desc.Digest)
+	}
+	f := &eagerBlobFetcher{cache: c.cache, key: desc.Digest.String()}
+	if err := f.Check(); err != nil {
+		return nil, 0, err
+	}
+	return f, desc.Size, nil
+}
+
+// cachingReader tees a blob into the cache while verifying its digest.
+type cachingReader struct {
+	r        io.Reader
+	w        cache.Writer
+	desc     ocispec.Descriptor
+	verifier digest.Verifier
+	n        int64
+	// done is set once the blob is committed or aborted.
+	done bool
+}
+
+func (cr *cachingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if n > 0 && !cr.done {
+		cr.verifier.Write(p[:n])
+		cr.n += int64(n)
+		if _, werr := cr.w.Write(p[:n]); werr != nil {
+			// Failing to cache the blob must not fail the pull.
+			log.L.WithError(werr).WithField("digest", cr.desc.Digest).Warn("failed to cache eagerly pulled blob")
+			cr.abort()
+		}
+	}
+	if err == io.EOF && !cr.done {
+		if cr.n != cr.desc.Size || !cr.verifier.Verified() {
+			cr.abort()
+			return n, fmt.Errorf("%w: %v", ErrEagerBlobDigestMismatch, cr.desc.Digest)
+		}
+		cr.done = true
+		if cerr := cr.w.Commit(); cerr != nil {
+			log.L.WithError(cerr).WithField("digest", cr.desc.Digest).Warn("failed to commit eagerly pulled blob to cache")
+		}
+		cr.w.Close()
+	}
+	return n, err
+}
+
+func (cr *cachingReader) abort() {
+	cr.done = true
+	cr.w.Abort()
+	cr.w.Close()
+}
+
+// Close discards the blob if it wasn't fully read.
+func (cr *cachingReader) Close() error {
+	if !cr.done {
+		cr.abort()
+	}
+	return nil
+}
+
+// eagerBlobFetcher reads ranges of a blob in the eager blob cache.
+type eagerBlobFetcher struct {
+	cache cache.BlobCache
+	key   string
+}
+
+func (f *eagerBlobFetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
+	r, err := f.cache.Get(f.key, cache.Direct())
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{
+		Reader:    io.NewSectionReader(r, off, size),
+		closeFunc: r.Close,
+	}, nil
+}
+
+func (f *eagerBlobFetcher) Check() error {
+	r, err := f.cache.Get(f.key, cache.Direct())
+	if err != nil {
+		return err
+	}
+	return r.Close()
+}
+
+func (f *eagerBlobFetcher) GenID(off int64, size int64) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", f.key, off, size)))
+	return fmt.Sprintf("%x", sum)
+}
+
+type readCloser struct {
+	io.Reader
+	closeFunc func() error
+}
+
+func (rc *readCloser) Close() error { return rc.closeFunc() }
+
+// cachingFetcher is a Fetcher that caches the blobs it stores from remote in an eagerBlobCache.
+type cachingFetcher struct {
+	Fetcher
+	cache *eagerBlobCache
+}
+
+// Store stores the blob in the local store while streaming it into the eager blob cache.
+func (f *cachingFetcher) Store(ctx context.Context, desc ocispec.Descriptor, reader io.Reader) error {
+	cr, err := f.cache.newReader(desc, reader)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("digest", desc.Digest).Warn("cannot cache eagerly pulled blob")
+		return f.Fetcher.Store(ctx, desc, reader)
+	}
+	defer cr.Close()
+	return f.Fetcher.Store(ctx, desc, cr)
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestEagerBlobCache(t *testing.T) {
+	ctx := context.Background()
+	const ref = "example.com/test:latest"
+	blob := testutil.NewTestRand(t).RandomByteData(1 << 20)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromBytes(blob),
+		Size:      int64(len(blob)),
+	}
+
+	t.Run("eager pull populates the cache for ranged reads", func(t *testing.T) {
+		ec, err := newEagerBlobCache(t.TempDir(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fetcher, err := newFakeArtifactFetcher(ref, blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpacker := NewLayerUnpacker(&cachingFetcher{Fetcher: fetcher, cache: ec}, newFakeArchive(int64(len(blob)), false))
+		if err := unpacker.Unpack(ctx, desc, "/some/path/filename", getFakeMounts()); err != nil {
+			t.Fatalf("failed to unpack layer: %v", err)
+		}
+
+		// Lazily loading the layer later reads its ranges from the cache.
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resolver := remote.NewResolver(t.TempDir(), config.BlobConfig{}, map[string]remote.Handler{eagerBlobCacheHandlerName: ec}, 0, nil)
+		b, err := resolver.Resolve(ctx, nil, refspec, desc, cache.NewMemoryCache())
+		if err != nil {
+			t.Fatalf("failed to resolve blob from the eager blob cache: %v", err)
+		}
+		defer b.Close()
+		if b.Size() != desc.Size {
+			t.Fatalf("unexpected blob size; expected %d, got %d", desc.Size, b.Size())
+		}
+		for _, r := range []struct{ off, size int64 }{{0, 100}, {12345, 4096}, {desc.Size - 10, 10}} {
+			p := make([]byte, r.size)
+			n, err := b.ReadAt(p, r.off)
+			if err != nil {
+				t.Fatalf("failed to read range %d-%d: %v", r.off, r.off+r.size, err)
+			}
+			if !bytes.Equal(p[:n], blob[r.off:r.off+r.size]) {
+				t.Fatalf("unexpected data in range %d-%d", r.off, r.off+r.size)
+			}
+		}
+	})
+
+	t.Run("blob not matching its digest is not cached", func(t *testing.T) {
+		ec, err := newEagerBlobCache(t.TempDir(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		corrupted := bytes.Clone(blob)
+		corrupted[0] ^= 0xff
+		fetcher, err := newFakeArtifactFetcher(ref, corrupted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpacker := NewLayerUnpacker(&cachingFetcher{Fetcher: fetcher, cache: ec}, newFakeArchive(int64(len(blob)), false))
+		if err := unpacker.Unpack(ctx, desc, "/some/path/filename", getFakeMounts()); err == nil {
+			t.Fatalf("expected unpacking a corrupted layer to fail")
+		}
+		if _, _, err := ec.Handle(ctx, desc); err == nil {
+			t.Fatalf("corrupted blob must not be cached")
+		}
+	})
+}
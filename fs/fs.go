@@ -50,12 +50,15 @@ import (
 	"io"
 	gofs "io/fs"
 	golog "log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/config"
@@ -67,12 +70,11 @@ import (
 	"github.com/awslabs/soci-snapshotter/fs/source"
 	"github.com/awslabs/soci-snapshotter/idtools"
 	"github.com/awslabs/soci-snapshotter/internal/archive/compression"
-	socihttp "github.com/awslabs/soci-snapshotter/internal/http"
 	"github.com/awslabs/soci-snapshotter/metadata"
-	"github.com/awslabs/soci-snapshotter/service/resolver"
 	"github.com/awslabs/soci-snapshotter/snapshot"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/awslabs/soci-snapshotter/util/ratelimit"
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/mount"
@@ -90,11 +92,13 @@ import (
 	"github.com/sirupsen/logrus"
 	"golang.org/x/sync/semaphore"
 	"golang.org/x/sys/unix"
+	orascontent "oras.land/oras-go/v2/content"
 	orasremote "oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/errcode"
 )
 
 var (
-	defaultIndexSelectionPolicy = SelectFirstPolicy
+	defaultIndexSelectionPolicy = SelectIndexVersionPolicy(soci.V2, soci.V1)
 	fusermountBin               = "fusermount"
 	preresolverQueueBufferSize  = 1024 // arbitrarily chosen buffer size
 
@@ -104,19 +108,42 @@ var (
 
 // Preresolver will resolve a number of layers in parallel,
 // up to the amount specified by MaxConcurrency.
+// Images with a per-image concurrency override are also limited to their
+// own limit, clamped to maxConcurrencyCeiling.
 type preresolver struct {
-	queue chan func(context.Context) string
-	cache *sync.Map
+	queue                 chan preresolveJob
+	cache                 *sync.Map
+	smp                   *semaphore.Weighted
+	maxConcurrencyCeiling int64
+
+	imageLimitersMu sync.Mutex
+	imageLimiters   map[string]*imageLimiter
+}
+
+// preresolveJob is a layer resolution queued in the preresolver.
+type preresolveJob struct {
+	fn        func(context.Context) string
+	imageName string
+	limiter   *imageLimiter
+}
+
+// imageLimiter limits the number of layers of a single image
+// that are resolved in parallel.
+type imageLimiter struct {
 	smp   *semaphore.Weighted
+	limit int64
+	refs  int
 }
 
-func newPreresolver(maxConcurrency int64) *preresolver {
+func newPreresolver(maxConcurrency, maxConcurrencyCeiling int64) *preresolver {
 	pr := &preresolver{}
-	pr.queue = make(chan func(context.Context) string, preresolverQueueBufferSize)
+	pr.queue = make(chan preresolveJob, preresolverQueueBufferSize)
 	pr.cache = &sync.Map{}
 	if maxConcurrency > 0 {
 		pr.smp = semaphore.NewWeighted(maxConcurrency)
 	}
+	pr.maxConcurrencyCeiling = maxConcurrencyCeiling
+	pr.imageLimiters = make(map[string]*imageLimiter)
 	return pr
 }
 
@@ -128,20 +155,8 @@ func (pr *preresolver) Start(ctx context.Context) error {
 				log.G(ctx).Info("exiting preresolver")
 				return
 			default:
-				resolveFn := <-pr.queue
-				// If concurrency limits are disabled,
-				// we don't need to wait for a semaphore
-				if pr.smp != nil {
-					pr.smp.Acquire(ctx, 1)
-				}
-
-				go func() {
-					digest := resolveFn(ctx)
-					pr.cache.Delete(digest)
-					if pr.smp != nil {
-						pr.smp.Release(1)
-					}
-				}()
+				job := <-pr.queue
+				go pr.run(ctx, job)
 			}
 		}
 	}()
@@ -149,27 +164,150 @@ func (pr *preresolver) Start(ctx context.Context) error {
 	return nil
 }
 
-func (pr *preresolver) Enqueue(imgNameAndDigest string, fn func(context.Context) string) {
+// run resolves the layer of job once the limiter of its image, if any, and MaxConcurrency
+// allow it. The limits are waited for by each job rather than by the dispatcher,
+// so that an image at its limit doesn't hold up the layers of other images.
+func (pr *preresolver) run(ctx context.Context, job preresolveJob) {
+	if job.limiter != nil {
+		defer pr.releaseImageLimiter(job.imageName)
+		if err := job.limiter.smp.Acquire(ctx, 1); err != nil {
+			return
+		}
+		defer job.limiter.smp.Release(1)
+	}
+	// If concurrency limits are disabled,
+	// we don't need to wait for a semaphore
+	if pr.smp != nil {
+		if err := pr.smp.Acquire(ctx, 1); err != nil {
+			return
+		}
+		defer pr.smp.Release(1)
+	}
+	digest := job.fn(ctx)
+	pr.cache.Delete(digest)
+}
+
+// Enqueue schedules fn to resolve a layer of imageName. If maxConcurrency is positive,
+// the layers of imageName are also limited to that many parallel resolutions (up to the
+// configured ceiling), in addition to the global MaxConcurrency.
+func (pr *preresolver) Enqueue(imageName, imgNameAndDigest string, maxConcurrency int64, fn func(context.Context) string) {
 	if _, ok := pr.cache.Load(imgNameAndDigest); !ok {
+		job := preresolveJob{
+			fn:        fn,
+			imageName: imageName,
+			limiter:   pr.acquireImageLimiter(imageName, maxConcurrency),
+		}
 		select {
-		case pr.queue <- fn:
+		case pr.queue <- job:
 			pr.cache.Store(imgNameAndDigest, struct{}{})
 		default:
+			if job.limiter != nil {
+				pr.releaseImageLimiter(imageName)
+			}
 			return
 		}
 	}
 
 }
 
+// acquireImageLimiter returns the limiter for imageName, creating it if needed.
+// It returns nil if the image should use the global MaxConcurrency.
+func (pr *preresolver) acquireImageLimiter(imageName string, maxConcurrency int64) *imageLimiter {
+	if maxConcurrency <= 0 || pr.maxConcurrencyCeiling <= 0 {
+		return nil
+	}
+	pr.imageLimitersMu.Lock()
+	defer pr.imageLimitersMu.Unlock()
+	l, ok := pr.imageLimiters[imageName]
+	if !ok {
+		limit := min(maxConcurrency, pr.maxConcurrencyCeiling)
+		l = &imageLimiter{
+			smp:   semaphore.NewWeighted(limit),
+			limit: limit,
+		}
+		pr.imageLimiters[imageName] = l
+	}
+	l.refs++
+	return l
+}
+
+// releaseImageLimiter drops a reference to the limiter of imageName,
+// removing it once no jobs for the image are queued or running.
+func (pr *preresolver) releaseImageLimiter(imageName string) {
+	pr.imageLimitersMu.Lock()
+	defer pr.imageLimitersMu.Unlock()
+	l, ok := pr.imageLimiters[imageName]
+	if !ok {
+		return
+	}
+	l.refs--
+	if l.refs <= 0 {
+		delete(pr.imageLimiters, imageName)
+	}
+}
+
+// parseFetchBudgetLabels returns the fetch budget of the layers of the image with the
+// overrides in labels applied to budget. It returns false if labels don't override it.
+func parseFetchBudgetLabels(ctx context.Context, labels map[string]string, budget layer.FetchBudget) (layer.FetchBudget, bool) {
+	var overridden bool
+	if v, ok := labels[source.TargetFetchBudgetBytesLabel]; ok {
+		bytes, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || bytes < 0 {
+			log.G(ctx).WithField("label", source.TargetFetchBudgetBytesLabel).WithField("value", v).Warn("ignoring invalid fetch budget override")
+		} else {
+			budget.Bytes = bytes
+			overridden = true
+		}
+	}
+	if v, ok := labels[source.TargetFetchBudgetActionLabel]; ok {
+		switch v {
+		case config.FetchBudgetActionFail, config.FetchBudgetActionAlert:
+			budget.Action = v
+			overridden = true
+		default:
+			log.G(ctx).WithField("label", source.TargetFetchBudgetActionLabel).WithField("value", v).Warn("ignoring invalid fetch budget action override")
+		}
+	}
+	return budget, overridden
+}
+
+// parseMaxConcurrencyLabel returns the per-image concurrency override in labels,
+// or 0 if there is no valid override.
+func parseMaxConcurrencyLabel(ctx context.Context, labels map[string]string) int64 {
+	v, ok := labels[source.TargetMaxConcurrencyLabel]
+	if !ok {
+		return 0
+	}
+	maxConcurrency, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || maxConcurrency <= 0 {
+		log.G(ctx).WithField("label", source.TargetMaxConcurrencyLabel).WithField("value", v).Warn("ignoring invalid max concurrency override")
+		return 0
+	}
+	return maxConcurrency
+}
+
 type Option func(*options)
 
 type options struct {
 	getSources        source.GetSources
+	registryHosts     source.RegistryHosts
 	resolveHandlers   map[string]remote.Handler
 	metadataStore     metadata.Store
 	overlayOpaqueType layer.OverlayOpaqueType
 	maxConcurrency    int64
 	pullModes         config.PullModes
+	statsHandler      *StatsHandler
+	hostSelector      HostSelector
+	resolveTimeout    time.Duration
+	rangeFlights      bool
+	coalesceWindow    int64
+	verifyRanges      bool
+	userAgent         string
+	scheme            schemeOverride
+	transportConfig   *TransportConfig
+	hostRateLimit     float64
+	hostRateBurst     int
+	originFallback    bool
 }
 
 func WithGetSources(s source.GetSources) Option {
@@ -178,6 +316,14 @@ func WithGetSources(s source.GetSources) Option {
 	}
 }
 
+// WithRegistryHosts sets the registry hosts of images that are prewarmed.
+// They should be the same as the hosts of the sources set with WithGetSources.
+func WithRegistryHosts(hosts source.RegistryHosts) Option {
+	return func(opts *options) {
+		opts.registryHosts = hosts
+	}
+}
+
 func WithResolveHandler(name string, handler remote.Handler) Option {
 	return func(opts *options) {
 		if opts.resolveHandlers == nil {
@@ -211,6 +357,120 @@ func WithPullModes(pullModes config.PullModes) Option {
 	}
 }
 
+// WithStatsHandler makes h serve the runtime stats of the filesystem.
+func WithStatsHandler(h *StatsHandler) Option {
+	return func(opts *options) {
+		opts.statsHandler = h
+	}
+}
+
+// WithHostSelector spreads the blobs of images with several mirrors across them, selecting
+// the mirror of each blob with s. By default, blobs are fetched from the first host, in
+// order, that didn't recently fail.
+func WithHostSelector(s HostSelector) Option {
+	return func(opts *options) {
+		opts.hostSelector = s
+	}
+}
+
+// WithMirrorResolveTimeout bounds how long requests for SOCI artifacts and layers pulled
+// in parallel wait for a registry host to respond, so that snapshot preparation doesn't
+// hang on hosts that never do. Downloading the response isn't bounded.
+func WithMirrorResolveTimeout(timeout time.Duration) Option {
+	return func(opts *options) {
+		opts.resolveTimeout = timeout
+	}
+}
+
+// WithRangeFlights coalesces concurrent requests for the same range of a blob, e.g. of a base
+// layer shared by images prepared at the same time, into a single upstream request. Since each
+// coalesced range is buffered in memory until it's fetched, it's best used with a bounded chunk
+// size. Requests aren't coalesced by default.
+func WithRangeFlights() Option {
+	return func(opts *options) {
+		opts.rangeFlights = true
+	}
+}
+
+// WithReadCoalesceWindow coalesces the requests of lazy reads for ranges of a layer that
+// start within window bytes of the end of the range last fetched for it into a single
+// larger request, whose data the ranges are sliced from. Only the window bytes following
+// the last fetched range of each layer are kept in memory. Requests aren't coalesced by default.
+func WithReadCoalesceWindow(window int64) Option {
+	return func(opts *options) {
+		opts.coalesceWindow = window
+	}
+}
+
+// WithRangeDigestVerification verifies the content of range requests covering whole blobs,
+// e.g. of layers downloaded in a single chunk, against the digest of the blob. Blobs fetched
+// whole are always verified. Ranges of part of a blob can't be verified.
+func WithRangeDigestVerification() Option {
+	return func(opts *options) {
+		opts.verifyRanges = true
+	}
+}
+
+// WithUserAgent sets the User-Agent of the requests for SOCI artifacts, manifests and layers
+// pulled in parallel, e.g. to identify the snapshotter in the access logs of registries.
+// It is "soci-snapshotter/<version>" by default.
+func WithUserAgent(userAgent string) Option {
+	return func(opts *options) {
+		opts.userAgent = userAgent
+	}
+}
+
+// WithForceTLS makes requests for SOCI artifacts, manifests and layers pulled in parallel use
+// TLS, even to registry hosts configured with the http scheme, e.g. https mirrors that redirect
+// internally. It takes precedence over WithForcePlainHTTP if both are set.
+func WithForceTLS() Option {
+	return func(opts *options) {
+		opts.scheme = schemeForceTLS
+	}
+}
+
+// WithForcePlainHTTP makes requests for SOCI artifacts, manifests and layers pulled in parallel
+// use plain HTTP, even to mirrors configured with the https scheme. Requests to the registry of
+// images keep their inferred scheme, so that its credentials never go over plain HTTP.
+func WithForcePlainHTTP() Option {
+	return func(opts *options) {
+		if opts.scheme != schemeForceTLS {
+			opts.scheme = schemeForcePlainHTTP
+		}
+	}
+}
+
+// WithTransportConfig tunes the transports of the clients used to fetch SOCI artifacts,
+// manifests and layers pulled in parallel with cfg, e.g. DefaultTransportConfig, to reduce
+// the connections opened to registry hosts. Transports are left as is by default.
+func WithTransportConfig(cfg TransportConfig) Option {
+	return func(opts *options) {
+		opts.transportConfig = &cfg
+	}
+}
+
+// WithPerHostRateLimit limits the blob requests of the snapshotter to each registry host,
+// e.g. of layers pulled in parallel, to perSec requests per second, with bursts of up to
+// burst requests. Requests over the limit wait until they are allowed. Requests aren't
+// limited by default.
+func WithPerHostRateLimit(perSec float64, burst int) Option {
+	return func(opts *options) {
+		opts.hostRateLimit = perSec
+		opts.hostRateBurst = burst
+	}
+}
+
+// WithOriginFallback makes requests for SOCI artifacts and layers pulled in parallel fall
+// back to the registry of the image, e.g. registry-1.docker.io for docker.io images, once
+// all the configured hosts of the image, e.g. mirrors, failed, like containerd does for
+// mirrors followed by their upstream. It has no effect on images without configured hosts
+// or whose hosts already include the registry.
+func WithOriginFallback() Option {
+	return func(opts *options) {
+		opts.originFallback = true
+	}
+}
+
 func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts ...Option) (_ snapshot.FileSystem, err error) {
 	var fsOpts options
 	for _, o := range opts {
@@ -231,11 +491,15 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 
 	metadataStore := fsOpts.metadataStore
 
+	registryHosts := fsOpts.registryHosts
+	if registryHosts == nil {
+		registryHosts = func(imgRefSpec reference.Spec) (hosts []docker.RegistryHost, _ error) {
+			return docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchLocalhost))(imgRefSpec.Hostname())
+		}
+	}
 	getSources := fsOpts.getSources
 	if getSources == nil {
-		getSources = source.FromDefaultLabels(func(imgRefSpec reference.Spec) (hosts []docker.RegistryHost, _ error) {
-			return docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchLocalhost))(imgRefSpec.Hostname())
-		})
+		getSources = source.FromDefaultLabels(registryHosts)
 	}
 
 	pullModes := fsOpts.pullModes
@@ -279,12 +543,33 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 		log.G(context.Background()).Info("background fetch is disabled")
 	}
 
-	r, err := layer.NewResolver(root, cfg, fsOpts.resolveHandlers, metadataStore, store, fsOpts.overlayOpaqueType, bgFetcher)
+	var eagerCache *eagerBlobCache
+	if cfg.CacheEagerPulls {
+		if cfg.DirectoryCacheConfig.RepairOnStartup {
+			repairEagerBlobCache(ctx, root, time.Duration(cfg.DirectoryCacheConfig.RepairTimeoutSec)*time.Second)
+		}
+		eagerCache, err = newEagerBlobCache(root, cfg.DirectoryCacheConfig.MinFreeInodes)
+		if err != nil {
+			return nil, err
+		}
+		// Serve layers that were pulled eagerly before from the cache when they are lazily loaded.
+		WithResolveHandler(eagerBlobCacheHandlerName, eagerCache)(&fsOpts)
+	}
+
+	var sharedMounts *sharedLayerMounts
+	if cfg.FuseConfig.ShareLayerMounts {
+		sharedMounts, err = newSharedLayerMounts(root)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r, err := layer.NewResolver(root, cfg, fsOpts.resolveHandlers, metadataStore, store, fsOpts.overlayOpaqueType, bgFetcher, fsOpts.coalesceWindow)
 	if err != nil {
 		return nil, fmt.Errorf("failed to setup resolver: %w", err)
 	}
 
-	pr := newPreresolver(fsOpts.maxConcurrency)
+	pr := newPreresolver(fsOpts.maxConcurrency, cfg.MaxConcurrencyOverrideCeiling)
 	pr.Start(ctx)
 
 	var ns *metrics.Namespace
@@ -292,7 +577,7 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 		ns = metrics.NewNamespace("soci", "fs", nil)
 		commonmetrics.Register() // Register common metrics. This will happen only once.
 	}
-	c := layermetrics.NewLayerMetrics(ns)
+	c := layermetrics.NewLayerMetrics(ns, cfg.MountProgressMetrics)
 	if ns != nil {
 		metrics.Register(ns) // Register layer metrics.
 	}
@@ -309,7 +594,16 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 		return nil, err
 	}
 
-	return &filesystem{
+	preferredIndexVersion, err := soci.ParseIndexVersion(cfg.IndexDiscoveryConfig.PreferredIndexVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid preferred index version: %w", err)
+	}
+	minIndexVersion, err := soci.ParseIndexVersion(cfg.IndexDiscoveryConfig.MinIndexVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid min index version: %w", err)
+	}
+
+	fs := &filesystem{
 		// it's generally considered bad practice to store a context in a struct,
 		// however `filesystem` has it's own lifecycle as well as a per-request lifecycle.
 		// Some operations (e.g. remote calls) exist within a per-request lifecycle and use
@@ -320,6 +614,7 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 		ctx:                         ctx,
 		resolver:                    r,
 		getSources:                  getSources,
+		registryHosts:               registryHosts,
 		debug:                       cfg.Debug,
 		layer:                       make(map[string]layer.Layer),
 		disableVerification:         cfg.DisableVerification,
@@ -332,10 +627,64 @@ func NewFilesystem(ctx context.Context, root string, cfg config.FSConfig, opts .
 		mountTimeout:                mountTimeout,
 		fuseMetricsEmitWaitDuration: fuseMetricsEmitWaitDuration,
 		pr:                          pr,
+		maxConcurrency:              fsOpts.maxConcurrency,
 		pullModes:                   pullModes,
 		containerd:                  client,
 		inProgressImageUnpacks:      unpackJobs,
-	}, nil
+		indexDiscoveryMaxRetries:    cfg.IndexDiscoveryConfig.MaxRetries,
+		indexDiscoveryMinWait:       time.Duration(cfg.IndexDiscoveryConfig.MinWaitMsec) * time.Millisecond,
+		indexDiscoveryMaxWait:       time.Duration(cfg.IndexDiscoveryConfig.MaxWaitMsec) * time.Millisecond,
+		skipIndexDigestVerification: cfg.IndexDiscoveryConfig.DisableDigestVerification,
+		indexHedgedFetchHosts:       cfg.IndexDiscoveryConfig.HedgedFetchHosts,
+		pipelineColdStart:           cfg.IndexDiscoveryConfig.PipelineColdStart,
+		indexRevalidationInterval:   time.Duration(cfg.IndexDiscoveryConfig.RevalidationIntervalSec) * time.Second,
+		indexRevalidationReadMode:   cfg.IndexDiscoveryConfig.RevalidationReadMode,
+		staleManifestMode:           cfg.IndexDiscoveryConfig.StaleManifestMode,
+		inlineIndexAnnotation:       cfg.IndexDiscoveryConfig.InlineIndexAnnotation,
+		hostPolicy:                  newHostPolicy(cfg, fsOpts),
+		preferredIndexVersion:       preferredIndexVersion,
+		indexSelectionPolicy:        SelectIndexVersionPolicy(preferredIndexVersion, minIndexVersion),
+		fetchBudget: layer.FetchBudget{
+			Bytes:  cfg.BlobConfig.MountFetchBudgetBytes,
+			Action: cfg.BlobConfig.MountFetchBudgetAction,
+		},
+		eagerCache:                eagerCache,
+		lazyMount:                 cfg.FuseConfig.LazyMount,
+		pendingMounts:             make(map[string]*pendingMount),
+		sharedMounts:              sharedMounts,
+		reclaimUnreferencedLayers: cfg.ReclaimUnreferencedLayers,
+		layerImageRefs:            make(map[string]string),
+	}
+	if fsOpts.statsHandler != nil {
+		fsOpts.statsHandler.setFilesystem(fs)
+	}
+	return fs, nil
+}
+
+// newHostPolicy returns the host policy of a filesystem configured with cfg and opts.
+func newHostPolicy(cfg config.FSConfig, opts options) hostPolicy {
+	var transports *hostTransports
+	if opts.transportConfig != nil {
+		transports = newHostTransports(*opts.transportConfig)
+	}
+	var flights *rangeFlights
+	if opts.rangeFlights {
+		flights = newRangeFlights()
+	}
+	return hostPolicy{
+		timeout:            time.Duration(cfg.HostFailoverTimeoutMsec) * time.Millisecond,
+		selector:           opts.hostSelector,
+		cooldown:           newHostCooldown(defaultHostCooldown),
+		resolveTimeout:     opts.resolveTimeout,
+		flights:            flights,
+		verifyRanges:       opts.verifyRanges,
+		userAgent:          opts.userAgent,
+		scheme:             opts.scheme,
+		transports:         transports,
+		rateLimiter:        ratelimit.NewKeyedLimiter(opts.hostRateLimit, opts.hostRateBurst),
+		repositoryPrefixes: cfg.HostRepositoryPrefixes,
+		originFallback:     opts.originFallback,
+	}
 }
 
 func createParallelPullStructs(ctx context.Context, storage LayerUnpackJobStorage, parallelConfig *config.Parallel) (*unpackJobs, error) {
@@ -358,9 +707,25 @@ type sociContext struct {
 	cachedErr            error
 	bgFetchPauseOnce     sync.Once
 	fetchOnce            sync.Once
+	fuseOperationCounter *layer.FuseOperationCounter
+
+	// index is the current SOCI index of the image. It is replaced as a whole
+	// when the index is revalidated, so callers that load it once keep using
+	// the index they started with.
+	index atomic.Pointer[sociIndexState]
+
+	// validatedAt is when the index was last discovered.
+	validatedAt time.Time
+	// revalidating is closed when the revalidation in progress finishes.
+	// It is nil if there is none.
+	revalidating chan struct{}
+	revalidateMu sync.Mutex
+}
+
+// sociIndexState is a SOCI index along with the zTOC of each layer it indexes.
+type sociIndexState struct {
 	sociIndex            *soci.Index
 	imageLayerToSociDesc map[string]ocispec.Descriptor
-	fuseOperationCounter *layer.FuseOperationCounter
 }
 
 func (c *sociContext) Init(ctx context.Context, fs *filesystem, imageRef, indexDigest, imageManifestDigest string, client *http.Client, hosts []docker.RegistryHost) error {
@@ -370,8 +735,8 @@ func (c *sociContext) Init(ctx context.Context, fs *filesystem, imageRef, indexD
 			c.cachedErr = err
 			return
 		}
-		c.sociIndex = index
-		c.populateImageLayerToSociMapping(index)
+		c.populateImageLayerToSociMapping(ctx, index)
+		c.validatedAt = time.Now()
 
 		// Create the FUSE operation counter.
 		// Metrics are emitted after a wait time of fuseOpEmitWaitDuration.
@@ -381,11 +746,68 @@ func (c *sociContext) Init(ctx context.Context, fs *filesystem, imageRef, indexD
 	return c.cachedErr
 }
 
-func (c *sociContext) populateImageLayerToSociMapping(sociIndex *soci.Index) {
-	c.imageLayerToSociDesc = make(map[string]ocispec.Descriptor, len(sociIndex.Blobs))
+func (c *sociContext) populateImageLayerToSociMapping(ctx context.Context, sociIndex *soci.Index) {
+	imageLayerToSociDesc := make(map[string]ocispec.Descriptor, len(sociIndex.Blobs))
 	for _, desc := range sociIndex.Blobs {
 		ociDigest := desc.Annotations[soci.IndexAnnotationImageLayerDigest]
-		c.imageLayerToSociDesc[ociDigest] = desc
+		// Layers that can't be seeked into are left out, so they are unpacked eagerly
+		// like layers without a zTOC instead of being read incorrectly.
+		if err := checkLayerCompression(ctx, desc); err != nil {
+			log.G(ctx).WithError(err).WithField("layerDigest", ociDigest).Info("layer will be unpacked eagerly")
+			continue
+		}
+		imageLayerToSociDesc[ociDigest] = desc
+	}
+	c.index.Store(&sociIndexState{sociIndex: sociIndex, imageLayerToSociDesc: imageLayerToSociDesc})
+}
+
+// imageLayerToSociDesc returns the zTOC of each layer in the current SOCI index.
+// The returned map is never modified, so it stays consistent even if the index
+// is revalidated while it's in use.
+func (c *sociContext) imageLayerToSociDesc() map[string]ocispec.Descriptor {
+	if state := c.index.Load(); state != nil {
+		return state.imageLayerToSociDesc
+	}
+	return nil
+}
+
+// revalidate discovers the SOCI index again in the background with fetch if it was
+// last discovered more than interval ago. In the meantime, the current index keeps
+// being served unless mode is config.IndexRevalidationReadModeBlock, in which case
+// revalidate waits for an in-progress revalidation to finish. A failed revalidation
+// keeps the current index.
+func (c *sociContext) revalidate(ctx context.Context, interval time.Duration, mode string, fetch func(context.Context) (*soci.Index, error)) error {
+	c.revalidateMu.Lock()
+	done := c.revalidating
+	if done == nil && time.Since(c.validatedAt) >= interval {
+		done = make(chan struct{})
+		c.revalidating = done
+		// The revalidation outlives the request that triggered it.
+		fetchCtx := context.WithoutCancel(ctx)
+		go func() {
+			defer close(done)
+			index, err := fetch(fetchCtx)
+			if err != nil {
+				log.G(fetchCtx).WithError(err).Warn("failed to revalidate SOCI index; keeping current index")
+			} else {
+				c.populateImageLayerToSociMapping(fetchCtx, index)
+			}
+			c.revalidateMu.Lock()
+			c.validatedAt = time.Now()
+			c.revalidating = nil
+			c.revalidateMu.Unlock()
+		}()
+	}
+	c.revalidateMu.Unlock()
+
+	if done == nil || mode != config.IndexRevalidationReadModeBlock {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -397,6 +819,7 @@ type filesystem struct {
 	layerMu                     sync.Mutex
 	disableVerification         bool
 	getSources                  source.GetSources
+	registryHosts               source.RegistryHosts
 	metricsController           *layermetrics.Controller
 	attrTimeout                 time.Duration
 	entryTimeout                time.Duration
@@ -407,9 +830,46 @@ type filesystem struct {
 	mountTimeout                time.Duration
 	fuseMetricsEmitWaitDuration time.Duration
 	pr                          *preresolver
+	// maxConcurrency bounds the blobs prefetched at once, if positive.
+	maxConcurrency              int64
 	pullModes                   config.PullModes
 	containerd                  *store.ContainerdClient
 	inProgressImageUnpacks      *unpackJobs
+	indexDiscoveryMaxRetries    int
+	indexDiscoveryMinWait       time.Duration
+	indexDiscoveryMaxWait       time.Duration
+	skipIndexDigestVerification bool
+	indexHedgedFetchHosts       int
+	pipelineColdStart           bool
+	indexRevalidationInterval   time.Duration
+	indexRevalidationReadMode   string
+	staleManifestMode           string
+	inlineIndexAnnotation       string
+	// hostPolicy is how the remote stores select and fail over between registry hosts.
+	hostPolicy hostPolicy
+	// preferredIndexVersion is the SOCI index version discovered first.
+	preferredIndexVersion soci.IndexVersion
+	// indexSelectionPolicy selects the SOCI index among the referrers of an image.
+	indexSelectionPolicy IndexSelectionPolicy
+	// fetchBudget is the fetch budget of each layer unless overridden by labels.
+	fetchBudget layer.FetchBudget
+	// eagerCache caches the blobs of eagerly pulled layers. It is nil if disabled.
+	eagerCache *eagerBlobCache
+	// lazyMount defers the FUSE mount of a layer until the layer is first used.
+	lazyMount bool
+	// pendingMounts maps the mountpoints of layers whose FUSE mount is deferred
+	// to their pending mount.
+	pendingMounts map[string]*pendingMount
+	pendingMu     sync.Mutex
+	// sharedMounts shares a single FUSE mount between the mountpoints of a layer
+	// repeated in an image. It is nil if disabled.
+	sharedMounts *sharedLayerMounts
+	// reclaimUnreferencedLayers removes the cache of a layer once containerd
+	// removes its last snapshot.
+	reclaimUnreferencedLayers bool
+	// layerImageRefs maps the mountpoints of layers to the reference of the image
+	// they were resolved for. It is only populated if reclaimUnreferencedLayers is set.
+	layerImageRefs map[string]string
 }
 
 func (fs *filesystem) MountParallel(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
@@ -440,22 +900,46 @@ func (fs *filesystem) MountParallel(ctx context.Context, mountpoint string, labe
 	if !ok {
 		return errors.New("layer has no image manifest attached")
 	}
+	// Layers covered by the SOCI index are lazily loaded, so they aren't unpacked in parallel.
+	var indexedLayers map[string]ocispec.Descriptor
+	if fs.pullModes.Parallel.LazyLoadIndexedLayers {
+		indexedLayers = fs.indexedLayers(ctx, imageRef, labels[source.TargetSociIndexDigestLabel], imageDigest, client, s.Hosts)
+		if _, ok := indexedLayers[desc.Digest.String()]; ok {
+			// This layer was expected to be lazily loaded, e.g. it is smaller than the
+			// min layer size, so there is no parallel unpack job for it.
+			log.G(ctx).WithField("layerDigest", desc.Digest).Info("unpacking indexed layer locally")
+			return fs.MountLocal(ctx, mountpoint, labels, mounts)
+		}
+	}
+
 	// If lazy-loading is disabled and the image has no jobs associated with it, start premounting all jobs
 	if !fs.inProgressImageUnpacks.ImageExists(imageDigest) {
-		err := fs.preloadAllLayers(ctx, desc, imageDigest, refspec, client, s.Hosts)
+		err := fs.preloadAllLayers(ctx, desc, imageDigest, refspec, client, s.Hosts, indexedLayers)
 		if err != nil {
 			return fmt.Errorf("failed to preload layers for image manifest digest %s: %w", imageDigest, err)
 		}
 	}
 
-	err = fs.rebase(ctx, desc.Digest, imageDigest, mountpoint)
+	err = fs.rebase(ctx, desc.Digest, imageDigest, mountpoint, labels)
 	if err != nil {
 		return fmt.Errorf("failed to rebase layer %s: %w", desc.Digest, err)
 	}
 	return nil
 }
 
-func (fs *filesystem) preloadAllLayers(ctx context.Context, desc ocispec.Descriptor, imageDigest string, refspec reference.Spec, cachedClient *http.Client, hosts []docker.RegistryHost) error {
+// indexedLayers returns the layers of an image covered by its SOCI index, keyed by layer digest.
+// If the image has no SOCI index, it returns nil.
+func (fs *filesystem) indexedLayers(ctx context.Context, imageRef, indexDigest, imageDigest string, client *http.Client, hosts []docker.RegistryHost) map[string]ocispec.Descriptor {
+	c, err := fs.getSociContext(ctx, imageRef, indexDigest, imageDigest, client, hosts)
+	if err != nil {
+		log.G(ctx).WithError(err).Debug("no SOCI index for image, unpacking all layers in parallel")
+		return nil
+	}
+	return c.imageLayerToSociDesc()
+}
+
+// preloadAllLayers starts unpacking all layers of an image in parallel, except for those in skip.
+func (fs *filesystem) preloadAllLayers(ctx context.Context, desc ocispec.Descriptor, imageDigest string, refspec reference.Spec, cachedClient *http.Client, hosts []docker.RegistryHost, skip map[string]ocispec.Descriptor) error {
 	// Try reading manifest/config from containerd's content store first.
 	manifest, err := fs.getImageManifest(ctx, imageDigest)
 	if err != nil && !errdefs.IsNotFound(err) {
@@ -474,16 +958,8 @@ func (fs *filesystem) preloadAllLayers(ctx context.Context, desc ocispec.Descrip
 		if !ok {
 			return ErrNamespaceNotAttached
 		}
-		client := cachedClient
-		if authClient, ok := cachedClient.Transport.(*socihttp.AuthClient); ok {
-			// Clone the retryable client but preserve the underlying Transport (TLS/mTLS config)
-			retryClient := resolver.CloneRetryableClient(authClient.Client())
-			retryClient.HTTPClient.Transport = authClient.Client().HTTPClient.Transport
-			newAuthClient := authClient.CloneWithNewClient(retryClient)
-			newAuthClient.CacheRedirects(true)
-			client = &http.Client{Transport: newAuthClient}
-		}
-		remoteBlobStore, err := newRemoteBlobStore(refspec, client, hosts)
+		client := redirectCachingClient(cachedClient)
+		remoteBlobStore, err := newRemoteBlobStore(ctx, refspec, client, hosts, fs.hostPolicy)
 		if err != nil {
 			return fmt.Errorf("cannot create remote store: %w", err)
 		}
@@ -504,24 +980,13 @@ func (fs *filesystem) preloadAllLayers(ctx context.Context, desc ocispec.Descrip
 	}
 	// Clone client if it's our internal [socihttp.AuthClient]
 	// so that this image pull request has an isolated client reference.
-	client := cachedClient
-	if authClient, ok := cachedClient.Transport.(*socihttp.AuthClient); ok {
-		retryClient := resolver.CloneRetryableClient(authClient.Client())
-		// Preserve the original HTTP transport to carry TLS settings (certs, client certs, proxies, etc.)
-		retryClient.HTTPClient.Transport = authClient.Client().HTTPClient.Transport
-		// The clone will have a cleaned cache
-		newAuthClient := authClient.CloneWithNewClient(retryClient)
-		// It's worth noting we don't ever directly clear the cache after this.
-		// This client is used to create the remoteStore, which falls
-		// out of scope after all layers are finished premounting,
-		// which should trigger Go's garbage collector, so it should
-		// be safe to never clear the cache and let Go handle it.
-		newAuthClient.CacheRedirects(true)
-		client = &http.Client{
-			Transport: newAuthClient,
-		}
-	}
-	remoteStore, err := newRemoteBlobStore(refspec, client, hosts)
+	// It's worth noting we don't ever directly clear the cache after this.
+	// This client is used to create the remoteStore, which falls
+	// out of scope after all layers are finished premounting,
+	// which should trigger Go's garbage collector, so it should
+	// be safe to never clear the cache and let Go handle it.
+	client := redirectCachingClient(cachedClient)
+	remoteStore, err := newRemoteBlobStore(ctx, refspec, client, hosts, fs.hostPolicy)
 	if err != nil {
 		return fmt.Errorf("cannot create remote store: %w", err)
 	}
@@ -543,6 +1008,9 @@ func (fs *filesystem) preloadAllLayers(ctx context.Context, desc ocispec.Descrip
 
 		// Enqueue ALL image layers (independent of the current target) on first prepare.
 		for _, l := range manifest.Layers {
+			if _, ok := skip[l.Digest.String()]; ok {
+				continue
+			}
 			if images.IsLayerType(l.MediaType) {
 				layerJob, err := fs.inProgressImageUnpacks.AddLayerJob(imageJob, l.Digest.String())
 				if err != nil {
@@ -574,6 +1042,7 @@ func (fs *filesystem) premount(ctx context.Context, desc ocispec.Descriptor, ref
 		}
 		layerJob.errCh <- err
 		close(layerJob.errCh)
+		layerJob.Finish()
 	}()
 
 	uncompressedDigest, ok := diffIDMap[desc.Digest.String()]
@@ -605,11 +1074,17 @@ func (fs *filesystem) premount(ctx context.Context, desc ocispec.Descriptor, ref
 	err = unpacker.Unpack(ctx, desc, fsPath, []mount.Mount{})
 	if err != nil {
 		log.G(ctx).WithError(err).WithField("digest", desc.Digest).Error("cannot unpack layer")
+		return err
 	}
-	return err
+	if s, ok := remoteStore.(interface{ servingHost(string) string }); ok {
+		layerJob.host = s.servingHost(desc.Digest.String())
+	}
+	return nil
 }
 
-func (fs *filesystem) rebase(ctx context.Context, dgst digest.Digest, imageDigest, mountpoint string) error {
+// rebase moves the layer dgst of the image unpacked in parallel to mountpoint once it's
+// unpacked, and records the host it was fetched from in labels.
+func (fs *filesystem) rebase(ctx context.Context, dgst digest.Digest, imageDigest, mountpoint string, labels map[string]string) error {
 	layerJob, err := fs.inProgressImageUnpacks.Claim(imageDigest, dgst.String())
 	if err != nil {
 		fs.inProgressImageUnpacks.RemoveImageWithError(imageDigest, err)
@@ -622,6 +1097,7 @@ func (fs *filesystem) rebase(ctx context.Context, dgst digest.Digest, imageDiges
 		} else {
 			fs.inProgressImageUnpacks.Remove(layerJob, err)
 		}
+		layerJob.FinishRebase()
 	}()
 
 	log.G(ctx).WithField("digest", dgst).Debug("claimed layer")
@@ -677,6 +1153,9 @@ func (fs *filesystem) rebase(ctx context.Context, dgst digest.Digest, imageDiges
 	if err = os.Rename(tempDir, mountpoint); err != nil {
 		return fmt.Errorf("error moving temp unpack dir %s to mountpoint %s: %w", tempDir, mountpoint, err)
 	}
+	if layerJob.host != "" {
+		labels[snapshot.MirrorHostLabel] = layerJob.host
+	}
 
 	return nil
 }
@@ -790,14 +1269,21 @@ func (fs *filesystem) getDiffIDMapFromRemote(ctx context.Context, remoteStore *o
 	return diffIDMap, nil
 }
 
-// CleanImage stops all parallel operations for the specific image.
+// CleanImage stops all parallel operations for the specific image
+// and deletes their partially downloaded and unpacked content.
 // Generally this will be called when removing a snapshot for an image.
 func (fs *filesystem) CleanImage(ctx context.Context, imgDigest string) error {
 	if !fs.pullModes.Parallel.Enable {
 		return nil
 	}
 
-	err := fs.inProgressImageUnpacks.RemoveImageWithError(imgDigest, context.Canceled)
+	timeout := time.Duration(fs.pullModes.Parallel.RemoveWaitTimeoutSec) * time.Second
+	err := fs.inProgressImageUnpacks.RemoveImageAndWait(ctx, imgDigest, context.Canceled, timeout)
+	if errors.Is(err, ErrImageUnpackJobStopTimeout) {
+		// The jobs are cancelled and no longer tracked, so the garbage collector deletes their content.
+		log.G(ctx).WithError(err).Warn("leaving cleanup of cancelled unpacks to garbage collection")
+		return nil
+	}
 	if !errors.Is(err, ErrImageUnpackJobNotFound) && err != nil {
 		return fmt.Errorf("error removing image: %w", err)
 	}
@@ -823,14 +1309,18 @@ func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels
 	if err != nil {
 		return fmt.Errorf("cannot parse image ref (%s): %w", imageRef, err)
 	}
-	remoteStore, err := newRemoteBlobStore(refspec, client, s.Hosts)
+	remoteStore, err := newRemoteBlobStore(ctx, refspec, client, s.Hosts, fs.hostPolicy)
 	if err != nil {
 		return fmt.Errorf("cannot create remote store: %w", err)
 	}
-	fetcher, err := newArtifactFetcher(refspec, fs.contentStore, remoteStore)
+	var fetcher Fetcher
+	fetcher, err = newArtifactFetcher(refspec, fs.contentStore, remoteStore)
 	if err != nil {
 		return fmt.Errorf("cannot create fetcher: %w", err)
 	}
+	if fs.eagerCache != nil {
+		fetcher = &cachingFetcher{Fetcher: fetcher, cache: fs.eagerCache}
+	}
 
 	desc := s.Target
 
@@ -873,6 +1363,7 @@ func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels
 	if err != nil {
 		return fmt.Errorf("cannot unpack the layer: %w", err)
 	}
+	labels[snapshot.MirrorHostLabel] = remoteStore.servingHost(desc.Digest.String())
 
 	return nil
 }
@@ -883,8 +1374,18 @@ func (fs *filesystem) getSociContext(ctx context.Context, imageRef, indexDigest,
 	if !ok {
 		return nil, fmt.Errorf("could not load index: fs soci context is invalid type for %s", indexDigest)
 	}
-	err := c.Init(ctx, fs, imageRef, indexDigest, imageManifestDigest, client, hosts)
-	return c, err
+	if err := c.Init(ctx, fs, imageRef, indexDigest, imageManifestDigest, client, hosts); err != nil {
+		return c, err
+	}
+	// An index given by digest can't change, so only discovered indices are revalidated.
+	if indexDigest == "" && fs.indexRevalidationInterval > 0 {
+		if err := c.revalidate(ctx, fs.indexRevalidationInterval, fs.indexRevalidationReadMode, func(ctx context.Context) (*soci.Index, error) {
+			return fs.fetchSociIndex(ctx, imageRef, "", imageManifestDigest, client, hosts)
+		}); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
 }
 
 func (fs *filesystem) fetchSociIndex(ctx context.Context, imageRef, indexDigest, imageManifestDigest string, client *http.Client, hosts []docker.RegistryHost) (*soci.Index, error) {
@@ -893,26 +1394,92 @@ func (fs *filesystem) fetchSociIndex(ctx context.Context, imageRef, indexDigest,
 		return nil, err
 	}
 
-	remoteStore, err := newRemoteStore(refspec, client, hosts)
+	remoteStore, err := newRemoteStore(ctx, refspec, client, hosts, fs.hostPolicy)
+	if err != nil {
+		return nil, err
+	}
+
+	manifestStores, err := newManifestStores(refspec, client, hosts)
+	if err != nil {
+		return nil, err
+	}
+
+	hedgedStores, err := newHedgedIndexStores(refspec, client, hosts, fs.indexHedgedFetchHosts, fs.hostPolicy.cooldown)
 	if err != nil {
 		return nil, err
 	}
 
-	indexDesc, err := fs.findSociIndexDesc(ctx, imageManifestDigest, indexDigest, remoteStore)
+	for attempt := 0; ; attempt++ {
+		index, err := fs.discoverSociIndex(ctx, refspec, imageManifestDigest, indexDigest, remoteStore, manifestStores, hedgedStores)
+		if err == nil {
+			return index, nil
+		}
+		if attempt >= fs.indexDiscoveryMaxRetries || !isTransientIndexDiscoveryError(err) {
+			return nil, err
+		}
+		wait := fs.indexDiscoveryBackoff(attempt)
+		log.G(ctx).WithError(err).WithFields(logrus.Fields{
+			"attempt": attempt + 1,
+			"wait":    wait,
+		}).Warn("transient failure discovering SOCI index, retrying")
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %w", snapshot.ErrNoIndex, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+}
+
+// discoverSociIndex runs a single attempt at finding the SOCI index for an image
+// and fetching its artifacts. If hedgedStores is set, the index itself is fetched
+// from all of them in parallel.
+func (fs *filesystem) discoverSociIndex(ctx context.Context, refspec reference.Spec, imageManifestDigest, indexDigest string, remoteStore *orasremote.Repository, manifestStores []*orasremote.Repository, hedgedStores []orascontent.Fetcher) (*soci.Index, error) {
+	indexDesc, err := fs.findSociIndexDesc(ctx, imageManifestDigest, indexDigest, remoteStore, manifestStores)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %w", snapshot.ErrNoIndex, err)
 	}
 
 	log.G(ctx).WithField("digest", indexDesc.Digest.String()).Infof("fetching SOCI artifacts using index descriptor")
 
-	index, err := FetchSociArtifacts(ctx, refspec, indexDesc, fs.contentStore, remoteStore)
+	var artifactStore resolverStorage = remoteStore
+	if len(hedgedStores) > 0 {
+		artifactStore = &hedgedIndexStore{
+			resolverStorage:  remoteStore,
+			indexDesc:        indexDesc,
+			hosts:            hedgedStores,
+			skipVerification: fs.skipIndexDigestVerification,
+		}
+	}
+	index, err := FetchSociArtifacts(ctx, refspec, indexDesc, fs.contentStore, artifactStore, fs.skipIndexDigestVerification)
 	if err != nil {
 		return nil, fmt.Errorf("%w: error trying to fetch SOCI artifacts: %w", snapshot.ErrNoIndex, err)
 	}
 	return index, nil
 }
 
-func (fs *filesystem) findSociIndexDesc(ctx context.Context, imageManifestDigest string, sociIndexDigest string, remoteStore *orasremote.Repository) (ocispec.Descriptor, error) {
+// indexDiscoveryBackoff returns how long to wait before retrying index discovery
+// after the given (zero-based) attempt failed.
+func (fs *filesystem) indexDiscoveryBackoff(attempt int) time.Duration {
+	wait := fs.indexDiscoveryMinWait
+	for i := 0; i < attempt && wait < fs.indexDiscoveryMaxWait; i++ {
+		wait *= 2
+	}
+	return min(wait, fs.indexDiscoveryMaxWait)
+}
+
+// isTransientIndexDiscoveryError returns whether an index discovery failure
+// is likely to succeed on retry, i.e. whether it was caused by a network error
+// or a throttling/server error from the registry.
+func isTransientIndexDiscoveryError(err error) bool {
+	var respErr *errcode.ErrorResponse
+	if errors.As(err, &respErr) {
+		return respErr.StatusCode == http.StatusTooManyRequests || respErr.StatusCode >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+func (fs *filesystem) findSociIndexDesc(ctx context.Context, imageManifestDigest string, sociIndexDigest string, remoteStore *orasremote.Repository, manifestStores []*orasremote.Repository) (ocispec.Descriptor, error) {
 	imgDigest, err := digest.Parse(imageManifestDigest)
 	if err != nil {
 		return ocispec.Descriptor{}, fmt.Errorf("unable to parse image digest: %w", err)
@@ -929,10 +1496,28 @@ func (fs *filesystem) findSociIndexDesc(ctx context.Context, imageManifestDigest
 		return ocispec.Descriptor{}, ErrAllLazyPullModesDisabled
 	}
 
-	// 2. Try to find an index digest in the manifest labels if SOCI v2 is enabled.
-	if fs.pullModes.SOCIv2.Enable {
+	// 2. Try to find an index or its digest in the configured manifest annotation.
+	if fs.inlineIndexAnnotation != "" {
+		log.G(ctx).WithField("annotation", fs.inlineIndexAnnotation).Debug("checking for inline soci index annotation")
+		desc, err := findSociIndexDescInlineAnnotation(ctx, imgDigest, manifestStores, fs.staleManifestMode, fs.inlineIndexAnnotation)
+		if err == nil {
+			log.G(ctx).Debug("using inline soci index annotation")
+			return desc, nil
+		}
+		if !errors.Is(err, errdefs.ErrNotFound) {
+			return ocispec.Descriptor{}, err
+		}
+		log.G(ctx).Debug("inline soci index annotation not found")
+	}
+
+	// 3. Try to find an index digest in the manifest labels if SOCI v2 is enabled.
+	findV2 := func() (ocispec.Descriptor, error) {
+		if !fs.pullModes.SOCIv2.Enable {
+			log.G(ctx).Debug("soci v2 is disabled")
+			return ocispec.Descriptor{}, errdefs.ErrNotFound
+		}
 		log.G(ctx).Debug("checking for soci v2 index annotation")
-		desc, err := findSociIndexDescAnnotation(ctx, imgDigest, remoteStore)
+		desc, err := findSociIndexDescAnnotation(ctx, imgDigest, manifestStores, fs.staleManifestMode)
 		if err == nil {
 			log.G(ctx).Debug("using soci v2 index annotation")
 			return desc, nil
@@ -941,29 +1526,58 @@ func (fs *filesystem) findSociIndexDesc(ctx context.Context, imageManifestDigest
 			return ocispec.Descriptor{}, err
 		}
 		log.G(ctx).Debug("soci v2 index annotation not found")
-	} else {
-		log.G(ctx).Debug("soci v2 is disabled")
+		return ocispec.Descriptor{}, errdefs.ErrNotFound
 	}
 
-	// 3. Try to find an index using the referrers API if SOCI v1 is enabled.
-	if fs.pullModes.SOCIv1.Enable {
-		log.G(ctx).Debug("checking for soci v1 index via referrers API")
-		desc, err := findSociIndexDescReferrer(ctx, imgDigest, remoteStore)
+	// 4. Try to find an index using the referrers API if SOCI v1 is enabled.
+	findV1 := func() (ocispec.Descriptor, error) {
+		if !fs.pullModes.SOCIv1.Enable {
+			log.G(ctx).Debug("soci v1 is disabled")
+			return ocispec.Descriptor{}, errdefs.ErrNotFound
+		}
+		log.G(ctx).Debug("checking for soci index via referrers API")
+		policy := fs.indexSelectionPolicy
+		if policy == nil {
+			policy = defaultIndexSelectionPolicy
+		}
+		desc, err := findSociIndexDescReferrer(ctx, imgDigest, remoteStore, selectEnabledIndexVersions(policy, fs.enabledIndexVersions()))
 		if err == nil {
-			log.G(ctx).Debug("using soci v1 index via referrers API")
+			log.G(ctx).WithField("artifactType", desc.ArtifactType).Debug("using soci index via referrers API")
 			return desc, nil
 		}
 		if !errors.Is(err, ErrNoReferrers) {
 			return ocispec.Descriptor{}, err
 		}
-		log.G(ctx).Debug("soci v1 referrers not found")
-	} else {
-		log.G(ctx).Debug("soci v1 is disabled")
+		log.G(ctx).Debug("soci referrers not found")
+		return ocispec.Descriptor{}, errdefs.ErrNotFound
 	}
 
+	// v1 indices are discovered first only if they are preferred over v2 indices.
+	find := []func() (ocispec.Descriptor, error){findV2, findV1}
+	if fs.preferredIndexVersion.Compare(soci.V1) == 0 {
+		find = []func() (ocispec.Descriptor, error){findV1, findV2}
+	}
+	for _, f := range find {
+		desc, err := f()
+		if !errors.Is(err, errdefs.ErrNotFound) {
+			return desc, err
+		}
+	}
 	return ocispec.Descriptor{}, errdefs.ErrNotFound
 }
 
+// enabledIndexVersions returns the SOCI index versions of the enabled pull modes.
+func (fs *filesystem) enabledIndexVersions() []soci.IndexVersion {
+	var versions []soci.IndexVersion
+	if fs.pullModes.SOCIv1.Enable {
+		versions = append(versions, soci.V1)
+	}
+	if fs.pullModes.SOCIv2.Enable {
+		versions = append(versions, soci.V2)
+	}
+	return versions
+}
+
 func parseIndexDigest(sociIndexDigest string) (ocispec.Descriptor, error) {
 	dg, err := digest.Parse(sociIndexDigest)
 	if err != nil {
@@ -974,17 +1588,10 @@ func parseIndexDigest(sociIndexDigest string) (ocispec.Descriptor, error) {
 	}, nil
 }
 
-func findSociIndexDescAnnotation(ctx context.Context, imgDigest digest.Digest, remoteStore *orasremote.Repository) (ocispec.Descriptor, error) {
-	ref := remoteStore.Reference
-	ref.Reference = imgDigest.String()
-	_, r, err := remoteStore.Manifests().FetchReference(ctx, ref.Reference)
-	if err != nil {
-		return ocispec.Descriptor{}, fmt.Errorf("could not fetch manifest: %w", err)
-	}
-	var manifest ocispec.Manifest
-	err = json.NewDecoder(r).Decode(&manifest)
+func findSociIndexDescAnnotation(ctx context.Context, imgDigest digest.Digest, manifestStores []*orasremote.Repository, staleManifestMode string) (ocispec.Descriptor, error) {
+	manifest, err := fetchImageManifest(ctx, imgDigest, manifestStores, staleManifestMode)
 	if err != nil {
-		return ocispec.Descriptor{}, fmt.Errorf("could not unmarshal manifest: %w", err)
+		return ocispec.Descriptor{}, err
 	}
 	if manifest.Annotations == nil {
 		return ocispec.Descriptor{}, errdefs.ErrNotFound
@@ -997,10 +1604,10 @@ func findSociIndexDescAnnotation(ctx context.Context, imgDigest digest.Digest, r
 	return ocispec.Descriptor{}, errdefs.ErrNotFound
 }
 
-func findSociIndexDescReferrer(ctx context.Context, imgDigest digest.Digest, remoteStore *orasremote.Repository) (ocispec.Descriptor, error) {
+func findSociIndexDescReferrer(ctx context.Context, imgDigest digest.Digest, remoteStore *orasremote.Repository, policy IndexSelectionPolicy) (ocispec.Descriptor, error) {
 	artifactClient := NewOCIArtifactClient(remoteStore)
 
-	desc, err := artifactClient.SelectReferrer(ctx, ocispec.Descriptor{Digest: imgDigest}, defaultIndexSelectionPolicy)
+	desc, err := artifactClient.SelectReferrer(ctx, ocispec.Descriptor{Digest: imgDigest}, policy)
 	if err != nil {
 		return ocispec.Descriptor{}, fmt.Errorf("cannot fetch list of referrers: %w", err)
 	}
@@ -1084,10 +1691,22 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		return fmt.Errorf("source must be passed")
 	}
 	client := src[0].Hosts[0].Client
+	if fs.pipelineColdStart {
+		// The blob doesn't depend on the SOCI index, so resolve it while the index
+		// is fetched. Resolve waits for it instead of resolving the blob again.
+		go func() {
+			if err := fs.resolver.PrefetchBlob(ctx, src[0].Hosts, src[0].Name, src[0].Target); err != nil {
+				log.G(ctx).WithError(err).Debug("failed to resolve blob ahead of SOCI index")
+			}
+		}()
+	}
 	c, err := fs.getSociContext(ctx, imageRef, sociIndexDigest, imgDigest, client, src[0].Hosts)
 	if err != nil {
 		return fmt.Errorf("unable to fetch SOCI artifacts for image %q: %w", imageRef, err)
 	}
+	// Resolve all layers of this mount against the same index, even if it's
+	// revalidated in the meantime.
+	imageLayerToSociDesc := c.imageLayerToSociDesc()
 
 	// Resolve the target layer
 	var (
@@ -1097,7 +1716,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	go func() {
 		var rErr error
 		for _, s := range src {
-			sociDesc, ok := c.imageLayerToSociDesc[s.Target.Digest.String()]
+			sociDesc, ok := imageLayerToSociDesc[s.Target.Digest.String()]
 			if !ok {
 				log.G(ctx).WithFields(logrus.Fields{
 					"layerDigest": s.Target.Digest.String(),
@@ -1123,12 +1742,13 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	}
 	// Also resolve and cache other layers in parallel
 	preResolve := src[0] // TODO: should we pre-resolve blobs in other sources as well?
+	maxConcurrency := parseMaxConcurrencyLabel(ctx, labels)
 	for _, desc := range neighboringLayers(preResolve.Manifest, preResolve.Target) {
 		imgNameAndDigest := preResolve.Name.String() + "/" + desc.Digest.String()
-		fs.pr.Enqueue(imgNameAndDigest, func(ctx context.Context) string {
+		fs.pr.Enqueue(preResolve.Name.String(), imgNameAndDigest, maxConcurrency, func(ctx context.Context) string {
 			// Use context from the preresolver, but append namespace from current ctx
 			ctx = namespaces.WithNamespace(ctx, ns)
-			sociDesc, ok := c.imageLayerToSociDesc[desc.Digest.String()]
+			sociDesc, ok := imageLayerToSociDesc[desc.Digest.String()]
 			if !ok {
 				log.G(ctx).WithError(snapshot.ErrNoZtoc).WithField("layerDigest", desc.Digest.String()).Debug("skipping layer pre-resolve")
 				return imgNameAndDigest
@@ -1168,6 +1788,10 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		}
 	}()
 
+	if budget, ok := parseFetchBudgetLabels(ctx, labels, fs.fetchBudget); ok {
+		l.SetFetchBudget(budget)
+	}
+
 	node, err := l.RootNode(0, idtools.IDMap{})
 	if err != nil {
 		log.G(ctx).WithError(err).Warnf("Failed to get root node")
@@ -1182,8 +1806,11 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	// Register the mountpoint layer
 	fs.layerMu.Lock()
 	fs.layer[mountpoint] = l
+	if fs.reclaimUnreferencedLayers {
+		fs.layerImageRefs[mountpoint] = imageRef
+	}
 	fs.layerMu.Unlock()
-	fs.metricsController.Add(mountpoint, l)
+	fs.metricsController.Add(mountpoint, imageRef, l)
 
 	// Pass in a logger to go-fuse with the layer digest
 	// The go-fuse logs are useful for tracing exactly what's happening at the fuse level.
@@ -1191,10 +1818,84 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		WithField("layerDigest", labels[ctdsnapshotters.TargetLayerDigestLabel]).
 		WriterLevel(logrus.TraceLevel)
 
-	retErr = fs.setupFuseServer(ctx, mountpoint, node, l, fuseLogger, c)
+	mountLayer := func(ctx context.Context) error {
+		return fs.setupFuseServer(ctx, mountpoint, node, l, fuseLogger, c)
+	}
+	if fs.sharedMounts != nil {
+		key := sharedLayerKey(imageRef, digest)
+		mountLayer = func(ctx context.Context) error {
+			return fs.sharedMounts.mount(key, mountpoint, func(sharedMountpoint string) error {
+				return fs.setupFuseServer(ctx, sharedMountpoint, node, l, fuseLogger, c)
+			})
+		}
+	}
+
+	if fs.lazyMount {
+		// The layer is resolved, so errors that make the snapshotter fall back
+		// to local snapshots have already surfaced. Only the FUSE mount itself
+		// is deferred until the layer is first used.
+		log.G(ctx).Debug("deferring filesystem mount until first use")
+		fs.pendingMu.Lock()
+		fs.pendingMounts[mountpoint] = &pendingMount{mount: mountLayer}
+		fs.pendingMu.Unlock()
+		setMirrorHostLabel(labels, l)
+		return nil
+	}
+
+	if retErr = mountLayer(ctx); retErr == nil {
+		setMirrorHostLabel(labels, l)
+	}
 	return
 }
 
+// setMirrorHostLabel records the host the layer l was resolved from in labels, if any.
+func setMirrorHostLabel(labels map[string]string, l layer.Layer) {
+	if host := l.Info().Host; host != "" {
+		labels[snapshot.MirrorHostLabel] = host
+	}
+}
+
+// pendingMount is the FUSE mount of a layer deferred by lazy mount.
+type pendingMount struct {
+	mount func(context.Context) error
+	// mu is held while the layer is mounted, so that concurrent uses mount it
+	// once without blocking the deferred mounts of other layers.
+	mu      sync.Mutex
+	mounted bool
+	// unmounted is set once the layer is unmounted, after which it isn't mounted anymore.
+	unmounted bool
+}
+
+// materializeMount mounts a layer whose mount was deferred by lazy mount.
+// It is a no-op if the layer is already mounted.
+func (fs *filesystem) materializeMount(ctx context.Context, mountpoint string) error {
+	fs.pendingMu.Lock()
+	p, ok := fs.pendingMounts[mountpoint]
+	fs.pendingMu.Unlock()
+	if !ok {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mounted {
+		return nil
+	}
+	if p.unmounted {
+		return fmt.Errorf("layer is already unmounted")
+	}
+	log.G(ctx).Debug("mounting deferred filesystem")
+	if err := p.mount(ctx); err != nil {
+		return fmt.Errorf("failed to mount deferred filesystem: %w", err)
+	}
+	p.mounted = true
+	fs.pendingMu.Lock()
+	if fs.pendingMounts[mountpoint] == p {
+		delete(fs.pendingMounts, mountpoint)
+	}
+	fs.pendingMu.Unlock()
+	return nil
+}
+
 func (fs *filesystem) setupFuseServer(ctx context.Context, mountpoint string, node fusefs.InodeEmbedder, l layer.Layer, logger *io.PipeWriter, c *sociContext) error {
 	// mount the node to the specified mountpoint
 	// TODO: bind mount the state directory as a read-only fs on snapshotter's side
@@ -1250,6 +1951,13 @@ func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[s
 		return fmt.Errorf("layer not registered")
 	}
 
+	// Check is called every time containerd uses the layer, so this is where
+	// a deferred mount is materialized.
+	if err := fs.materializeMount(ctx, mountpoint); err != nil {
+		log.G(ctx).WithError(err).Warn("check failed")
+		return err
+	}
+
 	if l.Info().FetchedSize < l.Info().Size {
 		// Image contents hasn't fully cached yet.
 		// Check the blob connectivity and try to refresh the connection on failure
@@ -1296,6 +2004,18 @@ func (fs *filesystem) check(ctx context.Context, l layer.Layer, labels map[strin
 	return rErr
 }
 
+// ActiveHost returns the registry host the layer mounted at mountpoint is currently fetched from.
+// It returns false if no lazily loaded layer is mounted at mountpoint.
+func (fs *filesystem) ActiveHost(mountpoint string) (string, bool) {
+	fs.layerMu.Lock()
+	l, ok := fs.layer[mountpoint]
+	fs.layerMu.Unlock()
+	if !ok {
+		return "", false
+	}
+	return l.Info().Host, true
+}
+
 func isIDMappedDir(mountpoint string) bool {
 	dirName := filepath.Base(mountpoint)
 	return len(strings.Split(dirName, "_")) > 1
@@ -1310,13 +2030,45 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	}
 
 	delete(fs.layer, mountpoint)
+	imageRef, reclaim := fs.layerImageRefs[mountpoint]
+	delete(fs.layerImageRefs, mountpoint)
 	// If the mountpoint is an id-mapped layer, it is pointing to the
 	// underlying layer, so we cannot call done on it.
 	if !isIDMappedDir(mountpoint) {
 		l.Done()
+		if reclaim {
+			// Containerd only removes a snapshot once it no longer references it,
+			// e.g. during garbage collection. Reclaim the layer's cache after it
+			// is unmounted unless other snapshots still use the layer.
+			defer fs.reclaimLayer(ctx, imageRef, l.Info().Digest)
+		}
 	}
 	fs.layerMu.Unlock()
 	fs.metricsController.Remove(mountpoint)
+
+	fs.pendingMu.Lock()
+	p, pending := fs.pendingMounts[mountpoint]
+	delete(fs.pendingMounts, mountpoint)
+	fs.pendingMu.Unlock()
+	if pending {
+		// Wait for a concurrent use to finish mounting the layer, so that
+		// the mount isn't leaked.
+		p.mu.Lock()
+		p.unmounted = true
+		mounted := p.mounted
+		p.mu.Unlock()
+		if !mounted {
+			// The layer was never used, so it was never mounted.
+			return nil
+		}
+	}
+
+	if fs.sharedMounts != nil {
+		if shared, err := fs.sharedMounts.unmountShared(mountpoint); shared {
+			return err
+		}
+	}
+
 	// The goroutine which serving the mountpoint possibly becomes not responding.
 	// In case of such situations, we use MNT_FORCE here and abort the connection.
 	// In the future, we might be able to consider to kill that specific hanging
@@ -1325,6 +2077,19 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 	return unix.Unmount(mountpoint, unix.MNT_FORCE)
 }
 
+// reclaimLayer removes the cache of the layer resolved for the image if it's no longer used.
+func (fs *filesystem) reclaimLayer(ctx context.Context, imageRef string, dgst digest.Digest) {
+	reclaimed, err := fs.resolver.ReclaimLayer(imageRef, dgst)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("layerDigest", dgst).Warn("failed to reclaim unreferenced layer")
+		return
+	}
+	log.G(ctx).WithFields(logrus.Fields{
+		"layerDigest": dgst,
+		"reclaimed":   reclaimed,
+	}).Debug("reclaimed unreferenced layer")
+}
+
 // neighboringLayers returns layer descriptors except the `target` layer in the specified manifest.
 func neighboringLayers(manifest ocispec.Manifest, target ocispec.Descriptor) (descs []ocispec.Descriptor) {
 	for _, desc := range manifest.Layers {
@@ -40,17 +40,31 @@ package fs
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/awslabs/soci-snapshotter/config"
 	"github.com/awslabs/soci-snapshotter/fs/layer"
+	layermetrics "github.com/awslabs/soci-snapshotter/fs/metrics/layer"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/awslabs/soci-snapshotter/fs/source"
 	"github.com/awslabs/soci-snapshotter/idtools"
+	"github.com/awslabs/soci-snapshotter/snapshot"
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -75,6 +89,122 @@ func TestCheck(t *testing.T) {
 	}
 }
 
+func TestLazyMount(t *testing.T) {
+	bl := &breakableLayer{success: true}
+	mountpoint := t.TempDir()
+	fs := &filesystem{
+		layer: map[string]layer.Layer{
+			mountpoint: bl,
+		},
+		metricsController: layermetrics.NewLayerMetrics(nil, false),
+		lazyMount:         true,
+		pendingMounts:     make(map[string]*pendingMount),
+	}
+
+	var mounts atomic.Int32
+	fs.pendingMounts[mountpoint] = &pendingMount{mount: func(context.Context) error {
+		mounts.Add(1)
+		return nil
+	}}
+	if n := mounts.Load(); n != 0 {
+		t.Fatalf("expected no mount before first use; got %d", n)
+	}
+
+	// First use mounts the layer exactly once.
+	for range 2 {
+		if err := fs.Check(context.TODO(), mountpoint, nil); err != nil {
+			t.Fatalf("failed to check layer: %v", err)
+		}
+		if n := mounts.Load(); n != 1 {
+			t.Fatalf("expected layer to be mounted once after first use; got %d", n)
+		}
+	}
+
+	// A layer that is never used is never mounted, so unmounting it
+	// must not attempt an unmount syscall, which would fail on a plain directory.
+	unused := t.TempDir()
+	fs.layer[unused] = bl
+	fs.pendingMounts[unused] = &pendingMount{mount: func(context.Context) error {
+		mounts.Add(1)
+		return nil
+	}}
+	if err := fs.Unmount(context.TODO(), unused); err != nil {
+		t.Fatalf("failed to unmount unused layer: %v", err)
+	}
+	if n := mounts.Load(); n != 1 {
+		t.Fatalf("expected unused layer not to be mounted; got %d mounts", n)
+	}
+	if _, ok := fs.pendingMounts[unused]; ok {
+		t.Fatalf("expected unused layer to be forgotten on unmount")
+	}
+
+	// A failed deferred mount is retried on the next use.
+	failing := t.TempDir()
+	fs.layer[failing] = bl
+	var attempts int
+	fs.pendingMounts[failing] = &pendingMount{mount: func(context.Context) error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("mount failed")
+		}
+		return nil
+	}}
+	if err := fs.Check(context.TODO(), failing, nil); err == nil {
+		t.Fatalf("expected check to fail when the deferred mount fails")
+	}
+	if err := fs.Check(context.TODO(), failing, nil); err != nil {
+		t.Fatalf("failed to check layer after retrying deferred mount: %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected deferred mount to be attempted twice; got %d", attempts)
+	}
+
+	// Mounting a layer doesn't block the deferred mounts of other layers,
+	// and concurrent uses of a layer mount it once.
+	slow, fast := t.TempDir(), t.TempDir()
+	fs.layer[slow], fs.layer[fast] = bl, bl
+	started, release := make(chan struct{}), make(chan struct{})
+	var slowMounts atomic.Int32
+	fs.pendingMounts[slow] = &pendingMount{mount: func(context.Context) error {
+		if slowMounts.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return nil
+	}}
+	fs.pendingMounts[fast] = &pendingMount{mount: func(context.Context) error {
+		return nil
+	}}
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fs.Check(context.TODO(), slow, nil); err != nil {
+				t.Errorf("failed to check slowly mounted layer: %v", err)
+			}
+		}()
+	}
+	<-started
+	checked := make(chan error)
+	go func() {
+		checked <- fs.Check(context.TODO(), fast, nil)
+	}()
+	select {
+	case err := <-checked:
+		if err != nil {
+			t.Fatalf("failed to check layer: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("deferred mount of a layer blocked on the mount of another layer")
+	}
+	close(release)
+	wg.Wait()
+	if n := slowMounts.Load(); n != 1 {
+		t.Fatalf("expected concurrently used layer to be mounted once; got %d", n)
+	}
+}
+
 type breakableLayer struct {
 	success bool
 }
@@ -84,7 +214,12 @@ func (l *breakableLayer) Info() layer.Info {
 		Size: 1,
 	}
 }
-func (l *breakableLayer) DisableXAttrs() bool { return false }
+func (l *breakableLayer) Fetched() <-chan struct{}         { return nil }
+func (l *breakableLayer) DisableXAttrs() bool              { return false }
+func (l *breakableLayer) SetFetchBudget(layer.FetchBudget) {}
+func (l *breakableLayer) UnfetchedFiles(int64) ([]layer.UnfetchedFile, error) {
+	return nil, nil
+}
 func (l *breakableLayer) RootNode(uint32, idtools.IDMap) (fusefs.InodeEmbedder, error) {
 	return nil, nil
 }
@@ -107,3 +242,314 @@ func (l *breakableLayer) Refresh(ctx context.Context, hosts []docker.RegistryHos
 	return nil
 }
 func (l *breakableLayer) Done() {}
+
+func TestFetchSociIndexRetriesTransientFailures(t *testing.T) {
+	index := soci.NewIndex(soci.V2, nil, nil, nil)
+	indexBytes, err := soci.MarshalIndex(index)
+	if err != nil {
+		t.Fatalf("failed to marshal index: %v", err)
+	}
+	indexDigest := digest.FromBytes(indexBytes)
+	manifestBytes, err := json.Marshal(ocispec.Manifest{
+		Versioned:   specs.Versioned{SchemaVersion: 2},
+		MediaType:   ocispec.MediaTypeImageManifest,
+		Annotations: map[string]string{soci.ImageAnnotationSociIndexDigest: indexDigest.String()},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	imgDigest := digest.FromBytes(manifestBytes)
+
+	testCases := []struct {
+		name             string
+		failures         int
+		status           int
+		maxRetries       int
+		expectSuccess    bool
+		expectedAttempts int
+	}{
+		{
+			name:             "discovery succeeds after transient failures",
+			failures:         2,
+			status:           http.StatusServiceUnavailable,
+			maxRetries:       2,
+			expectSuccess:    true,
+			expectedAttempts: 3,
+		},
+		{
+			name:             "discovery falls back after exhausting retries",
+			failures:         3,
+			status:           http.StatusTooManyRequests,
+			maxRetries:       2,
+			expectedAttempts: 3,
+		},
+		{
+			name:             "discovery does not retry non-transient failures",
+			failures:         1,
+			status:           http.StatusForbidden,
+			maxRetries:       2,
+			expectedAttempts: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			serve := func(w http.ResponseWriter, r *http.Request, dgst digest.Digest, content []byte) {
+				w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+				w.Header().Set("Docker-Content-Digest", dgst.String())
+				w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+				if r.Method != http.MethodHead {
+					w.Write(content)
+				}
+			}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch {
+				case strings.HasSuffix(r.URL.Path, "/manifests/"+imgDigest.String()):
+					if int(attempts.Add(1)) <= tc.failures {
+						w.WriteHeader(tc.status)
+						return
+					}
+					serve(w, r, imgDigest, manifestBytes)
+				case strings.HasSuffix(r.URL.Path, "/"+indexDigest.String()):
+					serve(w, r, indexDigest, indexBytes)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			host := strings.TrimPrefix(server.URL, "http://")
+			fs := &filesystem{
+				contentStore:             newFakeLocalStore(),
+				pullModes:                config.PullModes{SOCIv2: config.V2{Enable: true}},
+				indexDiscoveryMaxRetries: tc.maxRetries,
+				indexDiscoveryMinWait:    time.Millisecond,
+				indexDiscoveryMaxWait:    10 * time.Millisecond,
+			}
+			hosts := []docker.RegistryHost{{Host: host, Scheme: "http", Path: "/v2", Client: server.Client()}}
+			_, err := fs.fetchSociIndex(context.Background(), host+"/repo:latest", "", imgDigest.String(), server.Client(), hosts)
+			if tc.expectSuccess && err != nil {
+				t.Fatalf("expected index discovery to succeed; got %v", err)
+			}
+			if !tc.expectSuccess && !errors.Is(err, snapshot.ErrNoIndex) {
+				t.Fatalf("expected %v; got %v", snapshot.ErrNoIndex, err)
+			}
+			if int(attempts.Load()) != tc.expectedAttempts {
+				t.Fatalf("expected %d discovery attempts; got %d", tc.expectedAttempts, attempts.Load())
+			}
+		})
+	}
+}
+
+func TestSociContextRevalidation(t *testing.T) {
+	layerDigest := digest.FromString("layer")
+	newIndex := func(ztoc string) *soci.Index {
+		return soci.NewIndex(soci.V2, []ocispec.Descriptor{{
+			MediaType:   soci.SociLayerMediaType,
+			Digest:      digest.FromString(ztoc),
+			Annotations: map[string]string{soci.IndexAnnotationImageLayerDigest: layerDigest.String()},
+		}}, nil, nil)
+	}
+	oldZtoc, newZtoc := digest.FromString("old ztoc"), digest.FromString("new ztoc")
+	ztocOf := func(m map[string]ocispec.Descriptor) digest.Digest {
+		return m[layerDigest.String()].Digest
+	}
+
+	testCases := []struct {
+		name string
+		mode string
+	}{
+		{name: "stale mode serves the current index during revalidation", mode: config.IndexRevalidationReadModeStale},
+		{name: "block mode waits for revalidation", mode: config.IndexRevalidationReadModeBlock},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &sociContext{}
+			c.populateImageLayerToSociMapping(context.Background(), newIndex("old ztoc"))
+
+			// A mount that started before the revalidation holds on to the old index.
+			inFlight := c.imageLayerToSociDesc()
+
+			release := make(chan struct{})
+			var fetches atomic.Int32
+			fetch := func(context.Context) (*soci.Index, error) {
+				fetches.Add(1)
+				<-release
+				return newIndex("new ztoc"), nil
+			}
+			revalidated := make(chan error, 1)
+			go func() {
+				revalidated <- c.revalidate(context.Background(), 0, tc.mode, fetch)
+			}()
+
+			if tc.mode == config.IndexRevalidationReadModeStale {
+				if err := <-revalidated; err != nil {
+					t.Fatalf("failed to revalidate: %v", err)
+				}
+				if got := ztocOf(c.imageLayerToSociDesc()); got != oldZtoc {
+					t.Fatalf("expected the stale index to be served during revalidation; got ztoc %v", got)
+				}
+				// A concurrent mount joins the revalidation in progress instead of starting another one.
+				if err := c.revalidate(context.Background(), 0, tc.mode, fetch); err != nil {
+					t.Fatalf("failed to revalidate: %v", err)
+				}
+				close(release)
+				c.revalidateMu.Lock()
+				done := c.revalidating
+				c.revalidateMu.Unlock()
+				if done != nil {
+					<-done
+				}
+			} else {
+				select {
+				case err := <-revalidated:
+					t.Fatalf("expected revalidation to block until the index is fetched; got %v", err)
+				case <-time.After(50 * time.Millisecond):
+				}
+				close(release)
+				if err := <-revalidated; err != nil {
+					t.Fatalf("failed to revalidate: %v", err)
+				}
+			}
+
+			if got := ztocOf(c.imageLayerToSociDesc()); got != newZtoc {
+				t.Fatalf("expected the revalidated index to be used; got ztoc %v", got)
+			}
+			if got := ztocOf(inFlight); got != oldZtoc {
+				t.Fatalf("expected in-flight mount to keep the old index; got ztoc %v", got)
+			}
+			if fetches.Load() != 1 {
+				t.Fatalf("expected the index to be fetched once; got %d fetches", fetches.Load())
+			}
+		})
+	}
+}
+
+func TestPreresolverMaxConcurrencyOverride(t *testing.T) {
+	const (
+		globalMaxConcurrency = 4
+		ceiling              = 3
+	)
+	testCases := []struct {
+		name           string
+		override       int64
+		expectedActive int32
+	}{
+		{
+			name:           "image without override uses global max concurrency",
+			override:       0,
+			expectedActive: globalMaxConcurrency,
+		},
+		{
+			name:           "image with override uses its own max concurrency",
+			override:       2,
+			expectedActive: 2,
+		},
+		{
+			name:           "override is clamped to the ceiling",
+			override:       100,
+			expectedActive: ceiling,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			pr := newPreresolver(globalMaxConcurrency, ceiling)
+			pr.Start(ctx)
+
+			var active, maxActive atomic.Int32
+			release := make(chan struct{})
+			var wg sync.WaitGroup
+			const jobs = 10
+			wg.Add(jobs)
+			for i := 0; i < jobs; i++ {
+				key := fmt.Sprintf("image/%d", i)
+				pr.Enqueue("image", key, tc.override, func(context.Context) string {
+					defer wg.Done()
+					n := active.Add(1)
+					for {
+						m := maxActive.Load()
+						if n <= m || maxActive.CompareAndSwap(m, n) {
+							break
+						}
+					}
+					<-release
+					active.Add(-1)
+					return key
+				})
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for active.Load() < tc.expectedActive && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			// Give the preresolver a chance to exceed the limit if it's not enforced.
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if maxActive.Load() != tc.expectedActive {
+				t.Fatalf("expected %d concurrent resolutions; got %d", tc.expectedActive, maxActive.Load())
+			}
+			// Limiters are released after the jobs return.
+			for time.Now().Before(deadline) {
+				pr.imageLimitersMu.Lock()
+				n := len(pr.imageLimiters)
+				pr.imageLimitersMu.Unlock()
+				if n == 0 {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+			t.Fatalf("expected image limiters to be released")
+		})
+	}
+}
+
+func TestPreresolverMaxConcurrencyOverrideSharesGlobalLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pr := newPreresolver(2, 10)
+	pr.Start(ctx)
+
+	var active atomic.Int32
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	enqueue := func(image string, i int, override int64) {
+		wg.Add(1)
+		key := fmt.Sprintf("%s/%d", image, i)
+		pr.Enqueue(image, key, override, func(context.Context) string {
+			defer wg.Done()
+			active.Add(1)
+			if image == "blocked" {
+				<-blocked
+			} else {
+				<-release
+			}
+			active.Add(-1)
+			return key
+		})
+	}
+	// The first image is at its limit, with a layer waiting for it.
+	enqueue("blocked", 0, 1)
+	enqueue("blocked", 1, 1)
+	// The layers of other images are resolved meanwhile, up to the global limit.
+	for i := range 3 {
+		enqueue("other", i, 0)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for active.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	// Give the preresolver a chance to exceed the limit if it's not enforced.
+	time.Sleep(50 * time.Millisecond)
+	if n := active.Load(); n != 2 {
+		t.Fatalf("expected 2 concurrent resolutions; got %d", n)
+	}
+	close(release)
+	close(blocked)
+	wg.Wait()
+}
@@ -0,0 +1,133 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/log"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+)
+
+// hedgedIndexStore is a resolverStorage that fetches the SOCI index from several
+// registry hosts in parallel and uses the first response that completes and verifies.
+// The remaining requests are cancelled. All other content is fetched from the wrapped store.
+type hedgedIndexStore struct {
+	resolverStorage
+	indexDesc        ocispec.Descriptor
+	hosts            []content.Fetcher
+	skipVerification bool
+}
+
+// newHedgedIndexStores returns a store for each of the first n registry hosts, in order,
+// that didn't recently fail according to cooldown, if not nil. It returns nil if fewer than
+// two hosts would be used, since there is nothing to hedge.
+func newHedgedIndexStores(refspec reference.Spec, client *http.Client, hosts []docker.RegistryHost, n int, cooldown *hostCooldown) ([]content.Fetcher, error) {
+	var healthy []docker.RegistryHost
+	for _, h := range hosts {
+		if len(healthy) == n {
+			break
+		}
+		if cooldown == nil || !cooldown.cooling(h) {
+			healthy = append(healthy, h)
+		}
+	}
+	if len(healthy) < 2 {
+		return nil, nil
+	}
+	stores := make([]content.Fetcher, 0, len(healthy))
+	for i := range healthy {
+		hostClient := healthy[i].Client
+		if hostClient == nil {
+			hostClient = client
+		}
+		store, err := newHostRemoteStore(refspec, hostClient, healthy[i:i+1])
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	return stores, nil
+}
+
+// Fetch fetches the SOCI index from all hosts in parallel. Other content is
+// fetched from the wrapped store.
+func (s *hedgedIndexStore) Fetch(ctx context.Context, target ocispec.Descriptor) (io.ReadCloser, error) {
+	if target.Digest != s.indexDesc.Digest {
+		return s.resolverStorage.Fetch(ctx, target)
+	}
+	b, err := hedgedFetch(ctx, s.hosts, target, s.skipVerification)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+// hedgedFetch fetches target from all fetchers in parallel and returns the first
+// content that is fully read and, unless skipVerification is set, matches the
+// digest of target. Outstanding requests are cancelled once it returns.
+// If every fetch fails, the errors of all of them are returned.
+func hedgedFetch(ctx context.Context, fetchers []content.Fetcher, target ocispec.Descriptor, skipVerification bool) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		b   []byte
+		err error
+	}
+	results := make(chan result, len(fetchers))
+	for i, f := range fetchers {
+		go func() {
+			b, err := fetchAll(ctx, f, target)
+			if err == nil && !skipVerification {
+				err = verifyIndexDigest(target, b)
+			}
+			if err != nil {
+				err = fmt.Errorf("host %d: %w", i, err)
+			}
+			results <- result{b, err}
+		}()
+	}
+
+	var errs []error
+	for range fetchers {
+		r := <-results
+		if r.err == nil {
+			return r.b, nil
+		}
+		log.G(ctx).WithError(r.err).Debug("hedged SOCI index fetch failed")
+		errs = append(errs, r.err)
+	}
+	return nil, fmt.Errorf("failed to fetch SOCI index from any host: %w", errors.Join(errs...))
+}
+
+func fetchAll(ctx context.Context, f content.Fetcher, target ocispec.Descriptor) ([]byte, error) {
+	rc, err := f.Fetch(ctx, target)
+	if err != nil {
+		return nil, cleanFetchErrors(err)
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
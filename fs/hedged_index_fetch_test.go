@@ -0,0 +1,180 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func TestHedgedIndexFetch(t *testing.T) {
+	indexBytes := []byte(`{"schemaVersion":2}`)
+	indexDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(indexBytes),
+		Size:      int64(len(indexBytes)),
+	}
+	refspec, err := reference.Parse(imageRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// newMirror returns a registry host that serves body after delay. It reports
+	// on cancelled whether the request was cancelled before the delay passed.
+	newMirror := func(body []byte, status int, delay time.Duration, cancelled chan<- struct{}) docker.RegistryHost {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, "/manifests/"+indexDesc.Digest.String()) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				if cancelled != nil {
+					close(cancelled)
+				}
+				return
+			}
+			w.Header().Set("Content-Type", indexDesc.MediaType)
+			w.WriteHeader(status)
+			w.Write(body)
+		}))
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return docker.RegistryHost{Client: srv.Client(), Host: u.Host, Scheme: "http", Path: "/v2"}
+	}
+
+	t.Run("faster mirror wins", func(t *testing.T) {
+		cancelled := make(chan struct{})
+		hosts := []docker.RegistryHost{
+			newMirror(indexBytes, http.StatusOK, time.Minute, cancelled),
+			newMirror(indexBytes, http.StatusOK, 0, nil),
+		}
+		stores, err := newHedgedIndexStores(refspec, nil, hosts, 2, nil)
+		if err != nil {
+			t.Fatalf("failed to create stores: %v", err)
+		}
+		start := time.Now()
+		b, err := hedgedFetch(context.Background(), stores, indexDesc, false)
+		if err != nil {
+			t.Fatalf("hedged fetch failed: %v", err)
+		}
+		if !bytes.Equal(b, indexBytes) {
+			t.Fatalf("unexpected index content %q", b)
+		}
+		if elapsed := time.Since(start); elapsed > 30*time.Second {
+			t.Fatalf("hedged fetch waited for the slow mirror: %v", elapsed)
+		}
+		select {
+		case <-cancelled:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("request to the slow mirror was not cancelled")
+		}
+	})
+
+	t.Run("falls back when a mirror fails verification", func(t *testing.T) {
+		hosts := []docker.RegistryHost{
+			newMirror([]byte(`{"schemaVersion":3}`), http.StatusOK, 0, nil),
+			newMirror(indexBytes, http.StatusOK, 100*time.Millisecond, nil),
+		}
+		stores, err := newHedgedIndexStores(refspec, nil, hosts, 2, nil)
+		if err != nil {
+			t.Fatalf("failed to create stores: %v", err)
+		}
+		b, err := hedgedFetch(context.Background(), stores, indexDesc, false)
+		if err != nil {
+			t.Fatalf("hedged fetch failed: %v", err)
+		}
+		if !bytes.Equal(b, indexBytes) {
+			t.Fatalf("unexpected index content %q", b)
+		}
+	})
+
+	t.Run("fails when every mirror fails", func(t *testing.T) {
+		hosts := []docker.RegistryHost{
+			newMirror([]byte(`{"schemaVersion":3}`), http.StatusOK, 0, nil),
+			newMirror(nil, http.StatusNotFound, 0, nil),
+		}
+		stores, err := newHedgedIndexStores(refspec, nil, hosts, 2, nil)
+		if err != nil {
+			t.Fatalf("failed to create stores: %v", err)
+		}
+		_, err = hedgedFetch(context.Background(), stores, indexDesc, false)
+		if !errors.Is(err, ErrIndexDigestMismatch) {
+			t.Fatalf("expected %v; got %v", ErrIndexDigestMismatch, err)
+		}
+	})
+
+	t.Run("skips hosts cooling down", func(t *testing.T) {
+		hosts := []docker.RegistryHost{
+			newMirror(indexBytes, http.StatusOK, 0, nil),
+			newMirror(indexBytes, http.StatusOK, 0, nil),
+			newMirror(indexBytes, http.StatusOK, 0, nil),
+		}
+		cooldown := newHostCooldown(time.Minute)
+		cooldown.fail(hosts[0])
+		stores, err := newHedgedIndexStores(refspec, nil, hosts, 2, cooldown)
+		if err != nil {
+			t.Fatalf("failed to create stores: %v", err)
+		}
+		var storeHosts []string
+		for _, s := range stores {
+			storeHosts = append(storeHosts, s.(*remote.Repository).Reference.Registry)
+		}
+		expected := []string{hosts[1].Host, hosts[2].Host}
+		if !slices.Equal(storeHosts, expected) {
+			t.Fatalf("expected hedged stores on %v; got %v", expected, storeHosts)
+		}
+
+		cooldown.fail(hosts[1])
+		stores, err = newHedgedIndexStores(refspec, nil, hosts, 2, cooldown)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stores != nil {
+			t.Fatalf("expected no hedged stores for a single healthy host")
+		}
+	})
+
+	t.Run("disabled for fewer than two hosts", func(t *testing.T) {
+		hosts := []docker.RegistryHost{newMirror(indexBytes, http.StatusOK, 0, nil)}
+		stores, err := newHedgedIndexStores(refspec, nil, hosts, 2, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stores != nil {
+			t.Fatalf("expected no hedged stores for a single host")
+		}
+	})
+}
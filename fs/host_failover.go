@@ -0,0 +1,196 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	sociremote "github.com/awslabs/soci-snapshotter/fs/remote"
+	socihttp "github.com/awslabs/soci-snapshotter/internal/http"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/log"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// newFailoverRemoteStore returns a repository for the image of refspec on the first of hosts
+// that didn't recently fail according to cooldown, whose requests fail over to the other hosts.
+// Hosts but the last fail over if they take longer than the timeout of the policy to answer.
+func newFailoverRemoteStore(refspec reference.Spec, client *http.Client, hosts []docker.RegistryHost, policy hostPolicy, cooldown *hostCooldown) (*remote.Repository, error) {
+	c := &failoverClient{
+		hosts:    hosts,
+		repos:    make([]*remote.Repository, len(hosts)),
+		cooldown: cooldown,
+		base:     firstAvailableHost(hosts, cooldown),
+	}
+	for i := range hosts {
+		hostClient := policy.hostClient(client, hosts, i)
+		if policy.timeout > 0 && i < len(hosts)-1 {
+			hostClient = withFailoverTimeout(hostClient, policy.timeout)
+		}
+		repo, err := policy.hostRemoteStore(refspec, hostClient, hosts[i:i+1])
+		if err != nil {
+			return nil, err
+		}
+		c.repos[i] = repo
+	}
+	repo, err := policy.hostRemoteStore(refspec, nil, hosts[c.base:c.base+1])
+	if err != nil {
+		return nil, err
+	}
+	repo.Client = c
+	return repo, nil
+}
+
+// withFailoverTimeout returns client failing requests whose response doesn't arrive within timeout.
+func withFailoverTimeout(client *http.Client, timeout time.Duration) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	bounded := *client
+	bounded.Transport = &resolveTimeoutTransport{RoundTripper: transport, timeout: timeout, err: ErrHostFailoverTimeout}
+	return &bounded
+}
+
+// failoverClient sends the requests of a repository on hosts[base] to the hosts, in order,
+// until one of them answers. Hosts are only skipped once they fail a request, rather than
+// probed beforehand. A host fails a request if it can't be connected to or answers with an
+// error status. Hosts that can't be connected to or answer with a 5xx are skipped by the
+// requests of every client sharing cooldown for a while, unless all hosts are. Other error
+// statuses, e.g. 404 for an artifact a mirror doesn't have, are specific to the request.
+type failoverClient struct {
+	hosts []docker.RegistryHost
+	// repos are the repositories of the image on each host, whose clients send the requests.
+	repos    []*remote.Repository
+	cooldown *hostCooldown
+	// base is the index of the host the requests are made for.
+	base int
+}
+
+func (c *failoverClient) Do(req *http.Request) (*http.Response, error) {
+	if !c.canFailOver(req) {
+		return c.repos[c.base].Client.Do(req)
+	}
+	ctx := req.Context()
+	order := c.order()
+	var (
+		failures []*HostError
+		// answer is the last response with an error status, returned if every host fails
+		// the request without being unhealthy, so that the status can be told apart, e.g. 404.
+		answer *http.Response
+	)
+	for n, i := range order {
+		h := c.hosts[i]
+		resp, err := c.repos[i].Client.Do(c.hostRequest(req, i))
+		if abortedByCaller(ctx, err) {
+			if answer != nil {
+				socihttp.Drain(answer.Body)
+			}
+			return nil, err
+		}
+		if err == nil && resp.StatusCode < http.StatusBadRequest {
+			if answer != nil {
+				socihttp.Drain(answer.Body)
+			}
+			recordHostRequest(h.Host, len(failures) > 0, nil)
+			return resp, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%w: %d %s", sociremote.ErrUnexpectedStatusCode, resp.StatusCode, http.StatusText(resp.StatusCode))
+		}
+		recordHostRequest(h.Host, len(failures) > 0, err)
+		logger := log.G(ctx).WithError(err).WithField("host", h.Host)
+		if resp == nil || resp.StatusCode >= http.StatusInternalServerError {
+			logger.Warn("registry host failed, skipping it for a while")
+			c.cooldown.fail(h)
+			if resp != nil {
+				socihttp.Drain(resp.Body)
+			}
+		} else {
+			logger.Warn("registry host failed the request, trying the next host")
+			if answer != nil {
+				socihttp.Drain(answer.Body)
+			}
+			answer = resp
+		}
+		if n < len(order)-1 {
+			commonmetrics.IncMirrorFailover(h.Host)
+		}
+		failures = append(failures, &HostError{Host: h.Host, Err: err})
+	}
+	if answer != nil {
+		return answer, nil
+	}
+	return nil, &AllHostsFailedError{Hosts: failures}
+}
+
+// canFailOver returns whether req can be sent to other hosts: it's a request of the repository
+// on hosts[base], as opposed to e.g. a redirect, and its body, if any, can be sent again.
+func (c *failoverClient) canFailOver(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	base := c.repos[c.base].Reference
+	return req.URL.Host == base.Host() && strings.HasPrefix(req.URL.Path, "/v2/"+base.Repository+"/")
+}
+
+// order returns the indices of the hosts in the order requests are sent to them: the hosts
+// that didn't recently fail, in order, then the others.
+func (c *failoverClient) order() []int {
+	var available, cooling []int
+	for i, h := range c.hosts {
+		if c.cooldown.cooling(h) {
+			cooling = append(cooling, i)
+		} else {
+			available = append(available, i)
+		}
+	}
+	return append(available, cooling...)
+}
+
+// hostRequest returns req, a request of the repository on hosts[base], for the repository on hosts[i].
+func (c *failoverClient) hostRequest(req *http.Request, i int) *http.Request {
+	r := req.Clone(req.Context())
+	if req.GetBody != nil {
+		// The body of req may have been read by a previous host.
+		body, err := req.GetBody()
+		if err == nil {
+			r.Body = body
+		}
+	}
+	if i == c.base {
+		return r
+	}
+	from, to := c.repos[c.base], c.repos[i]
+	r.URL.Scheme = "https"
+	if to.PlainHTTP {
+		r.URL.Scheme = "http"
+	}
+	r.URL.Host = to.Reference.Host()
+	r.URL.Path = "/v2/" + to.Reference.Repository + strings.TrimPrefix(req.URL.Path, "/v2/"+from.Reference.Repository)
+	r.URL.RawPath = ""
+	r.Host = ""
+	return r
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// HostProbeResult is the result of probing a registry host.
+type HostProbeResult struct {
+	// Host is the name of the host, e.g. "mirror.example.com:5000".
+	Host string
+	// Reachable is whether the host answered the probe without a 5xx,
+	// i.e. whether blobs of the image would be fetched from it.
+	Reachable bool
+	// StatusCode is the status of the response to the probe, or 0 if the host didn't answer.
+	StatusCode int
+	// Latency is how long the host took to answer, or to fail.
+	Latency time.Duration
+	// Err is why the host is unreachable, if it is.
+	Err error
+}
+
+// HostProber probes registry hosts the way the filesystem makes requests to them.
+type HostProber interface {
+	// ProbeHosts is like ProbeHosts, with the configuration and clients of the filesystem.
+	ProbeHosts(ctx context.Context, refspec reference.Spec, hosts []docker.RegistryHost) []HostProbeResult
+}
+
+// ProbeHosts reports which of hosts, e.g. the mirrors of the registry of refspec, the
+// blobs of the image could be fetched from, without fetching any blob. Each host is sent
+// an unauthenticated ping of its registry API with the client a filesystem created with
+// cfg and opts would use for it, e.g. with its transport config and scheme override.
+// Probes are bounded by ctx. The results are in the order of hosts.
+func ProbeHosts(ctx context.Context, cfg config.FSConfig, refspec reference.Spec, hosts []docker.RegistryHost, opts ...Option) []HostProbeResult {
+	var fsOpts options
+	for _, o := range opts {
+		o(&fsOpts)
+	}
+	return newHostPolicy(cfg, fsOpts).probeHosts(ctx, refspec, hosts)
+}
+
+// ProbeHosts probes hosts with the clients of the filesystem, see HostProber.
+func (fs *filesystem) ProbeHosts(ctx context.Context, refspec reference.Spec, hosts []docker.RegistryHost) []HostProbeResult {
+	return fs.hostPolicy.probeHosts(ctx, refspec, hosts)
+}
+
+// probeHosts probes hosts, the hosts of the image of refspec, with the clients the policy
+// makes requests to them with.
+func (p hostPolicy) probeHosts(ctx context.Context, refspec reference.Spec, hosts []docker.RegistryHost) []HostProbeResult {
+	if len(hosts) == 0 {
+		return nil
+	}
+	results := make([]HostProbeResult, len(hosts))
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = p.probeHostResult(ctx, refspec, hosts, i)
+			results[i].Host = h.Host
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// probeHostResult probes hosts[i] with the client it's fetched from.
+func (p hostPolicy) probeHostResult(ctx context.Context, refspec reference.Spec, hosts []docker.RegistryHost, i int) HostProbeResult {
+	var result HostProbeResult
+	client := p.hostClient(hosts[0].Client, hosts, i)
+	start := time.Now()
+	status, err := pingHost(ctx, client, p.hostScheme(refspec, hosts[i]), 0)
+	result.StatusCode = status
+	result.Latency = time.Since(start)
+	if err == nil {
+		err = probeStatusError(result.StatusCode)
+	}
+	result.Err = err
+	result.Reachable = err == nil
+	return result
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	sociremote "github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+func TestProbeHosts(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []string
+	)
+	newServer := func(status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests = append(requests, r.URL.Path)
+			mu.Unlock()
+			w.WriteHeader(status)
+		}))
+	}
+	healthy := newServer(http.StatusOK)
+	defer healthy.Close()
+	failing := newServer(http.StatusInternalServerError)
+	defer failing.Close()
+
+	refspec, err := reference.Parse("registry.example.com/repo:tag")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	hosts := []docker.RegistryHost{
+		{Host: strings.TrimPrefix(failing.URL, "http://"), Scheme: "http", Path: "/v2", Client: failing.Client()},
+		{Host: strings.TrimPrefix(healthy.URL, "http://"), Scheme: "http", Path: "/v2", Client: healthy.Client()},
+	}
+
+	results := ProbeHosts(context.Background(), config.FSConfig{}, refspec, hosts)
+	if len(results) != len(hosts) {
+		t.Fatalf("expected %d results; got %d", len(hosts), len(results))
+	}
+
+	failed := results[0]
+	if failed.Host != hosts[0].Host || failed.Reachable || failed.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected %s to be unreachable with status 500; got %+v", hosts[0].Host, failed)
+	}
+	if !errors.Is(failed.Err, sociremote.ErrUnexpectedStatusCode) {
+		t.Fatalf("expected %v; got %v", sociremote.ErrUnexpectedStatusCode, failed.Err)
+	}
+	reached := results[1]
+	if reached.Host != hosts[1].Host || !reached.Reachable || reached.StatusCode != http.StatusOK || reached.Err != nil {
+		t.Fatalf("expected %s to be reachable with status 200; got %+v", hosts[1].Host, reached)
+	}
+	for _, r := range results {
+		if r.Latency <= 0 {
+			t.Fatalf("expected latency of %s to be measured; got %v", r.Host, r.Latency)
+		}
+	}
+
+	// The probes use the configuration of the filesystem, e.g. its scheme override.
+	plainHosts := []docker.RegistryHost{{Host: hosts[1].Host, Scheme: "https", Path: "/v2"}}
+	results = ProbeHosts(context.Background(), config.FSConfig{}, refspec, plainHosts, WithForcePlainHTTP())
+	if len(results) != 1 || !results[0].Reachable {
+		t.Fatalf("expected %s to be reachable over plain HTTP; got %+v", plainHosts[0].Host, results)
+	}
+
+	for _, path := range requests {
+		if path != "/v2/" {
+			t.Fatalf("expected only pings of /v2/; got a request for %s", path)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/util/ratelimit"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestPerHostRateLimit(t *testing.T) {
+	const (
+		requests = 5
+		perSec   = 20
+		interval = time.Second / perSec
+	)
+	blob := []byte("layer contents")
+	dgst := digest.FromBytes(blob)
+	var (
+		mu       sync.Mutex
+		arrivals []time.Time
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		mu.Unlock()
+		w.Header().Set("Accept-Ranges", "bytes")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer srv.Close()
+
+	refspec, err := reference.Parse(strings.TrimPrefix(srv.URL, "http://") + "/repo:tag")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	ref := refspec.Locator + "@" + dgst.String()
+	store, err := newRemoteBlobStore(context.Background(), refspec, srv.Client(), nil, hostPolicy{rateLimiter: ratelimit.NewKeyedLimiter(perSec, 1)})
+	if err != nil {
+		t.Fatalf("newRemoteBlobStore failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, requests)
+	for i := range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc, err := store.FetchRange(context.Background(), ref, 0, int64(len(blob)-1))
+			if err == nil {
+				rc.Close()
+			}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("FetchRange failed: %v", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(arrivals) != requests {
+		t.Fatalf("expected %d requests; got %d", requests, len(arrivals))
+	}
+	slices.SortFunc(arrivals, func(a, b time.Time) int { return a.Compare(b) })
+	for i := 1; i < len(arrivals); i++ {
+		// Allow for the scheduling of the requests after the limiter allows them.
+		if gap := arrivals[i].Sub(arrivals[i-1]); gap < interval*3/4 {
+			t.Fatalf("expected requests to be spaced by %v; got %v between requests %d and %d", interval, gap, i-1, i)
+		}
+	}
+
+	t.Run("waiting requests are canceled", func(t *testing.T) {
+		store, err := newRemoteBlobStore(context.Background(), refspec, srv.Client(), nil, hostPolicy{rateLimiter: ratelimit.NewKeyedLimiter(0.01, 1)})
+		if err != nil {
+			t.Fatalf("newRemoteBlobStore failed: %v", err)
+		}
+		rc, err := store.FetchRange(context.Background(), ref, 0, 0)
+		if err != nil {
+			t.Fatalf("FetchRange failed: %v", err)
+		}
+		rc.Close()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		time.AfterFunc(50*time.Millisecond, cancel)
+		if _, err := store.FetchRange(ctx, ref, 0, 0); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected %v; got %v", context.Canceled, err)
+		}
+	})
+}
@@ -0,0 +1,367 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/awslabs/soci-snapshotter/util/ratelimit"
+	"github.com/awslabs/soci-snapshotter/version"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// defaultUserAgent is the User-Agent of requests to registry hosts, unless configured otherwise.
+var defaultUserAgent = fmt.Sprintf("soci-snapshotter/%s", version.Version)
+
+// defaultHostCooldown is how long a registry host that failed a blob request
+// is skipped when selecting the hosts of blobs.
+const defaultHostCooldown = 30 * time.Second
+
+// HostSelector selects the registry host the requests for a blob are sent to, so that
+// blobs of images with several mirrors, e.g. pull-through caches, are spread across them.
+// The registry of the image is never selected, so that it only serves blobs when none of
+// the mirrors can. All the requests for a blob are sent to the host selected for it,
+// unless it fails.
+type HostSelector interface {
+	// Select returns the index in hosts of the host to fetch a blob from.
+	// hosts are never empty and don't include hosts that recently failed,
+	// unless all of them did.
+	Select(hosts []docker.RegistryHost) int
+}
+
+// NewRoundRobinHostSelector returns a HostSelector selecting each host in turn.
+func NewRoundRobinHostSelector() HostSelector {
+	return NewWeightedHostSelector(nil)
+}
+
+// NewWeightedHostSelector returns a HostSelector selecting each host in proportion
+// to its weight in weights, keyed by host name, e.g. "mirror.example.com:5000".
+// Hosts without a weight have a weight of 1, and hosts with a weight of 0 are only
+// selected if all hosts have a weight of 0. Selections of the same host are spread
+// out, e.g. hosts a and b of weights 2 and 1 are selected in the order a, b, a.
+func NewWeightedHostSelector(weights map[string]int) HostSelector {
+	return &weightedHostSelector{
+		weights: weights,
+		current: make(map[string]int),
+	}
+}
+
+// weightedHostSelector is a smooth weighted round-robin selector.
+type weightedHostSelector struct {
+	weights map[string]int
+
+	mu sync.Mutex
+	// current is the current weight of each host. The host with the highest current
+	// weight is selected, after which the total weight is subtracted from it.
+	current map[string]int
+}
+
+func (s *weightedHostSelector) Select(hosts []docker.RegistryHost) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	selected, total := 0, 0
+	for i, h := range hosts {
+		w := s.weight(h.Host)
+		s.current[h.Host] += w
+		total += w
+		if s.current[h.Host] > s.current[hosts[selected].Host] {
+			selected = i
+		}
+	}
+	s.current[hosts[selected].Host] -= total
+	return selected
+}
+
+func (s *weightedHostSelector) weight(host string) int {
+	w, ok := s.weights[host]
+	if !ok {
+		return 1
+	}
+	return max(w, 0)
+}
+
+// originHost returns the registry of refspec as a registry host name, e.g.
+// registry-1.docker.io for images on docker.io.
+func originHost(refspec reference.Spec) string {
+	origin, err := docker.DefaultHost(refspec.Hostname())
+	if err != nil {
+		return refspec.Hostname()
+	}
+	return origin
+}
+
+// hostCooldown tracks the registry hosts that recently failed.
+type hostCooldown struct {
+	period time.Duration
+
+	mu sync.Mutex
+	// until maps each host that failed to the time it can be selected again.
+	until map[string]time.Time
+}
+
+func newHostCooldown(period time.Duration) *hostCooldown {
+	return &hostCooldown{
+		period: period,
+		until:  make(map[string]time.Time),
+	}
+}
+
+// fail records that host failed.
+func (c *hostCooldown) fail(host docker.RegistryHost) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.until[hostKey(host)] = time.Now().Add(c.period)
+}
+
+// cooling returns whether host failed within the cooldown period.
+func (c *hostCooldown) cooling(host docker.RegistryHost) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := hostKey(host)
+	until, ok := c.until[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(c.until, key)
+		return false
+	}
+	return true
+}
+
+// hostKey identifies host by its name and API root.
+func hostKey(host docker.RegistryHost) string {
+	return host.Host + host.Path
+}
+
+// recordHostRequest records the result err of a request to host in the mirror metrics.
+// fellBack is whether the request was sent to host after another host failed it.
+func recordHostRequest(host string, fellBack bool, err error) {
+	switch {
+	case err != nil:
+		commonmetrics.IncMirrorRequest(host, commonmetrics.MirrorFailure)
+	case fellBack:
+		commonmetrics.IncMirrorRequest(host, commonmetrics.MirrorFallbackSuccess)
+	default:
+		commonmetrics.IncMirrorRequest(host, commonmetrics.MirrorPrimarySuccess)
+	}
+}
+
+// schemeOverride is whether requests to registry hosts use TLS regardless of their configuration.
+type schemeOverride int
+
+const (
+	// schemeInferred uses plain HTTP for hosts with the http scheme, or for
+	// registries on localhost if the image has no hosts, and TLS otherwise.
+	schemeInferred schemeOverride = iota
+	// schemeForceTLS always uses TLS.
+	schemeForceTLS
+	// schemeForcePlainHTTP always uses plain HTTP for mirrors. The registry of images
+	// is inferred, so that its credentials never go over plain HTTP.
+	schemeForcePlainHTTP
+)
+
+// hostPolicy is how the remote stores of images select and fail over between registry hosts,
+// and how they make requests to them.
+type hostPolicy struct {
+	// timeout is how long a host may take to answer before failing over to the next host.
+	timeout time.Duration
+	// selector selects the mirror of each blob. If nil, blobs are fetched from
+	// the first host, in order, that didn't recently fail.
+	selector HostSelector
+	// cooldown tracks the hosts that recently failed. If nil, each store tracks its own.
+	cooldown *hostCooldown
+	// resolveTimeout bounds how long requests wait for a host to respond, if positive.
+	resolveTimeout time.Duration
+	// flights coalesces concurrent range requests of the stores, if not nil.
+	flights *rangeFlights
+	// verifyRanges is whether ranges covering whole blobs are verified against their digest.
+	verifyRanges bool
+	// userAgent is the User-Agent of requests to the hosts. If empty, defaultUserAgent is used.
+	userAgent string
+	// scheme overrides whether requests to the hosts use TLS.
+	scheme schemeOverride
+	// transports tunes the transports of the clients of the hosts, if not nil.
+	transports *hostTransports
+	// rateLimiter limits the rate of blob requests to each host, if not nil, so that
+	// mirrors shared with other clients aren't overwhelmed by parallel pulls.
+	rateLimiter *ratelimit.KeyedLimiter
+	// repositoryPrefixes maps host names to the prefixes of the repositories of images
+	// on the hosts, e.g. "cache/docker.io" for pull-through caches namespacing upstream
+	// repositories under a prefix.
+	repositoryPrefixes map[string]string
+	// originFallback is whether the registry of images is tried after all their hosts failed.
+	originFallback bool
+}
+
+// withOrigin returns hosts followed by the registry of refspec, if the policy falls back to
+// it and hosts, e.g. the mirrors of the registry, don't already include it. The registry
+// uses the client of the first host, and plain HTTP only if it's on localhost.
+func (p hostPolicy) withOrigin(refspec reference.Spec, hosts []docker.RegistryHost) ([]docker.RegistryHost, error) {
+	if !p.originFallback || len(hosts) == 0 {
+		return hosts, nil
+	}
+	origin, err := docker.DefaultHost(refspec.Hostname())
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		if h.Host == origin {
+			return hosts, nil
+		}
+	}
+	isLocalhost, err := docker.MatchLocalhost(origin)
+	if err != nil {
+		return nil, fmt.Errorf("cannot determine http/https for %s: %w", origin, err)
+	}
+	scheme := "https"
+	if isLocalhost {
+		scheme = "http"
+	}
+	withOrigin := make([]docker.RegistryHost, len(hosts), len(hosts)+1)
+	copy(withOrigin, hosts)
+	return append(withOrigin, docker.RegistryHost{
+		Host:         origin,
+		Scheme:       scheme,
+		Path:         "/v2",
+		Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
+	}), nil
+}
+
+// wrapClient returns client sending the User-Agent of the policy, bounded by the resolve timeout, if any.
+func (p hostPolicy) wrapClient(client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	wrapped := *client
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if p.resolveTimeout > 0 {
+		transport = &resolveTimeoutTransport{RoundTripper: transport, timeout: p.resolveTimeout}
+	}
+	userAgent := p.userAgent
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	wrapped.Transport = &userAgentTransport{RoundTripper: transport, userAgent: userAgent}
+	return &wrapped
+}
+
+// userAgentTransport sets the User-Agent of requests.
+type userAgentTransport struct {
+	http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// plainHTTP returns whether requests to host, a host of the image of refspec, use plain
+// HTTP, given whether it was inferred from the configuration of the host.
+func (p hostPolicy) plainHTTP(refspec reference.Spec, host string, inferred bool) bool {
+	switch p.scheme {
+	case schemeForceTLS:
+		return false
+	case schemeForcePlainHTTP:
+		if !isOrigin(refspec, host) {
+			return true
+		}
+	}
+	return inferred
+}
+
+// hostScheme returns host, a host of the image of refspec, with the scheme requests to it use.
+func (p hostPolicy) hostScheme(refspec reference.Spec, host docker.RegistryHost) docker.RegistryHost {
+	if p.scheme == schemeInferred {
+		return host
+	}
+	scheme := "https"
+	if p.plainHTTP(refspec, host.Host, host.Scheme == "http") {
+		scheme = "http"
+	}
+	host.Scheme = scheme
+	return host
+}
+
+// isOrigin returns whether host is the registry of the image of refspec rather than a mirror.
+func isOrigin(refspec reference.Spec, host string) bool {
+	if host == refspec.Hostname() {
+		return true
+	}
+	origin, err := docker.DefaultHost(refspec.Hostname())
+	return err == nil && host == origin
+}
+
+// resolveTimeoutTransport fails requests whose response doesn't arrive within timeout.
+// Unlike http.Client.Timeout, reading the body of the response isn't bounded,
+// so that large blobs can still be downloaded.
+type resolveTimeoutTransport struct {
+	http.RoundTripper
+	timeout time.Duration
+	// err is the error of requests that time out. If nil, it's ErrMirrorResolveTimeout.
+	err error
+}
+
+func (t *resolveTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timeoutErr := t.err
+	if timeoutErr == nil {
+		timeoutErr = ErrMirrorResolveTimeout
+	}
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(t.timeout, func() {
+		cancel(timeoutErr)
+	})
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		// The timeout expired, possibly after the response arrived.
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel(nil)
+		return nil, fmt.Errorf("%w after %v", timeoutErr, t.timeout)
+	}
+	if err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels the context of a request when its response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelCauseFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel(nil)
+	return err
+}
@@ -0,0 +1,433 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestWeightedHostSelector(t *testing.T) {
+	hosts := []docker.RegistryHost{{Host: "a"}, {Host: "b"}, {Host: "c"}}
+	tests := []struct {
+		name     string
+		selector HostSelector
+		expected string
+	}{
+		{
+			name:     "round robin",
+			selector: NewRoundRobinHostSelector(),
+			expected: "abcabc",
+		},
+		{
+			name:     "weighted",
+			selector: NewWeightedHostSelector(map[string]int{"a": 2, "c": 0}),
+			expected: "abaaba",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var got strings.Builder
+			for range len(tc.expected) {
+				got.WriteString(hosts[tc.selector.Select(hosts)].Host)
+			}
+			if got.String() != tc.expected {
+				t.Fatalf("expected hosts %s; got %s", tc.expected, got.String())
+			}
+		})
+	}
+}
+
+// blobHostServer is a registry host recording the blobs requested from it
+// and answering blob requests with status.
+type blobHostServer struct {
+	*httptest.Server
+	mu    sync.Mutex
+	blobs map[string]int
+}
+
+func newBlobHostServer(t *testing.T, status int) *blobHostServer {
+	s := &blobHostServer{blobs: make(map[string]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, blob, ok := strings.Cut(r.URL.Path, "/blobs/"); ok {
+			s.mu.Lock()
+			s.blobs[blob]++
+			s.mu.Unlock()
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			w.Header().Set("Accept-Ranges", "bytes")
+			// Blobs are only requested up to their first byte.
+			w.Write([]byte{0})
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *blobHostServer) host() docker.RegistryHost {
+	return docker.RegistryHost{Host: strings.TrimPrefix(s.URL, "http://"), Scheme: "http", Path: "/v2"}
+}
+
+func (s *blobHostServer) requested(blob string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.blobs[blob] > 0
+}
+
+func TestBlobHostSelection(t *testing.T) {
+	refspec, err := reference.Parse("docker.io/library/alpine:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	blobs := []string{
+		digest.FromString("layer 1").String(),
+		digest.FromString("layer 2").String(),
+		digest.FromString("layer 3").String(),
+	}
+	blobRef := func(blob string) string {
+		return refspec.Locator + "@" + blob
+	}
+
+	t.Run("distinct blobs land on different hosts", func(t *testing.T) {
+		servers := []*blobHostServer{newBlobHostServer(t, http.StatusOK), newBlobHostServer(t, http.StatusOK)}
+		hosts := []docker.RegistryHost{servers[0].host(), servers[1].host()}
+		store, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{
+			timeout:  time.Second,
+			selector: NewRoundRobinHostSelector(),
+		})
+		if err != nil {
+			t.Fatalf("newRemoteBlobStore failed: %v", err)
+		}
+		for _, blob := range blobs[:2] {
+			ranges, err := store.doInitialFetch(context.Background(), blobRef(blob))
+			if err != nil {
+				t.Fatalf("doInitialFetch failed: %v", err)
+			}
+			if !ranges {
+				t.Fatal("expected host to accept ranges")
+			}
+			// Further requests for the blob go to the same host.
+			rc, err := store.FetchRange(context.Background(), blobRef(blob), 0, 0)
+			if err != nil {
+				t.Fatalf("FetchRange failed: %v", err)
+			}
+			rc.Close()
+		}
+		for i, s := range servers {
+			if !s.requested(blobs[i]) || s.requested(blobs[1-i]) {
+				t.Fatalf("expected host %d to only serve blob %s; got %v", i, blobs[i], s.blobs)
+			}
+		}
+	})
+
+	t.Run("failed hosts are skipped", func(t *testing.T) {
+		failing := newBlobHostServer(t, http.StatusInternalServerError)
+		healthy := newBlobHostServer(t, http.StatusOK)
+		hosts := []docker.RegistryHost{failing.host(), healthy.host()}
+		store, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{
+			timeout:  time.Second,
+			selector: NewRoundRobinHostSelector(),
+		})
+		if err != nil {
+			t.Fatalf("newRemoteBlobStore failed: %v", err)
+		}
+		for _, blob := range blobs {
+			if _, err := store.doInitialFetch(context.Background(), blobRef(blob)); err != nil {
+				t.Fatalf("doInitialFetch failed: %v", err)
+			}
+			if !healthy.requested(blob) {
+				t.Fatalf("expected blob %s to be fetched from the healthy host", blob)
+			}
+		}
+		for _, blob := range blobs[1:] {
+			if failing.requested(blob) {
+				t.Fatalf("expected blob %s not to be requested from the failed host", blob)
+			}
+		}
+	})
+}
+
+func TestBlobHostSelectionMirrorsFirst(t *testing.T) {
+	blobs := []string{
+		digest.FromString("layer 1").String(),
+		digest.FromString("layer 2").String(),
+		digest.FromString("layer 3").String(),
+	}
+
+	t.Run("blobs are spread across mirrors only", func(t *testing.T) {
+		mirrors := []*blobHostServer{newBlobHostServer(t, http.StatusOK), newBlobHostServer(t, http.StatusOK)}
+		origin := newBlobHostServer(t, http.StatusOK)
+		refspec, err := reference.Parse(origin.host().Host + "/repo:tag")
+		if err != nil {
+			t.Fatalf("failed to parse reference: %v", err)
+		}
+		hosts := []docker.RegistryHost{mirrors[0].host(), mirrors[1].host(), origin.host()}
+		store, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{
+			timeout:  time.Second,
+			selector: NewRoundRobinHostSelector(),
+		})
+		if err != nil {
+			t.Fatalf("newRemoteBlobStore failed: %v", err)
+		}
+		for _, blob := range blobs {
+			if _, err := store.doInitialFetch(context.Background(), refspec.Locator+"@"+blob); err != nil {
+				t.Fatalf("doInitialFetch failed: %v", err)
+			}
+			if origin.requested(blob) {
+				t.Fatalf("expected blob %s to be fetched from a mirror", blob)
+			}
+		}
+		if !mirrors[0].requested(blobs[0]) || !mirrors[1].requested(blobs[1]) {
+			t.Fatalf("expected blobs to be spread across mirrors; got %v and %v", mirrors[0].blobs, mirrors[1].blobs)
+		}
+	})
+
+	t.Run("blobs missing from a mirror don't skip it for other blobs", func(t *testing.T) {
+		missing := newBlobHostServer(t, http.StatusNotFound)
+		healthy := newBlobHostServer(t, http.StatusOK)
+		refspec, err := reference.Parse("docker.io/library/alpine:latest")
+		if err != nil {
+			t.Fatalf("failed to parse reference: %v", err)
+		}
+		hosts := []docker.RegistryHost{missing.host(), healthy.host()}
+		store, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{timeout: time.Second})
+		if err != nil {
+			t.Fatalf("newRemoteBlobStore failed: %v", err)
+		}
+		for _, blob := range blobs {
+			if _, err := store.doInitialFetch(context.Background(), refspec.Locator+"@"+blob); err != nil {
+				t.Fatalf("doInitialFetch failed: %v", err)
+			}
+			if !missing.requested(blob) || !healthy.requested(blob) {
+				t.Fatalf("expected blob %s to be requested from the first host, then the next one", blob)
+			}
+		}
+	})
+}
+
+func TestMirrorResolveTimeout(t *testing.T) {
+	blob := []byte("layer contents")
+	dgst := digest.FromBytes(blob)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("mode") {
+		case "slow-body":
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.WriteHeader(http.StatusPartialContent)
+			w.(http.Flusher).Flush()
+			time.Sleep(300 * time.Millisecond)
+			w.Write(blob)
+		default:
+			// The mirror never responds.
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	refspec, err := reference.Parse(strings.TrimPrefix(srv.URL, "http://") + "/repo:tag")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	timeout := 100 * time.Millisecond
+	store, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, nil, hostPolicy{resolveTimeout: timeout})
+	if err != nil {
+		t.Fatalf("newRemoteBlobStore failed: %v", err)
+	}
+	ref := refspec.Locator + "@" + dgst.String()
+
+	start := time.Now()
+	_, err = store.FetchRange(context.Background(), ref, 0, int64(len(blob)-1))
+	if !errors.Is(err, ErrMirrorResolveTimeout) {
+		t.Fatalf("expected %v; got %v", ErrMirrorResolveTimeout, err)
+	}
+	if _, err := store.doInitialFetch(context.Background(), ref); err == nil {
+		t.Fatal("expected doInitialFetch to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 10*timeout {
+		t.Fatalf("expected requests to fail within the timeout; took %v", elapsed)
+	}
+
+	// Reading a response that arrived in time isn't bounded by the timeout.
+	resp, err := store.policy.wrapClient(&http.Client{}).Get(srv.URL + "?mode=slow-body")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	got, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if !bytes.Equal(got, blob) {
+		t.Fatalf("expected %q; got %q", blob, got)
+	}
+}
+
+func TestMirrorMetrics(t *testing.T) {
+	commonmetrics.Register()
+	refspec, err := reference.Parse("docker.io/library/alpine:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	blobRef := func(s string) string {
+		return refspec.Locator + "@" + digest.FromString(s).String()
+	}
+
+	failing := newBlobHostServer(t, http.StatusInternalServerError)
+	healthy := newBlobHostServer(t, http.StatusOK)
+	hosts := []docker.RegistryHost{failing.host(), healthy.host()}
+	store, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{timeout: time.Second})
+	if err != nil {
+		t.Fatalf("newRemoteBlobStore failed: %v", err)
+	}
+	if _, err := store.doInitialFetch(context.Background(), blobRef("layer 1")); err != nil {
+		t.Fatalf("doInitialFetch failed: %v", err)
+	}
+	// The failed host is skipped, so the healthy host is the primary host of other blobs.
+	rc, err := store.FetchRange(context.Background(), blobRef("layer 2"), 0, 0)
+	if err != nil {
+		t.Fatalf("FetchRange failed: %v", err)
+	}
+	rc.Close()
+
+	metrics := scrapeMetrics(t)
+	failingHost, healthyHost := failing.host().Host, healthy.host().Host
+	for _, expected := range []string{
+		fmt.Sprintf(`soci_fs_mirror_requests_total{host=%q,result="failure"} 1`, failingHost),
+		fmt.Sprintf(`soci_fs_mirror_failover_total{host=%q} 1`, failingHost),
+		fmt.Sprintf(`soci_fs_mirror_requests_total{host=%q,result="fallback_success"} 1`, healthyHost),
+		fmt.Sprintf(`soci_fs_mirror_requests_total{host=%q,result="primary_success"} 1`, healthyHost),
+	} {
+		if !slices.Contains(metrics, expected) {
+			t.Fatalf("expected metric %s; got:\n%s", expected, strings.Join(metrics, "\n"))
+		}
+	}
+	if prefix := fmt.Sprintf(`soci_fs_mirror_failover_total{host=%q}`, healthyHost); slices.ContainsFunc(metrics, func(m string) bool {
+		return strings.HasPrefix(m, prefix)
+	}) {
+		t.Fatalf("expected no failover from the healthy host")
+	}
+}
+
+// scrapeMetrics returns the lines of the registered metrics served by the metrics endpoint.
+func scrapeMetrics(t *testing.T) []string {
+	t.Helper()
+	srv := httptest.NewServer(promhttp.Handler())
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read metrics: %v", err)
+	}
+	return strings.Split(string(body), "\n")
+}
+
+func TestUserAgent(t *testing.T) {
+	blob := []byte("layer contents")
+	dgst := digest.FromBytes(blob)
+	var (
+		mu         sync.Mutex
+		userAgents []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		userAgents = append(userAgents, r.Header.Get("User-Agent"))
+		mu.Unlock()
+		w.Header().Set("Accept-Ranges", "bytes")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+	}))
+	defer srv.Close()
+
+	refspec, err := reference.Parse(strings.TrimPrefix(srv.URL, "http://") + "/repo:tag")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	ref := refspec.Locator + "@" + dgst.String()
+
+	tests := []struct {
+		name      string
+		userAgent string
+		expected  string
+	}{
+		{
+			name:     "default",
+			expected: defaultUserAgent,
+		},
+		{
+			name:      "custom",
+			userAgent: "registry-team-agent/1.0",
+			expected:  "registry-team-agent/1.0",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			mu.Lock()
+			userAgents = nil
+			mu.Unlock()
+			store, err := newRemoteBlobStore(context.Background(), refspec, srv.Client(), nil, hostPolicy{userAgent: tc.userAgent})
+			if err != nil {
+				t.Fatalf("newRemoteBlobStore failed: %v", err)
+			}
+			if _, err := store.doInitialFetch(context.Background(), ref); err != nil {
+				t.Fatalf("doInitialFetch failed: %v", err)
+			}
+			rc, err := store.FetchRange(context.Background(), ref, 0, int64(len(blob)-1))
+			if err != nil {
+				t.Fatalf("FetchRange failed: %v", err)
+			}
+			rc.Close()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(userAgents) < 2 {
+				t.Fatalf("expected the initial fetch and range requests; got %d requests", len(userAgents))
+			}
+			for _, ua := range userAgents {
+				if ua != tc.expected {
+					t.Fatalf("expected User-Agent %q; got %q", tc.expected, ua)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	dconfig "github.com/containerd/containerd/remotes/docker/config"
+	"github.com/opencontainers/go-digest"
+)
+
+// TestHostCA checks that a host served over TLS with a private CA is trusted
+// when its certs.d hosts.toml sets the CA, and only then.
+func TestHostCA(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	defer srv.Close()
+
+	refspec, err := reference.Parse("registry.example.com/repo:tag")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	ref := refspec.Locator + "@" + digest.FromString("layer").String()
+
+	tests := []struct {
+		name      string
+		hostsToml string
+		expectErr bool
+	}{
+		{
+			name:      "system roots only",
+			hostsToml: fmt.Sprintf("server = %q\n", srv.URL),
+			expectErr: true,
+		},
+		{
+			name:      "CA of the host",
+			hostsToml: fmt.Sprintf("server = %q\nca = \"ca.pem\"\n", srv.URL),
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			dir := filepath.Join(root, refspec.Hostname())
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				t.Fatalf("failed to create host directory: %v", err)
+			}
+			ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+			if err := os.WriteFile(filepath.Join(dir, "ca.pem"), ca, 0600); err != nil {
+				t.Fatalf("failed to write CA file: %v", err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "hosts.toml"), []byte(tc.hostsToml), 0600); err != nil {
+				t.Fatalf("failed to write hosts.toml: %v", err)
+			}
+			hosts, err := dconfig.ConfigureHosts(context.Background(), dconfig.HostOptions{
+				HostDir: dconfig.HostDirFromRoot(root),
+			})(refspec.Hostname())
+			if err != nil {
+				t.Fatalf("failed to configure hosts: %v", err)
+			}
+
+			store, err := newRemoteBlobStore(context.Background(), refspec, hosts[0].Client, hosts, hostPolicy{})
+			if err == nil {
+				_, err = store.doInitialFetch(context.Background(), ref)
+			}
+			if tc.expectErr && err == nil {
+				t.Fatal("expected fetch to fail")
+			}
+			if !tc.expectErr && err != nil {
+				t.Fatalf("expected fetch to succeed; got %v", err)
+			}
+		})
+	}
+}
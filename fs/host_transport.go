@@ -0,0 +1,129 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	socihttp "github.com/awslabs/soci-snapshotter/internal/http"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+)
+
+// TransportConfig configures the connections to registry hosts used to fetch
+// SOCI artifacts, manifests and layers pulled in parallel.
+type TransportConfig struct {
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept open to each host,
+	// so that concurrent range requests reuse them rather than open new ones.
+	// If 0, the default of DefaultTransportConfig is used.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long idle connections are kept open.
+	// If 0, the default of DefaultTransportConfig is used.
+	IdleConnTimeout time.Duration
+	// ForceAttemptHTTP2 is whether HTTP/2 is attempted, so that requests to
+	// a host are multiplexed over a single connection if the host supports it.
+	ForceAttemptHTTP2 bool
+}
+
+// DefaultTransportConfig returns a TransportConfig tuned for many concurrent small range requests.
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConnsPerHost: 64,
+		IdleConnTimeout:     90 * time.Second,
+		ForceAttemptHTTP2:   true,
+	}
+}
+
+// hostTransports tunes the transports of the clients of registry hosts. Each transport
+// is tuned once, so that the clients of all images share its connections.
+type hostTransports struct {
+	cfg TransportConfig
+
+	mu sync.Mutex
+	// tuned maps each transport to its tuned clone.
+	tuned map[*http.Transport]*http.Transport
+}
+
+func newHostTransports(cfg TransportConfig) *hostTransports {
+	defaults := DefaultTransportConfig()
+	if cfg.MaxIdleConnsPerHost == 0 {
+		cfg.MaxIdleConnsPerHost = defaults.MaxIdleConnsPerHost
+	}
+	if cfg.IdleConnTimeout == 0 {
+		cfg.IdleConnTimeout = defaults.IdleConnTimeout
+	}
+	return &hostTransports{
+		cfg:   cfg,
+		tuned: make(map[*http.Transport]*http.Transport),
+	}
+}
+
+// tune returns the tuned clone of rt. It returns false if rt isn't an *http.Transport.
+func (t *hostTransports) tune(rt http.RoundTripper) (http.RoundTripper, bool) {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	tr, ok := rt.(*http.Transport)
+	if !ok {
+		return nil, false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tuned, ok := t.tuned[tr]; ok {
+		return tuned, true
+	}
+	tuned := tr.Clone()
+	tuned.MaxIdleConnsPerHost = t.cfg.MaxIdleConnsPerHost
+	tuned.MaxIdleConns = max(tuned.MaxIdleConns, t.cfg.MaxIdleConnsPerHost)
+	tuned.IdleConnTimeout = t.cfg.IdleConnTimeout
+	tuned.ForceAttemptHTTP2 = t.cfg.ForceAttemptHTTP2
+	t.tuned[tr] = tuned
+	return tuned, true
+}
+
+// withTransportConfig returns client with its transport tuned by the policy, if any.
+// client is returned as is if its transport can't be tuned.
+func (p hostPolicy) withTransportConfig(client *http.Client) *http.Client {
+	if p.transports == nil {
+		return client
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	if authClient, ok := client.Transport.(*socihttp.AuthClient); ok {
+		// The transport belongs to the inner retryable client.
+		transport, ok := p.transports.tune(authClient.Client().HTTPClient.Transport)
+		if !ok {
+			return client
+		}
+		retryClient := resolver.CloneRetryableClient(authClient.Client())
+		retryClient.HTTPClient.Transport = transport
+		newAuthClient := authClient.CloneWithNewClient(retryClient)
+		newAuthClient.CacheRedirects(authClient.CachesRedirects())
+		return &http.Client{Transport: newAuthClient}
+	}
+
+	transport, ok := p.transports.tune(client.Transport)
+	if !ok {
+		return client
+	}
+	tuned := *client
+	tuned.Transport = transport
+	return &tuned
+}
@@ -0,0 +1,113 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+)
+
+func TestHostTransportConfig(t *testing.T) {
+	refspec, err := reference.Parse("registry.example.com/repo:tag")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	defaults := DefaultTransportConfig()
+
+	tests := []struct {
+		name     string
+		cfg      TransportConfig
+		expected TransportConfig
+	}{
+		{
+			name: "requested values",
+			cfg: TransportConfig{
+				MaxIdleConnsPerHost: 8,
+				IdleConnTimeout:     30 * time.Second,
+				ForceAttemptHTTP2:   true,
+			},
+			expected: TransportConfig{
+				MaxIdleConnsPerHost: 8,
+				IdleConnTimeout:     30 * time.Second,
+				ForceAttemptHTTP2:   true,
+			},
+		},
+		{
+			name: "defaults",
+			expected: TransportConfig{
+				MaxIdleConnsPerHost: defaults.MaxIdleConnsPerHost,
+				IdleConnTimeout:     defaults.IdleConnTimeout,
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			base := &http.Transport{}
+			client := &http.Client{Transport: base}
+			policy := hostPolicy{transports: newHostTransports(tc.cfg)}
+
+			var transports []*http.Transport
+			for range 2 {
+				c := policy.hostClient(client, nil, 0)
+				tr, ok := c.Transport.(*http.Transport)
+				if !ok {
+					t.Fatalf("expected an *http.Transport; got %T", c.Transport)
+				}
+				transports = append(transports, tr)
+			}
+			tr := transports[0]
+			if tr == base {
+				t.Fatal("expected the transport of the client not to be modified")
+			}
+			if transports[1] != tr {
+				t.Fatal("expected clients to share the tuned transport")
+			}
+			got := TransportConfig{
+				MaxIdleConnsPerHost: tr.MaxIdleConnsPerHost,
+				IdleConnTimeout:     tr.IdleConnTimeout,
+				ForceAttemptHTTP2:   tr.ForceAttemptHTTP2,
+			}
+			if got != tc.expected {
+				t.Fatalf("expected transport configured with %+v; got %+v", tc.expected, got)
+			}
+		})
+	}
+
+	t.Run("remote store", func(t *testing.T) {
+		policy := hostPolicy{transports: newHostTransports(DefaultTransportConfig())}
+		store, err := newRemoteStore(context.Background(), refspec, &http.Client{}, nil, policy)
+		if err != nil {
+			t.Fatalf("newRemoteStore failed: %v", err)
+		}
+		client, ok := store.Client.(*http.Client)
+		if !ok {
+			t.Fatalf("expected an *http.Client; got %T", store.Client)
+		}
+		ua, ok := client.Transport.(*userAgentTransport)
+		if !ok {
+			t.Fatalf("expected a *userAgentTransport; got %T", client.Transport)
+		}
+		tr, ok := ua.RoundTripper.(*http.Transport)
+		if !ok || tr.MaxIdleConnsPerHost != defaults.MaxIdleConnsPerHost || !tr.ForceAttemptHTTP2 {
+			t.Fatal("expected the store to use the tuned transport")
+		}
+	})
+}
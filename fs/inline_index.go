@@ -0,0 +1,68 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orasremote "oras.land/oras-go/v2/registry/remote"
+)
+
+// ErrInvalidIndexAnnotation is returned when the configured SOCI index annotation
+// of an image manifest holds neither an index digest nor a base64 encoded index.
+var ErrInvalidIndexAnnotation = errors.New("invalid SOCI index annotation")
+
+// findSociIndexDescInlineAnnotation returns the descriptor of the SOCI index held by the
+// annotation key of the image manifest. The annotation either holds the digest of the
+// index, which is fetched like any other index, or the base64 encoded index itself, in
+// which case the returned descriptor carries the index bytes as its data.
+// errdefs.ErrNotFound is returned if the manifest doesn't have the annotation.
+func findSociIndexDescInlineAnnotation(ctx context.Context, imgDigest digest.Digest, manifestStores []*orasremote.Repository, staleManifestMode, key string) (ocispec.Descriptor, error) {
+	manifest, err := fetchImageManifest(ctx, imgDigest, manifestStores, staleManifestMode)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	value := manifest.Annotations[key]
+	if value == "" {
+		return ocispec.Descriptor{}, errdefs.ErrNotFound
+	}
+	return parseIndexAnnotation(value)
+}
+
+// parseIndexAnnotation parses the value of a SOCI index annotation, which is either
+// an index digest or a base64 encoded index.
+func parseIndexAnnotation(value string) (ocispec.Descriptor, error) {
+	if dgst, err := digest.Parse(value); err == nil {
+		return ocispec.Descriptor{Digest: dgst}, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return ocispec.Descriptor{}, fmt.Errorf("%w: not a digest or base64 encoded index", ErrInvalidIndexAnnotation)
+	}
+	return ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+		Data:      data,
+	}, nil
+}
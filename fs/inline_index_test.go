@@ -0,0 +1,144 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestInlineIndexAnnotation(t *testing.T) {
+	const annotation = "com.example.soci-index"
+	fakeZtoc := []byte("test data")
+	blobs := []ocispec.Descriptor{
+		{
+			MediaType: soci.SociLayerMediaType,
+			Digest:    digest.FromBytes(fakeZtoc),
+			Size:      int64(len(fakeZtoc)),
+		},
+	}
+	indexBytes, err := soci.MarshalIndex(soci.NewIndex(soci.V2, blobs, nil, nil))
+	if err != nil {
+		t.Fatalf("failed to serialize soci index: %v", err)
+	}
+	indexDigest := digest.FromBytes(indexBytes)
+	refspec, err := reference.Parse(imageRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		annotations   map[string]string
+		expectedData  []byte
+		expectedError error
+	}{
+		{
+			name:         "inline index",
+			annotations:  map[string]string{annotation: base64.StdEncoding.EncodeToString(indexBytes)},
+			expectedData: indexBytes,
+		},
+		{
+			name:        "index digest",
+			annotations: map[string]string{annotation: indexDigest.String()},
+		},
+		{
+			name:          "missing annotation",
+			annotations:   map[string]string{soci.ImageAnnotationSociIndexDigest: indexDigest.String()},
+			expectedError: errdefs.ErrNotFound,
+		},
+		{
+			name:          "invalid annotation",
+			annotations:   map[string]string{annotation: "not an index"},
+			expectedError: ErrInvalidIndexAnnotation,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			manifest, err := json.Marshal(ocispec.Manifest{
+				MediaType:   ocispec.MediaTypeImageManifest,
+				Annotations: tc.annotations,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifestDigest := digest.FromBytes(manifest)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/manifests/"+manifestDigest.String()) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+				w.Header().Set("Docker-Content-Digest", manifestDigest.String())
+				w.Write(manifest)
+			}))
+			defer srv.Close()
+			u, err := url.Parse(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hosts := []docker.RegistryHost{{Client: srv.Client(), Host: u.Host, Scheme: "http", Path: "/v2"}}
+			stores, err := newManifestStores(refspec, nil, hosts)
+			if err != nil {
+				t.Fatalf("failed to create stores: %v", err)
+			}
+
+			desc, err := findSociIndexDescInlineAnnotation(context.Background(), manifestDigest, stores, config.StaleManifestModeFailover, annotation)
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("expected error %v; got %v", tc.expectedError, err)
+			}
+			if tc.expectedError != nil {
+				return
+			}
+			if desc.Digest != indexDigest {
+				t.Fatalf("expected SOCI index %v; got %v", indexDigest, desc.Digest)
+			}
+			if !bytes.Equal(desc.Data, tc.expectedData) {
+				t.Fatalf("expected inline index data %q; got %q", tc.expectedData, desc.Data)
+			}
+
+			if tc.expectedData == nil {
+				return
+			}
+			// An inline index is used as is, without fetching it from the registry.
+			remoteContents := map[digest.Digest][]byte{blobs[0].Digest: fakeZtoc}
+			index, err := FetchSociArtifacts(context.Background(), refspec, desc, newFakeLocalStore(), newFakeRemoteStoreWithContents(remoteContents), false)
+			if err != nil {
+				t.Fatalf("failed to fetch SOCI artifacts: %v", err)
+			}
+			if len(index.Blobs) != 1 || index.Blobs[0].Digest != blobs[0].Digest {
+				t.Fatalf("unexpected SOCI index blobs %v", index.Blobs)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"errors"
+	"sync"
+
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrHostCorrupt is returned when a layer would be lazily loaded from a registry host
+// that has served more corrupt spans than allowed.
+var ErrHostCorrupt = errors.New("registry host served too many corrupt spans")
+
+// hostCorruption counts the corrupt spans served by each registry host. Once a host
+// reaches the limit, the circuit breaker of the host trips and new layers aren't
+// lazily loaded from it anymore.
+type hostCorruption struct {
+	// limit is the number of corrupt spans that trips the circuit breaker of a host.
+	// 0 disables the circuit breaker.
+	limit int64
+
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func newHostCorruption(limit int) *hostCorruption {
+	return &hostCorruption{
+		limit:  int64(limit),
+		counts: make(map[string]int64),
+	}
+}
+
+// record counts a corrupt span served by host and returns the number of corrupt
+// spans served by host so far.
+func (h *hostCorruption) record(host string) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[host]++
+	return h.counts[host]
+}
+
+// count returns the number of corrupt spans served by host.
+func (h *hostCorruption) count(host string) int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.counts[host]
+}
+
+// tripped returns whether the circuit breaker of host is tripped.
+func (h *hostCorruption) tripped(host string) bool {
+	return h.limit > 0 && h.count(host) >= h.limit
+}
+
+// watchCorruption counts the corrupt spans of the layer against the registry host
+// returned by host, i.e. the host the layer is currently fetched from.
+func (r *Resolver) watchCorruption(m *spanmanager.SpanManager, dgst digest.Digest, host func() string) {
+	m.SetCorruptionHandler(func(spanID compression.SpanID) {
+		h := host()
+		n := r.corruption.record(h)
+		logger := logrus.WithFields(logrus.Fields{
+			"digest": dgst,
+			"span":   spanID,
+			"host":   h,
+		})
+		logger.Warnf("found corrupt span, %d corrupt spans served by host so far", n)
+		if r.corruption.limit > 0 && n == r.corruption.limit {
+			logger.Errorf("host served %d corrupt spans, no longer lazily loading layers from it", n)
+		}
+	})
+}
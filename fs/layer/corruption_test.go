@@ -0,0 +1,150 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/config"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestCorruptCachedSpan(t *testing.T) {
+	const (
+		spanSize = 64 << 10
+		host     = "example.com"
+	)
+	cfg := config.FSConfig{}
+	cfg.BlobConfig.MaxHostCorruptSpans = 1
+	r, err := NewResolver(t.TempDir(), cfg, nil, nil, nil, OverlayOpaqueAll, nil, 0)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	rand := testutil.NewTestRand(t)
+	ents := []testutil.TarEntry{
+		testutil.File("data", string(rand.RandomByteData(3*spanSize))),
+	}
+	toc, sr, err := ztoc.BuildZtocReader(t, ents, gzip.DefaultCompression, spanSize)
+	if err != nil {
+		t.Fatalf("failed to build ztoc: %v", err)
+	}
+	zinfo, err := toc.Zinfo()
+	if err != nil {
+		t.Fatalf("failed to get zinfo: %v", err)
+	}
+	defer zinfo.Close()
+	zr, err := gzip.NewReader(io.NewSectionReader(sr, 0, sr.Size()))
+	if err != nil {
+		t.Fatalf("failed to decompress layer: %v", err)
+	}
+	uncompressed, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("failed to decompress layer: %v", err)
+	}
+
+	var fetches atomic.Int64
+	spanCache := cache.NewMemoryCache()
+	m := spanmanager.New(toc, io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		fetches.Add(1)
+		return sr.ReadAt(p, offset)
+	}), 0, sr.Size()), spanCache, 0)
+	r.watchCorruption(m, digest.FromString("layer"), func() string { return host })
+
+	// Cache all spans compressed, then corrupt the cached copy of a single span.
+	for id := compression.SpanID(0); id <= toc.MaxSpanID; id++ {
+		if err := m.FetchSingleSpan(id); err != nil {
+			t.Fatalf("failed to fetch span %d: %v", id, err)
+		}
+	}
+	const corruptID compression.SpanID = 1
+	key := fmt.Sprintf("%d", corruptID)
+	cr, err := spanCache.Get(key)
+	if err != nil {
+		t.Fatalf("failed to get cached span: %v", err)
+	}
+	size := zinfo.EndCompressedOffset(corruptID, toc.CompressedArchiveSize) - zinfo.StartCompressedOffset(corruptID)
+	corrupt := make([]byte, size)
+	if _, err := cr.ReadAt(corrupt, 0); err != nil && err != io.EOF {
+		t.Fatalf("failed to read cached span: %v", err)
+	}
+	cr.Close()
+	corrupt[0] ^= 0xff
+	w, err := spanCache.Add(key)
+	if err != nil {
+		t.Fatalf("failed to add corrupt span: %v", err)
+	}
+	w.Write(corrupt)
+	w.Commit()
+	w.Close()
+	fetches.Store(0)
+
+	readSpan := func(id compression.SpanID) {
+		start := zinfo.StartUncompressedOffset(id)
+		end := zinfo.EndUncompressedOffset(id, toc.UncompressedArchiveSize)
+		rc, err := m.GetContents(start, end)
+		if err != nil {
+			t.Fatalf("failed to read span %d: %v", id, err)
+		}
+		defer rc.Close()
+		got, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("failed to read span %d: %v", id, err)
+		}
+		if !bytes.Equal(got, uncompressed[start:end]) {
+			t.Fatalf("unexpected contents of span %d", id)
+		}
+	}
+	for id := compression.SpanID(0); id <= toc.MaxSpanID; id++ {
+		readSpan(id)
+	}
+
+	// Only the corrupt span is fetched again; the other spans are served from the cache.
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected only the corrupt span to be fetched again; got %d fetches", n)
+	}
+	if n := r.corruption.count(host); n != 1 {
+		t.Fatalf("expected 1 corrupt span to be counted against %s; got %d", host, n)
+	}
+	if !r.corruption.tripped(host) {
+		t.Fatalf("expected the circuit breaker of %s to be tripped", host)
+	}
+	if r.corruption.tripped("other.example.com") {
+		t.Fatalf("expected the circuit breaker of other hosts to not be tripped")
+	}
+	if spans := m.CachedSpans(); len(spans) != int(toc.MaxSpanID)+1 {
+		t.Fatalf("expected all spans to stay cached; got %d of %d", len(spans), toc.MaxSpanID+1)
+	}
+
+	// An invalidated span is fetched again the next time it is read.
+	if err := m.InvalidateSpan(0); err != nil {
+		t.Fatalf("failed to invalidate span: %v", err)
+	}
+	readSpan(0)
+	if n := fetches.Load(); n != 2 {
+		t.Fatalf("expected the invalidated span to be fetched again; got %d fetches in total", n)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// dirTree is an in-memory copy of the directory structure of a layer. It is
+// built once when the layer is mounted, so that readdir and lookup are served
+// without querying the metadata store. Layers are immutable, so it never
+// needs to be invalidated.
+type dirTree struct {
+	dirs map[uint32]*dirTreeDir
+}
+
+type dirTreeDir struct {
+	// ents are the entries of the directory as they are shown by readdir.
+	ents []fuse.DirEntry
+	// children are the entries of the directory as they are stored in the
+	// metadata store, including whiteouts.
+	children map[string]dirTreeEntry
+}
+
+type dirTreeEntry struct {
+	id   uint32
+	attr metadata.Attr
+}
+
+// buildDirTree walks the directory structure of the layer served by fs.
+func buildDirTree(fs *fs) (*dirTree, error) {
+	md := fs.r.Metadata()
+	t := &dirTree{dirs: make(map[uint32]*dirTreeDir)}
+	queue := []uint32{fs.rootID}
+	for len(queue) > 0 {
+		dirID := queue[0]
+		queue = queue[1:]
+
+		ents, err := fs.listDir(dirID)
+		if err != nil {
+			return nil, err
+		}
+		dir := &dirTreeDir{
+			ents:     ents,
+			children: make(map[string]dirTreeEntry),
+		}
+		var lastErr error
+		if err := md.ForeachChild(dirID, func(name string, id uint32, mode os.FileMode) bool {
+			attr, err := md.GetAttr(id)
+			if err != nil {
+				lastErr = err
+				return false
+			}
+			dir.children[name] = dirTreeEntry{id: id, attr: attr}
+			if mode.IsDir() {
+				queue = append(queue, id)
+			}
+			return true
+		}); err != nil || lastErr != nil {
+			return nil, fmt.Errorf("failed to list children of %d: err = %v; lastErr = %v", dirID, err, lastErr)
+		}
+		t.dirs[dirID] = dir
+	}
+	return t, nil
+}
+
+// readdir returns the entries of the directory id. It returns false if the
+// tree isn't precomputed or id isn't a directory.
+func (t *dirTree) readdir(id uint32) ([]fuse.DirEntry, bool) {
+	if t == nil {
+		return nil, false
+	}
+	dir, ok := t.dirs[id]
+	if !ok {
+		return nil, false
+	}
+	return dir.ents, true
+}
+
+// getChild returns the child base of the directory pid, from the precomputed
+// directory tree if there is one.
+func (fs *fs) getChild(pid uint32, base string) (uint32, metadata.Attr, error) {
+	if fs.dirTree == nil {
+		return fs.r.Metadata().GetChild(pid, base)
+	}
+	dir, ok := fs.dirTree.dirs[pid]
+	if !ok {
+		return 0, metadata.Attr{}, fmt.Errorf("node %d is not a directory", pid)
+	}
+	e, ok := dir.children[base]
+	if !ok {
+		return 0, metadata.Attr{}, fmt.Errorf("child %q of node %d not found", base, pid)
+	}
+	return e.id, e.attr, nil
+}
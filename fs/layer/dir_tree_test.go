@@ -0,0 +1,156 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"compress/gzip"
+	"context"
+	"path"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/fs/reader"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/idtools"
+	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/google/go-cmp/cmp"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPrecomputedDirTree(t *testing.T) {
+	ents := []testutil.TarEntry{
+		testutil.Dir("a/"),
+		testutil.Dir("a/b/"),
+		testutil.Dir("a/b/c/"),
+		testutil.File("a/b/c/file", "test"),
+		testutil.File("a/b/.wh.deleted", ""),
+		testutil.File("a/sibling", "sibling"),
+		testutil.Dir("opaque/"),
+		testutil.File("opaque/.wh..wh..opq", ""),
+		testutil.File("opaque/kept", "kept"),
+		testutil.Symlink("link", "a/sibling"),
+		testutil.File("implicit/parent/file", "implicit"),
+	}
+	toc, sr, err := ztoc.BuildZtocReader(t, ents, gzip.DefaultCompression, 64<<10)
+	if err != nil {
+		t.Fatalf("failed to build sample ztoc: %v", err)
+	}
+	mr, err := metadata.NewTempDbStore(sr, toc.TOC)
+	if err != nil {
+		t.Fatalf("failed to create metadata reader: %v", err)
+	}
+	defer mr.Close()
+	spanManager := spanmanager.New(toc, sr, cache.NewMemoryCache(), 0)
+	r, err := reader.NewReader(mr, digest.FromString(""), spanManager, false)
+	if err != nil {
+		t.Fatalf("failed to make new reader: %v", err)
+	}
+	defer r.Close()
+
+	uncached := getRootNode(t, r, OverlayOpaqueAll)
+	cached := getRootNodeWithFSConfig(t, r, OverlayOpaqueAll, config.FSConfig{PrecomputeDirTree: true})
+	if cached.fs.dirTree == nil {
+		t.Fatalf("expected directory tree to be precomputed")
+	}
+	compareDirTrees(t, "/", uncached, cached)
+
+	// Listing a directory from the precomputed tree must not rebuild the entries.
+	readdirAllocs := func(root *node) float64 {
+		return testing.AllocsPerRun(100, func() {
+			n := &node{id: root.id, fs: root.fs}
+			if _, errno := n.readdir(); errno != 0 {
+				t.Fatalf("failed to read root directory: %v", errno)
+			}
+		})
+	}
+	if uncachedAllocs, cachedAllocs := readdirAllocs(uncached), readdirAllocs(cached); cachedAllocs >= uncachedAllocs {
+		t.Fatalf("expected readdir from the precomputed tree to allocate less; got %v allocs, uncached %v allocs", cachedAllocs, uncachedAllocs)
+	}
+}
+
+// compareDirTrees recursively checks that the directory dir is listed and
+// looked up identically with and without a precomputed directory tree.
+func compareDirTrees(t *testing.T, dir string, uncached, cached *node) {
+	want, errno := uncached.readdir()
+	if errno != 0 {
+		t.Fatalf("failed to read directory %q: %v", dir, errno)
+	}
+	got, errno := cached.readdir()
+	if errno != 0 {
+		t.Fatalf("failed to read directory %q from the precomputed tree: %v", dir, errno)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected entries in directory %q (-want +got):\n%s", dir, diff)
+	}
+	if uncached.isOpaque() != cached.isOpaque() {
+		t.Fatalf("unexpected opaqueness of directory %q", dir)
+	}
+
+	for _, ent := range want {
+		var wantOut, gotOut fuse.EntryOut
+		wantInode, errno := uncached.Lookup(context.Background(), ent.Name, &wantOut)
+		if errno != 0 {
+			t.Fatalf("failed to lookup %q in %q: %v", ent.Name, dir, errno)
+		}
+		gotInode, errno := cached.Lookup(context.Background(), ent.Name, &gotOut)
+		if errno != 0 {
+			t.Fatalf("failed to lookup %q in %q from the precomputed tree: %v", ent.Name, dir, errno)
+		}
+		if diff := cmp.Diff(wantOut.Attr, gotOut.Attr); diff != "" {
+			t.Fatalf("unexpected attributes of %q in %q (-want +got):\n%s", ent.Name, dir, diff)
+		}
+		wantChild, ok := wantInode.Operations().(*node)
+		if !ok || ent.Mode&fuse.S_IFDIR == 0 {
+			continue
+		}
+		compareDirTrees(t, path.Join(dir, ent.Name), wantChild, gotInode.Operations().(*node))
+	}
+
+	var out fuse.EntryOut
+	if _, errno := cached.Lookup(context.Background(), "nonexistent", &out); errno == 0 {
+		t.Fatalf("expected lookup of nonexistent entry in %q to fail", dir)
+	}
+}
+
+func getRootNodeWithFSConfig(t *testing.T, r reader.Reader, opaque OverlayOpaqueType, cfg config.FSConfig) *node {
+	l := &layer{
+		resolver: &Resolver{
+			overlayOpaqueType: opaque,
+			config:            cfg,
+		},
+		desc: ocispec.Descriptor{
+			Digest: testStateLayerDigest,
+		},
+		blob: &blobRef{
+			Blob: &testBlobState{10, 5},
+			done: func() {},
+		},
+		r: &testReader{r},
+	}
+	rootNode, err := newNode(l, 100, idtools.IDMap{})
+	if err != nil {
+		t.Fatalf("failed to get root node: %v", err)
+	}
+	fusefs.NewNodeFS(rootNode, &fusefs.Options{})
+	return rootNode.(*node)
+}
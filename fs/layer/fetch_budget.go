@@ -0,0 +1,99 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrFetchBudgetExceeded is returned by fetches that would exceed the fetch budget
+// of a layer when the budget action is config.FetchBudgetActionFail.
+var ErrFetchBudgetExceeded = errors.New("layer fetch budget exceeded")
+
+// FetchBudget limits the number of bytes a mounted layer fetches from the registry.
+type FetchBudget struct {
+	// Bytes is the number of bytes the layer may fetch. Values <= 0 disable the budget.
+	Bytes int64
+	// Action is what happens to fetches beyond the budget.
+	// One of config.FetchBudgetActionFail or config.FetchBudgetActionAlert.
+	Action string
+}
+
+// fetchBudget tracks the bytes fetched for a layer against its FetchBudget.
+type fetchBudget struct {
+	dgst    digest.Digest
+	budget  atomic.Pointer[FetchBudget]
+	fetched atomic.Int64
+	alerted atomic.Bool
+}
+
+func newFetchBudget(dgst digest.Digest, budget FetchBudget) *fetchBudget {
+	b := &fetchBudget{dgst: dgst}
+	b.set(budget)
+	return b
+}
+
+// set replaces the budget. Bytes fetched so far count against the new budget.
+func (b *fetchBudget) set(budget FetchBudget) {
+	b.budget.Store(&budget)
+}
+
+// reserve accounts for n bytes about to be fetched. If the fetch would exceed the
+// budget and the budget action is config.FetchBudgetActionFail, the bytes aren't
+// accounted for and an error wrapping ErrFetchBudgetExceeded is returned.
+func (b *fetchBudget) reserve(n int64) error {
+	budget := b.budget.Load()
+	if budget.Bytes <= 0 {
+		b.fetched.Add(n)
+		return nil
+	}
+	if budget.Action == config.FetchBudgetActionAlert {
+		if fetched := b.fetched.Add(n); fetched > budget.Bytes {
+			commonmetrics.IncOperationCount(commonmetrics.FetchBudgetExceededCount, b.dgst)
+			if b.alerted.CompareAndSwap(false, true) {
+				logrus.WithField("digest", b.dgst).Errorf("layer fetched %d bytes, exceeding its fetch budget of %d bytes", fetched, budget.Bytes)
+			}
+		}
+		return nil
+	}
+	for {
+		fetched := b.fetched.Load()
+		if fetched+n > budget.Bytes {
+			return fmt.Errorf("%w: fetching %d bytes on top of %d bytes exceeds the budget of %d bytes", ErrFetchBudgetExceeded, n, fetched, budget.Bytes)
+		}
+		if b.fetched.CompareAndSwap(fetched, fetched+n) {
+			return nil
+		}
+	}
+}
+
+// readerAt returns a readerAtFunc reading from f as long as the budget allows it.
+func (b *fetchBudget) readerAt(f readerAtFunc) readerAtFunc {
+	return func(p []byte, offset int64) (int, error) {
+		if err := b.reserve(int64(len(p))); err != nil {
+			return 0, err
+		}
+		return f(p, offset)
+	}
+}
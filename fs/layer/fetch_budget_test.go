@@ -0,0 +1,77 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestFetchBudget(t *testing.T) {
+	const budgetBytes = 10
+	tests := []struct {
+		name        string
+		action      string
+		expectedErr error
+	}{
+		{
+			name:        "fail",
+			action:      config.FetchBudgetActionFail,
+			expectedErr: ErrFetchBudgetExceeded,
+		},
+		{
+			name:   "alert",
+			action: config.FetchBudgetActionAlert,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := bytes.NewReader(make([]byte, 4*budgetBytes))
+			var fetches int
+			b := newFetchBudget(digest.FromString(tc.name), FetchBudget{Bytes: budgetBytes, Action: tc.action})
+			readAt := b.readerAt(func(p []byte, offset int64) (int, error) {
+				fetches++
+				return data.ReadAt(p, offset)
+			})
+
+			if _, err := readAt(make([]byte, budgetBytes), 0); err != nil {
+				t.Fatalf("failed to fetch within the budget: %v", err)
+			}
+			_, err := readAt(make([]byte, 1), budgetBytes)
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("unexpected error fetching beyond the budget; expected %v; got %v", tc.expectedErr, err)
+			}
+			if tc.expectedErr != nil {
+				if fetches != 1 {
+					t.Fatalf("expected fetches beyond the budget to not reach the registry; got %d fetches", fetches)
+				}
+			} else if !b.alerted.Load() {
+				t.Fatalf("expected fetches beyond the budget to be alerted")
+			}
+
+			// Raising the budget allows further fetches.
+			b.set(FetchBudget{Bytes: 2 * budgetBytes, Action: tc.action})
+			if _, err := readAt(make([]byte, budgetBytes/2), budgetBytes); err != nil {
+				t.Fatalf("failed to fetch within the raised budget: %v", err)
+			}
+		})
+	}
+}
@@ -41,6 +41,7 @@ package layer
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -79,13 +80,22 @@ const (
 	defaultMaxLRUCacheEntry   = 10
 	defaultMaxCacheFds        = 10
 	memoryCacheType           = "memory"
+	// cacheSizeTTL is how long the size of the layer caches on disk is reused
+	// before walking the caches again.
+	cacheSizeTTL = 30 * time.Second
 )
 
+// ErrLayerNotResolved is returned when warming the span cache of a layer that isn't resolved.
+var ErrLayerNotResolved = errors.New("layer is not resolved")
+
 // Layer represents a layer.
 type Layer interface {
 	// Info returns the information of this layer.
 	Info() Info
 
+	// Fetched returns a channel that is closed once the whole layer is fetched.
+	Fetched() <-chan struct{}
+
 	// RootNode returns the root node of this layer.
 	RootNode(baseInode uint32, idMapper idtools.IDMap) (fusefs.InodeEmbedder, error)
 
@@ -101,6 +111,13 @@ type Layer interface {
 	// DisableXAttrs determines whether this layer should have xattrs disabled
 	DisableXAttrs() bool
 
+	// SetFetchBudget overrides the fetch budget of this layer set by the config.
+	SetFetchBudget(FetchBudget)
+
+	// UnfetchedFiles lists the regular files of at least minSize bytes whose
+	// contents aren't entirely fetched yet.
+	UnfetchedFiles(minSize int64) ([]UnfetchedFile, error)
+
 	// Done releases the reference to this layer. The resources related to this layer will be
 	// discarded sooner or later. Queries after calling this function won't be serviced.
 	Done()
@@ -112,6 +129,8 @@ type Info struct {
 	Size        int64     // layer size in bytes
 	FetchedSize int64     // layer fetched size in bytes
 	ReadTime    time.Time // last time the layer was read
+	Host        string    // registry host the layer is currently fetched from
+	OnDemand    bool      // layer is only fetched on demand, never in the background
 }
 
 // Resolver resolves the layer location and provieds the handler of that layer.
@@ -128,11 +147,31 @@ type Resolver struct {
 	artifactStore     content.Storage
 	overlayOpaqueType OverlayOpaqueType
 	bgFetcher         *backgroundfetcher.BackgroundFetcher
+	fetchLanes        *reader.FetchLanes
+
+	cacheWriteFailureMode spanmanager.CacheWriteFailureMode
+	// spanBufPool is shared by the span managers of all layers. It is nil if disabled.
+	spanBufPool *spanmanager.BufferPool
+	// corruption counts the corrupt spans served by each registry host.
+	corruption *hostCorruption
+	// fetchBudget is the default fetch budget of each layer.
+	fetchBudget FetchBudget
+
+	// imageLayers tracks the layer digests resolved for each image reference
+	// so that all of an image's cached layers can be evicted at once.
+	imageLayers   map[string]map[digest.Digest]struct{}
+	imageLayersMu sync.Mutex
+
+	// cacheSize is the size of the layer caches on disk, as of cacheSizeAt.
+	cacheSize   int64
+	cacheSizeAt time.Time
+	cacheSizeMu sync.Mutex
 }
 
 // NewResolver returns a new layer resolver.
 func NewResolver(root string, cfg config.FSConfig, resolveHandlers map[string]remote.Handler,
-	metadataStore metadata.Store, artifactStore content.Storage, overlayOpaqueType OverlayOpaqueType, bgFetcher *backgroundfetcher.BackgroundFetcher) (*Resolver, error) {
+	metadataStore metadata.Store, artifactStore content.Storage, overlayOpaqueType OverlayOpaqueType, bgFetcher *backgroundfetcher.BackgroundFetcher,
+	coalesceWindow int64) (*Resolver, error) {
 	resolveResultEntry := cfg.ResolveResultEntry
 	if resolveResultEntry == 0 {
 		resolveResultEntry = defaultResolveResultEntry
@@ -164,9 +203,27 @@ func NewResolver(root string, cfg config.FSConfig, resolveHandlers map[string]re
 		return nil, err
 	}
 
+	if cfg.DirectoryCacheConfig.RepairOnStartup {
+		// Stale caches must be listed before any cache of this run is created.
+		removeStale, err := staleCacheRemover(root)
+		if err != nil {
+			return nil, err
+		}
+		go removeStale()
+	}
+
+	if err := validateLazyLoadPaths(cfg.LazyLoadPaths); err != nil {
+		return nil, err
+	}
+
+	cacheWriteFailureMode, err := spanmanager.ParseCacheWriteFailureMode(cfg.DirectoryCacheConfig.WriteFailureMode)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Resolver{
 		rootDir:           root,
-		resolver:          remote.NewResolver(cfg.BlobConfig, resolveHandlers),
+		resolver:          remote.NewResolver(filepath.Join(root, "blobcopy"), cfg.BlobConfig, resolveHandlers, coalesceWindow, cfg.HostRepositoryPrefixes),
 		layerCache:        layerCache,
 		blobCache:         blobCache,
 		config:            cfg,
@@ -175,9 +232,94 @@ func NewResolver(root string, cfg config.FSConfig, resolveHandlers map[string]re
 		artifactStore:     artifactStore,
 		overlayOpaqueType: overlayOpaqueType,
 		bgFetcher:         bgFetcher,
+		fetchLanes:        reader.NewFetchLanes(cfg.FetchLanesConfig.MetadataMaxConcurrency, cfg.FetchLanesConfig.DataMaxConcurrency),
+
+		cacheWriteFailureMode: cacheWriteFailureMode,
+		spanBufPool:           spanmanager.NewBufferPool(int(cfg.BlobConfig.SpanBufferSize)),
+		corruption:            newHostCorruption(cfg.BlobConfig.MaxHostCorruptSpans),
+		fetchBudget: FetchBudget{
+			Bytes:  cfg.BlobConfig.MountFetchBudgetBytes,
+			Action: cfg.BlobConfig.MountFetchBudgetAction,
+		},
 	}, nil
 }
 
+// staleCacheRemover lists the span and HTTP caches and the temporary zTOC files left
+// in root by a previous run, e.g. one that crashed before cleaning them up. Every run
+// creates its caches in new directories, so these are never read again. The returned
+// function removes them, which may take a while for large caches.
+func staleCacheRemover(root string) (func(), error) {
+	var stale []string
+	for _, dir := range []string{"spancache", "httpcache"} {
+		entries, err := os.ReadDir(filepath.Join(root, dir))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to list stale caches: %w", err)
+		}
+		for _, e := range entries {
+			stale = append(stale, filepath.Join(root, dir, e.Name()))
+		}
+	}
+	ztocs, err := filepath.Glob(filepath.Join(root, "ztoc-*"))
+	if err != nil {
+		return nil, err
+	}
+	stale = append(stale, ztocs...)
+	return func() {
+		for _, p := range stale {
+			if err := os.RemoveAll(p); err != nil {
+				logrus.WithError(err).WithField("path", p).Warn("failed to remove stale cache")
+			}
+		}
+		if len(stale) > 0 {
+			logrus.WithField("count", len(stale)).Info("removed stale caches of a previous run")
+		}
+	}, nil
+}
+
+// CacheSize returns the number of bytes the layer caches take up on disk.
+// Walking the caches is expensive, so the size is only measured again once
+// it's older than cacheSizeTTL.
+func (r *Resolver) CacheSize() (int64, error) {
+	r.cacheSizeMu.Lock()
+	defer r.cacheSizeMu.Unlock()
+	if !r.cacheSizeAt.IsZero() && time.Since(r.cacheSizeAt) < cacheSizeTTL {
+		return r.cacheSize, nil
+	}
+	size, err := r.measureCacheSize()
+	if err != nil {
+		return 0, err
+	}
+	r.cacheSize, r.cacheSizeAt = size, time.Now()
+	return size, nil
+}
+
+// measureCacheSize walks the layer caches and returns the number of bytes they take up on disk.
+func (r *Resolver) measureCacheSize() (int64, error) {
+	var size int64
+	err := filepath.WalkDir(r.rootDir, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				// The file was removed while walking the cache.
+				return nil
+			}
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
 func newCache(root string, cacheType string, cfg config.FSConfig) (cache.BlobCache, error) {
 	if cacheType == memoryCacheType {
 		return cache.NewMemoryCache(), nil
@@ -222,6 +364,8 @@ func newCache(root string, cacheType string, cfg config.FSConfig) (cache.BlobCac
 			FdCache:   fCache,
 			BufPool:   bufPool,
 			Direct:    dcc.Direct,
+
+			MinFreeInodes: dcc.MinFreeInodes,
 		},
 	)
 }
@@ -265,6 +409,9 @@ func (r *Resolver) Resolve(ctx context.Context, hosts []docker.RegistryHost, ref
 			blobR.done()
 		}
 	}()
+	if host := blobR.Host(); r.corruption.tripped(host) {
+		return nil, fmt.Errorf("%w: %s", ErrHostCorrupt, host)
+	}
 
 	spanCache, err := newCache(filepath.Join(r.rootDir, "spancache"), r.config.FSCacheType, r.config)
 	if err != nil {
@@ -276,16 +423,11 @@ func (r *Resolver) Resolve(ctx context.Context, hosts []docker.RegistryHost, ref
 		}
 	}()
 
-	ztocReader, err := r.artifactStore.Fetch(ctx, sociDesc)
-	if err != nil {
-		return nil, err
-	}
-	defer ztocReader.Close()
 	// Check if the ztoc exists (will be passed from fs)
 	// If it exists, we decide if we want to lazily load layer, or
 	// download/decompress the entire layer
 	// If we decide to download/decompress the entire layer, getZtoc will not return the ztoc
-	ztoc, err := ztoc.Unmarshal(ztocReader)
+	ztoc, err := r.fetchZtoc(ctx, sociDesc)
 
 	if err != nil {
 		// for now error out and let container runtime handle the layer download
@@ -298,20 +440,30 @@ func (r *Resolver) Resolve(ctx context.Context, hosts []docker.RegistryHost, ref
 		// for now just error out, so container runtime takes care of this
 		return nil, fmt.Errorf("download and unpack this layer in container runtime for now")
 	}
+	// Releasing the TOC again once the metadata store is initialized is a no-op.
+	defer ztoc.Release()
 
 	// log ztoc info
 	log.G(context.Background()).WithFields(logrus.Fields{
 		"layer_sha":      desc.Digest,
-		"files_in_layer": len(ztoc.FileMetadata),
+		"files_in_layer": ztoc.Len(),
 	}).Debugf("[Resolver.Resolve] downloaded layer ZTOC")
 	// continue with resolving the layer presuming we handle ZTOC
 	// ztoc will belong to a layer
 
+	// Find the spans of files that aren't lazily loaded before the file
+	// metadata is released below.
+	eagerSpanIDs, err := eagerSpans(ztoc, r.config.LazyLoadPaths)
+	if err != nil {
+		return nil, fmt.Errorf("failed to filter lazily loaded files: %w", err)
+	}
+
 	// Get a reader for the layer files
 	// Each file's read operation is a prioritized task and all background tasks
 	// will be stopped during the execution so this can avoid being disturbed for
 	// NW traffic by background tasks.
-	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
+	budget := newFetchBudget(desc.Digest, r.fetchBudget)
+	sr := io.NewSectionReader(budget.readerAt(func(p []byte, offset int64) (n int, err error) {
 		return blobR.ReadAt(p, offset)
 	}), 0, blobR.Size())
 	// define telemetry hooks to measure latency metrics for the metadata store
@@ -324,31 +476,227 @@ func (r *Resolver) Resolve(ctx context.Context, hosts []docker.RegistryHost, ref
 	if err != nil {
 		return nil, err
 	}
-	ztoc.TOC.FileMetadata = nil
+	if err := ztoc.Release(); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to release ztoc")
+	}
 	log.G(ctx).Debugf("[Resolver.Resolve]Initialized metadata store for layer sha=%v", desc.Digest)
 
 	spanManager := spanmanager.New(ztoc, sr, spanCache, r.config.BlobConfig.MaxSpanVerificationRetries, cache.Direct())
+	spanManager.SetCacheWriteFailureMode(r.cacheWriteFailureMode)
+	spanManager.SetBufferPool(r.spanBufPool)
+	r.watchCorruption(spanManager, desc.Digest, blobR.Host)
+	if n := spanGroupSize(int64(spanManager.SpanSize()), r.config.BlobConfig); n > 1 {
+		log.G(ctx).Infof("layer is indexed with %d byte spans, fetching up to %d spans per request", spanManager.SpanSize(), n)
+		spanManager.SetSpanGroupSize(n)
+	}
 	var bgLayerResolver backgroundfetcher.Resolver
 	if r.bgFetcher != nil {
 		bgLayerResolver = backgroundfetcher.NewSequentialResolver(desc.Digest, spanManager)
 		r.bgFetcher.Add(bgLayerResolver)
 	}
-	vr, err := reader.NewReader(meta, desc.Digest, spanManager, disableVerification)
+	vr, err := reader.NewReader(meta, desc.Digest, spanManager, disableVerification, reader.WithFetchLanes(r.fetchLanes))
 	if err != nil {
 		return nil, fmt.Errorf("failed to read layer: %w", err)
 	}
 	disableXAttrs := getDisableXAttrAnnotation(sociDesc)
 	// Combine layer information together and cache it.
-	l := newLayer(r, desc, blobR, vr, bgLayerResolver, opCounter, disableXAttrs)
+	l := newLayer(r, desc, blobR, vr, spanManager, bgLayerResolver, opCounter, disableXAttrs, budget)
+	cachedL, done2 := r.cacheLayer(refspec, l)
+	if len(eagerSpanIDs) > 0 && cachedL == l {
+		// Spans are materialized in the background so they don't delay the mount.
+		// Failing to materialize is not fatal; the remaining spans are fetched lazily on read.
+		go func() {
+			if err := materializeSpans(spanManager, eagerSpanIDs, l.isClosed); err != nil {
+				log.G(ctx).WithError(err).Warn("failed to eagerly fetch files not matching lazy load paths")
+			} else {
+				log.G(ctx).Debugf("eagerly fetched %d spans of files not matching lazy load paths", len(eagerSpanIDs))
+			}
+		}()
+	}
+
+	log.G(ctx).Debugf("resolved layer")
+	return &layerRef{cachedL.(*layer), done2}, nil
+}
+
+// PrefetchBlob resolves the blob of a layer ahead of Resolve, so that the registry
+// round trips needed to resolve it can overlap with fetching the SOCI index of the
+// image. The blob stays in the blob cache, where Resolve picks it up, until it's evicted.
+func (r *Resolver) PrefetchBlob(ctx context.Context, hosts []docker.RegistryHost, refspec reference.Spec, desc ocispec.Descriptor) error {
+	name := refspec.String() + "/" + desc.Digest.String()
+
+	// Resolve waits for the blob to be resolved instead of resolving it again.
+	r.resolveLock.Lock(name)
+	defer r.resolveLock.Unlock(name)
+
+	blobR, err := r.resolveBlob(ctx, hosts, refspec, desc)
+	if err != nil {
+		return fmt.Errorf("failed to resolve the blob: %w", err)
+	}
+	blobR.done()
+	return nil
+}
+
+// WarmLayer fetches the spans of the layer dgst of the image refspec that aren't cached yet
+// into its span cache, from which lazy reads of the layer are served. The layer must have
+// been resolved, e.g. by mounting it, or ErrLayerNotResolved is returned. It returns whether
+// every span was already cached.
+func (r *Resolver) WarmLayer(refspec reference.Spec, dgst digest.Digest) (bool, error) {
+	r.layerCacheMu.Lock()
+	c, done, ok := r.layerCache.Get(refspec.String() + "/" + dgst.String())
+	r.layerCacheMu.Unlock()
+	if !ok {
+		return false, fmt.Errorf("%w: %s", ErrLayerNotResolved, dgst)
+	}
+	defer done()
+	l := c.(*layer)
+	if l.isClosed() || l.spanManager == nil {
+		return false, fmt.Errorf("%w: %s", ErrLayerNotResolved, dgst)
+	}
+	fetched, err := l.spanManager.FetchAllSpans()
+	if err != nil {
+		return false, err
+	}
+	return fetched == 0, nil
+}
+
+// spanGroupSize returns the number of consecutive spans of spanSize bytes fetched with
+// a single request, or 1 if spans smaller than cfg.SpanGroupingThreshold aren't grouped.
+func spanGroupSize(spanSize int64, cfg config.BlobConfig) int {
+	if spanSize <= 0 || cfg.SpanGroupingThreshold <= 0 || spanSize >= cfg.SpanGroupingThreshold {
+		return 1
+	}
+	return int(max(1, (cfg.SpanGroupSize+spanSize-1)/spanSize))
+}
+
+// cacheLayer adds the layer to the layer cache and records it as a layer of the image
+// referred by refspec. If the layer already exists in the cache, the passed one is
+// discarded and the cached one is returned.
+func (r *Resolver) cacheLayer(refspec reference.Spec, l *layer) (*layer, func()) {
+	ref := refspec.String()
 	r.layerCacheMu.Lock()
-	cachedL, done2, added := r.layerCache.Add(name, l)
+	cachedL, done, added := r.layerCache.Add(ref+"/"+l.desc.Digest.String(), l)
 	r.layerCacheMu.Unlock()
 	if !added {
 		l.close() // layer already exists in the cache. discard this.
 	}
 
-	log.G(ctx).Debugf("resolved layer")
-	return &layerRef{cachedL.(*layer), done2}, nil
+	r.imageLayersMu.Lock()
+	defer r.imageLayersMu.Unlock()
+	if r.imageLayers == nil {
+		r.imageLayers = make(map[string]map[digest.Digest]struct{})
+	}
+	if r.imageLayers[ref] == nil {
+		r.imageLayers[ref] = make(map[digest.Digest]struct{})
+	}
+	r.imageLayers[ref][l.desc.Digest] = struct{}{}
+	return cachedL.(*layer), done
+}
+
+// EvictImage synchronously removes the cached layers and blobs resolved for the image
+// reference, including their span and HTTP caches, and returns the number of fetched
+// bytes reclaimed. Layers of other images are cached separately, so they are preserved
+// even if they share a digest with a layer of this image. Layers that are still in use
+// (e.g. by a mounted snapshot) are also preserved; they can be evicted again once released.
+func (r *Resolver) EvictImage(ref string) (int64, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return 0, fmt.Errorf("invalid image reference %q: %w", ref, err)
+	}
+	ref = refspec.String()
+
+	r.imageLayersMu.Lock()
+	defer r.imageLayersMu.Unlock()
+	var reclaimed int64
+	for dgst := range r.imageLayers[ref] {
+		reclaimed += r.evictLayer(ref, dgst)
+	}
+	return reclaimed, nil
+}
+
+// ReclaimLayer removes the layer with the digest resolved for the image reference,
+// including its span and HTTP caches, if it is no longer used, and returns the number
+// of fetched bytes reclaimed. It lets the cache of a layer that containerd no longer
+// references be reclaimed right away instead of waiting for size-based eviction.
+func (r *Resolver) ReclaimLayer(ref string, dgst digest.Digest) (int64, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return 0, fmt.Errorf("invalid image reference %q: %w", ref, err)
+	}
+	ref = refspec.String()
+
+	r.imageLayersMu.Lock()
+	defer r.imageLayersMu.Unlock()
+	if _, ok := r.imageLayers[ref][dgst]; !ok {
+		return 0, nil
+	}
+	return r.evictLayer(ref, dgst), nil
+}
+
+// evictLayer removes the layer with the digest resolved for the image reference from
+// the layer and blob caches unless it is still in use, and returns the number of fetched
+// bytes reclaimed. The caller must hold imageLayersMu.
+func (r *Resolver) evictLayer(ref string, dgst digest.Digest) (reclaimed int64) {
+	name := ref + "/" + dgst.String()
+	l, layerRemoved, layerInUse := removeUnused(r.layerCache, &r.layerCacheMu, name)
+	// Closing the layer releases its reference to the blob so the blob can be removed as well.
+	b, blobRemoved, blobInUse := removeUnused(r.blobCache, &r.blobCacheMu, name)
+	switch {
+	case layerRemoved:
+		reclaimed = l.(*layer).blob.FetchedSize()
+	case blobRemoved:
+		reclaimed = b.(remote.Blob).FetchedSize()
+	}
+	if !layerInUse && !blobInUse {
+		delete(r.imageLayers[ref], dgst)
+		if len(r.imageLayers[ref]) == 0 {
+			delete(r.imageLayers, ref)
+		}
+	}
+	return reclaimed
+}
+
+// removeUnused removes the entry from the cache if nobody refers to it. inUse reports
+// whether the entry remains in the cache because it is still referenced.
+func removeUnused(c *lrucache.Cache, mu *sync.Mutex, key string) (value interface{}, removed, inUse bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if v, ok := c.RemoveUnused(key); ok {
+		return v, true, false
+	}
+	_, done, ok := c.Get(key)
+	if ok {
+		done()
+	}
+	return nil, false, ok
+}
+
+// fetchZtoc fetches and deserializes the ztoc described by sociDesc. Ztocs of at least
+// MmapZtocThresholdBytes are spooled to a temporary file and memory-mapped, so that
+// neither the serialized ztoc nor its whole TOC are held in memory. The TOC must be
+// released once it isn't needed anymore.
+func (r *Resolver) fetchZtoc(ctx context.Context, sociDesc ocispec.Descriptor) (*ztoc.Ztoc, error) {
+	ztocReader, err := r.artifactStore.Fetch(ctx, sociDesc)
+	if err != nil {
+		return nil, err
+	}
+	defer ztocReader.Close()
+
+	threshold := r.config.MmapZtocThresholdBytes
+	if threshold <= 0 || sociDesc.Size < threshold {
+		return ztoc.Unmarshal(ztocReader)
+	}
+	f, err := os.CreateTemp(r.rootDir, "ztoc-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary ztoc file: %w", err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	if _, err := io.Copy(f, ztocReader); err != nil {
+		return nil, fmt.Errorf("failed to write temporary ztoc file: %w", err)
+	}
+	return ztoc.UnmarshalFile(f)
 }
 
 // resolveBlob resolves a blob based on the passed layer blob information.
@@ -399,18 +747,22 @@ func newLayer(
 	desc ocispec.Descriptor,
 	blob *blobRef,
 	r reader.Reader,
+	spanManager *spanmanager.SpanManager,
 	bgResolver backgroundfetcher.Resolver,
 	opCounter *FuseOperationCounter,
 	disableXAttrs bool,
+	budget *fetchBudget,
 ) *layer {
 	return &layer{
 		resolver:             resolver,
 		desc:                 desc,
 		blob:                 blob,
 		r:                    r,
+		spanManager:          spanManager,
 		bgResolver:           bgResolver,
 		fuseOperationCounter: opCounter,
 		disableXAttrs:        disableXAttrs,
+		fetchBudget:          budget,
 	}
 }
 
@@ -423,8 +775,13 @@ type layer struct {
 
 	r reader.Reader
 
+	// spanManager manages the cached spans of the layer.
+	spanManager *spanmanager.SpanManager
+
 	fuseOperationCounter *FuseOperationCounter
 	disableXAttrs        bool
+	// fetchBudget limits the bytes the layer fetches from the registry.
+	fetchBudget *fetchBudget
 
 	closed   bool
 	closedMu sync.Mutex
@@ -436,9 +793,15 @@ func (l *layer) Info() Info {
 		Size:        l.blob.Size(),
 		FetchedSize: l.blob.FetchedSize(),
 		ReadTime:    l.r.LastOnDemandReadTime(),
+		Host:        l.blob.Host(),
+		OnDemand:    l.bgResolver == nil,
 	}
 }
 
+func (l *layer) Fetched() <-chan struct{} {
+	return l.blob.Fetched()
+}
+
 func (l *layer) Check() error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
@@ -472,6 +835,12 @@ func (l *layer) DisableXAttrs() bool {
 	return l.disableXAttrs
 }
 
+func (l *layer) SetFetchBudget(budget FetchBudget) {
+	if l.fetchBudget != nil {
+		l.fetchBudget.set(budget)
+	}
+}
+
 func (l *layer) close() error {
 	l.closedMu.Lock()
 	defer l.closedMu.Unlock()
@@ -39,20 +39,311 @@
 package layer
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
 	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 func TestLayer(t *testing.T) {
 	testNodeRead(t, metadata.NewTempDbStore)
+	testNodeReadLatency(t, metadata.NewTempDbStore)
 	testExistence(t, metadata.NewTempDbStore)
 	testStatfs(t, metadata.NewTempDbStore)
 }
 
+func TestEvictImage(t *testing.T) {
+	r, err := NewResolver(t.TempDir(), config.FSConfig{}, nil, nil, nil, OverlayOpaqueAll, nil, 0)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	target, err := reference.Parse("example.com/target:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := reference.Parse("example.com/other:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTestLayer := func(dgst digest.Digest, fetchedSize int64) *layer {
+		return &layer{
+			resolver: r,
+			desc:     ocispec.Descriptor{Digest: dgst},
+			blob:     &blobRef{&testBlobState{100, fetchedSize}, func() {}},
+			r:        &testReader{},
+		}
+	}
+	var (
+		uniqueDigest = digest.FromString("unique")
+		sharedDigest = digest.FromString("shared")
+		inUseDigest  = digest.FromString("in-use")
+	)
+
+	unique, done := r.cacheLayer(target, newTestLayer(uniqueDigest, 10))
+	done()
+	shared, done := r.cacheLayer(target, newTestLayer(sharedDigest, 20))
+	done()
+	inUse, inUseDone := r.cacheLayer(target, newTestLayer(inUseDigest, 40))
+	otherShared, otherDone := r.cacheLayer(other, newTestLayer(sharedDigest, 20))
+	defer otherDone()
+
+	reclaimed, err := r.EvictImage(target.String())
+	if err != nil {
+		t.Fatalf("failed to evict image: %v", err)
+	}
+	if reclaimed != 30 {
+		t.Fatalf("unexpected reclaimed bytes; want %d; got %d", 30, reclaimed)
+	}
+	if !unique.isClosed() || !shared.isClosed() {
+		t.Fatalf("unused layers of the evicted image must be cleaned up")
+	}
+	if inUse.isClosed() {
+		t.Fatalf("layer in use must not be cleaned up")
+	}
+	if otherShared.isClosed() {
+		t.Fatalf("shared layer of another image must not be cleaned up")
+	}
+	if _, done, ok := r.layerCache.Get(other.String() + "/" + sharedDigest.String()); !ok {
+		t.Fatalf("shared layer of another image must remain in the cache")
+	} else {
+		done()
+	}
+
+	// The layer in use can be evicted once it is released.
+	inUseDone()
+	reclaimed, err = r.EvictImage(target.String())
+	if err != nil {
+		t.Fatalf("failed to evict image: %v", err)
+	}
+	if reclaimed != 40 || !inUse.isClosed() {
+		t.Fatalf("released layer must be evicted; reclaimed %d bytes", reclaimed)
+	}
+	if _, ok := r.imageLayers[target.String()]; ok {
+		t.Fatalf("evicted image must not be tracked anymore")
+	}
+}
+
+func TestReclaimLayer(t *testing.T) {
+	r, err := NewResolver(t.TempDir(), config.FSConfig{}, nil, nil, nil, OverlayOpaqueAll, nil, 0)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	target, err := reference.Parse("example.com/target:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := reference.Parse("example.com/other:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromString("layer")
+	newTestLayer := func() *layer {
+		return &layer{
+			resolver: r,
+			desc:     ocispec.Descriptor{Digest: dgst},
+			blob:     &blobRef{&testBlobState{100, 60}, func() {}},
+			r:        &testReader{},
+		}
+	}
+	l, done := r.cacheLayer(target, newTestLayer())
+	otherL, otherDone := r.cacheLayer(other, newTestLayer())
+	defer otherDone()
+
+	// The layer is still referenced by a snapshot, so it must be kept.
+	reclaimed, err := r.ReclaimLayer(target.String(), dgst)
+	if err != nil {
+		t.Fatalf("failed to reclaim layer: %v", err)
+	}
+	if reclaimed != 0 || l.isClosed() {
+		t.Fatalf("layer in use must not be reclaimed; reclaimed %d bytes", reclaimed)
+	}
+
+	// Simulate containerd removing the last snapshot of the layer.
+	done()
+	reclaimed, err = r.ReclaimLayer(target.String(), dgst)
+	if err != nil {
+		t.Fatalf("failed to reclaim layer: %v", err)
+	}
+	if reclaimed != 60 || !l.isClosed() {
+		t.Fatalf("unreferenced layer must be reclaimed; reclaimed %d bytes", reclaimed)
+	}
+	if _, done, ok := r.layerCache.Get(target.String() + "/" + dgst.String()); ok {
+		done()
+		t.Fatalf("reclaimed layer must be removed from the cache")
+	}
+	if otherL.isClosed() {
+		t.Fatalf("layer of another image must not be reclaimed")
+	}
+
+	// Reclaiming a layer that isn't cached anymore is a no-op.
+	reclaimed, err = r.ReclaimLayer(target.String(), dgst)
+	if err != nil || reclaimed != 0 {
+		t.Fatalf("expected reclaiming an uncached layer to be a no-op; reclaimed %d bytes: %v", reclaimed, err)
+	}
+}
+
+func TestPrefetchBlob(t *testing.T) {
+	ctx := context.Background()
+	h := &blockingBlobHandler{
+		resolving: make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	r, err := NewResolver(t.TempDir(), config.FSConfig{}, map[string]remote.Handler{"test": h}, nil, nil, OverlayOpaqueAll, nil, 0)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	refspec, err := reference.Parse("example.com/target:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{Digest: digest.FromString("layer"), Size: 100}
+
+	prefetched := make(chan error, 1)
+	go func() {
+		prefetched <- r.PrefetchBlob(ctx, nil, refspec, desc)
+	}()
+	select {
+	case <-h.resolving:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("blob resolution didn't start")
+	}
+
+	// The SOCI index is fetched while the blob is still being resolved. Resolving the
+	// layer afterwards waits for the blob instead of resolving it again.
+	resolved := make(chan error, 1)
+	go func() {
+		blobR, err := r.resolveBlobLocked(ctx, refspec, desc)
+		if err == nil {
+			blobR.done()
+		}
+		resolved <- err
+	}()
+	close(h.release)
+	if err := <-prefetched; err != nil {
+		t.Fatalf("failed to prefetch blob: %v", err)
+	}
+	if err := <-resolved; err != nil {
+		t.Fatalf("failed to resolve blob: %v", err)
+	}
+	if calls := h.calls.Load(); calls != 1 {
+		t.Fatalf("expected the blob to be resolved in a single round trip; got %d", calls)
+	}
+}
+
+func TestWarmLayer(t *testing.T) {
+	const spanSize = 64 << 10
+	r, err := NewResolver(t.TempDir(), config.FSConfig{}, nil, nil, nil, OverlayOpaqueAll, nil, 0)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	refspec, err := reference.Parse("example.com/target:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rand := testutil.NewTestRand(t)
+	ents := []testutil.TarEntry{
+		testutil.File("data", string(rand.RandomByteData(4*spanSize))),
+	}
+	toc, sr, err := ztoc.BuildZtocReader(t, ents, gzip.DefaultCompression, spanSize)
+	if err != nil {
+		t.Fatalf("failed to build ztoc: %v", err)
+	}
+	maxSpanID := toc.MaxSpanID
+	m := spanmanager.New(toc, sr, cache.NewMemoryCache(), 0)
+	if err := m.FetchSingleSpan(1); err != nil {
+		t.Fatalf("failed to fetch span 1: %v", err)
+	}
+	dgst := digest.FromString("layer")
+
+	if _, err := r.WarmLayer(refspec, dgst); !errors.Is(err, ErrLayerNotResolved) {
+		t.Fatalf("expected warming an unresolved layer to fail with %v; got %v", ErrLayerNotResolved, err)
+	}
+
+	_, done := r.cacheLayer(refspec, &layer{
+		resolver:    r,
+		desc:        ocispec.Descriptor{Digest: dgst},
+		blob:        &blobRef{&testBlobState{100, 0}, func() {}},
+		r:           &testReader{},
+		spanManager: m,
+	})
+	done()
+
+	cached, err := r.WarmLayer(refspec, dgst)
+	if err != nil {
+		t.Fatalf("failed to warm layer: %v", err)
+	}
+	if cached {
+		t.Fatal("expected the layer not to be cached before warming it")
+	}
+	if n := len(m.CachedSpans()); n != int(maxSpanID)+1 {
+		t.Fatalf("expected all %d spans to be cached; got %d", maxSpanID+1, n)
+	}
+	cached, err = r.WarmLayer(refspec, dgst)
+	if err != nil {
+		t.Fatalf("failed to warm layer again: %v", err)
+	}
+	if !cached {
+		t.Fatal("expected the layer to be cached after warming it")
+	}
+}
+
+// resolveBlobLocked resolves the blob of a layer under the same lock as Resolve.
+func (r *Resolver) resolveBlobLocked(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor) (*blobRef, error) {
+	name := refspec.String() + "/" + desc.Digest.String()
+	r.resolveLock.Lock(name)
+	defer r.resolveLock.Unlock(name)
+	return r.resolveBlob(ctx, nil, refspec, desc)
+}
+
+// blockingBlobHandler resolves blobs with a simulated registry round trip
+// that doesn't complete until release is closed.
+type blockingBlobHandler struct {
+	calls     atomic.Int32
+	resolving chan struct{}
+	release   chan struct{}
+}
+
+func (h *blockingBlobHandler) Handle(ctx context.Context, desc ocispec.Descriptor) (remote.Fetcher, int64, error) {
+	if h.calls.Add(1) == 1 {
+		close(h.resolving)
+	}
+	<-h.release
+	return nopFetcher{}, desc.Size, nil
+}
+
+type nopFetcher struct{}
+
+func (nopFetcher) Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(make([]byte, size))), nil
+}
+
+func (nopFetcher) Check() error {
+	return nil
+}
+
+func (nopFetcher) GenID(off int64, size int64) string {
+	return fmt.Sprintf("%d-%d", off, size)
+}
+
 func TestWaiter(t *testing.T) {
 	var (
 		w         = newWaiter()
@@ -127,3 +418,63 @@ func (w *waiter) wait(timeout time.Duration) error {
 		return nil
 	}
 }
+
+func TestStaleCacheRemover(t *testing.T) {
+	root := t.TempDir()
+	// A previous run crashed, leaving its caches behind.
+	stale := []string{
+		filepath.Join(root, "spancache", "previous", "span"),
+		filepath.Join(root, "httpcache", "previous", "blob"),
+		filepath.Join(root, "ztoc-previous"),
+	}
+	kept := []string{
+		filepath.Join(root, "eagercache", "blob"),
+	}
+	for _, p := range append(stale, kept...) {
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remove, err := staleCacheRemover(root)
+	if err != nil {
+		t.Fatalf("failed to list stale caches: %v", err)
+	}
+	// Caches of this run created before the stale ones are removed are kept.
+	current, err := newCache(filepath.Join(root, "spancache"), "", config.FSConfig{
+		DirectoryCacheConfig: config.DirectoryCacheConfig{Direct: true},
+	})
+	if err != nil {
+		t.Fatalf("failed to create cache: %v", err)
+	}
+	defer current.Close()
+	w, err := current.Add("span")
+	if err != nil {
+		t.Fatalf("failed to add to cache: %v", err)
+	}
+	w.Write([]byte("data"))
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit to cache: %v", err)
+	}
+	w.Close()
+	remove()
+
+	for _, p := range stale {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("expected stale cache %s to be removed; got %v", p, err)
+		}
+	}
+	for _, p := range kept {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("expected %s to be kept: %v", p, err)
+		}
+	}
+	r, err := current.Get("span")
+	if err != nil {
+		t.Fatalf("expected cache of the current run to be kept: %v", err)
+	}
+	r.Close()
+}
@@ -0,0 +1,127 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"golang.org/x/sync/errgroup"
+)
+
+// validateLazyLoadPaths returns an error if any of the lazy load patterns is malformed.
+func validateLazyLoadPaths(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return fmt.Errorf("invalid lazy load path %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// matchesLazyLoadPath returns whether the file name matches any of patterns.
+// A pattern matches a file if it matches the file's path, any of its parent
+// directories, or, if the pattern has no slash, the file's base name.
+// This allows patterns like "*.bin" to select files by extension anywhere in the layer
+// and patterns like "opt/models" to select whole directories.
+func matchesLazyLoadPath(name string, patterns []string) bool {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	base := path.Base(name)
+	for _, p := range patterns {
+		p = strings.Trim(p, "/")
+		if !strings.Contains(p, "/") {
+			if ok, _ := path.Match(p, base); ok {
+				return true
+			}
+		}
+		for dir := name; dir != "."; dir = path.Dir(dir) {
+			if ok, _ := path.Match(p, dir); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// eagerSpansChunkSize is the number of file metadata deserialized at once by eagerSpans.
+const eagerSpansChunkSize = 1000
+
+// eagerSpans returns the spans that contain data of regular files not matching
+// any of patterns. These spans are materialized when the layer is resolved so only
+// matching files are served lazily. If patterns is empty, every file is served lazily.
+func eagerSpans(toc *ztoc.Ztoc, patterns []string) ([]compression.SpanID, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	zinfo, err := toc.Zinfo()
+	if err != nil {
+		return nil, err
+	}
+	defer zinfo.Close()
+
+	seen := make(map[compression.SpanID]struct{})
+	var spans []compression.SpanID
+	err = toc.Entries(eagerSpansChunkSize, func(files []ztoc.FileMetadata) error {
+		for _, f := range files {
+			if !f.FileMode().IsRegular() || f.UncompressedSize == 0 || matchesLazyLoadPath(f.Name, patterns) {
+				continue
+			}
+			start := zinfo.UncompressedOffsetToSpanID(f.UncompressedOffset)
+			end := zinfo.UncompressedOffsetToSpanID(f.UncompressedOffset + f.UncompressedSize - 1)
+			for id := start; id <= end; id++ {
+				if _, ok := seen[id]; ok {
+					continue
+				}
+				seen[id] = struct{}{}
+				spans = append(spans, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return spans, nil
+}
+
+// materializeConcurrency is the maximum number of spans fetched at once by materializeSpans.
+const materializeConcurrency = 4
+
+// materializeSpans fetches and caches spans, at most materializeConcurrency at once, so
+// reads of their files are served locally. It stops early if a span fails to be fetched
+// or once stop returns true, e.g. because the layer is closed.
+func materializeSpans(spanManager *spanmanager.SpanManager, spans []compression.SpanID, stop func() bool) error {
+	eg, ctx := errgroup.WithContext(context.Background())
+	eg.SetLimit(materializeConcurrency)
+	for _, id := range spans {
+		if ctx.Err() != nil || stop() {
+			break
+		}
+		eg.Go(func() error {
+			if err := spanManager.FetchSingleSpan(id); err != nil {
+				return fmt.Errorf("failed to fetch span %d: %w", id, err)
+			}
+			return nil
+		})
+	}
+	return eg.Wait()
+}
@@ -0,0 +1,125 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"compress/gzip"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+)
+
+func TestMatchesLazyLoadPath(t *testing.T) {
+	patterns := []string{"*.bin", "/opt/models/", "data/*.tar"}
+	testCases := []struct {
+		name     string
+		expected bool
+	}{
+		{name: "model.bin", expected: true},
+		{name: "usr/share/weights.bin", expected: true},
+		{name: "./usr/share/weights.bin", expected: true},
+		{name: "opt/models/config.json", expected: true},
+		{name: "opt/models/nested/vocab.txt", expected: true},
+		{name: "data/archive.tar", expected: true},
+		{name: "data/nested/archive.tar", expected: false},
+		{name: "bin/app", expected: false},
+		{name: "opt/models.json", expected: false},
+	}
+	for _, tc := range testCases {
+		if got := matchesLazyLoadPath(tc.name, patterns); got != tc.expected {
+			t.Errorf("matchesLazyLoadPath(%q) = %v; expected %v", tc.name, got, tc.expected)
+		}
+	}
+
+	if err := validateLazyLoadPaths([]string{"[a-"}); err == nil {
+		t.Errorf("expected malformed pattern to be rejected")
+	}
+}
+
+func TestEagerSpans(t *testing.T) {
+	r := testutil.NewTestRand(t)
+	const spanSize = 64 << 10
+
+	ents := []testutil.TarEntry{
+		testutil.File("bin/app", string(r.RandomByteData(200<<10))),
+		testutil.File("data/model.bin", string(r.RandomByteData(500<<10))),
+		testutil.File("etc/config", "config"),
+		testutil.File("opt/assets/texture.bin", string(r.RandomByteData(300<<10))),
+	}
+	toc, sr, err := ztoc.BuildZtocReader(t, ents, gzip.DefaultCompression, spanSize)
+	if err != nil {
+		t.Fatalf("failed to build ztoc: %v", err)
+	}
+
+	spans, err := eagerSpans(toc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 0 {
+		t.Fatalf("expected no eager spans without patterns; got %v", spans)
+	}
+
+	spans, err = eagerSpans(toc, []string{"*.bin"})
+	if err != nil {
+		t.Fatalf("failed to get eager spans: %v", err)
+	}
+	if len(spans) == 0 || len(spans) > int(toc.MaxSpanID) {
+		t.Fatalf("expected a strict subset of spans to be eager; got %d of %d", len(spans), toc.MaxSpanID+1)
+	}
+
+	m := spanmanager.New(toc, sr, cache.NewMemoryCache(), 0)
+	defer m.Close()
+	// Nothing is fetched once materializing is stopped, e.g. because the layer is closed.
+	if err := materializeSpans(m, spans, func() bool { return true }); err != nil {
+		t.Fatalf("failed to stop materializing spans: %v", err)
+	}
+	app, err := toc.GetMetadataEntry("bin/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.IsCached(app.UncompressedOffset, app.UncompressedOffset+app.UncompressedSize-1) {
+		t.Fatalf("expected no spans to be fetched once materializing is stopped")
+	}
+	if err := materializeSpans(m, spans, func() bool { return false }); err != nil {
+		t.Fatalf("failed to materialize spans: %v", err)
+	}
+
+	for _, name := range []string{"bin/app", "etc/config"} {
+		e, err := toc.GetMetadataEntry(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !m.IsCached(e.UncompressedOffset, e.UncompressedOffset+e.UncompressedSize-1) {
+			t.Errorf("expected %s to be eagerly fetched", name)
+		}
+	}
+	// The middle of large lazily loaded files doesn't share spans with eager files.
+	for _, name := range []string{"data/model.bin", "opt/assets/texture.bin"} {
+		e, err := toc.GetMetadataEntry(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mid := e.UncompressedOffset + e.UncompressedSize/2
+		if m.IsCached(mid, mid+compression.Offset(1)) {
+			t.Errorf("expected %s to be lazily loaded", name)
+		}
+	}
+}
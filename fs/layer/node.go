@@ -208,10 +208,16 @@ func newNode(l *layer, baseInode uint32, idMapper idtools.IDMap) (fusefs.InodeEm
 		rootID:           rootID,
 		opaqueXattrs:     opq,
 		logFSOperations:  l.resolver.config.LogFuseOperations,
+		readLatency:      l.resolver.config.ReadLatencyMetrics,
 		operationCounter: l.fuseOperationCounter,
 		statfsBase:       l.resolver.rootDir,
 	}
 	ffs.s = ffs.newState(l.desc.Digest, l.blob)
+	if l.resolver.config.PrecomputeDirTree {
+		if ffs.dirTree, err = buildDirTree(ffs); err != nil {
+			return nil, fmt.Errorf("failed to precompute directory tree: %w", err)
+		}
+	}
 	return &node{
 		id:       rootID,
 		attr:     rootAttr,
@@ -229,8 +235,12 @@ type fs struct {
 	rootID           uint32
 	opaqueXattrs     []string
 	logFSOperations  bool
+	readLatency      bool
 	operationCounter *FuseOperationCounter
 	statfsBase       string
+
+	// dirTree is the in-memory directory structure of the layer if it is precomputed.
+	dirTree *dirTree
 }
 
 func (fs *fs) inodeOfState() uint64 {
@@ -255,6 +265,15 @@ func (fs *fs) logAndIncrementOpCounter(ctx context.Context, operationName string
 	}
 }
 
+// measureReadLatency records the latency of a FUSE file read.
+func (fs *fs) measureReadLatency(cacheHit bool, start time.Time) {
+	var imageDigest digest.Digest
+	if fs.operationCounter != nil {
+		imageDigest = fs.operationCounter.imageDigest
+	}
+	commonmetrics.MeasureFuseReadLatency(imageDigest, fs.layerDigest, cacheHit, start)
+}
+
 // reportFailure handles telemetry operations pertaining to FUSE failures
 // as well as writing an error to the state file.
 func (fs *fs) reportFailure(operationName string, stateError error) {
@@ -292,7 +311,7 @@ func (n *node) isRootNode() bool {
 }
 
 func (n *node) isOpaque() bool {
-	if _, _, err := n.fs.r.Metadata().GetChild(n.id, whiteoutOpaqueDir); err == nil {
+	if _, _, err := n.fs.getChild(n.id, whiteoutOpaqueDir); err == nil {
 		return true
 	}
 	return false
@@ -317,6 +336,10 @@ func (n *node) readdir() ([]fuse.DirEntry, syscall.Errno) {
 	start := time.Now() // set start time
 	defer commonmetrics.MeasureLatencyInMicroseconds(commonmetrics.NodeReaddir, n.fs.layerDigest, start)
 
+	if ents, ok := n.fs.dirTree.readdir(n.id); ok {
+		return ents, 0
+	}
+
 	n.entsMu.Lock()
 	if n.entsCached {
 		ents := n.ents
@@ -325,11 +348,27 @@ func (n *node) readdir() ([]fuse.DirEntry, syscall.Errno) {
 	}
 	n.entsMu.Unlock()
 
+	ents, err := n.fs.listDir(n.id)
+	if err != nil {
+		n.fs.reportFailure(fuseOpReaddir, err)
+		return nil, syscall.EIO
+	}
+
+	n.entsMu.Lock()
+	defer n.entsMu.Unlock()
+	n.ents, n.entsCached = ents, true // cache it
+
+	return ents, 0
+}
+
+// listDir returns the entries of the directory id as they are shown by readdir,
+// sorted by name.
+func (fs *fs) listDir(dirID uint32) ([]fuse.DirEntry, error) {
 	var ents []fuse.DirEntry
 	whiteouts := map[string]uint32{}
 	normalEnts := map[string]bool{}
 	var lastErr error
-	if err := n.fs.r.Metadata().ForeachChild(n.id, func(name string, id uint32, mode os.FileMode) bool {
+	if err := fs.r.Metadata().ForeachChild(dirID, func(name string, id uint32, mode os.FileMode) bool {
 
 		// We don't want to show whiteouts.
 		if strings.HasPrefix(name, whiteoutPrefix) {
@@ -343,7 +382,7 @@ func (n *node) readdir() ([]fuse.DirEntry, syscall.Errno) {
 
 		// This is a normal entry.
 		normalEnts[name] = true
-		ino, err := n.fs.inodeOfID(id)
+		ino, err := fs.inodeOfID(id)
 		if err != nil {
 			lastErr = err
 			return false
@@ -355,17 +394,15 @@ func (n *node) readdir() ([]fuse.DirEntry, syscall.Errno) {
 		})
 		return true
 	}); err != nil || lastErr != nil {
-		n.fs.reportFailure(fuseOpReaddir, fmt.Errorf("%s: err = %v; lastErr = %v", fuseOpReaddir, err, lastErr))
-		return nil, syscall.EIO
+		return nil, fmt.Errorf("%s: err = %v; lastErr = %v", fuseOpReaddir, err, lastErr)
 	}
 
 	// Append whiteouts if no entry replaces the target entry in the lower layer.
 	for w, id := range whiteouts {
 		if !normalEnts[w[len(whiteoutPrefix):]] {
-			ino, err := n.fs.inodeOfID(id)
+			ino, err := fs.inodeOfID(id)
 			if err != nil {
-				n.fs.reportFailure(fuseOpReaddir, fmt.Errorf("%s: err = %v; lastErr = %v", fuseOpReaddir, err, lastErr))
-				return nil, syscall.EIO
+				return nil, fmt.Errorf("%s: err = %v; lastErr = %v", fuseOpReaddir, err, lastErr)
 			}
 			ents = append(ents, fuse.DirEntry{
 				Mode: syscall.S_IFCHR,
@@ -380,11 +417,7 @@ func (n *node) readdir() ([]fuse.DirEntry, syscall.Errno) {
 	sort.Slice(ents, func(i, j int) bool {
 		return ents[i].Name < ents[j].Name
 	})
-	n.entsMu.Lock()
-	defer n.entsMu.Unlock()
-	n.ents, n.entsCached = ents, true // cache it
-
-	return ents, 0
+	return ents, nil
 }
 
 var _ = (fusefs.NodeLookuper)((*node)(nil))
@@ -444,10 +477,10 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 	}
 	n.entsMu.Unlock()
 
-	id, ce, err := n.fs.r.Metadata().GetChild(n.id, name)
+	id, ce, err := n.fs.getChild(n.id, name)
 	if err != nil {
 		// If the entry exists as a whiteout, show an overlayfs-styled whiteout node.
-		if whID, wh, err := n.fs.r.Metadata().GetChild(n.id, fmt.Sprintf("%s%s", whiteoutPrefix, name)); err == nil {
+		if whID, wh, err := n.fs.getChild(n.id, fmt.Sprintf("%s%s", whiteoutPrefix, name)); err == nil {
 			ino, err := n.fs.inodeOfID(whID)
 			if err != nil {
 				n.fs.reportFailure(fuseOpLookup, fmt.Errorf("%s: %v", fuseOpLookup, err))
@@ -583,7 +616,10 @@ func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResul
 
 	defer commonmetrics.MeasureLatencyInMicroseconds(commonmetrics.SynchronousRead, f.n.fs.layerDigest, time.Now()) // measure time for synchronous file reads (in microseconds)
 	defer commonmetrics.IncOperationCount(commonmetrics.SynchronousReadCount, f.n.fs.layerDigest)                   // increment the counter for synchronous file reads
-	n, err := f.ra.ReadAt(dest, off)
+	if f.n.fs.readLatency {
+		defer f.n.fs.measureReadLatency(f.isCached(off, len(dest)), time.Now())
+	}
+	n, err := f.readAt(ctx, dest, off)
 	if err != nil && err != io.EOF {
 		f.n.fs.reportFailure(fuseOpFileRead, fmt.Errorf("%s: %v", fuseOpFileRead, err))
 		return nil, syscall.EIO
@@ -591,6 +627,24 @@ func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResul
 	return fuse.ReadResultData(dest[:n]), 0
 }
 
+// readAt reads the file for a FUSE request bounded by ctx, if the file supports it.
+func (f *file) readAt(ctx context.Context, dest []byte, off int64) (int, error) {
+	if r, ok := f.ra.(interface {
+		ReadAtContext(context.Context, []byte, int64) (int, error)
+	}); ok {
+		return r.ReadAtContext(ctx, dest, off)
+	}
+	return f.ra.ReadAt(dest, off)
+}
+
+// isCached returns whether a read can be served without fetching from the remote.
+func (f *file) isCached(off int64, size int) bool {
+	if c, ok := f.ra.(interface{ IsCached(int64, int) bool }); ok {
+		return c.IsCached(off, size)
+	}
+	return true
+}
+
 var _ = (fusefs.FileGetattrer)((*file)(nil))
 
 func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
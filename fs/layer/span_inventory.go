@@ -0,0 +1,148 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+)
+
+// ErrInvalidPageToken is returned when listing the span cache inventory with a malformed page token.
+var ErrInvalidPageToken = errors.New("invalid page token")
+
+// SpanCacheEntry describes a span cached for a lazily loaded layer.
+type SpanCacheEntry struct {
+	// Digest is the digest of the layer the span belongs to.
+	Digest digest.Digest `json:"digest"`
+	spanmanager.CachedSpan
+}
+
+// SpanCacheInventory is a page of the span cache inventory.
+type SpanCacheInventory struct {
+	// Spans are the cached spans, ordered by layer digest and span ID.
+	Spans []SpanCacheEntry `json:"spans"`
+	// NextPageToken returns the next page when passed to SpanCacheInventory.
+	// It is empty on the last page.
+	NextPageToken string `json:"next_page_token,omitempty"`
+}
+
+// SpanCacheInventory lists the spans cached for the resolved layers, so that external
+// tooling can reconcile them against the spans that should be cached. At most limit
+// spans are returned, starting after pageToken. A non-positive limit returns all
+// remaining spans and an empty pageToken starts from the beginning.
+//
+// A layer resolved for several images has a span cache per image. Its spans are
+// listed once, with the latest access of any of them.
+func (r *Resolver) SpanCacheInventory(pageToken string, limit int) (SpanCacheInventory, error) {
+	spans := r.cachedSpans()
+	if pageToken != "" {
+		after, err := parsePageToken(pageToken)
+		if err != nil {
+			return SpanCacheInventory{}, err
+		}
+		start := sort.Search(len(spans), func(i int) bool {
+			return spanCacheEntryLess(after, spans[i])
+		})
+		spans = spans[start:]
+	}
+
+	var inventory SpanCacheInventory
+	if limit > 0 && len(spans) > limit {
+		spans = spans[:limit]
+		inventory.NextPageToken = spanCacheEntryKey(spans[limit-1])
+	}
+	inventory.Spans = spans
+	return inventory, nil
+}
+
+// cachedSpans returns the cached spans of all resolved layers, ordered by layer digest and span ID.
+// Layers are peeked at in the layer cache, so listing them doesn't delay their eviction.
+func (r *Resolver) cachedSpans() []SpanCacheEntry {
+	r.imageLayersMu.Lock()
+	defer r.imageLayersMu.Unlock()
+
+	entries := make(map[string]SpanCacheEntry)
+	for ref, dgsts := range r.imageLayers {
+		for dgst := range dgsts {
+			r.layerCacheMu.Lock()
+			c, done, ok := r.layerCache.Peek(ref + "/" + dgst.String())
+			r.layerCacheMu.Unlock()
+			if !ok {
+				continue
+			}
+			l := c.(*layer)
+			if !l.isClosed() && l.spanManager != nil {
+				for _, s := range l.spanManager.CachedSpans() {
+					e := SpanCacheEntry{Digest: dgst, CachedSpan: s}
+					key := spanCacheEntryKey(e)
+					if prev, ok := entries[key]; ok && !prev.LastAccess.Before(e.LastAccess) {
+						continue
+					}
+					entries[key] = e
+				}
+			}
+			done()
+		}
+	}
+
+	spans := make([]SpanCacheEntry, 0, len(entries))
+	for _, e := range entries {
+		spans = append(spans, e)
+	}
+	sort.Slice(spans, func(i, j int) bool {
+		return spanCacheEntryLess(spans[i], spans[j])
+	})
+	return spans
+}
+
+func spanCacheEntryLess(a, b SpanCacheEntry) bool {
+	if a.Digest != b.Digest {
+		return a.Digest < b.Digest
+	}
+	return a.ID < b.ID
+}
+
+// spanCacheEntryKey returns the key identifying the span, which is also used as page token.
+func spanCacheEntryKey(e SpanCacheEntry) string {
+	return fmt.Sprintf("%s/%d", e.Digest, e.ID)
+}
+
+func parsePageToken(token string) (SpanCacheEntry, error) {
+	dgst, id, ok := strings.Cut(token, "/")
+	if !ok {
+		return SpanCacheEntry{}, fmt.Errorf("%w: %q", ErrInvalidPageToken, token)
+	}
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return SpanCacheEntry{}, fmt.Errorf("%w: %q: %w", ErrInvalidPageToken, token, err)
+	}
+	spanID, err := strconv.ParseInt(id, 10, 32)
+	if err != nil {
+		return SpanCacheEntry{}, fmt.Errorf("%w: %q: %w", ErrInvalidPageToken, token, err)
+	}
+	var e SpanCacheEntry
+	e.Digest = d
+	e.ID = compression.SpanID(spanID)
+	return e, nil
+}
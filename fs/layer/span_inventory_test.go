@@ -0,0 +1,180 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"sort"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/config"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestSpanCacheInventory(t *testing.T) {
+	const spanSize = 64 << 10
+	r, err := NewResolver(t.TempDir(), config.FSConfig{}, nil, nil, nil, OverlayOpaqueAll, nil, 0)
+	if err != nil {
+		t.Fatalf("failed to create resolver: %v", err)
+	}
+	target, err := reference.Parse("example.com/target:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := reference.Parse("example.com/other:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rand := testutil.NewTestRand(t)
+	ents := []testutil.TarEntry{
+		testutil.File("data", string(rand.RandomByteData(4*spanSize))),
+	}
+	toc, _, err := ztoc.BuildZtocReader(t, ents, gzip.DefaultCompression, spanSize)
+	if err != nil {
+		t.Fatalf("failed to build ztoc: %v", err)
+	}
+	zinfo, err := toc.Zinfo()
+	if err != nil {
+		t.Fatalf("failed to get zinfo: %v", err)
+	}
+	defer zinfo.Close()
+
+	expected := make(map[string]SpanCacheEntry)
+	newExpectedEntry := func(dgst digest.Digest, id compression.SpanID) SpanCacheEntry {
+		e := SpanCacheEntry{Digest: dgst}
+		e.ID = id
+		e.StartCompressedOffset = zinfo.StartCompressedOffset(id)
+		e.EndCompressedOffset = zinfo.EndCompressedOffset(id, toc.CompressedArchiveSize)
+		return e
+	}
+	addTestLayer := func(refspec reference.Spec, dgst digest.Digest, fetch, read []compression.SpanID) {
+		layerToc, sr, err := ztoc.BuildZtocReader(t, ents, gzip.DefaultCompression, spanSize)
+		if err != nil {
+			t.Fatalf("failed to build ztoc: %v", err)
+		}
+		m := spanmanager.New(layerToc, sr, cache.NewMemoryCache(), 0)
+		for _, id := range fetch {
+			if err := m.FetchSingleSpan(id); err != nil {
+				t.Fatalf("failed to fetch span %d: %v", id, err)
+			}
+		}
+		for _, id := range read {
+			rc, err := m.GetContents(zinfo.StartUncompressedOffset(id), zinfo.EndUncompressedOffset(id, toc.UncompressedArchiveSize))
+			if err != nil {
+				t.Fatalf("failed to read span %d: %v", id, err)
+			}
+			io.Copy(io.Discard, rc)
+			rc.Close()
+		}
+		_, done := r.cacheLayer(refspec, &layer{
+			resolver:    r,
+			desc:        ocispec.Descriptor{Digest: dgst},
+			blob:        &blobRef{&testBlobState{100, 0}, func() {}},
+			r:           &testReader{},
+			spanManager: m,
+		})
+		done()
+
+		for _, id := range fetch {
+			e := newExpectedEntry(dgst, id)
+			e.Size = int64(e.EndCompressedOffset - e.StartCompressedOffset)
+			expected[spanCacheEntryKey(e)] = e
+		}
+		// Spans are cached uncompressed once they are read.
+		for _, id := range read {
+			e := newExpectedEntry(dgst, id)
+			e.Size = int64(zinfo.EndUncompressedOffset(id, toc.UncompressedArchiveSize) - zinfo.StartUncompressedOffset(id))
+			e.Uncompressed = true
+			expected[spanCacheEntryKey(e)] = e
+		}
+	}
+
+	var (
+		digestA = digest.FromString("a")
+		digestB = digest.FromString("b")
+	)
+	addTestLayer(target, digestA, []compression.SpanID{0, 3}, []compression.SpanID{1})
+	addTestLayer(target, digestB, []compression.SpanID{2}, nil)
+	// The same layer resolved for another image is listed once.
+	addTestLayer(other, digestA, nil, []compression.SpanID{1, 2})
+
+	var want []SpanCacheEntry
+	for _, e := range expected {
+		want = append(want, e)
+	}
+	sort.Slice(want, func(i, j int) bool {
+		return spanCacheEntryLess(want[i], want[j])
+	})
+
+	const limit = 2
+	var (
+		got       []SpanCacheEntry
+		pageToken string
+		pages     int
+	)
+	for {
+		inventory, err := r.SpanCacheInventory(pageToken, limit)
+		if err != nil {
+			t.Fatalf("failed to list span cache inventory: %v", err)
+		}
+		if len(inventory.Spans) > limit {
+			t.Fatalf("expected at most %d spans per page; got %d", limit, len(inventory.Spans))
+		}
+		got = append(got, inventory.Spans...)
+		pages++
+		if inventory.NextPageToken == "" {
+			break
+		}
+		pageToken = inventory.NextPageToken
+	}
+	if expectedPages := (len(want) + limit - 1) / limit; pages != expectedPages {
+		t.Fatalf("expected %d pages; got %d", expectedPages, pages)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d spans; got %d: %+v", len(want), len(got), got)
+	}
+	for i := range want {
+		if got[i].LastAccess.IsZero() {
+			t.Fatalf("span %s has no last access time", spanCacheEntryKey(got[i]))
+		}
+		got[i].LastAccess = want[i].LastAccess
+		if got[i] != want[i] {
+			t.Fatalf("unexpected span at %d; expected %+v; got %+v", i, want[i], got[i])
+		}
+	}
+
+	inventory, err := r.SpanCacheInventory("", 0)
+	if err != nil {
+		t.Fatalf("failed to list span cache inventory: %v", err)
+	}
+	if len(inventory.Spans) != len(want) || inventory.NextPageToken != "" {
+		t.Fatalf("expected all spans on a single page without a limit; got %d spans", len(inventory.Spans))
+	}
+
+	if _, err := r.SpanCacheInventory("not-a-token", limit); !errors.Is(err, ErrInvalidPageToken) {
+		t.Fatalf("expected %v; got %v", ErrInvalidPageToken, err)
+	}
+}
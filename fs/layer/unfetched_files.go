@@ -0,0 +1,102 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/metadata"
+)
+
+// UnfetchedFile is a regular file of a layer whose contents aren't entirely fetched yet.
+type UnfetchedFile struct {
+	// Path is the path of the file in the layer.
+	Path string `json:"path"`
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+	// Spans is the number of spans holding the contents of the file.
+	Spans int `json:"spans"`
+	// FetchedSpans is the number of those spans that are already fetched.
+	FetchedSpans int `json:"fetched_spans"`
+}
+
+// UnfetchedFiles lists the regular files of at least minSize bytes whose contents aren't
+// entirely fetched yet, ordered by path. It's computed from the metadata of the layer and the
+// state of its spans, so nothing is read from the cache or the registry.
+func (l *layer) UnfetchedFiles(minSize int64) ([]UnfetchedFile, error) {
+	return unfetchedFiles(l.r.Metadata(), l.spanManager, minSize)
+}
+
+func unfetchedFiles(md metadata.Reader, spanManager *spanmanager.SpanManager, minSize int64) ([]UnfetchedFile, error) {
+	var files []UnfetchedFile
+	// Hardlinks share their ID, so each file is listed once.
+	seen := make(map[uint32]struct{})
+	type dir struct {
+		id   uint32
+		path string
+	}
+	queue := []dir{{id: md.RootID(), path: "/"}}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		var lastErr error
+		if err := md.ForeachChild(d.id, func(name string, id uint32, mode os.FileMode) bool {
+			p := path.Join(d.path, name)
+			if mode.IsDir() {
+				queue = append(queue, dir{id: id, path: p})
+				return true
+			}
+			if !mode.IsRegular() {
+				return true
+			}
+			if _, ok := seen[id]; ok {
+				return true
+			}
+			seen[id] = struct{}{}
+			f, err := md.OpenFile(id)
+			if err != nil {
+				lastErr = err
+				return false
+			}
+			size := f.GetUncompressedFileSize()
+			if size == 0 || int64(size) < minSize {
+				return true
+			}
+			start := f.GetUncompressedOffset()
+			total, cached := spanManager.CachedSpanCount(start, start+size)
+			if cached < total {
+				files = append(files, UnfetchedFile{
+					Path:         p,
+					Size:         int64(size),
+					Spans:        total,
+					FetchedSpans: cached,
+				})
+			}
+			return true
+		}); err != nil || lastErr != nil {
+			return nil, fmt.Errorf("failed to list children of %d: err = %v; lastErr = %v", d.id, err, lastErr)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, nil
+}
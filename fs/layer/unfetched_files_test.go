@@ -0,0 +1,142 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+)
+
+func TestUnfetchedFiles(t *testing.T) {
+	const spanSize = 64 << 10
+	rand := testutil.NewTestRand(t)
+	ents := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/read", string(rand.RandomByteData(2*spanSize))),
+		testutil.File("big", string(rand.RandomByteData(4*spanSize))),
+		testutil.File("small", string(rand.RandomByteData(1<<10))),
+		testutil.File("empty", ""),
+		testutil.Link("hardlink", "big"),
+	}
+	toc, sr, err := ztoc.BuildZtocReader(t, ents, gzip.DefaultCompression, spanSize)
+	if err != nil {
+		t.Fatalf("failed to build ztoc: %v", err)
+	}
+	mr, err := metadata.NewTempDbStore(sr, toc.TOC)
+	if err != nil {
+		t.Fatalf("failed to create metadata reader: %v", err)
+	}
+	defer mr.Close()
+	spanManager := spanmanager.New(toc, sr, cache.NewMemoryCache(), 0)
+
+	// Read dir/read entirely, as a workload would.
+	id, _, err := mr.GetChild(mr.RootID(), "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, err = mr.GetChild(id, "read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := mr.OpenFile(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := f.GetUncompressedOffset()
+	rc, err := spanManager.GetContents(start, start+f.GetUncompressedFileSize())
+	if err != nil {
+		t.Fatalf("failed to read dir/read: %v", err)
+	}
+	io.Copy(io.Discard, rc)
+	rc.Close()
+
+	tests := []struct {
+		name     string
+		minSize  int64
+		expected map[string]int64
+	}{
+		{
+			name:    "all files",
+			minSize: 0,
+			expected: map[string]int64{
+				"/big":   4 * spanSize,
+				"/small": 1 << 10,
+			},
+		},
+		{
+			name:    "large files",
+			minSize: 1<<10 + 1,
+			expected: map[string]int64{
+				"/big": 4 * spanSize,
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			files, err := unfetchedFiles(mr, spanManager, tc.minSize)
+			if err != nil {
+				t.Fatalf("failed to list unfetched files: %v", err)
+			}
+			if len(files) != len(tc.expected) {
+				t.Fatalf("expected %d unfetched files; got %+v", len(tc.expected), files)
+			}
+			for _, file := range files {
+				size, ok := tc.expected[file.Path]
+				if !ok {
+					t.Fatalf("unexpected unfetched file %q", file.Path)
+				}
+				if file.Size != size {
+					t.Fatalf("expected size of %q to be %d; got %d", file.Path, size, file.Size)
+				}
+				if file.Spans == 0 || file.FetchedSpans >= file.Spans {
+					t.Fatalf("expected %q to have unfetched spans; got %d of %d fetched", file.Path, file.FetchedSpans, file.Spans)
+				}
+			}
+		})
+	}
+
+	// Once read, big isn't listed anymore.
+	id, _, err = mr.GetChild(mr.RootID(), "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err = mr.OpenFile(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start = f.GetUncompressedOffset()
+	rc, err = spanManager.GetContents(start, start+f.GetUncompressedFileSize())
+	if err != nil {
+		t.Fatalf("failed to read big: %v", err)
+	}
+	io.Copy(io.Discard, rc)
+	rc.Close()
+	files, err := unfetchedFiles(mr, spanManager, 1<<10+1)
+	if err != nil {
+		t.Fatalf("failed to list unfetched files: %v", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected no unfetched large files after reading them; got %+v", files)
+	}
+}
@@ -53,6 +53,7 @@ import (
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
+	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
 	"github.com/awslabs/soci-snapshotter/fs/reader"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
 	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
@@ -67,6 +68,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sys/unix"
 )
 
@@ -157,6 +159,49 @@ func testNodeRead(t *testing.T, factory metadata.Store) {
 	}
 }
 
+func testNodeReadLatency(t *testing.T, factory metadata.Store) {
+	commonmetrics.Register()
+	f, closeFn := makeNodeReader(t, []byte(sampleData1), sampleSpanSize, factory)
+	defer closeFn()
+	imgDigest := digest.FromString(t.Name())
+	f.n.fs.readLatency = true
+	f.n.fs.operationCounter = NewFuseOperationCounter(imgDigest, time.Minute)
+
+	// The first read fetches the span and the second one is served from the cache.
+	for i := 0; i < 2; i++ {
+		buf := make([]byte, sampleSpanSize)
+		if _, errno := f.Read(context.Background(), buf, 0); errno != 0 {
+			t.Fatalf("failed to read: %v", errno)
+		}
+	}
+
+	mfs, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	counts := make(map[string]uint64)
+	for _, mf := range mfs {
+		if !strings.HasSuffix(mf.GetName(), commonmetrics.FuseReadLatencyKeyMicroseconds) {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["image"] != imgDigest.String() || labels["layer"] != testStateLayerDigest.String() {
+				continue
+			}
+			counts[labels["result"]] += m.GetHistogram().GetSampleCount()
+		}
+	}
+	for _, result := range []string{commonmetrics.FuseReadFetch, commonmetrics.FuseReadCacheHit} {
+		if counts[result] != 1 {
+			t.Fatalf("expected 1 %s read latency sample; got %d", result, counts[result])
+		}
+	}
+}
+
 func makeNodeReader(t *testing.T, contents []byte, spanSize int64, factory metadata.Store) (_ *file, closeFn func() error) {
 	testName := "test"
 	tarEntry := []testutil.TarEntry{testutil.File(testName, string(contents))}
@@ -420,9 +465,11 @@ type testBlobState struct {
 	fetchedSize int64
 }
 
-func (tb *testBlobState) Check() error       { return nil }
-func (tb *testBlobState) Size() int64        { return tb.size }
-func (tb *testBlobState) FetchedSize() int64 { return tb.fetchedSize }
+func (tb *testBlobState) Check() error             { return nil }
+func (tb *testBlobState) Size() int64              { return tb.size }
+func (tb *testBlobState) FetchedSize() int64       { return tb.fetchedSize }
+func (tb *testBlobState) Fetched() <-chan struct{} { return nil }
+func (tb *testBlobState) Host() string             { return "" }
 func (tb *testBlobState) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
 	return 0, nil
 }
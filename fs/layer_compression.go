@@ -0,0 +1,62 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ErrUnsupportedLayerCompression is returned when a layer is compressed with an
+// algorithm that a zTOC can't seek into.
+var ErrUnsupportedLayerCompression = errors.New("layer compression doesn't support lazy loading")
+
+// checkLayerCompression checks that the layer of the zTOC described by sociDesc is
+// compressed with an algorithm that the zTOC can seek into, based on the layer media
+// type recorded in the SOCI index. Indexes that don't record it are trusted to only
+// index supported layers.
+func checkLayerCompression(ctx context.Context, sociDesc ocispec.Descriptor) error {
+	mediaType, ok := sociDesc.Annotations[soci.IndexAnnotationImageLayerMediaType]
+	if !ok {
+		return nil
+	}
+	algo, err := images.DiffCompression(ctx, mediaType)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnsupportedLayerCompression, err)
+	}
+	// Layers wrapped in anything but gzip, e.g. encrypted ones, can't be seeked into.
+	if _, suffixes, ok := strings.Cut(mediaType, "+"); ok {
+		for _, suffix := range strings.Split(suffixes, "+") {
+			if suffix != compression.Gzip {
+				return fmt.Errorf("%w: media type %q has unsupported suffix %q", ErrUnsupportedLayerCompression, mediaType, suffix)
+			}
+		}
+	}
+	switch algo {
+	case compression.Gzip, compression.Unknown, "":
+		return nil
+	default:
+		return fmt.Errorf("%w: layer of media type %q is compressed with %s", ErrUnsupportedLayerCompression, mediaType, algo)
+	}
+}
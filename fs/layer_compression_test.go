@@ -0,0 +1,71 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestUnsupportedLayerCompression(t *testing.T) {
+	testCases := []struct {
+		name        string
+		mediaType   string
+		unsupported bool
+	}{
+		{name: "oci gzip", mediaType: ocispec.MediaTypeImageLayerGzip},
+		{name: "oci uncompressed", mediaType: ocispec.MediaTypeImageLayer},
+		{name: "docker gzip", mediaType: images.MediaTypeDockerSchema2LayerGzip},
+		{name: "docker uncompressed", mediaType: images.MediaTypeDockerSchema2Layer},
+		{name: "no media type in index"},
+		{name: "oci zstd", mediaType: ocispec.MediaTypeImageLayerZstd, unsupported: true},
+		{name: "encrypted", mediaType: ocispec.MediaTypeImageLayerGzip + "+encrypted", unsupported: true},
+		{name: "unknown media type", mediaType: "application/vnd.example.layer.v1.tar+lz4", unsupported: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			layerDigest := digest.FromString(tc.name)
+			annotations := map[string]string{soci.IndexAnnotationImageLayerDigest: layerDigest.String()}
+			if tc.mediaType != "" {
+				annotations[soci.IndexAnnotationImageLayerMediaType] = tc.mediaType
+			}
+			c := &sociContext{}
+			c.populateImageLayerToSociMapping(context.Background(), soci.NewIndex(soci.V2, []ocispec.Descriptor{{
+				MediaType:   soci.SociLayerMediaType,
+				Digest:      digest.FromString("ztoc"),
+				Annotations: annotations,
+			}}, nil, nil))
+
+			// Layers without a zTOC fail to mount with snapshot.ErrNoZtoc,
+			// which makes the snapshotter unpack them eagerly.
+			_, lazy := c.imageLayerToSociDesc()[layerDigest.String()]
+			if lazy == tc.unsupported {
+				t.Fatalf("expected layer of media type %q to be lazily loaded=%v", tc.mediaType, !tc.unsupported)
+			}
+			err := checkLayerCompression(context.Background(), ocispec.Descriptor{Annotations: annotations})
+			if tc.unsupported != errors.Is(err, ErrUnsupportedLayerCompression) {
+				t.Fatalf("unexpected result checking layer compression: %v", err)
+			}
+		})
+	}
+}
@@ -48,6 +48,9 @@ const (
 	// OperationLatencyKeyMicroseconds is the key for soci operation latency metrics in microseconds.
 	OperationLatencyKeyMicroseconds = "operation_duration_microseconds"
 
+	// FuseReadLatencyKeyMicroseconds is the key for FUSE file read latency metrics in microseconds.
+	FuseReadLatencyKeyMicroseconds = "fuse_read_duration_microseconds"
+
 	// OperationCountKey is the key for soci operation count metrics.
 	OperationCountKey = "operation_count"
 
@@ -57,6 +60,12 @@ const (
 	// ImageOperationCountKey is the key for any metric related to operation count metric at the image level (as opposed to layer).
 	ImageOperationCountKey = "image_operation_count_key"
 
+	// MirrorRequestsKey is the key for the count of requests to registry hosts.
+	MirrorRequestsKey = "mirror_requests_total"
+
+	// MirrorFailoverKey is the key for the count of failovers from registry hosts.
+	MirrorFailoverKey = "mirror_failover_total"
+
 	// Keep namespace as soci and subsystem as fs.
 	namespace = "soci"
 	subsystem = "fs"
@@ -89,6 +98,10 @@ const (
 	SynchronousReadRegistryFetchCount = "synchronous_read_remote_registry_fetch_count" // TODO revisit (wrong place)
 	SynchronousBytesServed            = "synchronous_bytes_served"
 
+	// FUSE read results
+	FuseReadCacheHit = "cache_hit"
+	FuseReadFetch    = "fetch"
+
 	// Global fuse failure state
 	FuseFailureState = "fuse_failure_state"
 
@@ -122,12 +135,23 @@ const (
 
 	// Number of items in the work queue of background fetcher
 	BackgroundFetchWorkQueueSize = "background_fetch_work_queue_size"
+
+	// Number of fetches of a layer beyond its fetch budget that were let through.
+	FetchBudgetExceededCount = "fetch_budget_exceeded_count"
+
+	// Registry host request results. A request succeeds on its primary host if it's the
+	// first host the request was sent to, and on a fallback host after another host failed.
+	MirrorPrimarySuccess  = "primary_success"
+	MirrorFallbackSuccess = "fallback_success"
+	MirrorFailure         = "failure"
 )
 
 var (
 	// Buckets for OperationLatency metrics.
 	latencyBucketsMilliseconds = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384} // in milliseconds
 	latencyBucketsMicroseconds = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}                          // in microseconds
+	// Buckets for FUSE read latency. Reads that fetch from the registry can take seconds.
+	fuseReadLatencyBucketsMicroseconds = prometheus.ExponentialBuckets(1, 4, 13) // 1us to ~16s
 
 	// operationLatencyMilliseconds collects operation latency numbers in milliseconds grouped by
 	// operation, type and layer digest.
@@ -155,6 +179,19 @@ var (
 		[]string{"operation_type", "layer"},
 	)
 
+	// fuseReadLatencyMicroseconds collects the latency of FUSE file reads in microseconds
+	// grouped by image, layer digest and whether the read was served from the cache.
+	fuseReadLatencyMicroseconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      FuseReadLatencyKeyMicroseconds,
+			Help:      "Latency in microseconds of FUSE file reads. Broken down by image digest, layer sha and whether the read was a cache hit.",
+			Buckets:   fuseReadLatencyBucketsMicroseconds,
+		},
+		[]string{"image", "layer", "result"},
+	)
+
 	// operationCount collects operation count numbers by operation
 	// type and layer sha.
 	operationCount = prometheus.NewCounterVec(
@@ -186,6 +223,28 @@ var (
 			Help:      "The count of soci snapshotter operations. Broken down by operation type and image digest.",
 		},
 		[]string{"operation_type", "image"})
+
+	// mirrorRequests counts the requests to registry hosts by host and result.
+	mirrorRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      MirrorRequestsKey,
+			Help:      "The count of requests to registry hosts. Broken down by host and whether the request succeeded on its primary host, on a fallback host or failed.",
+		},
+		[]string{"host", "result"},
+	)
+
+	// mirrorFailover counts the times requests failed over from a registry host to the next.
+	mirrorFailover = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      MirrorFailoverKey,
+			Help:      "The count of failovers from a registry host to another. Broken down by the host that failed.",
+		},
+		[]string{"host"},
+	)
 )
 
 var register sync.Once
@@ -209,9 +268,12 @@ func Register() {
 	register.Do(func() {
 		prometheus.MustRegister(operationLatencyMilliseconds)
 		prometheus.MustRegister(operationLatencyMicroseconds)
+		prometheus.MustRegister(fuseReadLatencyMicroseconds)
 		prometheus.MustRegister(operationCount)
 		prometheus.MustRegister(bytesCount)
 		prometheus.MustRegister(imageOperationCount)
+		prometheus.MustRegister(mirrorRequests)
+		prometheus.MustRegister(mirrorFailover)
 	})
 }
 
@@ -233,6 +295,16 @@ func MeasureLatencyInMicroseconds(operation string, layer digest.Digest, start t
 	operationLatencyMicroseconds.WithLabelValues(operation, layer.String()).Observe(sinceInMicroseconds(start))
 }
 
+// MeasureFuseReadLatency records the latency of a FUSE file read of a layer of an image.
+// cacheHit reports whether the read was served without fetching from the registry.
+func MeasureFuseReadLatency(image, layer digest.Digest, cacheHit bool, start time.Time) {
+	result := FuseReadFetch
+	if cacheHit {
+		result = FuseReadCacheHit
+	}
+	fuseReadLatencyMicroseconds.WithLabelValues(image.String(), layer.String(), result).Observe(sinceInMicroseconds(start))
+}
+
 // IncOperationCount wraps the labels attachment as well as calling Inc into a single method.
 func IncOperationCount(operation string, layer digest.Digest) {
 	operationCount.WithLabelValues(operation, layer.String()).Inc()
@@ -248,6 +320,17 @@ func AddImageOperationCount(operation string, image digest.Digest, count int32)
 	imageOperationCount.WithLabelValues(operation, image.String()).Add(float64(count))
 }
 
+// IncMirrorRequest counts a request to the registry host with its result, one of
+// MirrorPrimarySuccess, MirrorFallbackSuccess or MirrorFailure.
+func IncMirrorRequest(host, result string) {
+	mirrorRequests.WithLabelValues(host, result).Inc()
+}
+
+// IncMirrorFailover counts a failover from the registry host to another.
+func IncMirrorFailover(host string) {
+	mirrorFailover.WithLabelValues(host).Inc()
+}
+
 // ListenForFuseFailure infinitely listens for any FUSE failure.
 // If one occurs, it increments the `FuseFailureState` metric and
 // sleeps for a time block. This should be run at an FS level
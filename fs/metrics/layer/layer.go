@@ -44,7 +44,7 @@ var layerMetrics = []*metric{
 		help: "Total fetched size of the layer",
 		unit: metrics.Bytes,
 		vt:   prometheus.CounterValue,
-		getValues: func(l layer.Layer) []value {
+		getValues: func(_ string, l layer.Layer) []value {
 			return []value{
 				{
 					v: float64(l.Info().FetchedSize),
@@ -57,7 +57,7 @@ var layerMetrics = []*metric{
 		help: "Total size of the layer",
 		unit: metrics.Bytes,
 		vt:   prometheus.CounterValue,
-		getValues: func(l layer.Layer) []value {
+		getValues: func(_ string, l layer.Layer) []value {
 			return []value{
 				{
 					v: float64(l.Info().Size),
@@ -66,3 +66,31 @@ var layerMetrics = []*metric{
 		},
 	},
 }
+
+// progressMetrics are collected if mount progress metrics are enabled.
+var progressMetrics = []*metric{
+	{
+		name:   "layer_fetch_progress_percent",
+		help:   "Percentage of the layer that is fetched. Layers that are only fetched on demand are at 100 once they are mounted.",
+		vt:     prometheus.GaugeValue,
+		labels: []string{"image"},
+		getValues: func(image string, l layer.Layer) []value {
+			return []value{
+				{
+					v: fetchProgress(l.Info()),
+					l: []string{image},
+				},
+			}
+		},
+	},
+}
+
+// fetchProgress returns the percentage of the layer that is fetched.
+// Layers that are never fetched in the background are complete once they are ready
+// to serve reads, i.e. when they are mounted.
+func fetchProgress(info layer.Info) float64 {
+	if info.OnDemand || info.Size <= 0 || info.FetchedSize >= info.Size {
+		return 100
+	}
+	return 100 * float64(info.FetchedSize) / float64(info.Size)
+}
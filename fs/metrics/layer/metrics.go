@@ -34,21 +34,30 @@ package layermetrics
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/awslabs/soci-snapshotter/fs/layer"
 	metrics "github.com/docker/go-metrics"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-func NewLayerMetrics(ns *metrics.Namespace) *Controller {
+// NewLayerMetrics returns a Controller collecting the metrics of mounted layers.
+// If progress is true, the fetch progress of each mounted layer is collected as well.
+func NewLayerMetrics(ns *metrics.Namespace, progress bool) *Controller {
 	if ns == nil {
 		return &Controller{}
 	}
 	c := &Controller{
 		ns:    ns,
-		layer: make(map[string]layer.Layer),
+		layer: make(map[string]mountedLayer),
 	}
 	c.metrics = append(c.metrics, layerMetrics...)
+	if progress {
+		c.metrics = append(c.metrics, progressMetrics...)
+		c.completed = &completedMounts{
+			desc: ns.NewDesc("layer_fetch_completed", "Number of mounted layers that were fully fetched or ready", metrics.Total),
+		}
+	}
 	ns.Add(c)
 	return c
 }
@@ -57,48 +66,108 @@ type Controller struct {
 	ns      *metrics.Namespace
 	metrics []*metric
 
-	layer   map[string]layer.Layer
+	layer   map[string]mountedLayer
 	layerMu sync.RWMutex
+
+	// completed counts the mounts reaching 100% fetch progress. It is nil unless
+	// progress metrics are enabled.
+	completed *completedMounts
+}
+
+type mountedLayer struct {
+	image string
+	l     layer.Layer
+	// removed is closed when the layer is unmounted.
+	removed chan struct{}
+}
+
+// completedMounts counts the mounts whose layer completed fetching.
+type completedMounts struct {
+	desc  *prometheus.Desc
+	count atomic.Int64
+}
+
+// watch counts the mount of l once l is fetched, unless it's unmounted first.
+// Layers that are never fetched in the background are complete once they are mounted.
+func (c *completedMounts) watch(l layer.Layer, removed <-chan struct{}) {
+	if l.Info().OnDemand {
+		c.count.Add(1)
+		return
+	}
+	go func() {
+		select {
+		case <-l.Fetched():
+			select {
+			case <-removed:
+			default:
+				c.count.Add(1)
+			}
+		case <-removed:
+		}
+	}()
+}
+
+func (c *completedMounts) collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, float64(c.count.Load()))
 }
 
 func (c *Controller) Describe(ch chan<- *prometheus.Desc) {
 	for _, e := range c.metrics {
 		ch <- e.desc(c.ns)
 	}
+	if c.completed != nil {
+		ch <- c.completed.desc
+	}
 }
 
 func (c *Controller) Collect(ch chan<- prometheus.Metric) {
 	c.layerMu.RLock()
 	wg := &sync.WaitGroup{}
-	for mp, l := range c.layer {
+	for mp, m := range c.layer {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
 			for _, e := range c.metrics {
-				e.collect(mp, l, c.ns, ch)
+				e.collect(mp, m, c.ns, ch)
 			}
 		}()
 	}
 	c.layerMu.RUnlock()
 	wg.Wait()
+	if c.completed != nil {
+		c.completed.collect(ch)
+	}
 }
 
-func (c *Controller) Add(key string, l layer.Layer) {
+// Add collects the metrics of layer l of image mounted at key.
+func (c *Controller) Add(key, image string, l layer.Layer) {
 	if c.ns == nil {
 		return
 	}
+	m := mountedLayer{image: image, l: l, removed: make(chan struct{})}
 	c.layerMu.Lock()
-	c.layer[key] = l
+	if prev, ok := c.layer[key]; ok {
+		close(prev.removed)
+	}
+	c.layer[key] = m
 	c.layerMu.Unlock()
+	if c.completed != nil {
+		c.completed.watch(l, m.removed)
+	}
 }
 
+// Remove stops collecting the metrics of the layer mounted at key.
 func (c *Controller) Remove(key string) {
 	if c.ns == nil {
 		return
 	}
 	c.layerMu.Lock()
+	m, ok := c.layer[key]
 	delete(c.layer, key)
 	c.layerMu.Unlock()
+	if ok {
+		close(m.removed)
+	}
 }
 
 type value struct {
@@ -113,16 +182,16 @@ type metric struct {
 	vt     prometheus.ValueType
 	labels []string
 	// getValues returns the value and labels for the data
-	getValues func(l layer.Layer) []value
+	getValues func(image string, l layer.Layer) []value
 }
 
 func (m *metric) desc(ns *metrics.Namespace) *prometheus.Desc {
 	return ns.NewDesc(m.name, m.help, m.unit, append([]string{"digest", "mountpoint"}, m.labels...)...)
 }
 
-func (m *metric) collect(mountpoint string, l layer.Layer, ns *metrics.Namespace, ch chan<- prometheus.Metric) {
-	values := m.getValues(l)
+func (m *metric) collect(mountpoint string, ml mountedLayer, ns *metrics.Namespace, ch chan<- prometheus.Metric) {
+	values := m.getValues(ml.image, ml.l)
 	for _, v := range values {
-		ch <- prometheus.MustNewConstMetric(m.desc(ns), m.vt, v.v, append([]string{l.Info().Digest.String(), mountpoint}, v.l...)...)
+		ch <- prometheus.MustNewConstMetric(m.desc(ns), m.vt, v.v, append([]string{ml.l.Info().Digest.String(), mountpoint}, v.l...)...)
 	}
 }
@@ -0,0 +1,125 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layermetrics
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	metrics "github.com/docker/go-metrics"
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeLayer is a layer.Layer that only reports its Info and when it is fetched.
+type fakeLayer struct {
+	layer.Layer
+	info    *layer.Info
+	fetched chan struct{}
+}
+
+func (l fakeLayer) Info() layer.Info {
+	return *l.info
+}
+
+func (l fakeLayer) Fetched() <-chan struct{} {
+	return l.fetched
+}
+
+// waitCompleted waits until c counted n completed mounts.
+func waitCompleted(t *testing.T, c *Controller, n int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for c.completed.count.Load() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d completed mounts; got %d", n, c.completed.count.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMountProgressMetrics(t *testing.T) {
+	const (
+		image      = "example.com/image:latest"
+		mountpoint = "/mnt/layer"
+		progress   = "soci_fs_layer_fetch_progress_percent"
+		completed  = "soci_fs_layer_fetch_completed_total"
+	)
+	c := NewLayerMetrics(metrics.NewNamespace("soci", "fs", nil), true)
+	info := &layer.Info{
+		Digest: digest.FromString("layer"),
+		Size:   100,
+	}
+	fetched := make(chan struct{})
+	c.Add(mountpoint, image, fakeLayer{info: info, fetched: fetched})
+
+	expected := func(percent float64, completions int) string {
+		return fmt.Sprintf(`# HELP %[1]s Percentage of the layer that is fetched. Layers that are only fetched on demand are at 100 once they are mounted.
+# TYPE %[1]s gauge
+%[1]s{digest="%[2]s",image="%[3]s",mountpoint="%[4]s"} %[5]v
+# HELP %[6]s Number of mounted layers that were fully fetched or ready
+# TYPE %[6]s counter
+%[6]s %[7]d
+`, progress, info.Digest, image, mountpoint, percent, completed, completions)
+	}
+	for _, size := range []int64{0, 25} {
+		info.FetchedSize = size
+		if err := testutil.CollectAndCompare(c, strings.NewReader(expected(float64(size), 0)), progress, completed); err != nil {
+			t.Fatalf("unexpected metrics after fetching %d bytes: %v", size, err)
+		}
+	}
+
+	// The mount is counted when the layer is fetched, whether or not metrics are collected.
+	info.FetchedSize = info.Size
+	close(fetched)
+	waitCompleted(t, c, 1)
+	for range 2 {
+		if err := testutil.CollectAndCompare(c, strings.NewReader(expected(100, 1)), progress, completed); err != nil {
+			t.Fatalf("unexpected metrics after fetching the layer: %v", err)
+		}
+	}
+
+	c.Remove(mountpoint)
+	if n := testutil.CollectAndCount(c, progress); n != 0 {
+		t.Fatalf("expected unmounted layer to be removed from the progress gauge; got %d series", n)
+	}
+
+	// Layers unmounted before they are fetched aren't counted.
+	unfetched := make(chan struct{})
+	c.Add(mountpoint, image, fakeLayer{info: &layer.Info{Digest: digest.FromString("unfetched"), Size: 100}, fetched: unfetched})
+	c.Remove(mountpoint)
+	close(unfetched)
+	time.Sleep(10 * time.Millisecond)
+	if n := c.completed.count.Load(); n != 1 {
+		t.Fatalf("expected a layer unmounted before it is fetched to not be counted; got %d completed mounts", n)
+	}
+
+	// Layers that aren't fetched in the background are complete once they are mounted.
+	onDemand := &layer.Info{
+		Digest:   digest.FromString("on-demand"),
+		Size:     100,
+		OnDemand: true,
+	}
+	c.Add(mountpoint, image, fakeLayer{info: onDemand})
+	info = onDemand
+	waitCompleted(t, c, 2)
+	if err := testutil.CollectAndCompare(c, strings.NewReader(expected(100, 2)), progress, completed); err != nil {
+		t.Fatalf("unexpected metrics for an on-demand layer: %v", err)
+	}
+}
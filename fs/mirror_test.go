@@ -17,13 +17,25 @@
 package fs
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
+	"time"
 
+	sociremote "github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/log"
+	"github.com/sirupsen/logrus"
+	"oras.land/oras-go/v2/registry/remote"
 )
 
 // TestNewRemoteStoreMirrorSupport verifies that newRemoteStore respects the hosts argument.
@@ -39,7 +51,7 @@ func TestNewRemoteStoreMirrorSupport(t *testing.T) {
 
 	// Case 1: No mirrors (nil hosts)
 	// Expected behavior: Should use original locator (docker.io/library/ubuntu)
-	repo, err := newRemoteStore(refspec, client, nil)
+	repo, err := newRemoteStore(context.Background(), refspec, client, nil, hostPolicy{})
 	if err != nil {
 		t.Fatalf("newRemoteStore failed with nil hosts: %v", err)
 	}
@@ -56,7 +68,7 @@ func TestNewRemoteStoreMirrorSupport(t *testing.T) {
 	}
 	hosts := []docker.RegistryHost{mirrorHost}
 
-	repoMirror, err := newRemoteStore(refspec, client, hosts)
+	repoMirror, err := newRemoteStore(context.Background(), refspec, client, hosts, hostPolicy{})
 	if err != nil {
 		t.Fatalf("newRemoteStore failed with mirror hosts: %v", err)
 	}
@@ -73,6 +85,129 @@ func TestNewRemoteStoreMirrorSupport(t *testing.T) {
 	}
 }
 
+// TestNewRemoteStoreSchemeOverride verifies that the scheme overrides of the policy take
+// precedence over the scheme inferred from the hosts.
+func TestNewRemoteStoreSchemeOverride(t *testing.T) {
+	tests := []struct {
+		name   string
+		ref    string
+		scheme string
+		// host is the host of the image, mirror.local:5000 if empty.
+		host              string
+		override          schemeOverride
+		expectedPlainHTTP bool
+	}{
+		{
+			name:              "http mirror",
+			ref:               "docker.io/library/ubuntu:latest",
+			scheme:            "http",
+			expectedPlainHTTP: true,
+		},
+		{
+			name:   "https mirror",
+			ref:    "docker.io/library/ubuntu:latest",
+			scheme: "https",
+		},
+		{
+			name:              "localhost without mirrors",
+			ref:               "localhost:5000/ubuntu:latest",
+			expectedPlainHTTP: true,
+		},
+		{
+			name:     "TLS forced for http mirror",
+			ref:      "docker.io/library/ubuntu:latest",
+			scheme:   "http",
+			override: schemeForceTLS,
+		},
+		{
+			name:     "TLS forced for localhost",
+			ref:      "localhost:5000/ubuntu:latest",
+			override: schemeForceTLS,
+		},
+		{
+			name:              "plain HTTP forced for https mirror",
+			ref:               "docker.io/library/ubuntu:latest",
+			scheme:            "https",
+			override:          schemeForcePlainHTTP,
+			expectedPlainHTTP: true,
+		},
+		{
+			name:     "plain HTTP not forced for registry",
+			ref:      "docker.io/library/ubuntu:latest",
+			scheme:   "https",
+			host:     "registry-1.docker.io",
+			override: schemeForcePlainHTTP,
+		},
+		{
+			name:     "plain HTTP not forced for registry without mirrors",
+			ref:      "registry.example.com/ubuntu:latest",
+			override: schemeForcePlainHTTP,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			refspec, err := reference.Parse(tc.ref)
+			if err != nil {
+				t.Fatalf("failed to parse reference: %v", err)
+			}
+			var hosts []docker.RegistryHost
+			if tc.scheme != "" {
+				host := tc.host
+				if host == "" {
+					host = "mirror.local:5000"
+				}
+				hosts = append(hosts, docker.RegistryHost{Host: host, Scheme: tc.scheme, Path: "/v2"})
+			}
+			repo, err := newRemoteStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{scheme: tc.override})
+			if err != nil {
+				t.Fatalf("newRemoteStore failed: %v", err)
+			}
+			if repo.PlainHTTP != tc.expectedPlainHTTP {
+				t.Errorf("expected PlainHTTP to be %v, got %v", tc.expectedPlainHTTP, repo.PlainHTTP)
+			}
+		})
+	}
+}
+
+func TestSchemeOverrideOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected schemeOverride
+	}{
+		{
+			name:     "default",
+			expected: schemeInferred,
+		},
+		{
+			name:     "force TLS",
+			opts:     []Option{WithForceTLS()},
+			expected: schemeForceTLS,
+		},
+		{
+			name:     "force plain HTTP",
+			opts:     []Option{WithForcePlainHTTP()},
+			expected: schemeForcePlainHTTP,
+		},
+		{
+			name:     "TLS takes precedence",
+			opts:     []Option{WithForceTLS(), WithForcePlainHTTP()},
+			expected: schemeForceTLS,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var opts options
+			for _, o := range tc.opts {
+				o(&opts)
+			}
+			if opts.scheme != tc.expected {
+				t.Errorf("expected scheme override %v, got %v", tc.expected, opts.scheme)
+			}
+		})
+	}
+}
+
 // TestNewRemoteStoreFallback verifies backward compatibility when hosts is empty.
 func TestNewRemoteStoreFallback(t *testing.T) {
 	refspec, err := reference.Parse("docker.io/library/alpine:latest")
@@ -82,7 +217,7 @@ func TestNewRemoteStoreFallback(t *testing.T) {
 	client := &http.Client{}
 
 	// Empty slice should behave like nil (fallback to original)
-	repo, err := newRemoteStore(refspec, client, []docker.RegistryHost{})
+	repo, err := newRemoteStore(context.Background(), refspec, client, []docker.RegistryHost{}, hostPolicy{})
 	if err != nil {
 		t.Fatalf("newRemoteStore failed with empty hosts: %v", err)
 	}
@@ -91,6 +226,196 @@ func TestNewRemoteStoreFallback(t *testing.T) {
 	}
 }
 
+// TestOriginFallback verifies that the registry of an image is tried after all its mirrors
+// fail if the policy falls back to the origin.
+func TestOriginFallback(t *testing.T) {
+	dgst := "sha256:abc123"
+	// The origin is on localhost, so that it's served over plain HTTP like the registry of refspec.
+	origin := newBlobHostServer(t, http.StatusOK)
+	refspec, err := reference.Parse(origin.host().Host + "/library/alpine:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	ref := refspec.Locator + "@" + dgst
+	// The failing mirror answers the probe of its registry API but fails blob requests.
+	mirror := newBlobHostServer(t, http.StatusInternalServerError)
+	hosts := []docker.RegistryHost{mirror.host()}
+
+	store, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{timeout: time.Second})
+	if err != nil {
+		t.Fatalf("newRemoteBlobStore failed: %v", err)
+	}
+	if _, err := store.doInitialFetch(context.Background(), ref); !errors.Is(err, ErrNoReachableHost) {
+		t.Fatalf("expected %v without origin fallback, got %v", ErrNoReachableHost, err)
+	}
+	if origin.requested(dgst) {
+		t.Fatal("expected the origin not to be requested without origin fallback")
+	}
+
+	policy := hostPolicy{timeout: time.Second, originFallback: true}
+	store, err = newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, policy)
+	if err != nil {
+		t.Fatalf("newRemoteBlobStore failed: %v", err)
+	}
+	if _, err := store.doInitialFetch(context.Background(), ref); err != nil {
+		t.Fatalf("doInitialFetch failed: %v", err)
+	}
+	if !mirror.requested(dgst) || !origin.requested(dgst) {
+		t.Fatal("expected the blob to be requested from the mirror, then the origin")
+	}
+	if host := store.servingHost(dgst); host != origin.host().Host {
+		t.Fatalf("expected the blob to be served by the origin %s, got %s", origin.host().Host, host)
+	}
+
+	// The requests of images whose mirrors are unreachable fail over to the origin.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	unreachable := docker.RegistryHost{Host: l.Addr().String(), Scheme: "http", Path: "/v2"}
+	l.Close()
+	repo, err := newRemoteStore(context.Background(), refspec, &http.Client{}, []docker.RegistryHost{unreachable}, policy)
+	if err != nil {
+		t.Fatalf("newRemoteStore failed: %v", err)
+	}
+	otherDgst := "sha256:def456"
+	resp, err := getRepositoryBlob(repo, otherDgst)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if !origin.requested(otherDgst) {
+		t.Error("expected the request to fail over to the origin")
+	}
+}
+
+// getRepositoryBlob sends a request for the blob dgst of repo with the client of repo.
+func getRepositoryBlob(repo *remote.Repository, dgst string) (*http.Response, error) {
+	scheme := "https"
+	if repo.PlainHTTP {
+		scheme = "http"
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s://%s/v2/%s/blobs/%s", scheme, repo.Reference.Host(), repo.Reference.Repository, dgst), nil)
+	if err != nil {
+		return nil, err
+	}
+	return repo.Client.Do(req)
+}
+
+// TestNewRemoteStoreFailover verifies that the requests of the repositories returned by
+// newRemoteStore fail over to the next host if a host is unreachable or fails them, and fail
+// if every host is unreachable or fails with a 5xx status.
+func TestNewRemoteStoreFailover(t *testing.T) {
+	refspec, err := reference.Parse("docker.io/library/alpine:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+
+	// A closed listener gives an address nothing listens on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	unreachable := docker.RegistryHost{Host: l.Addr().String(), Scheme: "http", Path: "/v2"}
+	l.Close()
+
+	failing := newBlobHostServer(t, http.StatusServiceUnavailable)
+	missing := newBlobHostServer(t, http.StatusNotFound)
+	healthy := newBlobHostServer(t, http.StatusOK)
+	client := &http.Client{}
+
+	// Hosts aren't contacted until a request is made.
+	cooldown := newHostCooldown(time.Minute)
+	policy := hostPolicy{timeout: time.Second, cooldown: cooldown}
+	hosts := []docker.RegistryHost{unreachable, failing.host(), missing.host(), healthy.host()}
+	repo, err := newRemoteStore(context.Background(), refspec, client, hosts, policy)
+	if err != nil {
+		t.Fatalf("newRemoteStore failed: %v", err)
+	}
+	if repo.Reference.Registry != unreachable.Host {
+		t.Errorf("expected host %s, got %s", unreachable.Host, repo.Reference.Registry)
+	}
+
+	dgst := "sha256:abc123"
+	resp, err := getRepositoryBlob(repo, dgst)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if !failing.requested(dgst) || !missing.requested(dgst) || !healthy.requested(dgst) {
+		t.Error("expected the request to fail over to each host in order")
+	}
+
+	// Hosts that are unreachable or fail with a 5xx are skipped by later requests,
+	// including those of other repositories sharing the cooldown. Hosts answering
+	// with another error status are still requested.
+	repo, err = newRemoteStore(context.Background(), refspec, client, hosts, policy)
+	if err != nil {
+		t.Fatalf("newRemoteStore failed: %v", err)
+	}
+	if repo.Reference.Registry != missing.host().Host {
+		t.Errorf("expected host %s, got %s", missing.host().Host, repo.Reference.Registry)
+	}
+	otherDgst := "sha256:def456"
+	resp, err = getRepositoryBlob(repo, otherDgst)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if failing.requested(otherDgst) {
+		t.Error("expected the failing host to be skipped")
+	}
+	if !missing.requested(otherDgst) || !healthy.requested(otherDgst) {
+		t.Error("expected the request to fail over from the host missing the blob")
+	}
+
+	// Hosts that only answer with error statuses other than 5xx answer the request.
+	repo, err = newRemoteStore(context.Background(), refspec, client, []docker.RegistryHost{failing.host(), missing.host()}, hostPolicy{timeout: time.Second})
+	if err != nil {
+		t.Fatalf("newRemoteStore failed: %v", err)
+	}
+	resp, err = getRepositoryBlob(repo, dgst)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	// The error of each host can be retrieved.
+	repo, err = newRemoteStore(context.Background(), refspec, client, hosts[:2], hostPolicy{timeout: time.Second})
+	if err != nil {
+		t.Fatalf("newRemoteStore failed: %v", err)
+	}
+	_, err = getRepositoryBlob(repo, dgst)
+	if !errors.Is(err, ErrNoReachableHost) {
+		t.Fatalf("expected %v, got %v", ErrNoReachableHost, err)
+	}
+	var allFailed *AllHostsFailedError
+	if !errors.As(err, &allFailed) {
+		t.Fatalf("expected an *AllHostsFailedError, got %v", err)
+	}
+	if len(allFailed.Hosts) != 2 {
+		t.Fatalf("expected the errors of 2 hosts, got %d", len(allFailed.Hosts))
+	}
+	for i, h := range allFailed.Hosts {
+		if h.Host != hosts[i].Host || h.Err == nil {
+			t.Errorf("expected the error of host %s, got %q: %v", hosts[i].Host, h.Host, h.Err)
+		}
+	}
+	if !errors.Is(allFailed.Hosts[1], sociremote.ErrUnexpectedStatusCode) {
+		t.Errorf("expected %v for the failing host, got %v", sociremote.ErrUnexpectedStatusCode, allFailed.Hosts[1].Err)
+	}
+	var hostErr *HostError
+	if !errors.As(err, &hostErr) || hostErr.Host != hosts[0].Host {
+		t.Errorf("expected the error of host %s to be found with errors.As, got %v", hosts[0].Host, hostErr)
+	}
+}
+
 // TestBlobURLConstruction verifies that blob URLs are constructed correctly with mirrors.
 func TestBlobURLConstruction(t *testing.T) {
 	// Test with a registry that uses mirror
@@ -109,7 +434,7 @@ func TestBlobURLConstruction(t *testing.T) {
 	}
 	hosts := []docker.RegistryHost{mirrorHost}
 
-	blobStore, err := newRemoteBlobStore(refspec, client, hosts)
+	blobStore, err := newRemoteBlobStore(context.Background(), refspec, client, hosts, hostPolicy{})
 	if err != nil {
 		t.Fatalf("newRemoteBlobStore failed: %v", err)
 	}
@@ -139,6 +464,116 @@ func TestBlobURLConstruction(t *testing.T) {
 	}
 }
 
+// TestBlobURLConstructionDockerHubShortName verifies that short names of Docker Hub
+// images are expanded to their library/ repository on mirrors.
+func TestBlobURLConstructionDockerHubShortName(t *testing.T) {
+	refspec, err := reference.Parse("docker.io/ubuntu:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	hosts := []docker.RegistryHost{{
+		Host:   "mirror.internal:5000",
+		Scheme: "http",
+		Path:   "/v2",
+	}}
+
+	blobStore, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{})
+	if err != nil {
+		t.Fatalf("newRemoteBlobStore failed: %v", err)
+	}
+	url := blobStore.buildBlobURL("sha256:abc123")
+	expectedURL := "http://mirror.internal:5000/v2/library/ubuntu/blobs/sha256:abc123"
+	if url != expectedURL {
+		t.Errorf("URL mismatch:\nGot:      %s\nExpected: %s", url, expectedURL)
+	}
+	if !strings.Contains(url, "/library/ubuntu/") {
+		t.Errorf("expected URL to contain library/ubuntu, got %s", url)
+	}
+}
+
+// TestBlobURLConstructionRepositoryPrefix verifies that the repository prefix of a mirror
+// applies to its blob URLs but not to the ones of the registry.
+func TestBlobURLConstructionRepositoryPrefix(t *testing.T) {
+	refspec, err := reference.Parse("docker.io/library/ubuntu:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	dgst := "sha256:abc123"
+	hosts := []docker.RegistryHost{
+		{Host: "cache.example.com", Scheme: "https", Path: "/v2"},
+		{Host: "registry-1.docker.io", Scheme: "https", Path: "/v2"},
+	}
+	policy := hostPolicy{repositoryPrefixes: map[string]string{"cache.example.com": "/cache/docker.io/"}}
+	blobStore, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, policy)
+	if err != nil {
+		t.Fatalf("newRemoteBlobStore failed: %v", err)
+	}
+
+	expectedMirrorURL := "https://cache.example.com/v2/cache/docker.io/library/ubuntu/blobs/sha256:abc123"
+	if url := blobStore.buildBlobURL(dgst); url != expectedMirrorURL {
+		t.Errorf("mirror URL mismatch:\nGot:      %s\nExpected: %s", url, expectedMirrorURL)
+	}
+
+	// The prefix of the mirror doesn't apply once the blob falls back to the registry.
+	blobStore.hostFailed(context.Background(), 0, dgst, errors.New("mirror failed"))
+	expectedFallbackURL := "https://registry-1.docker.io/v2/library/ubuntu/blobs/sha256:abc123"
+	if url := blobStore.buildBlobURL(dgst); url != expectedFallbackURL {
+		t.Errorf("fallback URL mismatch:\nGot:      %s\nExpected: %s", url, expectedFallbackURL)
+	}
+}
+
+// TestBlobURLConstructionIPv6 verifies that mirrors on IPv6 literals get well-formed URLs.
+func TestBlobURLConstructionIPv6(t *testing.T) {
+	refspec, err := reference.Parse("registry.example.com/myorg/myapp/image:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		host        string
+		expectedURL string
+	}{
+		{
+			name:        "literal with port",
+			host:        "[fd00::1]:5000",
+			expectedURL: "http://[fd00::1]:5000/v2/myorg/myapp/image/blobs/sha256:abc123",
+		},
+		{
+			name:        "literal without brackets",
+			host:        "fd00::1",
+			expectedURL: "http://[fd00::1]/v2/myorg/myapp/image/blobs/sha256:abc123",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hosts := []docker.RegistryHost{{
+				Host:   tc.host,
+				Scheme: "http",
+				Path:   "/v2",
+			}}
+			blobStore, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{})
+			if err != nil {
+				t.Fatalf("newRemoteBlobStore failed: %v", err)
+			}
+			blobURL := blobStore.buildBlobURL("sha256:abc123")
+			if blobURL != tc.expectedURL {
+				t.Errorf("URL mismatch:\nGot:      %s\nExpected: %s", blobURL, tc.expectedURL)
+			}
+			u, err := url.Parse(blobURL)
+			if err != nil {
+				t.Fatalf("URL %s is malformed: %v", blobURL, err)
+			}
+			if u.Hostname() != "fd00::1" {
+				t.Errorf("expected URL host fd00::1, got %s", u.Hostname())
+			}
+			if u.Path != "/v2/myorg/myapp/image/blobs/sha256:abc123" {
+				t.Errorf("expected repository path myorg/myapp/image, got %s", u.Path)
+			}
+		})
+	}
+}
+
 // TestBlobURLConstructionWithCustomPath verifies support for non-standard registry paths.
 func TestBlobURLConstructionWithCustomPath(t *testing.T) {
 	refspec, err := reference.Parse("registry.example.com/myorg/myapp/image:latest")
@@ -156,7 +591,7 @@ func TestBlobURLConstructionWithCustomPath(t *testing.T) {
 	}
 	hosts := []docker.RegistryHost{mirrorHost}
 
-	blobStore, err := newRemoteBlobStore(refspec, client, hosts)
+	blobStore, err := newRemoteBlobStore(context.Background(), refspec, client, hosts, hostPolicy{})
 	if err != nil {
 		t.Fatalf("newRemoteBlobStore failed: %v", err)
 	}
@@ -171,6 +606,153 @@ func TestBlobURLConstructionWithCustomPath(t *testing.T) {
 	}
 }
 
+// TestBlobURLConstructionNormalizesPath verifies that the API root of hosts is normalized
+// to exactly one leading slash and no trailing slash.
+func TestBlobURLConstructionNormalizesPath(t *testing.T) {
+	refspec, err := reference.Parse("registry.example.com/myorg/myapp/image:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		expectedURL string
+	}{
+		{
+			name:        "trailing slash",
+			path:        "/v2/",
+			expectedURL: "http://mirror.internal:5000/v2/myorg/myapp/image/blobs/sha256:abc123",
+		},
+		{
+			name:        "missing leading slash",
+			path:        "v2",
+			expectedURL: "http://mirror.internal:5000/v2/myorg/myapp/image/blobs/sha256:abc123",
+		},
+		{
+			name:        "empty path",
+			path:        "",
+			expectedURL: "http://mirror.internal:5000/v2/myorg/myapp/image/blobs/sha256:abc123",
+		},
+		{
+			name:        "custom path with trailing slash",
+			path:        "/custom/v2/",
+			expectedURL: "http://mirror.internal:5000/custom/v2/myorg/myapp/image/blobs/sha256:abc123",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hosts := []docker.RegistryHost{{
+				Host:   "mirror.internal:5000",
+				Scheme: "http",
+				Path:   tc.path,
+			}}
+			blobStore, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{})
+			if err != nil {
+				t.Fatalf("newRemoteBlobStore failed: %v", err)
+			}
+			if url := blobStore.buildBlobURL("sha256:abc123"); url != tc.expectedURL {
+				t.Errorf("URL mismatch:\nGot:      %s\nExpected: %s", url, tc.expectedURL)
+			}
+		})
+	}
+}
+
+// TestServingHostAfterFailover verifies that the host a blob is fetched from,
+// which is recorded on the snapshots of unpacked layers, follows failovers.
+func TestServingHostAfterFailover(t *testing.T) {
+	refspec, err := reference.Parse("docker.io/library/alpine:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	dgst := "sha256:abc123"
+	// The failing mirror answers the probe of its registry API but fails blob requests.
+	failing := newBlobHostServer(t, http.StatusInternalServerError)
+	healthy := newBlobHostServer(t, http.StatusOK)
+	hosts := []docker.RegistryHost{failing.host(), healthy.host()}
+	store, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{timeout: time.Second})
+	if err != nil {
+		t.Fatalf("newRemoteBlobStore failed: %v", err)
+	}
+	if host := store.servingHost(dgst); host != failing.host().Host {
+		t.Fatalf("expected blob to be fetched from the primary host %s before any fetch; got %s", failing.host().Host, host)
+	}
+	if _, err := store.doInitialFetch(context.Background(), refspec.Locator+"@"+dgst); err != nil {
+		t.Fatalf("doInitialFetch failed: %v", err)
+	}
+	if host := store.servingHost(dgst); host != healthy.host().Host {
+		t.Fatalf("expected blob to be fetched from %s after failover; got %s", healthy.host().Host, host)
+	}
+}
+
+// TestBlobURLDebugLog verifies that the parts of blob URLs are logged at debug level only.
+func TestBlobURLDebugLog(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+
+	refspec, err := reference.Parse("registry.example.com/myorg/myapp/image:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	hosts := []docker.RegistryHost{{Host: host, Scheme: "http", Path: "/custom/v2/"}}
+	blobStore, err := newRemoteBlobStore(context.Background(), refspec, &http.Client{}, hosts, hostPolicy{})
+	if err != nil {
+		t.Fatalf("newRemoteBlobStore failed: %v", err)
+	}
+	dgst := "sha256:abc123"
+
+	fetchWithLogLevel := func(level logrus.Level) []map[string]any {
+		var buf bytes.Buffer
+		logger := logrus.New()
+		logger.SetOutput(&buf)
+		logger.SetFormatter(&logrus.JSONFormatter{})
+		logger.SetLevel(level)
+		ctx := log.WithLogger(context.Background(), logrus.NewEntry(logger))
+		rc, err := blobStore.FetchRange(ctx, refspec.Locator+"@"+dgst, 0, 0)
+		if err != nil {
+			t.Fatalf("FetchRange failed: %v", err)
+		}
+		rc.Close()
+
+		var entries []map[string]any
+		dec := json.NewDecoder(&buf)
+		for dec.More() {
+			var entry map[string]any
+			if err := dec.Decode(&entry); err != nil {
+				t.Fatalf("failed to decode log entry: %v", err)
+			}
+			if entry["msg"] == "resolved blob URL" {
+				entries = append(entries, entry)
+			}
+		}
+		return entries
+	}
+
+	if entries := fetchWithLogLevel(logrus.InfoLevel); len(entries) != 0 {
+		t.Fatalf("expected no blob URL logs at info level; got %v", entries)
+	}
+	entries := fetchWithLogLevel(logrus.DebugLevel)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 blob URL log at debug level; got %v", entries)
+	}
+	expected := map[string]string{
+		"host":       host,
+		"path":       "/custom/v2",
+		"repository": "myorg/myapp/image",
+		"digest":     dgst,
+		"reference":  host + "/myorg/myapp/image@" + dgst,
+	}
+	for field, value := range expected {
+		if entries[0][field] != value {
+			t.Errorf("expected %s to be %q; got %v", field, value, entries[0][field])
+		}
+	}
+}
+
 // TestDigestReferenceFormat verifies that digest references use @ separator, not :
 func TestDigestReferenceFormat(t *testing.T) {
 	refspec, err := reference.Parse("registry.example.com/myorg/myapp/image:latest")
@@ -186,7 +768,7 @@ func TestDigestReferenceFormat(t *testing.T) {
 	}
 	hosts := []docker.RegistryHost{mirrorHost}
 
-	blobStore, err := newRemoteBlobStore(refspec, client, hosts)
+	blobStore, err := newRemoteBlobStore(context.Background(), refspec, client, hosts, hostPolicy{})
 	if err != nil {
 		t.Fatalf("newRemoteBlobStore failed: %v", err)
 	}
@@ -230,7 +812,7 @@ func TestBlobRefString(t *testing.T) {
 	}
 
 	client := &http.Client{}
-	blobStore, err := newRemoteBlobStore(refspec, client, nil)
+	blobStore, err := newRemoteBlobStore(context.Background(), refspec, client, nil, hostPolicy{})
 	if err != nil {
 		t.Fatalf("newRemoteBlobStore failed: %v", err)
 	}
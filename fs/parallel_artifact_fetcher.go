@@ -208,7 +208,13 @@ func (f *parallelArtifactFetcher) oneRequestFetchWrite(ctx context.Context, desc
 	}
 	defer f.layerUnpackJob.ReleaseDownload(1)
 
-	rc, err := f.remoteStore.Fetch(ctx, desc)
+	var rc io.ReadCloser
+	if rs, ok := f.remoteStore.(*orasBlobStore); ok {
+		// The digest is verified by asyncVerifyBlobDigest once the blob is written.
+		rc, err = rs.fetch(ctx, desc, false)
+	} else {
+		rc, err = f.remoteStore.Fetch(ctx, desc)
+	}
 	if err != nil {
 		return fmt.Errorf("error fetching from remote: %v", err)
 	}
@@ -0,0 +1,149 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/semaphore"
+)
+
+// PrefetchResult is the result of prefetching a blob.
+type PrefetchResult struct {
+	Digest digest.Digest
+	// Cached is whether the blob was already in the local content store.
+	Cached bool
+	// Err is why the blob couldn't be prefetched, if it couldn't.
+	Err error
+}
+
+// Prefetch fetches the blobs digests of the image refspec from hosts into the cache their
+// reads are served from, e.g. ahead of predictable cold starts, so that they aren't fetched
+// when they are read. The spans of layers that are lazily loaded are fetched into their span
+// cache, which requires the layers to be mounted. Other blobs, e.g. of layers that are unpacked
+// locally when they are mounted, are fetched into the local content store, verified against
+// their digest, and labeled so that they aren't garbage collected. Blobs are fetched in
+// parallel, at most MaxConcurrency at once, and blobs that are already cached aren't fetched
+// again. The results are in the order of digests. Prefetch isn't part of snapshot.FileSystem,
+// so callers of NewFilesystem assert that the filesystem implements it.
+func (fs *filesystem) Prefetch(ctx context.Context, refspec reference.Spec, digests []digest.Digest, hosts []docker.RegistryHost) []PrefetchResult {
+	results := make([]PrefetchResult, len(digests))
+	for i, dgst := range digests {
+		results[i].Digest = dgst
+	}
+	if len(digests) == 0 {
+		return results
+	}
+	fail := func(err error) []PrefetchResult {
+		for i := range results {
+			results[i].Err = err
+		}
+		return results
+	}
+
+	var client *http.Client
+	if len(hosts) > 0 {
+		client = hosts[0].Client
+	}
+	remoteStore, err := newRemoteBlobStore(ctx, refspec, client, hosts, fs.hostPolicy)
+	if err != nil {
+		return fail(fmt.Errorf("cannot create remote store: %w", err))
+	}
+	fetcher, err := newArtifactFetcher(refspec, fs.contentStore, remoteStore)
+	if err != nil {
+		return fail(fmt.Errorf("cannot create fetcher: %w", err))
+	}
+	// batch will prevent content from being garbage collected in the middle of the following operations
+	ctx, batchDone, err := fs.contentStore.BatchOpen(ctx)
+	if err != nil {
+		return fail(err)
+	}
+	defer batchDone(ctx)
+
+	var smp *semaphore.Weighted
+	if fs.maxConcurrency > 0 {
+		smp = semaphore.NewWeighted(fs.maxConcurrency)
+	}
+	// Duplicate digests are only fetched once, and share the result of their first occurrence.
+	first := make(map[digest.Digest]int)
+	var wg sync.WaitGroup
+	for i, dgst := range digests {
+		if _, ok := first[dgst]; ok {
+			continue
+		}
+		first[dgst] = i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if smp != nil {
+				if err := smp.Acquire(ctx, 1); err != nil {
+					results[i].Err = err
+					return
+				}
+				defer smp.Release(1)
+			}
+			results[i].Cached, results[i].Err = fs.prefetchBlob(ctx, refspec, fetcher, dgst)
+		}()
+	}
+	wg.Wait()
+	for i, dgst := range digests {
+		results[i] = results[first[dgst]]
+	}
+	return results
+}
+
+// prefetchBlob fetches the blob dgst of the image refspec into the span cache of its layer
+// if it's lazily loaded, or into the local store of fetcher otherwise, unless it's already
+// there. It returns whether the blob was already cached.
+func (fs *filesystem) prefetchBlob(ctx context.Context, refspec reference.Spec, fetcher *artifactFetcher, dgst digest.Digest) (bool, error) {
+	if fs.resolver != nil {
+		cached, err := fs.resolver.WarmLayer(refspec, dgst)
+		if !errors.Is(err, layer.ErrLayerNotResolved) {
+			return cached, err
+		}
+	}
+	desc, err := fetcher.resolve(ctx, ocispec.Descriptor{Digest: dgst})
+	if err != nil {
+		return false, err
+	}
+	rc, local, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	if !local {
+		if err := fetcher.Store(ctx, desc, rc); err != nil {
+			return false, err
+		}
+	}
+	// The blob is only referenced by the lease of the batch, so it would be garbage
+	// collected before it's read without a label.
+	if err := store.LabelGCRoot(ctx, fs.contentStore, desc); err != nil {
+		return local, fmt.Errorf("cannot label blob: %w", err)
+	}
+	return local, nil
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPrefetch(t *testing.T) {
+	blobs := map[digest.Digest][]byte{}
+	for _, content := range []string{"layer 1", "layer 2"} {
+		blobs[digest.FromString(content)] = []byte(content)
+	}
+	var gets atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, dgst, ok := strings.Cut(r.URL.Path, "/blobs/")
+		content, found := blobs[digest.Digest(dgst)]
+		if !ok || !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", dgst)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method == http.MethodGet {
+			gets.Add(1)
+			w.Write(content)
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	refspec, err := reference.Parse(host + "/repo:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	hosts := []docker.RegistryHost{{Host: host, Scheme: "http", Path: "/v2", Client: server.Client()}}
+	missing := digest.FromString("missing")
+	// The duplicate digest is fetched once.
+	digests := []digest.Digest{digest.FromString("layer 1"), digest.FromString("layer 2"), missing, digest.FromString("layer 1")}
+	contentStore := &gcLabelStore{Store: newFakeLocalStore(), roots: make(map[digest.Digest]bool)}
+	fs := &filesystem{contentStore: contentStore, maxConcurrency: 1}
+
+	check := func(results []PrefetchResult, cached bool) {
+		t.Helper()
+		if len(results) != len(digests) {
+			t.Fatalf("expected %d results; got %d", len(digests), len(results))
+		}
+		for i, r := range results {
+			if r.Digest != digests[i] {
+				t.Fatalf("expected result %d to be of %s; got %s", i, digests[i], r.Digest)
+			}
+			if r.Digest == missing {
+				if r.Err == nil {
+					t.Fatalf("expected prefetching missing blob %s to fail", r.Digest)
+				}
+				continue
+			}
+			if r.Err != nil {
+				t.Fatalf("failed to prefetch %s: %v", r.Digest, r.Err)
+			}
+			if r.Cached != cached {
+				t.Fatalf("expected %s to be cached before prefetching: %v; got %v", r.Digest, cached, r.Cached)
+			}
+		}
+	}
+
+	check(fs.Prefetch(context.Background(), refspec, digests, hosts), false)
+	if n := gets.Load(); n != 2 {
+		t.Fatalf("expected both blobs to be fetched; got %d blob requests", n)
+	}
+	for dgst := range blobs {
+		if !contentStore.gcRoot(dgst) {
+			t.Fatalf("expected prefetched blob %s to be labeled as a GC root", dgst)
+		}
+	}
+
+	// The blobs are served from the local content store afterwards.
+	check(fs.Prefetch(context.Background(), refspec, digests, hosts), true)
+	if n := gets.Load(); n != 2 {
+		t.Fatalf("expected cached blobs not to be fetched again; got %d blob requests", n)
+	}
+}
+
+// gcLabelStore is a store recording the blobs labeled as GC roots.
+type gcLabelStore struct {
+	store.Store
+	mu    sync.Mutex
+	roots map[digest.Digest]bool
+}
+
+func (s *gcLabelStore) Label(ctx context.Context, target ocispec.Descriptor, name, value string) error {
+	if name == "containerd.io/gc.root" {
+		s.mu.Lock()
+		s.roots[target.Digest] = true
+		s.mu.Unlock()
+	}
+	return s.Store.Label(ctx, target, name, value)
+}
+
+func (s *gcLabelStore) gcRoot(dgst digest.Digest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.roots[dgst]
+}
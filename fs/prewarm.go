@@ -0,0 +1,150 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/log"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orasremote "oras.land/oras-go/v2/registry/remote"
+)
+
+// ErrNoPlatformManifest is returned when an image index has no image manifest
+// for the platform of the host.
+var ErrNoPlatformManifest = errors.New("no image manifest for the host platform")
+
+// Prewarm prepares lazily loading the image ref before it is pulled. It resolves the
+// registry hosts of the image, which warms up connections to them and acquires pull
+// tokens, discovers and fetches the SOCI index of the image manifest for the host
+// platform, and resolves the blobs of the indexed layers. No snapshot is created.
+//
+// Mounting the layers of ref reuses the SOCI index and the resolved blobs, so ref must
+// be the same reference that is pulled afterwards.
+func (fs *filesystem) Prewarm(ctx context.Context, ref string) error {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return fmt.Errorf("cannot parse image ref (%s): %w", ref, err)
+	}
+	hosts, err := fs.registryHosts(refspec)
+	if err != nil {
+		return fmt.Errorf("failed to get registry hosts of %q: %w", ref, err)
+	}
+	if len(hosts) == 0 {
+		return fmt.Errorf("no registry hosts for %q", ref)
+	}
+	client := hosts[0].Client
+
+	manifestStores, err := newManifestStores(refspec, client, hosts)
+	if err != nil {
+		return err
+	}
+	object := refspec.Object
+	if dgst := refspec.Digest(); dgst != "" {
+		object = dgst.String()
+	}
+	var (
+		imgDigest   digest.Digest
+		manifest    ocispec.Manifest
+		manifestErr error
+	)
+	for _, store := range manifestStores {
+		imgDigest, manifest, err = resolvePlatformManifest(ctx, store, object)
+		if err == nil {
+			manifestErr = nil
+			break
+		}
+		manifestErr = errors.Join(manifestErr, err)
+	}
+	if manifestErr != nil {
+		return fmt.Errorf("failed to resolve image manifest of %q: %w", ref, manifestErr)
+	}
+
+	c, err := fs.getSociContext(ctx, ref, "", imgDigest.String(), client, hosts)
+	if err != nil {
+		return fmt.Errorf("unable to fetch SOCI artifacts for image %q: %w", ref, err)
+	}
+	imageLayerToSociDesc := c.imageLayerToSociDesc()
+	var wg sync.WaitGroup
+	for _, desc := range manifest.Layers {
+		if _, ok := imageLayerToSociDesc[desc.Digest.String()]; !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Failing to resolve a blob isn't fatal; it's resolved again when the layer is mounted.
+			if err := fs.resolver.PrefetchBlob(ctx, hosts, refspec, desc); err != nil {
+				log.G(ctx).WithError(err).WithField("layerDigest", desc.Digest).Debug("failed to prewarm layer blob")
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// resolvePlatformManifest returns the digest and contents of the image manifest that
+// object refers to in store. If object refers to an image index, the image manifest
+// for the platform of the host is used, like containerd does when pulling an image.
+func resolvePlatformManifest(ctx context.Context, store *orasremote.Repository, object string) (digest.Digest, ocispec.Manifest, error) {
+	desc, r, err := store.Manifests().FetchReference(ctx, object)
+	if err != nil {
+		return "", ocispec.Manifest{}, fmt.Errorf("could not fetch manifest: %w", err)
+	}
+	b, err := io.ReadAll(io.LimitReader(r, maxManifestBytes))
+	r.Close()
+	if err != nil {
+		return "", ocispec.Manifest{}, fmt.Errorf("could not read manifest: %w", err)
+	}
+
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+		var index ocispec.Index
+		if err := json.Unmarshal(b, &index); err != nil {
+			return "", ocispec.Manifest{}, fmt.Errorf("could not unmarshal image index: %w", err)
+		}
+		matcher := platforms.Default()
+		var best *ocispec.Descriptor
+		for i, m := range index.Manifests {
+			if m.Platform == nil || !matcher.Match(*m.Platform) {
+				continue
+			}
+			if best == nil || matcher.Less(*m.Platform, *best.Platform) {
+				best = &index.Manifests[i]
+			}
+		}
+		if best == nil {
+			return "", ocispec.Manifest{}, fmt.Errorf("%w: %s", ErrNoPlatformManifest, platforms.DefaultString())
+		}
+		return resolvePlatformManifest(ctx, store, best.Digest.String())
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return "", ocispec.Manifest{}, fmt.Errorf("could not unmarshal manifest: %w", err)
+	}
+	return desc.Digest, manifest, nil
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPrewarm(t *testing.T) {
+	index := soci.NewIndex(soci.V2, nil, nil, nil)
+	indexBytes, err := soci.MarshalIndex(index)
+	if err != nil {
+		t.Fatalf("failed to marshal index: %v", err)
+	}
+	indexDigest := digest.FromBytes(indexBytes)
+	manifestBytes, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		// The layer has no zTOC, so its blob isn't resolved.
+		Layers:      []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("layer"), Size: 5}},
+		Annotations: map[string]string{soci.ImageAnnotationSociIndexDigest: indexDigest.String()},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	imgDigest := digest.FromBytes(manifestBytes)
+	platform := platforms.DefaultSpec()
+	imageIndexBytes, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{
+			{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    digest.FromString("other platform"),
+				Size:      1,
+				Platform:  &ocispec.Platform{OS: "other", Architecture: "other"},
+			},
+			{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    imgDigest,
+				Size:      int64(len(manifestBytes)),
+				Platform:  &platform,
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal image index: %v", err)
+	}
+
+	var requests atomic.Int32
+	serve := func(w http.ResponseWriter, r *http.Request, mediaType string, dgst digest.Digest, content []byte) {
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method != http.MethodHead {
+			w.Write(content)
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/manifests/latest"):
+			serve(w, r, ocispec.MediaTypeImageIndex, digest.FromBytes(imageIndexBytes), imageIndexBytes)
+		case strings.HasSuffix(r.URL.Path, "/manifests/"+imgDigest.String()):
+			serve(w, r, ocispec.MediaTypeImageManifest, imgDigest, manifestBytes)
+		case strings.HasSuffix(r.URL.Path, "/"+indexDigest.String()):
+			serve(w, r, ocispec.MediaTypeImageManifest, indexDigest, indexBytes)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ref := host + "/repo:latest"
+	hosts := []docker.RegistryHost{{Host: host, Scheme: "http", Path: "/v2", Client: server.Client()}}
+	newFilesystem := func() *filesystem {
+		return &filesystem{
+			ctx:          ctx,
+			contentStore: newFakeLocalStore(),
+			pullModes:    config.PullModes{SOCIv2: config.V2{Enable: true}},
+			registryHosts: func(reference.Spec) ([]docker.RegistryHost, error) {
+				return hosts, nil
+			},
+		}
+	}
+	// mount fetches the SOCI artifacts of the image like the first mount of a pull does.
+	mount := func(fs *filesystem) int32 {
+		start := requests.Load()
+		if _, err := fs.getSociContext(ctx, ref, "", imgDigest.String(), server.Client(), hosts); err != nil {
+			t.Fatalf("failed to fetch SOCI artifacts: %v", err)
+		}
+		return requests.Load() - start
+	}
+
+	coldRequests := mount(newFilesystem())
+	if coldRequests == 0 {
+		t.Fatalf("expected a cold mount to fetch the SOCI artifacts from the registry")
+	}
+
+	fs := newFilesystem()
+	if err := fs.Prewarm(ctx, ref); err != nil {
+		t.Fatalf("failed to prewarm image: %v", err)
+	}
+	if warmRequests := mount(fs); warmRequests >= coldRequests {
+		t.Fatalf("expected a prewarmed mount to send fewer requests than a cold one (%d); got %d", coldRequests, warmRequests)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// rangeFlights coalesces concurrent requests for the same range of a blob, e.g. of a
+// base layer shared by images prepared at the same time, into a single upstream request.
+// Ranges are keyed by the digest of their blob, so requests from the stores of different
+// images and hosts are coalesced. Only requests in flight are coalesced: fetched layers
+// are deduplicated by the content store. The data of each range is held in memory until
+// its fetch is done, so that every waiter can read it.
+type rangeFlights struct {
+	mu      sync.Mutex
+	flights map[string]*rangeFlight
+}
+
+// rangeFlight is a fetch of a range shared by its waiters.
+type rangeFlight struct {
+	done chan struct{}
+	data []byte
+	err  error
+	// waiters is the number of callers waiting for the fetch. The fetch
+	// is canceled when they all are.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newRangeFlights() *rangeFlights {
+	return &rangeFlights{flights: make(map[string]*rangeFlight)}
+}
+
+// rangeKey returns the key of the range [lower, upper] of the blob dgst.
+func rangeKey(dgst string, lower, upper int64) string {
+	return fmt.Sprintf("%s@%d-%d", dgst, lower, upper)
+}
+
+// do returns the result of fetch for key, calling fetch once for concurrent callers.
+// A caller whose ctx is canceled stops waiting without affecting the others. fetch
+// runs with a context that is only canceled once every caller stopped waiting.
+func (f *rangeFlights) do(ctx context.Context, key string, fetch func(context.Context) ([]byte, error)) ([]byte, error) {
+	f.mu.Lock()
+	fl, ok := f.flights[key]
+	if !ok {
+		fetchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		fl = &rangeFlight{done: make(chan struct{}), cancel: cancel}
+		f.flights[key] = fl
+		go func() {
+			defer cancel()
+			fl.data, fl.err = fetch(fetchCtx)
+			f.remove(key, fl)
+			close(fl.done)
+		}()
+	}
+	fl.waiters++
+	f.mu.Unlock()
+
+	select {
+	case <-fl.done:
+		return fl.data, fl.err
+	case <-ctx.Done():
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		fl.waiters--
+		if fl.waiters == 0 {
+			fl.cancel()
+			// Later callers start a new fetch rather than joining the canceled one.
+			if f.flights[key] == fl {
+				delete(f.flights, key)
+			}
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// remove removes fl from the flights if it's still the flight of key.
+func (f *rangeFlights) remove(key string, fl *rangeFlight) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.flights[key] == fl {
+		delete(f.flights, key)
+	}
+}
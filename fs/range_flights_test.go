@@ -0,0 +1,151 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestFetchRangeCoalescing(t *testing.T) {
+	const waiters = 8
+	blob := []byte("shared base layer contents")
+	dgst := digest.FromBytes(blob)
+
+	tests := []struct {
+		name string
+		// canceled is the number of waiters canceled before the fetch completes.
+		canceled int
+	}{
+		{
+			name: "concurrent requests make one upstream request",
+		},
+		{
+			name:     "canceled waiters don't abort the shared fetch",
+			canceled: waiters - 1,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var gets atomic.Int32
+			release := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gets.Add(1)
+				<-release
+				w.Header().Set("Accept-Ranges", "bytes")
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+			}))
+			defer srv.Close()
+
+			refspec, err := reference.Parse(strings.TrimPrefix(srv.URL, "http://") + "/repo:tag")
+			if err != nil {
+				t.Fatalf("failed to parse reference: %v", err)
+			}
+			ref := refspec.Locator + "@" + dgst.String()
+			flights := newRangeFlights()
+
+			var wg sync.WaitGroup
+			results := make([][]byte, waiters)
+			errs := make([]error, waiters)
+			cancels := make([]context.CancelFunc, waiters)
+			for i := range waiters {
+				// Each waiter uses its own store, like the prepares of different images.
+				store, err := newRemoteBlobStore(context.Background(), refspec, srv.Client(), nil, hostPolicy{flights: flights})
+				if err != nil {
+					t.Fatalf("newRemoteBlobStore failed: %v", err)
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				cancels[i] = cancel
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rc, err := store.FetchRange(ctx, ref, 0, int64(len(blob)-1))
+					if err != nil {
+						errs[i] = err
+						return
+					}
+					defer rc.Close()
+					results[i], errs[i] = io.ReadAll(rc)
+				}()
+			}
+			defer func() {
+				for _, cancel := range cancels {
+					cancel()
+				}
+			}()
+
+			waitForWaiters(t, flights, waiters)
+			for i := range tc.canceled {
+				cancels[i]()
+			}
+			waitForWaiters(t, flights, waiters-tc.canceled)
+			close(release)
+			wg.Wait()
+
+			if got := gets.Load(); got != 1 {
+				t.Fatalf("expected 1 upstream request; got %d", got)
+			}
+			for i := range waiters {
+				if i < tc.canceled {
+					if !errors.Is(errs[i], context.Canceled) {
+						t.Fatalf("expected waiter %d to be canceled; got %v", i, errs[i])
+					}
+					continue
+				}
+				if errs[i] != nil {
+					t.Fatalf("waiter %d failed: %v", i, errs[i])
+				}
+				if !bytes.Equal(results[i], blob) {
+					t.Fatalf("expected waiter %d to read %q; got %q", i, blob, results[i])
+				}
+			}
+		})
+	}
+}
+
+// waitForWaiters waits until n callers wait for the only flight of flights.
+func waitForWaiters(t *testing.T, flights *rangeFlights, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		flights.mu.Lock()
+		var got int
+		for _, fl := range flights.flights {
+			got += fl.waiters
+		}
+		flights.mu.Unlock()
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d waiters; got %d", n, got)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,72 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"context"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// fetchLane is a class of on-demand fetches that is limited independently.
+type fetchLane int
+
+const (
+	// metadataLane are fetches driven by metadata operations, i.e. fetching
+	// the tar header of a file to verify it when the file is first read.
+	metadataLane fetchLane = iota
+	// dataLane are fetches of file data.
+	dataLane
+)
+
+// FetchLanes limits the number of concurrent on-demand fetches driven by metadata
+// separately from fetches of file data, so that a burst of one can neither starve
+// nor be starved by the other. FetchLanes can be shared by the readers of many layers.
+type FetchLanes struct {
+	metadata *semaphore.Weighted
+	data     *semaphore.Weighted
+}
+
+// NewFetchLanes returns FetchLanes that allow up to metadataLimit concurrent
+// metadata fetches and dataLimit concurrent data fetches. A limit <= 0 doesn't
+// limit the lane.
+func NewFetchLanes(metadataLimit, dataLimit int64) *FetchLanes {
+	l := &FetchLanes{}
+	if metadataLimit > 0 {
+		l.metadata = semaphore.NewWeighted(metadataLimit)
+	}
+	if dataLimit > 0 {
+		l.data = semaphore.NewWeighted(dataLimit)
+	}
+	return l
+}
+
+// acquire waits for a free slot in lane and returns a func that releases it.
+// It fails with the error of ctx if ctx is done first.
+func (l *FetchLanes) acquire(ctx context.Context, lane fetchLane) (release func(), err error) {
+	sem := l.data
+	if lane == metadataLane {
+		sem = l.metadata
+	}
+	if sem == nil {
+		return func() {}, nil
+	}
+	if err := sem.Acquire(ctx, 1); err != nil {
+		return nil, err
+	}
+	return func() { sem.Release(1) }, nil
+}
@@ -0,0 +1,202 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	spanmanager "github.com/awslabs/soci-snapshotter/fs/span-manager"
+	"github.com/awslabs/soci-snapshotter/metadata"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// waitFor fails the test if done isn't closed within a second.
+func waitFor(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// acquire waits for a free slot in lane of lanes and returns a func that releases it.
+func acquire(t *testing.T, lanes *FetchLanes, lane fetchLane) (release func()) {
+	t.Helper()
+	release, err := lanes.acquire(context.Background(), lane)
+	if err != nil {
+		t.Errorf("failed to acquire a slot: %v", err)
+		return func() {}
+	}
+	return release
+}
+
+// expectBlocked fails the test if done is closed within a short time.
+func expectBlocked(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+		t.Fatalf("expected %s to block", what)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestFetchLanesBurst(t *testing.T) {
+	const limit = 2
+	testCases := []struct {
+		name  string
+		burst fetchLane
+		other fetchLane
+	}{
+		{name: "metadata burst doesn't starve data fetches", burst: metadataLane, other: dataLane},
+		{name: "data burst doesn't starve metadata fetches", burst: dataLane, other: metadataLane},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lanes := NewFetchLanes(limit, limit)
+
+			// Start a burst of fetches that hold their slot until they're released.
+			var (
+				inFlight atomic.Int32
+				wg       sync.WaitGroup
+			)
+			release := make(chan struct{})
+			burstDone := make(chan struct{})
+			for i := 0; i < 5*limit; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					done := acquire(t, lanes, tc.burst)
+					inFlight.Add(1)
+					<-release
+					inFlight.Add(-1)
+					done()
+				}()
+			}
+			go func() {
+				wg.Wait()
+				close(burstDone)
+			}()
+			deadline := time.Now().Add(time.Second)
+			for inFlight.Load() < limit {
+				if time.Now().After(deadline) {
+					t.Fatalf("timed out waiting for the burst to fill its lane")
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			// The burst is limited to its own lane...
+			burstBlocked := make(chan struct{})
+			go func() {
+				acquire(t, lanes, tc.burst)()
+				close(burstBlocked)
+			}()
+			expectBlocked(t, burstBlocked, "fetch in the saturated lane")
+			if n := inFlight.Load(); n != limit {
+				t.Fatalf("expected %d fetches in flight in the saturated lane; got %d", limit, n)
+			}
+
+			// ...so fetches in the other lane still get all of their slots.
+			otherDone := make(chan struct{})
+			go func() {
+				var releases []func()
+				for i := 0; i < limit; i++ {
+					releases = append(releases, acquire(t, lanes, tc.other))
+				}
+				for _, r := range releases {
+					r()
+				}
+				close(otherDone)
+			}()
+			waitFor(t, otherDone, "fetches in the other lane")
+
+			close(release)
+			waitFor(t, burstDone, "the burst to finish")
+			waitFor(t, burstBlocked, "fetch in the drained lane")
+		})
+	}
+}
+
+func TestReaderUsesFetchLanes(t *testing.T) {
+	r := testutil.NewTestRand(t)
+	contents := r.RandomByteData(1 << 10)
+	toc, sr, err := ztoc.BuildZtocReader(t, []testutil.TarEntry{testutil.File("test", string(contents))}, gzip.DefaultCompression, 64)
+	if err != nil {
+		t.Fatalf("failed to build sample ztoc: %v", err)
+	}
+	mr, err := metadata.NewTempDbStore(sr, toc.TOC)
+	if err != nil {
+		t.Fatalf("failed to create metadata reader: %v", err)
+	}
+	lanes := NewFetchLanes(1, 1)
+	spanManager := spanmanager.New(toc, sr, cache.NewMemoryCache(), 0)
+	gr, err := NewReader(mr, digest.FromString(""), spanManager, false, WithFetchLanes(lanes))
+	if err != nil {
+		mr.Close()
+		t.Fatalf("failed to make new reader: %v", err)
+	}
+	defer gr.Close()
+	id, _, err := mr.GetChild(mr.RootID(), "test")
+	if err != nil {
+		t.Fatalf("failed to get test file: %v", err)
+	}
+	f, err := gr.OpenFile(id)
+	if err != nil {
+		t.Fatalf("failed to open test file: %v", err)
+	}
+	read := func() <-chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p := make([]byte, len(contents))
+			if n, err := f.ReadAt(p, 0); err != nil || !bytes.Equal(p[:n], contents) {
+				t.Errorf("failed to read test file: %v", err)
+			}
+		}()
+		return done
+	}
+
+	// The first read verifies the file's tar header in the metadata lane. A read whose
+	// request is cancelled stops waiting for a slot.
+	releaseMetadata := acquire(t, lanes, metadataLane)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := f.(*file).ReadAtContext(ctx, make([]byte, len(contents)), 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a cancelled read to fail with %v; got %v", context.DeadlineExceeded, err)
+	}
+	done := read()
+	expectBlocked(t, done, "read while the metadata lane is full")
+	releaseMetadata()
+	waitFor(t, done, "read after the metadata lane is drained")
+
+	// Reads served from the cache don't need a slot in either lane.
+	releaseMetadata = acquire(t, lanes, metadataLane)
+	releaseData := acquire(t, lanes, dataLane)
+	defer releaseMetadata()
+	defer releaseData()
+	waitFor(t, read(), "cached read")
+}
@@ -40,6 +40,7 @@ package reader
 
 import (
 	"archive/tar"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -64,14 +65,28 @@ type Reader interface {
 	LastOnDemandReadTime() time.Time
 }
 
+// Option configures a Reader.
+type Option func(*reader)
+
+// WithFetchLanes limits the concurrent on-demand fetches of the reader with lanes.
+func WithFetchLanes(lanes *FetchLanes) Option {
+	return func(gr *reader) {
+		gr.fetchLanes = lanes
+	}
+}
+
 // NewReader creates a Reader based on the given soci blob and Span Manager.
-func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager, disableVerification bool) (Reader, error) {
-	return &reader{
+func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager, disableVerification bool, opts ...Option) (Reader, error) {
+	gr := &reader{
 		spanManager:         spanManager,
 		r:                   r,
 		layerSha:            layerSha,
 		disableVerification: disableVerification,
-	}, nil
+	}
+	for _, o := range opts {
+		o(gr)
+	}
+	return gr, nil
 }
 
 type reader struct {
@@ -86,6 +101,9 @@ type reader struct {
 	closedMu sync.Mutex
 
 	disableVerification bool
+
+	// fetchLanes limits concurrent on-demand fetches. It is nil if they are unlimited.
+	fetchLanes *FetchLanes
 }
 
 func (gr *reader) Metadata() metadata.Reader {
@@ -134,6 +152,20 @@ func (gr *reader) Close() (retErr error) {
 	return
 }
 
+// getContents returns the uncompressed contents between start and end. If any of
+// it must be fetched on demand, the fetch waits for a free slot in lane, unless
+// ctx is done first.
+func (gr *reader) getContents(ctx context.Context, lane fetchLane, start, end compression.Offset) (io.ReadCloser, error) {
+	if gr.fetchLanes != nil && !gr.spanManager.IsCached(start, end) {
+		release, err := gr.fetchLanes.acquire(ctx, lane)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+	return gr.spanManager.GetContents(start, end)
+}
+
 func (gr *reader) isClosed() bool {
 	gr.closedMu.Lock()
 	closed := gr.closed
@@ -151,8 +183,14 @@ type file struct {
 
 // ReadAt reads the file when the file is requested by the container
 func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
+	return sf.ReadAtContext(context.Background(), p, offset)
+}
+
+// ReadAtContext is ReadAt for a request bounded by ctx: on-demand fetches
+// stop waiting for a free fetch lane once ctx is done.
+func (sf *file) ReadAtContext(ctx context.Context, p []byte, offset int64) (int, error) {
 	if !sf.gr.disableVerification {
-		if err := sf.Verify(); err != nil {
+		if err := sf.verify(ctx); err != nil {
 			return 0, err
 		}
 	}
@@ -169,7 +207,7 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	}
 	fileOffsetStart := sf.fr.GetUncompressedOffset() + compression.Offset(offset)
 	fileOffsetEnd := fileOffsetStart + expectedSize
-	r, err := sf.gr.spanManager.GetContents(fileOffsetStart, fileOffsetEnd)
+	r, err := sf.gr.getContents(ctx, dataLane, fileOffsetStart, fileOffsetEnd)
 	if err != nil {
 		return 0, fmt.Errorf("failed to read the file: %w", err)
 	}
@@ -189,8 +227,25 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	return n, nil
 }
 
+// IsCached returns whether reading size bytes at offset can be served
+// from the local cache without fetching from the remote.
+func (sf *file) IsCached(offset int64, size int) bool {
+	uncompFileSize := sf.fr.GetUncompressedFileSize()
+	if size == 0 || compression.Offset(offset) >= uncompFileSize {
+		return true
+	}
+	end := min(compression.Offset(offset)+compression.Offset(size), uncompFileSize)
+	fileOffset := sf.fr.GetUncompressedOffset()
+	return sf.gr.spanManager.IsCached(fileOffset+compression.Offset(offset), fileOffset+end)
+}
+
 // Verify verifies that the file's attributes match the tar header in the image layer
-func (sf *file) Verify() (retErr error) {
+func (sf *file) Verify() error {
+	return sf.verify(context.Background())
+}
+
+// verify is Verify, with the fetch of the tar header bounded by ctx.
+func (sf *file) verify(ctx context.Context) (retErr error) {
 	if sf.verified.Load() {
 		return nil
 	}
@@ -215,7 +270,7 @@ func (sf *file) Verify() (retErr error) {
 	if sf.fr.TarHeaderSize() < 0 {
 		return fmt.Errorf("invalid tar header size: %d", sf.fr.TarHeaderSize())
 	}
-	tarHeaderReader, err := sf.gr.spanManager.GetContents(tarHeaderOffset, tarHeaderOffset+tarHeaderSize)
+	tarHeaderReader, err := sf.gr.getContents(ctx, metadataLane, tarHeaderOffset, tarHeaderOffset+tarHeaderSize)
 	if err != nil {
 		return err
 	}
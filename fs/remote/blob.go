@@ -45,6 +45,7 @@ import (
 	"regexp"
 
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/containerd/containerd/reference"
@@ -54,10 +55,24 @@ import (
 
 var contentRangeRegexp = regexp.MustCompile(`bytes ([0-9]+)-([0-9]+)/([0-9]+|\\*)`)
 
+// inFlightFetches is the number of blob regions being fetched from remote.
+var inFlightFetches atomic.Int64
+
+// InFlightFetches returns the number of blob regions currently being fetched from remote.
+func InFlightFetches() int64 {
+	return inFlightFetches.Load()
+}
+
 type Blob interface {
 	Check() error
 	Size() int64
 	FetchedSize() int64
+	// Fetched returns a channel that is closed once the whole blob is fetched.
+	Fetched() <-chan struct{}
+	// Host returns the registry host the blob is currently fetched from.
+	// It changes when the blob fails over to another host on Refresh.
+	// It is empty if the blob isn't fetched from a registry host.
+	Host() string
 	ReadAt(p []byte, offset int64, opts ...Option) (int, error)
 	Refresh(ctx context.Context, hosts []docker.RegistryHost, refspec reference.Spec, desc ocispec.Descriptor) error
 	Close() error
@@ -74,8 +89,14 @@ type blob struct {
 
 	fetchedRegionSet   regionSet
 	fetchedRegionSetMu sync.Mutex
+	// fetched is closed once fetchedRegionSet covers the whole blob.
+	fetched chan struct{}
 
 	resolver *Resolver
+	// local is the local copy of the blob, used if its host ignores ranged requests.
+	local *blobCopy
+	// coalescer coalesces the requests for nearby regions of the blob, if not nil.
+	coalescer *rangeCoalescer
 
 	closed   bool
 	closedMu sync.Mutex
@@ -83,13 +104,18 @@ type blob struct {
 
 func makeBlob(fetcher fetcher, size int64, lastCheck time.Time, checkInterval time.Duration,
 	r *Resolver) *blob {
-	return &blob{
+	b := &blob{
 		fetcher:       fetcher,
 		size:          size,
 		lastCheck:     lastCheck,
 		checkInterval: checkInterval,
 		resolver:      r,
+		fetched:       make(chan struct{}),
 	}
+	if size <= 0 {
+		close(b.fetched)
+	}
+	return b
 }
 
 func (b *blob) Close() error {
@@ -97,6 +123,12 @@ func (b *blob) Close() error {
 	defer b.closedMu.Unlock()
 	if !b.closed {
 		b.closed = true
+		if b.coalescer != nil {
+			b.coalescer.reset()
+		}
+		if b.local != nil {
+			return b.local.close()
+		}
 	}
 	return nil
 }
@@ -113,11 +145,7 @@ func (b *blob) Refresh(ctx context.Context, hosts []docker.RegistryHost, refspec
 		return fmt.Errorf("blob is already closed")
 	}
 	// refresh the fetcher
-	f, newSize, err := b.resolver.resolveFetcher(ctx, &fetcherConfig{
-		hosts:   hosts,
-		refspec: refspec,
-		desc:    desc,
-	})
+	f, newSize, err := b.resolver.resolveFetcher(ctx, b.resolver.newFetcherConfig(hosts, refspec, desc, b.local))
 	if err != nil {
 		return err
 	}
@@ -175,6 +203,16 @@ func (b *blob) FetchedSize() int64 {
 	return sz
 }
 
+func (b *blob) Fetched() <-chan struct{} {
+	return b.fetched
+}
+
+func (b *blob) Host() string {
+	b.fetcherMu.Lock()
+	defer b.fetcherMu.Unlock()
+	return b.fetcher.host()
+}
+
 // ReadAt reads remote blob from specified offset for the buffer size.
 // We can configure this function with options.
 func (b *blob) ReadAt(p []byte, offset int64, opts ...Option) (int, error) {
@@ -182,11 +220,12 @@ func (b *blob) ReadAt(p []byte, offset int64, opts ...Option) (int, error) {
 		return 0, fmt.Errorf("blob is already closed")
 	}
 
-	if len(p) == 0 || offset > b.size {
+	if len(p) == 0 || offset >= b.size {
 		return 0, nil
 	}
 
-	reg := region{offset, offset + int64(len(p)) - 1}
+	// Regions are inclusive and must not extend past the last byte of the blob.
+	reg := region{offset, min(offset+int64(len(p)), b.size) - 1}
 
 	var readAtOpts options
 	for _, o := range opts {
@@ -251,6 +290,13 @@ func (b *blob) fetchRegion(reg region, w io.Writer, fetched bool, opts *options)
 
 		b.fetchedRegionSetMu.Lock()
 		b.fetchedRegionSet.add(reg)
+		if b.fetchedRegionSet.totalSize() >= b.size {
+			select {
+			case <-b.fetched:
+			default:
+				close(b.fetched)
+			}
+		}
 		b.fetchedRegionSetMu.Unlock()
 		fetched = true
 	}
@@ -264,7 +310,23 @@ func (b *blob) fetchRegion(reg region, w io.Writer, fetched bool, opts *options)
 
 // fetchRange fetches content from remote blob.
 func (b *blob) fetchRange(reg region, w io.Writer, opts *options) error {
-	return b.fetchRegion(reg, w, false, opts)
+	inFlightFetches.Add(1)
+	defer inFlightFetches.Add(-1)
+	if b.coalescer == nil {
+		return b.fetchRegion(reg, w, false, opts)
+	}
+	data, err := b.coalescer.fetch(reg, b.size, func(span region) ([]byte, error) {
+		buf := make([]byte, span.size())
+		if err := b.fetchRegion(span, newBytesWriter(buf, 0), false, opts); err != nil {
+			return nil, err
+		}
+		return buf, nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
 }
 
 func newBytesWriter(dest []byte, destOff int64) io.Writer {
@@ -0,0 +1,161 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// blobCopy is the local copy of a blob whose host ignores ranged requests. When the whole
+// blob is small enough to be sliced, it is downloaded once and later ranges are read out
+// of the copy instead of downloading the blob again for each of them.
+// The copy is an unlinked file in dir, so it's removed once the copy is closed.
+type blobCopy struct {
+	dir    string
+	digest digest.Digest
+
+	mu sync.Mutex
+	// done is closed once the download of the copy completes. It's nil if no download started.
+	done   chan struct{}
+	file   *os.File
+	size   int64
+	err    error
+	closed bool
+}
+
+// errNotCopied is returned by the functions opening the blob to download
+// when the blob must not be copied, e.g. because it's too large.
+var errNotCopied = errors.New("blob is not copied")
+
+func newBlobCopy(dir string, dgst digest.Digest) *blobCopy {
+	return &blobCopy{dir: dir, digest: dgst}
+}
+
+// load returns the reader of the regions rs out of the copy. Unless the copy is downloaded
+// or being downloaded, which is waited for, the whole blob is opened with open and copied.
+// It returns nil if the blob isn't copied because open returned errNotCopied.
+func (c *blobCopy) load(ctx context.Context, rs []region, open func() (io.ReadCloser, error)) (multipartReadCloser, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("blob %s is already closed", c.digest)
+	}
+	if c.done == nil || c.failed() {
+		done := make(chan struct{})
+		c.done, c.err = done, nil
+		c.mu.Unlock()
+
+		file, size, err := c.download(open)
+
+		c.mu.Lock()
+		if err == nil && c.closed {
+			// The blob was closed during the download.
+			file.Close()
+			file, err = nil, fmt.Errorf("blob %s is already closed", c.digest)
+		}
+		c.file, c.size, c.err = file, size, err
+		close(done)
+	} else {
+		done := c.done
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	defer c.mu.Unlock()
+	if errors.Is(c.err, errNotCopied) {
+		return nil, nil
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.file == nil {
+		return nil, fmt.Errorf("blob %s is already closed", c.digest)
+	}
+	first := rs[0].b
+	return &slicingReader{
+		r:      io.NewSectionReader(c.file, first, max(c.size-first, 0)),
+		Closer: io.NopCloser(nil),
+		rs:     rs,
+		offset: first,
+	}, nil
+}
+
+// failed returns whether the download of the copy completed and failed in a way
+// that may not happen again. c.mu must be held.
+func (c *blobCopy) failed() bool {
+	select {
+	case <-c.done:
+		return c.err != nil && !errors.Is(c.err, errNotCopied)
+	default:
+		return false
+	}
+}
+
+// download copies the blob opened with open to an unlinked file in c.dir and returns the
+// file and the size of the blob. It fails if the blob doesn't match its digest.
+func (c *blobCopy) download(open func() (io.ReadCloser, error)) (*os.File, int64, error) {
+	body, err := open()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer body.Close()
+	if c.dir != "" {
+		if err := os.MkdirAll(c.dir, 0700); err != nil {
+			return nil, 0, fmt.Errorf("failed to create local copy of blob %s: %w", c.digest, err)
+		}
+	}
+	file, err := os.CreateTemp(c.dir, "blob-")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create local copy of blob %s: %w", c.digest, err)
+	}
+	// The file is only accessed through its descriptor.
+	os.Remove(file.Name())
+	verifier := c.digest.Verifier()
+	size, err := io.Copy(io.MultiWriter(file, verifier), body)
+	if err == nil && !verifier.Verified() {
+		err = fmt.Errorf("%w: local copy of blob %s doesn't match its digest", ErrCorruptRangedResponse, c.digest)
+	}
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to download local copy of blob %s: %w", c.digest, err)
+	}
+	return file, size, nil
+}
+
+// close removes the copy. Readers of the copy fail once it's closed.
+func (c *blobCopy) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
@@ -40,6 +40,7 @@ package remote
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"mime"
@@ -158,7 +159,109 @@ func checkRead(t *testing.T, wantData []byte, r *blob, offset int64, wantSize in
 	}
 }
 
+// Tests that degenerate reads don't send requests beyond the requested bytes.
+func TestDegenerateReadAt(t *testing.T) {
+	size := int64(len(sampleData1))
+	testCases := []struct {
+		name          string
+		offset        int64
+		length        int
+		expected      string
+		expectedRange string
+	}{
+		{
+			name:   "zero length",
+			offset: 0,
+			length: 0,
+		},
+		{
+			name:   "zero length at EOF",
+			offset: size,
+			length: 0,
+		},
+		{
+			name:          "1 byte at offset 0",
+			offset:        0,
+			length:        1,
+			expected:      sampleData1[:1],
+			expectedRange: "bytes=0-0",
+		},
+		{
+			name:          "1 byte at EOF",
+			offset:        size - 1,
+			length:        1,
+			expected:      sampleData1[size-1:],
+			expectedRange: fmt.Sprintf("bytes=%d-%d", size-1, size-1),
+		},
+		{
+			name:   "1 byte past EOF",
+			offset: size,
+			length: 1,
+		},
+		{
+			name:          "read across EOF",
+			offset:        size - 2,
+			length:        4,
+			expected:      sampleData1[size-2:],
+			expectedRange: fmt.Sprintf("bytes=%d-%d", size-2, size-1),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var ranges []string
+			tr := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(false))
+			r := makeTestBlob(t, size, func(req *http.Request) *http.Response {
+				ranges = append(ranges, req.Header.Get("Range"))
+				return tr(req)
+			})
+			p := make([]byte, tc.length)
+			n, err := r.ReadAt(p, tc.offset)
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if got := string(p[:n]); got != tc.expected {
+				t.Fatalf("expected %q; got %q", tc.expected, got)
+			}
+			var expectedRanges []string
+			if tc.expectedRange != "" {
+				expectedRanges = []string{tc.expectedRange}
+			}
+			if fmt.Sprint(ranges) != fmt.Sprint(expectedRanges) {
+				t.Fatalf("expected requests for %v; got %v", expectedRanges, ranges)
+			}
+		})
+	}
+}
+
 // Tests ReadAt method for failure cases.
+func TestFetched(t *testing.T) {
+	data := []byte(sampleData1)
+	b := makeTestBlob(t, int64(len(data)), multiRoundTripper(t, data))
+	half := int64(len(data) / 2)
+	isFetched := func() bool {
+		select {
+		case <-b.Fetched():
+			return true
+		default:
+			return false
+		}
+	}
+
+	checkRead(t, data[half:], b, half, int64(len(data))-half)
+	if isFetched() {
+		t.Fatalf("expected the blob to not be fetched after reading its second half")
+	}
+	// Reading again a fetched region doesn't complete the blob.
+	checkRead(t, data[half:], b, half, int64(len(data))-half)
+	if isFetched() {
+		t.Fatalf("expected the blob to not be fetched after reading its second half again")
+	}
+	checkRead(t, data[:half], b, 0, half)
+	if !isFetched() {
+		t.Fatalf("expected the blob to be fetched after reading all of it")
+	}
+}
+
 func TestFailReadAt(t *testing.T) {
 
 	// test failed http respose.
@@ -179,6 +282,94 @@ func TestFailReadAt(t *testing.T) {
 	checkBrokenHeader(t, false) // with prohibiting multi range
 }
 
+// Tests that ranged responses altered by a proxy are treated as corrupt fetches.
+func TestRangeLengthCheck(t *testing.T) {
+	padBody := func(res *http.Response, updateLength bool) {
+		data, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("failed to read body: %v", err)
+		}
+		data = append(data, "padding"...)
+		res.Body = io.NopCloser(bytes.NewReader(data))
+		if updateLength {
+			res.Header.Set("Content-Length", strconv.Itoa(len(data)))
+		}
+	}
+	testCases := []struct {
+		name      string
+		alter     func(res *http.Response)
+		skipCheck bool
+		expectErr bool
+	}{
+		{
+			name:  "unaltered response",
+			alter: func(res *http.Response) {},
+		},
+		{
+			name:      "proxy pads body and updates Content-Length",
+			alter:     func(res *http.Response) { padBody(res, true) },
+			expectErr: true,
+		},
+		{
+			name: "proxy truncates body without updating Content-Length",
+			alter: func(res *http.Response) {
+				data, _ := io.ReadAll(res.Body)
+				res.Body = io.NopCloser(bytes.NewReader(data[:len(data)-1]))
+			},
+			expectErr: true,
+		},
+		{
+			name: "proxy strips Content-Length and pads body",
+			alter: func(res *http.Response) {
+				padBody(res, false)
+				res.Header.Del("Content-Length")
+			},
+			expectErr: true,
+		},
+		{
+			name:      "proxy declares an encoding",
+			alter:     func(res *http.Response) { res.Header.Set("Content-Encoding", "gzip") },
+			expectErr: true,
+		},
+		{
+			name:      "check disabled",
+			alter:     func(res *http.Response) { padBody(res, true) },
+			skipCheck: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(false))
+			r := makeTestBlob(t, int64(len(sampleData1)), func(req *http.Request) *http.Response {
+				res := tr(req)
+				if res.StatusCode == http.StatusPartialContent {
+					tc.alter(res)
+				}
+				return res
+			})
+			r.fetcher.(*httpFetcher).skipRangeLengthCheck = tc.skipCheck
+
+			respData := make([]byte, sampleChunkSize)
+			_, err := r.ReadAt(respData, 1)
+			if tc.expectErr {
+				if !errors.Is(err, ErrCorruptRangedResponse) {
+					t.Fatalf("expected %v; got %v", ErrCorruptRangedResponse, err)
+				}
+				if r.FetchedSize() != 0 {
+					t.Fatalf("corrupt fetch must not be recorded as fetched")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if want := sampleData1[1 : 1+sampleChunkSize]; string(respData) != want {
+				t.Fatalf("expected %q; got %q", want, respData)
+			}
+		})
+	}
+}
+
 func checkBrokenBody(t *testing.T, allowMultiRange bool) {
 	respData := make([]byte, len(sampleData1))
 	r := makeTestBlob(t, int64(len(sampleData1)), brokenBodyRoundTripper(t, []byte(sampleData1), allowMultiRange))
@@ -265,7 +456,8 @@ func TestParallelDownloadingBehavior(t *testing.T) {
 					realURL:      "test",
 					roundTripper: tr,
 				},
-				size: int64(len(tst.content)),
+				size:    int64(len(tst.content)),
+				fetched: make(chan struct{}),
 			}
 		)
 
@@ -16,7 +16,10 @@
 
 package remote
 
-import "errors"
+import (
+	"errors"
+	"slices"
+)
 
 var (
 	ErrUnexpectedStatusCode      = errors.New("unexpected status code")
@@ -30,4 +33,27 @@ var (
 	ErrCannotParseContentType    = errors.New("failed to parse Content-Type header")
 	ErrFailedToRefreshURL        = errors.New("failed to refresh URL")
 	ErrRequestFailed             = errors.New("request to registry failed")
+	ErrCorruptRangedResponse     = errors.New("ranged response does not match requested range")
+	ErrRangeOutOfBounds          = errors.New("requested range is out of the bounds of the blob")
+	ErrUnexpectedContentType     = errors.New("unexpected Content-Type for blob data")
+	ErrRangesIgnored             = errors.New("registry host ignores ranged requests")
 )
+
+// HeaderStatusError is returned by GetHeader and GetHeaderWithGet when none of their
+// requests for the header of a blob are answered with a 200 or 206.
+type HeaderStatusError struct {
+	// StatusCodes are the statuses of the requests, in order.
+	StatusCodes []int
+	msg         string
+}
+
+func (e *HeaderStatusError) Error() string {
+	return e.msg
+}
+
+// ServerError returns whether a request was answered with a 5xx.
+func (e *HeaderStatusError) ServerError() bool {
+	return slices.ContainsFunc(e.StatusCodes, func(code int) bool {
+		return code >= 500
+	})
+}
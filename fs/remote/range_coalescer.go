@@ -0,0 +1,118 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"sync"
+)
+
+// rangeCoalescer coalesces the requests for nearby regions of a blob into a single upstream
+// request. A region that isn't covered by the span last fetched for the blob is fetched
+// along with the window bytes that follow it, and the regions that fall within them are
+// sliced from the fetched data rather than requested again.
+//
+// Only the window bytes that follow the last fetched region are retained once its fetch
+// completes, so a blob retains at most window bytes.
+type rangeCoalescer struct {
+	window int64
+
+	mu   sync.Mutex
+	span *coalescedSpan
+}
+
+// coalescedSpan is a region of a blob fetched for the requests it covers.
+type coalescedSpan struct {
+	region
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newRangeCoalescer(window int64) *rangeCoalescer {
+	return &rangeCoalescer{window: window}
+}
+
+// fetch returns the region reg of a blob of size bytes, fetching spans with fetch.
+// If the fetch of the span covering reg fails, reg is fetched again.
+func (c *rangeCoalescer) fetch(reg region, size int64, fetch func(region) ([]byte, error)) ([]byte, error) {
+	for {
+		c.mu.Lock()
+		span := c.span
+		if span == nil || !span.covers(reg) {
+			span = &coalescedSpan{
+				region: region{reg.b, min(reg.e+c.window, size-1)},
+				done:   make(chan struct{}),
+			}
+			c.span = span
+			c.mu.Unlock()
+			c.fetchSpan(span, reg, fetch)
+			return span.slice(reg)
+		}
+		c.mu.Unlock()
+
+		<-span.done
+		if span.err == nil {
+			return span.slice(reg)
+		}
+	}
+}
+
+// fetchSpan fetches span for reg. Once the span is fetched, only the bytes that follow
+// reg are retained for later regions; the span is forgotten if the fetch fails.
+func (c *rangeCoalescer) fetchSpan(span *coalescedSpan, reg region, fetch func(region) ([]byte, error)) {
+	span.data, span.err = fetch(span.region)
+	close(span.done)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.span != span {
+		return
+	}
+	c.span = nil
+	if span.err != nil || reg.e >= span.e {
+		return
+	}
+	done := make(chan struct{})
+	close(done)
+	c.span = &coalescedSpan{
+		region: region{reg.e + 1, span.e},
+		done:   done,
+		// The tail is copied so that the data of the whole span can be freed.
+		data: bytes.Clone(span.data[reg.e+1-span.b:]),
+	}
+}
+
+// reset forgets the retained span.
+func (c *rangeCoalescer) reset() {
+	c.mu.Lock()
+	c.span = nil
+	c.mu.Unlock()
+}
+
+// slice returns the region reg of the fetched span.
+func (s *coalescedSpan) slice(reg region) ([]byte, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	return s.data[reg.b-s.b : reg.e-s.b+1], nil
+}
+
+// covers returns whether reg is within the span.
+func (s *coalescedSpan) covers(reg region) bool {
+	return s.b <= reg.b && reg.e <= s.e
+}
@@ -0,0 +1,74 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestReadAtCoalescing(t *testing.T) {
+	const window = 20
+	contents := make([]byte, 100)
+	for i := range contents {
+		contents[i] = byte(i)
+	}
+	var ranges []string
+	tr := multiRoundTripper(t, contents)
+	b := makeTestBlob(t, int64(len(contents)), func(req *http.Request) *http.Response {
+		ranges = append(ranges, req.Header.Get("Range"))
+		return tr(req)
+	})
+	b.coalescer = newRangeCoalescer(window)
+
+	read := func(offset, size int64) {
+		t.Helper()
+		p := make([]byte, size)
+		if _, err := b.ReadAt(p, offset); err != nil {
+			t.Fatalf("failed to read %d bytes at %d: %v", size, offset, err)
+		}
+		if !bytes.Equal(p, contents[offset:offset+size]) {
+			t.Fatalf("unexpected contents of %d bytes at %d: %v", size, offset, p)
+		}
+	}
+
+	// The second read starts within the window of the first one.
+	read(0, 10)
+	read(15, 5)
+	expected := []string{"bytes=0-29"}
+	if !slices.Equal(ranges, expected) {
+		t.Fatalf("expected requests for %v; got %v", expected, ranges)
+	}
+	// Only the window following the last read is retained.
+	if span := b.coalescer.span; span == nil || span.region != (region{10, 29}) || len(span.data) != 20 {
+		t.Fatalf("expected the bytes following the last read to be retained; got %+v", span)
+	}
+
+	// A read past the window is requested again, and the window is bounded by the blob.
+	read(90, 5)
+	expected = append(expected, "bytes=90-99")
+	if !slices.Equal(ranges, expected) {
+		t.Fatalf("expected requests for %v; got %v", expected, ranges)
+	}
+
+	b.Close()
+	if b.coalescer.span != nil {
+		t.Fatalf("expected the retained span to be released on close")
+	}
+}
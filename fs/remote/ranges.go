@@ -0,0 +1,137 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/config"
+)
+
+// hostRanges remembers which registry hosts ignore ranged requests, i.e. answer them
+// with the whole blob even though they may advertise "Accept-Ranges: bytes". Whether a
+// host honors ranges is learned from its answers to ranged requests that don't cover the
+// whole blob, and is shared by the fetchers of all blobs.
+type hostRanges struct {
+	// exclude makes fetchers stop fetching from hosts ignoring ranges,
+	// instead of slicing ranges out of whole blobs.
+	exclude bool
+	// maxSlice is the number of bytes of a whole blob that may be read to slice a range out of it.
+	maxSlice int64
+
+	mu      sync.Mutex
+	ignored map[string]bool
+}
+
+func newHostRanges(cfg config.BlobConfig) *hostRanges {
+	maxSlice := cfg.MaxIgnoredRangeSliceBytes
+	if maxSlice <= 0 {
+		maxSlice = defaultMaxIgnoredRangeSliceBytes
+	}
+	return &hostRanges{
+		exclude:  cfg.IgnoredRangeAction == config.IgnoredRangeActionExclude,
+		maxSlice: maxSlice,
+		ignored:  make(map[string]bool),
+	}
+}
+
+// defaultMaxIgnoredRangeSliceBytes bounds slicing for fetchers created without a config.
+const defaultMaxIgnoredRangeSliceBytes = 64 << 20
+
+// record records whether host honored a ranged request and returns
+// whether this changed what is known about the host.
+func (h *hostRanges) record(host string, honored bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ignored, known := h.ignored[host]
+	h.ignored[host] = !honored
+	return !known || ignored == honored
+}
+
+// ignores returns whether host is known to ignore ranged requests.
+func (h *hostRanges) ignores(host string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ignored[host]
+}
+
+// excluded returns whether blobs must not be fetched from host.
+func (h *hostRanges) excluded(host string) bool {
+	return h.exclude && h.ignores(host)
+}
+
+// checkSlice returns an error if reg can't be sliced out of a whole blob.
+func (h *hostRanges) checkSlice(host string, reg region) error {
+	if h.exclude {
+		return fmt.Errorf("%w: %s", ErrRangesIgnored, host)
+	}
+	if reg.e >= h.maxSlice {
+		return fmt.Errorf("%w: %s: range %d-%d is beyond the %d bytes that may be sliced out of the blob",
+			ErrRangesIgnored, host, reg.b, reg.e, h.maxSlice)
+	}
+	return nil
+}
+
+// newSlicingReader returns a multipartReadCloser reading the sorted, non-overlapping
+// regions rs out of rc, the body of a response containing the whole blob.
+func newSlicingReader(rc io.ReadCloser, rs []region) multipartReadCloser {
+	return &slicingReader{
+		r:      rc,
+		Closer: rc,
+		rs:     rs,
+	}
+}
+
+type slicingReader struct {
+	io.Closer
+	r io.Reader
+	// rs are the regions that aren't returned yet.
+	rs []region
+	// offset is the offset in the blob of the next byte of r.
+	offset int64
+	// part is the reader of the last returned region.
+	part *io.LimitedReader
+}
+
+func (sr *slicingReader) Next() (region, io.Reader, error) {
+	if sr.part != nil {
+		// Skip what the caller didn't read of the last region.
+		if _, err := io.Copy(io.Discard, sr.part); err != nil {
+			return region{}, nil, err
+		}
+		if sr.part.N > 0 {
+			return region{}, nil, fmt.Errorf("%w: blob ended at %d", ErrCorruptRangedResponse, sr.offset-sr.part.N)
+		}
+		sr.part = nil
+	}
+	if len(sr.rs) == 0 {
+		return region{}, nil, io.EOF
+	}
+	reg := sr.rs[0]
+	sr.rs = sr.rs[1:]
+	n, err := io.CopyN(io.Discard, sr.r, reg.b-sr.offset)
+	sr.offset += n
+	if err != nil {
+		return region{}, nil, fmt.Errorf("%w: blob ended at %d before range %d-%d", ErrCorruptRangedResponse, sr.offset, reg.b, reg.e)
+	}
+	// The offset is past the region once the caller read it or it's skipped.
+	sr.offset = reg.e + 1
+	sr.part = &io.LimitedReader{R: sr.r, N: reg.size()}
+	return reg, sr.part, nil
+}
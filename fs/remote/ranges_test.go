@@ -0,0 +1,203 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// rangeIgnoringRoundTripper advertises range support but answers
+// every request to the hosts in ignoring with the whole blob.
+func rangeIgnoringRoundTripper(blob []byte, ignoring string, requests map[string]int) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requests[req.URL.Host]++
+		header := make(http.Header)
+		header.Set("Accept-Ranges", "bytes")
+		status := http.StatusOK
+		body := blob
+		if req.URL.Host != ignoring {
+			var b, e int64
+			if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-%d", &b, &e); err != nil {
+				return nil, err
+			}
+			status = http.StatusPartialContent
+			body = blob[b : e+1]
+			header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", b, e, len(blob)))
+		}
+		header.Set("Content-Length", fmt.Sprint(len(body)))
+		return &http.Response{
+			StatusCode: status,
+			Header:     header,
+			Body:       io.NopCloser(bytes.NewReader(body)),
+			Request:    req,
+		}, nil
+	})
+}
+
+func TestIgnoredRanges(t *testing.T) {
+	const (
+		blobSize = 100
+		mirror   = "mirror.example.com"
+	)
+	blob := make([]byte, blobSize)
+	for i := range blob {
+		blob[i] = byte(i)
+	}
+	newFetcher := func(tr http.RoundTripper, action string) *httpFetcher {
+		return &httpFetcher{
+			roundTripper: tr,
+			registryHost: mirror,
+			registryURL:  "https://" + mirror + "/v2/test/blobs/sha256:dummy",
+			realURL:      "https://" + mirror + "/v2/test/blobs/sha256:dummy",
+			ranges: newHostRanges(config.BlobConfig{
+				IgnoredRangeAction:        action,
+				MaxIgnoredRangeSliceBytes: 64,
+			}),
+		}
+	}
+
+	t.Run("slice", func(t *testing.T) {
+		requests := make(map[string]int)
+		f := newFetcher(rangeIgnoringRoundTripper(blob, mirror, requests), config.IgnoredRangeActionSlice)
+
+		regions := []region{{10, 19}, {30, 39}}
+		mr, err := f.fetch(context.Background(), regions, true)
+		if err != nil {
+			t.Fatalf("failed to fetch: %v", err)
+		}
+		for _, expected := range regions {
+			reg, p, err := mr.Next()
+			if err != nil {
+				t.Fatalf("failed to read region %v: %v", expected, err)
+			}
+			if reg != expected {
+				t.Fatalf("expected region %v; got %v", expected, reg)
+			}
+			data, err := io.ReadAll(p)
+			if err != nil {
+				t.Fatalf("failed to read region %v: %v", reg, err)
+			}
+			if !bytes.Equal(data, blob[reg.b:reg.e+1]) {
+				t.Fatalf("expected region %v to be sliced out of the blob; got %v", reg, data)
+			}
+		}
+		if _, _, err := mr.Next(); err != io.EOF {
+			t.Fatalf("expected no more regions; got %v", err)
+		}
+		mr.Close()
+		if !f.ranges.ignores(mirror) {
+			t.Fatalf("expected %s to be known to ignore ranges", mirror)
+		}
+
+		// Once the host is known to ignore ranges, regions beyond the slicing
+		// bound fail without downloading the blob again.
+		if _, err := f.fetch(context.Background(), []region{{70, 79}}, true); !errors.Is(err, ErrRangesIgnored) {
+			t.Fatalf("expected %v; got %v", ErrRangesIgnored, err)
+		}
+		if requests[mirror] != 1 {
+			t.Fatalf("expected 1 request to %s; got %d", mirror, requests[mirror])
+		}
+	})
+
+	t.Run("copy", func(t *testing.T) {
+		// The blob can be sliced as a whole, so it's downloaded once
+		// and later regions are read out of its local copy.
+		small := blob[:50]
+		requests := make(map[string]int)
+		f := newFetcher(rangeIgnoringRoundTripper(small, mirror, requests), config.IgnoredRangeActionSlice)
+		f.local = newBlobCopy(t.TempDir(), digest.FromBytes(small))
+		defer f.local.close()
+
+		for _, reg := range []region{{10, 19}, {40, 49}, {0, 4}} {
+			mr, err := f.fetch(context.Background(), []region{reg}, true)
+			if err != nil {
+				t.Fatalf("failed to fetch region %v: %v", reg, err)
+			}
+			got, p, err := mr.Next()
+			if err != nil {
+				t.Fatalf("failed to read region %v: %v", reg, err)
+			}
+			if got != reg {
+				t.Fatalf("expected region %v; got %v", reg, got)
+			}
+			data, err := io.ReadAll(p)
+			if err != nil {
+				t.Fatalf("failed to read region %v: %v", reg, err)
+			}
+			if !bytes.Equal(data, small[reg.b:reg.e+1]) {
+				t.Fatalf("expected region %v to be read out of the blob; got %v", reg, data)
+			}
+			mr.Close()
+		}
+		if requests[mirror] != 1 {
+			t.Fatalf("expected the blob to be downloaded once; got %d requests to %s", requests[mirror], mirror)
+		}
+	})
+
+	t.Run("exclude", func(t *testing.T) {
+		requests := make(map[string]int)
+		tr := rangeIgnoringRoundTripper(blob, mirror, requests)
+		f := newFetcher(tr, config.IgnoredRangeActionExclude)
+
+		if _, err := f.fetch(context.Background(), []region{{10, 19}}, true); !errors.Is(err, ErrRangesIgnored) {
+			t.Fatalf("expected %v; got %v", ErrRangesIgnored, err)
+		}
+		if err := f.check(); !errors.Is(err, ErrRangesIgnored) {
+			t.Fatalf("expected check to fail with %v; got %v", ErrRangesIgnored, err)
+		}
+
+		// New fetchers skip the excluded host.
+		refspec, err := reference.Parse("registry.example.com/test:latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hosts []docker.RegistryHost
+		for _, host := range []string{mirror, refspec.Hostname()} {
+			hosts = append(hosts, docker.RegistryHost{
+				Client:       &http.Client{Transport: tr},
+				Host:         host,
+				Scheme:       "https",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityPull,
+			})
+		}
+		hf, err := newHTTPFetcher(context.Background(), &fetcherConfig{
+			hosts:   hosts,
+			refspec: refspec,
+			desc:    ocispec.Descriptor{Digest: digest.FromBytes(blob), Size: blobSize},
+			ranges:  f.ranges,
+		})
+		if err != nil {
+			t.Fatalf("failed to create fetcher: %v", err)
+		}
+		if host := hf.host(); host != refspec.Hostname() {
+			t.Fatalf("expected blob to be fetched from %s; got %q", refspec.Hostname(), host)
+		}
+	})
+}
@@ -56,6 +56,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/cache"
 	"github.com/awslabs/soci-snapshotter/config"
 	commonmetrics "github.com/awslabs/soci-snapshotter/fs/metrics/common"
+	"github.com/awslabs/soci-snapshotter/internal/audit"
 	socihttp "github.com/awslabs/soci-snapshotter/internal/http"
 	"github.com/awslabs/soci-snapshotter/service/resolver"
 	"github.com/containerd/containerd/reference"
@@ -70,6 +71,8 @@ type fetcher interface {
 	fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error)
 	check() error
 	genID(reg region) string
+	// host returns the registry host the fetcher fetches from, if any.
+	host() string
 }
 type Handler interface {
 	Handle(ctx context.Context, desc ocispec.Descriptor) (fetcher Fetcher, size int64, err error)
@@ -83,17 +86,62 @@ type fetcherConfig struct {
 	maxRetries   int
 	minWait      time.Duration
 	maxWait      time.Duration
+	// skipContentTypeCheck accepts blob responses with an HTML Content-Type.
+	skipContentTypeCheck bool
+	// ranges skips the hosts excluded for ignoring ranged requests.
+	ranges *hostRanges
+	// local is the local copy of the blob, used if its host ignores ranged requests.
+	local *blobCopy
+	// repositoryPrefixes maps host names to the prefixes of the repositories of images on the hosts.
+	repositoryPrefixes map[string]string
+	// headBeforeGet sends a HEAD request for the blob to each host before any GET.
+	headBeforeGet bool
 }
 
 type Resolver struct {
 	blobConfig config.BlobConfig
 	handlers   map[string]Handler
+	// ranges remembers the hosts ignoring ranged requests.
+	ranges *hostRanges
+	// copyDir is the directory of the local copies of blobs whose host ignores ranged requests.
+	copyDir string
+	// coalesceWindow is how many bytes following a region of a blob are fetched along
+	// with it for later regions. Requests aren't coalesced if it isn't positive.
+	coalesceWindow int64
+	// repositoryPrefixes maps host names to the prefixes of the repositories of images
+	// on the hosts, e.g. "cache/docker.io" for pull-through caches.
+	repositoryPrefixes map[string]string
 }
 
-func NewResolver(cfg config.BlobConfig, handlers map[string]Handler) *Resolver {
+// NewResolver returns a new blob resolver. Local copies of blobs whose host
+// ignores ranged requests are kept in copyDir. Requests for regions of a blob
+// within coalesceWindow bytes of each other are coalesced, if it's positive.
+// Blobs are fetched from the repositories of images prefixed on each host by
+// repositoryPrefixes, if any.
+func NewResolver(copyDir string, cfg config.BlobConfig, handlers map[string]Handler, coalesceWindow int64, repositoryPrefixes map[string]string) *Resolver {
 	return &Resolver{
-		blobConfig: cfg,
-		handlers:   handlers,
+		blobConfig:         cfg,
+		handlers:           handlers,
+		ranges:             newHostRanges(cfg),
+		copyDir:            copyDir,
+		coalesceWindow:     coalesceWindow,
+		repositoryPrefixes: repositoryPrefixes,
+	}
+}
+
+// newFetcherConfig returns the config of a fetcher of the blob desc on hosts, whose local
+// copy is local, with the settings of r. Resolve and Refresh both build fetchers from it.
+func (r *Resolver) newFetcherConfig(hosts []docker.RegistryHost, refspec reference.Spec, desc ocispec.Descriptor, local *blobCopy) *fetcherConfig {
+	return &fetcherConfig{
+		hosts:   hosts,
+		refspec: refspec,
+		desc:    desc,
+
+		skipContentTypeCheck: r.blobConfig.DisableContentTypeCheck,
+		ranges:               r.ranges,
+		local:                local,
+		repositoryPrefixes:   r.repositoryPrefixes,
+		headBeforeGet:        r.blobConfig.HeadBeforeGet,
 	}
 }
 
@@ -105,27 +153,29 @@ func (r *Resolver) Resolve(ctx context.Context, hosts []docker.RegistryHost, ref
 		minWait       = time.Duration(r.blobConfig.MinWaitMsec) * time.Millisecond
 		maxWait       = time.Duration(r.blobConfig.MaxWaitMsec) * time.Millisecond
 		maxRetries    = r.blobConfig.MaxRetries
+		local         = newBlobCopy(r.copyDir, desc.Digest)
 	)
 
-	f, size, err := r.resolveFetcher(ctx, &fetcherConfig{
-		hosts:        hosts,
-		refspec:      refspec,
-		desc:         desc,
-		fetchTimeout: fetchTimeout,
-		maxRetries:   maxRetries,
-		minWait:      minWait,
-		maxWait:      maxWait,
-	})
+	fc := r.newFetcherConfig(hosts, refspec, desc, local)
+	fc.fetchTimeout = fetchTimeout
+	fc.maxRetries = maxRetries
+	fc.minWait = minWait
+	fc.maxWait = maxWait
+	f, size, err := r.resolveFetcher(ctx, fc)
 	if err != nil {
 		return nil, err
 	}
-	return makeBlob(
-			f,
-			size,
-			time.Now(),
-			validInterval,
-			r),
-		nil
+	b := makeBlob(
+		f,
+		size,
+		time.Now(),
+		validInterval,
+		r)
+	b.local = local
+	if r.coalesceWindow > 0 {
+		b.coalescer = newRangeCoalescer(r.coalesceWindow)
+	}
+	return b, nil
 }
 
 func (r *Resolver) resolveFetcher(ctx context.Context, fc *fetcherConfig) (f fetcher, size int64, err error) {
@@ -164,12 +214,15 @@ func (r *Resolver) resolveFetcher(ctx context.Context, fc *fetcherConfig) (f fet
 	if r.blobConfig.ForceSingleRangeMode {
 		hf.singleRangeMode()
 	}
+	hf.skipRangeLengthCheck = r.blobConfig.DisableRangeLengthCheck
 	return hf, fc.desc.Size, err
 }
 
 type httpFetcher struct {
 	roundTripper http.RoundTripper
 	scope        string
+	// registryHost is the host of the registry or mirror the blob is fetched from.
+	registryHost string
 	// registryURL is the distribution spec compliant blob URL.
 	registryURL string
 	// realURL is the real blob URL. For registries, with single storage
@@ -179,6 +232,23 @@ type httpFetcher struct {
 	digest        digest.Digest
 	singleRange   bool
 	singleRangeMu sync.Mutex
+	// skipRangeLengthCheck disables verifying that ranged response bodies
+	// have the length of the range they claim to contain.
+	skipRangeLengthCheck bool
+	// skipContentTypeCheck disables rejecting responses with an HTML Content-Type.
+	skipContentTypeCheck bool
+	// headBeforeGet makes the fetcher learn the size of the blob with a HEAD
+	// request before its first ranged GET, and validate ranges against it.
+	headBeforeGet bool
+	sizeMu        sync.Mutex
+	// headSent is whether the HEAD request was sent.
+	headSent bool
+	// headSize is the size of the blob reported by the HEAD request, or -1 if unknown.
+	headSize int64
+	// ranges remembers the hosts ignoring ranged requests.
+	ranges *hostRanges
+	// local is the local copy of the blob, or nil if the blob is never copied.
+	local *blobCopy
 }
 
 func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, error) {
@@ -194,14 +264,26 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, error
 	}
 
 	// Try to create a fetcher
+	ctx = audit.WithRequestID(ctx)
 	var createFetcherErr error
-	for _, host := range fc.hosts {
+	for i, host := range fc.hosts {
+		failover := func(err error) {
+			createFetcherErr = errors.Join(err, createFetcherErr)
+			var next string
+			if i+1 < len(fc.hosts) {
+				next = fc.hosts[i+1].Host
+			}
+			audit.Failover(ctx, host.Host, next, err)
+		}
 		if host.Host == "" || strings.Contains(host.Host, "/") {
-			createFetcherErr = errors.Join(
-				fmt.Errorf("%w: (host %q, ref:%q, digest:%q)",
-					ErrInvalidHost, host.Host, fc.refspec, digest),
-				createFetcherErr,
-			)
+			failover(fmt.Errorf("%w: (host %q, ref:%q, digest:%q)",
+				ErrInvalidHost, host.Host, fc.refspec, digest))
+			// Try another
+			continue
+		}
+		if fc.ranges != nil && fc.ranges.excluded(host.Host) {
+			failover(fmt.Errorf("%w: (host %q, ref:%q, digest:%q)",
+				ErrRangesIgnored, host.Host, fc.refspec, digest))
 			// Try another
 			continue
 		}
@@ -237,46 +319,75 @@ func newHTTPFetcher(ctx context.Context, fc *fetcherConfig) (*httpFetcher, error
 			}
 		}
 
+		repository, scope := strings.TrimPrefix(fc.refspec.Locator, fc.refspec.Hostname()+"/"), pullScope
+		if prefix := strings.Trim(fc.repositoryPrefixes[host.Host], "/"); prefix != "" {
+			// The prefix only applies to the host it's configured for.
+			repository = path.Join(prefix, repository)
+			scope = fmt.Sprintf("repository:%s:pull", repository)
+		}
 		registryURL := fmt.Sprintf("%s://%s/%s/blobs/%s",
 			host.Scheme,
 			path.Join(host.Host, host.Path),
-			strings.TrimPrefix(fc.refspec.Locator, fc.refspec.Hostname()+"/"),
+			repository,
 			digest,
 		)
 
+		// Scopes accumulate in the context, so each host gets its own.
+		hostCtx := docker.WithScope(ctx, scope)
+		headSize := int64(-1)
+		if fc.headBeforeGet {
+			// Confirm that the host has the blob before any GET.
+			headSize, err = headBlob(hostCtx, registryURL, tr)
+			if err != nil {
+				failover(fmt.Errorf("%w (host %q, ref:%q, digest:%q)",
+					err, host.Host, fc.refspec, digest))
+				// Try another
+				continue
+			}
+		}
+
 		// Get the real blob URL
-		ctx = docker.WithScope(ctx, pullScope)
-		realURL, err := redirect(ctx, registryURL, tr)
+		realURL, err := redirect(hostCtx, registryURL, tr, !fc.skipContentTypeCheck)
 		if err != nil {
-			createFetcherErr = errors.Join(
-				fmt.Errorf("%w: %w (host %q, ref:%q, digest:%q)",
-					ErrFailedToRedirect, err, host.Host, fc.refspec, digest),
-				createFetcherErr,
-			)
+			failover(fmt.Errorf("%w: %w (host %q, ref:%q, digest:%q)",
+				ErrFailedToRedirect, err, host.Host, fc.refspec, digest))
 			// Try another
 			continue
 		}
 
 		// Hit one destination
+		audit.Outcome(ctx, host.Host, nil)
 		return &httpFetcher{
 			roundTripper: tr,
-			scope:        pullScope,
+			scope:        scope,
+			registryHost: host.Host,
 			registryURL:  registryURL,
 			realURL:      realURL,
 			digest:       digest,
+
+			skipContentTypeCheck: fc.skipContentTypeCheck,
+			headBeforeGet:        fc.headBeforeGet,
+			headSent:             fc.headBeforeGet,
+			headSize:             headSize,
+			ranges:               fc.ranges,
+			local:                fc.local,
 		}, nil
 	}
 
-	return nil, fmt.Errorf("%w: %w", ErrUnableToCreateFetcher, createFetcherErr)
+	err = fmt.Errorf("%w: %w", ErrUnableToCreateFetcher, createFetcherErr)
+	audit.Outcome(ctx, "", err)
+	return nil, err
 }
 
 func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multipartReadCloser, error) {
-	ctx = docker.WithScope(ctx, f.scope)
+	ctx = audit.WithRequestID(docker.WithScope(ctx, f.scope))
 	if len(rs) == 0 {
 		return nil, ErrNoRegion
 	}
 
 	singleRangeMode := f.isSingleRangeMode()
+	hr := f.hostRanges()
+	rangesIgnored := hr.ignores(f.registryHost)
 
 	// squash requesting regions for reducing the total size of request header
 	// (servers generally have limits for the size of headers)
@@ -287,10 +398,36 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		s.add(reg)
 	}
 	requests := s.rs
-	if singleRangeMode {
+	if singleRangeMode || rangesIgnored {
 		// Squash requests if the layer doesn't support multi range.
 		requests = []region{superRegion(requests)}
 	}
+	if rangesIgnored {
+		// The whole blob will be returned, so don't request it unless it can be sliced.
+		if err := hr.checkSlice(f.registryHost, requests[0]); err != nil {
+			return nil, err
+		}
+		if f.local != nil {
+			// Read the ranges out of the local copy of the blob, downloading it once.
+			mr, err := f.local.load(ctx, requests, func() (io.ReadCloser, error) {
+				return f.openBlob(ctx, hr.maxSlice)
+			})
+			if mr != nil || err != nil {
+				return mr, err
+			}
+		}
+	}
+	if f.headBeforeGet {
+		size, err := f.blobSize(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, reg := range requests {
+			if size >= 0 && (reg.b < 0 || reg.e >= size) {
+				return nil, fmt.Errorf("%w: range %d-%d, blob size %d", ErrRangeOutOfBounds, reg.b, reg.e, size)
+			}
+		}
+	}
 
 	// Request to the registry
 	f.urlMu.Lock()
@@ -315,6 +452,15 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		return nil, err
 	}
 
+	if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent {
+		if !f.skipContentTypeCheck {
+			if err := checkBlobContentType(res.Header); err != nil {
+				res.Body.Close()
+				return nil, err
+			}
+		}
+	}
+
 	switch res.StatusCode {
 	case http.StatusOK:
 		// We are getting the whole blob in one part (= status 200)
@@ -322,22 +468,59 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		if err != nil {
 			return nil, fmt.Errorf("%w: %w", ErrCannotParseContentLength, err)
 		}
-		return newSinglePartReader(region{0, size - 1}, res.Body), nil
+		whole := region{0, size - 1}
+		if len(requests) == 1 && requests[0] == whole {
+			return newSinglePartReader(whole, res.Body), nil
+		}
+		// The host answered a ranged request with the whole blob.
+		if hr.record(f.registryHost, false) {
+			log.G(ctx).WithField("host", f.registryHost).WithField("digest", f.digest).
+				Warn("registry host ignores ranged requests")
+		}
+		if err := hr.checkSlice(f.registryHost, superRegion(requests)); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		if f.local != nil && size <= hr.maxSlice {
+			// The whole blob may be read, so keep it to serve later ranges locally.
+			mr, err := f.local.load(ctx, requests, func() (io.ReadCloser, error) {
+				return res.Body, nil
+			})
+			if mr != nil || err != nil {
+				res.Body.Close()
+				return mr, err
+			}
+		}
+		return newSlicingReader(res.Body, requests), nil
 	case http.StatusPartialContent:
+		hr.record(f.registryHost, true)
 		mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
 		if err != nil {
 			return nil, fmt.Errorf("%w: invalid media type %q: %w", ErrCannotParseContentType, mediaType, err)
 		}
+		if !f.skipRangeLengthCheck {
+			if err := checkContentEncoding(res.Header); err != nil {
+				res.Body.Close()
+				return nil, err
+			}
+		}
 		if strings.HasPrefix(mediaType, "multipart/") {
 			// We are getting a set of regions as a multipart body.
-			return newMultiPartReader(res.Body, params["boundary"]), nil
+			return newMultiPartReader(res.Body, params["boundary"], !f.skipRangeLengthCheck), nil
 		}
 		// We are getting single range
 		reg, _, err := parseRange(res.Header.Get("Content-Range"))
 		if err != nil {
 			return nil, fmt.Errorf("%w: %w", ErrCannotParseContentRange, err)
 		}
-		return newSinglePartReader(reg, res.Body), nil
+		if f.skipRangeLengthCheck {
+			return newSinglePartReader(reg, res.Body), nil
+		}
+		if err := checkContentLength(res.Header, reg); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+		return newSinglePartReader(reg, &rangeLengthReadCloser{ReadCloser: res.Body, remaining: reg.size()}), nil
 	case http.StatusUnauthorized, http.StatusForbidden:
 		// 401 response: The underlying AuthClient should have already handled a 401 response.
 		// This may indicate token expiry for the blob URL, so we will refresh the URL.
@@ -345,6 +528,7 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		// cannot be resolved client-side, we will still attempt a URL refresh as a last resort.
 		if retry {
 			log.G(ctx).Infof("Received status code: %v. Refreshing URL and retrying...", res.Status)
+			audit.Retry(ctx, f.registryHost, res.StatusCode, nil)
 			if err := f.refreshURL(ctx); err != nil {
 				return nil, fmt.Errorf("%w: status %v: %w", ErrFailedToRefreshURL, res.Status, err)
 			}
@@ -354,6 +538,7 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 		// gcr.io (https://storage.googleapis.com) returns 400 on multi-range request (2020 #81)
 		if retry && !singleRangeMode {
 			log.G(ctx).Infof("Received status code: %v. Setting single range mode and retrying...", res.Status)
+			audit.Retry(ctx, f.registryHost, res.StatusCode, nil)
 			// fallback and retry with  range request mode
 			f.singleRangeMode()
 			return f.fetch(ctx, rs, false)
@@ -363,6 +548,10 @@ func (f *httpFetcher) fetch(ctx context.Context, rs []region, retry bool) (multi
 }
 
 func (f *httpFetcher) check() error {
+	if f.hostRanges().excluded(f.registryHost) {
+		// Fail the check so that the blob is refreshed from another host.
+		return fmt.Errorf("check failed: %w: %s", ErrRangesIgnored, f.registryHost)
+	}
 	ctx := context.Background()
 	f.urlMu.Lock()
 	url := f.realURL
@@ -392,8 +581,79 @@ func (f *httpFetcher) check() error {
 	return fmt.Errorf("%w on check: %v", ErrUnexpectedStatusCode, res.StatusCode)
 }
 
+// openBlob returns the body of a GET of the whole blob. It fails with errNotCopied
+// if the blob is larger than maxSize.
+func (f *httpFetcher) openBlob(ctx context.Context, maxSize int64) (io.ReadCloser, error) {
+	f.urlMu.Lock()
+	url := f.realURL
+	f.urlMu.Unlock()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept-Encoding", "identity")
+	start := time.Now()
+	res, err := f.roundTripper.RoundTrip(req)
+	commonmetrics.MeasureLatencyInMilliseconds(commonmetrics.RemoteRegistryGet, f.digest, start)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		socihttp.Drain(res.Body)
+		return nil, fmt.Errorf("%w on fetch: %v", ErrUnexpectedStatusCode, res.Status)
+	}
+	if res.ContentLength < 0 || res.ContentLength > maxSize {
+		res.Body.Close()
+		return nil, errNotCopied
+	}
+	return res.Body, nil
+}
+
+// blobSize returns the size of the blob from the Content-Length of a HEAD request,
+// or -1 if the HEAD response has none. The HEAD request is only sent once per blob,
+// usually when the fetcher is created.
+func (f *httpFetcher) blobSize(ctx context.Context) (int64, error) {
+	f.sizeMu.Lock()
+	defer f.sizeMu.Unlock()
+	if f.headSent {
+		return f.headSize, nil
+	}
+	size, err := headBlob(ctx, f.registryURL, f.roundTripper)
+	if err != nil {
+		return 0, err
+	}
+	f.headSent, f.headSize = true, size
+	return size, nil
+}
+
+// headBlob sends a HEAD request for the blob at blobURL and returns its size from the
+// Content-Length of the response, or -1 if the response has none.
+func headBlob(ctx context.Context, blobURL string, tr http.RoundTripper) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, blobURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrRequestFailed, err)
+	}
+	socihttp.Drain(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%w on HEAD: %v", ErrUnexpectedStatusCode, res.Status)
+	}
+	contentLength := res.Header.Get("Content-Length")
+	if contentLength == "" {
+		return -1, nil
+	}
+	size, err := strconv.ParseInt(contentLength, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrCannotParseContentLength, err)
+	}
+	return size, nil
+}
+
 func (f *httpFetcher) refreshURL(ctx context.Context) error {
-	newRealURL, err := redirect(ctx, f.registryURL, f.roundTripper)
+	newRealURL, err := redirect(ctx, f.registryURL, f.roundTripper, !f.skipContentTypeCheck)
 	if err != nil {
 		return err
 	}
@@ -408,6 +668,18 @@ func (f *httpFetcher) genID(reg region) string {
 	return fmt.Sprintf("%x", sum)
 }
 
+func (f *httpFetcher) host() string {
+	return f.registryHost
+}
+
+// hostRanges returns what is known about the hosts ignoring ranged requests.
+func (f *httpFetcher) hostRanges() *hostRanges {
+	if f.ranges == nil {
+		return newHostRanges(config.BlobConfig{})
+	}
+	return f.ranges
+}
+
 func (f *httpFetcher) singleRangeMode() {
 	f.singleRangeMu.Lock()
 	f.singleRange = true
@@ -422,8 +694,9 @@ func (f *httpFetcher) isSingleRangeMode() bool {
 }
 
 // redirect sends a GET request to a given endpoint with a given http.RoundTripper and
-// returns the final URL in a redirect chain.
-func redirect(ctx context.Context, blobURL string, tr http.RoundTripper) (string, error) {
+// returns the final URL in a redirect chain. If checkContentType is true, successful
+// responses that can't be blob data are treated as failures.
+func redirect(ctx context.Context, blobURL string, tr http.RoundTripper, checkContentType bool) (string, error) {
 	// We use GET request for redirect.
 	// gcr.io returns 200 on HEAD without Location header (2020).
 	// ghcr.io returns 200 on HEAD without Location header (2020).
@@ -443,6 +716,11 @@ func redirect(ctx context.Context, blobURL string, tr http.RoundTripper) (string
 
 	// If we get an OK response, return the request URL.
 	if res.StatusCode/100 == 2 {
+		if checkContentType {
+			if err := checkBlobContentType(res.Header); err != nil {
+				return "", err
+			}
+		}
 		return res.Request.URL.String(), nil
 	}
 	// If we still get a redirection, return the redirect URL.
@@ -496,8 +774,11 @@ func GetHeader(ctx context.Context, realURL string, rt http.RoundTripper) (*http
 		}
 	}
 
-	return nil, fmt.Errorf("failed to get header with code (HEAD=%v, range GET=%v, GET=%v)",
-		statusCodes[0], statusCodes[1], statusCodes[2])
+	return nil, &HeaderStatusError{
+		StatusCodes: statusCodes,
+		msg: fmt.Sprintf("failed to get header with code (HEAD=%v, range GET=%v, GET=%v)",
+			statusCodes[0], statusCodes[1], statusCodes[2]),
+	}
 }
 
 // GetHeaderWithGet is identical to GetHeader, but strictly uses GET requests in its attempts
@@ -525,8 +806,11 @@ func GetHeaderWithGet(ctx context.Context, realURL string, rt http.RoundTripper)
 		}
 	}
 
-	return nil, fmt.Errorf("failed to get header via GET with code (range GET=%v, GET=%v)",
-		statusCodes[0], statusCodes[1])
+	return nil, &HeaderStatusError{
+		StatusCodes: statusCodes,
+		msg: fmt.Sprintf("failed to get header via GET with code (range GET=%v, GET=%v)",
+			statusCodes[0], statusCodes[1]),
+	}
 }
 
 // getLayerSize gets the size of a layer by sending a request to the registry
@@ -568,16 +852,18 @@ func (sr *singlepartReader) Next() (region, io.Reader, error) {
 	return region{}, nil, io.EOF
 }
 
-func newMultiPartReader(rc io.ReadCloser, boundary string) multipartReadCloser {
+func newMultiPartReader(rc io.ReadCloser, boundary string, checkLength bool) multipartReadCloser {
 	return &multipartReader{
-		m:      multipart.NewReader(rc, boundary),
-		Closer: rc,
+		m:           multipart.NewReader(rc, boundary),
+		Closer:      rc,
+		checkLength: checkLength,
 	}
 }
 
 type multipartReader struct {
 	io.Closer
-	m *multipart.Reader
+	m           *multipart.Reader
+	checkLength bool
 }
 
 func (sr *multipartReader) Next() (region, io.Reader, error) {
@@ -589,9 +875,93 @@ func (sr *multipartReader) Next() (region, io.Reader, error) {
 	if err != nil {
 		return region{}, nil, fmt.Errorf("%w: %w", ErrCannotParseContentRange, err)
 	}
+	if sr.checkLength {
+		if err := checkContentLength(http.Header(p.Header), reg); err != nil {
+			return region{}, nil, err
+		}
+		return reg, &rangeLengthReadCloser{ReadCloser: io.NopCloser(p), remaining: reg.size()}, nil
+	}
 	return reg, p, nil
 }
 
+// checkContentEncoding returns an error if a ranged response declares an encoding.
+// Ranges are requested over the identity encoding, so an encoded body means
+// something between us and the registry transformed it.
+func checkContentEncoding(header http.Header) error {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return fmt.Errorf("%w: unexpected Content-Encoding %q", ErrCorruptRangedResponse, encoding)
+	}
+	return nil
+}
+
+// checkBlobContentType returns an error if a response declares a Content-Type that can't
+// be blob data. Proxies and captive portals may serve an HTML error page with a successful
+// status, which would otherwise be read as the contents of the blob.
+func checkBlobContentType(header http.Header) error {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// Only Content-Types known to be error pages are rejected.
+		return nil
+	}
+	switch mediaType {
+	case "text/html", "application/xhtml+xml":
+		return fmt.Errorf("%w: %q", ErrUnexpectedContentType, mediaType)
+	}
+	return nil
+}
+
+// checkContentLength returns an error if the declared length of a ranged
+// response doesn't match the size of the range it contains.
+func checkContentLength(header http.Header, reg region) error {
+	cl := header.Get("Content-Length")
+	if cl == "" {
+		return nil
+	}
+	size, err := strconv.ParseInt(cl, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrCannotParseContentLength, err)
+	}
+	if size != reg.size() {
+		return fmt.Errorf("%w: Content-Length %d for range %d-%d", ErrCorruptRangedResponse, size, reg.b, reg.e)
+	}
+	return nil
+}
+
+// rangeLengthReadCloser fails reads of a ranged response body
+// that contains fewer or more bytes than the range.
+type rangeLengthReadCloser struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *rangeLengthReadCloser) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		return n, fmt.Errorf("%w: body is %d bytes longer than the range", ErrCorruptRangedResponse, -r.remaining)
+	}
+	if err == io.EOF && r.remaining > 0 {
+		return n, fmt.Errorf("%w: body is %d bytes shorter than the range", ErrCorruptRangedResponse, r.remaining)
+	}
+	if err == nil && r.remaining == 0 {
+		// Readers usually stop at the end of the range, so look for trailing
+		// bytes that would otherwise go unnoticed.
+		var b [1]byte
+		m, peekErr := r.ReadCloser.Read(b[:])
+		if m > 0 {
+			return n, fmt.Errorf("%w: body is longer than the range", ErrCorruptRangedResponse)
+		}
+		if peekErr == io.EOF {
+			return n, io.EOF
+		}
+	}
+	return n, err
+}
+
 func ParseSize(resp *http.Response) (int64, error) {
 	switch resp.StatusCode {
 	case http.StatusOK:
@@ -669,6 +1039,10 @@ func (r *remoteFetcher) genID(reg region) string {
 	return r.r.GenID(reg.b, reg.size())
 }
 
+func (r *remoteFetcher) host() string {
+	return ""
+}
+
 type Fetcher interface {
 	Fetch(ctx context.Context, off int64, size int64) (io.ReadCloser, error)
 	Check() error
@@ -41,15 +41,21 @@ package remote
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/internal/audit"
 	socihttp "github.com/awslabs/soci-snapshotter/internal/http"
 	"github.com/awslabs/soci-snapshotter/version"
 	"github.com/containerd/containerd/reference"
@@ -125,6 +131,15 @@ func TestMirror(t *testing.T) {
 			},
 			wantHost: refHost,
 		},
+		{
+			name: "html-error-page-mirror",
+			tr: &sampleRoundTripper{
+				htmlURLs: []string{"mirrorexample.com"},
+				okURLs:   []string{refHost},
+			},
+			mirrors:  []string{"mirrorexample.com"},
+			wantHost: refHost,
+		},
 		{
 			name: "invalid-hostname-of-mirror",
 			tr: &sampleRoundTripper{
@@ -196,10 +211,65 @@ func TestMirror(t *testing.T) {
 	}
 }
 
+// TestMirrorRepositoryPrefix verifies that the repository prefix of a mirror applies to
+// the blob URL of the mirror but not to the one of the registry it falls back to.
+func TestMirrorRepositoryPrefix(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	blobDigest := digest.FromString("dummy")
+
+	tests := []struct {
+		name        string
+		tr          http.RoundTripper
+		expectedURL string
+	}{
+		{
+			name:        "mirror",
+			tr:          &sampleRoundTripper{okURLs: []string{"mirrorexample.com"}},
+			expectedURL: "https://mirrorexample.com/v2/cache/upstream/library/test/blobs/" + blobDigest.String(),
+		},
+		{
+			name:        "fallback",
+			tr:          &sampleRoundTripper{okURLs: []string{"dummyexample.com"}},
+			expectedURL: "https://dummyexample.com/v2/library/test/blobs/" + blobDigest.String(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var regHosts []docker.RegistryHost
+			for _, h := range []string{"mirrorexample.com", refspec.Hostname()} {
+				regHosts = append(regHosts, docker.RegistryHost{
+					Client:       &http.Client{Transport: tt.tr},
+					Host:         h,
+					Scheme:       "https",
+					Path:         "/v2",
+					Capabilities: docker.HostCapabilityPull,
+				})
+			}
+			fetcher, err := newHTTPFetcher(context.Background(), &fetcherConfig{
+				hosts:              regHosts,
+				refspec:            refspec,
+				desc:               ocispec.Descriptor{Digest: blobDigest},
+				repositoryPrefixes: map[string]string{"mirrorexample.com": "/cache/upstream/"},
+			})
+			if err != nil {
+				t.Fatalf("failed to resolve reference: %v", err)
+			}
+			if fetcher.registryURL != tt.expectedURL {
+				t.Errorf("expected blob URL %q; got %q", tt.expectedURL, fetcher.registryURL)
+			}
+		})
+	}
+}
+
 type sampleRoundTripper struct {
 	withCode    map[string]int
 	redirectURL map[string]string
-	okURLs      []string
+	// htmlURLs respond with an HTML error page and a 200 status.
+	htmlURLs []string
+	okURLs   []string
 }
 
 func (tr *sampleRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -213,6 +283,20 @@ func (tr *sampleRoundTripper) RoundTrip(req *http.Request) (*http.Response, erro
 			}, nil
 		}
 	}
+	for _, host := range tr.htmlURLs {
+		if ok, _ := regexp.Match(host, []byte(req.URL.String())); ok {
+			page := []byte("<html><body>Please log in</body></html>")
+			header := make(http.Header)
+			header.Set("Content-Type", "text/html; charset=utf-8")
+			header.Set("Content-Length", fmt.Sprint(len(page)))
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     header,
+				Body:       io.NopCloser(bytes.NewReader(page)),
+				Request:    req,
+			}, nil
+		}
+	}
 	for host, rurl := range tr.redirectURL {
 		if ok, _ := regexp.Match(host, []byte(req.URL.String())); ok {
 			rURL, _ := url.Parse(rurl)
@@ -517,3 +601,422 @@ func TestGetHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestHostFailover(t *testing.T) {
+	ref := "dummyexample.com/library/test"
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	desc := ocispec.Descriptor{Digest: digest.FromString("dummy"), Size: 1}
+
+	tr := &sampleRoundTripper{okURLs: []string{`.*`}}
+	var hosts []docker.RegistryHost
+	for _, host := range []string{"mirrorexample1.com", "mirrorexample2.com", refspec.Hostname()} {
+		hosts = append(hosts, docker.RegistryHost{
+			Client:       &http.Client{Transport: tr},
+			Host:         host,
+			Scheme:       "https",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+		})
+	}
+
+	r := NewResolver(t.TempDir(), config.BlobConfig{}, nil, 0, nil)
+	b, err := r.Resolve(context.Background(), hosts, refspec, desc, nil)
+	if err != nil {
+		t.Fatalf("failed to resolve blob: %v", err)
+	}
+	if host := b.Host(); host != "mirrorexample1.com" {
+		t.Fatalf("expected blob to be fetched from the first mirror; got %q", host)
+	}
+
+	// The first mirror goes down, so refreshing the blob fails over to the second one.
+	tr.withCode = map[string]int{"mirrorexample1.com": http.StatusInternalServerError}
+	if err := b.Refresh(context.Background(), hosts, refspec, desc); err != nil {
+		t.Fatalf("failed to refresh blob: %v", err)
+	}
+	if host := b.Host(); host != "mirrorexample2.com" {
+		t.Fatalf("expected blob to fail over to the second mirror; got %q", host)
+	}
+}
+
+func TestHostFailoverAudit(t *testing.T) {
+	ref := "dummyexample.com/library/test"
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	desc := ocispec.Descriptor{Digest: digest.FromString("dummy"), Size: 1}
+
+	var (
+		mu      sync.Mutex
+		records []audit.Record
+	)
+	audit.SetEmitter(audit.EmitterFunc(func(r audit.Record) {
+		mu.Lock()
+		records = append(records, r)
+		mu.Unlock()
+	}))
+	t.Cleanup(func() { audit.SetEmitter(nil) })
+
+	tr := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		switch req.URL.Host {
+		case "mirrorexample1.com":
+			// The URL carries a credential, which must not be audited.
+			return nil, &url.Error{Op: "Get", URL: req.URL.String() + "?X-Amz-Credential=secret", Err: errors.New("connection refused")}
+		case "mirrorexample2.com":
+			return &http.Response{
+				StatusCode: http.StatusInternalServerError,
+				Header:     make(http.Header),
+				Body:       io.NopCloser(&bytes.Buffer{}),
+				Request:    req,
+			}, nil
+		}
+		header := make(http.Header)
+		header.Set("Content-Length", "1")
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       io.NopCloser(bytes.NewReader([]byte{0})),
+			Request:    req,
+		}, nil
+	})
+	var hosts []docker.RegistryHost
+	for _, host := range []string{"mirrorexample1.com", "mirrorexample2.com", refspec.Hostname()} {
+		hosts = append(hosts, docker.RegistryHost{
+			Client:       &http.Client{Transport: tr},
+			Host:         host,
+			Scheme:       "https",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+		})
+	}
+
+	r := NewResolver(t.TempDir(), config.BlobConfig{}, nil, 0, nil)
+	b, err := r.Resolve(context.Background(), hosts, refspec, desc, nil)
+	if err != nil {
+		t.Fatalf("failed to resolve blob: %v", err)
+	}
+	if host := b.Host(); host != refspec.Hostname() {
+		t.Fatalf("expected blob to be fetched from %s; got %q", refspec.Hostname(), host)
+	}
+
+	expected := []struct {
+		event    audit.Event
+		host     string
+		nextHost string
+		reason   string
+		outcome  string
+	}{
+		{event: audit.EventFailover, host: "mirrorexample1.com", nextHost: "mirrorexample2.com", reason: "connection refused"},
+		{event: audit.EventFailover, host: "mirrorexample2.com", nextHost: refspec.Hostname(), reason: "500"},
+		{event: audit.EventOutcome, host: refspec.Hostname(), outcome: audit.OutcomeSuccess},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d audit records; got %+v", len(expected), records)
+	}
+	for i, e := range expected {
+		rec := records[i]
+		if rec.Event != e.event || rec.Host != e.host || rec.NextHost != e.nextHost || rec.Outcome != e.outcome {
+			t.Fatalf("unexpected audit record %d: %+v", i, rec)
+		}
+		if !strings.Contains(rec.Reason, e.reason) {
+			t.Fatalf("expected reason of audit record %d to contain %q; got %q", i, e.reason, rec.Reason)
+		}
+		if strings.Contains(rec.Reason, "secret") {
+			t.Fatalf("audit record %d contains a credential: %q", i, rec.Reason)
+		}
+		if rec.Time.IsZero() {
+			t.Fatalf("audit record %d has no timestamp", i)
+		}
+		if rec.RequestID == "" || rec.RequestID != records[0].RequestID {
+			t.Fatalf("expected audit records to share a request ID; got %q and %q", records[0].RequestID, rec.RequestID)
+		}
+	}
+}
+
+func TestHeadBeforeGet(t *testing.T) {
+	const blobSize = 10
+	tests := []struct {
+		name          string
+		headBeforeGet bool
+		headCode      int
+		// headNoLength omits the Content-Length of the HEAD response.
+		headNoLength bool
+		regions      [][]region
+		expectedErr  error
+		expected     []string
+	}{
+		{
+			name:     "disabled",
+			regions:  [][]region{{{0, 3}}},
+			expected: []string{http.MethodGet},
+		},
+		{
+			name:          "HEAD is sent once before the first GET",
+			headBeforeGet: true,
+			headCode:      http.StatusOK,
+			regions:       [][]region{{{0, 3}}, {{4, blobSize - 1}}},
+			expected:      []string{http.MethodHead, http.MethodGet, http.MethodGet},
+		},
+		{
+			name:          "range beyond the blob size",
+			headBeforeGet: true,
+			headCode:      http.StatusOK,
+			regions:       [][]region{{{0, 3}, {8, blobSize}}},
+			expectedErr:   ErrRangeOutOfBounds,
+			expected:      []string{http.MethodHead},
+		},
+		{
+			name:          "missing blob",
+			headBeforeGet: true,
+			headCode:      http.StatusNotFound,
+			regions:       [][]region{{{0, 3}}},
+			expectedErr:   ErrUnexpectedStatusCode,
+			expected:      []string{http.MethodHead},
+		},
+		{
+			name:          "unknown blob size",
+			headBeforeGet: true,
+			headCode:      http.StatusOK,
+			headNoLength:  true,
+			regions:       [][]region{{{0, 3}}, {{4, blobSize - 1}}},
+			expected:      []string{http.MethodHead, http.MethodGet, http.MethodGet},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var methods []string
+			tr := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				methods = append(methods, req.Method)
+				header := make(http.Header)
+				header.Set("Content-Length", fmt.Sprint(blobSize))
+				res := &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     header,
+					Body:       io.NopCloser(bytes.NewReader(make([]byte, blobSize))),
+					Request:    req,
+				}
+				if req.Method == http.MethodHead {
+					res.StatusCode = tt.headCode
+					res.Body = io.NopCloser(&bytes.Buffer{})
+					if tt.headNoLength {
+						header.Del("Content-Length")
+					}
+				}
+				return res, nil
+			})
+			f := &httpFetcher{
+				roundTripper:  tr,
+				registryURL:   "https://example.com/v2/test/blobs/sha256:dummy",
+				realURL:       "https://storage.example.com/dummy",
+				headBeforeGet: tt.headBeforeGet,
+			}
+			var err error
+			for _, regions := range tt.regions {
+				var mr multipartReadCloser
+				mr, err = f.fetch(context.Background(), regions, true)
+				if err != nil {
+					break
+				}
+				mr.Close()
+			}
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected %v; got %v", tt.expectedErr, err)
+			}
+			if !slices.Equal(methods, tt.expected) {
+				t.Fatalf("expected requests %v; got %v", tt.expected, methods)
+			}
+		})
+	}
+}
+
+// TestHeadBeforeRedirect verifies that the HEAD request is sent to each host before
+// any GET, so that hosts missing the blob are skipped without a GET.
+func TestHeadBeforeRedirect(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	var requests []string
+	tr := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.Method+" "+req.URL.Host)
+		header := make(http.Header)
+		header.Set("Content-Length", "1")
+		res := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       io.NopCloser(bytes.NewReader([]byte{0})),
+			Request:    req,
+		}
+		if req.URL.Host == "mirrorexample.com" {
+			res.StatusCode = http.StatusNotFound
+		}
+		return res, nil
+	})
+	var regHosts []docker.RegistryHost
+	for _, h := range []string{"mirrorexample.com", refspec.Hostname()} {
+		regHosts = append(regHosts, docker.RegistryHost{
+			Client:       &http.Client{Transport: tr},
+			Host:         h,
+			Scheme:       "https",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+		})
+	}
+	fetcher, err := newHTTPFetcher(context.Background(), &fetcherConfig{
+		hosts:         regHosts,
+		refspec:       refspec,
+		desc:          ocispec.Descriptor{Digest: digest.FromString("dummy")},
+		headBeforeGet: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to resolve reference: %v", err)
+	}
+	expected := []string{"HEAD mirrorexample.com", "HEAD dummyexample.com", "GET dummyexample.com"}
+	if !slices.Equal(requests, expected) {
+		t.Fatalf("expected requests %v; got %v", expected, requests)
+	}
+	if size, err := fetcher.blobSize(context.Background()); err != nil || size != 1 {
+		t.Fatalf("expected the blob size of the HEAD request to be cached; got %d, %v", size, err)
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected no more requests; got %v", requests[len(expected):])
+	}
+}
+
+// TestRefreshPrefixedMirror verifies that refreshing a blob keeps the settings of its
+// resolver: the repository prefix of the mirror and the HEAD request before any GET.
+func TestRefreshPrefixedMirror(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	desc := ocispec.Descriptor{Digest: digest.FromString("dummy"), Size: 1}
+	blobPath := "/v2/cache/upstream/library/test/blobs/" + desc.Digest.String()
+	var requests []string
+	tr := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		requests = append(requests, req.Method+" "+req.URL.Host+req.URL.Path)
+		header := make(http.Header)
+		header.Set("Content-Length", "1")
+		res := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     header,
+			Body:       io.NopCloser(bytes.NewReader([]byte{0})),
+			Request:    req,
+		}
+		if req.URL.Path != blobPath {
+			res.StatusCode = http.StatusNotFound
+		}
+		return res, nil
+	})
+	regHosts := []docker.RegistryHost{{
+		Client:       &http.Client{Transport: tr},
+		Host:         "mirrorexample.com",
+		Scheme:       "https",
+		Path:         "/v2",
+		Capabilities: docker.HostCapabilityPull,
+	}}
+	r := NewResolver(t.TempDir(), config.BlobConfig{HeadBeforeGet: true}, nil, 0,
+		map[string]string{"mirrorexample.com": "/cache/upstream/"})
+	b := makeBlob(nil, desc.Size, time.Now(), 0, r)
+
+	if err := b.Refresh(context.Background(), regHosts, refspec, desc); err != nil {
+		t.Fatalf("failed to refresh blob: %v", err)
+	}
+	expected := []string{"HEAD mirrorexample.com" + blobPath, "GET mirrorexample.com" + blobPath}
+	if !slices.Equal(requests, expected) {
+		t.Fatalf("expected requests %v; got %v", expected, requests)
+	}
+	hf, ok := b.fetcher.(*httpFetcher)
+	if !ok {
+		t.Fatalf("expected an HTTP fetcher; got %T", b.fetcher)
+	}
+	if !hf.headBeforeGet {
+		t.Fatalf("expected the refreshed fetcher to send a HEAD request before any GET")
+	}
+	if expectedURL := "https://mirrorexample.com" + blobPath; hf.registryURL != expectedURL {
+		t.Fatalf("expected blob URL %q; got %q", expectedURL, hf.registryURL)
+	}
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestContentTypeCheck(t *testing.T) {
+	const blobSize = 4
+	tests := []struct {
+		name        string
+		status      int
+		contentType string
+		skipCheck   bool
+		expectedErr error
+	}{
+		{
+			name:        "octet-stream",
+			status:      http.StatusPartialContent,
+			contentType: "application/octet-stream",
+		},
+		{
+			name:   "no Content-Type",
+			status: http.StatusOK,
+		},
+		{
+			name:        "html range",
+			status:      http.StatusPartialContent,
+			contentType: "text/html",
+			expectedErr: ErrUnexpectedContentType,
+		},
+		{
+			name:        "html with 200",
+			status:      http.StatusOK,
+			contentType: "text/html; charset=utf-8",
+			expectedErr: ErrUnexpectedContentType,
+		},
+		{
+			name:        "html with 200 and check disabled",
+			status:      http.StatusOK,
+			contentType: "text/html; charset=utf-8",
+			skipCheck:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				header := make(http.Header)
+				header.Set("Content-Length", fmt.Sprint(blobSize))
+				if tt.status == http.StatusPartialContent {
+					header.Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", blobSize-1, blobSize))
+				}
+				if tt.contentType != "" {
+					header.Set("Content-Type", tt.contentType)
+				}
+				return &http.Response{
+					StatusCode: tt.status,
+					Header:     header,
+					Body:       io.NopCloser(bytes.NewReader(make([]byte, blobSize))),
+					Request:    req,
+				}, nil
+			})
+			f := &httpFetcher{
+				roundTripper:         tr,
+				registryURL:          "https://example.com/v2/test/blobs/sha256:dummy",
+				realURL:              "https://storage.example.com/dummy",
+				skipContentTypeCheck: tt.skipCheck,
+			}
+			mr, err := f.fetch(context.Background(), []region{{0, blobSize - 1}}, true)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected %v; got %v", tt.expectedErr, err)
+			}
+			if err == nil {
+				mr.Close()
+			}
+		})
+	}
+}
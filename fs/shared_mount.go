@@ -0,0 +1,192 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// sharedLayerMounts shares a single FUSE mount between the mountpoints of a layer
+// that appears multiple times in the chain of an image. The layer is mounted once in
+// a directory owned by the snapshotter and bind mounted to each of its mountpoints, so
+// they all serve the same files from the same fetch state and span cache.
+//
+// Overlay semantics are unaffected: every lower directory of the layer has exactly
+// the same contents as a dedicated mount would have.
+type sharedLayerMounts struct {
+	dir string
+
+	mu sync.Mutex
+	// mounts maps a layer key to the shared mount of the layer.
+	mounts map[string]*sharedLayerMount
+	// mountpoints maps a mountpoint to the key of the layer bind mounted to it.
+	mountpoints map[string]string
+
+	bind    func(source, target string) error
+	unmount func(target string, flags int) error
+}
+
+type sharedLayerMount struct {
+	// ready is closed once the layer is mounted at mountpoint, or failed to be mounted with err.
+	ready      chan struct{}
+	mountpoint string
+	err        error
+	// refs counts the mountpoints the layer is bind mounted to, or is being bind mounted to.
+	refs int
+}
+
+func newSharedLayerMounts(root string) (*sharedLayerMounts, error) {
+	dir := filepath.Join(root, "sharedmounts")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create shared mount directory: %w", err)
+	}
+	s := &sharedLayerMounts{
+		dir:         dir,
+		mounts:      make(map[string]*sharedLayerMount),
+		mountpoints: make(map[string]string),
+		bind: func(source, target string) error {
+			return unix.Mount(source, target, "", unix.MS_BIND, "")
+		},
+		unmount: unix.Unmount,
+	}
+	if err := s.sweep(); err != nil {
+		log.L.WithError(err).Warn("failed to remove shared layer mounts of a previous run")
+	}
+	return s, nil
+}
+
+// sweep removes the shared mounts left over by a previous run, e.g. one that crashed.
+// Their FUSE servers are gone, so they are detached even if they are still in use.
+func (s *sharedLayerMounts) sweep() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, e := range entries {
+		p := filepath.Join(s.dir, e.Name())
+		// EINVAL means the directory isn't mounted anymore.
+		if err := s.unmount(p, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) {
+			errs = append(errs, err)
+			continue
+		}
+		if err := os.Remove(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sharedLayerKey returns the key of the layer with the digest in the image.
+// Layers of different images are resolved separately, so they aren't shared.
+func sharedLayerKey(imageRef string, dgst digest.Digest) string {
+	return imageRef + "/" + dgst.String()
+}
+
+// mount makes the layer identified by key available at mountpoint. The layer is
+// mounted with mountLayer the first time it is mounted; later mounts reuse it.
+// Concurrent mounts of the same layer wait for the first one, while mounts of
+// other layers proceed, so that a slow layer doesn't hold up the others.
+func (s *sharedLayerMounts) mount(key, mountpoint string, mountLayer func(mountpoint string) error) error {
+	s.mu.Lock()
+	m, ok := s.mounts[key]
+	if !ok {
+		m = &sharedLayerMount{ready: make(chan struct{})}
+		s.mounts[key] = m
+	}
+	// The reference keeps the shared mount from being released before it's bind mounted.
+	m.refs++
+	s.mu.Unlock()
+
+	if !ok {
+		m.mountpoint, m.err = s.mountLayer(mountLayer)
+		if m.err != nil {
+			s.mu.Lock()
+			delete(s.mounts, key)
+			s.mu.Unlock()
+		}
+		close(m.ready)
+	}
+	<-m.ready
+	if m.err != nil {
+		return m.err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.bind(m.mountpoint, mountpoint); err != nil {
+		m.refs--
+		if m.refs == 0 {
+			s.release(key, m)
+		}
+		return fmt.Errorf("failed to bind mount shared layer mount %q: %w", m.mountpoint, err)
+	}
+	s.mountpoints[mountpoint] = key
+	return nil
+}
+
+// mountLayer mounts a layer with mountLayer in a new directory of s.dir and returns the directory.
+func (s *sharedLayerMounts) mountLayer(mountLayer func(mountpoint string) error) (string, error) {
+	dir, err := os.MkdirTemp(s.dir, "")
+	if err != nil {
+		return "", fmt.Errorf("failed to create shared mountpoint: %w", err)
+	}
+	if err := mountLayer(dir); err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// unmountShared unmounts mountpoint if it is bind mounted to a shared layer mount.
+// The shared mount is unmounted once no mountpoint refers to it anymore.
+// It returns false if mountpoint isn't bind mounted to a shared layer mount.
+func (s *sharedLayerMounts) unmountShared(mountpoint string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.mountpoints[mountpoint]
+	if !ok {
+		return false, nil
+	}
+	delete(s.mountpoints, mountpoint)
+	m := s.mounts[key]
+	m.refs--
+	err := s.unmount(mountpoint, 0)
+	if m.refs == 0 {
+		err = errors.Join(err, s.release(key, m))
+	}
+	return true, err
+}
+
+// release unmounts the shared mount of the layer. The caller must hold s.mu.
+func (s *sharedLayerMounts) release(key string, m *sharedLayerMount) error {
+	delete(s.mounts, key)
+	// See Unmount for why MNT_FORCE is used.
+	if err := s.unmount(m.mountpoint, unix.MNT_FORCE); err != nil {
+		return err
+	}
+	return os.Remove(m.mountpoint)
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+func TestSharedLayerMounts(t *testing.T) {
+	s, err := newSharedLayerMounts(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create shared layer mounts: %v", err)
+	}
+	// binds maps each mountpoint to the shared mount bind mounted to it.
+	binds := make(map[string]string)
+	unmounted := make(map[string]bool)
+	s.bind = func(source, target string) error {
+		binds[target] = source
+		return nil
+	}
+	s.unmount = func(target string, _ int) error {
+		unmounted[target] = true
+		return nil
+	}
+
+	const imageRef = "example.com/image:latest"
+	var (
+		repeated = digest.FromString("repeated")
+		unique   = digest.FromString("unique")
+	)
+	// The chain contains the repeated layer at the bottom and the top.
+	chain := []digest.Digest{repeated, unique, repeated}
+	var layerMounts []string
+	for i, dgst := range chain {
+		err := s.mount(sharedLayerKey(imageRef, dgst), fmt.Sprintf("snapshot-%d", i), func(mountpoint string) error {
+			layerMounts = append(layerMounts, mountpoint)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to mount layer %d: %v", i, err)
+		}
+	}
+
+	if len(layerMounts) != 2 {
+		t.Fatalf("expected a single mount per distinct layer; got %d mounts", len(layerMounts))
+	}
+	if binds["snapshot-0"] != binds["snapshot-2"] {
+		t.Fatalf("expected repeated layer to share a single mount; got %q and %q", binds["snapshot-0"], binds["snapshot-2"])
+	}
+	if binds["snapshot-0"] == binds["snapshot-1"] {
+		t.Fatalf("expected distinct layers to be mounted separately")
+	}
+
+	// The shared mount stays until the last snapshot of the repeated layer is unmounted.
+	shared := binds["snapshot-0"]
+	if ok, err := s.unmountShared("snapshot-0"); !ok || err != nil {
+		t.Fatalf("failed to unmount shared layer: %v", err)
+	}
+	if !unmounted["snapshot-0"] || unmounted[shared] {
+		t.Fatalf("expected only the bind mount to be unmounted while the layer is still in use")
+	}
+	if ok, err := s.unmountShared("snapshot-2"); !ok || err != nil {
+		t.Fatalf("failed to unmount shared layer: %v", err)
+	}
+	if !unmounted[shared] {
+		t.Fatalf("expected shared mount to be unmounted once no snapshot uses it")
+	}
+	if _, err := os.Stat(shared); !os.IsNotExist(err) {
+		t.Fatalf("expected shared mountpoint to be removed; got %v", err)
+	}
+	if ok, _ := s.unmountShared("snapshot-2"); ok {
+		t.Fatalf("expected unmounted snapshot to not be shared anymore")
+	}
+}
+
+func TestSharedLayerMountsConcurrent(t *testing.T) {
+	s, err := newSharedLayerMounts(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create shared layer mounts: %v", err)
+	}
+	s.bind = func(source, target string) error { return nil }
+
+	// The slow layer is mounted until the other layer is mounted,
+	// which deadlocks if mounts of different layers are serialized.
+	const imageRef = "example.com/image:latest"
+	other := make(chan struct{})
+	errs := make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			errs <- s.mount(sharedLayerKey(imageRef, digest.FromString("slow")), fmt.Sprintf("slow-%d", i), func(string) error {
+				<-other
+				return nil
+			})
+		}()
+	}
+	if err := s.mount(sharedLayerKey(imageRef, digest.FromString("other")), "other", func(string) error { return nil }); err != nil {
+		t.Fatalf("failed to mount layer: %v", err)
+	}
+	close(other)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("failed to mount slow layer: %v", err)
+		}
+	}
+	if refs := s.mounts[sharedLayerKey(imageRef, digest.FromString("slow"))].refs; refs != 2 {
+		t.Fatalf("expected slow layer to be shared by 2 mountpoints; got %d", refs)
+	}
+}
+
+func TestSharedLayerMountsSweep(t *testing.T) {
+	root := t.TempDir()
+	s, err := newSharedLayerMounts(root)
+	if err != nil {
+		t.Fatalf("failed to create shared layer mounts: %v", err)
+	}
+	// Shared mounts of a previous run, one of which is still mounted.
+	mounted := filepath.Join(s.dir, "mounted")
+	for _, dir := range []string{mounted, filepath.Join(s.dir, "unmounted")} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unmounted := make(map[string]int)
+	s.unmount = func(target string, flags int) error {
+		if target != mounted {
+			return unix.EINVAL
+		}
+		unmounted[target] = flags
+		return nil
+	}
+	if err := s.sweep(); err != nil {
+		t.Fatalf("failed to sweep shared layer mounts: %v", err)
+	}
+	if flags, ok := unmounted[mounted]; !ok || flags != unix.MNT_DETACH {
+		t.Fatalf("expected stale shared mount to be detached")
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected stale shared mountpoints to be removed; got %d", len(entries))
+	}
+}
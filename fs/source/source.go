@@ -90,6 +90,18 @@ const (
 
 	// HasSociIndexDigest is a label that tells if the layer was pulled with a SOCI index.
 	HasSociIndexDigest = "containerd.io/snapshot/remote/has.soci.index.digest"
+
+	// TargetMaxConcurrencyLabel is a label which limits the number of layers of the target
+	// image resolved in parallel, in addition to the global MaxConcurrency.
+	TargetMaxConcurrencyLabel = "containerd.io/snapshot/remote/soci.max.concurrency"
+
+	// TargetFetchBudgetBytesLabel is a label which overrides the global fetch budget,
+	// in bytes, of each layer mounted for the target image.
+	TargetFetchBudgetBytesLabel = "containerd.io/snapshot/remote/soci.fetch.budget.bytes"
+
+	// TargetFetchBudgetActionLabel is a label which overrides the global action taken
+	// on fetches beyond the fetch budget of the target image's layers.
+	TargetFetchBudgetActionLabel = "containerd.io/snapshot/remote/soci.fetch.budget.action"
 )
 
 // RegistryHosts is copied from [github.com/awslabs/soci-snapshotter/service/resolver.RegistryHosts]
@@ -0,0 +1,62 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import "sync"
+
+// BufferPool reuses the buffers that compressed spans are fetched into, so that
+// fetching a span doesn't allocate once the pool is warm. A BufferPool may be
+// shared by the SpanManagers of many layers. Buffers are cleared when they are
+// returned to the pool, so the contents of a span never leak into a later fetch,
+// even one for a layer of another image.
+//
+// A nil *BufferPool allocates a new buffer for every fetch.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool returns a BufferPool of size-byte buffers. It should match the span
+// size of the images, so that most compressed spans fit. Larger spans are fetched into
+// buffers that are allocated as usual. If size <= 0, nil is returned.
+func NewBufferPool(size int) *BufferPool {
+	if size <= 0 {
+		return nil
+	}
+	return &BufferPool{size: size}
+}
+
+// get returns a zeroed buffer of n bytes.
+func (p *BufferPool) get(n int) []byte {
+	if p == nil || n > p.size {
+		return make([]byte, n)
+	}
+	if b, ok := p.pool.Get().(*[]byte); ok {
+		return (*b)[:n]
+	}
+	return make([]byte, n, p.size)
+}
+
+// put returns b to the pool. b must not be used afterwards.
+func (p *BufferPool) put(b []byte) {
+	if p == nil || cap(b) != p.size {
+		return
+	}
+	b = b[:cap(b)]
+	clear(b)
+	p.pool.Put(&b)
+}
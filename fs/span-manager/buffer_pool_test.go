@@ -0,0 +1,141 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package spanmanager
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/cache"
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+)
+
+const bufferPoolTestSpanSize = 64 << 10
+
+// newBufferPoolTestSpanManager returns a span manager of a layer with a single
+// file whose contents repeat pattern, so that every compressed span fits in a
+// pooled buffer of the span size.
+func newBufferPoolTestSpanManager(t testing.TB, pattern string, pool *BufferPool) (*SpanManager, *ztoc.Ztoc, []byte) {
+	content := bytes.Repeat([]byte(pattern), 4*bufferPoolTestSpanSize/len(pattern))
+	toc, r, err := ztoc.BuildZtocReader(nil, []testutil.TarEntry{
+		testutil.File("data", string(content)),
+	}, gzip.DefaultCompression, bufferPoolTestSpanSize)
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	m := New(toc, r, cache.NewMemoryCache(), 0)
+	m.SetBufferPool(pool)
+	return m, toc, content
+}
+
+func TestBufferPoolClearsBuffers(t *testing.T) {
+	const size = 64
+	p := NewBufferPool(size)
+	for range 10 {
+		b := p.get(size)
+		for i := range b {
+			if b[i] != 0 {
+				t.Fatalf("buffer from pool contains data of a previous fetch at %d", i)
+			}
+		}
+		copy(b, bytes.Repeat([]byte{0xaa}, size))
+		p.put(b)
+
+		// A smaller buffer from the pool must not expose data beyond its length either.
+		b = p.get(size / 2)
+		if full := b[:cap(b)]; !bytes.Equal(full, make([]byte, len(full))) {
+			t.Fatalf("buffer from pool contains data of a previous fetch")
+		}
+		p.put(b)
+	}
+
+	if b := p.get(2 * size); len(b) != 2*size {
+		t.Fatalf("expected a buffer of %d bytes for a span larger than the pool; got %d", 2*size, len(b))
+	}
+	if NewBufferPool(0) != nil {
+		t.Fatalf("expected no pool for size 0")
+	}
+}
+
+func TestSharedBufferPool(t *testing.T) {
+	// Layers of different images share the pool, so the spans of one must never
+	// show up in the reads of the other.
+	pool := NewBufferPool(bufferPoolTestSpanSize)
+	a, tocA, contentA := newBufferPoolTestSpanManager(t, "image a ", pool)
+	b, tocB, contentB := newBufferPoolTestSpanManager(t, "IMAGE B!", pool)
+
+	// Spans fetched in the background are read back into pooled buffers to be uncompressed.
+	if err := b.FetchSingleSpan(1); err != nil {
+		t.Fatalf("failed to fetch span: %v", err)
+	}
+	for _, tc := range []struct {
+		m       *SpanManager
+		toc     *ztoc.Ztoc
+		content []byte
+	}{{a, tocA, contentA}, {b, tocB, contentB}, {a, tocA, contentA}} {
+		got, err := getFileContentFromSpans(tc.m, tc.toc, "data")
+		if err != nil {
+			t.Fatalf("failed to read contents: %v", err)
+		}
+		if !bytes.Equal(got, tc.content) {
+			t.Fatalf("unexpected contents read through the shared buffer pool")
+		}
+	}
+}
+
+func TestBufferPoolReducesAllocations(t *testing.T) {
+	fetch := func(m *SpanManager) func() {
+		return func() {
+			buf, err := m.fetchSpanWithRetries(0)
+			if err != nil {
+				t.Fatalf("failed to fetch span: %v", err)
+			}
+			m.bufPool.put(buf)
+		}
+	}
+	unpooled, _, _ := newBufferPoolTestSpanManager(t, "unpooled", nil)
+	pooled, _, _ := newBufferPoolTestSpanManager(t, "pooled!!", NewBufferPool(bufferPoolTestSpanSize))
+	unpooledAllocs := testing.AllocsPerRun(100, fetch(unpooled))
+	pooledAllocs := testing.AllocsPerRun(100, fetch(pooled))
+	if pooledAllocs >= unpooledAllocs {
+		t.Fatalf("expected fewer allocations per fetch with a buffer pool; got %v with and %v without", pooledAllocs, unpooledAllocs)
+	}
+}
+
+func BenchmarkFetchSpan(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		pool *BufferPool
+	}{
+		{"unpooled", nil},
+		{"pooled", NewBufferPool(bufferPoolTestSpanSize)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			m, _, _ := newBufferPoolTestSpanManager(b, "benchmark", bc.pool)
+			b.ReportAllocs()
+			for b.Loop() {
+				buf, err := m.fetchSpanWithRetries(0)
+				if err != nil {
+					b.Fatalf("failed to fetch span: %v", err)
+				}
+				m.bufPool.put(buf)
+			}
+		})
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 )
@@ -54,9 +55,10 @@ var stateTransitionMap = map[spanState][]spanState{
 		requested,
 	},
 	requested: {
-		// when a span fetch fails; change back to unrequested so other goroutines can request again
+		// when a span fetch fails or the cache has paused writes; change back to unrequested so other goroutines can request again
 		unrequested,
-		// when bg-fetcher fetches and caches compressed span
+		// when bg-fetcher fetches and caches compressed span, or the span is fetched
+		// along with a preceding span in a span group
 		fetched,
 		// when span data request comes; span is fetched, uncompressed and cached
 		uncompressed,
@@ -64,6 +66,12 @@ var stateTransitionMap = map[spanState][]spanState{
 	fetched: {
 		// when span data request comes and span is fetched by bg-fetcher; compressed span is available in cache
 		uncompressed,
+		// when the cached span is found corrupt; it is fetched again on the next read
+		unrequested,
+	},
+	uncompressed: {
+		// when the cached span is invalidated; it is fetched again on the next read
+		unrequested,
 	},
 }
 
@@ -75,6 +83,13 @@ type span struct {
 	endUncompOffset   compression.Offset
 	state             atomic.Value
 	mu                sync.Mutex
+	// lastAccess is the last time, in nanoseconds since the Unix epoch,
+	// the span was cached or read from the cache.
+	lastAccess atomic.Int64
+}
+
+func (s *span) touch() {
+	s.lastAccess.Store(time.Now().UnixNano())
 }
 
 func (s *span) checkState(expected spanState) bool {
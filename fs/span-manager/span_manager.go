@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"io"
 	"runtime"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/cache"
 	"github.com/awslabs/soci-snapshotter/util/ioutils"
@@ -38,8 +39,34 @@ var (
 	ErrSpanNotAvailable    = errors.New("span not available in cache")
 	ErrIncorrectSpanDigest = errors.New("span digests do not match")
 	ErrExceedMaxSpan       = errors.New("span id larger than max span id")
+
+	ErrUnknownCacheWriteFailureMode = errors.New("unknown cache write failure mode")
 )
 
+// CacheWriteFailureMode defines how reads behave when a fetched span can't be written to the cache.
+type CacheWriteFailureMode string
+
+const (
+	// CacheWriteFailureModeFailOpen serves the fetched span without caching it.
+	// The span is fetched again the next time it is read.
+	CacheWriteFailureModeFailOpen CacheWriteFailureMode = "fail-open"
+	// CacheWriteFailureModeFailClosed fails the read.
+	CacheWriteFailureModeFailClosed CacheWriteFailureMode = "fail-closed"
+)
+
+// ParseCacheWriteFailureMode parses a CacheWriteFailureMode. An empty string
+// is parsed as the default CacheWriteFailureModeFailOpen.
+func ParseCacheWriteFailureMode(s string) (CacheWriteFailureMode, error) {
+	switch mode := CacheWriteFailureMode(s); mode {
+	case "":
+		return CacheWriteFailureModeFailOpen, nil
+	case CacheWriteFailureModeFailOpen, CacheWriteFailureModeFailClosed:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownCacheWriteFailureMode, s)
+	}
+}
+
 // SpanManager fetches and caches spans of a given layer.
 type SpanManager struct {
 	cache                             cache.BlobCache
@@ -49,6 +76,29 @@ type SpanManager struct {
 	spans                             []*span
 	ztoc                              *ztoc.Ztoc
 	maxSpanVerificationFailureRetries int
+	cacheWriteFailureMode             CacheWriteFailureMode
+	bufPool                           *BufferPool
+	// onCorruption is called with the ID of each span found corrupt,
+	// either when it is fetched or when it is read from the cache.
+	onCorruption func(compression.SpanID)
+	// spanGroupSize is the maximum number of consecutive spans fetched with a
+	// single request when a span is read. Values <= 1 fetch spans one by one.
+	spanGroupSize int
+}
+
+// CachedSpan describes a span whose contents are cached.
+type CachedSpan struct {
+	ID compression.SpanID `json:"id"`
+	// StartCompressedOffset and EndCompressedOffset are the range of the span in the layer blob.
+	StartCompressedOffset compression.Offset `json:"start_compressed_offset"`
+	EndCompressedOffset   compression.Offset `json:"end_compressed_offset"`
+	// Size is the size of the cached contents in bytes. Spans fetched in the background
+	// are cached compressed until they are first read, then they are cached uncompressed.
+	Size int64 `json:"size"`
+	// Uncompressed is whether the cached contents are uncompressed.
+	Uncompressed bool `json:"uncompressed"`
+	// LastAccess is the last time the span was cached or read from the cache.
+	LastAccess time.Time `json:"last_access"`
 }
 
 type spanInfo struct {
@@ -94,6 +144,7 @@ func New(ztoc *ztoc.Ztoc, r *io.SectionReader, cache cache.BlobCache, retries in
 		spans:                             spans,
 		ztoc:                              ztoc,
 		maxSpanVerificationFailureRetries: retries,
+		cacheWriteFailureMode:             CacheWriteFailureModeFailOpen,
 	}
 	if m.maxSpanVerificationFailureRetries < 0 {
 		m.maxSpanVerificationFailureRetries = defaultSpanVerificationFailureRetries
@@ -143,8 +194,28 @@ func (m *SpanManager) FetchSingleSpan(spanID compression.SpanID) error {
 		return nil
 	}
 
-	_, err := m.fetchAndCacheSpan(spanID, false)
-	return err
+	buf, err := m.fetchAndCacheSpan(spanID, false)
+	if err != nil {
+		return err
+	}
+	m.bufPool.put(buf)
+	return nil
+}
+
+// FetchAllSpans fetches every span that isn't cached or being fetched yet into the cache,
+// like FetchSingleSpan. It returns the number of spans it fetched.
+func (m *SpanManager) FetchAllSpans() (int, error) {
+	var fetched int
+	for id := compression.SpanID(0); id <= m.ztoc.MaxSpanID; id++ {
+		if !m.spans[id].checkState(unrequested) {
+			continue
+		}
+		if err := m.FetchSingleSpan(id); err != nil {
+			return fetched, fmt.Errorf("failed to fetch span %d: %w", id, err)
+		}
+		fetched++
+	}
+	return fetched, nil
 }
 
 // resolveSpan ensures the span exists in cache and is uncompressed by calling
@@ -159,24 +230,65 @@ func (m *SpanManager) resolveSpan(spanID compression.SpanID) error {
 	return err
 }
 
+// IsCached returns whether the requested contents can be served without fetching
+// from the remote, i.e. whether every span they cover is already cached.
+func (m *SpanManager) IsCached(startUncompOffset, endUncompOffset compression.Offset) bool {
+	if endUncompOffset <= startUncompOffset {
+		return true
+	}
+	spanStart, spanEnd := m.spanRange(startUncompOffset, endUncompOffset)
+	for i := spanStart; i <= spanEnd && i <= m.ztoc.MaxSpanID; i++ {
+		s := m.spans[i]
+		if !s.checkState(fetched) && !s.checkState(uncompressed) {
+			return false
+		}
+	}
+	return true
+}
+
+// CachedSpanCount returns the number of spans covering the uncompressed range
+// [startUncompOffset, endUncompOffset) and how many of them are cached.
+func (m *SpanManager) CachedSpanCount(startUncompOffset, endUncompOffset compression.Offset) (spans, cached int) {
+	if endUncompOffset <= startUncompOffset {
+		return 0, 0
+	}
+	spanStart, spanEnd := m.spanRange(startUncompOffset, endUncompOffset)
+	for i := spanStart; i <= spanEnd && i <= m.ztoc.MaxSpanID; i++ {
+		spans++
+		if s := m.spans[i]; s.checkState(fetched) || s.checkState(uncompressed) {
+			cached++
+		}
+	}
+	return spans, cached
+}
+
 // GetContents returns a reader for the requested contents. The contents may be
-// across multiple spans.
+// across multiple spans. Cached spans are served from the cache and only the
+// missing spans are fetched, so a partially cached read doesn't fetch it all again.
 func (m *SpanManager) GetContents(startUncompOffset, endUncompOffset compression.Offset) (io.ReadCloser, error) {
+	if endUncompOffset <= startUncompOffset {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
 	si := m.getSpanInfo(startUncompOffset, endUncompOffset)
 	numSpans := si.spanEnd - si.spanStart + 1
 	spanReaders := make([]io.ReadCloser, numSpans)
 
+	// When spans are grouped, each group is read by a single goroutine so the
+	// first span of the group fetches the rest of it in the same request.
+	step := compression.SpanID(max(m.spanGroupSize, 1))
 	eg, _ := errgroup.WithContext(context.Background())
 	var i compression.SpanID
-	for i = 0; i < numSpans; i++ {
-		j := i
+	for i = 0; i < numSpans; i += step {
+		first := i
 		eg.Go(func() error {
-			spanID := j + si.spanStart
-			r, err := m.getSpanContent(spanID, si.startOffInSpan[j], si.endOffInSpan[j])
-			if err != nil {
-				return err
+			for j := first; j < min(first+step, numSpans); j++ {
+				spanID := j + si.spanStart
+				r, err := m.getSpanContent(spanID, si.startOffInSpan[j], si.endOffInSpan[j])
+				if err != nil {
+					return err
+				}
+				spanReaders[j] = r
 			}
-			spanReaders[j] = r
 			return nil
 		})
 	}
@@ -186,10 +298,45 @@ func (m *SpanManager) GetContents(startUncompOffset, endUncompOffset compression
 	return ioutils.NewMultiReadCloser(spanReaders), nil
 }
 
+// CachedSpans returns the spans whose contents are cached, ordered by span ID.
+func (m *SpanManager) CachedSpans() []CachedSpan {
+	var spans []CachedSpan
+	for _, s := range m.spans {
+		cs := CachedSpan{
+			ID:                    s.id,
+			StartCompressedOffset: s.startCompOffset,
+			EndCompressedOffset:   s.endCompOffset,
+			LastAccess:            time.Unix(0, s.lastAccess.Load()),
+		}
+		switch {
+		case s.checkState(fetched):
+			cs.Size = int64(s.endCompOffset - s.startCompOffset)
+		case s.checkState(uncompressed):
+			cs.Size = int64(s.endUncompOffset - s.startUncompOffset)
+			cs.Uncompressed = true
+		default:
+			continue
+		}
+		spans = append(spans, cs)
+	}
+	return spans
+}
+
+// spanRange returns the first and last spans covering the uncompressed range
+// [offsetStart, offsetEnd). offsetEnd is exclusive, so a range ending on a span
+// boundary doesn't include the following span.
+func (m *SpanManager) spanRange(offsetStart, offsetEnd compression.Offset) (compression.SpanID, compression.SpanID) {
+	spanStart := m.zinfo.UncompressedOffsetToSpanID(offsetStart)
+	spanEnd := spanStart
+	if offsetEnd > offsetStart {
+		spanEnd = m.zinfo.UncompressedOffsetToSpanID(offsetEnd - 1)
+	}
+	return spanStart, spanEnd
+}
+
 // getSpanInfo returns spanInfo from the offsets of the requested file
 func (m *SpanManager) getSpanInfo(offsetStart, offsetEnd compression.Offset) *spanInfo {
-	spanStart := m.zinfo.UncompressedOffsetToSpanID(offsetStart)
-	spanEnd := m.zinfo.UncompressedOffsetToSpanID(offsetEnd)
+	spanStart, spanEnd := m.spanRange(offsetStart, offsetEnd)
 	numSpans := spanEnd - spanStart + 1
 	start := make([]compression.Offset, numSpans)
 	end := make([]compression.Offset, numSpans)
@@ -225,9 +372,11 @@ func (m *SpanManager) getSpanInfo(offsetStart, offsetEnd compression.Offset) *sp
 // which is returned as an `io.Reader`.
 //
 // It resolves the span to ensure it exists and is uncompressed in cache:
-//  1. For `uncompressed` span, directly return the reader from the cache.
+//  1. For `uncompressed` span, directly return the reader from the cache. If the span
+//     was evicted from the cache, it is handled like an `unrequested` span.
 //  2. For `fetched` span, read and uncompress the compressed span from cache, cache and
-//     return the reader from the uncompressed span.
+//     return the reader from the uncompressed span. If the cached span is corrupt or
+//     was evicted, it is handled like an `unrequested` span.
 //  3. For `unrequested` span, fetch-uncompress-cache the span data, return the reader
 //     from the uncompressed span
 //  4. No span state lock will be acquired in `requested` state.
@@ -237,46 +386,43 @@ func (m *SpanManager) getSpanContent(spanID compression.SpanID, offsetStart, off
 
 	// return from cache directly if cached and uncompressed
 	if s.checkState(uncompressed) {
-		return m.getSpanFromCache(s.id, offsetStart, size)
+		r, err := m.getSpanFromCache(s.id, offsetStart, size)
+		if !errors.Is(err, ErrSpanNotAvailable) {
+			return r, err
+		}
 	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	// check again after acquiring lock
 	if s.checkState(uncompressed) {
-		return m.getSpanFromCache(s.id, offsetStart, size)
-	}
-
-	// if cached but not uncompressed, uncompress and cache the span content
-	if s.checkState(fetched) {
-		// get compressed span from the cache
-		compressedSize := s.endCompOffset - s.startCompOffset
-		r, err := m.getSpanFromCache(s.id, 0, compressedSize)
-		if err != nil {
-			return nil, err
+		r, err := m.getSpanFromCache(s.id, offsetStart, size)
+		if !errors.Is(err, ErrSpanNotAvailable) {
+			return r, err
 		}
-		defer r.Close()
-
-		// read compressed span
-		compressedBuf, err := io.ReadAll(r)
-		if err != nil {
-			return nil, err
-		}
-
-		// uncompress span
-		uncompSpanBuf, err := m.uncompressSpan(s, compressedBuf)
-		if err != nil {
+		// The cache evicted the span, e.g. to release inodes; it is fetched again below.
+		log.L.WithError(err).Debugf("cached span %d is not available, fetching it again", s.id)
+		if err := s.setState(unrequested); err != nil {
 			return nil, err
 		}
+	}
 
-		// cache uncompressed span
-		if err := m.addSpanToCache(s.id, uncompSpanBuf); err != nil {
-			return nil, err
+	// if cached but not uncompressed, uncompress and cache the span content
+	if s.checkState(fetched) {
+		r, err := m.uncompressCachedSpan(s, offsetStart, size)
+		switch {
+		case errors.Is(err, ErrIncorrectSpanDigest):
+			// Only the corrupt span is evicted; it is fetched again below.
+			log.L.WithError(err).Warnf("cached span %d is corrupt, fetching it again", s.id)
+			m.reportCorruption(s.id)
+		case errors.Is(err, ErrSpanNotAvailable):
+			log.L.WithError(err).Debugf("cached span %d is not available, fetching it again", s.id)
+		default:
+			return r, err
 		}
-		if err := s.setState(uncompressed); err != nil {
+		if err := s.setState(unrequested); err != nil {
 			return nil, err
 		}
-		return io.NopCloser(bytes.NewReader(uncompSpanBuf[offsetStart : offsetStart+size])), nil
 	}
 
 	// fetch-uncompress-cache span: span state can only be `unrequested` since
@@ -289,6 +435,51 @@ func (m *SpanManager) getSpanContent(spanID compression.SpanID, offsetStart, off
 	return io.NopCloser(buf), nil
 }
 
+// uncompressCachedSpan reads the compressed span from the cache, uncompresses it and
+// caches the uncompressed span. It returns an error wrapping ErrIncorrectSpanDigest
+// if the cached span is corrupt. The caller must hold the span's state lock.
+func (m *SpanManager) uncompressCachedSpan(s *span, offsetStart, size compression.Offset) (io.ReadCloser, error) {
+	// get compressed span from the cache
+	compressedSize := s.endCompOffset - s.startCompOffset
+	r, err := m.getSpanFromCache(s.id, 0, compressedSize)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// read compressed span
+	compressedBuf := m.bufPool.get(int(compressedSize))
+	if _, err := io.ReadFull(r, compressedBuf); err != nil {
+		m.bufPool.put(compressedBuf)
+		return nil, err
+	}
+	// Verify the cached span, so that a corrupt cache entry is never served.
+	if err := m.verifySpanContents(compressedBuf, s.id); err != nil {
+		m.bufPool.put(compressedBuf)
+		return nil, err
+	}
+
+	// uncompress span
+	uncompSpanBuf, err := m.uncompressSpan(s, compressedBuf)
+	m.releaseCompressedBuf(compressedBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	// cache uncompressed span
+	if err := m.addSpanToCache(s.id, uncompSpanBuf); err != nil {
+		if !m.serveUncached(s.id, err) {
+			return nil, err
+		}
+		// Keep the compressed span and uncompress it again on the next read.
+		return io.NopCloser(bytes.NewReader(uncompSpanBuf[offsetStart : offsetStart+size])), nil
+	}
+	if err := s.setState(uncompressed); err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(uncompSpanBuf[offsetStart : offsetStart+size])), nil
+}
+
 // fetchAndCacheSpan fetches a span, uncompresses the span if `uncompress == true`,
 // caches and returns the span content. The span state is set to `fetched/uncompressed`,
 // depending on if `uncompress` is enabled.
@@ -309,7 +500,12 @@ func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bo
 	}()
 
 	// fetch compressed span
-	compressedBuf, err := m.fetchSpanWithRetries(spanID)
+	var compressedBuf []byte
+	if uncompress && m.spanGroupSize > 1 {
+		compressedBuf, err = m.fetchSpanGroup(spanID)
+	} else {
+		compressedBuf, err = m.fetchSpanWithRetries(spanID)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -320,6 +516,7 @@ func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bo
 	if uncompress {
 		// uncompress span
 		uncompSpanBuf, err := m.uncompressSpan(s, compressedBuf)
+		m.releaseCompressedBuf(compressedBuf)
 		if err != nil {
 			return nil, err
 		}
@@ -329,11 +526,20 @@ func (m *SpanManager) fetchAndCacheSpan(spanID compression.SpanID, uncompress bo
 
 	// cache span data
 	if err := m.addSpanToCache(spanID, buf); err != nil {
-		return nil, err
+		if !m.serveUncached(spanID, err) {
+			return nil, err
+		}
+		// Serve the span without caching it so that it is fetched
+		// again the next time it is needed.
+		if err := s.setState(unrequested); err != nil {
+			return nil, err
+		}
+		return buf, nil
 	}
 	if err := s.setState(state); err != nil {
 		return nil, err
 	}
+	s.touch()
 	return buf, nil
 }
 
@@ -345,7 +551,7 @@ func (m *SpanManager) fetchSpanWithRetries(spanID compression.SpanID) ([]byte, e
 	s := m.spans[spanID]
 	offset := s.startCompOffset
 	compressedSize := s.endCompOffset - s.startCompOffset
-	compressedBuf := make([]byte, compressedSize)
+	compressedBuf := m.bufPool.get(int(compressedSize))
 
 	var (
 		err error
@@ -356,20 +562,105 @@ func (m *SpanManager) fetchSpanWithRetries(spanID compression.SpanID) ([]byte, e
 		// if the n = len(p) bytes returned by ReadAt are at the end of the input source,
 		// ReadAt may return either err == EOF or err == nil: https://pkg.go.dev/io#ReaderAt
 		if err != nil && err != io.EOF {
+			m.bufPool.put(compressedBuf)
 			return []byte{}, err
 		}
 
 		if n != len(compressedBuf) {
+			m.bufPool.put(compressedBuf)
 			return []byte{}, fmt.Errorf("unexpected data size for reading compressed span. read = %d, expected = %d", n, len(compressedBuf))
 		}
 
 		if err = m.verifySpanContents(compressedBuf, spanID); err == nil {
 			return compressedBuf, nil
 		}
+		m.reportCorruption(spanID)
 	}
+	m.bufPool.put(compressedBuf)
 	return []byte{}, err
 }
 
+// fetchSpanGroup fetches the span together with the unrequested spans following it,
+// up to m.spanGroupSize spans, with a single request. The following spans are cached
+// compressed, like spans fetched in the background, so that reading them doesn't
+// fetch them again. It returns the compressed contents of the span.
+// The caller must hold the span's state lock.
+func (m *SpanManager) fetchSpanGroup(spanID compression.SpanID) ([]byte, error) {
+	// Spans locked by other goroutines end the group, so that spans are never fetched
+	// twice and goroutines never wait on each other's spans.
+	var group []*span
+	for id := spanID + 1; id <= m.ztoc.MaxSpanID && len(group)+1 < m.spanGroupSize; id++ {
+		s := m.spans[id]
+		if !s.mu.TryLock() {
+			break
+		}
+		if !s.checkState(unrequested) {
+			s.mu.Unlock()
+			break
+		}
+		group = append(group, s)
+	}
+	defer func() {
+		for _, s := range group {
+			s.mu.Unlock()
+		}
+	}()
+	if len(group) == 0 {
+		return m.fetchSpanWithRetries(spanID)
+	}
+
+	first, last := m.spans[spanID], group[len(group)-1]
+	buf := make([]byte, last.endCompOffset-first.startCompOffset)
+	n, err := m.r.ReadAt(buf, int64(first.startCompOffset))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n != len(buf) {
+		return nil, fmt.Errorf("unexpected data size for reading span group. read = %d, expected = %d", n, len(buf))
+	}
+	for _, s := range group {
+		m.cacheGroupedSpan(s, buf[s.startCompOffset-first.startCompOffset:s.endCompOffset-first.startCompOffset])
+	}
+
+	size := first.endCompOffset - first.startCompOffset
+	compressedBuf := buf[:size:size]
+	if err := m.verifySpanContents(compressedBuf, spanID); err != nil {
+		m.reportCorruption(spanID)
+		return m.fetchSpanWithRetries(spanID)
+	}
+	return compressedBuf, nil
+}
+
+// cacheGroupedSpan caches the compressed contents of a span fetched in a span group.
+// Spans that can't be verified or cached are left unrequested, so that they are
+// fetched again when they are read. The caller must hold the span's state lock.
+func (m *SpanManager) cacheGroupedSpan(s *span, compressedBuf []byte) {
+	if err := m.verifySpanContents(compressedBuf, s.id); err != nil {
+		m.reportCorruption(s.id)
+		return
+	}
+	if err := s.setState(requested); err != nil {
+		return
+	}
+	if err := m.addSpanToCache(s.id, compressedBuf); err != nil {
+		log.L.WithError(err).Debugf("failed to cache span %d fetched in a span group", s.id)
+		s.setState(unrequested)
+		return
+	}
+	s.setState(fetched)
+	s.touch()
+}
+
+// releaseCompressedBuf returns the buffer a compressed span was read into to the
+// buffer pool once the span is uncompressed. Only gzip spans are uncompressed into a
+// new buffer; spans of uncompressed layers are served straight from the fetched one.
+func (m *SpanManager) releaseCompressedBuf(compressedBuf []byte) {
+	if m.ztoc.CompressionAlgorithm != compression.Gzip {
+		return
+	}
+	m.bufPool.put(compressedBuf)
+}
+
 // uncompressSpan uses zinfo to extract uncompressed span data from compressed
 // span data.
 func (m *SpanManager) uncompressSpan(s *span, compressedBuf []byte) ([]byte, error) {
@@ -402,8 +693,73 @@ func (m *SpanManager) addSpanToCache(spanID compression.SpanID, contents []byte)
 		return err
 	}
 
-	w.Commit()
-	return nil
+	return w.Commit()
+}
+
+// serveUncached returns whether a span that failed to be written to the cache
+// with err should still be served.
+func (m *SpanManager) serveUncached(spanID compression.SpanID, err error) bool {
+	// Cache writes are intentionally paused; this is not a failure.
+	if errors.Is(err, cache.ErrLowFreeInodes) {
+		return true
+	}
+	if m.cacheWriteFailureMode == CacheWriteFailureModeFailClosed {
+		return false
+	}
+	log.L.WithError(err).Warnf("failed to cache span %d, serving it without caching", spanID)
+	return true
+}
+
+// SetBufferPool sets the pool that compressed spans are fetched into.
+// It must be called before the SpanManager is used.
+func (m *SpanManager) SetBufferPool(p *BufferPool) {
+	m.bufPool = p
+}
+
+// SetCorruptionHandler sets a function called with the ID of each span that is
+// found corrupt, either when it is fetched or when it is read from the cache.
+// It must be called before the SpanManager is used.
+func (m *SpanManager) SetCorruptionHandler(fn func(compression.SpanID)) {
+	m.onCorruption = fn
+}
+
+// InvalidateSpan evicts the span from the cache, e.g. after it is found corrupt,
+// so that it is fetched again the next time it is read. Other spans are unaffected.
+func (m *SpanManager) InvalidateSpan(spanID compression.SpanID) error {
+	if spanID > m.ztoc.MaxSpanID {
+		return ErrExceedMaxSpan
+	}
+	s := m.spans[spanID]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.checkState(fetched) && !s.checkState(uncompressed) {
+		return nil
+	}
+	return s.setState(unrequested)
+}
+
+func (m *SpanManager) reportCorruption(spanID compression.SpanID) {
+	if m.onCorruption != nil {
+		m.onCorruption(spanID)
+	}
+}
+
+// SpanSize returns the uncompressed size of the spans of the layer.
+func (m *SpanManager) SpanSize() compression.Offset {
+	return m.zinfo.SpanSize()
+}
+
+// SetSpanGroupSize makes reads fetch up to n consecutive spans with a single request,
+// which bounds the number of requests for layers indexed with small spans.
+// It must be called before the SpanManager is used.
+func (m *SpanManager) SetSpanGroupSize(n int) {
+	m.spanGroupSize = n
+}
+
+// SetCacheWriteFailureMode sets how reads behave when a fetched span can't be
+// written to the cache. It must be called before the SpanManager is used.
+func (m *SpanManager) SetCacheWriteFailureMode(mode CacheWriteFailureMode) {
+	m.cacheWriteFailureMode = mode
 }
 
 // getSpanFromCache returns the cached span content as an `io.Reader`.
@@ -414,6 +770,7 @@ func (m *SpanManager) getSpanFromCache(spanID compression.SpanID, offset, size c
 	if err != nil {
 		return nil, fmt.Errorf("%w: %w", ErrSpanNotAvailable, err)
 	}
+	m.spans[spanID].touch()
 	return ioutils.NewSectionReadCloser(io.NewSectionReader(rc, int64(offset), int64(size)), rc), nil
 }
 
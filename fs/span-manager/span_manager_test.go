@@ -22,6 +22,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/awslabs/soci-snapshotter/cache"
@@ -175,6 +178,245 @@ func TestSpanManagerCache(t *testing.T) {
 	}
 }
 
+func TestGetContentsPartiallyCached(t *testing.T) {
+	tRand := testutil.NewTestRand(t)
+	var spanSize compression.Offset = 65536 // 64 KiB
+	const numSpans = 6
+	fileName := "partially-cached"
+	content := tRand.RandomByteData(int64(spanSize) * numSpans)
+	tarEntries := []testutil.TarEntry{
+		testutil.File(fileName, string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+
+	var (
+		mu      sync.Mutex
+		fetched []int64
+	)
+	sr := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+		mu.Lock()
+		fetched = append(fetched, off)
+		mu.Unlock()
+		return r.ReadAt(b, off)
+	}), 0, r.Size())
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m := New(toc, sr, cache, 0)
+
+	// Cache every other span of the file.
+	entry, err := toc.GetMetadataEntry(fileName)
+	if err != nil {
+		t.Fatalf("failed to get file metadata: %v", err)
+	}
+	si := m.getSpanInfo(entry.UncompressedOffset, entry.UncompressedOffset+entry.UncompressedSize)
+	var cached, missing []int64
+	for i := si.spanStart; i <= si.spanEnd; i++ {
+		if i%2 == 0 {
+			if err := m.resolveSpan(i); err != nil {
+				t.Fatalf("failed to resolve span %d: %v", i, err)
+			}
+			cached = append(cached, int64(m.spans[i].startCompOffset))
+		} else {
+			missing = append(missing, int64(m.spans[i].startCompOffset))
+		}
+	}
+	if len(missing) == 0 {
+		t.Fatalf("expected the file to cover multiple spans")
+	}
+	mu.Lock()
+	fetched = nil
+	mu.Unlock()
+
+	// Reading the whole file only fetches the missing spans,
+	// and stitches them together with the cached ones in order.
+	fileContent, err := getFileContentFromSpans(m, toc, fileName)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if !bytes.Equal(content, fileContent) {
+		t.Fatalf("file contents are not the same as span contents")
+	}
+	sort.Slice(fetched, func(i, j int) bool { return fetched[i] < fetched[j] })
+	if fmt.Sprint(fetched) != fmt.Sprint(missing) {
+		t.Fatalf("expected only the missing spans at offsets %v to be fetched; fetched %v (cached %v)", missing, fetched, cached)
+	}
+}
+
+func TestGetContentsDegenerateReads(t *testing.T) {
+	tRand := testutil.NewTestRand(t)
+	var spanSize compression.Offset = 65536 // 64 KiB
+	fileName := "degenerate"
+	content := tRand.RandomByteData(int64(spanSize) * 3)
+	tarEntries := []testutil.TarEntry{
+		testutil.File(fileName, string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	entry, err := toc.GetMetadataEntry(fileName)
+	if err != nil {
+		t.Fatalf("failed to get file metadata: %v", err)
+	}
+	fileStart := entry.UncompressedOffset
+	fileEnd := fileStart + entry.UncompressedSize
+
+	testCases := []struct {
+		name string
+		// start and end are relative to the start of the file.
+		start, end      compression.Offset
+		expectedFetches int
+	}{
+		{
+			name:            "zero length",
+			start:           0,
+			end:             0,
+			expectedFetches: 0,
+		},
+		{
+			name:            "zero length at EOF",
+			start:           entry.UncompressedSize,
+			end:             entry.UncompressedSize,
+			expectedFetches: 0,
+		},
+		{
+			name:            "1 byte at offset 0",
+			start:           0,
+			end:             1,
+			expectedFetches: 1,
+		},
+		{
+			name:            "1 byte at EOF",
+			start:           entry.UncompressedSize - 1,
+			end:             entry.UncompressedSize,
+			expectedFetches: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var fetches atomic.Int64
+			sr := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+				fetches.Add(1)
+				return r.ReadAt(b, off)
+			}), 0, r.Size())
+			cache := cache.NewMemoryCache()
+			defer cache.Close()
+			m := New(toc, sr, cache, 0)
+
+			rc, err := m.GetContents(fileStart+tc.start, fileStart+tc.end)
+			if err != nil {
+				t.Fatalf("failed to get contents: %v", err)
+			}
+			defer rc.Close()
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("failed to read contents: %v", err)
+			}
+			if !bytes.Equal(got, content[tc.start:tc.end]) {
+				t.Fatalf("expected %d bytes at %d; got %d different bytes", tc.end-tc.start, tc.start, len(got))
+			}
+			if n := fetches.Load(); n != int64(tc.expectedFetches) {
+				t.Fatalf("expected %d span fetches; got %d", tc.expectedFetches, n)
+			}
+		})
+	}
+
+	// A read ending on a span boundary doesn't fetch the following span.
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m := New(toc, r, cache, 0)
+	boundary := m.spans[m.zinfo.UncompressedOffsetToSpanID(fileStart)].endUncompOffset
+	if boundary >= fileEnd {
+		t.Fatalf("expected the file to cover multiple spans")
+	}
+	si := m.getSpanInfo(fileStart, boundary)
+	if si.spanStart != si.spanEnd {
+		t.Fatalf("expected a read ending on a span boundary to cover a single span; got spans %d to %d", si.spanStart, si.spanEnd)
+	}
+	if !m.IsCached(boundary, boundary) {
+		t.Fatalf("expected an empty range to be cached")
+	}
+}
+
+func TestSpanGrouping(t *testing.T) {
+	const groupSize = 4
+	tRand := testutil.NewTestRand(t)
+	var spanSize compression.Offset = 65536 // 64 KiB
+	content := tRand.RandomByteData(int64(spanSize) * 10)
+	tarEntries := []testutil.TarEntry{
+		testutil.File("grouped", string(content)),
+	}
+	toc, r, err := ztoc.BuildZtocReader(t, tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	numSpans := int64(toc.MaxSpanID) + 1
+
+	var fetches atomic.Int64
+	sr := io.NewSectionReader(readerFn(func(b []byte, off int64) (int, error) {
+		fetches.Add(1)
+		return r.ReadAt(b, off)
+	}), 0, r.Size())
+	cache := cache.NewMemoryCache()
+	defer cache.Close()
+	m := New(toc, sr, cache, 0)
+	m.SetSpanGroupSize(groupSize)
+
+	readSpan := func(spanID compression.SpanID) {
+		s := m.spans[spanID]
+		rc, err := m.GetContents(s.startUncompOffset, s.endUncompOffset)
+		if err != nil {
+			t.Fatalf("failed to read span %d: %v", spanID, err)
+		}
+		defer rc.Close()
+		if _, err := io.Copy(io.Discard, rc); err != nil {
+			t.Fatalf("failed to read span %d: %v", spanID, err)
+		}
+	}
+
+	// Reading the first span fetches the rest of its group with the same request.
+	readSpan(0)
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected 1 fetch; got %d", n)
+	}
+	for id := compression.SpanID(1); id < groupSize; id++ {
+		if !m.spans[id].checkState(fetched) {
+			t.Fatalf("expected span %d to be fetched with its group", id)
+		}
+	}
+	if !m.spans[groupSize].checkState(unrequested) {
+		t.Fatalf("expected span %d past the group to be unrequested", groupSize)
+	}
+	readSpan(1)
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("expected span fetched with its group to be read from the cache; got %d fetches", n)
+	}
+
+	// Reading the whole layer fetches the remaining spans in groups.
+	rc, err := m.GetContents(0, toc.UncompressedArchiveSize)
+	if err != nil {
+		t.Fatalf("failed to get contents: %v", err)
+	}
+	defer rc.Close()
+	if _, err := io.Copy(io.Discard, rc); err != nil {
+		t.Fatalf("failed to read contents: %v", err)
+	}
+	expected := 1 + (numSpans-groupSize+groupSize-1)/groupSize
+	if n := fetches.Load(); n != expected {
+		t.Fatalf("expected %d fetches for %d spans; got %d", expected, numSpans, n)
+	}
+	got, err := getFileContentFromSpans(m, toc, "grouped")
+	if err != nil {
+		t.Fatalf("failed to get file contents: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("unexpected file contents")
+	}
+}
+
 func TestStateTransition(t *testing.T) {
 	tRand := testutil.NewTestRand(t)
 	var spanSize compression.Offset = 65536 // 64 KiB
@@ -283,25 +525,25 @@ func TestValidateState(t *testing.T) {
 		{
 			name:         "span in Fetched state with valid new state",
 			currentState: fetched,
-			newState:     []spanState{uncompressed},
+			newState:     []spanState{uncompressed, unrequested},
 			expectedErr:  nil,
 		},
 		{
 			name:         "span in Fetched state with invalid new state",
 			currentState: fetched,
-			newState:     []spanState{unrequested, requested, fetched},
+			newState:     []spanState{requested, fetched},
 			expectedErr:  errInvalidSpanStateTransition,
 		},
 		{
 			name:         "span in Uncompressed state with valid new state",
 			currentState: uncompressed,
-			newState:     []spanState{},
+			newState:     []spanState{unrequested},
 			expectedErr:  nil,
 		},
 		{
 			name:         "span in Uncompressed state with invalid new state",
 			currentState: uncompressed,
-			newState:     []spanState{unrequested, requested, fetched, uncompressed},
+			newState:     []spanState{requested, fetched, uncompressed},
 			expectedErr:  errInvalidSpanStateTransition,
 		},
 	}
@@ -374,6 +616,98 @@ func TestSpanManagerRetries(t *testing.T) {
 	}
 }
 
+func TestCacheWriteFailureMode(t *testing.T) {
+	errCacheWrite := errors.New("no space left on device")
+	testCases := []struct {
+		name        string
+		mode        CacheWriteFailureMode
+		expectedErr error
+	}{
+		{
+			name: "fail-open serves the span without caching",
+			mode: CacheWriteFailureModeFailOpen,
+		},
+		{
+			name:        "fail-closed fails the read",
+			mode:        CacheWriteFailureModeFailClosed,
+			expectedErr: errCacheWrite,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := testutil.NewTestRand(t)
+			fileContent := r.RandomByteData(1000000)
+			toc, sr, err := ztoc.BuildZtocReader(t, []testutil.TarEntry{testutil.File("test", string(fileContent))}, gzip.DefaultCompression, 100000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := New(toc, sr, &failingWriteCache{BlobCache: cache.NewMemoryCache(), err: errCacheWrite}, 0)
+			m.SetCacheWriteFailureMode(tc.mode)
+
+			content, err := getFileContentFromSpans(m, toc, "test")
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("unexpected err; expected %v, got %v", tc.expectedErr, err)
+			}
+			if tc.expectedErr != nil {
+				return
+			}
+			if !bytes.Equal(content, fileContent) {
+				t.Fatalf("unexpected file content")
+			}
+			for _, s := range m.spans {
+				if !s.checkState(unrequested) {
+					t.Fatalf("expected uncached span %d to be unrequested", s.id)
+				}
+			}
+			if err := m.FetchSingleSpan(0); err != nil {
+				t.Fatalf("failed to fetch span without caching: %v", err)
+			}
+		})
+	}
+
+	if _, err := ParseCacheWriteFailureMode("ignore"); !errors.Is(err, ErrUnknownCacheWriteFailureMode) {
+		t.Fatalf("expected %v; got %v", ErrUnknownCacheWriteFailureMode, err)
+	}
+	if mode, err := ParseCacheWriteFailureMode(""); err != nil || mode != CacheWriteFailureModeFailOpen {
+		t.Fatalf("expected default mode %q; got %q, %v", CacheWriteFailureModeFailOpen, mode, err)
+	}
+}
+
+func TestSpansEvictedFromCache(t *testing.T) {
+	r := testutil.NewTestRand(t)
+	fileContent := r.RandomByteData(1000000)
+	toc, sr, err := ztoc.BuildZtocReader(t, []testutil.TarEntry{testutil.File("test", string(fileContent))}, gzip.DefaultCompression, 100000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := cache.NewMemoryCache().(*cache.MemoryCache)
+	m := New(toc, sr, c, 0)
+	if _, err := getFileContentFromSpans(m, toc, "test"); err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+
+	// The cache evicts every span, e.g. to release inodes, so reads fetch them again.
+	c.Membuf = map[string]*bytes.Buffer{}
+	content, err := getFileContentFromSpans(m, toc, "test")
+	if err != nil {
+		t.Fatalf("failed to read file after the cache evicted its spans: %v", err)
+	}
+	if !bytes.Equal(content, fileContent) {
+		t.Fatalf("unexpected file content")
+	}
+}
+
+// A failingWriteCache fails every write with err.
+type failingWriteCache struct {
+	cache.BlobCache
+	err error
+}
+
+func (c *failingWriteCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	return nil, c.err
+}
+
 // A retryableReaderAt returns incorrect data to the caller maxErrors - 1 times.
 type retryableReaderAt struct {
 	inner     *io.SectionReader
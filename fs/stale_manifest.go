@@ -0,0 +1,152 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orasremote "oras.land/oras-go/v2/registry/remote"
+)
+
+// maxManifestBytes is the largest image manifest that is verified. Registries
+// aren't required to accept larger manifests.
+const maxManifestBytes = 4 << 20
+
+// ErrManifestDigestMismatch is returned when a registry host serves an image manifest
+// that doesn't match the digest it was requested by.
+var ErrManifestDigestMismatch = errors.New("image manifest digest mismatch")
+
+// newManifestStores returns a store for each of hosts to fetch image manifests from,
+// in the order of the configured mirrors followed by the registry. Manifests fetched
+// through them by digest are verified against the digest.
+func newManifestStores(refspec reference.Spec, client *http.Client, hosts []docker.RegistryHost) ([]*orasremote.Repository, error) {
+	if len(hosts) == 0 {
+		store, err := newHostRemoteStore(refspec, verifyingManifestClient(client), nil)
+		if err != nil {
+			return nil, err
+		}
+		return []*orasremote.Repository{store}, nil
+	}
+	stores := make([]*orasremote.Repository, 0, len(hosts))
+	for i := range hosts {
+		hostClient := hosts[i].Client
+		if hostClient == nil {
+			hostClient = client
+		}
+		store, err := newHostRemoteStore(refspec, verifyingManifestClient(hostClient), hosts[i:i+1])
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	return stores, nil
+}
+
+// fetchImageManifest fetches the image manifest with imgDigest from the first of stores
+// that serves it. A store serving a manifest that doesn't match imgDigest, e.g. a
+// pull-through mirror with a stale manifest cached for a mutable tag, is skipped if
+// staleManifestMode is config.StaleManifestModeFailover. Otherwise, ErrManifestDigestMismatch
+// is returned right away.
+func fetchImageManifest(ctx context.Context, imgDigest digest.Digest, stores []*orasremote.Repository, staleManifestMode string) (ocispec.Manifest, error) {
+	var mismatchErrs error
+	for _, store := range stores {
+		_, r, err := store.Manifests().FetchReference(ctx, imgDigest.String())
+		if errors.Is(err, ErrManifestDigestMismatch) {
+			log.G(ctx).WithError(err).WithField("host", store.Reference.Registry).Warn("registry host served a stale image manifest")
+			mismatchErrs = errors.Join(mismatchErrs, err)
+			if staleManifestMode == config.StaleManifestModeFailover {
+				continue
+			}
+			return ocispec.Manifest{}, fmt.Errorf("could not fetch manifest: %w", err)
+		}
+		if err != nil {
+			return ocispec.Manifest{}, fmt.Errorf("could not fetch manifest: %w", err)
+		}
+		var manifest ocispec.Manifest
+		err = json.NewDecoder(r).Decode(&manifest)
+		r.Close()
+		if err != nil {
+			return ocispec.Manifest{}, fmt.Errorf("could not unmarshal manifest: %w", err)
+		}
+		return manifest, nil
+	}
+	return ocispec.Manifest{}, fmt.Errorf("could not fetch manifest from any host: %w", mismatchErrs)
+}
+
+// verifyingManifestClient returns a copy of client that verifies manifests fetched
+// by digest against the digest.
+func verifyingManifestClient(client *http.Client) *http.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	inner := client.Transport
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	c := *client
+	c.Transport = &manifestDigestTransport{inner: inner}
+	return &c
+}
+
+// manifestDigestTransport verifies that manifests fetched by digest match the digest.
+// Manifests fetched by tag can't be verified and are passed through.
+type manifestDigestTransport struct {
+	inner http.RoundTripper
+}
+
+func (t *manifestDigestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil || req.Method != http.MethodGet || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	_, ref, ok := strings.Cut(req.URL.Path, "/manifests/")
+	if !ok {
+		return resp, nil
+	}
+	dgst, err := digest.Parse(ref)
+	if err != nil {
+		return resp, nil
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxManifestBytes+1))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxManifestBytes {
+		return nil, fmt.Errorf("manifest %v from %s exceeds %d bytes", dgst, req.URL.Host, maxManifestBytes)
+	}
+	if actual := dgst.Algorithm().FromBytes(b); actual != dgst {
+		return nil, fmt.Errorf("%w: %s served %v when %v was requested", ErrManifestDigestMismatch, req.URL.Host, actual, dgst)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(b))
+	resp.ContentLength = int64(len(b))
+	return resp, nil
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestStaleManifest(t *testing.T) {
+	newManifest := func(indexDigest digest.Digest) []byte {
+		b, err := json.Marshal(ocispec.Manifest{
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Annotations: map[string]string{soci.ImageAnnotationSociIndexDigest: indexDigest.String()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	// The mirror cached the manifest the tag pointed to before the image was
+	// pushed again with a new SOCI index.
+	var (
+		indexDigest    = digest.FromString("index")
+		manifest       = newManifest(indexDigest)
+		manifestDigest = digest.FromBytes(manifest)
+		staleManifest  = newManifest(digest.FromString("stale index"))
+	)
+	refspec, err := reference.Parse(imageRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newHost := func(body []byte) docker.RegistryHost {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasSuffix(r.URL.Path, "/manifests/"+manifestDigest.String()) {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+			w.Header().Set("Docker-Content-Digest", digest.FromBytes(body).String())
+			w.Write(body)
+		}))
+		t.Cleanup(srv.Close)
+		u, err := url.Parse(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return docker.RegistryHost{Client: srv.Client(), Host: u.Host, Scheme: "http", Path: "/v2"}
+	}
+	staleMirror := newHost(staleManifest)
+	origin := newHost(manifest)
+
+	tests := []struct {
+		name          string
+		hosts         []docker.RegistryHost
+		mode          string
+		expectedError error
+	}{
+		{
+			name:  "fails over from a stale mirror to the origin",
+			hosts: []docker.RegistryHost{staleMirror, origin},
+			mode:  config.StaleManifestModeFailover,
+		},
+		{
+			name:          "rejects a stale mirror in error mode",
+			hosts:         []docker.RegistryHost{staleMirror, origin},
+			mode:          config.StaleManifestModeError,
+			expectedError: ErrManifestDigestMismatch,
+		},
+		{
+			name:          "rejects a stale manifest without another host",
+			hosts:         []docker.RegistryHost{staleMirror},
+			mode:          config.StaleManifestModeFailover,
+			expectedError: ErrManifestDigestMismatch,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stores, err := newManifestStores(refspec, nil, tc.hosts)
+			if err != nil {
+				t.Fatalf("failed to create stores: %v", err)
+			}
+			desc, err := findSociIndexDescAnnotation(context.Background(), manifestDigest, stores, tc.mode)
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("expected error %v; got %v", tc.expectedError, err)
+			}
+			if tc.expectedError == nil && desc.Digest != indexDigest {
+				t.Fatalf("expected SOCI index %v; got %v", indexDigest, desc.Digest)
+			}
+		})
+	}
+}
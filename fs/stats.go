@@ -0,0 +1,202 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/fs/layer"
+	"github.com/awslabs/soci-snapshotter/fs/remote"
+	"github.com/containerd/log"
+	"github.com/opencontainers/go-digest"
+)
+
+// Stats are runtime stats of the filesystem, used to debug its performance.
+type Stats struct {
+	// Goroutines is the number of goroutines of the snapshotter.
+	Goroutines int `json:"goroutines"`
+	// ActiveMounts is the number of layers currently mounted.
+	ActiveMounts int `json:"active_mounts"`
+	// InFlightFetches is the number of blob regions currently being fetched from remote.
+	InFlightFetches int64 `json:"in_flight_fetches"`
+	// CacheSize is the number of bytes the layer caches take up on disk.
+	CacheSize int64 `json:"cache_size"`
+}
+
+func (fs *filesystem) stats() (Stats, error) {
+	fs.layerMu.Lock()
+	activeMounts := len(fs.layer)
+	fs.layerMu.Unlock()
+	cacheSize, err := fs.resolver.CacheSize()
+	if err != nil {
+		return Stats{}, err
+	}
+	return Stats{
+		Goroutines:      runtime.NumGoroutine(),
+		ActiveMounts:    activeMounts,
+		InFlightFetches: remote.InFlightFetches(),
+		CacheSize:       cacheSize,
+	}, nil
+}
+
+// StatsHandler serves the runtime stats of a filesystem as JSON.
+// It must be passed to NewFilesystem with WithStatsHandler; until then
+// it responds with 503 Service Unavailable.
+type StatsHandler struct {
+	mu sync.Mutex
+	fs *filesystem
+}
+
+// NewStatsHandler returns a StatsHandler.
+func NewStatsHandler() *StatsHandler {
+	return &StatsHandler{}
+}
+
+func (h *StatsHandler) setFilesystem(fs *filesystem) {
+	h.mu.Lock()
+	h.fs = fs
+	h.mu.Unlock()
+}
+
+func (h *StatsHandler) filesystem() *filesystem {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.fs
+}
+
+func (h *StatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	fs := h.filesystem()
+	if fs == nil {
+		http.Error(w, "filesystem isn't initialized yet", http.StatusServiceUnavailable)
+		return
+	}
+	stats, err := fs.stats()
+	if err != nil {
+		log.G(r.Context()).WithError(err).Warn("failed to get filesystem stats")
+		http.Error(w, "failed to get filesystem stats", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// MountUnfetchedFiles lists the files of a mounted layer that aren't entirely fetched yet.
+type MountUnfetchedFiles struct {
+	Mountpoint string                `json:"mountpoint"`
+	Digest     digest.Digest         `json:"digest"`
+	Files      []layer.UnfetchedFile `json:"files"`
+}
+
+// unfetchedFiles lists the files of at least minSize bytes that aren't entirely fetched
+// yet for each mounted layer, ordered by mountpoint.
+func (fs *filesystem) unfetchedFiles(minSize int64) ([]MountUnfetchedFiles, error) {
+	fs.layerMu.Lock()
+	layers := make(map[string]layer.Layer, len(fs.layer))
+	for mountpoint, l := range fs.layer {
+		layers[mountpoint] = l
+	}
+	fs.layerMu.Unlock()
+
+	mounts := make([]MountUnfetchedFiles, 0, len(layers))
+	for mountpoint, l := range layers {
+		files, err := l.UnfetchedFiles(minSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list unfetched files of %s: %w", mountpoint, err)
+		}
+		mounts = append(mounts, MountUnfetchedFiles{
+			Mountpoint: mountpoint,
+			Digest:     l.Info().Digest,
+			Files:      files,
+		})
+	}
+	sort.Slice(mounts, func(i, j int) bool {
+		return mounts[i].Mountpoint < mounts[j].Mountpoint
+	})
+	return mounts, nil
+}
+
+// UnfetchedFiles returns a handler serving, as JSON, the files of each mounted layer whose
+// contents aren't entirely fetched yet, so that operators can see what a workload hasn't
+// touched. The optional min_size query parameter only lists files of at least that many bytes.
+func (h *StatsHandler) UnfetchedFiles() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fs := h.filesystem()
+		if fs == nil {
+			http.Error(w, "filesystem isn't initialized yet", http.StatusServiceUnavailable)
+			return
+		}
+		var minSize int64
+		if v := r.URL.Query().Get("min_size"); v != "" {
+			var err error
+			minSize, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || minSize < 0 {
+				http.Error(w, fmt.Sprintf("invalid min_size %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+		mounts, err := fs.unfetchedFiles(minSize)
+		if err != nil {
+			log.G(r.Context()).WithError(err).Warn("failed to list unfetched files")
+			http.Error(w, "failed to list unfetched files", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(mounts)
+	})
+}
+
+// SpanCacheInventory returns a handler serving, as JSON, a page of the spans cached for the
+// resolved layers, so that external tooling can reconcile them against the spans that should
+// be cached. The optional limit query parameter bounds the number of spans of the page, and
+// the page_token query parameter takes the next_page_token of the previous page.
+func (h *StatsHandler) SpanCacheInventory() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fs := h.filesystem()
+		if fs == nil {
+			http.Error(w, "filesystem isn't initialized yet", http.StatusServiceUnavailable)
+			return
+		}
+		var limit int
+		if v := r.URL.Query().Get("limit"); v != "" {
+			var err error
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 0 {
+				http.Error(w, fmt.Sprintf("invalid limit %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+		inventory, err := fs.resolver.SpanCacheInventory(r.URL.Query().Get("page_token"), limit)
+		if err != nil {
+			if errors.Is(err, layer.ErrInvalidPageToken) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.G(r.Context()).WithError(err).Warn("failed to list cached spans")
+			http.Error(w, "failed to list cached spans", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(inventory)
+	})
+}
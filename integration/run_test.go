@@ -434,6 +434,36 @@ func TestRootFolderPermission(t *testing.T) {
 	}
 }
 
+// TestRunCopyUpLazyFile tests that modifying a file of a lazily pulled layer copies up
+// its original contents, even though they haven't been fetched yet.
+func TestRunCopyUpLazyFile(t *testing.T) {
+	const (
+		containerImage = alpineImage
+		file           = "/etc/ssl/certs/ca-certificates.crt"
+	)
+
+	regConfig := newRegistryConfig()
+	sh, done := newShellWithRegistry(t, regConfig)
+	defer done()
+
+	rebootContainerd(t, sh, getContainerdConfigToml(t, false), getSnapshotterConfigToml(t, withTCPMetrics, withDisableBgFetcher))
+	copyImage(sh, dockerhub(containerImage), regConfig.mirror(containerImage))
+	indexDigest := buildIndex(sh, regConfig.mirror(containerImage), withMinLayerSize(0), withSpanSize(64*1024))
+	sh.X("soci", "push", "--user", regConfig.creds(), regConfig.mirror(containerImage).ref)
+	sh.X(append(imagePullCmd, "--soci-index-digest", indexDigest, regConfig.mirror(containerImage).ref)...)
+	checkFuseMounts(t, sh, 1)
+
+	// Appending to the file copies it up before any of it has been read.
+	modified := sh.O(append(runSociCmd, "--rm", regConfig.mirror(containerImage).ref,
+		"sh", "-c", fmt.Sprintf("size=$(stat -c %%s %[1]s) && echo appended >> %[1]s && head -c $size %[1]s | sha256sum", file))...)
+	original := sh.O(append(runSociCmd, "--rm", regConfig.mirror(containerImage).ref, "sha256sum", file)...)
+	modifiedSum, _, _ := strings.Cut(string(modified), " ")
+	originalSum, _, _ := strings.Cut(string(original), " ")
+	if modifiedSum != originalSum {
+		t.Fatalf("expected the copied up file to start with the original contents of sha256 %s; got %s", originalSum, modifiedSum)
+	}
+}
+
 func TestRestartAfterSigint(t *testing.T) {
 	const containerImage = alpineImage
 	const killTimeout = 5
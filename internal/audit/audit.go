@@ -0,0 +1,189 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package audit records fetch retries and registry host failovers as structured
+// audit records, separately from the debug logs. Records never contain credentials:
+// URLs in failure reasons have their query values and passwords redacted, and
+// request headers are never recorded.
+package audit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	socihttp "github.com/awslabs/soci-snapshotter/internal/http"
+)
+
+// Event is the kind of an audit record.
+type Event string
+
+const (
+	// EventRetry is recorded when a request to a host failed and is retried.
+	EventRetry Event = "retry"
+	// EventFailover is recorded when a host failed and the next host is tried.
+	EventFailover Event = "failover"
+	// EventOutcome is recorded once the hosts were tried, with the host finally used, if any.
+	EventOutcome Event = "outcome"
+)
+
+const (
+	// OutcomeSuccess is the outcome of a request that was finally served by a host.
+	OutcomeSuccess = "success"
+	// OutcomeFailure is the outcome of a request that no host could serve.
+	OutcomeFailure = "failure"
+)
+
+// Record is an audit record.
+type Record struct {
+	Time time.Time `json:"time"`
+	// RequestID identifies the records of the same request, e.g. the resolution of a blob.
+	RequestID string `json:"request_id"`
+	Event     Event  `json:"event"`
+	// Host is the host that failed, or for outcomes, the host finally used.
+	Host string `json:"host,omitempty"`
+	// NextHost is the host tried after Host failed.
+	NextHost string `json:"next_host,omitempty"`
+	// Reason is why Host failed.
+	Reason  string `json:"reason,omitempty"`
+	Outcome string `json:"outcome,omitempty"`
+}
+
+// Emitter emits audit records. It must be safe for concurrent use.
+type Emitter interface {
+	Emit(Record)
+}
+
+// EmitterFunc is an Emitter calling the function for each record.
+type EmitterFunc func(Record)
+
+// Emit calls f(r).
+func (f EmitterFunc) Emit(r Record) {
+	f(r)
+}
+
+// emitter is the Emitter of the process. Records are discarded if it isn't set.
+var emitter atomic.Pointer[Emitter]
+
+// SetEmitter makes e receive all audit records. A nil e discards them.
+func SetEmitter(e Emitter) {
+	if e == nil {
+		emitter.Store(nil)
+		return
+	}
+	emitter.Store(&e)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying a new request ID for the audit records of
+// the request, unless ctx already carries one, so that nested operations, e.g. retries
+// of a failover attempt, are recorded with the ID of the request they are part of.
+func WithRequestID(ctx context.Context) context.Context {
+	if RequestID(ctx) != "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, rand.Text())
+}
+
+// RequestID returns the request ID carried by ctx, or "" if there's none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Retry records that a request to host failed because of err, or with status if err
+// is nil, and is retried.
+func Retry(ctx context.Context, host string, status int, err error) {
+	emit(ctx, Record{Event: EventRetry, Host: host, Reason: reason(status, err)})
+}
+
+// Failover records that host failed because of err and that next is tried instead.
+// next is empty if there are no more hosts to try.
+func Failover(ctx context.Context, host, next string, err error) {
+	emit(ctx, Record{Event: EventFailover, Host: host, NextHost: next, Reason: reason(0, err)})
+}
+
+// Outcome records the final outcome of a request: success if host served it,
+// or failure because of err otherwise.
+func Outcome(ctx context.Context, host string, err error) {
+	r := Record{Event: EventOutcome, Host: host, Outcome: OutcomeSuccess}
+	if err != nil {
+		r.Outcome = OutcomeFailure
+		r.Reason = reason(0, err)
+	}
+	emit(ctx, r)
+}
+
+func emit(ctx context.Context, r Record) {
+	e := emitter.Load()
+	if e == nil {
+		return
+	}
+	r.Time = time.Now().UTC()
+	r.RequestID = RequestID(ctx)
+	(*e).Emit(r)
+}
+
+// reason describes a failure without credentials.
+func reason(status int, err error) string {
+	if err != nil {
+		return socihttp.RedactHTTPQueryValuesFromError(err).Error()
+	}
+	if status != 0 {
+		return fmt.Sprintf("status %d", status)
+	}
+	return ""
+}
+
+// FileEmitter appends audit records to a file, one JSON-encoded Record per line.
+type FileEmitter struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// NewFileEmitter returns a FileEmitter appending to the file at path, which is
+// created if it doesn't exist. The file is only accessible to its owner.
+func NewFileEmitter(path string) (*FileEmitter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return &FileEmitter{f: f}, nil
+}
+
+// Emit appends r to the file. Records that can't be written are dropped.
+func (e *FileEmitter) Emit(r Record) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.f.Write(append(b, '\n'))
+}
+
+// Close closes the file.
+func (e *FileEmitter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.f.Close()
+}
@@ -0,0 +1,78 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileEmitter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	e, err := NewFileEmitter(path)
+	if err != nil {
+		t.Fatalf("failed to create file emitter: %v", err)
+	}
+	SetEmitter(e)
+	t.Cleanup(func() { SetEmitter(nil) })
+
+	ctx := WithRequestID(context.Background())
+	if nested := WithRequestID(ctx); RequestID(nested) != RequestID(ctx) {
+		t.Fatalf("expected nested request to keep request ID %q; got %q", RequestID(ctx), RequestID(nested))
+	}
+	Retry(ctx, "registry.example.com", 503, nil)
+	Outcome(ctx, "", errors.New("no host left"))
+	if err := e.Close(); err != nil {
+		t.Fatalf("failed to close file emitter: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Fatalf("expected audit log to be only accessible to its owner; got %v", perm)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("failed to parse audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected 2 audit records; got %+v", records)
+	}
+	if r := records[0]; r.Event != EventRetry || r.Host != "registry.example.com" || r.Reason != "status 503" || r.RequestID != RequestID(ctx) {
+		t.Fatalf("unexpected retry record: %+v", r)
+	}
+	if r := records[1]; r.Event != EventOutcome || r.Outcome != OutcomeFailure || r.Reason != "no host left" || r.RequestID != RequestID(ctx) {
+		t.Fatalf("unexpected outcome record: %+v", r)
+	}
+}
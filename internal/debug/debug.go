@@ -0,0 +1,117 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package debug implements the debug server of the snapshotter, which serves
+// pprof profiles and runtime stats for debugging performance in the field.
+package debug
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/log"
+)
+
+// Listen returns a listener for the debug server at address on network, which is
+// either "tcp" or "unix". Unix sockets are only accessible to the owner of the
+// snapshotter. TCP addresses should be loopback addresses, so that profiles and stats
+// aren't exposed outside of the host, and a warning is logged if they aren't.
+// It returns a nil listener if address is empty, which disables the debug server.
+func Listen(network, address string) (net.Listener, error) {
+	if address == "" {
+		return nil, nil
+	}
+	switch network {
+	case "tcp":
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if !isLoopback(host) {
+			log.L.WithField("address", address).Warn("debug server listens on a non-loopback address, exposing profiles and stats outside of the host")
+		}
+		return net.Listen(network, address)
+	case "unix":
+		if err := os.MkdirAll(filepath.Dir(address), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create directory %q: %w", filepath.Dir(address), err)
+		}
+		// Try to remove the socket file to avoid EADDRINUSE
+		if err := os.RemoveAll(address); err != nil {
+			return nil, fmt.Errorf("failed to remove %q: %w", address, err)
+		}
+		l, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(address, 0600); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to restrict access to %q: %w", address, err)
+		}
+		return l, nil
+	default:
+		return nil, fmt.Errorf("unsupported debug network %q; must be tcp or unix", network)
+	}
+}
+
+// isLoopback returns whether host, the host of a TCP address, is a loopback address.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Handlers are the endpoints of the debug server besides pprof profiles. Each of
+// them is only served if it isn't nil.
+type Handlers struct {
+	// Stats serves runtime stats under /debug/stats.
+	Stats http.Handler
+	// Unfetched serves the files of mounted layers that aren't fetched yet under /debug/unfetched.
+	Unfetched http.Handler
+	// Spans serves the inventory of the span cache under /debug/spans.
+	Spans http.Handler
+	// Prewarm prewarms the pull of an image under /debug/prewarm.
+	Prewarm http.Handler
+}
+
+// NewHandler returns the handler of the debug server. It serves pprof profiles
+// under /debug/pprof/, and the endpoints of h that aren't nil.
+func NewHandler(h Handlers) http.Handler {
+	m := http.NewServeMux()
+	m.HandleFunc("/debug/pprof/", pprof.Index)
+	m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if h.Stats != nil {
+		m.Handle("/debug/stats", h.Stats)
+	}
+	if h.Unfetched != nil {
+		m.Handle("/debug/unfetched", h.Unfetched)
+	}
+	if h.Spans != nil {
+		m.Handle("/debug/spans", h.Spans)
+	}
+	if h.Prewarm != nil {
+		m.Handle("/debug/prewarm", h.Prewarm)
+	}
+	return m
+}
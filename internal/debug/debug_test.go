@@ -0,0 +1,143 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package debug
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDebugServer(t *testing.T) {
+	stats := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"goroutines":1}`)
+	})
+	unfetched := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `[]`)
+	})
+	spans := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"spans":[]}`)
+	})
+	prewarm := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	tests := []struct {
+		name     string
+		handlers Handlers
+		expected map[string]int
+	}{
+		{
+			name: "stats enabled",
+			handlers: Handlers{
+				Stats:     stats,
+				Unfetched: unfetched,
+				Spans:     spans,
+				Prewarm:   prewarm,
+			},
+			expected: map[string]int{
+				"/debug/pprof/":        http.StatusOK,
+				"/debug/pprof/cmdline": http.StatusOK,
+				"/debug/stats":         http.StatusOK,
+				"/debug/unfetched":     http.StatusOK,
+				"/debug/spans":         http.StatusOK,
+				"/debug/prewarm":       http.StatusNoContent,
+			},
+		},
+		{
+			name: "stats disabled",
+			expected: map[string]int{
+				"/debug/pprof/":    http.StatusOK,
+				"/debug/stats":     http.StatusNotFound,
+				"/debug/unfetched": http.StatusNotFound,
+				"/debug/spans":     http.StatusNotFound,
+				"/debug/prewarm":   http.StatusNotFound,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := filepath.Join(t.TempDir(), "debug.sock")
+			l, err := Listen("unix", addr)
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+			defer l.Close()
+			if info, err := os.Stat(addr); err != nil || info.Mode().Perm() != 0600 {
+				t.Fatalf("expected debug socket to only be accessible to its owner; got %v, %v", info.Mode(), err)
+			}
+			go http.Serve(l, NewHandler(tt.handlers))
+
+			client := &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, "unix", addr)
+					},
+				},
+			}
+			for path, code := range tt.expected {
+				resp, err := client.Get("http://debug" + path)
+				if err != nil {
+					t.Fatalf("failed to get %s: %v", path, err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != code {
+					t.Fatalf("expected %s to respond with %d; got %d", path, code, resp.StatusCode)
+				}
+			}
+		})
+	}
+}
+
+func TestDebugServerDisabled(t *testing.T) {
+	for _, network := range []string{"tcp", "unix"} {
+		l, err := Listen(network, "")
+		if err != nil || l != nil {
+			t.Fatalf("expected no %s debug listener without an address; got %v, %v", network, l, err)
+		}
+	}
+}
+
+func TestListenNonLoopbackAddress(t *testing.T) {
+	// Non-loopback addresses are allowed, with a warning.
+	for _, addr := range []string{":0", "0.0.0.0:0", "localhost:0", "127.0.0.1:0"} {
+		l, err := Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to listen on %q: %v", addr, err)
+		}
+		l.Close()
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	for host, expected := range map[string]bool{
+		"localhost": true,
+		"127.0.0.1": true,
+		"::1":       true,
+		"":          false,
+		"0.0.0.0":   false,
+		"192.0.2.1": false,
+		"example":   false,
+	} {
+		if got := isLoopback(host); got != expected {
+			t.Errorf("expected isLoopback(%q) to be %v; got %v", host, expected, got)
+		}
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 
 	rhttp "github.com/hashicorp/go-retryablehttp"
@@ -60,6 +61,17 @@ var DefaultAuthReqContext = func(reqCtx context.Context) context.Context {
 	return context.Background()
 }
 
+// DefaultQueryAuthParams are the query parameters that carry auth tokens in
+// pre-signed URLs of well-known registry storage backends and CDNs.
+var DefaultQueryAuthParams = []string{
+	"X-Amz-Signature",  // AWS S3/CloudFront SigV4
+	"X-Goog-Signature", // Google Cloud Storage
+	"Signature",        // AWS CloudFront
+	"sig",              // Azure Blob Storage SAS
+	"token",
+	"access_token",
+}
+
 // AuthClient provides a HTTP client that is capable of authenticating
 // with origin servers. It contains an AuthHandler type that is responsible
 // for preparing valid responses/answers to challenges as well authenticating
@@ -77,6 +89,12 @@ type AuthClient struct {
 	redirMap   map[string]string
 	redirMu    sync.Mutex
 	cacheRedir bool
+	// queryAuthParams are the query parameters that mark a request URL
+	// as already authorized.
+	queryAuthParams []string
+	// staleConnRetry is whether requests failing because the server closed
+	// an idle connection are retried once on a fresh connection.
+	staleConnRetry bool
 }
 
 type AuthClientOpt func(*AuthClient)
@@ -110,12 +128,33 @@ func WithAuthRequestCtxFunc(arc AuthReqContextFunc) AuthClientOpt {
 	}
 }
 
+// WithQueryAuthParams sets the query parameters that carry auth tokens in
+// request URLs. Requests whose URL contains any of them are sent as-is without
+// being authorized by the AuthHandler.
+func WithQueryAuthParams(params []string) AuthClientOpt {
+	return func(ac *AuthClient) {
+		ac.queryAuthParams = params
+	}
+}
+
+// WithStaleConnRetry sets whether requests whose reused connection was closed
+// by the server before the first response byte are transparently retried once
+// on a fresh connection. This retry doesn't count against the retry budget of
+// the retryable client as long as its retry policy doesn't retry errors
+// matched by IsStaleConnError.
+func WithStaleConnRetry(enable bool) AuthClientOpt {
+	return func(ac *AuthClient) {
+		ac.staleConnRetry = enable
+	}
+}
+
 // NewAuthClient creates a new AuthClient given an AuthHandler.
 //
 // An AuthHandler must be provided. If no retryable client is provided
 // a default one will be created. If no AuthPolicy is provided the
 // DefaultAuthPolicy will be used. If no AuthReqCtxFunc is provided
-// the DefaultAuthReqContext is used.
+// the DefaultAuthReqContext is used. If no query auth params are provided
+// the DefaultQueryAuthParams are used.
 func NewAuthClient(authHandler AuthHandler, opts ...AuthClientOpt) (*AuthClient, error) {
 	if authHandler == nil {
 		return nil, ErrMissingAuthHandler
@@ -134,6 +173,11 @@ func NewAuthClient(authHandler AuthHandler, opts ...AuthClientOpt) (*AuthClient,
 // error is returned and the AuthPolicy deems that the response
 // warrants authentication, it will invoke the AuthHandler to handle
 // the challenge, re-authorize and re-send the request.
+//
+// Requests whose URL already carries auth in its query string (e.g. pre-signed
+// blob URLs) are neither authorized nor challenged, since an Authorization header
+// would conflict with the query string auth. It is up to the caller to refresh
+// the URL once its token expires.
 func (ac *AuthClient) Do(req *http.Request) (*http.Response, error) {
 	ac.init.Do(ac.initClient)
 	if ac.handler == nil {
@@ -145,9 +189,21 @@ func (ac *AuthClient) Do(req *http.Request) (*http.Response, error) {
 		for k := range ac.header {
 			req.Header.Set(k, ac.header.Get(k))
 		}
-		authReq, err := ac.handler.AuthorizeRequest(ctx, req)
-		if err != nil {
-			return nil, fmt.Errorf("%w: %w", ErrFailedToAuthorizeRequest, err)
+		authReq := req
+		if ac.hasQueryAuth(req.URL) {
+			req.Header.Del("Authorization")
+		} else {
+			var err error
+			authReq, err = ac.handler.AuthorizeRequest(ctx, req)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrFailedToAuthorizeRequest, err)
+			}
+		}
+		var st *staleConnTrace
+		if ac.staleConnRetry {
+			var traceCtx context.Context
+			traceCtx, st = withStaleConnTrace(authReq.Context())
+			authReq = authReq.WithContext(traceCtx)
 		}
 		// Convert the auth request to be a "retryable" request.
 		rAuthReq, err := rhttp.FromRequest(authReq)
@@ -155,6 +211,13 @@ func (ac *AuthClient) Do(req *http.Request) (*http.Response, error) {
 			return nil, err
 		}
 		resp, err := ac.client.Do(rAuthReq)
+		if st != nil && st.isStale(err) {
+			// The server closed the connection while it was idle, so the request
+			// never reached it. Retry once on a fresh connection.
+			st.markRetried()
+			ac.client.HTTPClient.CloseIdleConnections()
+			resp, err = ac.client.Do(rAuthReq)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -175,7 +238,7 @@ func (ac *AuthClient) Do(req *http.Request) (*http.Response, error) {
 		return nil, err
 	}
 
-	if ac.policy(resp) {
+	if ac.policy(resp) && !ac.hasQueryAuth(req.URL) {
 		err = ac.handler.HandleChallenge(ctx, resp)
 		if err != nil {
 			return nil, fmt.Errorf("%w: %w", ErrFailedToHandleChallenge, err)
@@ -206,10 +269,12 @@ func (ac *AuthClient) RoundTrip(req *http.Request) (*http.Response, error) {
 // and auth policy.
 func (ac *AuthClient) CloneWithNewClient(client *rhttp.Client) *AuthClient {
 	nc := &AuthClient{
-		client:  client,
-		policy:  ac.policy,
-		handler: ac.handler,
-		header:  ac.header,
+		client:          client,
+		policy:          ac.policy,
+		handler:         ac.handler,
+		header:          ac.header,
+		queryAuthParams: ac.queryAuthParams,
+		staleConnRetry:  ac.staleConnRetry,
 	}
 	nc.init.Do(nc.initClient)
 	return nc
@@ -226,6 +291,11 @@ func (ac *AuthClient) CacheRedirects(b bool) {
 	ac.cacheRedir = b
 }
 
+// CachesRedirects returns whether the client caches redirects. See CacheRedirects.
+func (ac *AuthClient) CachesRedirects() bool {
+	return ac.cacheRedir
+}
+
 // initClient populates the AuthClient with a set of default values if they aren't already set.
 func (ac *AuthClient) initClient() {
 	if ac.client == nil {
@@ -237,9 +307,27 @@ func (ac *AuthClient) initClient() {
 	if ac.getAuthCtx == nil {
 		ac.getAuthCtx = DefaultAuthReqContext
 	}
+	if len(ac.queryAuthParams) == 0 {
+		ac.queryAuthParams = DefaultQueryAuthParams
+	}
 	ac.redirMap = make(map[string]string)
 }
 
+// hasQueryAuth returns whether the URL carries auth in its query string.
+func (ac *AuthClient) hasQueryAuth(u *url.URL) bool {
+	if u == nil || u.RawQuery == "" {
+		return false
+	}
+	for key := range u.Query() {
+		for _, param := range ac.queryAuthParams {
+			if strings.EqualFold(key, param) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (ac *AuthClient) redirected(req *http.Request) *http.Request {
 	if req.Method != http.MethodGet {
 		return nil
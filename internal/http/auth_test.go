@@ -180,6 +180,84 @@ func TestCustomAuthHeaders(t *testing.T) {
 	}
 }
 
+type queryAuthRoundTripper struct {
+	status   int
+	requests []*http.Request
+}
+
+func (qrt *queryAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	qrt.requests = append(qrt.requests, req)
+	return &http.Response{
+		StatusCode: qrt.status,
+		Request:    req,
+	}, nil
+}
+
+func TestQueryStringAuth(t *testing.T) {
+	const blobURL = "https://cdn.example.com/blobs/sha256:abcd?token=secret&expires=1700000000"
+	testCases := []struct {
+		name          string
+		url           string
+		status        int
+		expectedAuth  bool
+		expectedCount int
+	}{
+		{
+			name:          "blob URL with query string auth is not authorized",
+			url:           blobURL,
+			status:        http.StatusOK,
+			expectedCount: 1,
+		},
+		{
+			name:          "blob URL with query string auth is not challenged",
+			url:           blobURL,
+			status:        http.StatusUnauthorized,
+			expectedCount: 1,
+		},
+		{
+			name:          "blob URL without query string auth is authorized",
+			url:           "https://registry.example.com/v2/repo/blobs/sha256:abcd",
+			status:        http.StatusOK,
+			expectedAuth:  true,
+			expectedCount: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := &queryAuthRoundTripper{status: tc.status}
+			rc := rhttp.NewClient()
+			rc.RetryMax = 0
+			rc.HTTPClient.Transport = tr
+			authHandler := &basicAuthHandler{username: "testuser", password: "testpassword"}
+			ac, _ := NewAuthClient(authHandler, WithRetryableClient(rc))
+
+			req, _ := http.NewRequestWithContext(context.Background(), "GET", tc.url, nil)
+			req.Header.Set("Authorization", "Bearer conflicting")
+			resp, err := ac.Do(req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.StatusCode != tc.status {
+				t.Fatalf("unexpected status; expected: %v, got: %v", tc.status, resp.StatusCode)
+			}
+			if len(tr.requests) != tc.expectedCount {
+				t.Fatalf("unexpected request count; expected: %v, got: %v", tc.expectedCount, len(tr.requests))
+			}
+			sent := tr.requests[0]
+			if sent.URL.String() != tc.url {
+				t.Fatalf("request URL was modified; expected: %s, got: %s", tc.url, sent.URL.String())
+			}
+			_, _, hasAuth := sent.BasicAuth()
+			if hasAuth != tc.expectedAuth {
+				t.Fatalf("unexpected basic auth; expected: %v, got: %v", tc.expectedAuth, hasAuth)
+			}
+			if !tc.expectedAuth && sent.Header.Get("Authorization") != "" {
+				t.Fatalf("unexpected Authorization header: %s", sent.Header.Get("Authorization"))
+			}
+		})
+	}
+}
+
 type reqCounter struct {
 	count int
 }
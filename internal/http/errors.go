@@ -22,4 +22,7 @@ var (
 	ErrMissingAuthHandler       = errors.New("missing auth handler")
 	ErrFailedToAuthorizeRequest = errors.New("failed to authorize request")
 	ErrFailedToHandleChallenge  = errors.New("failed to handle challenge")
+	ErrNoRecordedExchange       = errors.New("no recorded exchange for request")
+	ErrBodyNotRecorded          = errors.New("response body was not recorded")
+	ErrRecordedRequestFailed    = errors.New("recorded request failed")
 )
@@ -0,0 +1,306 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// redacted replaces credentials in recordings.
+const redacted = "redacted"
+
+// sensitiveHeaders are headers whose values are always redacted in recordings.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// tokenFields are fields of JSON token responses whose values are redacted in recordings.
+var tokenFields = []string{"token", "access_token", "refresh_token"}
+
+// RecordedExchange is a single HTTP request and its response in a recording.
+// Credentials in headers, query strings and token responses are redacted.
+type RecordedExchange struct {
+	Method         string      `json:"method"`
+	URL            string      `json:"url"`
+	RequestHeader  http.Header `json:"requestHeader,omitempty"`
+	Status         int         `json:"status,omitempty"`
+	ResponseHeader http.Header `json:"responseHeader,omitempty"`
+	// Body is the part of the response body read by the client. It is empty
+	// if the recorder only keeps body digests.
+	Body       []byte `json:"body,omitempty"`
+	BodyDigest string `json:"bodyDigest,omitempty"`
+	BodySize   int64  `json:"bodySize"`
+	// Error is the error returned instead of a response, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// Recorder records HTTP exchanges to a file, one JSON-encoded RecordedExchange per line.
+type Recorder struct {
+	mu         sync.Mutex
+	f          *os.File
+	digestOnly bool
+}
+
+// NewRecorder creates a Recorder writing to path, truncating any existing recording.
+// If digestOnly is set, only the sha256 digest and size of response bodies are recorded,
+// which keeps the recording small but means it can't be replayed.
+func NewRecorder(path string, digestOnly bool) (*Recorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recording: %w", err)
+	}
+	return &Recorder{f: f, digestOnly: digestOnly}, nil
+}
+
+// Transport returns an http.RoundTripper that sends requests with inner and
+// records them along with their responses.
+func (r *Recorder) Transport(inner http.RoundTripper) http.RoundTripper {
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	return &recordingTransport{recorder: r, inner: inner}
+}
+
+// Close closes the recording file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+func (r *Recorder) record(e *RecordedExchange) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.f.Write(append(b, '\n'))
+	return err
+}
+
+type recordingTransport struct {
+	recorder *Recorder
+	inner    http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := &RecordedExchange{
+		Method:        req.Method,
+		URL:           redactURL(req.URL),
+		RequestHeader: redactHeader(req.Header),
+	}
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		e.Error = RedactHTTPQueryValuesFromError(err).Error()
+		t.recorder.record(e)
+		return nil, err
+	}
+	e.Status = resp.StatusCode
+	e.ResponseHeader = redactHeader(resp.Header)
+	rb := &recordingBody{
+		ReadCloser: resp.Body,
+		recorder:   t.recorder,
+		exchange:   e,
+		digester:   sha256.New(),
+	}
+	if !t.recorder.digestOnly {
+		rb.buf = new(bytes.Buffer)
+	}
+	resp.Body = rb
+	return resp, nil
+}
+
+// recordingBody records the exchange once the response body is closed,
+// including the part of the body that was read.
+type recordingBody struct {
+	io.ReadCloser
+	recorder *Recorder
+	exchange *RecordedExchange
+	digester hash.Hash
+	buf      *bytes.Buffer
+	once     sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.digester.Write(p[:n])
+	if b.buf != nil {
+		b.buf.Write(p[:n])
+	}
+	b.exchange.BodySize += int64(n)
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.exchange.BodyDigest = fmt.Sprintf("sha256:%x", b.digester.Sum(nil))
+		if b.buf != nil {
+			b.exchange.Body = redactTokens(b.buf.Bytes())
+		}
+		b.recorder.record(b.exchange)
+	})
+	return err
+}
+
+// NewReplayTransport returns an http.RoundTripper that serves responses from the
+// recording at path without network access. Requests are matched to recorded
+// exchanges by method, URL and Range header, ignoring credentials. Repeated requests
+// are served the recorded responses in order; once they run out, the last one is
+// served again.
+func NewReplayTransport(path string) (http.RoundTripper, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open recording: %w", err)
+	}
+	defer f.Close()
+
+	t := &replayTransport{
+		exchanges: make(map[string][]*RecordedExchange),
+		served:    make(map[string]int),
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		var e RecordedExchange
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("failed to parse recording: %w", err)
+		}
+		key := exchangeKey(e.Method, e.URL, e.RequestHeader.Get("Range"))
+		t.exchanges[key] = append(t.exchanges[key], &e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recording: %w", err)
+	}
+	return t, nil
+}
+
+type replayTransport struct {
+	mu        sync.Mutex
+	exchanges map[string][]*RecordedExchange
+	served    map[string]int
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	redactedURL := redactURL(req.URL)
+	key := exchangeKey(req.Method, redactedURL, req.Header.Get("Range"))
+
+	t.mu.Lock()
+	exchanges := t.exchanges[key]
+	if len(exchanges) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s %s", ErrNoRecordedExchange, req.Method, redactedURL)
+	}
+	e := exchanges[min(t.served[key], len(exchanges)-1)]
+	t.served[key]++
+	t.mu.Unlock()
+
+	if e.Error != "" {
+		return nil, fmt.Errorf("%w: %s", ErrRecordedRequestFailed, e.Error)
+	}
+	if e.Body == nil && e.BodySize > 0 {
+		return nil, fmt.Errorf("%w: %s %s", ErrBodyNotRecorded, req.Method, redactedURL)
+	}
+	header := e.ResponseHeader.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	// The recorded body may be shorter than the original one if the client
+	// stopped reading early, or differ in length after tokens were redacted.
+	header.Set("Content-Length", strconv.Itoa(len(e.Body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status)),
+		StatusCode:    e.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}, nil
+}
+
+func exchangeKey(method, url, byteRange string) string {
+	return method + " " + url + " " + byteRange
+}
+
+// redactURL returns the URL with its user info and query values redacted.
+func redactURL(u *url.URL) string {
+	c := *u
+	RedactHTTPQueryValuesFromURL(&c)
+	return c.Redacted()
+}
+
+// redactHeader returns a copy of header with credentials redacted.
+func redactHeader(header http.Header) http.Header {
+	if len(header) == 0 {
+		return nil
+	}
+	h := header.Clone()
+	for _, k := range sensitiveHeaders {
+		if h.Get(k) != "" {
+			h.Set(k, redacted)
+		}
+	}
+	if loc := h.Get("Location"); loc != "" {
+		h.Set("Location", RedactHTTPQueryValuesFromString(loc))
+	}
+	return h
+}
+
+// redactTokens redacts the tokens of a JSON token response. Other bodies are returned as-is.
+func redactTokens(body []byte) []byte {
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return body
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	found := false
+	for k := range fields {
+		for _, f := range tokenFields {
+			if strings.EqualFold(k, f) {
+				fields[k] = json.RawMessage(`"` + redacted + `"`)
+				found = true
+			}
+		}
+	}
+	if !found {
+		return body
+	}
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return b
+}
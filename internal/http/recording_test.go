@@ -0,0 +1,157 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	const secret = "s3cr3t-token"
+	blob := bytes.Repeat([]byte("0123456789"), 100)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"token":"` + secret + `","expires_in":300}`))
+		case "/v2/repo/manifests/latest":
+			if r.Header.Get("Authorization") != "Bearer "+secret {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"schemaVersion":2}`))
+		case "/v2/repo/blobs/sha256:abc":
+			http.Redirect(w, r, "/storage/abc?X-Amz-Signature="+secret, http.StatusTemporaryRedirect)
+		case "/storage/abc":
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	// pull simulates a pull and returns the responses it got.
+	pull := func(t *testing.T, client *http.Client) []string {
+		var got []string
+		do := func(method, path string, header http.Header) {
+			req, err := http.NewRequest(method, srv.URL+path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s failed: %v", method, path, err)
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, resp.Status+" "+string(b))
+		}
+		do(http.MethodGet, "/v2/repo/manifests/latest", nil)
+		do(http.MethodGet, "/token", nil)
+		do(http.MethodGet, "/v2/repo/manifests/latest", http.Header{"Authorization": {"Bearer " + secret}})
+		do(http.MethodGet, "/v2/repo/blobs/sha256:abc", http.Header{"Range": {"bytes=10-19"}})
+		do(http.MethodGet, "/v2/repo/blobs/sha256:abc", http.Header{"Range": {"bytes=500-999"}})
+		return got
+	}
+
+	recordingPath := filepath.Join(t.TempDir(), "recording.jsonl")
+	rec, err := NewRecorder(recordingPath, false)
+	if err != nil {
+		t.Fatalf("failed to create recorder: %v", err)
+	}
+	recorded := pull(t, &http.Client{Transport: rec.Transport(http.DefaultTransport)})
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	b, err := os.ReadFile(recordingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte(secret)) {
+		t.Fatalf("recording contains credentials:\n%s", b)
+	}
+
+	replay, err := NewReplayTransport(recordingPath)
+	if err != nil {
+		t.Fatalf("failed to load recording: %v", err)
+	}
+	replayed := pull(t, &http.Client{Transport: replay})
+	for i := range recorded {
+		// Replayed tokens are redacted.
+		if i == 1 {
+			continue
+		}
+		if recorded[i] != replayed[i] {
+			t.Fatalf("response %d differs: recorded %q, replayed %q", i, recorded[i], replayed[i])
+		}
+	}
+	if string(blob[10:20]) != recorded[3][len(recorded[3])-10:] {
+		t.Fatalf("unexpected ranged response %q", recorded[3])
+	}
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/v2/repo/blobs/sha256:def", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := replay.RoundTrip(req); !errors.Is(err, ErrNoRecordedExchange) {
+		t.Fatalf("expected %v for an unrecorded request; got %v", ErrNoRecordedExchange, err)
+	}
+}
+
+func TestRecordDigestOnly(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("layer data"))
+	}))
+	defer srv.Close()
+
+	recordingPath := filepath.Join(t.TempDir(), "recording.jsonl")
+	rec, err := NewRecorder(recordingPath, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: rec.Transport(nil)}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	rec.Close()
+
+	replay, err := NewReplayTransport(recordingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: replay}).Get(srv.URL); !errors.Is(err, ErrBodyNotRecorded) {
+		t.Fatalf("expected %v; got %v", ErrBodyNotRecorded, err)
+	}
+}
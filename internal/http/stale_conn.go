@@ -0,0 +1,101 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// staleConnTrace tracks the connection used by the latest attempt of a request
+// so that failures caused by the server closing an idle connection can be told
+// apart from other network errors.
+type staleConnTrace struct {
+	mu sync.Mutex
+	// reused is whether the latest attempt was sent on a reused connection.
+	reused bool
+	// gotFirstByte is whether the latest attempt received any response bytes.
+	gotFirstByte bool
+	// retried is whether the request was already retried on a fresh connection.
+	retried bool
+}
+
+type staleConnTraceKey struct{}
+
+// withStaleConnTrace returns a context that records the connection state of every
+// attempt of a request sent with it, along with the trace the state is recorded in.
+func withStaleConnTrace(ctx context.Context) (context.Context, *staleConnTrace) {
+	st := &staleConnTrace{}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			st.reused = info.Reused
+			st.gotFirstByte = false
+		},
+		GotFirstResponseByte: func() {
+			st.mu.Lock()
+			defer st.mu.Unlock()
+			st.gotFirstByte = true
+		},
+	})
+	return context.WithValue(ctx, staleConnTraceKey{}, st), st
+}
+
+// isStale returns whether err was caused by the server closing the connection of
+// the latest attempt before responding, and the request hasn't been retried yet.
+func (st *staleConnTrace) isStale(err error) bool {
+	if err == nil {
+		return false
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.reused && !st.gotFirstByte && !st.retried && isConnClosedError(err)
+}
+
+// markRetried marks the request as retried on a fresh connection.
+func (st *staleConnTrace) markRetried() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.retried = true
+}
+
+// IsStaleConnError returns whether err is the failure of a request, sent with ctx by an
+// AuthClient, whose reused connection was closed by the server before the first response
+// byte. Some registries close idle connections aggressively, so this is benign.
+// The AuthClient retries such requests once on a fresh connection, so retry policies
+// should not retry them, which would count against the retry budget.
+func IsStaleConnError(ctx context.Context, err error) bool {
+	st, ok := ctx.Value(staleConnTraceKey{}).(*staleConnTrace)
+	if !ok {
+		return false
+	}
+	return st.isStale(err)
+}
+
+// isConnClosedError returns whether err indicates that the connection was closed by the server.
+func isConnClosedError(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		strings.Contains(err.Error(), "server closed idle connection")
+}
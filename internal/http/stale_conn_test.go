@@ -0,0 +1,158 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package http
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	rhttp "github.com/hashicorp/go-retryablehttp"
+)
+
+// idleClosingServer is an HTTP/1.1 server that serves the first request on
+// every connection and closes the connection, without responding, once a second
+// request is sent on it, like a server that closed the connection while it was idle.
+type idleClosingServer struct {
+	l     net.Listener
+	conns atomic.Int32
+}
+
+func newIdleClosingServer(t *testing.T) *idleClosingServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &idleClosingServer{l: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.conns.Add(1)
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *idleClosingServer) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	for i := 0; ; i++ {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+		if i > 0 {
+			return
+		}
+		if _, err := io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"); err != nil {
+			return
+		}
+	}
+}
+
+func (s *idleClosingServer) url() string {
+	return "http://" + s.l.Addr().String()
+}
+
+func TestStaleConnRetry(t *testing.T) {
+	testCases := []struct {
+		name           string
+		staleConnRetry bool
+		expectErr      bool
+		expectedConns  int32
+	}{
+		{
+			name:           "stale connection is retried on a fresh connection",
+			staleConnRetry: true,
+			expectedConns:  2,
+		},
+		{
+			name:           "stale connection fails the request when retries are disabled",
+			staleConnRetry: false,
+			expectErr:      true,
+			expectedConns:  1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newIdleClosingServer(t)
+
+			// Don't allow any retries so that the request only succeeds
+			// if the stale connection retry doesn't count against the budget.
+			retryClient := rhttp.NewClient()
+			retryClient.Logger = nil
+			retryClient.RetryMax = 0
+			t.Cleanup(retryClient.HTTPClient.CloseIdleConnections)
+			ac, err := NewAuthClient(&basicAuthHandler{}, WithRetryableClient(retryClient), WithStaleConnRetry(tc.staleConnRetry))
+			if err != nil {
+				t.Fatalf("failed to create auth client: %v", err)
+			}
+
+			// Open a connection and leave it idle in the pool.
+			req, err := http.NewRequest(http.MethodGet, s.url(), nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			resp, err := ac.Do(req)
+			if err != nil {
+				t.Fatalf("first request failed: %v", err)
+			}
+			io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			// The transport only replays idempotent requests itself, so use a
+			// request with a body to make sure the failure reaches the AuthClient.
+			req, err = http.NewRequest(http.MethodPost, s.url(), strings.NewReader("body"))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			resp, err = ac.Do(req)
+			if tc.expectErr {
+				if err == nil {
+					resp.Body.Close()
+					t.Fatalf("expected request on the stale connection to fail")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("request on the stale connection failed: %v", err)
+				}
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil {
+					t.Fatalf("failed to read response: %v", err)
+				}
+				if string(body) != "ok" {
+					t.Fatalf("unexpected response body %q", string(body))
+				}
+			}
+			if conns := s.conns.Load(); conns != tc.expectedConns {
+				t.Fatalf("expected %d connections; got %d", tc.expectedConns, conns)
+			}
+		})
+	}
+}
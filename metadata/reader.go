@@ -165,11 +165,10 @@ func (r *reader) initRootNode(fsID string) error {
 }
 
 func (r *reader) initNodes(toc ztoc.TOC) error {
-	fileMetadataChunks := partition(toc.FileMetadata, bboltInsertionChunkSize)
-
 	md := make(map[uint32]*metadataEntry)
-	for _, fileMetadataChunk := range fileMetadataChunks {
-		if err := r.db.Batch(func(tx *bolt.Tx) (err error) {
+	// A TOC unmarshaled with ztoc.UnmarshalFile only deserializes the chunk being inserted.
+	if err := toc.Entries(bboltInsertionChunkSize, func(fileMetadataChunk []ztoc.FileMetadata) error {
+		return r.db.Batch(func(tx *bolt.Tx) (err error) {
 			nodes, err := getNodesBucket(tx, r.fsID)
 			if err != nil {
 				return err
@@ -259,9 +258,9 @@ func (r *reader) initNodes(toc ztoc.TOC) error {
 				}
 			}
 			return nil
-		}); err != nil {
-			return err
-		}
+		})
+	}); err != nil {
+		return err
 	}
 
 	addendum := make([]struct {
@@ -0,0 +1,112 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	socifs "github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+var (
+	// ErrHealthCheckerNotAttached is returned when checking the health of a snapshotter with
+	// a HealthChecker that wasn't passed to NewSociSnapshotterService with WithHealthChecker.
+	ErrHealthCheckerNotAttached = errors.New("health checker is not attached to a snapshotter")
+	// ErrUnhealthy is returned when no mirror of the sentinel reference is reachable.
+	ErrUnhealthy = errors.New("no mirror of the sentinel reference is reachable")
+)
+
+// HealthChecker checks that a snapshotter can reach at least one of the mirrors of the
+// registry of a sentinel reference. The registry itself isn't checked, since it's only
+// a fallback for the mirrors. The mirrors are probed like with socifs.ProbeHosts, with the
+// clients of the filesystem of the snapshotter, so no blob is fetched. The mirrors follow
+// reloads of the registry configuration of the snapshotter.
+//
+// The check is a readiness signal, e.g. to stop scheduling pulls on the node: mounted
+// layers keep being served from their cache and other hosts while the mirrors are
+// unreachable, so it must not be used as a liveness probe restarting the snapshotter,
+// which would tear down the FUSE mounts of running containers.
+type HealthChecker struct {
+	sentinel reference.Spec
+	// origin is the registry host of sentinel, which isn't checked.
+	origin string
+
+	mu     sync.Mutex
+	hosts  resolver.RegistryHosts
+	prober socifs.HostProber
+}
+
+// NewHealthChecker returns a HealthChecker probing the mirrors of the registry of
+// the image reference sentinel, e.g. "docker.io/library/busybox:latest".
+func NewHealthChecker(sentinel string) (*HealthChecker, error) {
+	refspec, err := reference.Parse(sentinel)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sentinel reference %q: %w", sentinel, err)
+	}
+	origin, err := docker.DefaultHost(refspec.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("invalid sentinel reference %q: %w", sentinel, err)
+	}
+	return &HealthChecker{sentinel: refspec, origin: origin}, nil
+}
+
+// Check returns nil if the snapshotter is healthy, i.e. at least one mirror of the registry
+// of the sentinel reference is reachable, or an error wrapping ErrUnhealthy and the errors
+// of the mirrors otherwise. Probes are bounded by ctx.
+func (c *HealthChecker) Check(ctx context.Context) error {
+	c.mu.Lock()
+	hosts, prober := c.hosts, c.prober
+	c.mu.Unlock()
+	if hosts == nil || prober == nil {
+		return ErrHealthCheckerNotAttached
+	}
+	registryHosts, err := hosts(c.sentinel)
+	if err != nil {
+		return fmt.Errorf("%w: cannot get the registry hosts of %s: %w", ErrUnhealthy, c.sentinel, err)
+	}
+	var mirrors []docker.RegistryHost
+	for _, h := range registryHosts {
+		if h.Host != c.origin {
+			mirrors = append(mirrors, h)
+		}
+	}
+	if len(mirrors) == 0 {
+		return fmt.Errorf("%w: %s has no mirrors", ErrUnhealthy, c.sentinel)
+	}
+	errs := []error{ErrUnhealthy}
+	for _, result := range prober.ProbeHosts(ctx, c.sentinel, mirrors) {
+		if result.Reachable {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", result.Host, result.Err))
+	}
+	return errors.Join(errs...)
+}
+
+// attach makes c check the health of the snapshotter with hosts, probed by prober.
+func (c *HealthChecker) attach(hosts resolver.RegistryHosts, prober socifs.HostProber) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hosts = hosts
+	c.prober = prober
+}
@@ -0,0 +1,140 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	socifs "github.com/awslabs/soci-snapshotter/fs"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// probeHostsFunc probes hosts like the filesystem of a snapshotter.
+type probeHostsFunc func(ctx context.Context, refspec reference.Spec, hosts []docker.RegistryHost) []socifs.HostProbeResult
+
+func (f probeHostsFunc) ProbeHosts(ctx context.Context, refspec reference.Spec, hosts []docker.RegistryHost) []socifs.HostProbeResult {
+	return f(ctx, refspec, hosts)
+}
+
+// probeHosts probes hosts like a filesystem with the default configuration.
+func probeHosts(ctx context.Context, refspec reference.Spec, hosts []docker.RegistryHost) []socifs.HostProbeResult {
+	return socifs.ProbeHosts(ctx, config.FSConfig{}, refspec, hosts)
+}
+
+func TestHealthChecker(t *testing.T) {
+	reachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer reachable.Close()
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// The closed server refuses connections.
+	unreachable.Close()
+
+	hostOf := func(srv *httptest.Server) docker.RegistryHost {
+		return docker.RegistryHost{Host: strings.TrimPrefix(srv.URL, "http://"), Scheme: "http", Path: "/v2", Client: &http.Client{}}
+	}
+	hostsOf := func(hosts ...docker.RegistryHost) resolver.RegistryHosts {
+		return func(reference.Spec) ([]docker.RegistryHost, error) {
+			return hosts, nil
+		}
+	}
+
+	if _, err := NewHealthChecker("registry.example.com/Sentinel:latest"); err == nil {
+		t.Fatalf("expected invalid sentinel reference to be rejected")
+	}
+	c, err := NewHealthChecker("registry.example.com/sentinel:latest")
+	if err != nil {
+		t.Fatalf("failed to create health checker: %v", err)
+	}
+	if err := c.Check(context.Background()); !errors.Is(err, ErrHealthCheckerNotAttached) {
+		t.Fatalf("expected %v; got %v", ErrHealthCheckerNotAttached, err)
+	}
+
+	// The reachable server is the registry of the sentinel, which isn't checked.
+	sentinel := hostOf(reachable).Host + "/sentinel:latest"
+	tests := []struct {
+		name      string
+		hosts     resolver.RegistryHosts
+		expectErr bool
+	}{
+		{
+			name:  "reachable mirror",
+			hosts: hostsOf(hostOf(reachable)),
+		},
+		{
+			name:  "unreachable mirror with reachable mirror",
+			hosts: hostsOf(hostOf(unreachable), hostOf(reachable)),
+		},
+		{
+			name:      "unreachable mirror",
+			hosts:     hostsOf(hostOf(unreachable)),
+			expectErr: true,
+		},
+		{
+			name:      "no hosts",
+			hosts:     hostsOf(),
+			expectErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewHealthChecker("registry.example.com/sentinel:latest")
+			if err != nil {
+				t.Fatalf("failed to create health checker: %v", err)
+			}
+			c.attach(tc.hosts, probeHostsFunc(probeHosts))
+			err = c.Check(context.Background())
+			if !tc.expectErr {
+				if err != nil {
+					t.Fatalf("expected snapshotter to be healthy; got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrUnhealthy) {
+				t.Fatalf("expected %v; got %v", ErrUnhealthy, err)
+			}
+		})
+	}
+
+	t.Run("unreachable mirror with reachable registry", func(t *testing.T) {
+		c, err := NewHealthChecker(sentinel)
+		if err != nil {
+			t.Fatalf("failed to create health checker: %v", err)
+		}
+		var probed []string
+		c.attach(hostsOf(hostOf(unreachable), hostOf(reachable)), probeHostsFunc(func(ctx context.Context, refspec reference.Spec, hosts []docker.RegistryHost) []socifs.HostProbeResult {
+			for _, h := range hosts {
+				probed = append(probed, h.Host)
+			}
+			return probeHosts(ctx, refspec, hosts)
+		}))
+		if err := c.Check(context.Background()); !errors.Is(err, ErrUnhealthy) {
+			t.Fatalf("expected %v; got %v", ErrUnhealthy, err)
+		}
+		if len(probed) != 1 || probed[0] != hostOf(unreachable).Host {
+			t.Fatalf("expected only the mirror to be probed; got %v", probed)
+		}
+	})
+}
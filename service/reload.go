@@ -0,0 +1,80 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+)
+
+// ErrReloaderNotAttached is returned when reloading the config with a ConfigReloader
+// that wasn't passed to NewSociSnapshotterService with WithConfigReloader.
+var ErrReloaderNotAttached = errors.New("config reloader is not attached to a snapshotter")
+
+// ConfigReloader reloads the registry configuration of a snapshotter without restarting
+// it, i.e. the mirrors, registry host configuration, mirror discovery and mirror checks.
+// Layers mounted before a reload keep fetching from the hosts they were resolved with, so
+// in-flight reads complete against their existing setup; layers mounted afterwards use the
+// new configuration.
+type ConfigReloader struct {
+	mu    sync.Mutex
+	hosts *resolver.ReloadableRegistryHosts
+	// stop stops the background work of the current hosts.
+	stop func()
+	// recording is the HTTP recording of the current hosts, if any. It's kept by reloads
+	// that don't change its config, so that they don't truncate the recording.
+	recording *resolver.HTTPRecording
+	build     func(*config.ServiceConfig, *resolver.HTTPRecording) (resolver.RegistryHosts, func(), error)
+}
+
+// Reload swaps the registry configuration of the snapshotter for the one in cfg.
+// If the new configuration is invalid, the current one is kept and an error is returned.
+func (r *ConfigReloader) Reload(cfg *config.ServiceConfig) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.build == nil {
+		return ErrReloaderNotAttached
+	}
+	recording := r.recording
+	if cfg.HTTPRecordingConfig != recording.Config() {
+		var err error
+		recording, err = resolver.NewHTTPRecording(cfg.HTTPRecordingConfig)
+		if err != nil {
+			return fmt.Errorf("invalid HTTP recording config, keeping the current one: %w", err)
+		}
+	}
+	hosts, stop, err := r.build(cfg, recording)
+	if err != nil {
+		if recording != r.recording {
+			recording.Close()
+		}
+		return fmt.Errorf("invalid registry config, keeping the current one: %w", err)
+	}
+	r.hosts.Swap(hosts)
+	r.stop()
+	r.stop = stop
+	if recording != r.recording {
+		// Layers mounted before the reload stop recording their requests.
+		r.recording.Close()
+		r.recording = recording
+	}
+	return nil
+}
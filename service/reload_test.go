@@ -0,0 +1,158 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+func TestConfigReloader(t *testing.T) {
+	hostsNamed := func(host string) resolver.RegistryHosts {
+		return func(reference.Spec) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{Host: host, Scheme: "https", Path: "/v2"}}, nil
+		}
+	}
+	currentHost := func(hosts *resolver.ReloadableRegistryHosts) string {
+		h, err := hosts.RegistryHosts(reference.Spec{})
+		if err != nil {
+			t.Fatalf("failed to get registry hosts: %v", err)
+		}
+		return h[0].Host
+	}
+
+	if err := (&ConfigReloader{}).Reload(&config.ServiceConfig{}); !errors.Is(err, ErrReloaderNotAttached) {
+		t.Fatalf("expected %v; got %v", ErrReloaderNotAttached, err)
+	}
+
+	var stopped int
+	hosts := resolver.NewReloadableRegistryHosts(hostsNamed("old.example.com"))
+	r := &ConfigReloader{
+		hosts: hosts,
+		stop:  func() { stopped++ },
+		build: func(cfg *config.ServiceConfig, recording *resolver.HTTPRecording) (resolver.RegistryHosts, func(), error) {
+			return newRegistryHosts(context.Background(), cfg, options{registryHosts: hostsNamed("new.example.com")}, recording, true)
+		},
+	}
+
+	// An invalid config is rejected and the current one is kept.
+	var invalid config.ServiceConfig
+	invalid.HTTPRecordingConfig.Mode = "invalid"
+	if err := r.Reload(&invalid); err == nil {
+		t.Fatalf("expected invalid config to be rejected")
+	}
+	if host := currentHost(hosts); host != "old.example.com" {
+		t.Fatalf("expected current config to be kept; got host %q", host)
+	}
+	if stopped != 0 {
+		t.Fatalf("expected current hosts to keep running")
+	}
+
+	if err := r.Reload(&config.ServiceConfig{}); err != nil {
+		t.Fatalf("failed to reload config: %v", err)
+	}
+	if host := currentHost(hosts); host != "new.example.com" {
+		t.Fatalf("expected reloaded config to be used; got host %q", host)
+	}
+	if stopped != 1 {
+		t.Fatalf("expected previous hosts to be stopped once; got %d", stopped)
+	}
+}
+
+func TestConfigReloaderRejectsInvalidHostsConfig(t *testing.T) {
+	certsD := t.TempDir()
+	hostDir := filepath.Join(certsD, "registry.example.com")
+	if err := os.Mkdir(hostDir, 0700); err != nil {
+		t.Fatalf("failed to create host dir: %v", err)
+	}
+	hostsToml := filepath.Join(hostDir, "hosts.toml")
+	if err := os.WriteFile(hostsToml, []byte("server = \"https://registry.example.com\"\n"), 0600); err != nil {
+		t.Fatalf("failed to write hosts.toml: %v", err)
+	}
+
+	var stopped int
+	r := &ConfigReloader{
+		hosts: resolver.NewReloadableRegistryHosts(nil),
+		stop:  func() { stopped++ },
+		build: func(cfg *config.ServiceConfig, recording *resolver.HTTPRecording) (resolver.RegistryHosts, func(), error) {
+			return newRegistryHosts(context.Background(), cfg, options{}, recording, true)
+		},
+	}
+	var cfg config.ServiceConfig
+	cfg.RegistryConfig.ConfigPath = certsD
+	if err := r.Reload(&cfg); err != nil {
+		t.Fatalf("failed to reload config: %v", err)
+	}
+
+	// The CA of the host doesn't exist.
+	if err := os.WriteFile(hostsToml, []byte("server = \"https://registry.example.com\"\nca = \"/nonexistent/ca.pem\"\n"), 0600); err != nil {
+		t.Fatalf("failed to write hosts.toml: %v", err)
+	}
+	if err := r.Reload(&cfg); err == nil {
+		t.Fatalf("expected invalid hosts config to be rejected")
+	}
+	if stopped != 1 {
+		t.Fatalf("expected the hosts of the first reload to keep running; got %d stops", stopped)
+	}
+}
+
+func TestConfigReloaderKeepsRecording(t *testing.T) {
+	dir := t.TempDir()
+	recordingConfig := config.HTTPRecordingConfig{Mode: config.HTTPRecordingModeRecord, Path: filepath.Join(dir, "recording")}
+	recording, err := resolver.NewHTTPRecording(recordingConfig)
+	if err != nil {
+		t.Fatalf("failed to open recording: %v", err)
+	}
+	r := &ConfigReloader{
+		hosts:     resolver.NewReloadableRegistryHosts(nil),
+		stop:      func() {},
+		recording: recording,
+		build: func(cfg *config.ServiceConfig, recording *resolver.HTTPRecording) (resolver.RegistryHosts, func(), error) {
+			return newRegistryHosts(context.Background(), cfg, options{registryHosts: func(reference.Spec) ([]docker.RegistryHost, error) {
+				return nil, nil
+			}}, recording, true)
+		},
+	}
+
+	var cfg config.ServiceConfig
+	cfg.HTTPRecordingConfig = recordingConfig
+	if err := r.Reload(&cfg); err != nil {
+		t.Fatalf("failed to reload config: %v", err)
+	}
+	if r.recording != recording {
+		t.Fatalf("expected the recording to be kept by a reload that doesn't change it")
+	}
+
+	cfg.HTTPRecordingConfig.Path = filepath.Join(dir, "other")
+	if err := r.Reload(&cfg); err != nil {
+		t.Fatalf("failed to reload config: %v", err)
+	}
+	if r.recording == recording || r.recording.Config() != cfg.HTTPRecordingConfig {
+		t.Fatalf("expected a new recording for the new config")
+	}
+	if err := recording.Close(); err == nil {
+		t.Fatalf("expected the replaced recording to be closed")
+	}
+}
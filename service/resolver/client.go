@@ -21,16 +21,21 @@ import (
 	"context"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/internal/audit"
 	socihttp "github.com/awslabs/soci-snapshotter/internal/http"
+	"github.com/awslabs/soci-snapshotter/util/ratelimit"
 	"github.com/awslabs/soci-snapshotter/version"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/log"
@@ -40,6 +45,9 @@ import (
 
 var userAgent = fmt.Sprintf("soci-snapshotter/%s", version.Version)
 
+// ErrTooManyRedirects is returned when a request exceeds the maximum number of redirects.
+var ErrTooManyRedirects = errors.New("too many redirects")
+
 // globalHeaders returns a global http.Header that should be attached
 // to all requests.
 func globalHeaders() http.Header {
@@ -48,11 +56,29 @@ func globalHeaders() http.Header {
 	return header
 }
 
-// newAuthClient returns a new AuthClient.
-func newAuthClient(retryClient *rhttp.Client, header http.Header, creds func(string) (string, string, error)) (*socihttp.AuthClient, error) {
+// newAuthClient returns a new AuthClient. If tokenRefreshGrace is positive, bearer
+// tokens will be refreshed that long before they expire. Requests to URLs carrying
+// any of queryAuthParams are not authorized by the client. If staleConnRetry is set,
+// requests failing because the registry closed an idle connection are retried once
+// on a fresh connection. If tokenLimiter is not nil, token requests wait for the rate
+// limit of their auth server.
+func newAuthClient(retryClient *rhttp.Client, header http.Header, creds func(string) (string, string, error), tokenRefreshGrace time.Duration, queryAuthParams []string, staleConnRetry bool, tokenLimiter *ratelimit.KeyedLimiter) (*socihttp.AuthClient, error) {
+	tokenClient := retryClient.StandardClient()
+	if tokenLimiter != nil {
+		tokenClient.Transport = &tokenRateLimitTransport{
+			inner:   tokenClient.Transport,
+			limiter: tokenLimiter,
+		}
+	}
+	if tokenRefreshGrace > 0 {
+		tokenClient.Transport = &tokenRefreshGraceTransport{
+			inner: tokenClient.Transport,
+			grace: tokenRefreshGrace,
+		}
+	}
 
 	authorizer := docker.NewDockerAuthorizer(
-		docker.WithAuthClient(retryClient.StandardClient()),
+		docker.WithAuthClient(tokenClient),
 		docker.WithAuthCreds(creds), docker.WithAuthHeader(header),
 	)
 
@@ -60,6 +86,8 @@ func newAuthClient(retryClient *rhttp.Client, header http.Header, creds func(str
 		socihttp.WithRetryableClient(retryClient),
 		socihttp.WithAuthPolicy(shouldAuthenticate), socihttp.WithHeader(header),
 		socihttp.WithAuthRequestCtxFunc(newContextWithScope),
+		socihttp.WithQueryAuthParams(queryAuthParams),
+		socihttp.WithStaleConnRetry(staleConnRetry),
 	}
 
 	authClient, err := socihttp.NewAuthClient(newDockerAuthHandler(authorizer), authClientOpts...)
@@ -69,6 +97,62 @@ func newAuthClient(retryClient *rhttp.Client, header http.Header, creds func(str
 	return authClient, nil
 }
 
+// tokenRefreshGraceTransport wraps the transport used by the docker.Authorizer to fetch
+// bearer tokens. It shortens the lifetime (`expires_in`) advertised by the token server
+// so that the authorizer considers a token expired, and refreshes it, a grace period
+// before it actually expires. This prevents long-running range requests from being
+// issued with a token that lapses mid-read.
+//
+// The authorizer only allows a single in-flight token fetch per scope, so concurrent
+// requests near expiry wait on the same refresh instead of all refreshing at once.
+type tokenRefreshGraceTransport struct {
+	inner http.RoundTripper
+	grace time.Duration
+}
+
+// RoundTrip sends the token request and rewrites the token lifetime in the response.
+func (t *tokenRefreshGraceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body = applyTokenRefreshGrace(body, t.grace)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Length")
+	return resp, nil
+}
+
+// applyTokenRefreshGrace subtracts grace from the `expires_in` field of a token response body.
+// The grace is never more than half of the token's lifetime so that short-lived tokens are
+// still reused between refreshes. If the body is not a token response with a positive
+// `expires_in`, it is returned unmodified.
+func applyTokenRefreshGrace(body []byte, grace time.Duration) []byte {
+	var token map[string]json.RawMessage
+	if err := json.Unmarshal(body, &token); err != nil {
+		return body
+	}
+	var expiresIn int
+	if err := json.Unmarshal(token["expires_in"], &expiresIn); err != nil || expiresIn <= 0 {
+		return body
+	}
+	graceSec := min(int(grace/time.Second), expiresIn/2)
+	if graceSec <= 0 {
+		return body
+	}
+	token["expires_in"], _ = json.Marshal(expiresIn - graceSec)
+	newBody, err := json.Marshal(token)
+	if err != nil {
+		return body
+	}
+	return newBody
+}
+
 // newRetryableClientFromConfig creates a retryable HTTP client which will automatically
 // retry on non-fatal errors given a RetryableHTTPClientConfig.
 func newRetryableClientFromConfig(config config.RetryableHTTPClientConfig) *rhttp.Client {
@@ -81,8 +165,11 @@ func newRetryableClientFromConfig(config config.RetryableHTTPClientConfig) *rhtt
 	rhttpClient.RetryWaitMin = time.Duration(config.MinWaitMsec) * time.Millisecond
 	rhttpClient.RetryWaitMax = time.Duration(config.MaxWaitMsec) * time.Millisecond
 	rhttpClient.Backoff = backoffStrategy
-	rhttpClient.CheckRetry = retryStrategy
+	rhttpClient.CheckRetry = func(ctx context.Context, resp *http.Response, err error) (bool, error) {
+		return retryStrategy(ctx, resp, err, config.RetryStatusCodes)
+	}
 	rhttpClient.ErrorHandler = handleHTTPError
+	rhttpClient.HTTPClient.CheckRedirect = checkRedirect(config.MaxRedirects)
 
 	// set timeouts
 	rhttpClient.HTTPClient.Timeout = time.Duration(config.RequestTimeoutMsec) * time.Millisecond
@@ -110,6 +197,7 @@ func CloneRetryableClient(retryClient *rhttp.Client) *rhttp.Client {
 	newRetryClient.CheckRetry = retryClient.CheckRetry
 	newRetryClient.Backoff = retryClient.Backoff
 	newRetryClient.ErrorHandler = retryClient.ErrorHandler
+	newRetryClient.HTTPClient.CheckRedirect = retryClient.HTTPClient.CheckRedirect
 
 	return newRetryClient
 }
@@ -122,26 +210,88 @@ func jitter(duration time.Duration, divisor int64) time.Duration {
 // backoffStrategy extends retryablehttp's DefaultBackoff to add a random jitter to avoid
 // overwhelming the repository when it comes back online
 // DefaultBackoff either tries to parse the 'Retry-After' header of the response; or, it uses an
-// exponential backoff 2 ^ numAttempts, limited by max
+// exponential backoff 2 ^ numAttempts, limited by max. The 'Retry-After' of a response is also
+// limited by max, so that a registry can't stall requests for longer than the configured wait.
 func backoffStrategy(minDuration, maxDuration time.Duration, attemptNum int, resp *http.Response) time.Duration {
 	delayTime := rhttp.DefaultBackoff(minDuration, maxDuration, attemptNum, resp)
+	if maxDuration > 0 {
+		delayTime = min(delayTime, maxDuration)
+	}
 	return jitter(delayTime, 8)
 }
 
+// checkRedirect returns an http.Client CheckRedirect func that follows up to maxRedirects
+// redirects. If maxRedirects is negative, redirects are not followed and the 3xx response
+// is returned as-is.
+//
+// Redirects are followed by the http.Client within a single attempt of the retryable client,
+// so they never count against the retry budget.
+func checkRedirect(maxRedirects int) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if maxRedirects < 0 {
+			return http.ErrUseLastResponse
+		}
+		if len(via) > maxRedirects {
+			return fmt.Errorf("%w: stopped after %d redirects", ErrTooManyRedirects, maxRedirects)
+		}
+		return nil
+	}
+}
+
 // retryStrategy extends retryablehttp's DefaultRetryPolicy to log the error and response when retrying
 // DefaultRetryPolicy retries whenever err is non-nil (except for some url errors) or if returned
-// status code is 429 or 5xx (except 501)
-func retryStrategy(ctx context.Context, resp *http.Response, err error) (bool, error) {
+// status code is 429 or 5xx (except 501). If statusCodes is set, responses are only retried if
+// their status is one of statusCodes instead. Redirects are followed by the inner http.Client before
+// the policy sees the final response, so only the final response of a redirect chain can consume
+// a retry. Exceeding the redirect limit is not retried since the chain would be the same.
+func retryStrategy(ctx context.Context, resp *http.Response, err error, statusCodes []int) (bool, error) {
+	if errors.Is(err, ErrTooManyRedirects) {
+		return false, socihttp.RedactHTTPQueryValuesFromError(err)
+	}
+	// Retrying won't change the proxy's mind, so fail fast with a clear error.
+	if errors.Is(err, ErrProxyAuthenticationRequired) {
+		return false, socihttp.RedactHTTPQueryValuesFromError(err)
+	}
+	if err == nil && resp != nil && resp.StatusCode == http.StatusProxyAuthRequired {
+		return false, fmt.Errorf("%w: proxy responded with %q", ErrProxyAuthenticationRequired, resp.Status)
+	}
+	// The AuthClient retries requests on stale connections itself without
+	// counting them against the retry budget.
+	if socihttp.IsStaleConnError(ctx, err) {
+		return false, socihttp.RedactHTTPQueryValuesFromError(err)
+	}
 	retry, err2 := rhttp.DefaultRetryPolicy(ctx, resp, err)
+	if len(statusCodes) > 0 && err == nil && err2 == nil && resp != nil {
+		retry = slices.Contains(statusCodes, resp.StatusCode)
+	}
 	if retry {
 		log.G(ctx).WithFields(logrus.Fields{
 			"error":    socihttp.RedactHTTPQueryValuesFromError(err),
 			"response": resp,
 		}).Debugf("retrying request")
+		var status int
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		audit.Retry(ctx, retryHost(resp, err), status, err)
 	}
 	return retry, socihttp.RedactHTTPQueryValuesFromError(err2)
 }
 
+// retryHost returns the host of the request that failed with resp or err.
+func retryHost(resp *http.Response, err error) string {
+	if resp != nil && resp.Request != nil && resp.Request.URL != nil {
+		return resp.Request.URL.Host
+	}
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if u, err := url.Parse(urlErr.URL); err == nil {
+			return u.Host
+		}
+	}
+	return ""
+}
+
 // handleHTTPError implements retryablehttp client's ErrorHandler to ensure returned errors
 // have HTTP query values redacted to prevent leaking sensitive information like encoded credentials or tokens.
 func handleHTTPError(resp *http.Response, err error, attempts int) (*http.Response, error) {
@@ -18,13 +18,19 @@ package resolver
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/awslabs/soci-snapshotter/config"
 	"github.com/containerd/containerd/remotes/docker"
 )
 
@@ -227,3 +233,263 @@ func TestAuthentication(t *testing.T) {
 
 	}
 }
+
+func TestApplyTokenRefreshGrace(t *testing.T) {
+	testCases := []struct {
+		name              string
+		body              string
+		grace             time.Duration
+		expectedExpiresIn int
+		expectUnmodified  bool
+	}{
+		{
+			name:              "grace is subtracted from token lifetime",
+			body:              `{"token":"abc","expires_in":300}`,
+			grace:             10 * time.Second,
+			expectedExpiresIn: 290,
+		},
+		{
+			name:              "grace is capped at half the token lifetime",
+			body:              `{"token":"abc","expires_in":60}`,
+			grace:             time.Minute,
+			expectedExpiresIn: 30,
+		},
+		{
+			name:             "token without expires_in is unmodified",
+			body:             `{"token":"abc"}`,
+			grace:            10 * time.Second,
+			expectUnmodified: true,
+		},
+		{
+			name:             "non-JSON body is unmodified",
+			body:             "data",
+			grace:            10 * time.Second,
+			expectUnmodified: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := applyTokenRefreshGrace([]byte(tc.body), tc.grace)
+			if tc.expectUnmodified {
+				if string(body) != tc.body {
+					t.Fatalf("expected body to be unmodified; got %s", body)
+				}
+				return
+			}
+			var token struct {
+				Token     string `json:"token"`
+				ExpiresIn int    `json:"expires_in"`
+			}
+			if err := json.Unmarshal(body, &token); err != nil {
+				t.Fatalf("failed to decode token response: %v", err)
+			}
+			if token.Token != "abc" {
+				t.Fatalf("expected token to be preserved; got %q", token.Token)
+			}
+			if token.ExpiresIn != tc.expectedExpiresIn {
+				t.Fatalf("expected expires_in %d; got %d", tc.expectedExpiresIn, token.ExpiresIn)
+			}
+		})
+	}
+}
+
+func TestTokenRefreshGrace(t *testing.T) {
+	testCases := []struct {
+		name              string
+		status            int
+		body              string
+		expectedExpiresIn int
+	}{
+		{
+			name:              "token lifetime is shortened by the grace period",
+			status:            http.StatusOK,
+			body:              `{"token":"abc","expires_in":300}`,
+			expectedExpiresIn: 290,
+		},
+		{
+			name:              "error responses are unmodified",
+			status:            http.StatusUnauthorized,
+			body:              `{"token":"abc","expires_in":300}`,
+			expectedExpiresIn: 300,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var tokenFetches int
+			tr := &tokenRefreshGraceTransport{
+				inner: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					tokenFetches++
+					header := make(http.Header)
+					header.Set("Content-Length", fmt.Sprint(len(tc.body)))
+					return &http.Response{
+						StatusCode:    tc.status,
+						Header:        header,
+						Body:          io.NopCloser(strings.NewReader(tc.body)),
+						ContentLength: int64(len(tc.body)),
+						Request:       req,
+					}, nil
+				}),
+				grace: 10 * time.Second,
+			}
+			req, err := http.NewRequest(http.MethodGet, "https://auth.example.com/token", nil)
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			resp, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("token request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("failed to read token response: %v", err)
+			}
+			if tokenFetches != 1 {
+				t.Fatalf("expected 1 token fetch; got %d", tokenFetches)
+			}
+			if resp.ContentLength != int64(len(body)) {
+				t.Fatalf("expected Content-Length %d to match the body; got %d", len(body), resp.ContentLength)
+			}
+			var token struct {
+				Token     string `json:"token"`
+				ExpiresIn int    `json:"expires_in"`
+			}
+			if err := json.Unmarshal(body, &token); err != nil {
+				t.Fatalf("failed to decode token response: %v", err)
+			}
+			if token.Token != "abc" || token.ExpiresIn != tc.expectedExpiresIn {
+				t.Fatalf("expected token %q expiring in %d; got %q expiring in %d", "abc", tc.expectedExpiresIn, token.Token, token.ExpiresIn)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRedirectsDoNotConsumeRetries(t *testing.T) {
+	const maxRetries = 2
+	var startHits, finalHits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/start":
+			startHits.Add(1)
+			http.Redirect(w, r, "/hop1", http.StatusFound)
+		case "/hop1":
+			http.Redirect(w, r, "/hop2", http.StatusTemporaryRedirect)
+		case "/hop2":
+			http.Redirect(w, r, "/final", http.StatusFound)
+		case "/final":
+			finalHits.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	testCases := []struct {
+		name              string
+		maxRedirects      int
+		expectedAttempts  int32
+		expectedFinalHits int32
+		expectedStatus    int
+		expectedErr       error
+	}{
+		{
+			name:              "redirects are followed and only the 503 is retried",
+			maxRedirects:      10,
+			expectedAttempts:  maxRetries + 1,
+			expectedFinalHits: maxRetries + 1,
+		},
+		{
+			name:             "exceeding max redirects is not retried",
+			maxRedirects:     2,
+			expectedAttempts: 1,
+			expectedErr:      ErrTooManyRedirects,
+		},
+		{
+			name:             "negative max redirects returns the redirect",
+			maxRedirects:     -1,
+			expectedAttempts: 1,
+			expectedStatus:   http.StatusFound,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			startHits.Store(0)
+			finalHits.Store(0)
+			client := newRetryableClientFromConfig(config.RetryableHTTPClientConfig{
+				RetryConfig:  config.RetryConfig{MaxRetries: maxRetries, MinWaitMsec: 1, MaxWaitMsec: 1},
+				MaxRedirects: tc.maxRedirects,
+			})
+			// Clones must keep the redirect policy.
+			client = CloneRetryableClient(client)
+
+			resp, err := client.Get(srv.URL + "/start")
+			if tc.expectedStatus != 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tc.expectedStatus {
+					t.Fatalf("expected status %d; got %d", tc.expectedStatus, resp.StatusCode)
+				}
+			} else if err == nil {
+				t.Fatalf("expected request to fail")
+			} else if tc.expectedErr != nil && !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected %v; got %v", tc.expectedErr, err)
+			}
+			if got := startHits.Load(); got != tc.expectedAttempts {
+				t.Fatalf("expected %d attempts; got %d", tc.expectedAttempts, got)
+			}
+			if got := finalHits.Load(); got != tc.expectedFinalHits {
+				t.Fatalf("expected %d requests to the final URL; got %d", tc.expectedFinalHits, got)
+			}
+		})
+	}
+}
+
+func TestBackoffStrategyRetryAfter(t *testing.T) {
+	const (
+		minWait = time.Millisecond
+		maxWait = 10 * time.Second
+	)
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		expected   time.Duration
+	}{
+		{
+			name:       "delta-seconds",
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "2",
+			expected:   2 * time.Second,
+		},
+		{
+			name:       "capped by the max wait",
+			status:     http.StatusServiceUnavailable,
+			retryAfter: "3600",
+			expected:   maxWait,
+		},
+		{
+			name:       "ignored for other statuses",
+			status:     http.StatusInternalServerError,
+			retryAfter: "2",
+			expected:   minWait,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tc.status, Header: http.Header{"Retry-After": []string{tc.retryAfter}}}
+			delay := backoffStrategy(minWait, maxWait, 0, resp)
+			// The jitter adds at most an eighth of the delay.
+			if delay < tc.expected || delay > tc.expected+tc.expected/4 {
+				t.Fatalf("expected a delay of about %v; got %v", tc.expected, delay)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/reference"
+)
+
+// CredentialRoute binds a credential helper to the registry hosts matching Pattern.
+// Pattern is a glob as accepted by path.Match, e.g. "*.dkr.ecr.*.amazonaws.com",
+// and is matched against the host, including its port if any, case-insensitively.
+type CredentialRoute struct {
+	Pattern    string
+	Credential Credential
+}
+
+// CredentialRouter routes credential lookups to the credential helpers bound to the
+// host, so that helpers of other registries are never consulted. When several patterns
+// match a host, only the helpers of the most specific one are consulted: a pattern without
+// wildcards is more specific than any glob, and a glob with more literal characters is more
+// specific than one with fewer. Ties go to the pattern registered first. Helpers bound
+// to the same pattern are consulted in the order they are registered, like the helpers
+// passed to WithCredsFuncs.
+//
+// CredentialRouter.Credential can be used wherever a Credential is expected.
+type CredentialRouter struct {
+	mu sync.RWMutex
+	// patterns are the registered patterns, in registration order.
+	patterns []string
+	// creds maps each pattern to the helpers bound to it.
+	creds map[string][]Credential
+	// routes caches the pattern routed to each host. Hosts without a
+	// matching pattern are cached with "".
+	routes map[string]string
+}
+
+// NewCredentialRouter returns a CredentialRouter without routes.
+func NewCredentialRouter() *CredentialRouter {
+	return &CredentialRouter{
+		creds:  make(map[string][]Credential),
+		routes: make(map[string]string),
+	}
+}
+
+// Register binds each credential helper to its host pattern. Either all routes are
+// registered, or none of them if a route is invalid.
+func (r *CredentialRouter) Register(routes ...CredentialRoute) error {
+	for _, route := range routes {
+		if route.Pattern == "" {
+			return fmt.Errorf("empty credential host pattern")
+		}
+		if _, err := path.Match(route.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid credential host pattern %q: %w", route.Pattern, err)
+		}
+		if route.Credential == nil {
+			return fmt.Errorf("no credential helper for host pattern %q", route.Pattern)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, route := range routes {
+		pattern := strings.ToLower(route.Pattern)
+		if _, ok := r.creds[pattern]; !ok {
+			r.patterns = append(r.patterns, pattern)
+		}
+		r.creds[pattern] = append(r.creds[pattern], route.Credential)
+	}
+	// New patterns may be more specific than the cached ones.
+	clear(r.routes)
+	return nil
+}
+
+// Credential returns the credentials of host from the helpers bound to the most
+// specific pattern matching it. It returns empty credentials if no pattern matches.
+func (r *CredentialRouter) Credential(imgRefSpec reference.Spec, host string) (string, string, error) {
+	return multiCredsFuncs(imgRefSpec, r.helpers(host)...)(host)
+}
+
+// helpers returns the credential helpers the host is routed to.
+func (r *CredentialRouter) helpers(host string) []Credential {
+	host = strings.ToLower(host)
+	r.mu.RLock()
+	pattern, ok := r.routes[host]
+	if ok {
+		helpers := r.creds[pattern]
+		r.mu.RUnlock()
+		return helpers
+	}
+	r.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pattern = ""
+	for _, p := range r.patterns {
+		if matched, _ := path.Match(p, host); matched && (pattern == "" || moreSpecific(p, pattern)) {
+			pattern = p
+		}
+	}
+	r.routes[host] = pattern
+	return r.creds[pattern]
+}
+
+// moreSpecific returns whether pattern a is more specific than pattern b.
+func moreSpecific(a, b string) bool {
+	aLiteral, aCount := literalChars(a)
+	bLiteral, bCount := literalChars(b)
+	if aLiteral != bLiteral {
+		return aLiteral
+	}
+	return aCount > bCount
+}
+
+// literalChars returns whether pattern has no wildcards and the number of
+// characters it matches literally.
+func literalChars(pattern string) (bool, int) {
+	literal := true
+	count := 0
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+		case c == '*' || c == '?':
+			literal = false
+		case c == '[':
+			literal = false
+			inClass = true
+		case c == '\\':
+			i++
+			count++
+		default:
+			count++
+		}
+	}
+	return literal, count
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+)
+
+func TestCredentialRouter(t *testing.T) {
+	var consulted []string
+	helper := func(name string) Credential {
+		return func(_ reference.Spec, host string) (string, string, error) {
+			consulted = append(consulted, name)
+			return name, "secret", nil
+		}
+	}
+
+	r := NewCredentialRouter()
+	err := r.Register(
+		CredentialRoute{Pattern: "*.dkr.ecr.*.amazonaws.com", Credential: helper("ecr")},
+		CredentialRoute{Pattern: "*.example.com", Credential: helper("example")},
+		CredentialRoute{Pattern: "registry.example.com", Credential: helper("registry")},
+		CredentialRoute{Pattern: "*", Credential: helper("fallback")},
+	)
+	if err != nil {
+		t.Fatalf("failed to register credential helpers: %v", err)
+	}
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{host: "123456789012.dkr.ecr.us-west-2.amazonaws.com", expected: "ecr"},
+		{host: "mirror.example.com", expected: "example"},
+		// The exact pattern is more specific than the glob also matching the host.
+		{host: "registry.example.com", expected: "registry"},
+		{host: "Registry.Example.com", expected: "registry"},
+		{host: "docker.io", expected: "fallback"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.host, func(t *testing.T) {
+			consulted = nil
+			username, _, err := r.Credential(reference.Spec{}, tc.host)
+			if err != nil {
+				t.Fatalf("failed to get credentials: %v", err)
+			}
+			if username != tc.expected {
+				t.Fatalf("expected credentials from %q; got %q", tc.expected, username)
+			}
+			if !slices.Equal(consulted, []string{tc.expected}) {
+				t.Fatalf("expected only %q to be consulted; got %v", tc.expected, consulted)
+			}
+		})
+	}
+
+	// Unmatched hosts get empty credentials without consulting any helper.
+	r = NewCredentialRouter()
+	if err := r.Register(CredentialRoute{Pattern: "*.example.com", Credential: helper("example")}); err != nil {
+		t.Fatalf("failed to register credential helper: %v", err)
+	}
+	consulted = nil
+	if username, secret, err := r.Credential(reference.Spec{}, "docker.io"); username != "" || secret != "" || err != nil {
+		t.Fatalf("expected empty credentials for an unmatched host; got %q, %q, %v", username, secret, err)
+	}
+	if len(consulted) != 0 {
+		t.Fatalf("expected no helper to be consulted; got %v", consulted)
+	}
+
+	if err := r.Register(CredentialRoute{Pattern: "[", Credential: helper("bad")}); err == nil {
+		t.Fatalf("expected malformed pattern to be rejected")
+	}
+}
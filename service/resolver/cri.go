@@ -191,6 +191,33 @@ func RegistryHostsFromCRIConfig(ctx context.Context, config Registry, credsFuncs
 	}
 }
 
+// ValidateCRIConfig checks that the host configuration of each registry under the ConfigPath
+// of config, i.e. its hosts.toml and the certificates it references, can be loaded, so that
+// a broken configuration is rejected before RegistryHostsFromCRIConfig fails on every pull
+// from the registry.
+func ValidateCRIConfig(ctx context.Context, config Registry) error {
+	for _, root := range filepath.SplitList(config.ConfigPath) {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+		hostOptions := dconfig.HostOptions{HostDir: dconfig.HostDirFromRoot(root)}
+		for _, e := range entries {
+			if !e.IsDir() {
+				continue
+			}
+			// The directory name is looked up as is, whether it's a host name or not.
+			if _, err := dconfig.ConfigureHosts(ctx, hostOptions)(e.Name()); err != nil {
+				return fmt.Errorf("invalid host config in %s: %w", filepath.Join(root, e.Name()), err)
+			}
+		}
+	}
+	return nil
+}
+
 // Ported from https://github.com/containerd/containerd/blob/v1.5.2/pkg/cri/server/image_pull.go#L316-L330
 // TODO: import this from CRI package once we drop support to continerd v1.4.x
 func hostDirFromRoots(roots []string) func(string) (string, error) {
@@ -0,0 +1,146 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/log"
+)
+
+// dockerHubHost is the host Docker Hub images are pulled from and the
+// host Docker config files key the mirrors and credentials of Docker Hub by.
+const dockerHubHost = "docker.io"
+
+// dockerConfigFile is the part of a Docker config file used to configure registry hosts.
+type dockerConfigFile struct {
+	// Auths maps registries, e.g. "registry.example.com" or "https://index.docker.io/v1/",
+	// to their credentials.
+	Auths map[string]dockerAuthConfig `json:"auths"`
+	// RegistryMirrors are the URLs of the mirrors of Docker Hub, e.g. "https://mirror.example.com".
+	// This is a key of the config of the Docker daemon (daemon.json) rather than of the Docker
+	// CLI (config.json), which the CLI ignores, so it can be added to either file.
+	RegistryMirrors []string `json:"registry-mirrors"`
+	// CredsStore and CredHelpers are the credential helpers of the Docker CLI, which aren't used.
+	CredsStore  string            `json:"credsStore"`
+	CredHelpers map[string]string `json:"credHelpers"`
+}
+
+// dockerAuthConfig is the credentials of a registry in a Docker config file.
+type dockerAuthConfig struct {
+	// Auth is the base64 encoding of "username:password".
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// RegistryHostsFromDockerConfig returns the registry hosts configured by the Docker config
+// file at path, e.g. ~/.docker/config.json. Registries are authenticated with the credentials
+// in "auths", after those of credsFuncs. Images of Docker Hub are pulled from the mirrors in
+// "registry-mirrors", in order, then from Docker Hub. "registry-mirrors" is a key of the Docker
+// daemon config (daemon.json) that the Docker CLI neither writes nor reads, so it has to be
+// added to the file. Credential helpers and stores of the file aren't used, which is logged:
+// pass e.g. the Docker config keychain in credsFuncs to use them.
+func RegistryHostsFromDockerConfig(path string, httpConfig config.RetryableHTTPClientConfig, credsFuncs ...Credential) (RegistryHosts, error) {
+	cfg, creds, err := loadDockerConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewRegistryManager(httpConfig, cfg, append(slices.Clone(credsFuncs), creds)).AsRegistryHosts(), nil
+}
+
+// loadDockerConfig returns the mirrors and credentials of the Docker config file at path.
+func loadDockerConfig(path string) (config.ResolverConfig, Credential, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config.ResolverConfig{}, nil, fmt.Errorf("cannot read Docker config file: %w", err)
+	}
+	var file dockerConfigFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return config.ResolverConfig{}, nil, fmt.Errorf("cannot parse Docker config file %s: %w", path, err)
+	}
+	if file.CredsStore != "" || len(file.CredHelpers) > 0 {
+		log.L.WithField("path", path).Warn("credential helpers of Docker config file are ignored, only its auths are used")
+	}
+
+	var cfg config.ResolverConfig
+	if len(file.RegistryMirrors) > 0 {
+		var mirrors []config.MirrorConfig
+		for _, m := range file.RegistryMirrors {
+			u, err := url.Parse(m)
+			if err != nil || u.Host == "" {
+				return config.ResolverConfig{}, nil, fmt.Errorf("invalid registry mirror %q in Docker config file %s", m, path)
+			}
+			mirrors = append(mirrors, config.MirrorConfig{
+				Host:     m,
+				Insecure: u.Scheme == "http",
+			})
+		}
+		cfg.Host = map[string]config.HostConfig{dockerHubHost: {Mirrors: mirrors}}
+	}
+
+	auths := make(map[string]dockerAuthConfig, len(file.Auths))
+	for registry, auth := range file.Auths {
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return config.ResolverConfig{}, nil, fmt.Errorf("invalid auth of %q in Docker config file %s: %w", registry, path, err)
+			}
+			username, password, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return config.ResolverConfig{}, nil, fmt.Errorf("invalid auth of %q in Docker config file %s: not username:password", registry, path)
+			}
+			auth.Username, auth.Password = username, password
+		}
+		auths[dockerConfigHost(registry)] = auth
+	}
+	creds := func(_ reference.Spec, host string) (string, string, error) {
+		auth, ok := auths[dockerConfigHost(host)]
+		if !ok {
+			return "", "", nil
+		}
+		if auth.IdentityToken != "" {
+			return "", auth.IdentityToken, nil
+		}
+		return auth.Username, auth.Password, nil
+	}
+	return cfg, creds, nil
+}
+
+// dockerConfigHost returns the host of registry, a key of the auths of a Docker config file
+// or a registry host, e.g. "docker.io" for "https://index.docker.io/v1/".
+func dockerConfigHost(registry string) string {
+	host := registry
+	if u, err := url.Parse(registry); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	host = strings.ToLower(host)
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return dockerHubHost
+	}
+	return host
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/containerd/containerd/reference"
+)
+
+func TestRegistryHostsFromDockerConfig(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "`+auth+`"},
+		"registry.example.com": {"identitytoken": "token"}
+	},
+	"registry-mirrors": ["https://mirror.example.com"],
+	"credHelpers": {"helper.example.com": "ecr-login"}
+}`), 0600); err != nil {
+		t.Fatalf("failed to write Docker config: %v", err)
+	}
+
+	hosts, err := RegistryHostsFromDockerConfig(path, config.RetryableHTTPClientConfig{})
+	if err != nil {
+		t.Fatalf("RegistryHostsFromDockerConfig failed: %v", err)
+	}
+
+	t.Run("mirrors", func(t *testing.T) {
+		refspec, err := reference.Parse("docker.io/library/ubuntu:latest")
+		if err != nil {
+			t.Fatalf("failed to parse reference: %v", err)
+		}
+		registryHosts, err := hosts(refspec)
+		if err != nil {
+			t.Fatalf("failed to get registry hosts: %v", err)
+		}
+		expected := []string{"mirror.example.com", "registry-1.docker.io"}
+		if len(registryHosts) != len(expected) {
+			t.Fatalf("expected hosts %v; got %v", expected, registryHosts)
+		}
+		for i, h := range registryHosts {
+			if h.Host != expected[i] || h.Scheme != "https" || h.Path != "/v2" {
+				t.Fatalf("expected host %d to be https://%s/v2; got %s://%s%s", i, expected[i], h.Scheme, h.Host, h.Path)
+			}
+		}
+	})
+
+	t.Run("auths", func(t *testing.T) {
+		_, creds, err := loadDockerConfig(path)
+		if err != nil {
+			t.Fatalf("loadDockerConfig failed: %v", err)
+		}
+		tests := []struct {
+			host             string
+			expectedUsername string
+			expectedSecret   string
+		}{
+			{host: "registry-1.docker.io", expectedUsername: "user", expectedSecret: "secret"},
+			{host: "registry.example.com", expectedSecret: "token"},
+			{host: "other.example.com"},
+			// Credential helpers aren't used.
+			{host: "helper.example.com"},
+		}
+		for _, tc := range tests {
+			username, secret, err := creds(reference.Spec{}, tc.host)
+			if err != nil {
+				t.Fatalf("failed to get credentials of %s: %v", tc.host, err)
+			}
+			if username != tc.expectedUsername || secret != tc.expectedSecret {
+				t.Fatalf("expected credentials %q:%q for %s; got %q:%q", tc.expectedUsername, tc.expectedSecret, tc.host, username, secret)
+			}
+		}
+	})
+
+	t.Run("invalid file", func(t *testing.T) {
+		invalid := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(invalid, []byte(`{"registry-mirrors": "not a list"}`), 0600); err != nil {
+			t.Fatalf("failed to write Docker config: %v", err)
+		}
+		if _, err := RegistryHostsFromDockerConfig(invalid, config.RetryableHTTPClientConfig{}); err == nil {
+			t.Fatal("expected an invalid Docker config file to fail")
+		}
+	})
+}
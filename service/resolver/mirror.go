@@ -0,0 +1,55 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/config"
+)
+
+// RegistryHostsWithMirror returns registry hosts pulling the images of every registry from
+// mirror, e.g. "mirror.local:5000" or "http://mirror.local:5000/v2", then from the registry.
+// Mirrors without a scheme use plain HTTP only on localhost, like registries. Registries are
+// authenticated with the credentials of credsFuncs.
+func RegistryHostsWithMirror(mirror string, httpConfig config.RetryableHTTPClientConfig, credsFuncs ...Credential) (RegistryHosts, error) {
+	mirrorConfig, err := parseMirrorConfig(mirror)
+	if err != nil {
+		return nil, err
+	}
+	rm := NewRegistryManager(httpConfig, config.ResolverConfig{}, credsFuncs)
+	rm.defaultMirrors = []config.MirrorConfig{mirrorConfig}
+	return rm.AsRegistryHosts(), nil
+}
+
+// parseMirrorConfig returns the config of mirror, a host with an optional scheme and API root.
+func parseMirrorConfig(mirror string) (config.MirrorConfig, error) {
+	host := mirror
+	if !strings.Contains(host, "://") {
+		host = "//" + host
+	}
+	u, err := url.Parse(host)
+	if err != nil || u.Host == "" || (u.Scheme != "" && u.Scheme != "http" && u.Scheme != "https") {
+		return config.MirrorConfig{}, fmt.Errorf("invalid registry mirror %q", mirror)
+	}
+	return config.MirrorConfig{
+		Host:     host,
+		Insecure: u.Scheme == "http",
+	}, nil
+}
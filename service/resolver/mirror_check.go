@@ -0,0 +1,203 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/log"
+	"github.com/golang/groupcache/lru"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// manifestMediaTypes are the media types accepted when checking whether a mirror
+// serves an image's manifest.
+var manifestMediaTypes = []string{
+	ocispec.MediaTypeImageIndex,
+	ocispec.MediaTypeImageManifest,
+	images.MediaTypeDockerSchema2ManifestList,
+	images.MediaTypeDockerSchema2Manifest,
+}
+
+// mirrorCheckMaxResults is the maximum number of mirror and repository pairs whose
+// result is cached. The least recently used results are dropped first.
+const mirrorCheckMaxResults = 1024
+
+// errRepositoryNotServed is returned by headManifest when a mirror answers that it
+// doesn't serve the manifest, as opposed to failing to answer.
+var errRepositoryNotServed = errors.New("mirror doesn't serve repository")
+
+// mirrorCheckResult is the cached result of checking a mirror for a repository.
+type mirrorCheckResult struct {
+	serves  bool
+	expires time.Time
+}
+
+// MirrorCheck excludes mirrors that don't serve an image's repository, so that
+// blobs aren't requested from mirrors that respond to each of them with a 404.
+type MirrorCheck struct {
+	timeout  time.Duration
+	cacheTTL time.Duration
+
+	// results maps a mirror host and repository to whether the mirror serves the repository.
+	results   *lru.Cache
+	resultsMu sync.Mutex
+}
+
+// NewMirrorCheck returns a new MirrorCheck for the given config.
+func NewMirrorCheck(cfg config.MirrorCheckConfig) *MirrorCheck {
+	return &MirrorCheck{
+		timeout:  time.Duration(cfg.TimeoutSec) * time.Second,
+		cacheTTL: time.Duration(cfg.CacheTTLSec) * time.Second,
+		results:  lru.New(mirrorCheckMaxResults),
+	}
+}
+
+// RegistryHosts returns a RegistryHosts that removes the mirrors returned by hosts
+// that answer a HEAD request for the image's manifest negatively. Mirrors are checked
+// in parallel. Mirrors that fail to answer are kept, since failing over between
+// unhealthy hosts is left to the filesystem. The last host is the registry itself,
+// which is always kept, so images fall back to the registry if no mirror serves them.
+func (mc *MirrorCheck) RegistryHosts(hosts RegistryHosts) RegistryHosts {
+	return func(imgRefSpec reference.Spec) ([]docker.RegistryHost, error) {
+		registryHosts, err := hosts(imgRefSpec)
+		if err != nil || len(registryHosts) <= 1 {
+			return registryHosts, err
+		}
+
+		repository := strings.TrimPrefix(imgRefSpec.Locator, imgRefSpec.Hostname()+"/")
+		mirrors := registryHosts[:len(registryHosts)-1]
+		serves := make([]bool, len(mirrors))
+		var wg sync.WaitGroup
+		for i, h := range mirrors {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serves[i] = mc.serves(h, repository, imgRefSpec)
+			}()
+		}
+		wg.Wait()
+
+		checked := make([]docker.RegistryHost, 0, len(registryHosts))
+		for i, h := range mirrors {
+			if serves[i] {
+				checked = append(checked, h)
+			}
+		}
+		return append(checked, registryHosts[len(registryHosts)-1]), nil
+	}
+}
+
+// serves returns whether the mirror h serves repository, using the cached
+// result if there is one that hasn't expired. Only answers of the mirror are
+// cached; if it fails to answer, it's assumed to serve repository and is
+// checked again the next time.
+func (mc *MirrorCheck) serves(h docker.RegistryHost, repository string, imgRefSpec reference.Spec) bool {
+	key := h.Scheme + "://" + h.Host + h.Path + "/" + repository
+	mc.resultsMu.Lock()
+	cached, ok := mc.results.Get(key)
+	mc.resultsMu.Unlock()
+	if ok {
+		if result := cached.(mirrorCheckResult); time.Now().Before(result.expires) {
+			return result.serves
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mc.timeout)
+	defer cancel()
+	err := headManifest(ctx, h, repository, imgRefSpec)
+	logger := log.G(ctx).WithError(err).WithField("host", h.Host).WithField("repository", repository)
+	switch {
+	case err == nil:
+	case errors.Is(err, errRepositoryNotServed):
+		logger.Warn("mirror doesn't serve repository; skipping it")
+	default:
+		logger.Warn("failed to check whether mirror serves repository; using it")
+		return true
+	}
+	result := mirrorCheckResult{serves: err == nil, expires: time.Now().Add(mc.cacheTTL)}
+	mc.resultsMu.Lock()
+	mc.results.Add(key, result)
+	mc.resultsMu.Unlock()
+	return result.serves
+}
+
+// headManifest issues a HEAD request for the manifest of imgRefSpec in repository
+// against h and returns an error unless it succeeds. The error wraps
+// errRepositoryNotServed if h answers with a client error status, other than
+// ones that may go away when retrying.
+func headManifest(ctx context.Context, h docker.RegistryHost, repository string, imgRefSpec reference.Spec) error {
+	ref := imgRefSpec.Digest().String()
+	if ref == "" {
+		ref, _, _ = strings.Cut(imgRefSpec.Object, "@")
+	}
+	if ref == "" {
+		ref = "latest"
+	}
+	u := fmt.Sprintf("%s://%s%s/%s/manifests/%s", h.Scheme, h.Host, h.Path, repository, ref)
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+		if h.Authorizer != nil {
+			if err := h.Authorizer.Authorize(ctx, req); err != nil {
+				return nil, err
+			}
+		}
+		return client.Do(req)
+	}
+	resp, err := do()
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized && h.Authorizer != nil {
+		if err := h.Authorizer.AddResponses(ctx, []*http.Response{resp}); err != nil {
+			return err
+		}
+		if resp, err = do(); err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode <= 499 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return fmt.Errorf("%w: unexpected status code from %s: %v", errRepositoryNotServed, u, resp.Status)
+	default:
+		return fmt.Errorf("unexpected status code from %s: %v", u, resp.Status)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+func TestMirrorCheck(t *testing.T) {
+	newMirror := func(repository string, requests *atomic.Int64) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			if r.Method != http.MethodHead || r.URL.Path != "/v2/"+repository+"/manifests/latest" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+	}
+	var servingRequests, missingRequests atomic.Int64
+	serving := newMirror("library/alpine", &servingRequests)
+	defer serving.Close()
+	missing := newMirror("library/busybox", &missingRequests)
+	defer missing.Close()
+	var unavailableRequests atomic.Int64
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unavailableRequests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	mirrorHost := func(ts *httptest.Server) docker.RegistryHost {
+		return docker.RegistryHost{
+			Client: ts.Client(),
+			Host:   strings.TrimPrefix(ts.URL, "http://"),
+			Scheme: "http",
+			Path:   "/v2",
+		}
+	}
+	mc := NewMirrorCheck(config.MirrorCheckConfig{Enable: true, TimeoutSec: 5, CacheTTLSec: 60})
+	hosts := mc.RegistryHosts(func(imgRefSpec reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{
+			mirrorHost(missing),
+			mirrorHost(unavailable),
+			mirrorHost(serving),
+			{Host: "registry-1.docker.io", Scheme: "https", Path: "/v2"},
+		}, nil
+	})
+	refspec, err := reference.Parse("docker.io/library/alpine:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+
+	// Mirrors that fail to answer are kept, but mirrors that answer that they
+	// don't serve the repository aren't.
+	expected := []string{
+		mirrorHost(unavailable).Host,
+		mirrorHost(serving).Host,
+		"registry-1.docker.io",
+	}
+	for i := 0; i < 2; i++ {
+		registryHosts, err := hosts(refspec)
+		if err != nil {
+			t.Fatalf("failed to get registry hosts: %v", err)
+		}
+		var actual []string
+		for _, h := range registryHosts {
+			actual = append(actual, h.Host)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("expected registry hosts %v; got %v", expected, actual)
+		}
+	}
+	// The second resolution is served from the cached answers.
+	if servingRequests.Load() != 1 || missingRequests.Load() != 1 {
+		t.Fatalf("expected each answering mirror to be checked once; got %d and %d checks", servingRequests.Load(), missingRequests.Load())
+	}
+	if unavailableRequests.Load() != 2 {
+		t.Fatalf("expected failures to answer not to be cached; got %d checks", unavailableRequests.Load())
+	}
+}
@@ -0,0 +1,197 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/log"
+)
+
+// discoveredMirrors is the response body of a mirror discovery endpoint.
+// It mirrors the layout of the `[resolver.host]` config.
+type discoveredMirrors struct {
+	Host map[string]struct {
+		Mirrors []struct {
+			Host     string `json:"host"`
+			Insecure bool   `json:"insecure"`
+		} `json:"mirrors"`
+	} `json:"host"`
+}
+
+// mirror is a validated mirror of a registry host.
+type mirror struct {
+	host   string
+	scheme string
+	path   string
+}
+
+// MirrorDiscovery periodically pulls the current set of registry mirrors
+// from a discovery endpoint so that mirrors can be added or removed without
+// restarting the snapshotter.
+type MirrorDiscovery struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+
+	// mirrors maps a registry host to its last successfully discovered mirrors.
+	mirrors   map[string][]mirror
+	mirrorsMu sync.RWMutex
+}
+
+// NewMirrorDiscovery returns a new MirrorDiscovery for the given config.
+func NewMirrorDiscovery(cfg config.MirrorDiscoveryConfig) *MirrorDiscovery {
+	interval := time.Duration(cfg.RefreshIntervalSec) * time.Second
+	return &MirrorDiscovery{
+		url:      cfg.URL,
+		interval: interval,
+		client:   &http.Client{Timeout: interval},
+		mirrors:  make(map[string][]mirror),
+	}
+}
+
+// Run refreshes the mirrors immediately and then once every refresh interval
+// until ctx is done.
+func (md *MirrorDiscovery) Run(ctx context.Context) {
+	ticker := time.NewTicker(md.interval)
+	defer ticker.Stop()
+	for {
+		if err := md.Refresh(ctx); err != nil {
+			log.G(ctx).WithError(err).WithField("url", md.url).Warn("failed to refresh registry mirrors; keeping last known mirrors")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh pulls the mirrors from the discovery endpoint and replaces the
+// known mirrors with them. On failure, the known mirrors are left unchanged.
+func (md *MirrorDiscovery) Refresh(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, md.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := md.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code from mirror discovery endpoint: %v", resp.Status)
+	}
+	var body discoveredMirrors
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("failed to decode discovered mirrors: %w", err)
+	}
+
+	mirrors := make(map[string][]mirror, len(body.Host))
+	for host, hostConfig := range body.Host {
+		for _, m := range hostConfig.Mirrors {
+			parsed, err := parseMirror(m.Host, m.Insecure)
+			if err != nil {
+				return fmt.Errorf("invalid mirror for host %q: %w", host, err)
+			}
+			mirrors[host] = append(mirrors[host], parsed)
+		}
+	}
+
+	md.mirrorsMu.Lock()
+	md.mirrors = mirrors
+	md.mirrorsMu.Unlock()
+	return nil
+}
+
+// RegistryHosts returns a RegistryHosts that adds the discovered mirrors of an
+// image's host to the registry hosts returned by hosts. Discovered mirrors are
+// placed right before the registry itself, i.e. after any statically configured
+// mirrors, and share its client and authorizer.
+func (md *MirrorDiscovery) RegistryHosts(hosts RegistryHosts) RegistryHosts {
+	return func(imgRefSpec reference.Spec) ([]docker.RegistryHost, error) {
+		registryHosts, err := hosts(imgRefSpec)
+		if err != nil || len(registryHosts) == 0 {
+			return registryHosts, err
+		}
+
+		md.mirrorsMu.RLock()
+		mirrors := md.mirrors[imgRefSpec.Hostname()]
+		md.mirrorsMu.RUnlock()
+		if len(mirrors) == 0 {
+			return registryHosts, nil
+		}
+
+		known := make(map[string]struct{}, len(registryHosts))
+		for _, h := range registryHosts {
+			known[h.Host] = struct{}{}
+		}
+		upstream := registryHosts[len(registryHosts)-1]
+		merged := make([]docker.RegistryHost, 0, len(registryHosts)+len(mirrors))
+		merged = append(merged, registryHosts[:len(registryHosts)-1]...)
+		for _, m := range mirrors {
+			if _, ok := known[m.host]; ok {
+				continue
+			}
+			h := upstream
+			h.Host = m.host
+			h.Scheme = m.scheme
+			h.Path = m.path
+			h.Capabilities = docker.HostCapabilityPull | docker.HostCapabilityResolve
+			merged = append(merged, h)
+		}
+		return append(merged, upstream), nil
+	}
+}
+
+// parseMirror validates a mirror host, which is either a host name
+// optionally followed by a port, or a URL.
+func parseMirror(host string, insecure bool) (mirror, error) {
+	raw := host
+	if !strings.Contains(raw, "://") {
+		raw = "//" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return mirror{}, fmt.Errorf("failed to parse mirror host %q: %w", host, err)
+	}
+	if u.Host == "" {
+		return mirror{}, fmt.Errorf("mirror host %q is missing a host name", host)
+	}
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = DefaultScheme(u.Host)
+	}
+	if insecure {
+		scheme = "http"
+	}
+	path := u.Path
+	if path == "" {
+		path = "/v2"
+	}
+	return mirror{host: u.Host, scheme: scheme, path: path}, nil
+}
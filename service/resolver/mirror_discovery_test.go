@@ -0,0 +1,150 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+func TestMirrorDiscovery(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		status = http.StatusOK
+		body   string
+	)
+	setResponse := func(s int, b string) {
+		mu.Lock()
+		defer mu.Unlock()
+		status, body = s, b
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	md := NewMirrorDiscovery(config.MirrorDiscoveryConfig{URL: ts.URL, RefreshIntervalSec: 60})
+	hosts := md.RegistryHosts(func(imgRefSpec reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{
+			{Host: "static-mirror.example.com", Scheme: "https", Path: "/v2"},
+			{Host: "registry-1.docker.io", Scheme: "https", Path: "/v2"},
+		}, nil
+	})
+	refspec, err := reference.Parse("docker.io/library/alpine:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	checkHosts := func(t *testing.T, expected []string) {
+		registryHosts, err := hosts(refspec)
+		if err != nil {
+			t.Fatalf("failed to get registry hosts: %v", err)
+		}
+		var actual []string
+		for _, h := range registryHosts {
+			actual = append(actual, h.Scheme+"://"+h.Host+h.Path)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Fatalf("expected registry hosts %v; got %v", expected, actual)
+		}
+	}
+
+	checkHosts(t, []string{
+		"https://static-mirror.example.com/v2",
+		"https://registry-1.docker.io/v2",
+	})
+
+	testCases := []struct {
+		name      string
+		status    int
+		body      string
+		expectErr bool
+		expected  []string
+	}{
+		{
+			name:   "discovered mirrors are added before the registry",
+			status: http.StatusOK,
+			body:   `{"host": {"docker.io": {"mirrors": [{"host": "mirror-a.example.com"}, {"host": "http://mirror-b.example.com:5000/custom"}]}}}`,
+			expected: []string{
+				"https://static-mirror.example.com/v2",
+				"https://mirror-a.example.com/v2",
+				"http://mirror-b.example.com:5000/custom",
+				"https://registry-1.docker.io/v2",
+			},
+		},
+		{
+			name:   "mirrors are replaced on refresh",
+			status: http.StatusOK,
+			body:   `{"host": {"docker.io": {"mirrors": [{"host": "mirror-c.example.com", "insecure": true}, {"host": "static-mirror.example.com"}]}, "ghcr.io": {"mirrors": [{"host": "mirror-d.example.com"}]}}}`,
+			expected: []string{
+				"https://static-mirror.example.com/v2",
+				"http://mirror-c.example.com/v2",
+				"https://registry-1.docker.io/v2",
+			},
+		},
+		{
+			name:      "failed refresh keeps last known mirrors",
+			status:    http.StatusInternalServerError,
+			expectErr: true,
+			expected: []string{
+				"https://static-mirror.example.com/v2",
+				"http://mirror-c.example.com/v2",
+				"https://registry-1.docker.io/v2",
+			},
+		},
+		{
+			name:      "malformed response keeps last known mirrors",
+			status:    http.StatusOK,
+			body:      `{"host": {"docker.io": {"mirrors": [{"host": ""}]}}}`,
+			expectErr: true,
+			expected: []string{
+				"https://static-mirror.example.com/v2",
+				"http://mirror-c.example.com/v2",
+				"https://registry-1.docker.io/v2",
+			},
+		},
+		{
+			name:   "mirrors are removed on refresh",
+			status: http.StatusOK,
+			body:   `{"host": {}}`,
+			expected: []string{
+				"https://static-mirror.example.com/v2",
+				"https://registry-1.docker.io/v2",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setResponse(tc.status, tc.body)
+			err := md.Refresh(context.Background())
+			if tc.expectErr != (err != nil) {
+				t.Fatalf("expected error: %v; got %v", tc.expectErr, err)
+			}
+			checkHosts(t, tc.expected)
+		})
+	}
+}
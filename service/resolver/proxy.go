@@ -0,0 +1,67 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/awslabs/soci-snapshotter/config"
+)
+
+// ErrProxyAuthenticationRequired is returned when an HTTP proxy responds with
+// 407 Proxy Authentication Required.
+var ErrProxyAuthenticationRequired = errors.New("proxy authentication required")
+
+// newProxyTransport returns a clone of base that sends every request through the
+// proxy described by cfg. If cfg has credentials, they are sent to the proxy in
+// the Proxy-Authorization header, both on CONNECT requests for https registries
+// and on plain http requests. They are never sent to the registry itself.
+func newProxyTransport(base *http.Transport, cfg config.ProxyConfig) (*http.Transport, error) {
+	proxyURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse proxy url: %w", err)
+	}
+	if proxyURL.Scheme == "" || proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy url %q: scheme and host are required", proxyURL.Redacted())
+	}
+	if cfg.Username != "" || cfg.Password != "" {
+		proxyURL.User = url.UserPassword(cfg.Username, cfg.Password)
+	}
+	hasCreds := proxyURL.User != nil
+
+	t := base.Clone()
+	t.Proxy = http.ProxyURL(proxyURL)
+	t.OnProxyConnectResponse = func(_ context.Context, proxyURL *url.URL, _ *http.Request, resp *http.Response) error {
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			return nil
+		}
+		return proxyAuthError(proxyURL, hasCreds)
+	}
+	return t, nil
+}
+
+// proxyAuthError returns an error explaining why proxyURL rejected a request.
+func proxyAuthError(proxyURL *url.URL, hasCreds bool) error {
+	if hasCreds {
+		return fmt.Errorf("%w: proxy %s rejected the configured credentials", ErrProxyAuthenticationRequired, proxyURL.Redacted())
+	}
+	return fmt.Errorf("%w: proxy %s requires credentials; configure them in the resolver host's proxy config", ErrProxyAuthenticationRequired, proxyURL.Redacted())
+}
@@ -0,0 +1,196 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+)
+
+const (
+	proxyUser     = "proxy-user"
+	proxyPassword = "proxy-password"
+)
+
+// newMockProxy returns a proxy that requires basic Proxy-Authorization and
+// counts the requests it receives. It tunnels CONNECT requests and forwards
+// plain http requests.
+func newMockProxy(t *testing.T, requests *atomic.Int32) *httptest.Server {
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(proxyUser+":"+proxyPassword))
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.Header.Get("Proxy-Authorization") != expected {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != http.MethodConnect {
+			r.RequestURI = ""
+			r.Header.Del("Proxy-Authorization")
+			resp, err := http.DefaultTransport.RoundTrip(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		if rw.Reader.Buffered() > 0 {
+			io.CopyN(upstream, rw, int64(rw.Reader.Buffered()))
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy
+}
+
+func TestProxyAuthentication(t *testing.T) {
+	registryHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("proxy credentials were sent to the registry")
+		}
+		w.Write([]byte("ok"))
+	})
+	registries := map[string]*httptest.Server{
+		"http":  httptest.NewServer(registryHandler),
+		"https": httptest.NewTLSServer(registryHandler),
+	}
+	for _, registry := range registries {
+		t.Cleanup(registry.Close)
+	}
+
+	testCases := []struct {
+		name     string
+		username string
+		password string
+		wantErr  bool
+	}{
+		{
+			name:     "valid credentials",
+			username: proxyUser,
+			password: proxyPassword,
+		},
+		{
+			name:    "missing credentials",
+			wantErr: true,
+		},
+		{
+			name:     "wrong credentials",
+			username: proxyUser,
+			password: "wrong",
+			wantErr:  true,
+		},
+	}
+	for scheme, registry := range registries {
+		for _, tc := range testCases {
+			t.Run(scheme+"/"+tc.name, func(t *testing.T) {
+				var proxyRequests atomic.Int32
+				proxy := newMockProxy(t, &proxyRequests)
+				registryURL, err := url.Parse(registry.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				host := registryURL.Host
+
+				rm := NewRegistryManager(config.RetryableHTTPClientConfig{
+					RetryConfig: config.RetryConfig{MaxRetries: 3, MinWaitMsec: 1, MaxWaitMsec: 1},
+				}, config.ResolverConfig{
+					Host: map[string]config.HostConfig{
+						host: {
+							Proxy: config.ProxyConfig{
+								URL:      proxy.URL,
+								Username: tc.username,
+								Password: tc.password,
+							},
+						},
+					},
+				}, nil)
+				retryClient, err := rm.hostRetryClient(host)
+				if err != nil {
+					t.Fatalf("failed to create client: %v", err)
+				}
+				if retryClient == rm.retryClient {
+					t.Fatalf("expected a proxied client for host %s", host)
+				}
+				retryClient.HTTPClient.Transport.(*http.Transport).TLSClientConfig = registries["https"].Client().Transport.(*http.Transport).TLSClientConfig
+
+				resp, err := retryClient.Get(registry.URL)
+				if tc.wantErr {
+					if !errors.Is(err, ErrProxyAuthenticationRequired) {
+						t.Fatalf("expected %v; got %v", ErrProxyAuthenticationRequired, err)
+					}
+					if got := proxyRequests.Load(); got != 1 {
+						t.Fatalf("expected the request not to be retried; proxy got %d requests", got)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("request through proxy failed: %v", err)
+				}
+				defer resp.Body.Close()
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(body) != "ok" {
+					t.Fatalf("unexpected response %q", body)
+				}
+				if proxyRequests.Load() == 0 {
+					t.Fatalf("request was not sent through the proxy")
+				}
+			})
+		}
+	}
+
+	t.Run("unconfigured host", func(t *testing.T) {
+		rm := NewRegistryManager(config.RetryableHTTPClientConfig{}, config.ResolverConfig{}, nil)
+		retryClient, err := rm.hostRetryClient("registry.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if retryClient != rm.retryClient {
+			t.Fatalf("expected the global client for a host without a proxy")
+		}
+	})
+}
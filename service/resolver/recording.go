@@ -0,0 +1,108 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	socihttp "github.com/awslabs/soci-snapshotter/internal/http"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// HTTPRecording records registry traffic to, or replays it from, the file configured in
+// its config. The file is opened once, so the registry hosts wrapped by a recording, e.g.
+// before and after a config reload, all record to it without truncating it.
+type HTTPRecording struct {
+	cfg  config.HTTPRecordingConfig
+	wrap func(http.RoundTripper) http.RoundTripper
+	// recorder is the recorder of the file when recording, nil when replaying.
+	recorder *socihttp.Recorder
+}
+
+// NewHTTPRecording opens the recording configured in cfg. It returns nil if recording is disabled.
+func NewHTTPRecording(cfg config.HTTPRecordingConfig) (*HTTPRecording, error) {
+	switch cfg.Mode {
+	case "":
+		return nil, nil
+	case config.HTTPRecordingModeRecord:
+		rec, err := socihttp.NewRecorder(cfg.Path, cfg.DigestOnly)
+		if err != nil {
+			return nil, err
+		}
+		return &HTTPRecording{cfg: cfg, wrap: rec.Transport, recorder: rec}, nil
+	case config.HTTPRecordingModeReplay:
+		replay, err := socihttp.NewReplayTransport(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		return &HTTPRecording{cfg: cfg, wrap: func(http.RoundTripper) http.RoundTripper {
+			return replay
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unknown HTTP recording mode %q", cfg.Mode)
+	}
+}
+
+// Config returns the config r was opened with, which is empty if r is nil.
+func (r *HTTPRecording) Config() config.HTTPRecordingConfig {
+	if r == nil {
+		return config.HTTPRecordingConfig{}
+	}
+	return r.cfg
+}
+
+// RegistryHosts returns RegistryHosts whose clients record registry traffic to, or
+// replay it from, r. If r is nil, hosts is returned as-is.
+func (r *HTTPRecording) RegistryHosts(hosts RegistryHosts) RegistryHosts {
+	if r == nil {
+		return hosts
+	}
+	return wrapTransports(hosts, r.wrap)
+}
+
+// Close closes the recording file. Requests sent afterwards by the clients of the hosts
+// wrapped by r are still sent, but no longer recorded.
+func (r *HTTPRecording) Close() error {
+	if r == nil || r.recorder == nil {
+		return nil
+	}
+	return r.recorder.Close()
+}
+
+// wrapTransports returns RegistryHosts whose clients use the transports of hosts wrapped by wrap.
+func wrapTransports(hosts RegistryHosts, wrap func(http.RoundTripper) http.RoundTripper) RegistryHosts {
+	return func(imgRefSpec reference.Spec) ([]docker.RegistryHost, error) {
+		registryHosts, err := hosts(imgRefSpec)
+		if err != nil {
+			return nil, err
+		}
+		wrapped := make([]docker.RegistryHost, len(registryHosts))
+		for i, host := range registryHosts {
+			var client http.Client
+			if host.Client != nil {
+				client = *host.Client
+			}
+			client.Transport = wrap(client.Transport)
+			host.Client = &client
+			wrapped[i] = host
+		}
+		return wrapped, nil
+	}
+}
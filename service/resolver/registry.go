@@ -33,6 +33,7 @@
 package resolver
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -40,6 +41,7 @@ import (
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/awslabs/soci-snapshotter/util/ratelimit"
 	rhttp "github.com/hashicorp/go-retryablehttp"
 
 	"github.com/containerd/containerd/reference"
@@ -66,19 +68,65 @@ type RegistryManager struct {
 	creds []Credential
 	// registryHostMap is a map of image reference to registry configurations
 	registryHostMap *sync.Map
+	// tokenRefreshGrace is how long before expiry bearer tokens are refreshed
+	tokenRefreshGrace time.Duration
+	// queryAuthParams are the query parameters that carry auth tokens in blob URLs
+	queryAuthParams []string
+	// staleConnRetry is whether requests on connections closed by the registry
+	// while idle are retried on a fresh connection
+	staleConnRetry bool
+	// tokenLimiter limits the rate of token requests per auth server.
+	// It is shared by all registries since they may use the same auth server.
+	tokenLimiter *ratelimit.KeyedLimiter
+	// proxyClients is a map of host to the retryable client sending requests
+	// through the host's configured proxy
+	proxyClients *sync.Map
+	// defaultMirrors are the mirrors of hosts without per-host registry config
+	defaultMirrors []config.MirrorConfig
 }
 
 // NewRegistryManager returns a new RegistryManager
 func NewRegistryManager(httpConfig config.RetryableHTTPClientConfig, registryConfig config.ResolverConfig, credsFuncs []Credential) *RegistryManager {
 	return &RegistryManager{
-		retryClient:     newRetryableClientFromConfig(httpConfig),
-		header:          globalHeaders(),
-		registryConfig:  registryConfig,
-		creds:           credsFuncs,
-		registryHostMap: &sync.Map{},
+		retryClient:       newRetryableClientFromConfig(httpConfig),
+		header:            globalHeaders(),
+		registryConfig:    registryConfig,
+		creds:             credsFuncs,
+		registryHostMap:   &sync.Map{},
+		tokenRefreshGrace: time.Duration(httpConfig.TokenRefreshGraceMsec) * time.Millisecond,
+		queryAuthParams:   httpConfig.QueryAuthParams,
+		staleConnRetry:    !httpConfig.DisableStaleConnRetry,
+		tokenLimiter:      ratelimit.NewKeyedLimiter(httpConfig.TokenRateLimit, httpConfig.TokenRateLimitBurst),
+		proxyClients:      &sync.Map{},
 	}
 }
 
+// hostRetryClient returns the retryable client used for requests to host.
+// If a proxy is configured for host, the returned client sends requests
+// through it. Otherwise, the global retryable client is returned.
+func (rm *RegistryManager) hostRetryClient(host string) (*rhttp.Client, error) {
+	proxyConfig := rm.registryConfig.Host[host].Proxy
+	if proxyConfig.URL == "" {
+		return rm.retryClient, nil
+	}
+	if client, ok := rm.proxyClients.Load(host); ok {
+		return client.(*rhttp.Client), nil
+	}
+	base, ok := rm.retryClient.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		return nil, fmt.Errorf("cannot configure proxy for host %q: unexpected transport type %T", host, rm.retryClient.HTTPClient.Transport)
+	}
+	transport, err := newProxyTransport(base, proxyConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure proxy for host %q: %w", host, err)
+	}
+	retryClient := CloneRetryableClient(rm.retryClient)
+	retryClient.HTTPClient.Timeout = rm.retryClient.HTTPClient.Timeout
+	retryClient.HTTPClient.Transport = transport
+	client, _ := rm.proxyClients.LoadOrStore(host, retryClient)
+	return client.(*rhttp.Client), nil
+}
+
 // AsRegistryHosts returns a RegistryHosts type responsible for returning
 // configurations for registries that contain a given image with respect
 // to the configurations present in RegistryManager.
@@ -101,22 +149,35 @@ func (rm *RegistryManager) AsRegistryHosts() RegistryHosts {
 
 		var registryHosts []docker.RegistryHost
 
+		host := imgRefSpec.Hostname()
+		upstreamClient, err := rm.hostRetryClient(host)
+		if err != nil {
+			return nil, err
+		}
+
 		// Create an AuthClient for this image reference.
-		authClient, err := newAuthClient(rm.retryClient, rm.header, multiCredsFuncs(imgRefSpec, rm.creds...))
+		authClient, err := newAuthClient(upstreamClient, rm.header, multiCredsFuncs(imgRefSpec, rm.creds...), rm.tokenRefreshGrace, rm.queryAuthParams, rm.staleConnRetry, rm.tokenLimiter)
 		if err != nil {
 			return nil, err
 		}
 
-		host := imgRefSpec.Hostname()
 		// If mirrors exist for the host that provides this image, create new
 		// `RegistryHost` configurations for them.
-		if hostConfig, ok := rm.registryConfig.Host[host]; ok {
+		hostConfig, ok := rm.registryConfig.Host[host]
+		if !ok && len(rm.defaultMirrors) > 0 {
+			hostConfig, ok = config.HostConfig{Mirrors: rm.defaultMirrors}, true
+		}
+		if ok {
 			for _, mirror := range hostConfig.Mirrors {
 				// Ensure the mirror host is a valid host url.
 				url, err := url.Parse(mirror.Host)
 				if err != nil {
 					return nil, fmt.Errorf("failed to parse mirror host: %q: %w", mirror.Host, err)
 				}
+				mirrorClient, err := rm.hostRetryClient(url.Host)
+				if err != nil {
+					return nil, err
+				}
 				host, err := docker.DefaultHost(url.Host)
 				if err != nil {
 					return nil, err
@@ -127,11 +188,15 @@ func (rm *RegistryManager) AsRegistryHosts() RegistryHosts {
 				}
 				// Create a copy of the auth and retry client's so we don't overwrite the existing ones.
 				authClient := authClient
-				retryClient := rm.retryClient
+				retryClient := mirrorClient
+				if retryClient != upstreamClient {
+					authClient = authClient.CloneWithNewClient(retryClient)
+				}
 
 				// If a RequestTimeoutSec is set (non-zero) and it differs from the timeout set in
 				// the global retryable client, we will need to create a new one.
 				if mirror.RequestTimeoutSec != 0 && mirror.RequestTimeoutSec != int64(retryClient.HTTPClient.Timeout) {
+					transport := retryClient.HTTPClient.Transport
 					retryClient = CloneRetryableClient(retryClient)
 					if mirror.RequestTimeoutSec < 0 {
 						retryClient.HTTPClient.Timeout = 0
@@ -139,8 +204,8 @@ func (rm *RegistryManager) AsRegistryHosts() RegistryHosts {
 						retryClient.HTTPClient.Timeout = time.Duration(mirror.RequestTimeoutSec) * time.Second
 					}
 					// Re-use the same transport so we can use a single
-					// global connection pool.
-					retryClient.HTTPClient.Transport = rm.retryClient.HTTPClient.Transport
+					// connection pool per proxy.
+					retryClient.HTTPClient.Transport = transport
 					// Create a clone of the AuthClient with the new retryable client.
 					authClient = authClient.CloneWithNewClient(retryClient)
 				}
@@ -178,20 +243,37 @@ func (rm *RegistryManager) AsRegistryHosts() RegistryHosts {
 	}
 }
 
-// multiCredsFuncs joins a list of credential functions into a single credential function.
+// ChainCredentials joins credsFuncs into a single Credential. The funcs are consulted
+// in order, and the credentials of the first returning a non-empty username or secret
+// are used. A func failing doesn't stop the following ones from being consulted: the
+// errors are only returned, joined, if no func returns credentials. Empty credentials,
+// e.g. for anonymous access, are returned if no func returns credentials or fails.
+func ChainCredentials(credsFuncs ...Credential) Credential {
+	return func(imgRefSpec reference.Spec, host string) (string, string, error) {
+		var errs []error
+		for _, f := range credsFuncs {
+			username, secret, err := f(imgRefSpec, host)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if username != "" || secret != "" {
+				return username, secret, nil
+			}
+		}
+		return "", "", errors.Join(errs...)
+	}
+}
+
+// multiCredsFuncs joins a list of credential functions into a single credential function,
+// consulted like the credential returned by ChainCredentials.
 //
 // Note: We close over an image reference so that our invdidual credential providers
 // can store+index credentials at an image level.
 func multiCredsFuncs(imgRefSpec reference.Spec, credsFuncs ...Credential) func(string) (string, string, error) {
+	chain := ChainCredentials(credsFuncs...)
 	return func(host string) (string, string, error) {
-		for _, f := range credsFuncs {
-			if username, secret, err := f(imgRefSpec, host); err != nil {
-				return "", "", err
-			} else if username != "" || secret != "" {
-				return username, secret, nil
-			}
-		}
-		return "", "", nil
+		return chain(imgRefSpec, host)
 	}
 }
 
@@ -0,0 +1,96 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+)
+
+func TestChainCredentials(t *testing.T) {
+	errHelper := errors.New("credential helper failed")
+	var consulted []string
+	helper := func(name, username string, err error) Credential {
+		return func(_ reference.Spec, _ string) (string, string, error) {
+			consulted = append(consulted, name)
+			if err != nil || username == "" {
+				return "", "", err
+			}
+			return username, "secret", nil
+		}
+	}
+
+	tests := []struct {
+		name              string
+		creds             []Credential
+		expectedUsername  string
+		expectedErr       error
+		expectedConsulted []string
+	}{
+		{
+			name: "valid credentials after failing and empty ones",
+			creds: []Credential{
+				helper("error", "", errHelper),
+				helper("empty", "", nil),
+				helper("valid", "user", nil),
+			},
+			expectedUsername:  "user",
+			expectedConsulted: []string{"error", "empty", "valid"},
+		},
+		{
+			name: "first valid credentials win",
+			creds: []Credential{
+				helper("first", "first-user", nil),
+				helper("second", "second-user", nil),
+			},
+			expectedUsername:  "first-user",
+			expectedConsulted: []string{"first"},
+		},
+		{
+			name: "errors without credentials",
+			creds: []Credential{
+				helper("empty", "", nil),
+				helper("error", "", errHelper),
+			},
+			expectedErr:       errHelper,
+			expectedConsulted: []string{"empty", "error"},
+		},
+		{
+			name:              "anonymous",
+			creds:             []Credential{helper("empty", "", nil)},
+			expectedConsulted: []string{"empty"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			consulted = nil
+			username, _, err := ChainCredentials(tc.creds...)(reference.Spec{}, "registry.example.com")
+			if !errors.Is(err, tc.expectedErr) {
+				t.Fatalf("expected error %v; got %v", tc.expectedErr, err)
+			}
+			if username != tc.expectedUsername {
+				t.Fatalf("expected username %q; got %q", tc.expectedUsername, username)
+			}
+			if !slices.Equal(consulted, tc.expectedConsulted) {
+				t.Fatalf("expected %v to be consulted; got %v", tc.expectedConsulted, consulted)
+			}
+		})
+	}
+}
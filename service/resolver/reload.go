@@ -0,0 +1,51 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"sync/atomic"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// ReloadableRegistryHosts serves registry hosts from a configuration that can be swapped
+// while the snapshotter is running. Each call to RegistryHosts uses the configuration
+// current at the time of the call. The hosts it returns keep their configuration after a
+// swap, so fetches of layers resolved before the swap complete against the hosts they were
+// resolved with, while layers resolved afterwards use the new configuration.
+type ReloadableRegistryHosts struct {
+	current atomic.Pointer[RegistryHosts]
+}
+
+// NewReloadableRegistryHosts returns ReloadableRegistryHosts serving hosts until they are swapped.
+func NewReloadableRegistryHosts(hosts RegistryHosts) *ReloadableRegistryHosts {
+	r := &ReloadableRegistryHosts{}
+	r.current.Store(&hosts)
+	return r
+}
+
+// RegistryHosts returns the hosts of the image from the current configuration.
+// It can be used wherever RegistryHosts are expected.
+func (r *ReloadableRegistryHosts) RegistryHosts(imgRefSpec reference.Spec) ([]docker.RegistryHost, error) {
+	return (*r.current.Load())(imgRefSpec)
+}
+
+// Swap atomically replaces the current configuration with hosts and returns the previous one.
+func (r *ReloadableRegistryHosts) Swap(hosts RegistryHosts) RegistryHosts {
+	return *r.current.Swap(&hosts)
+}
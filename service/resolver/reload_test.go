@@ -0,0 +1,102 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+func TestReloadableRegistryHosts(t *testing.T) {
+	const blobPath = "/v2/library/alpine/blobs/sha256:0000"
+	var (
+		received = make(chan struct{})
+		release  = make(chan struct{})
+	)
+	// The old mirror holds the in-flight read until the config is reloaded.
+	oldMirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+		io.WriteString(w, "old")
+	}))
+	defer oldMirror.Close()
+	newMirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "new")
+	}))
+	defer newMirror.Close()
+
+	hostsOf := func(ts *httptest.Server) RegistryHosts {
+		return func(reference.Spec) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{
+				Client: ts.Client(),
+				Host:   strings.TrimPrefix(ts.URL, "http://"),
+				Scheme: "http",
+				Path:   "/v2",
+			}}, nil
+		}
+	}
+	fetch := func(hosts RegistryHosts) (string, error) {
+		registryHosts, err := hosts(reference.Spec{})
+		if err != nil {
+			return "", err
+		}
+		h := registryHosts[0]
+		resp, err := h.Client.Get(h.Scheme + "://" + h.Host + blobPath)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	r := NewReloadableRegistryHosts(hostsOf(oldMirror))
+	type result struct {
+		body string
+		err  error
+	}
+	inFlight := make(chan result)
+	go func() {
+		body, err := fetch(r.RegistryHosts)
+		inFlight <- result{body, err}
+	}()
+	<-received
+
+	r.Swap(hostsOf(newMirror))
+	close(release)
+
+	res := <-inFlight
+	if res.err != nil {
+		t.Fatalf("expected in-flight read to succeed after reload; got %v", res.err)
+	}
+	if res.body != "old" {
+		t.Fatalf("expected in-flight read to complete against the old mirror; got %q", res.body)
+	}
+	body, err := fetch(r.RegistryHosts)
+	if err != nil {
+		t.Fatalf("failed to fetch after reload: %v", err)
+	}
+	if body != "new" {
+		t.Fatalf("expected fetch after reload to use the new mirror; got %q", body)
+	}
+}
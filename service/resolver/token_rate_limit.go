@@ -0,0 +1,39 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"net/http"
+
+	"github.com/awslabs/soci-snapshotter/util/ratelimit"
+)
+
+// tokenRateLimitTransport wraps the transport used by the docker.Authorizer to fetch
+// bearer tokens and waits for the auth server's rate limit before sending each request,
+// so that a broker shared by many registries isn't overwhelmed during a mass pull.
+type tokenRateLimitTransport struct {
+	inner   http.RoundTripper
+	limiter *ratelimit.KeyedLimiter
+}
+
+// RoundTrip sends the token request once the auth server's rate limit allows it.
+func (t *tokenRateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.Wait(req.Context(), req.URL.Host); err != nil {
+		return nil, err
+	}
+	return t.inner.RoundTrip(req)
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/util/ratelimit"
+)
+
+func TestTokenRateLimit(t *testing.T) {
+	const (
+		perSec   = 20
+		burst    = 2
+		requests = 12
+		// tolerance accounts for the time between the limiter allowing
+		// a request and the server receiving it.
+		tolerance = 10 * time.Millisecond
+	)
+
+	var (
+		mu       sync.Mutex
+		arrivals []time.Time
+	)
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer authServer.Close()
+	otherAuthServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer otherAuthServer.Close()
+
+	client := &http.Client{
+		Transport: &tokenRateLimitTransport{
+			inner:   http.DefaultTransport,
+			limiter: ratelimit.NewKeyedLimiter(perSec, burst),
+		},
+	}
+	fetchToken := func(url string) {
+		resp, err := client.Get(url + "/token")
+		if err != nil {
+			t.Errorf("token request failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+	}
+
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fetchToken(authServer.URL)
+		}()
+	}
+
+	// Other auth servers have their own limit, so they aren't held up by the burst.
+	start := time.Now()
+	fetchToken(otherAuthServer.URL)
+	if elapsed := time.Since(start); elapsed > time.Second/perSec {
+		t.Fatalf("expected token request to another auth server to not be limited; took %v", elapsed)
+	}
+	wg.Wait()
+
+	if len(arrivals) != requests {
+		t.Fatalf("expected %d token requests; got %d", requests, len(arrivals))
+	}
+	sort.Slice(arrivals, func(i, j int) bool {
+		return arrivals[i].Before(arrivals[j])
+	})
+	// After the initial burst, requests must be spaced out by the rate limit.
+	for i := burst; i < requests; i++ {
+		minElapsed := time.Duration(i-burst+1) * time.Second / perSec
+		if elapsed := arrivals[i].Sub(arrivals[0]); elapsed < minElapsed-tolerance {
+			t.Fatalf("token request %d arrived %v after the first; expected at least %v", i, elapsed, minElapsed)
+		}
+	}
+}
@@ -34,7 +34,12 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
 	"path/filepath"
+	"runtime"
+	"time"
 
 	"github.com/awslabs/soci-snapshotter/config"
 	socifs "github.com/awslabs/soci-snapshotter/fs"
@@ -43,19 +48,50 @@ import (
 	"github.com/awslabs/soci-snapshotter/service/resolver"
 	snbase "github.com/awslabs/soci-snapshotter/snapshot"
 	"github.com/containerd/containerd/snapshots"
-	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
 	"github.com/containerd/log"
 )
 
+// ErrNoRegistryConfig is returned when no registry hosts are configured and
+// falling back to the default certs.d directory is disabled.
+var ErrNoRegistryConfig = errors.New("no registry configuration and the default certs.d directory is disabled")
+
+// RegistryMirrorEnv is the environment variable setting a mirror, e.g. "mirror.local:5000",
+// that the images of every registry are pulled from before the registry, for environments
+// where the certs.d directory can't be written, e.g. ephemeral CI. It's used if no registry
+// hosts are passed to NewSociSnapshotterService and no certs.d directory or per-host
+// resolver config is configured, in which case it takes precedence over the default
+// certs.d directory.
+const RegistryMirrorEnv = "SOCI_REGISTRY_MIRROR"
+
+// ErrInvalidMaxConcurrency is returned when the configured max concurrency is negative.
+var ErrInvalidMaxConcurrency = errors.New("max concurrency must not be negative")
+
+const (
+	// maxConcurrencyPerProc is the number of layers resolved at once per GOMAXPROCS
+	// if no max concurrency is configured.
+	maxConcurrencyPerProc = 4
+	// maxConcurrencyLimit is the maximum number of layers resolved at once. Higher
+	// configured values are clamped to it, so that a misconfiguration doesn't start
+	// thousands of goroutines during parallel pulls.
+	maxConcurrencyLimit = 1000
+)
+
 type Option func(*options)
 
 type options struct {
 	credsFuncs    []resolver.Credential
 	registryHosts resolver.RegistryHosts
 	fsOpts        []socifs.Option
+	reloader      *ConfigReloader
+	healthChecker *HealthChecker
+
+	mirrorResolveTimeout time.Duration
+	dockerConfigPath     string
 }
 
 // WithCredsFuncs specifies credsFuncs to be used for connecting to the registries.
+// They are consulted like resolver.ChainCredentials: in the order they are added,
+// until one returns credentials, even if some of them fail.
 func WithCredsFuncs(creds ...resolver.Credential) Option {
 	return func(o *options) {
 		o.credsFuncs = append(o.credsFuncs, creds...)
@@ -69,6 +105,18 @@ func WithCustomRegistryHosts(hosts resolver.RegistryHosts) Option {
 	}
 }
 
+// WithRegistryHostsFromDockerConfig configures the registry hosts with the Docker config
+// file at path, e.g. ~/.docker/config.json, like WithCustomRegistryHosts: the credentials in
+// its "auths" and the mirrors of Docker Hub in its "registry-mirrors", a key of the Docker
+// daemon config (daemon.json) that has to be added to the file, are used. Its credential
+// helpers aren't, see resolver.RegistryHostsFromDockerConfig. The file is read when the
+// snapshotter is created. WithCustomRegistryHosts takes precedence.
+func WithRegistryHostsFromDockerConfig(path string) Option {
+	return func(o *options) {
+		o.dockerConfigPath = path
+	}
+}
+
 // WithFilesystemOptions allows to pass filesystem-related configuration.
 func WithFilesystemOptions(opts ...socifs.Option) Option {
 	return func(o *options) {
@@ -76,6 +124,31 @@ func WithFilesystemOptions(opts ...socifs.Option) Option {
 	}
 }
 
+// WithConfigReloader attaches reloader to the snapshotter, so that its registry
+// configuration can be reloaded with reloader.Reload.
+func WithConfigReloader(reloader *ConfigReloader) Option {
+	return func(o *options) {
+		o.reloader = reloader
+	}
+}
+
+// WithHealthChecker attaches checker to the snapshotter, so that whether it can reach
+// the mirrors of the sentinel reference of checker can be checked with checker.Check.
+func WithHealthChecker(checker *HealthChecker) Option {
+	return func(o *options) {
+		o.healthChecker = checker
+	}
+}
+
+// WithMirrorResolveTimeout bounds how long the snapshotter waits for registry hosts,
+// including mirrors, to respond to requests for SOCI artifacts and layers pulled in
+// parallel, so that snapshot preparation fails instead of hanging on hosts that never do.
+func WithMirrorResolveTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.mirrorResolveTimeout = timeout
+	}
+}
+
 // NewSociSnapshotterService returns soci snapshotter.
 func NewSociSnapshotterService(ctx context.Context, root string, serviceCfg *config.ServiceConfig, opts ...Option) (snapshots.Snapshotter, error) {
 	var sOpts options
@@ -83,35 +156,24 @@ func NewSociSnapshotterService(ctx context.Context, root string, serviceCfg *con
 		o(&sOpts)
 	}
 
-	httpConfig := serviceCfg.FSConfig.RetryableHTTPClientConfig
-	registryConfig := serviceCfg.RegistryConfig // Containerd-standard registry config
-	resolverConfig := serviceCfg.ResolverConfig // Legacy SOCI resolver config
-
-	hosts := sOpts.registryHosts
-	if hosts == nil {
-		// Default to containerd's standard certs.d directory approach.
-		// This ensures parallel pulling works with TLS the same way containerd does.
-		configPath := registryConfig.ConfigPath
-		if configPath == "" {
-			configPath = config.DefaultCertsDPath
-		}
-
-		criRegistry := resolver.Registry{
-			ConfigPath: configPath,
-		}
-		hosts = resolver.RegistryHostsFromCRIConfig(ctx, criRegistry, sOpts.credsFuncs...)
+	maxConcurrency, err := effectiveMaxConcurrency(serviceCfg.FSConfig.MaxConcurrency)
+	if err != nil {
+		return nil, err
+	}
+	log.G(ctx).WithField("max_concurrency", maxConcurrency).Info("effective max concurrency of layer resolution")
 
-		// Only fall back to legacy resolver if explicitly configured with per-host settings
-		// and no certs.d path was specified
-		if len(resolverConfig.Host) > 0 && registryConfig.ConfigPath == "" {
-			log.G(ctx).Warn("using legacy [resolver.host] configuration which is deprecated; please migrate to [registry.config_path] pointing to containerd-style certs.d directory")
-			hosts = resolver.NewRegistryManager(httpConfig, resolverConfig, sOpts.credsFuncs).AsRegistryHosts()
-		}
+	recording, err := resolver.NewHTTPRecording(serviceCfg.HTTPRecordingConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure HTTP recording: %w", err)
 	}
-	userxattr, err := overlayutils.NeedsUserXAttr(snapshotterRoot(root))
+	hosts, stopHosts, err := newRegistryHosts(ctx, serviceCfg, sOpts, recording, false)
 	if err != nil {
-		log.G(ctx).WithError(err).Warnf("cannot detect whether \"userxattr\" option needs to be used, assuming to be %v", userxattr)
+		recording.Close()
+		return nil, fmt.Errorf("failed to configure registry hosts: %w", err)
 	}
+	reloadableHosts := resolver.NewReloadableRegistryHosts(hosts)
+	hosts = reloadableHosts.RegistryHosts
+	userxattr := snbase.NeedsUserXAttr(ctx, snapshotterRoot(root), serviceCfg.SnapshotterConfig.VerifyUserXAttr)
 	opq := layer.OverlayOpaqueTrusted
 	if userxattr {
 		opq = layer.OverlayOpaqueUser
@@ -119,16 +181,38 @@ func NewSociSnapshotterService(ctx context.Context, root string, serviceCfg *con
 	// Configure filesystem and snapshotter
 	getSources := source.FromDefaultLabels(source.RegistryHosts(hosts)) // provides source info based on default labels
 	fsOpts := append(sOpts.fsOpts, socifs.WithGetSources(getSources),
+		socifs.WithRegistryHosts(source.RegistryHosts(hosts)),
 		socifs.WithOverlayOpaqueType(opq),
 		socifs.WithPullModes(serviceCfg.PullModes),
+		socifs.WithMaxConcurrency(maxConcurrency),
 	)
-	if serviceCfg.FSConfig.MaxConcurrency != 0 {
-		fsOpts = append(fsOpts, socifs.WithMaxConcurrency(serviceCfg.FSConfig.MaxConcurrency))
+	if sOpts.mirrorResolveTimeout > 0 {
+		fsOpts = append(fsOpts, socifs.WithMirrorResolveTimeout(sOpts.mirrorResolveTimeout))
 	}
 	fs, err := socifs.NewFilesystem(ctx, fsRoot(root), serviceCfg.FSConfig, fsOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure filesystem")
 	}
+	if c := sOpts.healthChecker; c != nil {
+		prober, ok := fs.(socifs.HostProber)
+		if !ok {
+			stopHosts()
+			recording.Close()
+			return nil, fmt.Errorf("filesystem doesn't probe registry hosts")
+		}
+		c.attach(hosts, prober)
+	}
+	// The reloader owns the registry hosts and the recording from here on.
+	if r := sOpts.reloader; r != nil {
+		r.mu.Lock()
+		r.hosts = reloadableHosts
+		r.stop = stopHosts
+		r.recording = recording
+		r.build = func(cfg *config.ServiceConfig, recording *resolver.HTTPRecording) (resolver.RegistryHosts, func(), error) {
+			return newRegistryHosts(ctx, cfg, sOpts, recording, true)
+		}
+		r.mu.Unlock()
+	}
 
 	var snapshotter snapshots.Snapshotter
 
@@ -141,6 +225,30 @@ func NewSociSnapshotterService(ctx context.Context, root string, serviceCfg *con
 	}
 	if serviceCfg.PullModes.Parallel.Enable {
 		snOpts = append(snOpts, snbase.ParallelPullUnpack)
+		if serviceCfg.PullModes.Parallel.LazyLoadIndexedLayers {
+			snOpts = append(snOpts, snbase.LazyLoadIndexedLayers)
+		}
+		if prefixes := serviceCfg.PullModes.Parallel.SerialRepositoryPrefixes; len(prefixes) > 0 {
+			snOpts = append(snOpts, snbase.WithSerialPullPrefixes(prefixes...))
+		}
+	}
+	if serviceCfg.SnapshotterConfig.TmpfsUpperdirPath != "" {
+		snOpts = append(snOpts, snbase.WithTmpfsUpperdir(serviceCfg.SnapshotterConfig.TmpfsUpperdirPath, serviceCfg.SnapshotterConfig.TmpfsUpperdirSize))
+	}
+	if serviceCfg.SnapshotterConfig.ChainMode != "" {
+		snOpts = append(snOpts, snbase.WithChainMode(snbase.ChainMode(serviceCfg.SnapshotterConfig.ChainMode)))
+	}
+	if serviceCfg.SnapshotterConfig.LowerdirLimitMode != "" {
+		snOpts = append(snOpts, snbase.WithLowerdirLimitMode(snbase.LowerdirLimitMode(serviceCfg.SnapshotterConfig.LowerdirLimitMode)))
+	}
+	if serviceCfg.SnapshotterConfig.ActiveHostLabel {
+		snOpts = append(snOpts, snbase.WithActiveHostLabel)
+	}
+	if serviceCfg.SnapshotterConfig.SELinuxContext != "" {
+		snOpts = append(snOpts, snbase.WithSELinuxContext(serviceCfg.SnapshotterConfig.SELinuxContext))
+	}
+	if serviceCfg.SnapshotterConfig.VerifyUserXAttr {
+		snOpts = append(snOpts, snbase.WithVerifiedUserXAttr)
 	}
 
 	snapshotter, err = snbase.NewSnapshotter(ctx, snapshotterRoot(root), fs, snOpts...)
@@ -151,6 +259,20 @@ func NewSociSnapshotterService(ctx context.Context, root string, serviceCfg *con
 	return snapshotter, err
 }
 
+// effectiveMaxConcurrency returns the maximum number of layers resolved at once for the
+// configured maxConcurrency: maxConcurrencyPerProc per GOMAXPROCS if it's 0, and at most
+// maxConcurrencyLimit. Negative values are rejected.
+func effectiveMaxConcurrency(maxConcurrency int64) (int64, error) {
+	switch {
+	case maxConcurrency < 0:
+		return 0, fmt.Errorf("%w: %d", ErrInvalidMaxConcurrency, maxConcurrency)
+	case maxConcurrency == 0:
+		return min(int64(runtime.GOMAXPROCS(0))*maxConcurrencyPerProc, maxConcurrencyLimit), nil
+	default:
+		return min(maxConcurrency, maxConcurrencyLimit), nil
+	}
+}
+
 func snapshotterRoot(root string) string {
 	return filepath.Join(root, "snapshotter")
 }
@@ -166,3 +288,73 @@ func Supported(root string) error {
 	// Remote snapshotter is implemented based on overlayfs snapshotter.
 	return overlayutils.Supported(snapshotterRoot(root))
 }
+
+// newRegistryHosts returns the registry hosts configured by serviceCfg, recording their
+// traffic to recording, if not nil. If validate is set, the certs.d host configuration is
+// loaded up front so that an invalid one is rejected. The returned function stops the
+// background work of the hosts, e.g. mirror discovery.
+func newRegistryHosts(ctx context.Context, serviceCfg *config.ServiceConfig, sOpts options, recording *resolver.HTTPRecording, validate bool) (resolver.RegistryHosts, func(), error) {
+	httpConfig := serviceCfg.FSConfig.RetryableHTTPClientConfig
+	registryConfig := serviceCfg.RegistryConfig // Containerd-standard registry config
+	resolverConfig := serviceCfg.ResolverConfig // Legacy SOCI resolver config
+
+	hosts := sOpts.registryHosts
+	if hosts == nil && sOpts.dockerConfigPath != "" {
+		var err error
+		hosts, err = resolver.RegistryHostsFromDockerConfig(sOpts.dockerConfigPath, httpConfig, sOpts.credsFuncs...)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if mirror := os.Getenv(RegistryMirrorEnv); hosts == nil && mirror != "" && registryConfig.ConfigPath == "" && len(resolverConfig.Host) == 0 {
+		log.G(ctx).WithField("mirror", mirror).Infof("using registry mirror from %s", RegistryMirrorEnv)
+		var err error
+		hosts, err = resolver.RegistryHostsWithMirror(mirror, httpConfig, sOpts.credsFuncs...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s: %w", RegistryMirrorEnv, err)
+		}
+	}
+	if hosts == nil {
+		if registryConfig.ConfigPath == "" && len(resolverConfig.Host) == 0 && registryConfig.DisableDefaultConfigPath {
+			return nil, nil, ErrNoRegistryConfig
+		}
+		// Default to containerd's standard certs.d directory approach.
+		// This ensures parallel pulling works with TLS the same way containerd does.
+		configPath := registryConfig.ConfigPath
+		if configPath == "" {
+			configPath = config.DefaultCertsDPath
+		}
+
+		criRegistry := resolver.Registry{
+			ConfigPath: configPath,
+		}
+		if validate {
+			if err := resolver.ValidateCRIConfig(ctx, criRegistry); err != nil {
+				return nil, nil, err
+			}
+		}
+		hosts = resolver.RegistryHostsFromCRIConfig(ctx, criRegistry, sOpts.credsFuncs...)
+
+		// Only fall back to legacy resolver if explicitly configured with per-host settings
+		// and no certs.d path was specified
+		if len(resolverConfig.Host) > 0 && registryConfig.ConfigPath == "" {
+			log.G(ctx).Warn("using legacy [resolver.host] configuration which is deprecated; please migrate to [registry.config_path] pointing to containerd-style certs.d directory")
+			hosts = resolver.NewRegistryManager(httpConfig, resolverConfig, sOpts.credsFuncs).AsRegistryHosts()
+		}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if discoveryConfig := resolverConfig.MirrorDiscovery; discoveryConfig.URL != "" {
+		discovery := resolver.NewMirrorDiscovery(discoveryConfig)
+		go discovery.Run(ctx)
+		hosts = discovery.RegistryHosts(hosts)
+	}
+	if recording != nil {
+		recordingConfig := recording.Config()
+		log.G(ctx).WithField("path", recordingConfig.Path).Warnf("HTTP recording mode %q is enabled", recordingConfig.Mode)
+		hosts = recording.RegistryHosts(hosts)
+	}
+	if checkConfig := resolverConfig.MirrorCheck; checkConfig.Enable {
+		hosts = resolver.NewMirrorCheck(checkConfig).RegistryHosts(hosts)
+	}
+	return hosts, cancel, nil
+}
@@ -0,0 +1,182 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/config"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+func TestDisableDefaultConfigPath(t *testing.T) {
+	t.Run("disabled default fails without registry config", func(t *testing.T) {
+		var cfg config.ServiceConfig
+		cfg.RegistryConfig.DisableDefaultConfigPath = true
+		_, err := NewSociSnapshotterService(context.Background(), t.TempDir(), &cfg)
+		if !errors.Is(err, ErrNoRegistryConfig) {
+			t.Fatalf("expected %v; got %v", ErrNoRegistryConfig, err)
+		}
+	})
+
+	t.Run("disabled default with config path", func(t *testing.T) {
+		var cfg config.ServiceConfig
+		cfg.RegistryConfig.DisableDefaultConfigPath = true
+		cfg.RegistryConfig.ConfigPath = t.TempDir()
+		hosts, stop, err := newRegistryHosts(context.Background(), &cfg, options{}, nil, false)
+		if err != nil {
+			t.Fatalf("failed to configure registry hosts: %v", err)
+		}
+		defer stop()
+		if hosts == nil {
+			t.Fatal("expected registry hosts")
+		}
+	})
+
+	t.Run("default is used unless disabled", func(t *testing.T) {
+		hosts, stop, err := newRegistryHosts(context.Background(), &config.ServiceConfig{}, options{}, nil, false)
+		if err != nil {
+			t.Fatalf("failed to configure registry hosts: %v", err)
+		}
+		defer stop()
+		if hosts == nil {
+			t.Fatal("expected registry hosts")
+		}
+	})
+}
+
+func TestEffectiveMaxConcurrency(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxConcurrency int64
+		expected       int64
+		expectedErr    error
+	}{
+		{
+			name:           "negative is rejected",
+			maxConcurrency: -1,
+			expectedErr:    ErrInvalidMaxConcurrency,
+		},
+		{
+			name:     "zero defaults based on GOMAXPROCS",
+			expected: min(int64(runtime.GOMAXPROCS(0))*maxConcurrencyPerProc, maxConcurrencyLimit),
+		},
+		{
+			name:           "huge is clamped",
+			maxConcurrency: 1 << 40,
+			expected:       maxConcurrencyLimit,
+		},
+		{
+			name:           "configured is kept",
+			maxConcurrency: 8,
+			expected:       8,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := effectiveMaxConcurrency(tc.maxConcurrency)
+			if tc.expectedErr != nil {
+				if !errors.Is(err, tc.expectedErr) {
+					t.Fatalf("expected %v; got %v", tc.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tc.expected {
+				t.Fatalf("expected max concurrency %d; got %d", tc.expected, got)
+			}
+		})
+	}
+
+	t.Run("snapshotter rejects negative", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "config.toml")
+		if err := os.WriteFile(path, []byte("max_concurrency = -1\n"), 0644); err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+		cfg, err := config.NewConfigFromToml(path)
+		if err != nil {
+			t.Fatalf("failed to parse config: %v", err)
+		}
+		_, err = NewSociSnapshotterService(context.Background(), t.TempDir(), &cfg.ServiceConfig)
+		if !errors.Is(err, ErrInvalidMaxConcurrency) {
+			t.Fatalf("expected %v; got %v", ErrInvalidMaxConcurrency, err)
+		}
+	})
+}
+
+func TestRegistryMirrorEnv(t *testing.T) {
+	refspec, err := reference.Parse("registry.example.com/repo:tag")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+
+	t.Run("mirror is used for all pulls", func(t *testing.T) {
+		t.Setenv(RegistryMirrorEnv, "mirror.local:5000")
+		hosts, stop, err := newRegistryHosts(context.Background(), &config.ServiceConfig{}, options{}, nil, false)
+		if err != nil {
+			t.Fatalf("failed to configure registry hosts: %v", err)
+		}
+		defer stop()
+		registryHosts, err := hosts(refspec)
+		if err != nil {
+			t.Fatalf("failed to get registry hosts: %v", err)
+		}
+		if len(registryHosts) != 2 {
+			t.Fatalf("expected the mirror and the registry; got %d hosts", len(registryHosts))
+		}
+		if h := registryHosts[0]; h.Host != "mirror.local:5000" || h.Scheme != "https" || h.Path != "/v2" {
+			t.Fatalf("expected mirror https://mirror.local:5000/v2; got %s://%s%s", h.Scheme, h.Host, h.Path)
+		}
+		if h := registryHosts[1]; h.Host != "registry.example.com" {
+			t.Fatalf("expected registry.example.com after the mirror; got %s", h.Host)
+		}
+	})
+
+	t.Run("explicit hosts take precedence", func(t *testing.T) {
+		t.Setenv(RegistryMirrorEnv, "mirror.local:5000")
+		explicit := func(reference.Spec) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{Host: "explicit.example.com", Scheme: "https", Path: "/v2"}}, nil
+		}
+		hosts, stop, err := newRegistryHosts(context.Background(), &config.ServiceConfig{}, options{registryHosts: explicit}, nil, false)
+		if err != nil {
+			t.Fatalf("failed to configure registry hosts: %v", err)
+		}
+		defer stop()
+		registryHosts, err := hosts(refspec)
+		if err != nil {
+			t.Fatalf("failed to get registry hosts: %v", err)
+		}
+		if registryHosts[0].Host != "explicit.example.com" {
+			t.Fatalf("expected explicit host; got %s", registryHosts[0].Host)
+		}
+	})
+
+	t.Run("invalid mirror", func(t *testing.T) {
+		t.Setenv(RegistryMirrorEnv, "ftp://mirror.local")
+		if _, _, err := newRegistryHosts(context.Background(), &config.ServiceConfig{}, options{}, nil, false); err == nil {
+			t.Fatal("expected invalid mirror to be rejected")
+		}
+	})
+}
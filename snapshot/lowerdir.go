@@ -0,0 +1,131 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+const (
+	// maxOverlayLowerdirs is the maximum number of lower layers the kernel
+	// allows in a single overlay mount (OVL_MAX_STACK).
+	maxOverlayLowerdirs = 500
+	// mountDataSlack is the slack left in the mount data page before the
+	// mounter compacts the lowerdir option. It matches containerd's mounter.
+	mountDataSlack = 512
+
+	lowerdirOptionPrefix = "lowerdir="
+)
+
+// ErrLowerdirLimitExceeded is returned when the lowerdir option of an overlay
+// mount can't be passed to the kernel.
+var ErrLowerdirLimitExceeded = errors.New("overlay lowerdir limit exceeded")
+
+// LowerdirLimitMode controls what the snapshotter does when the lowerdir option
+// of an overlay mount is longer than the kernel accepts in a single page of mount data.
+type LowerdirLimitMode string
+
+const (
+	// LowerdirLimitModeRelative returns the mount as-is and relies on the mounter
+	// (e.g. containerd) to chdir into the common parent of the lowerdirs and pass
+	// relative lowerdir paths. The snapshotter only fails if even the relative
+	// paths don't fit.
+	LowerdirLimitModeRelative LowerdirLimitMode = "relative"
+	// LowerdirLimitModeError fails as soon as the absolute lowerdir paths don't fit,
+	// for mounters that don't shorten lowerdir paths.
+	LowerdirLimitModeError LowerdirLimitMode = "error"
+)
+
+// WithLowerdirLimitMode sets how overlay mounts with too long lowerdir options are handled.
+func WithLowerdirLimitMode(mode LowerdirLimitMode) Opt {
+	return func(config *SnapshotterConfig) error {
+		switch mode {
+		case LowerdirLimitModeRelative, LowerdirLimitModeError:
+		default:
+			return fmt.Errorf("unknown lowerdir limit mode: %q", mode)
+		}
+		config.lowerdirLimitMode = mode
+		return nil
+	}
+}
+
+// checkLowerdirLimit checks that the overlay mount options can be passed to the
+// kernel, returning an actionable ErrLowerdirLimitExceeded instead of letting the
+// mount fail later with a cryptic error.
+func checkLowerdirLimit(mode LowerdirLimitMode, options []string) error {
+	var lowerdirs []string
+	for _, opt := range options {
+		if strings.HasPrefix(opt, lowerdirOptionPrefix) {
+			lowerdirs = strings.Split(strings.TrimPrefix(opt, lowerdirOptionPrefix), ":")
+			break
+		}
+	}
+	if len(lowerdirs) > maxOverlayLowerdirs {
+		return fmt.Errorf("%w: the snapshot has %d lower layers but overlay supports at most %d; reduce the number of layers of the image, e.g. by squashing it",
+			ErrLowerdirLimitExceeded, len(lowerdirs), maxOverlayLowerdirs)
+	}
+
+	pageSize := os.Getpagesize()
+	size := len(strings.Join(options, ","))
+	if size < pageSize-mountDataSlack {
+		return nil
+	}
+	if mode == LowerdirLimitModeError {
+		return fmt.Errorf("%w: the mount options of %d lower layers are %d bytes but at most %d bytes are allowed; "+
+			"reduce the number of layers of the image, use a shorter snapshotter root, or set the lowerdir limit mode to %q if the mounter supports relative lowerdirs",
+			ErrLowerdirLimitExceeded, len(lowerdirs), size, pageSize-mountDataSlack, LowerdirLimitModeRelative)
+	}
+
+	commonDir := lowerdirsCommonDir(lowerdirs)
+	relativeSize := size - len(commonDir)*len(lowerdirs)
+	if relativeSize > pageSize {
+		return fmt.Errorf("%w: the mount options of %d lower layers are %d bytes even with relative lowerdirs but at most %d bytes are allowed; "+
+			"reduce the number of layers of the image, e.g. by squashing it",
+			ErrLowerdirLimitExceeded, len(lowerdirs), relativeSize, pageSize)
+	}
+	return nil
+}
+
+// lowerdirsCommonDir returns the directory, with a trailing slash, that the
+// mounter makes lowerdirs relative to. This mirrors containerd's mounter, which
+// takes the parent of the longest common prefix of the lowerdirs. It returns ""
+// if the lowerdirs can't be made relative.
+func lowerdirsCommonDir(lowerdirs []string) string {
+	if len(lowerdirs) < 2 {
+		return ""
+	}
+	prefix := lowerdirs[0]
+	for _, dir := range lowerdirs[1:] {
+		i := 0
+		for i < len(prefix) && i < len(dir) && prefix[i] == dir[i] {
+			i++
+		}
+		prefix = prefix[:i]
+	}
+	if prefix == "" {
+		return ""
+	}
+	dir := path.Dir(prefix)
+	if dir == "/" || dir == "." {
+		return ""
+	}
+	return dir + "/"
+}
@@ -0,0 +1,124 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func lowerdirOption(root string, n int) string {
+	dirs := make([]string, n)
+	for i := range dirs {
+		dirs[i] = filepath.Join(root, "snapshots", fmt.Sprint(n-i), "fs")
+	}
+	return lowerdirOptionPrefix + strings.Join(dirs, ":")
+}
+
+func TestCheckLowerdirLimit(t *testing.T) {
+	longRoot := "/" + strings.Repeat("r", 200)
+	tests := []struct {
+		name          string
+		mode          LowerdirLimitMode
+		options       []string
+		expectedError error
+	}{
+		{
+			name:    "short chain fits",
+			mode:    LowerdirLimitModeError,
+			options: []string{lowerdirOption("/var/lib/soci", 10)},
+		},
+		{
+			name:    "long absolute lowerdirs fit as relative lowerdirs",
+			mode:    LowerdirLimitModeRelative,
+			options: []string{lowerdirOption(longRoot, 100)},
+		},
+		{
+			name:          "long absolute lowerdirs fail in error mode",
+			mode:          LowerdirLimitModeError,
+			options:       []string{lowerdirOption(longRoot, 100)},
+			expectedError: ErrLowerdirLimitExceeded,
+		},
+		{
+			name:          "too many lowerdirs fail",
+			mode:          LowerdirLimitModeRelative,
+			options:       []string{lowerdirOption("/s", maxOverlayLowerdirs+1)},
+			expectedError: ErrLowerdirLimitExceeded,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkLowerdirLimit(tc.mode, tc.options)
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("unexpected error; expected %v, got %v", tc.expectedError, err)
+			}
+		})
+	}
+}
+
+func TestLowerdirLimitChain(t *testing.T) {
+	const layers = 30
+	ctx := context.TODO()
+	// A long root makes the absolute lowerdirs of the chain exceed the mount data limit.
+	root := filepath.Join(t.TempDir(), strings.Repeat("r", 200))
+	sn, err := NewSnapshotter(ctx, root, dummyFileSystem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := ""
+	for i := 0; i < layers; i++ {
+		key, name := fmt.Sprintf("active-%d", i), fmt.Sprintf("layer-%d", i)
+		if _, err := sn.Prepare(ctx, key, parent); err != nil {
+			t.Fatalf("failed to prepare layer %d: %v", i, err)
+		}
+		if err := sn.Commit(ctx, name, key); err != nil {
+			t.Fatalf("failed to commit layer %d: %v", i, err)
+		}
+		parent = name
+	}
+	if err := sn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		mode          LowerdirLimitMode
+		expectedError error
+	}{
+		{mode: LowerdirLimitModeRelative},
+		{mode: LowerdirLimitModeError, expectedError: ErrLowerdirLimitExceeded},
+	} {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			sn, err := NewSnapshotter(ctx, root, dummyFileSystem(), WithLowerdirLimitMode(tc.mode))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sn.Close()
+
+			mounts, err := sn.View(ctx, "view-"+string(tc.mode), parent)
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("unexpected error; expected %v, got %v", tc.expectedError, err)
+			}
+			if err == nil && (len(mounts) != 1 || mounts[0].Type != "overlay") {
+				t.Fatalf("expected an overlay mount, got %v", mounts)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"net/http"
+
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/log"
+)
+
+// NewPrewarmHandler returns a handler prewarming the image given by the ref query parameter
+// of POST requests with p, so that integrations knowing a pull is imminent can prepare it.
+// The optional namespace query parameter is the containerd namespace the image is pulled in,
+// which defaults to the default namespace. It responds once the image is prewarmed.
+func NewPrewarmHandler(p Prewarmer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "prewarming requires a POST request", http.StatusMethodNotAllowed)
+			return
+		}
+		ref := r.URL.Query().Get("ref")
+		if ref == "" {
+			http.Error(w, "missing ref", http.StatusBadRequest)
+			return
+		}
+		ns := r.URL.Query().Get("namespace")
+		if ns == "" {
+			ns = namespaces.Default
+		}
+		ctx := log.WithLogger(namespaces.WithNamespace(r.Context(), ns), log.G(r.Context()).WithField("ref", ref))
+		if err := p.Prewarm(ctx, ref); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to prewarm image")
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+)
+
+type prewarmerFunc func(ctx context.Context, ref string) error
+
+func (f prewarmerFunc) Prewarm(ctx context.Context, ref string) error {
+	return f(ctx, ref)
+}
+
+func TestPrewarmHandler(t *testing.T) {
+	var gotRef, gotNamespace string
+	h := NewPrewarmHandler(prewarmerFunc(func(ctx context.Context, ref string) error {
+		gotRef = ref
+		gotNamespace, _ = namespaces.Namespace(ctx)
+		if ref == "registry.example.com/broken:latest" {
+			return errors.New("no SOCI index")
+		}
+		return nil
+	}))
+
+	tests := []struct {
+		name          string
+		method        string
+		target        string
+		expectedCode  int
+		expectedRef   string
+		expectedNS    string
+		expectPrewarm bool
+	}{
+		{
+			name:          "prewarms ref in default namespace",
+			method:        http.MethodPost,
+			target:        "/debug/prewarm?ref=registry.example.com/app:latest",
+			expectedCode:  http.StatusNoContent,
+			expectedRef:   "registry.example.com/app:latest",
+			expectedNS:    namespaces.Default,
+			expectPrewarm: true,
+		},
+		{
+			name:          "prewarms ref in given namespace",
+			method:        http.MethodPost,
+			target:        "/debug/prewarm?ref=registry.example.com/app:latest&namespace=k8s.io",
+			expectedCode:  http.StatusNoContent,
+			expectedRef:   "registry.example.com/app:latest",
+			expectedNS:    "k8s.io",
+			expectPrewarm: true,
+		},
+		{
+			name:          "reports prewarm failures",
+			method:        http.MethodPost,
+			target:        "/debug/prewarm?ref=registry.example.com/broken:latest",
+			expectedCode:  http.StatusBadGateway,
+			expectedRef:   "registry.example.com/broken:latest",
+			expectedNS:    namespaces.Default,
+			expectPrewarm: true,
+		},
+		{
+			name:         "rejects GET",
+			method:       http.MethodGet,
+			target:       "/debug/prewarm?ref=registry.example.com/app:latest",
+			expectedCode: http.StatusMethodNotAllowed,
+		},
+		{
+			name:         "rejects missing ref",
+			method:       http.MethodPost,
+			target:       "/debug/prewarm",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotRef, gotNamespace = "", ""
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+			if w.Code != tt.expectedCode {
+				t.Fatalf("expected status %d; got %d", tt.expectedCode, w.Code)
+			}
+			if !tt.expectPrewarm {
+				if gotRef != "" {
+					t.Fatalf("expected no prewarm; got one of %q", gotRef)
+				}
+				return
+			}
+			if gotRef != tt.expectedRef || gotNamespace != tt.expectedNS {
+				t.Fatalf("expected %q to be prewarmed in namespace %q; got %q in %q", tt.expectedRef, tt.expectedNS, gotRef, gotNamespace)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// SELinuxContextLabel is a snapshot label setting the SELinux context of the
+// overlay mount of a snapshot. It takes precedence over the context configured
+// with WithSELinuxContext.
+const SELinuxContextLabel = "containerd.io/snapshot/soci.selinux-context"
+
+// ErrInvalidSELinuxContext is returned when an SELinux context can't be used as a mount option.
+var ErrInvalidSELinuxContext = errors.New("invalid SELinux context")
+
+// selinuxContextRegexp matches a context of the form user:role:type[:level].
+// The level may contain ':' and ',' (e.g. "s0:c1,c2"), which is why the
+// context is quoted in the mount option.
+var selinuxContextRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]+:[A-Za-z0-9_.-]+:[A-Za-z0-9_.-]+(:[A-Za-z0-9_.:,-]+)?$`)
+
+// WithSELinuxContext sets the SELinux context of the overlay mounts of
+// snapshots without SELinuxContextLabel.
+func WithSELinuxContext(context string) Opt {
+	return func(config *SnapshotterConfig) error {
+		if err := validateSELinuxContext(context); err != nil {
+			return err
+		}
+		config.selinuxContext = context
+		return nil
+	}
+}
+
+func validateSELinuxContext(context string) error {
+	if !selinuxContextRegexp.MatchString(context) {
+		return fmt.Errorf("%w: %q; expected user:role:type[:level]", ErrInvalidSELinuxContext, context)
+	}
+	return nil
+}
+
+// selinuxContextOption returns the "context=" overlay mount option for a snapshot
+// with labels, or "" if no SELinux context is set.
+func (o *snapshotter) selinuxContextOption(labels map[string]string) (string, error) {
+	context := o.selinuxContext
+	if l, ok := labels[SELinuxContextLabel]; ok {
+		if err := validateSELinuxContext(l); err != nil {
+			return "", fmt.Errorf("label %s: %w", SELinuxContextLabel, err)
+		}
+		context = l
+	}
+	if context == "" {
+		return "", nil
+	}
+	return fmt.Sprintf("context=%q", context), nil
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/snapshots"
+)
+
+func TestSELinuxContextMountOption(t *testing.T) {
+	const (
+		configContext = "system_u:object_r:container_file_t:s0"
+		labelContext  = "system_u:object_r:container_file_t:s0:c1,c2"
+	)
+	ctx := context.TODO()
+	root := t.TempDir()
+	sn, err := NewSnapshotter(ctx, root, dummyFileSystem(), WithSELinuxContext(configContext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sn.Close()
+
+	parent := ""
+	for _, name := range []string{"layer-0", "layer-1"} {
+		key := "active-" + name
+		if _, err := sn.Prepare(ctx, key, parent); err != nil {
+			t.Fatalf("failed to prepare %s: %v", name, err)
+		}
+		if err := sn.Commit(ctx, name, key); err != nil {
+			t.Fatalf("failed to commit %s: %v", name, err)
+		}
+		parent = name
+	}
+
+	tests := []struct {
+		name           string
+		labels         map[string]string
+		expectedOption string
+		expectedError  error
+	}{
+		{
+			name:           "configured context",
+			expectedOption: `context="` + configContext + `"`,
+		},
+		{
+			name:           "label overrides configured context",
+			labels:         map[string]string{SELinuxContextLabel: labelContext},
+			expectedOption: `context="` + labelContext + `"`,
+		},
+		{
+			name:          "invalid label",
+			labels:        map[string]string{SELinuxContextLabel: "container_file_t"},
+			expectedError: ErrInvalidSELinuxContext,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key := "container-" + tc.name
+			mounts, err := sn.Prepare(ctx, key, parent, snapshots.WithLabels(tc.labels))
+			if !errors.Is(err, tc.expectedError) {
+				t.Fatalf("unexpected error; expected %v, got %v", tc.expectedError, err)
+			}
+			if tc.expectedError != nil {
+				return
+			}
+			if len(mounts) != 1 || mounts[0].Type != "overlay" {
+				t.Fatalf("expected an overlay mount, got %v", mounts)
+			}
+			if !slices.Contains(mounts[0].Options, tc.expectedOption) {
+				t.Fatalf("expected mount option %s, got %v", tc.expectedOption, mounts[0].Options)
+			}
+
+			// Recovering the mounts of the snapshot keeps its context.
+			mounts, err = sn.Mounts(ctx, key)
+			if err != nil {
+				t.Fatalf("failed to get mounts: %v", err)
+			}
+			if len(mounts) != 1 || !slices.Contains(mounts[0].Options, tc.expectedOption) {
+				t.Fatalf("expected mount option %s, got %v", tc.expectedOption, mounts)
+			}
+		})
+	}
+
+	if _, err := NewSnapshotter(ctx, t.TempDir(), dummyFileSystem(), WithSELinuxContext("system_u:object_r")); !errors.Is(err, ErrInvalidSELinuxContext) {
+		t.Fatalf("expected %v for invalid configured context, got %v", ErrInvalidSELinuxContext, err)
+	}
+}
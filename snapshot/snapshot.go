@@ -50,11 +50,11 @@ import (
 	"github.com/containerd/containerd/namespaces"
 	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
 	"github.com/containerd/containerd/snapshots"
-	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/continuity/fs"
 	"github.com/containerd/errdefs"
 	"github.com/containerd/log"
+	distribution "github.com/distribution/reference"
 	"github.com/moby/sys/mountinfo"
 	"github.com/opencontainers/go-digest"
 	"github.com/sirupsen/logrus"
@@ -66,6 +66,15 @@ const (
 	remoteLabel         = "containerd.io/snapshot/remote"
 	remoteLabelVal      = "remote snapshot"
 
+	// ActiveHostLabel reports the registry host a lazily loaded layer is currently fetched from.
+	// It is computed when the snapshot is stat'ed and is never persisted.
+	ActiveHostLabel = "containerd.io/snapshot/remote/soci.active.host"
+
+	// MirrorHostLabel records the registry host, e.g. a mirror, that a layer was first
+	// fetched from, whether it's lazily loaded or unpacked by the snapshotter. It is set by
+	// the FileSystem when the layer is mounted and persisted with the snapshot.
+	MirrorHostLabel = "containerd.io/snapshot/remote/soci.mirror.host"
+
 	// remoteSnapshotLogKey is a key for log line, which indicates whether
 	// `Prepare` method successfully prepared targeting remote snapshot or not, as
 	// defined in the following:
@@ -107,6 +116,8 @@ var (
 // directory. After that it applies the difference to the parent layers if there are any.
 // If succeeded, the mountpoint directory will be treated as a regular layer snapshot.
 // If MountLocal() fails, the mountpoint directory MUST be cleaned up.
+// Prewarm() is called ahead of pulling an image to prepare lazily loading it
+// without creating any snapshot.
 type FileSystem interface {
 	Mount(ctx context.Context, mountpoint string, labels map[string]string) error
 	Check(ctx context.Context, mountpoint string, labels map[string]string) error
@@ -116,6 +127,14 @@ type FileSystem interface {
 	IDMapMount(ctx context.Context, mountpoint, activeLayerID string, idmap idtools.IDMap) (string, error)
 	IDMapMountLocal(ctx context.Context, mountpoint, activeLayerID string, idmap idtools.IDMap) (string, error)
 	CleanImage(ctx context.Context, digest string) error
+	ActiveHost(mountpoint string) (string, bool)
+	Prewarm(ctx context.Context, ref string) error
+}
+
+// Prewarmer is implemented by snapshotters that can prepare lazily loading an image
+// before it is pulled, e.g. when an integration knows that a pull is imminent.
+type Prewarmer interface {
+	Prewarm(ctx context.Context, ref string) error
 }
 
 // SnapshotterConfig is used to configure the remote snapshotter instance
@@ -125,8 +144,45 @@ type SnapshotterConfig struct {
 	minLayerSize                int64
 	allowInvalidMountsOnRestart bool
 	parallelPullUnpack          bool
+	// lazyLoadIndexedLayers lazily loads indexed layers in parallel pull mode
+	lazyLoadIndexedLayers bool
+	// serialPullPrefixes are the prefixes of the repositories of images that
+	// aren't pulled in parallel, even in parallel pull mode
+	serialPullPrefixes []string
+	// tmpfsUpperdir is the directory on tmpfs in which upperdirs and
+	// workdirs of container snapshots are placed
+	tmpfsUpperdir string
+	// tmpfsSize is the size limit of the tmpfs created for each container snapshot
+	tmpfsSize int64
+	// chainMode controls whether a chain may mix lazy and eager layers
+	chainMode ChainMode
+	// lowerdirLimitMode controls how too long lowerdir options are handled
+	lowerdirLimitMode LowerdirLimitMode
+	// activeHostLabel adds ActiveHostLabel to the info of lazily loaded layers
+	activeHostLabel bool
+	// selinuxContext is the SELinux context of overlay mounts
+	selinuxContext string
+	// verifyUserXAttr probes the backing filesystem to verify the "userxattr" detection
+	verifyUserXAttr bool
 }
 
+// ChainMode controls how the snapshotter prepares a layer depending on
+// whether the layers below it in the same chain are lazy (FUSE) or eager (local).
+type ChainMode string
+
+const (
+	// ChainModeMixed prepares each layer independently, so a chain may freely
+	// mix lazy and eager layers.
+	ChainModeMixed ChainMode = "mixed"
+	// ChainModeLazy prefers keeping a chain lazy: while every layer below is lazy,
+	// layers are mounted lazily even if they are smaller than the min layer size.
+	// Layers without a zTOC are still prepared eagerly.
+	ChainModeLazy ChainMode = "lazy"
+	// ChainModeEager keeps lazy layers from being stacked on top of eager ones:
+	// once a layer of a chain is prepared eagerly, all layers above it are too.
+	ChainModeEager ChainMode = "eager"
+)
+
 // Opt is an option to configure the remote snapshotter
 type Opt func(config *SnapshotterConfig) error
 
@@ -157,6 +213,61 @@ func ParallelPullUnpack(config *SnapshotterConfig) error {
 	return nil
 }
 
+// LazyLoadIndexedLayers lazily loads the layers covered by an image's SOCI index
+// when parallel pull and unpack is enabled. Only the layers the index omits are
+// unpacked in parallel. Images without a SOCI index are unpacked in parallel entirely.
+func LazyLoadIndexedLayers(config *SnapshotterConfig) error {
+	config.lazyLoadIndexedLayers = true
+	return nil
+}
+
+// WithSerialPullPrefixes prepares the layers of images whose normalized repository name,
+// e.g. "docker.io/library/ubuntu", starts with one of prefixes as if parallel pull and
+// unpack was disabled, e.g. for registries that break under concurrent requests.
+func WithSerialPullPrefixes(prefixes ...string) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.serialPullPrefixes = append(config.serialPullPrefixes, prefixes...)
+		return nil
+	}
+}
+
+// WithTmpfsUpperdir places the upperdir and workdir of container (non-layer)
+// snapshots under path, which should be backed by tmpfs, instead of the
+// snapshotter root. If sizeBytes is positive, a tmpfs limited to sizeBytes
+// is mounted for each snapshot under path. When a snapshot on tmpfs is committed,
+// its contents are moved to the snapshotter root.
+func WithTmpfsUpperdir(path string, sizeBytes int64) Opt {
+	return func(config *SnapshotterConfig) error {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("tmpfs upperdir path must be absolute: %q", path)
+		}
+		config.tmpfsUpperdir = path
+		config.tmpfsSize = sizeBytes
+		return nil
+	}
+}
+
+// WithActiveHostLabel sets ActiveHostLabel on the info of lazily loaded layers returned
+// by Stat, so that the registry host or mirror serving each layer can be observed through
+// containerd. The label follows failovers between hosts.
+func WithActiveHostLabel(config *SnapshotterConfig) error {
+	config.activeHostLabel = true
+	return nil
+}
+
+// WithChainMode sets how layers are prepared in chains that mix lazy and eager layers.
+func WithChainMode(mode ChainMode) Opt {
+	return func(config *SnapshotterConfig) error {
+		switch mode {
+		case ChainModeMixed, ChainModeLazy, ChainModeEager:
+		default:
+			return fmt.Errorf("unknown chain mode: %q", mode)
+		}
+		config.chainMode = mode
+		return nil
+	}
+}
+
 type snapshotter struct {
 	root        string
 	ms          *storage.MetaStore
@@ -168,7 +279,15 @@ type snapshotter struct {
 	minLayerSize                int64 // minimum layer size for remote mounting
 	allowInvalidMountsOnRestart bool
 	parallelPullUnpack          bool
+	lazyLoadIndexedLayers       bool     // lazily load indexed layers in parallel pull mode
+	serialPullPrefixes          []string // repository prefixes of images not pulled in parallel
 	idmapped                    *sync.Map
+	tmpfsUpperdir               string // directory for container snapshot upperdirs on tmpfs
+	tmpfsSize                   int64  // size limit of per-snapshot tmpfs mounts
+	chainMode                   ChainMode
+	lowerdirLimitMode           LowerdirLimitMode
+	activeHostLabel             bool
+	selinuxContext              string // SELinux context of overlay mounts without SELinuxContextLabel
 }
 
 // NewSnapshotter returns a Snapshotter which can use unpacked remote layers
@@ -206,11 +325,14 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 		return nil, err
 	}
 
-	userxattr, err := overlayutils.NeedsUserXAttr(root)
-	if err != nil {
-		logrus.WithError(err).Warnf("cannot detect whether \"userxattr\" option needs to be used, assuming to be %v", userxattr)
+	if config.tmpfsUpperdir != "" {
+		if err := os.MkdirAll(config.tmpfsUpperdir, 0700); err != nil {
+			return nil, err
+		}
 	}
 
+	userxattr := NeedsUserXAttr(ctx, root, config.verifyUserXAttr)
+
 	idMap := &sync.Map{}
 
 	o := &snapshotter{
@@ -223,6 +345,20 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 		allowInvalidMountsOnRestart: config.allowInvalidMountsOnRestart,
 		idmapped:                    idMap,
 		parallelPullUnpack:          config.parallelPullUnpack,
+		lazyLoadIndexedLayers:       config.lazyLoadIndexedLayers,
+		serialPullPrefixes:          config.serialPullPrefixes,
+		tmpfsUpperdir:               config.tmpfsUpperdir,
+		tmpfsSize:                   config.tmpfsSize,
+		chainMode:                   config.chainMode,
+		lowerdirLimitMode:           config.lowerdirLimitMode,
+		activeHostLabel:             config.activeHostLabel,
+		selinuxContext:              config.selinuxContext,
+	}
+	if o.chainMode == "" {
+		o.chainMode = ChainModeMixed
+	}
+	if o.lowerdirLimitMode == "" {
+		o.lowerdirLimitMode = LowerdirLimitModeRelative
 	}
 
 	if err := o.restoreRemoteSnapshot(ctx); err != nil {
@@ -244,11 +380,21 @@ func (o *snapshotter) Stat(ctx context.Context, key string) (snapshots.Info, err
 		return snapshots.Info{}, err
 	}
 	defer t.Rollback()
-	_, info, _, err := storage.GetInfo(ctx, key)
+	id, info, _, err := storage.GetInfo(ctx, key)
 	if err != nil {
 		return snapshots.Info{}, err
 	}
 
+	if o.activeHostLabel {
+		if _, ok := info.Labels[remoteLabel]; ok {
+			// The host is read from the layer on every call rather than stored, so
+			// the label can't go stale or contend with fetches on failover.
+			if host, ok := o.fs.ActiveHost(o.upperPath(id)); ok && host != "" {
+				info.Labels[ActiveHostLabel] = host
+			}
+		}
+	}
+
 	return info, nil
 }
 
@@ -327,7 +473,7 @@ func (o *snapshotter) setupIDMap(ctx context.Context, s storage.Snapshot, parent
 		if _, ok := parentSnapshot.Labels[source.HasSociIndexDigest]; !ok {
 			// Fallback to overlay
 			log.G(ctx).Debug("no SOCI index found, remapping from root")
-			mounts, err := o.mounts(ctx, s, parent)
+			mounts, err := o.mounts(ctx, s, parent, labels)
 			if err != nil {
 				return err
 			}
@@ -369,12 +515,17 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 	target, ok := base.Labels[targetSnapshotLabel]
 	// !ok means we are in an active snapshot
 	if !ok {
+		if o.tmpfsUpperdir != "" {
+			if err := o.prepareTmpfsDirectory(ctx, s.ID); err != nil {
+				return nil, fmt.Errorf("failed to prepare tmpfs upperdir: %w", err)
+			}
+		}
 		// Setup id-mapped mounts if config allows.
 		// Any error here needs to stop the container from starting.
 		if err := o.setupIDMap(ctx, s, parent, base.Labels); err != nil {
 			return nil, err
 		}
-		return o.mounts(ctx, s, parent)
+		return o.mounts(ctx, s, parent, base.Labels)
 	}
 
 	// Get namespace to save into snapshot
@@ -392,10 +543,11 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 	log.G(lCtx).Debug("preparing snapshot")
 
 	var deferToContainerRuntime bool
+	parallelPullUnpack := o.parallelPull(lCtx, base.Labels)
 
 	// remote snapshot prepare
-	// skip if parallel pull is enabled
-	if !o.skipRemoteSnapshotPrepare(lCtx, base.Labels) {
+	// skip if parallel pull is enabled, unless indexed layers are lazily loaded
+	if !o.skipRemoteSnapshotPrepare(lCtx, parent, base.Labels, parallelPullUnpack) {
 		err := o.prepareRemoteSnapshot(lCtx, key, base.Labels)
 		if err == nil {
 			base.Labels[remoteLabel] = remoteLabelVal       // Mark this snapshot as remote
@@ -417,14 +569,15 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 		case errors.Is(err, ErrNoZtoc):
 			// no-op
 		case errors.Is(err, ErrNoIndex):
-			deferToContainerRuntime = true
+			// In parallel pull mode, images without an index are unpacked by the snapshotter.
+			deferToContainerRuntime = !parallelPullUnpack
 		default:
 			commonmetrics.IncOperationCount(commonmetrics.FuseMountFailureCount, digest.Digest(""))
 		}
 	}
 
 	// fall back to local snapshot
-	mounts, err := o.mounts(ctx, s, parent)
+	mounts, err := o.mounts(ctx, s, parent, base.Labels)
 	if err != nil {
 		// don't fallback here, since there was an error getting mounts
 		return nil, err
@@ -440,7 +593,7 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 		return mounts, nil
 	}
 
-	if o.parallelPullUnpack {
+	if parallelPullUnpack {
 		log.G(ctx).WithField("layerDigest", base.Labels[ctdsnapshotters.TargetLayerDigestLabel]).Info("preparing snapshot with parallel pull/unpack")
 		err = o.prepareParallelPullSnapshot(lCtx, key, base.Labels, mounts)
 	} else {
@@ -465,7 +618,7 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 		return nil, err
 	}
 	log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).WithError(err).Debug("skipped preparing remote snapshot")
-	if o.parallelPullUnpack {
+	if parallelPullUnpack {
 		// If parallel pull/unpack fails, then we should not defer to the container runtime
 		// and just return the error.
 		return nil, err
@@ -478,10 +631,59 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 	return mounts, nil
 }
 
-func (o *snapshotter) skipRemoteSnapshotPrepare(ctx context.Context, labels map[string]string) bool {
-	if o.parallelPullUnpack {
+// parallelPull returns whether the layer with labels is pulled and unpacked in parallel,
+// i.e. parallel pull mode is enabled and the repository of its image doesn't match any
+// of the serial pull prefixes.
+func (o *snapshotter) parallelPull(ctx context.Context, labels map[string]string) bool {
+	if !o.parallelPullUnpack || len(o.serialPullPrefixes) == 0 {
+		return o.parallelPullUnpack
+	}
+	ref := labels[ctdsnapshotters.TargetRefLabel]
+	if prefix := matchRepositoryPrefix(o.serialPullPrefixes, ref); prefix != "" {
+		log.G(ctx).WithField("ref", ref).WithField("prefix", prefix).Info("image matches a serial pull prefix, disabling parallel pull/unpack")
+		return false
+	}
+	return true
+}
+
+// matchRepositoryPrefix returns the longest of prefixes that the normalized repository
+// name of the image ref starts with, or "" if there's none or ref is invalid.
+func matchRepositoryPrefix(prefixes []string, ref string) string {
+	named, err := distribution.ParseDockerRef(ref)
+	if err != nil {
+		return ""
+	}
+	name := named.Name()
+	var match string
+	for _, p := range prefixes {
+		if p != "" && strings.HasPrefix(name, p) && len(p) > len(match) {
+			match = p
+		}
+	}
+	return match
+}
+
+func (o *snapshotter) skipRemoteSnapshotPrepare(ctx context.Context, parent string, labels map[string]string, parallelPullUnpack bool) bool {
+	if parallelPullUnpack && !o.lazyLoadIndexedLayers {
+		return true
+	}
+
+	var parentsEager bool
+	if o.chainMode != ChainModeMixed && parent != "" {
+		var err error
+		parentsEager, err = o.chainHasEagerLayer(ctx, parent)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("failed to get parent chain, preparing layer independently")
+		}
+	}
+	if o.chainMode == ChainModeEager && parentsEager {
+		log.G(ctx).Info("a lower layer in the chain is eager, skipping remote snapshot preparation")
 		return true
 	}
+	if o.chainMode == ChainModeLazy && !parentsEager {
+		// Keep the chain lazy regardless of the layer size.
+		return false
+	}
 
 	if o.minLayerSize > 0 {
 		if strVal, ok := labels[source.TargetSizeLabel]; ok {
@@ -504,7 +706,13 @@ func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snap
 	if err != nil {
 		return nil, err
 	}
-	return o.mounts(ctx, s, parent)
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return nil, err
+		}
+	}
+	return o.mounts(ctx, s, parent, base.Labels)
 }
 
 // Mounts returns the mounts for the transaction identified by key. Can be
@@ -518,11 +726,16 @@ func (o *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, er
 		return nil, err
 	}
 	s, err := storage.GetSnapshot(ctx, key)
-	t.Rollback()
 	if err != nil {
+		t.Rollback()
 		return nil, fmt.Errorf("failed to get active mount: %w", err)
 	}
-	return o.mounts(ctx, s, key)
+	_, info, _, err := storage.GetInfo(ctx, key)
+	t.Rollback()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot info: %w", err)
+	}
+	return o.mounts(ctx, s, key, info.Labels)
 }
 
 func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
@@ -550,6 +763,14 @@ func (o *snapshotter) commit(ctx context.Context, isRemote bool, name, key strin
 		return err
 	}
 
+	if o.onTmpfs(id) {
+		// Committed snapshots can be used as lower layers of other snapshots,
+		// so they must not be lost when tmpfs is cleared.
+		if err = o.moveFromTmpfs(ctx, id); err != nil {
+			return fmt.Errorf("failed to move snapshot from tmpfs: %w", err)
+		}
+	}
+
 	if !isRemote { // skip diskusage for remote snapshots for allowing lazy preparation of nodes
 		du, err := fs.DiskUsage(ctx, o.upperPath(id))
 		if err != nil {
@@ -655,6 +876,12 @@ func (o *snapshotter) Walk(ctx context.Context, fn snapshots.WalkFunc, fs ...str
 	return storage.WalkInfo(ctx, fn, fs...)
 }
 
+// Prewarm warms up the connections, tokens and SOCI index used to lazily load the
+// image ref, so that preparing its snapshots right after is faster.
+func (o *snapshotter) Prewarm(ctx context.Context, ref string) error {
+	return o.fs.Prewarm(ctx, ref)
+}
+
 // Cleanup cleans up disk resources from removed or abandoned snapshots
 func (o *snapshotter) Cleanup(ctx context.Context) error {
 	log.G(ctx).Debug("cleanup")
@@ -740,6 +967,79 @@ func (o *snapshotter) cleanupSnapshotDirectory(ctx context.Context, dir string)
 	if err := os.RemoveAll(dir); err != nil {
 		return fmt.Errorf("failed to remove directory %q: %w", dir, err)
 	}
+	if o.tmpfsUpperdir != "" {
+		if err := o.cleanupTmpfsDirectory(filepath.Base(dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareTmpfsDirectory creates the upperdir and workdir of the snapshot on tmpfs.
+// If a size limit is configured, a dedicated tmpfs is mounted for the snapshot.
+func (o *snapshotter) prepareTmpfsDirectory(ctx context.Context, id string) (err error) {
+	td := o.tmpfsPath(id)
+	if err := os.Mkdir(td, 0700); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if err1 := o.cleanupTmpfsDirectory(id); err1 != nil {
+				log.G(ctx).WithError(err1).WithField("path", td).Warn("failed to cleanup tmpfs directory")
+			}
+		}
+	}()
+
+	if o.tmpfsSize > 0 {
+		m := mount.Mount{
+			Type:    "tmpfs",
+			Source:  "tmpfs",
+			Options: []string{"mode=0700", fmt.Sprintf("size=%d", o.tmpfsSize)},
+		}
+		if err := m.Mount(td); err != nil {
+			return fmt.Errorf("failed to mount tmpfs at %q: %w", td, err)
+		}
+	}
+
+	// Preserve the ownership of the original upperdir, which is inherited from the parent.
+	st, err := os.Stat(filepath.Join(o.root, "snapshots", id, "fs"))
+	if err != nil {
+		return err
+	}
+	stat := st.Sys().(*syscall.Stat_t)
+
+	upper := filepath.Join(td, "fs")
+	if err := os.Mkdir(upper, 0755); err != nil {
+		return err
+	}
+	if err := os.Lchown(upper, int(stat.Uid), int(stat.Gid)); err != nil {
+		return fmt.Errorf("failed to chown: %w", err)
+	}
+	return os.Mkdir(filepath.Join(td, "work"), 0711)
+}
+
+// moveFromTmpfs copies the contents of the snapshot's upperdir on tmpfs
+// to the snapshotter root and removes the snapshot's directory from tmpfs.
+func (o *snapshotter) moveFromTmpfs(ctx context.Context, id string) error {
+	src := filepath.Join(o.tmpfsPath(id), "fs")
+	dst := filepath.Join(o.root, "snapshots", id, "fs")
+	log.G(ctx).WithField("src", src).WithField("dst", dst).Debug("moving snapshot from tmpfs")
+	if err := fs.CopyDir(dst, src); err != nil {
+		return err
+	}
+	return o.cleanupTmpfsDirectory(id)
+}
+
+// cleanupTmpfsDirectory unmounts the snapshot's tmpfs, if any,
+// and removes the snapshot's directory from tmpfs.
+func (o *snapshotter) cleanupTmpfsDirectory(id string) error {
+	td := o.tmpfsPath(id)
+	if err := mount.UnmountAll(td, 0); err != nil {
+		return fmt.Errorf("failed to unmount tmpfs %q: %w", td, err)
+	}
+	if err := os.RemoveAll(td); err != nil {
+		return fmt.Errorf("failed to remove tmpfs directory %q: %w", td, err)
+	}
 	return nil
 }
 
@@ -856,7 +1156,7 @@ func (o *snapshotter) prepareDirectory(ctx context.Context, snapshotDir string,
 	return td, nil
 }
 
-func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey string) ([]mount.Mount, error) {
+func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey string, labels map[string]string) ([]mount.Mount, error) {
 	// Make sure that all layers lower than the target layer are available
 	if checkKey != "" && !o.checkAvailability(ctx, checkKey) {
 		return nil, fmt.Errorf("layer %q unavailable: %w", s.ID, errdefs.ErrUnavailable)
@@ -910,6 +1210,17 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 	if o.userxattr {
 		options = append(options, "userxattr")
 	}
+	// The context only applies to overlay mounts; the kernel ignores it on bind mounts.
+	contextOption, err := o.selinuxContextOption(labels)
+	if err != nil {
+		return nil, err
+	}
+	if contextOption != "" {
+		options = append(options, contextOption)
+	}
+	if err := checkLowerdirLimit(o.lowerdirLimitMode, options); err != nil {
+		return nil, err
+	}
 
 	return []mount.Mount{
 		{
@@ -964,15 +1275,37 @@ func (o *snapshotter) createIDMapMount(ctx context.Context, path, id string, idm
 }
 
 // upperPath produces a file path like "{snapshotter.root}/snapshots/{id}/fs"
+// or "{tmpfs_upperdir}/{id}/fs" if the snapshot is on tmpfs
 func (o *snapshotter) upperPath(id string) string {
+	if o.onTmpfs(id) {
+		return filepath.Join(o.tmpfsPath(id), "fs")
+	}
 	return filepath.Join(o.root, "snapshots", id, "fs")
 }
 
 // workPath produces a file path like "{snapshotter.root}/snapshots/{id}/work"
+// or "{tmpfs_upperdir}/{id}/work" if the snapshot is on tmpfs
 func (o *snapshotter) workPath(id string) string {
+	if o.onTmpfs(id) {
+		return filepath.Join(o.tmpfsPath(id), "work")
+	}
 	return filepath.Join(o.root, "snapshots", id, "work")
 }
 
+// tmpfsPath produces a file path like "{tmpfs_upperdir}/{id}"
+func (o *snapshotter) tmpfsPath(id string) string {
+	return filepath.Join(o.tmpfsUpperdir, id)
+}
+
+// onTmpfs returns whether the upperdir of the snapshot is on tmpfs.
+func (o *snapshotter) onTmpfs(id string) bool {
+	if o.tmpfsUpperdir == "" {
+		return false
+	}
+	_, err := os.Stat(o.tmpfsPath(id))
+	return err == nil
+}
+
 // Close closes the snapshotter
 func (o *snapshotter) Close() error {
 	log.L.Debug("close")
@@ -1052,6 +1385,28 @@ func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, lab
 	return o.fs.Mount(ctx, mountpoint, labels)
 }
 
+// chainHasEagerLayer returns whether a layer of the chain ending at key,
+// including key itself, is unpacked eagerly rather than mounted lazily.
+func (o *snapshotter) chainHasEagerLayer(ctx context.Context, key string) (bool, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return false, err
+	}
+	defer t.Rollback()
+
+	for cKey := key; cKey != ""; {
+		_, info, _, err := storage.GetInfo(ctx, cKey)
+		if err != nil {
+			return false, fmt.Errorf("failed to get info of %q: %w", cKey, err)
+		}
+		if _, remote := info.Labels[remoteLabel]; !remote {
+			return true, nil
+		}
+		cKey = info.Parent
+	}
+	return false, nil
+}
+
 // checkAvailability checks avaiability of the specified layer and all lower
 // layers using filesystem's checking functionality.
 func (o *snapshotter) checkAvailability(ctx context.Context, key string) bool {
@@ -38,17 +38,22 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"syscall"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/fs/source"
 	"github.com/awslabs/soci-snapshotter/idtools"
 	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/namespaces"
+	ctdsnapshotters "github.com/containerd/containerd/pkg/snapshotters"
 	"github.com/containerd/containerd/pkg/testutil"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/containerd/snapshots/testsuite"
 	"github.com/containerd/errdefs"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -116,6 +121,43 @@ func TestRemotePrepare(t *testing.T) {
 	}
 }
 
+func TestActiveHostLabel(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%t", enabled), func(t *testing.T) {
+			var opts []Opt
+			if enabled {
+				opts = append(opts, WithActiveHostLabel)
+			}
+			fs := bindFileSystem(t).(*bindFs)
+			sn, err := NewSnapshotter(ctx, t.TempDir(), fs, opts...)
+			if err != nil {
+				t.Fatalf("failed to make new remote snapshotter: %q", err)
+			}
+			target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+			defer sn.Remove(ctx, target)
+
+			for _, host := range []string{"mirror1.example.com", "mirror2.example.com"} {
+				// Failing over to another mirror changes the host the layer is fetched from.
+				fs.activeHost = host
+				info, err := sn.Stat(ctx, target)
+				if err != nil {
+					t.Fatalf("failed to stat remote snapshot: %v", err)
+				}
+				label, ok := info.Labels[ActiveHostLabel]
+				if enabled && label != host {
+					t.Fatalf("expected active host label %q; got %q", host, label)
+				}
+				if !enabled && ok {
+					t.Fatalf("expected no active host label; got %q", label)
+				}
+			}
+		})
+	}
+}
+
 func TestRemoteOverlay(t *testing.T) {
 	testutil.RequiresRoot(t)
 	ctx := context.TODO()
@@ -384,6 +426,7 @@ type bindFs struct {
 	root         string
 	checkFailure bool
 	broken       map[string]bool
+	activeHost   string
 }
 
 func (fs *bindFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
@@ -435,6 +478,14 @@ func (fs *bindFs) CleanImage(ctx context.Context, digest string) error {
 	return nil
 }
 
+func (fs *bindFs) ActiveHost(mountpoint string) (string, bool) {
+	return fs.activeHost, true
+}
+
+func (fs *bindFs) Prewarm(ctx context.Context, ref string) error {
+	return nil
+}
+
 func dummyFileSystem() FileSystem { return &dummyFs{} }
 
 type dummyFs struct{}
@@ -471,6 +522,14 @@ func (fs *dummyFs) CleanImage(ctx context.Context, digest string) error {
 	return nil
 }
 
+func (fs *dummyFs) ActiveHost(mountpoint string) (string, bool) {
+	return "", false
+}
+
+func (fs *dummyFs) Prewarm(ctx context.Context, ref string) error {
+	return fmt.Errorf("dummy")
+}
+
 // =============================================================================
 // Tests backword-comaptibility of overlayfs snapshotter.
 
@@ -584,6 +643,65 @@ func TestOverlayOverlayMount(t *testing.T) {
 	}
 }
 
+func TestOverlayTmpfsUpperdir(t *testing.T) {
+	ctx := context.TODO()
+	root := t.TempDir()
+	tmpfsRoot := t.TempDir()
+	o, err := NewSnapshotter(ctx, root, dummyFileSystem(), WithTmpfsUpperdir(tmpfsRoot, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "/tmp/test"
+	mounts, err := o.Prepare(ctx, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mounts[0]
+	if err := os.WriteFile(filepath.Join(m.Source, "foo"), []byte("hi"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Commit(ctx, "base", key); err != nil {
+		t.Fatal(err)
+	}
+	if mounts, err = o.Prepare(ctx, "/tmp/layer2", "base"); err != nil {
+		t.Fatal(err)
+	}
+	if len(mounts) != 1 {
+		t.Fatalf("should only have 1 mount but received %d", len(mounts))
+	}
+	m = mounts[0]
+	if m.Type != "overlay" {
+		t.Errorf("mount type should be overlay but received %q", m.Type)
+	}
+	parent := getParents(ctx, o, root, "/tmp/layer2")[0]
+	if data, err := os.ReadFile(filepath.Join(parent, "foo")); err != nil || string(data) != "hi" {
+		t.Errorf("expected committed snapshot contents to be moved from tmpfs, got %q: %v", data, err)
+	}
+	var (
+		tp    = filepath.Join(tmpfsRoot, filepath.Base(getBasePath(ctx, o, root, "/tmp/layer2")))
+		work  = "workdir=" + filepath.Join(tp, "work")
+		upper = "upperdir=" + filepath.Join(tp, "fs")
+		lower = "lowerdir=" + parent
+	)
+	for i, v := range []string{
+		work,
+		upper,
+		lower,
+	} {
+		if m.Options[i] != v {
+			t.Errorf("expected %q but received %q", v, m.Options[i])
+		}
+	}
+
+	// Removing the snapshot should remove its directory from tmpfs.
+	if err := o.Remove(ctx, "/tmp/layer2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tp); !os.IsNotExist(err) {
+		t.Errorf("expected tmpfs directory %q to be removed: %v", tp, err)
+	}
+}
+
 func getBasePath(ctx context.Context, sn snapshots.Snapshotter, root, key string) string {
 	o := sn.(*snapshotter)
 	ctx, t, err := o.ms.TransactionContext(ctx, false)
@@ -743,3 +861,372 @@ func TestOverlayView(t *testing.T) {
 		t.Errorf("expected userxattr option, but got %s", m.Options[1])
 	}
 }
+
+const testLayerLabel = "containerd.io/snapshot/test.layer"
+
+// chainFs is a FileSystem that materializes a different set of files
+// for each layer, so the merged view of a chain can be verified.
+type chainFs struct {
+	dummyFs
+	t      *testing.T
+	layers map[string]func(dir string) error
+}
+
+func (fs *chainFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	dir := fs.t.TempDir()
+	if err := fs.layers[labels[testLayerLabel]](dir); err != nil {
+		return err
+	}
+	return syscall.Mount(dir, mountpoint, "none", syscall.MS_BIND, "")
+}
+
+func (fs *chainFs) Unmount(ctx context.Context, mountpoint string) error {
+	return syscall.Unmount(mountpoint, 0)
+}
+
+func (fs *chainFs) MountLocal(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
+	return fs.layers[labels[testLayerLabel]](mountpoint)
+}
+
+func TestMixedChain(t *testing.T) {
+	testutil.RequiresRoot(t)
+	writeFiles := func(files map[string]string, opaqueDirs ...string) func(string) error {
+		return func(dir string) error {
+			for name, contents := range files {
+				p := filepath.Join(dir, name)
+				if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+					return err
+				}
+				if err := os.WriteFile(p, []byte(contents), 0644); err != nil {
+					return err
+				}
+			}
+			for _, d := range opaqueDirs {
+				if err := unix.Setxattr(filepath.Join(dir, d), "trusted.overlay.opaque", []byte("y"), 0); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	layers := []struct {
+		name     string
+		size     string
+		contents func(string) error
+	}{
+		{name: "layer1", size: "100", contents: writeFiles(map[string]string{"a": "1", "d/x": "1"})},
+		// layer2 is smaller than the min layer size, so it's eager unless the chain is forced lazy.
+		{name: "layer2", size: "1", contents: writeFiles(map[string]string{"a": "2", "d/y": "2"}, "d")},
+		{name: "layer3", size: "100", contents: writeFiles(map[string]string{"b": "3"})},
+	}
+
+	testCases := []struct {
+		mode           ChainMode
+		expectedRemote []bool
+	}{
+		{mode: ChainModeMixed, expectedRemote: []bool{true, false, true}},
+		{mode: ChainModeLazy, expectedRemote: []bool{true, true, true}},
+		{mode: ChainModeEager, expectedRemote: []bool{true, false, false}},
+	}
+	for _, tc := range testCases {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			ctx := namespaces.WithNamespace(context.Background(), "test")
+			fs := &chainFs{t: t, layers: make(map[string]func(string) error)}
+			for _, l := range layers {
+				fs.layers[l.name] = l.contents
+			}
+			sn, err := NewSnapshotter(ctx, t.TempDir(), fs, WithMinLayerSize(10), WithChainMode(tc.mode))
+			if err != nil {
+				t.Fatalf("failed to make new snapshotter: %v", err)
+			}
+			defer sn.Close()
+
+			var parent string
+			for i, l := range layers {
+				labels := map[string]string{
+					targetSnapshotLabel:    l.name,
+					testLayerLabel:         l.name,
+					source.TargetSizeLabel: l.size,
+				}
+				if _, err := sn.Prepare(ctx, "prepare-"+l.name, parent, snapshots.WithLabels(labels)); !errdefs.IsAlreadyExists(err) {
+					t.Fatalf("failed to prepare %s: %v", l.name, err)
+				}
+				info, err := sn.Stat(ctx, l.name)
+				if err != nil {
+					t.Fatalf("failed to stat %s: %v", l.name, err)
+				}
+				if _, remote := info.Labels[remoteLabel]; remote != tc.expectedRemote[i] {
+					t.Fatalf("expected %s to be remote=%v", l.name, tc.expectedRemote[i])
+				}
+				parent = l.name
+			}
+
+			mounts, err := sn.Prepare(ctx, "container", parent)
+			if err != nil {
+				t.Fatalf("failed to prepare container snapshot: %v", err)
+			}
+			dest := t.TempDir()
+			if err := mount.All(mounts, dest); err != nil {
+				t.Fatalf("failed to mount container snapshot: %v", err)
+			}
+			defer mount.UnmountAll(dest, 0)
+
+			for name, expected := range map[string]string{"a": "2", "b": "3", "d/y": "2"} {
+				data, err := os.ReadFile(filepath.Join(dest, name))
+				if err != nil {
+					t.Fatalf("failed to read %s: %v", name, err)
+				}
+				if string(data) != expected {
+					t.Fatalf("expected %s to contain %q; got %q", name, expected, data)
+				}
+			}
+			// d is opaque in layer2, so d/x from layer1 must be hidden.
+			if _, err := os.Stat(filepath.Join(dest, "d/x")); !os.IsNotExist(err) {
+				t.Fatalf("expected d/x to be hidden by opaque directory: %v", err)
+			}
+		})
+	}
+}
+
+// partialIndexFs is a FileSystem for an image whose SOCI index only covers some of its layers.
+type partialIndexFs struct {
+	chainFs
+	indexed        map[string]bool
+	parallelMounts []string
+}
+
+func (fs *partialIndexFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if !fs.indexed[labels[testLayerLabel]] {
+		return ErrNoZtoc
+	}
+	return fs.chainFs.Mount(ctx, mountpoint, labels)
+}
+
+func (fs *partialIndexFs) MountParallel(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
+	fs.parallelMounts = append(fs.parallelMounts, labels[testLayerLabel])
+	return fs.layers[labels[testLayerLabel]](mountpoint)
+}
+
+func TestPartialIndexParallelPull(t *testing.T) {
+	testutil.RequiresRoot(t)
+	writeFile := func(name, contents string) func(string) error {
+		return func(dir string) error {
+			return os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644)
+		}
+	}
+	layers := []struct {
+		name     string
+		indexed  bool
+		contents func(string) error
+	}{
+		{name: "layer1", indexed: true, contents: writeFile("a", "1")},
+		{name: "layer2", contents: writeFile("b", "2")},
+		{name: "layer3", indexed: true, contents: writeFile("c", "3")},
+		{name: "layer4", contents: writeFile("a", "4")},
+	}
+
+	testCases := []struct {
+		name                   string
+		opts                   []Opt
+		expectedRemote         []bool
+		expectedParallelMounts []string
+	}{
+		{
+			name:                   "parallel pull unpacks all layers",
+			opts:                   []Opt{ParallelPullUnpack},
+			expectedRemote:         []bool{false, false, false, false},
+			expectedParallelMounts: []string{"layer1", "layer2", "layer3", "layer4"},
+		},
+		{
+			name:                   "parallel pull lazily loads indexed layers",
+			opts:                   []Opt{ParallelPullUnpack, LazyLoadIndexedLayers},
+			expectedRemote:         []bool{true, false, true, false},
+			expectedParallelMounts: []string{"layer2", "layer4"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := namespaces.WithNamespace(context.Background(), "test")
+			fs := &partialIndexFs{
+				chainFs: chainFs{t: t, layers: make(map[string]func(string) error)},
+				indexed: make(map[string]bool),
+			}
+			for _, l := range layers {
+				fs.layers[l.name] = l.contents
+				fs.indexed[l.name] = l.indexed
+			}
+			sn, err := NewSnapshotter(ctx, t.TempDir(), fs, tc.opts...)
+			if err != nil {
+				t.Fatalf("failed to make new snapshotter: %v", err)
+			}
+			defer sn.Close()
+
+			var parent string
+			for i, l := range layers {
+				labels := map[string]string{
+					targetSnapshotLabel: l.name,
+					testLayerLabel:      l.name,
+				}
+				if _, err := sn.Prepare(ctx, "prepare-"+l.name, parent, snapshots.WithLabels(labels)); !errdefs.IsAlreadyExists(err) {
+					t.Fatalf("failed to prepare %s: %v", l.name, err)
+				}
+				info, err := sn.Stat(ctx, l.name)
+				if err != nil {
+					t.Fatalf("failed to stat %s: %v", l.name, err)
+				}
+				if _, remote := info.Labels[remoteLabel]; remote != tc.expectedRemote[i] {
+					t.Fatalf("expected %s to be remote=%v", l.name, tc.expectedRemote[i])
+				}
+				parent = l.name
+			}
+			if !reflect.DeepEqual(fs.parallelMounts, tc.expectedParallelMounts) {
+				t.Fatalf("expected layers %v to be unpacked in parallel; got %v", tc.expectedParallelMounts, fs.parallelMounts)
+			}
+
+			mounts, err := sn.Prepare(ctx, "container", parent)
+			if err != nil {
+				t.Fatalf("failed to prepare container snapshot: %v", err)
+			}
+			dest := t.TempDir()
+			if err := mount.All(mounts, dest); err != nil {
+				t.Fatalf("failed to mount container snapshot: %v", err)
+			}
+			defer mount.UnmountAll(dest, 0)
+
+			for name, expected := range map[string]string{"a": "4", "b": "2", "c": "3"} {
+				data, err := os.ReadFile(filepath.Join(dest, name))
+				if err != nil {
+					t.Fatalf("failed to read %s: %v", name, err)
+				}
+				if string(data) != expected {
+					t.Fatalf("expected %s to contain %q; got %q", name, expected, data)
+				}
+			}
+		})
+	}
+}
+
+// pullModeFs records the layers prepared locally and in parallel. Like the soci
+// filesystem, it records the host layers are fetched from in their labels, if any.
+type pullModeFs struct {
+	dummyFs
+	local, parallel []string
+	host            string
+	// remote is whether layers are mounted as remote snapshots.
+	remote bool
+}
+
+func (fs *pullModeFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if !fs.remote {
+		return ErrNoZtoc
+	}
+	if fs.host != "" {
+		labels[MirrorHostLabel] = fs.host
+	}
+	return nil
+}
+
+func (fs *pullModeFs) MountLocal(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
+	fs.local = append(fs.local, labels[ctdsnapshotters.TargetRefLabel])
+	if fs.host != "" {
+		labels[MirrorHostLabel] = fs.host
+	}
+	return nil
+}
+
+func (fs *pullModeFs) MountParallel(ctx context.Context, mountpoint string, labels map[string]string, mounts []mount.Mount) error {
+	fs.parallel = append(fs.parallel, labels[ctdsnapshotters.TargetRefLabel])
+	if fs.host != "" {
+		labels[MirrorHostLabel] = fs.host
+	}
+	return nil
+}
+
+func TestSerialPullPrefixes(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.Background(), "test")
+	fs := &pullModeFs{}
+	sn, err := NewSnapshotter(ctx, t.TempDir(), fs, ParallelPullUnpack,
+		WithSerialPullPrefixes("registry.example.com/fragile/", "docker.io/library/"))
+	if err != nil {
+		t.Fatalf("failed to make new snapshotter: %v", err)
+	}
+	defer sn.Close()
+
+	refs := []string{
+		"registry.example.com/fragile/app:latest",
+		"registry.example.com/robust/app:latest",
+		"ubuntu:latest",
+		"docker.io/myorg/app:latest",
+	}
+	for i, ref := range refs {
+		labels := map[string]string{
+			targetSnapshotLabel:            fmt.Sprintf("layer%d", i),
+			ctdsnapshotters.TargetRefLabel: ref,
+		}
+		if _, err := sn.Prepare(ctx, fmt.Sprintf("prepare%d", i), "", snapshots.WithLabels(labels)); !errdefs.IsAlreadyExists(err) {
+			t.Fatalf("failed to prepare layer of %s: %v", ref, err)
+		}
+	}
+	if expected := []string{refs[0], refs[2]}; !reflect.DeepEqual(fs.local, expected) {
+		t.Fatalf("expected layers of %v to be prepared serially; got %v", expected, fs.local)
+	}
+	if expected := []string{refs[1], refs[3]}; !reflect.DeepEqual(fs.parallel, expected) {
+		t.Fatalf("expected layers of %v to be prepared in parallel; got %v", expected, fs.parallel)
+	}
+}
+
+func TestMirrorHostLabel(t *testing.T) {
+	const host = "mirror.example.com:5000"
+	for _, tc := range []struct {
+		name   string
+		opts   []Opt
+		remote bool
+	}{
+		{name: "remote snapshot", remote: true},
+		{name: "local snapshot"},
+		{name: "parallel pull", opts: []Opt{ParallelPullUnpack}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := namespaces.WithNamespace(context.Background(), "test")
+			sn, err := NewSnapshotter(ctx, t.TempDir(), &pullModeFs{host: host, remote: tc.remote}, tc.opts...)
+			if err != nil {
+				t.Fatalf("failed to make new snapshotter: %v", err)
+			}
+			defer sn.Close()
+
+			labels := map[string]string{
+				targetSnapshotLabel:            "layer",
+				ctdsnapshotters.TargetRefLabel: "registry.example.com/app:latest",
+			}
+			if _, err := sn.Prepare(ctx, "prepare", "", snapshots.WithLabels(labels)); !errdefs.IsAlreadyExists(err) {
+				t.Fatalf("failed to prepare layer: %v", err)
+			}
+			info, err := sn.Stat(ctx, "layer")
+			if err != nil {
+				t.Fatalf("failed to stat layer: %v", err)
+			}
+			if got := info.Labels[MirrorHostLabel]; got != host {
+				t.Fatalf("expected %s to be %q; got %q", MirrorHostLabel, host, got)
+			}
+		})
+	}
+}
+
+func TestMatchRepositoryPrefix(t *testing.T) {
+	prefixes := []string{"registry.example.com/", "registry.example.com/team/", "docker.io/library/ubuntu"}
+	tests := []struct {
+		ref      string
+		expected string
+	}{
+		{ref: "registry.example.com/team/app:latest", expected: "registry.example.com/team/"},
+		{ref: "registry.example.com/other/app:latest", expected: "registry.example.com/"},
+		{ref: "ubuntu:22.04", expected: "docker.io/library/ubuntu"},
+		{ref: "docker.io/library/alpine:latest", expected: ""},
+		{ref: "", expected: ""},
+	}
+	for _, tc := range tests {
+		if got := matchRepositoryPrefix(prefixes, tc.ref); got != tc.expected {
+			t.Errorf("expected %q to match prefix %q; got %q", tc.ref, tc.expected, got)
+		}
+	}
+}
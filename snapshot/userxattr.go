@@ -0,0 +1,124 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/snapshots/overlay/overlayutils"
+	"github.com/containerd/log"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// trustedXAttrProbe and userXAttrProbe are the xattrs written to probe whether
+	// overlay can store its xattrs in the trusted and user namespaces.
+	trustedXAttrProbe = "trusted.overlay.soci-probe"
+	userXAttrProbe    = "user.overlay.soci-probe"
+)
+
+// xattrFuncs sets and gets the xattrs of files. They are replaced in tests to
+// simulate filesystems restricting xattrs.
+type xattrFuncs struct {
+	set func(path, attr string, data []byte, flags int) error
+	get func(path, attr string, dest []byte) (int, error)
+}
+
+var defaultXAttrFuncs = xattrFuncs{
+	set: unix.Lsetxattr,
+	get: unix.Lgetxattr,
+}
+
+// WithVerifiedUserXAttr checks whether the "userxattr" overlay mount option is needed
+// by probing the xattr namespaces of the backing filesystem, instead of only relying on
+// the kernel and user namespace heuristic. See NeedsUserXAttr.
+func WithVerifiedUserXAttr(config *SnapshotterConfig) error {
+	config.verifyUserXAttr = true
+	return nil
+}
+
+// NeedsUserXAttr returns whether overlay needs the "userxattr" mount option, i.e. stores
+// its xattrs in the user namespace, for snapshots under root. It's detected heuristically
+// with overlayutils.NeedsUserXAttr. If verify is true, the detection is checked by writing
+// and reading back an xattr of each namespace on a temporary file under root, and corrected
+// if the backing filesystem only supports the other namespace.
+func NeedsUserXAttr(ctx context.Context, root string, verify bool) bool {
+	userxattr, err := overlayutils.NeedsUserXAttr(root)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("cannot detect whether \"userxattr\" option needs to be used, assuming to be %v", userxattr)
+	}
+	if !verify {
+		return userxattr
+	}
+	return verifyUserXAttr(ctx, root, userxattr, defaultXAttrFuncs)
+}
+
+// verifyUserXAttr probes the xattr namespaces supported by the filesystem at root and
+// returns whether the "userxattr" option is needed. The detected value is kept unless only
+// the other namespace is supported, or if the filesystem can't be probed.
+func verifyUserXAttr(ctx context.Context, root string, userxattr bool, x xattrFuncs) bool {
+	f, err := os.CreateTemp(root, ".xattr-probe-")
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to probe xattr support, assuming \"userxattr\" option to be %v", userxattr)
+		return userxattr
+	}
+	path := f.Name()
+	f.Close()
+	defer os.Remove(path)
+
+	trustedErr := probeXAttr(path, trustedXAttrProbe, x)
+	userErr := probeXAttr(path, userXAttrProbe, x)
+	verified := userxattr
+	switch {
+	case userxattr && userErr != nil && trustedErr == nil:
+		verified = false
+	case !userxattr && trustedErr != nil && userErr == nil:
+		verified = true
+	}
+	if verified != userxattr {
+		log.G(ctx).WithField("root", root).
+			WithField("trusted", trustedErr).
+			WithField("user", userErr).
+			Warnf("backing filesystem doesn't support the detected xattr namespace, correcting \"userxattr\" option from %v to %v", userxattr, verified)
+	} else if trustedErr != nil && userErr != nil {
+		log.G(ctx).WithField("root", root).
+			WithField("trusted", trustedErr).
+			WithField("user", userErr).
+			Warn("backing filesystem supports neither trusted nor user xattrs, overlay mounts may not work")
+	}
+	return verified
+}
+
+// probeXAttr writes attr on the file at path and checks that it reads back the same value.
+func probeXAttr(path, attr string, x xattrFuncs) error {
+	value := []byte("soci")
+	if err := x.set(path, attr, value, 0); err != nil {
+		return err
+	}
+	buf := make([]byte, len(value))
+	n, err := x.get(path, attr, buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:n], value) {
+		return fmt.Errorf("xattr %s read back as %q; expected %q", attr, buf[:n], value)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// restrictedXAttrs simulates a filesystem that only supports xattrs in some namespaces.
+func restrictedXAttrs(namespaces ...string) xattrFuncs {
+	attrs := make(map[string][]byte)
+	supported := func(attr string) bool {
+		for _, ns := range namespaces {
+			if strings.HasPrefix(attr, ns+".") {
+				return true
+			}
+		}
+		return false
+	}
+	return xattrFuncs{
+		set: func(path, attr string, data []byte, _ int) error {
+			if !supported(attr) {
+				return unix.EOPNOTSUPP
+			}
+			attrs[path+"/"+attr] = append([]byte(nil), data...)
+			return nil
+		},
+		get: func(path, attr string, dest []byte) (int, error) {
+			data, ok := attrs[path+"/"+attr]
+			if !ok {
+				return 0, unix.ENODATA
+			}
+			return copy(dest, data), nil
+		},
+	}
+}
+
+func TestVerifyUserXAttr(t *testing.T) {
+	tests := []struct {
+		name       string
+		namespaces []string
+		detected   bool
+		expected   bool
+	}{
+		{
+			name:       "trusted only corrects user",
+			namespaces: []string{"trusted"},
+			detected:   true,
+			expected:   false,
+		},
+		{
+			name:       "user only corrects trusted",
+			namespaces: []string{"user"},
+			detected:   false,
+			expected:   true,
+		},
+		{
+			name:       "both keep trusted",
+			namespaces: []string{"trusted", "user"},
+			detected:   false,
+			expected:   false,
+		},
+		{
+			name:       "both keep user",
+			namespaces: []string{"trusted", "user"},
+			detected:   true,
+			expected:   true,
+		},
+		{
+			name:     "neither keeps detection",
+			detected: true,
+			expected: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root := t.TempDir()
+			got := verifyUserXAttr(context.TODO(), root, tc.detected, restrictedXAttrs(tc.namespaces...))
+			if got != tc.expected {
+				t.Fatalf("expected userxattr to be %v; got %v", tc.expected, got)
+			}
+			entries, err := os.ReadDir(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("expected probe file to be removed; got %d entries", len(entries))
+			}
+		})
+	}
+}
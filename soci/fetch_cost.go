@@ -0,0 +1,153 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// FetchProfile describes how a workload accesses the files of a lazily loaded image.
+type FetchProfile int
+
+const (
+	// FetchProfileColdStart models a workload that only touches its entrypoint
+	// dependencies on startup. It is approximated as all executables and
+	// shared libraries in the image.
+	FetchProfileColdStart FetchProfile = iota
+	// FetchProfileFullMaterialization models a workload that eventually reads
+	// every file in the image, e.g. when the background fetcher runs to completion.
+	FetchProfileFullMaterialization
+)
+
+// ErrUnknownFetchProfile is returned when estimating the fetch cost for an unknown FetchProfile.
+var ErrUnknownFetchProfile = errors.New("unknown fetch profile")
+
+// String returns the name of the FetchProfile.
+func (p FetchProfile) String() string {
+	switch p {
+	case FetchProfileColdStart:
+		return "cold-start"
+	case FetchProfileFullMaterialization:
+		return "full-materialization"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(p))
+	}
+}
+
+// EstimateFetchCost estimates the number of bytes that will be fetched from the
+// registry when the image indexed by the SOCI index described by indexDesc is lazily
+// loaded by a workload with the given profile. The estimate is computed
+// entirely from the SOCI index and its zTOCs in blobStore; no layers are downloaded.
+//
+// The SOCI index is given by its descriptor rather than by an image reference: an image
+// may have several SOCI indexes, e.g. one per platform, and this package doesn't resolve
+// image references. Callers holding a reference resolve it with GetIndexDescriptorCollection.
+//
+// Layers without a zTOC are not lazily loaded, so they are not part of the estimate.
+func EstimateFetchCost(ctx context.Context, blobStore store.BasicStore, indexDesc ocispec.Descriptor, profile FetchProfile) (int64, error) {
+	if profile != FetchProfileColdStart && profile != FetchProfileFullMaterialization {
+		return 0, fmt.Errorf("%w: %v", ErrUnknownFetchProfile, profile)
+	}
+
+	rc, err := blobStore.Fetch(ctx, indexDesc)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch SOCI index %v: %w", indexDesc.Digest, err)
+	}
+	var index Index
+	err = DecodeIndex(rc, &index)
+	rc.Close()
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode SOCI index %v: %w", indexDesc.Digest, err)
+	}
+
+	var total int64
+	for _, blob := range index.Blobs {
+		if blob.MediaType != SociLayerMediaType {
+			continue
+		}
+		rc, err := blobStore.Fetch(ctx, blob)
+		if err != nil {
+			return 0, fmt.Errorf("failed to fetch ztoc %v: %w", blob.Digest, err)
+		}
+		toc, err := ztoc.Unmarshal(rc)
+		rc.Close()
+		if err != nil {
+			return 0, fmt.Errorf("failed to unmarshal ztoc %v: %w", blob.Digest, err)
+		}
+		cost, err := estimateZtocFetchCost(toc, profile)
+		if err != nil {
+			return 0, fmt.Errorf("failed to estimate fetch cost of ztoc %v: %w", blob.Digest, err)
+		}
+		total += cost
+	}
+	return total, nil
+}
+
+// estimateZtocFetchCost estimates the number of compressed bytes fetched from a single
+// layer by summing the compressed size of every span that contains data of a file
+// touched by profile.
+func estimateZtocFetchCost(toc *ztoc.Ztoc, profile FetchProfile) (int64, error) {
+	if profile == FetchProfileFullMaterialization {
+		return int64(toc.CompressedArchiveSize), nil
+	}
+
+	zinfo, err := toc.Zinfo()
+	if err != nil {
+		return 0, err
+	}
+	defer zinfo.Close()
+
+	spans := make(map[compression.SpanID]struct{})
+	for _, f := range toc.FileMetadata {
+		if f.UncompressedSize == 0 || !touchedOnColdStart(f) {
+			continue
+		}
+		start := zinfo.UncompressedOffsetToSpanID(f.UncompressedOffset)
+		end := zinfo.UncompressedOffsetToSpanID(f.UncompressedOffset + f.UncompressedSize - 1)
+		for id := start; id <= end; id++ {
+			spans[id] = struct{}{}
+		}
+	}
+
+	var cost int64
+	for id := range spans {
+		cost += int64(zinfo.EndCompressedOffset(id, toc.CompressedArchiveSize) - zinfo.StartCompressedOffset(id))
+	}
+	return cost, nil
+}
+
+// touchedOnColdStart returns whether a file is expected to be read when a
+// workload starts, i.e. whether it is an executable or a shared library.
+func touchedOnColdStart(f ztoc.FileMetadata) bool {
+	if !f.FileMode().IsRegular() {
+		return false
+	}
+	if f.FileMode().Perm()&0111 != 0 {
+		return true
+	}
+	name := path.Base(f.Name)
+	return strings.HasSuffix(name, ".so") || strings.Contains(name, ".so.")
+}
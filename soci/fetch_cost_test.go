@@ -0,0 +1,131 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestEstimateFetchCost(t *testing.T) {
+	ctx := context.Background()
+	r := testutil.NewTestRand(t)
+	const spanSize = 64 << 10
+
+	ents := []testutil.TarEntry{
+		testutil.File("bin/app", string(r.RandomByteData(200<<10)), testutil.WithFileMode(0755)),
+		testutil.File("data/blob", string(r.RandomByteData(500<<10)), testutil.WithFileMode(0644)),
+		testutil.File("lib/libfoo.so.1", string(r.RandomByteData(50<<10)), testutil.WithFileMode(0644)),
+		testutil.File("data/config", "config", testutil.WithFileMode(0644)),
+	}
+	toc, _, err := ztoc.BuildZtocReader(t, ents, gzip.DefaultCompression, spanSize)
+	if err != nil {
+		t.Fatalf("failed to build ztoc: %v", err)
+	}
+
+	blobStore := NewOrasMemoryStore()
+	ztocReader, ztocDesc, err := ztoc.Marshal(toc)
+	if err != nil {
+		t.Fatalf("failed to marshal ztoc: %v", err)
+	}
+	ztocDesc.MediaType = SociLayerMediaType
+	if err := blobStore.Push(ctx, ztocDesc, ztocReader); err != nil {
+		t.Fatalf("failed to push ztoc: %v", err)
+	}
+
+	index := NewIndex(V2, []ocispec.Descriptor{ztocDesc}, nil, nil)
+	indexBytes, err := MarshalIndex(index)
+	if err != nil {
+		t.Fatalf("failed to marshal index: %v", err)
+	}
+	indexDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(indexBytes),
+		Size:      int64(len(indexBytes)),
+	}
+	if err := blobStore.Push(ctx, indexDesc, bytes.NewReader(indexBytes)); err != nil {
+		t.Fatalf("failed to push index: %v", err)
+	}
+
+	// The cold start estimate should cover exactly the spans containing the
+	// executable and the shared library.
+	zinfo, err := toc.Zinfo()
+	if err != nil {
+		t.Fatalf("failed to get zinfo: %v", err)
+	}
+	defer zinfo.Close()
+	spans := make(map[compression.SpanID]struct{})
+	for _, name := range []string{"bin/app", "lib/libfoo.so.1"} {
+		entry, err := toc.GetMetadataEntry(name)
+		if err != nil {
+			t.Fatalf("failed to get metadata for %s: %v", name, err)
+		}
+		start := zinfo.UncompressedOffsetToSpanID(entry.UncompressedOffset)
+		end := zinfo.UncompressedOffsetToSpanID(entry.UncompressedOffset + entry.UncompressedSize - 1)
+		for id := start; id <= end; id++ {
+			spans[id] = struct{}{}
+		}
+	}
+	var expectedColdStart int64
+	for id := range spans {
+		expectedColdStart += int64(zinfo.EndCompressedOffset(id, toc.CompressedArchiveSize) - zinfo.StartCompressedOffset(id))
+	}
+	if expectedColdStart >= int64(toc.CompressedArchiveSize) {
+		t.Fatalf("expected cold start spans to be a subset of the layer")
+	}
+
+	testCases := []struct {
+		name     string
+		profile  FetchProfile
+		expected int64
+	}{
+		{
+			name:     "cold start fetches spans of executables and shared libraries",
+			profile:  FetchProfileColdStart,
+			expected: expectedColdStart,
+		},
+		{
+			name:     "full materialization fetches the entire layer",
+			profile:  FetchProfileFullMaterialization,
+			expected: int64(toc.CompressedArchiveSize),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			cost, err := EstimateFetchCost(ctx, blobStore, indexDesc, tc.profile)
+			if err != nil {
+				t.Fatalf("failed to estimate fetch cost: %v", err)
+			}
+			if cost != tc.expected {
+				t.Fatalf("expected fetch cost %d; got %d", tc.expected, cost)
+			}
+		})
+	}
+
+	if _, err := EstimateFetchCost(ctx, blobStore, indexDesc, FetchProfile(-1)); !errors.Is(err, ErrUnknownFetchProfile) {
+		t.Fatalf("expected %v for unknown profile; got %v", ErrUnknownFetchProfile, err)
+	}
+}
@@ -0,0 +1,120 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/awslabs/soci-snapshotter/soci/store"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// IndexMetadata is the build-time metadata of a SOCI index.
+type IndexMetadata struct {
+	// Version is the format version of the SOCI index.
+	Version IndexVersion `json:"version"`
+	// BuildToolIdentifier is the tool that built the SOCI index.
+	BuildToolIdentifier string `json:"build_tool"`
+	// SpanSize is the span size used to build every zTOC of the index.
+	// It is 0 if the zTOCs were built with different span sizes.
+	SpanSize int64 `json:"span_size"`
+	// Layers is the metadata of each layer covered by the index.
+	Layers []LayerMetadata `json:"layers"`
+}
+
+// LayerMetadata is the build-time metadata of the zTOC of a single layer.
+type LayerMetadata struct {
+	// LayerDigest is the digest of the image layer.
+	LayerDigest digest.Digest `json:"layer_digest"`
+	// ZtocDigest is the digest of the zTOC of the layer.
+	ZtocDigest digest.Digest `json:"ztoc_digest"`
+	// SpanSize is the span size used to build the zTOC.
+	SpanSize int64 `json:"span_size"`
+	// ZtocVersion is the format version of the zTOC.
+	ZtocVersion ztoc.Version `json:"ztoc_version"`
+	// BuildToolIdentifier is the tool that built the zTOC.
+	BuildToolIdentifier string `json:"build_tool"`
+	// NumSpans is the number of spans of the layer.
+	NumSpans int `json:"num_spans"`
+}
+
+// DescribeIndex returns the build-time metadata of the SOCI index described by indexDesc.
+// The metadata is read entirely from the SOCI index and its zTOCs in blobStore;
+// no layers are downloaded.
+func DescribeIndex(ctx context.Context, blobStore store.BasicStore, indexDesc ocispec.Descriptor) (IndexMetadata, error) {
+	rc, err := blobStore.Fetch(ctx, indexDesc)
+	if err != nil {
+		return IndexMetadata{}, fmt.Errorf("failed to fetch SOCI index %v: %w", indexDesc.Digest, err)
+	}
+	var index Index
+	err = DecodeIndex(rc, &index)
+	rc.Close()
+	if err != nil {
+		return IndexMetadata{}, fmt.Errorf("failed to decode SOCI index %v: %w", indexDesc.Digest, err)
+	}
+
+	md := IndexMetadata{
+		Version:             V1,
+		BuildToolIdentifier: index.Annotations[IndexAnnotationBuildToolIdentifier],
+	}
+	if index.ArtifactType == V2.artifactType {
+		md.Version = V2
+	}
+	for _, blob := range index.Blobs {
+		if blob.MediaType != SociLayerMediaType {
+			continue
+		}
+		var spanSize int64
+		if spanSizeStr, ok := blob.Annotations[IndexAnnotationSociSpanSize]; ok {
+			spanSize, err = strconv.ParseInt(spanSizeStr, 10, 64)
+			if err != nil {
+				return IndexMetadata{}, fmt.Errorf("failed to parse span size from annotations for ztoc %v: %w", blob.Digest, err)
+			}
+		}
+		rc, err := blobStore.Fetch(ctx, blob)
+		if err != nil {
+			return IndexMetadata{}, fmt.Errorf("failed to fetch ztoc %v: %w", blob.Digest, err)
+		}
+		toc, err := ztoc.Unmarshal(rc)
+		rc.Close()
+		if err != nil {
+			return IndexMetadata{}, fmt.Errorf("failed to unmarshal ztoc %v: %w", blob.Digest, err)
+		}
+		md.Layers = append(md.Layers, LayerMetadata{
+			LayerDigest:         digest.Digest(blob.Annotations[IndexAnnotationImageLayerDigest]),
+			ZtocDigest:          blob.Digest,
+			SpanSize:            spanSize,
+			ZtocVersion:         toc.Version,
+			BuildToolIdentifier: toc.BuildToolIdentifier,
+			NumSpans:            int(toc.MaxSpanID) + 1,
+		})
+	}
+
+	for i, l := range md.Layers {
+		if i == 0 {
+			md.SpanSize = l.SpanSize
+		} else if l.SpanSize != md.SpanSize {
+			md.SpanSize = 0
+			break
+		}
+	}
+	return md, nil
+}
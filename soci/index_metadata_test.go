@@ -0,0 +1,146 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/awslabs/soci-snapshotter/ztoc"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestDescribeIndex(t *testing.T) {
+	ctx := context.Background()
+	r := testutil.NewTestRand(t)
+	const buildTool = "test-build-tool"
+
+	testCases := []struct {
+		name             string
+		version          IndexVersion
+		spanSizes        []int64
+		expectedSpanSize int64
+	}{
+		{
+			name:             "v1 index with a single span size",
+			version:          V1,
+			spanSizes:        []int64{64 << 10, 64 << 10},
+			expectedSpanSize: 64 << 10,
+		},
+		{
+			name:             "v2 index with a single span size",
+			version:          V2,
+			spanSizes:        []int64{128 << 10},
+			expectedSpanSize: 128 << 10,
+		},
+		{
+			name:             "index with mixed span sizes",
+			version:          V2,
+			spanSizes:        []int64{64 << 10, 128 << 10},
+			expectedSpanSize: 0,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// The blob store only contains the index and its zTOCs, so
+			// describing the index must not fetch any layer.
+			blobStore := NewOrasMemoryStore()
+			var (
+				blobs    []ocispec.Descriptor
+				expected = IndexMetadata{
+					Version:             tc.version,
+					BuildToolIdentifier: buildTool,
+					SpanSize:            tc.expectedSpanSize,
+				}
+			)
+			for _, spanSize := range tc.spanSizes {
+				ents := []testutil.TarEntry{
+					testutil.File("data", string(r.RandomByteData(3*spanSize))),
+				}
+				toc, _, err := ztoc.BuildZtocReader(t, ents, gzip.DefaultCompression, spanSize)
+				if err != nil {
+					t.Fatalf("failed to build ztoc: %v", err)
+				}
+				ztocReader, ztocDesc, err := ztoc.Marshal(toc)
+				if err != nil {
+					t.Fatalf("failed to marshal ztoc: %v", err)
+				}
+				ztocDesc.MediaType = SociLayerMediaType
+				layerDigest := digest.FromBytes(r.RandomByteData(16))
+				ztocDesc.Annotations = map[string]string{
+					IndexAnnotationImageLayerMediaType: ocispec.MediaTypeImageLayerGzip,
+					IndexAnnotationImageLayerDigest:    layerDigest.String(),
+					IndexAnnotationSociSpanSize:        strconv.FormatInt(spanSize, 10),
+				}
+				if err := blobStore.Push(ctx, ztocDesc, ztocReader); err != nil {
+					t.Fatalf("failed to push ztoc: %v", err)
+				}
+				blobs = append(blobs, ztocDesc)
+				expected.Layers = append(expected.Layers, LayerMetadata{
+					LayerDigest:         layerDigest,
+					ZtocDigest:          ztocDesc.Digest,
+					SpanSize:            spanSize,
+					ZtocVersion:         toc.Version,
+					BuildToolIdentifier: toc.BuildToolIdentifier,
+					NumSpans:            int(toc.MaxSpanID) + 1,
+				})
+			}
+
+			index := NewIndex(tc.version, blobs, nil, map[string]string{
+				IndexAnnotationBuildToolIdentifier: buildTool,
+			})
+			indexBytes, err := MarshalIndex(index)
+			if err != nil {
+				t.Fatalf("failed to marshal index: %v", err)
+			}
+			indexDesc := ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    digest.FromBytes(indexBytes),
+				Size:      int64(len(indexBytes)),
+			}
+			if err := blobStore.Push(ctx, indexDesc, bytes.NewReader(indexBytes)); err != nil {
+				t.Fatalf("failed to push index: %v", err)
+			}
+
+			md, err := DescribeIndex(ctx, blobStore, indexDesc)
+			if err != nil {
+				t.Fatalf("failed to describe index: %v", err)
+			}
+			if diff := cmp.Diff(expected, md, cmp.Comparer(func(a, b IndexVersion) bool {
+				return a.String() == b.String()
+			})); diff != "" {
+				t.Fatalf("unexpected index metadata (-want +got):\n%s", diff)
+			}
+			b, err := json.Marshal(md)
+			if err != nil {
+				t.Fatalf("failed to marshal index metadata: %v", err)
+			}
+			if expected := fmt.Sprintf(`"version":%q`, tc.version); !strings.Contains(string(b), expected) {
+				t.Fatalf("expected index metadata JSON to contain %s; got %s", expected, b)
+			}
+		})
+	}
+}
@@ -18,12 +18,15 @@ package soci
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -128,6 +131,16 @@ type IndexVersion struct {
 	configDescriptor ocispec.Descriptor
 }
 
+// String returns the name of the IndexVersion, e.g. "v2".
+func (v IndexVersion) String() string {
+	return v.version
+}
+
+// MarshalText encodes the IndexVersion as its name, e.g. "v2".
+func (v IndexVersion) MarshalText() ([]byte, error) {
+	return []byte(v.version), nil
+}
+
 var (
 	V1 = IndexVersion{
 		version:          "v1",
@@ -139,8 +152,55 @@ var (
 		artifactType:     SociIndexArtifactTypeV2,
 		configDescriptor: defaultConfigDescriptorV2,
 	}
+
+	// SupportedIndexVersions are the index versions this snapshotter understands, oldest first.
+	SupportedIndexVersions = []IndexVersion{V1, V2}
+
+	// indexArtifactTypeRegexp matches the artifact type of a SOCI index of any version,
+	// including versions newer than the supported ones.
+	indexArtifactTypeRegexp = regexp.MustCompile(`^application/vnd\.amazon\.soci\.index\.v[0-9]+\+json$`)
 )
 
+// ParseIndexVersion returns the supported index version named version, e.g. "v2".
+func ParseIndexVersion(version string) (IndexVersion, error) {
+	for _, v := range SupportedIndexVersions {
+		if v.version == version {
+			return v, nil
+		}
+	}
+	return IndexVersion{}, fmt.Errorf("unsupported SOCI index version %q", version)
+}
+
+// IndexVersionOf returns the supported index version of SOCI indices with artifactType.
+// It returns false if artifactType isn't the artifact type of a supported index version.
+func IndexVersionOf(artifactType string) (IndexVersion, bool) {
+	for _, v := range SupportedIndexVersions {
+		if v.artifactType == artifactType {
+			return v, true
+		}
+	}
+	return IndexVersion{}, false
+}
+
+// IsIndexArtifactType returns whether artifactType is the artifact type of a SOCI index
+// of any version, including versions this snapshotter doesn't support yet.
+func IsIndexArtifactType(artifactType string) bool {
+	return indexArtifactTypeRegexp.MatchString(artifactType)
+}
+
+// Compare returns -1, 0 or +1 depending on whether v is older than, the same as
+// or newer than other.
+func (v IndexVersion) Compare(other IndexVersion) int {
+	return cmp.Compare(v.rank(), other.rank())
+}
+
+// rank returns the position of v in SupportedIndexVersions.
+func (v IndexVersion) rank() int {
+	return slices.IndexFunc(SupportedIndexVersions, func(s IndexVersion) bool {
+		return s.version == v.version
+	})
+}
+
 // Index represents a SOCI index manifest.
 type Index struct {
 	// MediaType represents the type of document into which the SOCI index manifest will be serialized
@@ -44,7 +44,10 @@ import (
 // reference counts of contents and calls OnEvicted when nobody refers to the evicted contents.
 type Cache struct {
 	cache *lru.Cache
-	mu    sync.Mutex
+	// entries indexes the contents of cache by key, so that they can be peeked at
+	// without updating their recency.
+	entries map[string]*refCounter
+	mu      sync.Mutex
 
 	// OnEvicted optionally specifies a callback function to be
 	// executed when an entry is purged from the cache.
@@ -53,15 +56,17 @@ type Cache struct {
 
 // New creates new cache.
 func New(maxEntries int) *Cache {
-	inner := lru.New(maxEntries)
-	inner.OnEvicted = func(key lru.Key, value interface{}) {
+	c := &Cache{
+		cache:   lru.New(maxEntries),
+		entries: make(map[string]*refCounter),
+	}
+	c.cache.OnEvicted = func(key lru.Key, value interface{}) {
+		delete(c.entries, key.(string))
 		// Decrease the ref count incremented in Add().
 		// When nobody refers to this value, this value will be finalized via refCounter.
 		value.(*refCounter).finalize()
 	}
-	return &Cache{
-		cache: inner,
-	}
+	return c
 }
 
 // Get retrieves the specified object from the cache and increments the reference counter of the
@@ -79,6 +84,19 @@ func (c *Cache) Get(key string) (value interface{}, done func(), ok bool) {
 	return rc.v, c.decreaseOnceFunc(rc), true
 }
 
+// Peek is like Get but doesn't mark the content as recently used, so that inspecting the
+// cache doesn't change which contents are evicted first.
+func (c *Cache) Peek(key string) (value interface{}, done func(), ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rc, ok := c.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+	rc.inc()
+	return rc.v, c.decreaseOnceFunc(rc), true
+}
+
 // Add adds object to the cache and returns the cached contents with incrementing the reference count.
 // If the specified content already exists in the cache, this sets `added` to false and returns
 // "already cached" content (i.e. doesn't replace the content with the new one). Client must call
@@ -99,6 +117,7 @@ func (c *Cache) Add(key string, value interface{}) (cachedValue interface{}, don
 	rc.initialize() // Keep this object having at least 1 ref count (will be decreased in OnEviction)
 	rc.inc()        // The client references this object (will be decreased on "done")
 	c.cache.Add(key, rc)
+	c.entries[key] = rc
 	return rc.v, c.decreaseOnceFunc(rc), true
 }
 
@@ -110,6 +129,27 @@ func (c *Cache) Remove(key string) {
 	c.cache.Remove(key)
 }
 
+// RemoveUnused removes the specified contents from the cache only if nobody refers to it.
+// OnEvicted callback is called synchronously before this returns. The returned value is the
+// removed content and `removed` is false if the content doesn't exist or is still referenced.
+func (c *Cache) RemoveUnused(key string) (value interface{}, removed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	o, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	rc := o.(*refCounter)
+	rc.mu.Lock()
+	inUse := rc.refCounts > 1 // the cache itself holds one reference
+	rc.mu.Unlock()
+	if inUse {
+		return nil, false
+	}
+	c.cache.Remove(key)
+	return rc.v, true
+}
+
 func (c *Cache) decreaseOnceFunc(rc *refCounter) func() {
 	var once sync.Once
 	return func() {
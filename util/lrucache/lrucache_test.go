@@ -81,6 +81,41 @@ func TestGet(t *testing.T) {
 	}
 }
 
+func TestPeek(t *testing.T) {
+	var evicted []string
+	c := New(2)
+	c.OnEvicted = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+	key1, value1 := "key1", "abcd1"
+	key2, value2 := "key2", "abcd2"
+	_, done1, _ := c.Add(key1, value1)
+	done1()
+	_, done2, _ := c.Add(key2, value2)
+	done2()
+
+	v, done, ok := c.Peek(key1)
+	if !ok {
+		t.Errorf("failed to peek obj %q (%q)", key1, value1)
+		return
+	} else if v.(string) != value1 {
+		t.Errorf("unexpected object for %q; want %q; got %q", key1, value1, v.(string))
+		return
+	}
+	done()
+
+	// Peeking at key1 must not have made it more recently used than key2.
+	_, done3, _ := c.Add("key3", "abcd3")
+	done3()
+	if len(evicted) != 1 || evicted[0] != key1 {
+		t.Errorf("%q must be evicted but got %v", key1, evicted)
+		return
+	}
+	if _, _, ok := c.Peek(key1); ok {
+		t.Errorf("evicted obj %q must not be peeked", key1)
+	}
+}
+
 func TestRemove(t *testing.T) {
 	var evicted []string
 	c := New(2)
@@ -114,6 +149,50 @@ func TestRemove(t *testing.T) {
 	}
 }
 
+func TestRemoveUnused(t *testing.T) {
+	var evicted []string
+	c := New(10)
+	c.OnEvicted = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+	key1, value1 := "key1", "abcd1"
+	key2, value2 := "key2", "abcd2"
+	_, done1, _ := c.Add(key1, value1)
+	_, done2, _ := c.Add(key2, value2)
+	done2()
+
+	if _, removed := c.RemoveUnused(key1); removed {
+		t.Errorf("referenced content %q must not be removed", key1)
+		return
+	}
+	if _, _, ok := c.Get(key1); !ok {
+		t.Errorf("referenced content %q must remain in the cache", key1)
+		return
+	}
+
+	v, removed := c.RemoveUnused(key2)
+	if !removed {
+		t.Errorf("unreferenced content %q must be removed", key2)
+		return
+	} else if v.(string) != value2 {
+		t.Errorf("unexpected removed object for %q; want %q; got %q", key2, value2, v.(string))
+		return
+	}
+	if len(evicted) != 1 || evicted[0] != key2 {
+		t.Errorf("content %q must be evicted synchronously; got %v", key2, evicted)
+		return
+	}
+	if _, _, ok := c.Get(key2); ok {
+		t.Errorf("removed content %q must not be in the cache", key2)
+		return
+	}
+
+	if _, removed := c.RemoveUnused("unknown"); removed {
+		t.Errorf("unknown content must not be removed")
+	}
+	done1()
+}
+
 func TestEviction(t *testing.T) {
 	var evicted []string
 	c := New(2)
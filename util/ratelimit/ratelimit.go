@@ -0,0 +1,71 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ratelimit provides KeyedLimiter that limits the rate of events
+// separately for each key, e.g. requests to each host.
+package ratelimit
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// KeyedLimiter limits the rate of events of each key with a rate.Limiter of its own.
+// Events over the limit wait until they are allowed.
+type KeyedLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// NewKeyedLimiter returns a KeyedLimiter allowing perSec events per second for each key,
+// with bursts of up to burst events. A burst <= 0 allows a single event at a time.
+// If perSec <= 0, events aren't limited and nil is returned.
+func NewKeyedLimiter(perSec float64, burst int) *KeyedLimiter {
+	if perSec <= 0 {
+		return nil
+	}
+	return &KeyedLimiter{
+		limit:    rate.Limit(perSec),
+		burst:    max(burst, 1),
+		limiters: make(map[string]*rate.Limiter),
+	}
+}
+
+// Wait waits until an event of key is allowed or ctx is done.
+// A nil KeyedLimiter allows every event.
+func (l *KeyedLimiter) Wait(ctx context.Context, key string) error {
+	if l == nil {
+		return nil
+	}
+	return l.limiter(key).Wait(ctx)
+}
+
+// limiter returns the rate limiter of key.
+func (l *KeyedLimiter) limiter(key string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lim, ok := l.limiters[key]
+	if !ok {
+		lim = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[key] = lim
+	}
+	return lim
+}
@@ -0,0 +1,59 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestKeyedLimiter(t *testing.T) {
+	l := NewKeyedLimiter(0.01, 1)
+	if err := l.Wait(context.Background(), "a"); err != nil {
+		t.Fatalf("expected the first event to be allowed, got %v", err)
+	}
+
+	// Other keys have their own limit, so they aren't held up by the first one.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l.Wait(ctx, "b"); err != nil {
+		t.Fatalf("expected the first event of another key to be allowed, got %v", err)
+	}
+	if err := l.Wait(ctx, "a"); err == nil {
+		t.Fatalf("expected the second event to wait for the limit")
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Wait(cancelled, "c"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected waiting with a cancelled context to fail with %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestNilKeyedLimiter(t *testing.T) {
+	l := NewKeyedLimiter(0, 1)
+	if l != nil {
+		t.Fatalf("expected no limiter for a rate of 0, got %v", l)
+	}
+	for range 10 {
+		if err := l.Wait(context.Background(), "a"); err != nil {
+			t.Fatalf("expected events to be allowed, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
+	ztoc_flatbuffers "github.com/awslabs/soci-snapshotter/ztoc/fbs/ztoc"
+	"golang.org/x/sys/unix"
+)
+
+// mappedTOC is a TOC whose file metadata is deserialized from a memory-mapped ztoc as it's iterated.
+type mappedTOC struct {
+	flatbuf []byte
+	fbtoc   *ztoc_flatbuffers.TOC
+	// order holds the indices of the file metadata in fbtoc, sorted by uncompressed offset.
+	order []int
+}
+
+// newMappedTOC returns the TOC serialized as fbtoc in the mapping flatbuf. Like flatbufferToTOC,
+// it fails if the file metadata overlap, so that iterating the TOC can't.
+func newMappedTOC(flatbuf []byte, fbtoc *ztoc_flatbuffers.TOC) (*mappedTOC, error) {
+	n := fbtoc.MetadataLength()
+	offsets := make([]compression.Offset, n)
+	order := make([]int, n)
+	metadataEntry := new(ztoc_flatbuffers.FileMetadata)
+	for i := 0; i < n; i++ {
+		fbtoc.Metadata(metadataEntry, i)
+		offsets[i] = compression.Offset(metadataEntry.UncompressedOffset())
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return offsets[order[i]] < offsets[order[j]]
+	})
+
+	nextTarHeader := compression.Offset(0)
+	for _, i := range order {
+		if nextTarHeader > offsets[i] {
+			return nil, ErrInvalidTOCEntry
+		}
+		fbtoc.Metadata(metadataEntry, i)
+		nextTarHeader = AlignToTarBlock(offsets[i] + compression.Offset(metadataEntry.UncompressedSize()))
+	}
+	return &mappedTOC{flatbuf: flatbuf, fbtoc: fbtoc, order: order}, nil
+}
+
+// entries calls fn with the file metadata of the TOC in chunks of n entries, reusing the chunk.
+func (m *mappedTOC) entries(n int, fn func([]FileMetadata) error) error {
+	if n <= 0 || n > len(m.order) {
+		n = len(m.order)
+	}
+	chunk := make([]FileMetadata, 0, n)
+	// The first tar header is at offset 0
+	nextTarHeader := compression.Offset(0)
+	for start := 0; start < len(m.order); start += n {
+		var err error
+		chunk, nextTarHeader, err = m.decode(chunk[:0], m.order[start:min(start+n, len(m.order))], nextTarHeader)
+		if err != nil {
+			return err
+		}
+		if err := fn(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decode appends the file metadata at indices to chunk, given the offset of the tar header of the
+// first one, and returns the offset of the tar header following the last one.
+func (m *mappedTOC) decode(chunk []FileMetadata, indices []int, nextTarHeader compression.Offset) (_ []FileMetadata, _ compression.Offset, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("cannot unmarshal ztoc: %v", r)
+		}
+	}()
+	metadataEntry := new(ztoc_flatbuffers.FileMetadata)
+	for _, i := range indices {
+		m.fbtoc.Metadata(metadataEntry, i)
+		me := flatbufferToFileMetadata(metadataEntry)
+		me.TarHeaderOffset = nextTarHeader
+		// The next tar header can be found immediately after the current file + padding
+		nextTarHeader = AlignToTarBlock(me.UncompressedOffset + me.UncompressedSize)
+		chunk = append(chunk, me)
+	}
+	return chunk, nextTarHeader, nil
+}
+
+func (m *mappedTOC) unmap() error {
+	return unix.Munmap(m.flatbuf)
+}
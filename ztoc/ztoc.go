@@ -67,6 +67,47 @@ type CompressionInfo struct {
 // data (e.g., a gzip tar file).
 type TOC struct {
 	FileMetadata []FileMetadata
+	// mapped holds the file metadata instead of FileMetadata if the TOC was unmarshaled with UnmarshalFile.
+	mapped *mappedTOC
+}
+
+// Len returns the number of files in the TOC.
+func (toc *TOC) Len() int {
+	if toc.mapped != nil {
+		return len(toc.mapped.order)
+	}
+	return len(toc.FileMetadata)
+}
+
+// Entries calls fn with the metadata of the files in the TOC, sorted by offset, in chunks
+// of at most n entries, or all of them if n isn't positive. If the TOC was unmarshaled with
+// UnmarshalFile, each chunk is only deserialized when it's passed to fn and is reused
+// afterwards, so fn must not retain it.
+func (toc *TOC) Entries(n int, fn func([]FileMetadata) error) error {
+	if toc.mapped != nil {
+		return toc.mapped.entries(n, fn)
+	}
+	if n <= 0 {
+		n = len(toc.FileMetadata)
+	}
+	for start := 0; start < len(toc.FileMetadata); start += n {
+		if err := fn(toc.FileMetadata[start:min(start+n, len(toc.FileMetadata))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release drops the file metadata of the TOC, e.g. once they're stored elsewhere, and
+// unmaps the ztoc if it was unmarshaled with UnmarshalFile.
+func (toc *TOC) Release() error {
+	toc.FileMetadata = nil
+	if toc.mapped == nil {
+		return nil
+	}
+	mapped := toc.mapped
+	toc.mapped = nil
+	return mapped.unmap()
 }
 
 // FileMetadata contains metadata of a file in the compressed data.
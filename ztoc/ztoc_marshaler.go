@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"sort"
 	"strings"
 	"time"
@@ -30,6 +31,7 @@ import (
 	flatbuffers "github.com/google/flatbuffers/go"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
 )
 
 var ErrInvalidTOCEntry = errors.New("invalid toc entry")
@@ -62,7 +64,43 @@ func Unmarshal(serializedZtoc io.Reader) (*Ztoc, error) {
 	return flatbufToZtoc(flatbuf)
 }
 
-func flatbufToZtoc(flatbuffer []byte) (z *Ztoc, err error) {
+// UnmarshalFile deserializes the ztoc serialized in f. Unlike Unmarshal, the serialized
+// ztoc is memory-mapped instead of being read into memory, and the file metadata of its
+// TOC is only deserialized as it's iterated with TOC.Entries, so the TOC of large layers
+// is never held on the heap at once. The ztoc must be released with TOC.Release once its
+// TOC isn't needed anymore; the mapping outlives f.
+func UnmarshalFile(f *os.File) (*Ztoc, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return nil, fmt.Errorf("cannot unmarshal ztoc: empty file")
+	}
+	flatbuf, err := unix.Mmap(int(f.Fd()), 0, int(fi.Size()), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("cannot mmap ztoc: %w", err)
+	}
+	ztoc, err := unmarshalFlatbuf(flatbuf, func(fbtoc *ztoc_flatbuffers.TOC) (TOC, error) {
+		mapped, err := newMappedTOC(flatbuf, fbtoc)
+		if err != nil {
+			return TOC{}, err
+		}
+		return TOC{mapped: mapped}, nil
+	})
+	if err != nil {
+		unix.Munmap(flatbuf)
+		return nil, err
+	}
+	return ztoc, nil
+}
+
+func flatbufToZtoc(flatbuffer []byte) (*Ztoc, error) {
+	return unmarshalFlatbuf(flatbuffer, flatbufferToTOC)
+}
+
+// unmarshalFlatbuf deserializes the ztoc serialized in flatbuffer, whose TOC is deserialized by toTOC.
+func unmarshalFlatbuf(flatbuffer []byte, toTOC func(*ztoc_flatbuffers.TOC) (TOC, error)) (z *Ztoc, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			z = nil
@@ -82,7 +120,7 @@ func flatbufToZtoc(flatbuffer []byte) (z *Ztoc, err error) {
 	fbtoc := new(ztoc_flatbuffers.TOC)
 	ztocFlatbuf.Toc(fbtoc)
 
-	toc, err := flatbufferToTOC(fbtoc)
+	toc, err := toTOC(fbtoc)
 	if err != nil {
 		return nil, err
 	}
@@ -113,32 +151,7 @@ func flatbufferToTOC(fbtoc *ztoc_flatbuffers.TOC) (TOC, error) {
 	for i := 0; i < fbtoc.MetadataLength(); i++ {
 		metadataEntry := new(ztoc_flatbuffers.FileMetadata)
 		fbtoc.Metadata(metadataEntry, i)
-		var me FileMetadata
-		me.Name = string(metadataEntry.Name())
-		me.Type = string(metadataEntry.Type())
-		me.UncompressedOffset = compression.Offset(metadataEntry.UncompressedOffset())
-		me.UncompressedSize = compression.Offset(metadataEntry.UncompressedSize())
-		me.Linkname = string(metadataEntry.Linkname())
-		me.Mode = metadataEntry.Mode()
-		me.UID = int(metadataEntry.Uid())
-		me.GID = int(metadataEntry.Gid())
-		me.Uname = string(metadataEntry.Uname())
-		me.Gname = string(metadataEntry.Gname())
-		modTime := new(time.Time)
-		modTime.UnmarshalText(metadataEntry.ModTime())
-		me.ModTime = *modTime
-		me.Devmajor = metadataEntry.Devmajor()
-		me.Devminor = metadataEntry.Devminor()
-		me.PAXHeaders = make(map[string]string)
-		for j := 0; j < metadataEntry.XattrsLength(); j++ {
-			xattrEntry := new(ztoc_flatbuffers.Xattr)
-			metadataEntry.Xattrs(xattrEntry, j)
-			key := string(xattrEntry.Key())
-			value := string(xattrEntry.Value())
-			me.PAXHeaders[key] = value
-		}
-
-		toc.FileMetadata[i] = me
+		toc.FileMetadata[i] = flatbufferToFileMetadata(metadataEntry)
 	}
 
 	sort.Slice(toc.FileMetadata, func(i, j int) bool {
@@ -161,6 +174,36 @@ func flatbufferToTOC(fbtoc *ztoc_flatbuffers.TOC) (TOC, error) {
 	return toc, nil
 }
 
+// flatbufferToFileMetadata deserializes metadataEntry, except for its TarHeaderOffset,
+// which depends on the entry preceding it in the TAR archive.
+func flatbufferToFileMetadata(metadataEntry *ztoc_flatbuffers.FileMetadata) FileMetadata {
+	var me FileMetadata
+	me.Name = string(metadataEntry.Name())
+	me.Type = string(metadataEntry.Type())
+	me.UncompressedOffset = compression.Offset(metadataEntry.UncompressedOffset())
+	me.UncompressedSize = compression.Offset(metadataEntry.UncompressedSize())
+	me.Linkname = string(metadataEntry.Linkname())
+	me.Mode = metadataEntry.Mode()
+	me.UID = int(metadataEntry.Uid())
+	me.GID = int(metadataEntry.Gid())
+	me.Uname = string(metadataEntry.Uname())
+	me.Gname = string(metadataEntry.Gname())
+	modTime := new(time.Time)
+	modTime.UnmarshalText(metadataEntry.ModTime())
+	me.ModTime = *modTime
+	me.Devmajor = metadataEntry.Devmajor()
+	me.Devminor = metadataEntry.Devminor()
+	me.PAXHeaders = make(map[string]string)
+	for j := 0; j < metadataEntry.XattrsLength(); j++ {
+		xattrEntry := new(ztoc_flatbuffers.Xattr)
+		metadataEntry.Xattrs(xattrEntry, j)
+		key := string(xattrEntry.Key())
+		value := string(xattrEntry.Value())
+		me.PAXHeaders[key] = value
+	}
+	return me
+}
+
 func ztocToFlatbuffer(ztoc *Ztoc) (fb []byte, err error) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -17,9 +17,17 @@
 package ztoc
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/ztoc/compression"
 	ztoc_flatbuffers "github.com/awslabs/soci-snapshotter/ztoc/fbs/ztoc"
 	flatbuffers "github.com/google/flatbuffers/go"
 )
@@ -36,6 +44,19 @@ func roundtrip(toc *TOC) (TOC, error) {
 	return flatbufferToTOC(fbtoc)
 }
 
+func mappedRoundtrip(toc *TOC) (TOC, error) {
+	builder := flatbuffers.NewBuilder(0)
+	tocFB := tocToFlatbuffer(toc, builder)
+	builder.Finish(tocFB)
+	bytes := builder.FinishedBytes()
+
+	mapped, err := newMappedTOC(bytes, ztoc_flatbuffers.GetRootAsTOC(bytes, 0))
+	if err != nil {
+		return TOC{}, err
+	}
+	return TOC{mapped: mapped}, nil
+}
+
 func TestPositiveTOCRoundtrip(t *testing.T) {
 	// The two files in this test are aligned like a well-formatted tar file with one
 	// header+data following the other. The offsets/sizes are mostly arbitrary except
@@ -65,13 +86,13 @@ func TestPositiveTOCRoundtrip(t *testing.T) {
 		{
 			name: "serialize -> deserialize produces same toc",
 			toc: TOC{
-				[]FileMetadata{
+				FileMetadata: []FileMetadata{
 					testFile1,
 					testFile2,
 				},
 			},
 			expectedTOC: TOC{
-				[]FileMetadata{
+				FileMetadata: []FileMetadata{
 					testFile1,
 					testFile2,
 				},
@@ -80,13 +101,13 @@ func TestPositiveTOCRoundtrip(t *testing.T) {
 		{
 			name: "files are reordered by uncompressed offset",
 			toc: TOC{
-				[]FileMetadata{
+				FileMetadata: []FileMetadata{
 					testFile2,
 					testFile1,
 				},
 			},
 			expectedTOC: TOC{
-				[]FileMetadata{
+				FileMetadata: []FileMetadata{
 					testFile1,
 					testFile2,
 				},
@@ -139,7 +160,7 @@ func TestNegativeTOCRoundtrip(t *testing.T) {
 		{
 			name: "overlapping files are invalid",
 			toc: TOC{
-				[]FileMetadata{
+				FileMetadata: []FileMetadata{
 					testFile1,
 					overlapTestFile1,
 				},
@@ -150,13 +171,123 @@ func TestNegativeTOCRoundtrip(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			_, err := roundtrip(&tc.toc)
-			if err == nil {
-				t.Fatal("toc deserialization did not produce expected error")
-			}
-			if tc.expectedError != anyError && !errors.Is(err, tc.expectedError) {
-				t.Fatalf("toc deserializtion did not produce the correct error. Actual %v, expected %v", err, tc.expectedError)
+			for _, roundtrip := range []func(*TOC) (TOC, error){roundtrip, mappedRoundtrip} {
+				_, err := roundtrip(&tc.toc)
+				if err == nil {
+					t.Fatal("toc deserialization did not produce expected error")
+				}
+				if tc.expectedError != anyError && !errors.Is(err, tc.expectedError) {
+					t.Fatalf("toc deserializtion did not produce the correct error. Actual %v, expected %v", err, tc.expectedError)
+				}
 			}
 		})
 	}
 }
+
+func TestUnmarshalFile(t *testing.T) {
+	// A synthetic ztoc of a layer with many small files, where each file is
+	// a 512 byte tar header followed by 512 bytes of data.
+	const numFiles = 50000
+	toc := TOC{FileMetadata: make([]FileMetadata, numFiles)}
+	for i := range toc.FileMetadata {
+		toc.FileMetadata[i] = FileMetadata{
+			Name:               fmt.Sprintf("usr/share/dir%d/file%d", i/100, i),
+			Type:               "reg",
+			UncompressedOffset: compression.Offset(i*1024 + 512),
+			UncompressedSize:   512,
+			Mode:               0644,
+		}
+	}
+	z := &Ztoc{
+		TOC:                     toc,
+		Version:                 Version09,
+		CompressedArchiveSize:   numFiles * 1024,
+		UncompressedArchiveSize: numFiles * 1024,
+		CompressionInfo: CompressionInfo{
+			Checkpoints:          []byte("checkpoints"),
+			CompressionAlgorithm: compression.Gzip,
+		},
+	}
+	r, _, err := Marshal(z)
+	if err != nil {
+		t.Fatalf("failed to marshal ztoc: %v", err)
+	}
+	serialized, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read serialized ztoc: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "ztoc")
+	if err := os.WriteFile(path, serialized, 0600); err != nil {
+		t.Fatalf("failed to write serialized ztoc: %v", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open serialized ztoc: %v", err)
+	}
+	defer f.Close()
+
+	// allocated returns the number of bytes allocated on the heap by fn.
+	allocated := func(fn func()) uint64 {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		fn()
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	var inMemory, mapped *Ztoc
+	inMemoryAlloc := allocated(func() {
+		inMemory, err = Unmarshal(bytes.NewReader(serialized))
+	})
+	if err != nil {
+		t.Fatalf("failed to unmarshal ztoc: %v", err)
+	}
+	mappedAlloc := allocated(func() {
+		mapped, err = UnmarshalFile(f)
+	})
+	if err != nil {
+		t.Fatalf("failed to unmarshal memory-mapped ztoc: %v", err)
+	}
+
+	defer mapped.Release()
+
+	if mapped.Len() != numFiles {
+		t.Fatalf("expected memory-mapped ztoc to have %d files; got %d", numFiles, mapped.Len())
+	}
+	var entries []FileMetadata
+	err = mapped.Entries(1000, func(chunk []FileMetadata) error {
+		if len(chunk) != 1000 {
+			t.Fatalf("expected chunks of 1000 files; got %d", len(chunk))
+		}
+		entries = append(entries, chunk...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to iterate memory-mapped ztoc: %v", err)
+	}
+	if !reflect.DeepEqual(inMemory.FileMetadata, entries) {
+		t.Fatalf("files of memory-mapped ztoc differ from ztoc unmarshaled in memory")
+	}
+	if err := mapped.Release(); err != nil {
+		t.Fatalf("failed to release memory-mapped ztoc: %v", err)
+	}
+	inMemory.TOC = TOC{}
+	if !reflect.DeepEqual(inMemory, mapped) {
+		t.Fatalf("memory-mapped ztoc differs from ztoc unmarshaled in memory")
+	}
+	// Unmarshal copies the serialized ztoc to the heap and deserializes every file, whereas
+	// UnmarshalFile only indexes the files until they're iterated.
+	if mappedAlloc*4 > inMemoryAlloc {
+		t.Fatalf("expected unmarshaling a memory-mapped ztoc to allocate at most %d bytes; allocated %d bytes",
+			inMemoryAlloc/4, mappedAlloc)
+	}
+
+	empty, err := os.Create(filepath.Join(t.TempDir(), "empty"))
+	if err != nil {
+		t.Fatalf("failed to create empty file: %v", err)
+	}
+	defer empty.Close()
+	if _, err := UnmarshalFile(empty); err == nil {
+		t.Fatalf("expected unmarshaling an empty file to fail")
+	}
+}